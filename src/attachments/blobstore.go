@@ -0,0 +1,59 @@
+// src/attachments/blobstore.go
+
+// Package attachments stores attachment blobs, which clients encrypt
+// before uploading. Uploads arrive in numbered chunks that can come in any
+// order and be sent again, so a client on a flaky connection resumes from
+// the chunks the server is missing instead of starting over. Once every
+// chunk is in, they are assembled into one blob and checked against the
+// digest the client declared up front.
+package attachments
+
+import (
+	"context"
+	"errors"
+	"io"
+	"regexp"
+)
+
+var (
+	// ErrNotFound means no assembled blob is stored under the ID.
+	ErrNotFound = errors.New("attachment not found")
+	// ErrMissingChunk means Assemble was asked for a chunk never stored.
+	ErrMissingChunk = errors.New("attachment chunk missing")
+	// ErrDigestMismatch means the assembled chunks don't hash to the
+	// declared SHA-256. Nothing is kept.
+	ErrDigestMismatch = errors.New("attachment digest mismatch")
+)
+
+// idPattern is the form of upload IDs: 16 random bytes in hex. Stores
+// refuse anything else, so an ID can't name a path outside the store.
+var idPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// ValidID reports whether id has the form of an upload ID.
+func ValidID(id string) bool {
+	return idPattern.MatchString(id)
+}
+
+// BlobStore holds the chunks of uploads in progress and the blobs they are
+// assembled into. FSStore keeps them on a local disk; an object store can
+// implement it too, e.g. with one object per chunk and a multipart upload
+// to assemble them.
+type BlobStore interface {
+	// PutChunk stores chunk n of upload id, replacing any earlier copy, so
+	// sending a chunk again is harmless.
+	PutChunk(ctx context.Context, id string, n int, data []byte) error
+	// Chunks returns the numbers of the chunks stored for id, in order.
+	Chunks(ctx context.Context, id string) ([]int, error)
+	// Assemble joins chunks 0 to count-1 of id into its blob and drops the
+	// chunks, provided they hash to sum; otherwise it fails with
+	// ErrDigestMismatch and keeps no blob. It returns the blob's size.
+	Assemble(ctx context.Context, id string, count int, sum []byte) (int64, error)
+	// Open returns the assembled blob of id and its size, or ErrNotFound.
+	Open(ctx context.Context, id string) (io.ReadCloser, int64, error)
+	// Delete removes everything stored for id. Deleting an unknown ID is
+	// not an error.
+	Delete(ctx context.Context, id string) error
+	// List returns every ID with anything stored, for finding blobs whose
+	// upload record is gone.
+	List(ctx context.Context) ([]string, error)
+}
@@ -0,0 +1,217 @@
+// src/attachments/fsstore.go
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	chunkPrefix = "chunk-"
+	blobName    = "blob"
+)
+
+// FSStore is a BlobStore in a directory on the local disk. Each upload has
+// a directory named by its ID, holding chunk-000000, chunk-000001, ...
+// until it is assembled into blob. Files are written under a temporary
+// name and renamed into place, so a crash never leaves a partial chunk or
+// blob under its real name.
+type FSStore struct {
+	root string
+}
+
+// NewFSStore returns a store in root, creating the directory if needed.
+func NewFSStore(root string) (*FSStore, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, fmt.Errorf("attachment store: %w", err)
+	}
+	return &FSStore{root: root}, nil
+}
+
+// dir returns the directory of upload id, refusing IDs that aren't.
+func (s *FSStore) dir(id string) (string, error) {
+	if !ValidID(id) {
+		return "", fmt.Errorf("invalid attachment ID %q", id)
+	}
+	return filepath.Join(s.root, id), nil
+}
+
+func chunkName(n int) string {
+	return fmt.Sprintf("%s%06d", chunkPrefix, n)
+}
+
+// writeFile writes data to path through a temporary file in the same
+// directory and renames it into place.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FSStore) PutChunk(ctx context.Context, id string, n int, data []byte) error {
+	dir, err := s.dir(id)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("invalid chunk number %d", n)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, chunkName(n)), data)
+}
+
+func (s *FSStore) Chunks(ctx context.Context, id string) ([]int, error) {
+	dir, err := s.dir(id)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []int{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	chunks := []int{}
+	for _, e := range entries {
+		digits, ok := strings.CutPrefix(e.Name(), chunkPrefix)
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		if n, err := strconv.Atoi(digits); err == nil {
+			chunks = append(chunks, n)
+		}
+	}
+	sort.Ints(chunks)
+	return chunks, nil
+}
+
+func (s *FSStore) Assemble(ctx context.Context, id string, count int, sum []byte) (int64, error) {
+	dir, err := s.dir(id)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, ErrMissingChunk
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	out := io.MultiWriter(tmp, h)
+	var size int64
+	for n := 0; n < count; n++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		written, err := appendFile(out, filepath.Join(dir, chunkName(n)))
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, ErrMissingChunk
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += written
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return 0, ErrDigestMismatch
+	}
+	if err := tmp.Sync(); err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, blobName)); err != nil {
+		return 0, err
+	}
+
+	// The blob is in place; chunks left behind by a failure here only
+	// take up space until the upload is deleted
+	for n := 0; n < count; n++ {
+		os.Remove(filepath.Join(dir, chunkName(n)))
+	}
+	return size, nil
+}
+
+// appendFile copies the file at path to w.
+func appendFile(w io.Writer, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+func (s *FSStore) Open(ctx context.Context, id string) (io.ReadCloser, int64, error) {
+	dir, err := s.dir(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(filepath.Join(dir, blobName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (s *FSStore) Delete(ctx context.Context, id string) error {
+	dir, err := s.dir(id)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (s *FSStore) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() && ValidID(e.Name()) {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
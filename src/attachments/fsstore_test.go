@@ -0,0 +1,174 @@
+// src/attachments/fsstore_test.go
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const testID = "0123456789abcdef0123456789abcdef"
+
+func newTestStore(t *testing.T) *FSStore {
+	t.Helper()
+	s, err := NewFSStore(filepath.Join(t.TempDir(), "attachments"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// split cuts blob into chunks of size bytes, the last one shorter.
+func split(blob []byte, size int) [][]byte {
+	var chunks [][]byte
+	for len(blob) > size {
+		chunks = append(chunks, blob[:size])
+		blob = blob[size:]
+	}
+	return append(chunks, blob)
+}
+
+// TestResumeAfterMissingChunks uploads a blob with its middle chunks lost,
+// checks it can't be assembled, then sends just the missing ones.
+func TestResumeAfterMissingChunks(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	blob := bytes.Repeat([]byte("0123456789"), 100)
+	sum := sha256.Sum256(blob)
+	chunks := split(blob, 128) // 8 chunks, the last of 104 bytes
+
+	for _, n := range []int{0, 1, 5, 6, 7} {
+		if err := s.PutChunk(ctx, testID, n, chunks[n]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := s.Chunks(ctx, testID)
+	if err != nil || !slices.Equal(got, []int{0, 1, 5, 6, 7}) {
+		t.Fatalf("chunks before resuming: %v %v", got, err)
+	}
+	if _, err := s.Assemble(ctx, testID, len(chunks), sum[:]); !errors.Is(err, ErrMissingChunk) {
+		t.Fatalf("assembling with chunks missing: %v", err)
+	}
+
+	for _, n := range []int{2, 3, 4} {
+		if err := s.PutChunk(ctx, testID, n, chunks[n]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size, err := s.Assemble(ctx, testID, len(chunks), sum[:])
+	if err != nil || size != int64(len(blob)) {
+		t.Fatalf("assembling: %d %v", size, err)
+	}
+	if got, _ := s.Chunks(ctx, testID); len(got) != 0 {
+		t.Errorf("chunks left after assembling: %v", got)
+	}
+
+	r, size, err := s.Open(ctx, testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stored, err := io.ReadAll(r)
+	if err != nil || size != int64(len(blob)) || !bytes.Equal(stored, blob) {
+		t.Errorf("read back %d bytes (size %d), %v", len(stored), size, err)
+	}
+}
+
+// TestChunksAreReplaced sends a chunk twice, the second time with other
+// data, and checks only the second copy counts.
+func TestChunksAreReplaced(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	blob := []byte("the right bytes")
+	sum := sha256.Sum256(blob)
+
+	for _, data := range [][]byte{[]byte("the wrong bytes"), blob} {
+		if err := s.PutChunk(ctx, testID, 0, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := s.Chunks(ctx, testID); !slices.Equal(got, []int{0}) {
+		t.Errorf("chunks: %v", got)
+	}
+	if _, err := s.Assemble(ctx, testID, 1, sum[:]); err != nil {
+		t.Errorf("assembling: %v", err)
+	}
+}
+
+func TestDigestMismatch(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	if err := s.PutChunk(ctx, testID, 0, []byte("some bytes")); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("other bytes"))
+	if _, err := s.Assemble(ctx, testID, 1, sum[:]); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("assembling: %v", err)
+	}
+	if _, _, err := s.Open(ctx, testID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("opening after a mismatch: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(s.root, testID))
+	if len(entries) != 1 {
+		t.Errorf("left in the upload's directory: %v", entries)
+	}
+}
+
+func TestDeleteAndList(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	other := "fedcba9876543210fedcba9876543210"
+	for _, id := range []string{testID, other} {
+		if err := s.PutChunk(ctx, id, 0, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not an upload, so neither listed nor touched
+	if err := os.Mkdir(filepath.Join(s.root, "lost+found"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := s.List(ctx)
+	if err != nil || !slices.Equal(ids, []string{testID, other}) {
+		t.Errorf("listing: %v %v", ids, err)
+	}
+	if err := s.Delete(ctx, testID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, testID); err != nil {
+		t.Errorf("deleting twice: %v", err)
+	}
+	if ids, _ := s.List(ctx); !slices.Equal(ids, []string{other}) {
+		t.Errorf("after deleting: %v", ids)
+	}
+	if _, _, err := s.Open(ctx, testID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("opening a deleted upload: %v", err)
+	}
+}
+
+// TestRefusesPaths checks IDs that could name other files are refused
+// before the disk is touched.
+func TestRefusesPaths(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	for _, id := range []string{"", "..", "../" + testID, testID + "/..", "0123456789ABCDEF0123456789ABCDEF", testID[:31]} {
+		if err := s.PutChunk(ctx, id, 0, []byte("x")); err == nil {
+			t.Errorf("stored a chunk under %q", id)
+		}
+		if err := s.Delete(ctx, id); err == nil {
+			t.Errorf("deleted %q", id)
+		}
+		if _, _, err := s.Open(ctx, id); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("opening %q: %v", id, err)
+		}
+	}
+	if err := s.PutChunk(ctx, testID, -1, []byte("x")); err == nil {
+		t.Error("stored chunk -1")
+	}
+}
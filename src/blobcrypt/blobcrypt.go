@@ -0,0 +1,159 @@
+// src/blobcrypt/blobcrypt.go
+
+// Package blobcrypt is the envelope encryption used for blobs at rest.
+// Blobs are sealed with AES-256-GCM under a data key. Data keys are stored
+// in the database wrapped by a master key that is kept out of it, so a
+// database dump on its own yields neither the blobs nor the keys.
+//
+// Blobs are already end-to-end encrypted by clients; this is defence in
+// depth for the stored copy only.
+package blobcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// KeySize is the size of master and data keys in bytes.
+const KeySize = 32
+
+// KeyWrapper wraps and unwraps data keys. LocalWrapper does so with a
+// master key from config; a KMS client can implement it too.
+type KeyWrapper interface {
+	// ID names the master key. It is stored next to each wrapped data key.
+	ID() string
+	Wrap(dataKey []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+var keyIDRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// LocalWrapper wraps data keys with AES-256-GCM under a local master key.
+type LocalWrapper struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewLocalWrapper creates a wrapper for a KeySize-byte master key.
+func NewLocalWrapper(id string, masterKey []byte) (*LocalWrapper, error) {
+	if !keyIDRe.MatchString(id) {
+		return nil, fmt.Errorf("master key id %q must be 1-64 letters, digits, '.', '_' or '-'", id)
+	}
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("master key %s: %v", id, err)
+	}
+	return &LocalWrapper{id: id, aead: aead}, nil
+}
+
+// ParseMasterKey parses "<id>:<base64 key>", the config format.
+func ParseMasterKey(s string) (*LocalWrapper, error) {
+	id, encoded, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return nil, errors.New(`master key must look like "<id>:<base64 key>"`)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("master key %s is not base64", id)
+	}
+	return NewLocalWrapper(id, key)
+}
+
+// ID implements KeyWrapper.
+func (w *LocalWrapper) ID() string {
+	return w.id
+}
+
+// Wrap implements KeyWrapper.
+func (w *LocalWrapper) Wrap(dataKey []byte) ([]byte, error) {
+	return seal(w.aead, dataKey, []byte("blobcrypt data key")), nil
+}
+
+// Unwrap implements KeyWrapper.
+func (w *LocalWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	key, err := open(w.aead, wrapped, []byte("blobcrypt data key"))
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key with master key %s", w.id)
+	}
+	return key, nil
+}
+
+// NewDataKey returns a fresh random data key.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Sealer encrypts and decrypts blobs under one data key.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// NewSealer creates a sealer for a KeySize-byte data key.
+func NewSealer(dataKey []byte) (*Sealer, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// Seal encrypts a blob and returns it as base64 (nonce, then ciphertext).
+// aad binds the result to where it is stored, e.g. the table name.
+func (s *Sealer) Seal(blob, aad string) string {
+	return base64.StdEncoding.EncodeToString(seal(s.aead, []byte(blob), []byte(aad)))
+}
+
+// Open reverses Seal.
+func (s *Sealer) Open(sealed, aad string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", errors.New("sealed blob is not base64")
+	}
+	blob, err := open(s.aead, raw, []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	return string(blob), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext, aad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic("blobcrypt: could not read random nonce: " + err.Error())
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad)
+}
+
+func open(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("sealed blob is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, errors.New("sealed blob failed authentication")
+	}
+	return plaintext, nil
+}
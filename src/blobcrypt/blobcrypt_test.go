@@ -0,0 +1,106 @@
+// src/blobcrypt/blobcrypt_test.go
+package blobcrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestSealerRoundTrip(t *testing.T) {
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSealer(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, blob := range []string{"", "hello", strings.Repeat("x", 100000)} {
+		sealed := s.Seal(blob, "messages")
+		got, err := s.Open(sealed, "messages")
+		if err != nil || got != blob {
+			t.Errorf("%d byte blob: %v", len(blob), err)
+		}
+	}
+	// A fresh nonce each time, so equal blobs don't look equal
+	if s.Seal("hello", "messages") == s.Seal("hello", "messages") {
+		t.Error("sealing twice gave the same result")
+	}
+
+	sealed := s.Seal("hello", "messages")
+	if _, err := s.Open(sealed, "key_backups"); err == nil {
+		t.Error("opened under another table's aad")
+	}
+	other, _ := NewDataKey()
+	otherSealer, _ := NewSealer(other)
+	if _, err := otherSealer.Open(sealed, "messages"); err == nil {
+		t.Error("opened with another data key")
+	}
+	raw, _ := base64.StdEncoding.DecodeString(sealed)
+	raw[len(raw)-1] ^= 1
+	if _, err := s.Open(base64.StdEncoding.EncodeToString(raw), "messages"); err == nil {
+		t.Error("opened a tampered blob")
+	}
+	for _, bad := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := s.Open(bad, "messages"); err == nil {
+			t.Errorf("opened %q", bad)
+		}
+	}
+	if _, err := NewSealer(make([]byte, 16)); err == nil {
+		t.Error("accepted a 16 byte data key")
+	}
+}
+
+func TestLocalWrapper(t *testing.T) {
+	master := bytes.Repeat([]byte{7}, KeySize)
+	w, err := ParseMasterKey(" k2025.a-1:" + base64.StdEncoding.EncodeToString(master) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.ID() != "k2025.a-1" {
+		t.Errorf("id %q", w.ID())
+	}
+
+	dataKey, _ := NewDataKey()
+	wrapped, err := w.Wrap(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(wrapped, dataKey) {
+		t.Error("the wrapped key contains the data key")
+	}
+	got, err := w.Unwrap(wrapped)
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Errorf("unwrapping: %v", err)
+	}
+
+	// Another master key, or a data key sealed as a blob, doesn't unwrap
+	other, _ := NewLocalWrapper("other", bytes.Repeat([]byte{8}, KeySize))
+	if _, err := other.Unwrap(wrapped); err == nil {
+		t.Error("unwrapped with another master key")
+	}
+	sealer, _ := NewSealer(master)
+	asBlob, _ := base64.StdEncoding.DecodeString(sealer.Seal(string(dataKey), ""))
+	if _, err := w.Unwrap(asBlob); err == nil {
+		t.Error("unwrapped a blob sealed with the master key")
+	}
+}
+
+func TestParseMasterKeyRefuses(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, KeySize))
+	for _, bad := range []string{
+		key,             // No id
+		":" + key,       // Empty id
+		"bad id:" + key, // Space in the id
+		strings.Repeat("k", 65) + ":" + key,
+		"k1:not base64!",
+		"k1:" + base64.StdEncoding.EncodeToString(make([]byte, 16)),
+	} {
+		if _, err := ParseMasterKey(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
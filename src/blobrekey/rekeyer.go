@@ -0,0 +1,143 @@
+// src/blobrekey/rekeyer.go
+package blobrekey
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"cryptachat-server/clock"
+	"cryptachat-server/store"
+)
+
+const (
+	// rekeyInterval is how often rows not under the current data key are
+	// looked for.
+	rekeyInterval = time.Hour
+	// rekeyBatch is the number of rows re-sealed per transaction.
+	rekeyBatch = 500
+	// maxBatchesPerPass bounds the work done per interval, so a large
+	// backfill is spread out instead of loading the database all at once.
+	maxBatchesPerPass = 20
+)
+
+// Rekeyer moves blobs onto the current data key: plaintext rows written
+// before encryption was enabled, and rows sealed under a key wrapped by a
+// previous master key. Once nothing uses an old data key it is deleted.
+type Rekeyer struct {
+	store *store.PostgresStore
+	clock clock.Clock
+	after int // Message ID the current pass continues after
+}
+
+// NewRekeyer creates a rekeyer. Several replicas may run one each; rows
+// are claimed with SKIP LOCKED.
+func NewRekeyer(store *store.PostgresStore) *Rekeyer {
+	return &Rekeyer{
+		store: store,
+		clock: clock.Real,
+	}
+}
+
+// SetClock replaces the rekeyer's clock. Must be called before Run. Intended for tests.
+func (r *Rekeyer) SetClock(c clock.Clock) {
+	r.clock = c
+}
+
+// Run rekeys once immediately and then every rekeyInterval until ctx is cancelled.
+func (r *Rekeyer) Run(ctx context.Context) {
+	ticker := r.clock.NewTicker(rekeyInterval)
+	defer ticker.Stop()
+
+	for {
+		r.RekeyOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// RekeyOnce re-seals up to maxBatchesPerPass batches and logs the result.
+func (r *Rekeyer) RekeyOnce(ctx context.Context) {
+	finish := r.store.StartJobRun("blob_rekey")
+	var messages, backups int
+	for i := 0; i < maxBatchesPerPass; i++ {
+		done, err := r.step(ctx, false, &messages, &backups)
+		if err != nil {
+			log.Printf("BLOBREKEY: rekey failed: %v", err)
+			finish(err)
+			return
+		}
+		if done {
+			if n, err := r.store.PruneBlobKeys(ctx); err != nil {
+				log.Printf("BLOBREKEY: could not prune unused data keys: %v", err)
+			} else if n > 0 {
+				log.Printf("BLOBREKEY: deleted %d unused data keys", n)
+			}
+			break
+		}
+	}
+	if messages > 0 || backups > 0 {
+		log.Printf("BLOBREKEY: re-sealed %d messages and %d key backups", messages, backups)
+	}
+	finish(nil)
+}
+
+// RekeyAll re-seals every row, for the -reencrypt-blobs and -decrypt-blobs
+// commands. With toPlaintext, blobs are decrypted instead.
+func RekeyAll(ctx context.Context, s *store.PostgresStore, toPlaintext bool) (messages, backups int, err error) {
+	r := NewRekeyer(s)
+	for {
+		done, err := r.step(ctx, toPlaintext, &messages, &backups)
+		if err != nil {
+			return messages, backups, err
+		}
+		if done {
+			break
+		}
+	}
+	if !toPlaintext {
+		_, err = s.PruneBlobKeys(ctx)
+	}
+	return messages, backups, err
+}
+
+// step re-seals one batch of messages, or of key backups once the messages
+// are covered, then of TOTP secrets, and reports whether every table has
+// been. TOTP secrets aren't counted; there are few and they're logged with
+// nothing else.
+func (r *Rekeyer) step(ctx context.Context, toPlaintext bool, messages, backups *int) (bool, error) {
+	if r.after >= 0 {
+		n, next, err := r.store.RekeyMessageBlobs(ctx, r.after, rekeyBatch, toPlaintext)
+		if err != nil {
+			return false, err
+		}
+		*messages += n
+		if next > 0 {
+			r.after = next
+			return false, nil
+		}
+		r.after = -1 // Messages covered; key backups next
+	}
+
+	n, err := r.store.RekeyBackupBlobs(ctx, rekeyBatch, toPlaintext)
+	if err != nil {
+		return false, err
+	}
+	*backups += n
+	if n == rekeyBatch {
+		return false, nil
+	}
+
+	n, err = r.store.RekeyTOTPSecrets(ctx, rekeyBatch, toPlaintext)
+	if err != nil {
+		return false, err
+	}
+	if n == rekeyBatch {
+		return false, nil
+	}
+	r.after = 0 // The next pass starts over
+	return true, nil
+}
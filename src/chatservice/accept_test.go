@@ -0,0 +1,92 @@
+// src/chatservice/accept_test.go
+package chatservice
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestAcceptChatOutcomes accepts requests twice, concurrently, from the
+// wrong side, from oneself and where there is none, and checks each gets
+// its own answer.
+func TestAcceptChatOutcomes(t *testing.T) {
+	svc, st, _ := newTestService(t)
+	ctx := context.Background()
+	ids := make(map[string]int)
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		if err := st.RegisterUser(ctx, name, "hash", nil); err != nil {
+			t.Fatal(err)
+		}
+		id, err := st.GetUserIDByUsername(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+	request := func(from, to string) {
+		t.Helper()
+		if _, err := svc.RequestChat(ctx, ids[from], to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A double tap succeeds twice
+	request("bob", "alice")
+	for i := 0; i < 2; i++ {
+		if err := svc.AcceptChat(ctx, ids["alice"], "bob"); err != nil {
+			t.Errorf("accept %d: %v", i+1, err)
+		}
+	}
+
+	// Concurrent accepts all succeed, and only one changes anything
+	request("carol", "alice")
+	var wg sync.WaitGroup
+	var changed atomic.Int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			accepted, err := st.AcceptChat(ctx, ids["alice"], "carol")
+			if err != nil {
+				t.Errorf("concurrent accept: %v", err)
+			}
+			if accepted {
+				changed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := changed.Load(); n != 1 {
+		t.Errorf("%d concurrent accepts changed the request, want 1", n)
+	}
+
+	request("alice", "dave")
+	request("erin", "dave")
+	if err := svc.DeclineChat(ctx, ids["dave"], "erin"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		user      string
+		requester string
+		want      Kind
+	}{
+		{"one's own request", "alice", "dave", KindInvalid},
+		{"oneself", "alice", "alice", KindInvalid},
+		{"no request", "alice", "erin", KindNotFound},
+		{"no such user", "alice", "nobody", KindNotFound},
+		{"a declined request", "dave", "erin", KindConflict},
+	}
+	for _, tt := range tests {
+		if err := svc.AcceptChat(ctx, ids[tt.user], tt.requester); KindOf(err) != tt.want {
+			t.Errorf("%s: %v, want kind %d", tt.name, err, tt.want)
+		}
+	}
+	// dave can still accept alice's request
+	if err := svc.AcceptChat(ctx, ids["dave"], "alice"); err != nil {
+		t.Errorf("the other side accepting: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+// src/chatservice/account.go
+package chatservice
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"cryptachat-server/store"
+)
+
+// ---- Account Summary ----
+
+// summaryTTL is how long a user's account summary is served from cache.
+// The aggregates are expensive, so this stops clients hammering them.
+const summaryTTL = time.Minute
+
+// AccountSummary is what the server knows about a user: counts and dates only.
+type AccountSummary struct {
+	Username        string              `json:"username"`
+	Messages        store.MessageCounts `json:"messages"`
+	Contacts        int                 `json:"contacts"`
+	PendingRequests store.RequestCounts `json:"pending_requests"`
+	HasPublicKey    bool                `json:"has_public_key"`
+	StorageBytes    int64               `json:"storage_bytes"`
+	RetentionDays   int                 `json:"retention_days"` // Effective; 0 = forever
+	GeneratedAt     store.Timestamp     `json:"generated_at"`
+}
+
+// summaryCache holds recently computed summaries per user.
+type summaryCache struct {
+	mu      sync.Mutex
+	entries map[int]*AccountSummary
+}
+
+func (c *summaryCache) get(userID int, now time.Time) (*AccountSummary, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[userID]
+	if !ok || now.Sub(entry.GeneratedAt.Time) >= summaryTTL {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (c *summaryCache) put(userID int, summary *AccountSummary) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[int]*AccountSummary)
+	}
+	// Drop expired entries so the map doesn't grow with every user ever seen
+	for id, entry := range c.entries {
+		if summary.GeneratedAt.Sub(entry.GeneratedAt.Time) >= summaryTTL {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[userID] = summary
+}
+
+// AccountSummary returns the user's summary, cached for summaryTTL.
+func (s *Service) AccountSummary(ctx context.Context, user *store.User) (*AccountSummary, error) {
+	if summary, ok := s.summaries.get(user.ID, s.clock.Now()); ok {
+		return summary, nil
+	}
+
+	summary, err := s.buildAccountSummary(ctx, user)
+	if err != nil {
+		return nil, internal(err)
+	}
+	s.summaries.put(user.ID, summary)
+	return summary, nil
+}
+
+// buildAccountSummary runs the aggregate queries for one user.
+func (s *Service) buildAccountSummary(ctx context.Context, user *store.User) (*AccountSummary, error) {
+	summary := &AccountSummary{Username: user.Username, GeneratedAt: store.NewTimestamp(s.clock.Now())}
+	var err error
+
+	if summary.Messages, err = s.store.CountMessages(ctx, user.ID); err != nil {
+		return nil, err
+	}
+	if summary.Contacts, err = s.store.CountContacts(ctx, user.ID); err != nil {
+		return nil, err
+	}
+	if summary.PendingRequests, err = s.store.CountPendingRequests(ctx, user.ID); err != nil {
+		return nil, err
+	}
+	if summary.HasPublicKey, err = s.store.HasPublicKey(ctx, user.ID); err != nil {
+		return nil, err
+	}
+	if summary.StorageBytes, err = s.store.GetStorageUsage(ctx, user.ID); err != nil {
+		return nil, err
+	}
+	settings, err := s.store.GetUserSettings(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	summary.RetentionDays = store.EffectiveRetentionDays(settings, s.cfg.Runtime().MessageRetentionDays)
+	return summary, nil
+}
+
+// ---- Settings ----
+
+// maxRetentionDays bounds retention_days to something sane (100 years).
+const maxRetentionDays = 36500
+
+// maxInboundMessagesPerHour bounds inbound_messages_per_hour.
+const maxInboundMessagesPerHour = 100000
+
+// Settings shows the saved preference alongside what actually applies.
+type Settings struct {
+	RetentionDays          *int `json:"retention_days"`
+	EffectiveRetentionDays int  `json:"effective_retention_days"`
+	InboundMessagesPerHour *int `json:"inbound_messages_per_hour"` // nil = unlimited
+	PushBadgeCounts        bool `json:"push_badge_counts"`
+}
+
+// GetSettings returns the user's settings.
+func (s *Service) GetSettings(ctx context.Context, userID int) (Settings, error) {
+	settings, err := s.store.GetUserSettings(ctx, userID)
+	if err != nil {
+		return Settings{}, internal(err)
+	}
+	return Settings{
+		RetentionDays:          settings.RetentionDays,
+		EffectiveRetentionDays: store.EffectiveRetentionDays(settings, s.cfg.Runtime().MessageRetentionDays),
+		InboundMessagesPerHour: settings.InboundMessagesPerHour,
+		PushBadgeCounts:        settings.PushBadgeCounts,
+	}, nil
+}
+
+// SetRetentionDays stores the user's retention preference (nil = server default, 0 = forever).
+func (s *Service) SetRetentionDays(ctx context.Context, userID int, days *int) error {
+	if days != nil && (*days < 0 || *days > maxRetentionDays) {
+		return invalid("retention_days must be between 0 (forever) and 36500")
+	}
+	if err := s.store.SetRetentionDays(ctx, userID, days); err != nil {
+		return internal(err)
+	}
+	return nil
+}
+
+// SetInboundLimit stores the most messages per hour the user accepts from
+// everyone together (nil = unlimited). Contacts count like anyone else.
+func (s *Service) SetInboundLimit(ctx context.Context, userID int, perHour *int) error {
+	if perHour != nil && (*perHour < 1 || *perHour > maxInboundMessagesPerHour) {
+		return invalid("inbound_messages_per_hour must be between 1 and %d, or null for no limit", maxInboundMessagesPerHour)
+	}
+	if err := s.store.SetInboundLimit(ctx, userID, perHour); err != nil {
+		return internal(err)
+	}
+	return nil
+}
+
+// ---- Account Deletion ----
+
+// CodeLegalHold is the error code of account deletions refused because the
+// data is on legal hold.
+const CodeLegalHold = "legal_hold"
+
+// DeleteAccount deletes userID's account and everything stored for it,
+// after checking their password. Their former contacts and requesters are
+// told to refresh their lists.
+func (s *Service) DeleteAccount(ctx context.Context, userID int, password string) error {
+	if password == "" {
+		return invalid("Missing password")
+	}
+	user, err := s.store.GetUserByID(ctx, userID)
+	if err != nil {
+		return internal(err)
+	}
+	if err := s.checkPassword(ctx, user, password); err != nil {
+		if KindOf(err) == KindUnavailable {
+			return err
+		}
+		return forbidden("Password is incorrect.")
+	}
+
+	partners, err := s.store.DeleteUser(ctx, userID)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "legal hold"):
+			// Don't say whose hold it is
+			return &Error{
+				Kind:    KindConflict,
+				Message: "This account can't be deleted right now. Contact the operator.",
+				Details: map[string]interface{}{"code": CodeLegalHold},
+			}
+		case strings.Contains(err.Error(), "not found"):
+			return notFound("User not found.")
+		}
+		return internal(err)
+	}
+
+	s.invalidate(ctx, partners, ScopeContacts, user.Username)
+	s.invalidate(ctx, partners, ScopeChatRequests, user.Username)
+	return nil
+}
@@ -0,0 +1,73 @@
+// src/chatservice/admin.go
+package chatservice
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+)
+
+const auditAdminBootstrapped = "admin.bootstrapped"
+
+// InitAdminBootstrap opens the one-time admin bootstrap if
+// BOOTSTRAP_ADMIN_TOKEN is set and no admin user exists yet. Call it once at
+// startup.
+func (s *Service) InitAdminBootstrap(ctx context.Context) error {
+	if s.cfg.BootstrapAdminToken == "" {
+		return nil
+	}
+	n, err := s.store.CountAdmins(ctx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("BOOTSTRAP: BOOTSTRAP_ADMIN_TOKEN is set but %d admin user(s) already exist; POST /bootstrap_admin is disabled. Remove the variable.", n)
+		return nil
+	}
+	s.bootstrapOpen.Store(true)
+	log.Printf("BOOTSTRAP: no admin user exists; POST /bootstrap_admin is OPEN until the first admin is created.")
+	return nil
+}
+
+// BootstrapAdmin creates the first admin user, provided token matches
+// BOOTSTRAP_ADMIN_TOKEN. After one success the route is closed for the life
+// of the process, and the database guard keeps it closed on every replica.
+func (s *Service) BootstrapAdmin(ctx context.Context, token, username, password string) error {
+	if !s.bootstrapOpen.Load() {
+		return notFound("Not found.")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.BootstrapAdminToken)) != 1 {
+		log.Printf("BOOTSTRAP: rejected attempt with an invalid token")
+		return unauthorized("Bootstrap token is invalid!")
+	}
+	if username == "" || password == "" {
+		return invalid("Missing username or password")
+	}
+	username, err := normalizeUsername(username)
+	if err != nil {
+		return err
+	}
+
+	hash, err := s.hashPassword(ctx, username, password)
+	if err != nil {
+		return err
+	}
+
+	userID, err := s.store.BootstrapAdmin(ctx, username, hash)
+	if err != nil {
+		switch err.Error() {
+		case "admin already bootstrapped":
+			// Another replica got there first
+			s.bootstrapOpen.Store(false)
+			return notFound("Not found.")
+		case "username already exists":
+			return conflict("Username already exists.")
+		}
+		return internal(err)
+	}
+
+	s.bootstrapOpen.Store(false)
+	log.Printf("BOOTSTRAP: created first admin user %q (id %d). POST /bootstrap_admin is now disabled; remove BOOTSTRAP_ADMIN_TOKEN.", username, userID)
+	s.audit(ctx, userID, auditAdminBootstrapped, nil)
+	return nil
+}
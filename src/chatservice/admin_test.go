@@ -0,0 +1,73 @@
+// src/chatservice/admin_test.go
+package chatservice
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestBootstrapAdminOnce bootstraps from two replicas at once, several
+// times each. Exactly one call may create an admin; every other one, and
+// every call after, is answered as if the route didn't exist, including
+// on a replica started later.
+func TestBootstrapAdminOnce(t *testing.T) {
+	const token = "bootstrap-token-0123456789"
+	svc, st, _ := newTestService(t, "BOOTSTRAP_ADMIN_TOKEN", token)
+	ctx := context.Background()
+	replica := New(svc.cfg, st, nil)
+	for _, s := range []*Service{svc, replica} {
+		if err := s.InitAdminBootstrap(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := svc.BootstrapAdmin(ctx, "wrong", "root", "correct horse battery"); KindOf(err) != KindUnauthorized {
+		t.Fatalf("wrong token: %v, want unauthorized", err)
+	}
+
+	errs := make([]error, 8)
+	var wg sync.WaitGroup
+	for i := range errs {
+		s := svc
+		if i%2 == 1 {
+			s = replica
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.BootstrapAdmin(ctx, token, fmt.Sprintf("root%d", i), "correct horse battery")
+		}()
+	}
+	wg.Wait()
+	created := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case KindOf(err) != KindNotFound:
+			t.Errorf("call %d: %v, want not found", i, err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d calls created an admin, want 1", created)
+	}
+	if n, err := st.CountAdmins(ctx); err != nil || n != 1 {
+		t.Errorf("%d admins (%v), want 1", n, err)
+	}
+
+	// Reuse after success, on both replicas and on one started after
+	later := New(svc.cfg, st, nil)
+	if err := later.InitAdminBootstrap(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]*Service{"first": svc, "second": replica, "later": later} {
+		if err := s.BootstrapAdmin(ctx, token, "again", "correct horse battery"); KindOf(err) != KindNotFound {
+			t.Errorf("reuse on the %s replica: %v, want not found", name, err)
+		}
+	}
+	if _, err := st.GetUserIDByUsername(ctx, "again"); err == nil {
+		t.Error("a reuse created a user")
+	}
+}
@@ -0,0 +1,400 @@
+// src/chatservice/attachments.go
+package chatservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"cryptachat-server/attachments"
+	"cryptachat-server/store"
+)
+
+const (
+	// maxOpenUploads caps the incomplete uploads one user can have, so
+	// abandoned ones can't fill the disk before they expire.
+	maxOpenUploads = 10
+	// attachmentGCInterval is how often expired uploads and orphaned
+	// blobs are deleted.
+	attachmentGCInterval = time.Hour
+)
+
+// Error codes for attachment uploads.
+const (
+	CodeChunkDigestMismatch = "chunk_digest_mismatch"
+	CodeChunksMissing       = "chunks_missing"
+	CodeDigestMismatch      = "digest_mismatch"
+)
+
+// AttachmentUpload describes an attachment upload. Every chunk but the last
+// is ChunkSize bytes. ExpiresAt is when an incomplete upload is deleted.
+type AttachmentUpload struct {
+	UploadID   string           `json:"upload_id"`
+	Size       int64            `json:"size"`
+	ChunkSize  int              `json:"chunk_size"`
+	ChunkCount int              `json:"chunk_count"`
+	Complete   bool             `json:"complete"`
+	ExpiresAt  *store.Timestamp `json:"expires_at,omitempty"`
+}
+
+// AttachmentStatus is an upload with the chunks the server has, and those
+// a resuming client still has to send.
+type AttachmentStatus struct {
+	AttachmentUpload
+	Received []int `json:"received"`
+	Missing  []int `json:"missing"`
+}
+
+// EnableAttachments stores attachment uploads in blobs. RunAttachmentGC
+// must be running for abandoned uploads to be deleted.
+func (s *Service) EnableAttachments(blobs attachments.BlobStore) {
+	s.blobs = blobs
+}
+
+// requireAttachments fails if the instance has attachments switched off.
+func (s *Service) requireAttachments() error {
+	if !s.caps.Attachments.Enabled || s.blobs == nil {
+		return forbidden("Attachments are disabled on this instance.")
+	}
+	return nil
+}
+
+func newAttachmentUpload(a *store.Attachment) *AttachmentUpload {
+	u := &AttachmentUpload{
+		UploadID:   a.ID,
+		Size:       a.Size,
+		ChunkSize:  a.ChunkSize,
+		ChunkCount: a.ChunkCount(),
+		Complete:   a.CompletedAt != nil,
+	}
+	if !u.Complete {
+		expires := store.NewTimestamp(a.ExpiresAt)
+		u.ExpiresAt = &expires
+	}
+	return u
+}
+
+// InitiateAttachment starts an upload of size bytes whose SHA-256 is
+// sha256Hex, and says how to cut it into chunks.
+func (s *Service) InitiateAttachment(ctx context.Context, userID int, size int64, sha256Hex string) (*AttachmentUpload, error) {
+	if err := s.requireAttachments(); err != nil {
+		return nil, err
+	}
+	limits := s.cfg.Attachments
+	if size <= 0 {
+		return nil, invalid("size must be a positive number of bytes.")
+	}
+	if size > limits.MaxBytes {
+		return nil, tooLarge(fmt.Sprintf("Attachments are limited to %d bytes.", limits.MaxBytes))
+	}
+	sum, err := hex.DecodeString(sha256Hex)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, invalid("sha256 must be 64 hex characters.")
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, internal(fmt.Errorf("could not generate upload ID: %w", err))
+	}
+	a := &store.Attachment{
+		ID:        hex.EncodeToString(b),
+		UserID:    userID,
+		Size:      size,
+		ChunkSize: limits.ChunkBytes,
+		SHA256:    sum,
+		ExpiresAt: s.clock.Now().Add(limits.UploadTTL),
+	}
+	if err := s.store.CreateAttachment(ctx, a, maxOpenUploads); err != nil {
+		if strings.Contains(err.Error(), "upload limit reached") {
+			return nil, conflict(fmt.Sprintf("You already have %d uploads in progress. Complete or delete one first.", maxOpenUploads))
+		}
+		return nil, internal(err)
+	}
+	return newAttachmentUpload(a), nil
+}
+
+// ownUpload returns the caller's upload id. Other users' uploads are not
+// found, so upload IDs can't be probed.
+func (s *Service) ownUpload(ctx context.Context, userID int, id string) (*store.Attachment, error) {
+	if !attachments.ValidID(id) {
+		return nil, notFound("No such upload.")
+	}
+	a, err := s.store.GetAttachment(ctx, id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, notFound("No such upload.")
+		}
+		return nil, internal(err)
+	}
+	if a.UserID != userID {
+		return nil, notFound("No such upload.")
+	}
+	return a, nil
+}
+
+// PutAttachmentChunk stores chunk n of the caller's upload id, after
+// checking its length and that it hashes to sha256Hex. Sending a chunk
+// again replaces it.
+func (s *Service) PutAttachmentChunk(ctx context.Context, userID int, id string, n int, data []byte, sha256Hex string) error {
+	if err := s.requireAttachments(); err != nil {
+		return err
+	}
+	a, err := s.ownUpload(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	if a.CompletedAt != nil {
+		return conflict("The upload is already complete.")
+	}
+	count := a.ChunkCount()
+	if n < 0 || n >= count {
+		return invalid("Chunk %d is out of range; the upload has chunks 0 to %d.", n, count-1)
+	}
+	want := int64(a.ChunkSize)
+	if n == count-1 {
+		want = a.Size - int64(count-1)*int64(a.ChunkSize)
+	}
+	if int64(len(data)) != want {
+		return invalid("Chunk %d must be %d bytes, not %d.", n, want, len(data))
+	}
+	sum, err := hex.DecodeString(sha256Hex)
+	if err != nil || len(sum) != sha256.Size {
+		return invalid("The chunk's SHA-256 must be 64 hex characters.")
+	}
+	if got := sha256.Sum256(data); !bytes.Equal(got[:], sum) {
+		return &Error{
+			Kind:    KindInvalid,
+			Message: fmt.Sprintf("Chunk %d doesn't match its SHA-256; send it again.", n),
+			Details: map[string]interface{}{"code": CodeChunkDigestMismatch},
+		}
+	}
+
+	if err := s.blobs.PutChunk(ctx, id, n, data); err != nil {
+		return internal(err)
+	}
+	return nil
+}
+
+// AttachmentStatus returns the caller's upload id with the chunks received
+// so far.
+func (s *Service) AttachmentStatus(ctx context.Context, userID int, id string) (*AttachmentStatus, error) {
+	if err := s.requireAttachments(); err != nil {
+		return nil, err
+	}
+	a, err := s.ownUpload(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	status := &AttachmentStatus{AttachmentUpload: *newAttachmentUpload(a), Missing: []int{}}
+	if status.Complete {
+		status.Received = make([]int, status.ChunkCount)
+		for n := range status.Received {
+			status.Received[n] = n
+		}
+		return status, nil
+	}
+	if status.Received, err = s.blobs.Chunks(ctx, id); err != nil {
+		return nil, internal(err)
+	}
+	status.Missing = missingChunks(status.Received, status.ChunkCount)
+	return status, nil
+}
+
+// missingChunks returns the chunks from 0 to count-1 not in received,
+// which is sorted.
+func missingChunks(received []int, count int) []int {
+	missing := []int{}
+	i := 0
+	for n := 0; n < count; n++ {
+		for i < len(received) && received[i] < n {
+			i++
+		}
+		if i == len(received) || received[i] != n {
+			missing = append(missing, n)
+		}
+	}
+	return missing
+}
+
+// CompleteAttachment assembles the caller's upload id once every chunk is
+// in. If the whole doesn't match the SHA-256 given when it started, the
+// upload is deleted. Completing an upload again returns it as it is.
+func (s *Service) CompleteAttachment(ctx context.Context, userID int, id string) (*AttachmentUpload, error) {
+	if err := s.requireAttachments(); err != nil {
+		return nil, err
+	}
+	a, err := s.ownUpload(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if a.CompletedAt != nil {
+		return newAttachmentUpload(a), nil
+	}
+
+	received, err := s.blobs.Chunks(ctx, id)
+	if err != nil {
+		return nil, internal(err)
+	}
+	if missing := missingChunks(received, a.ChunkCount()); len(missing) > 0 {
+		return nil, chunksMissing(missing)
+	}
+	if _, err := s.blobs.Assemble(ctx, id, a.ChunkCount(), a.SHA256); err != nil {
+		switch {
+		case errors.Is(err, attachments.ErrDigestMismatch):
+			s.deleteUpload(ctx, id)
+			return nil, &Error{
+				Kind:    KindInvalid,
+				Message: "The upload doesn't match its SHA-256 and has been deleted; start it again.",
+				Details: map[string]interface{}{"code": CodeDigestMismatch},
+			}
+		case errors.Is(err, attachments.ErrMissingChunk):
+			// A concurrent request got there first; the client can ask
+			// for the status and try again
+			return nil, chunksMissing(nil)
+		}
+		return nil, internal(err)
+	}
+
+	completedAt, err := s.store.CompleteAttachment(ctx, id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			// It expired or was deleted while being assembled
+			if err := s.blobs.Delete(ctx, id); err != nil {
+				log.Printf("ATTACHMENTS: could not delete upload %s: %v", id, err)
+			}
+			return nil, notFound("No such upload.")
+		}
+		return nil, internal(err)
+	}
+	a.CompletedAt = &completedAt
+	return newAttachmentUpload(a), nil
+}
+
+// chunksMissing refuses to complete an upload without all its chunks.
+func chunksMissing(missing []int) error {
+	details := map[string]interface{}{"code": CodeChunksMissing}
+	if missing != nil {
+		details["missing"] = missing
+	}
+	return &Error{
+		Kind:    KindConflict,
+		Message: "Some chunks haven't been received; send them and complete the upload again.",
+		Details: details,
+	}
+}
+
+// OpenAttachment returns a completed attachment and its size. Any user
+// with the ID can download it: the ID is random, and whoever uploaded it
+// shares it with the recipients along with the key.
+func (s *Service) OpenAttachment(ctx context.Context, id string) (io.ReadCloser, int64, error) {
+	if err := s.requireAttachments(); err != nil {
+		return nil, 0, err
+	}
+	if !attachments.ValidID(id) {
+		return nil, 0, notFound("No such attachment.")
+	}
+	a, err := s.store.GetAttachment(ctx, id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, 0, notFound("No such attachment.")
+		}
+		return nil, 0, internal(err)
+	}
+	if a.CompletedAt == nil {
+		return nil, 0, notFound("No such attachment.")
+	}
+	r, size, err := s.blobs.Open(ctx, id)
+	if err != nil {
+		if errors.Is(err, attachments.ErrNotFound) {
+			return nil, 0, notFound("No such attachment.")
+		}
+		return nil, 0, internal(err)
+	}
+	return r, size, nil
+}
+
+// DeleteAttachment deletes the caller's attachment or upload id.
+func (s *Service) DeleteAttachment(ctx context.Context, userID int, id string) error {
+	if err := s.requireAttachments(); err != nil {
+		return err
+	}
+	if _, err := s.ownUpload(ctx, userID, id); err != nil {
+		return err
+	}
+	return s.deleteUpload(ctx, id)
+}
+
+// deleteUpload deletes an upload's row and then its blobs. Blobs that
+// can't be deleted are left to the GC job, which finds them without a row.
+func (s *Service) deleteUpload(ctx context.Context, id string) error {
+	if _, err := s.store.DeleteAttachment(ctx, id); err != nil {
+		return internal(err)
+	}
+	if err := s.blobs.Delete(ctx, id); err != nil {
+		log.Printf("ATTACHMENTS: could not delete upload %s: %v", id, err)
+	}
+	return nil
+}
+
+// RunAttachmentGC deletes expired uploads and orphaned blobs once
+// immediately and then every attachmentGCInterval until ctx is done.
+func (s *Service) RunAttachmentGC(ctx context.Context) {
+	ticker := s.clock.NewTicker(attachmentGCInterval)
+	defer ticker.Stop()
+	for {
+		s.CollectAttachments(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// CollectAttachments runs a single pass of the attachment GC job. It
+// deletes incomplete uploads past their expiry, then blobs with no upload
+// row, such as those of deleted accounts.
+func (s *Service) CollectAttachments(ctx context.Context) {
+	finish := s.store.StartJobRun("attachment_gc")
+	expired, err := s.store.DeleteExpiredAttachments(ctx, s.clock.Now())
+	if err != nil {
+		log.Printf("ATTACHMENTS: expiring uploads failed: %v", err)
+		finish(err)
+		return
+	}
+	for _, id := range expired {
+		if err := s.blobs.Delete(ctx, id); err != nil {
+			log.Printf("ATTACHMENTS: could not delete upload %s: %v", id, err)
+		}
+	}
+
+	stored, err := s.blobs.List(ctx)
+	if err != nil {
+		log.Printf("ATTACHMENTS: listing the attachment store failed: %v", err)
+		finish(err)
+		return
+	}
+	orphans, err := s.store.UnknownAttachments(ctx, stored)
+	if err != nil {
+		log.Printf("ATTACHMENTS: finding orphaned blobs failed: %v", err)
+		finish(err)
+		return
+	}
+	for _, id := range orphans {
+		if err := s.blobs.Delete(ctx, id); err != nil {
+			log.Printf("ATTACHMENTS: could not delete orphaned blob %s: %v", id, err)
+		}
+	}
+	finish(nil)
+	if len(expired) > 0 || len(orphans) > 0 {
+		log.Printf("ATTACHMENTS: deleted %d expired uploads and %d orphaned blobs", len(expired), len(orphans))
+	}
+}
@@ -0,0 +1,311 @@
+// src/chatservice/attachments_test.go
+package chatservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"cryptachat-server/attachments"
+	"cryptachat-server/store"
+	"cryptachat-server/testutil"
+)
+
+func TestMissingChunks(t *testing.T) {
+	tests := []struct {
+		received []int
+		count    int
+		want     []int
+	}{
+		{nil, 3, []int{0, 1, 2}},
+		{[]int{0, 1, 2}, 3, []int{}},
+		{[]int{0, 4}, 5, []int{1, 2, 3}},
+		{[]int{1, 3}, 4, []int{0, 2}},
+		{[]int{0, 1, 7}, 3, []int{2}}, // Out-of-range chunks are ignored
+	}
+	for _, tt := range tests {
+		if got := missingChunks(tt.received, tt.count); !slices.Equal(got, tt.want) {
+			t.Errorf("%v of %d: %v, want %v", tt.received, tt.count, got, tt.want)
+		}
+	}
+}
+
+// newAttachmentService returns a service storing attachments in a
+// temporary directory, in 64 KiB chunks, with alice and bob registered.
+func newAttachmentService(t *testing.T) (*Service, *store.PostgresStore, *testutil.FakeClock, int, int) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "attachments")
+	svc, st, clk := newTestService(t, "ATTACHMENTS_DIR", dir, "ATTACHMENT_CHUNK_BYTES", "65536",
+		"ATTACHMENT_MAX_BYTES", "1000000")
+	blobs, err := attachments.NewFSStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.EnableAttachments(blobs)
+	ctx := context.Background()
+	var ids []int
+	for _, name := range []string{"alice", "bob"} {
+		if err := st.RegisterUser(ctx, name, "hash", nil); err != nil {
+			t.Fatal(err)
+		}
+		id, err := st.GetUserIDByUsername(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return svc, st, clk, ids[0], ids[1]
+}
+
+// chunkSums cuts blob into chunks of size and returns them with their
+// SHA-256s in hex.
+func chunkSums(blob []byte, size int) ([][]byte, []string) {
+	var chunks [][]byte
+	var sums []string
+	for start := 0; start < len(blob); start += size {
+		chunk := blob[start:min(start+size, len(blob))]
+		sum := sha256.Sum256(chunk)
+		chunks = append(chunks, chunk)
+		sums = append(sums, hex.EncodeToString(sum[:]))
+	}
+	return chunks, sums
+}
+
+// TestAttachmentResume uploads an attachment whose middle chunks are lost,
+// resumes from the status, and downloads the result as another user.
+func TestAttachmentResume(t *testing.T) {
+	svc, _, _, alice, bob := newAttachmentService(t)
+	ctx := context.Background()
+	blob := bytes.Repeat([]byte("encrypted "), 40000) // 400000 bytes: 6 chunks and a short one
+	sum := sha256.Sum256(blob)
+	chunks, sums := chunkSums(blob, 65536)
+
+	upload, err := svc.InitiateAttachment(ctx, alice, int64(len(blob)), hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.ChunkSize != 65536 || upload.ChunkCount != 7 || upload.Complete || upload.ExpiresAt == nil {
+		t.Fatalf("initiated: %+v", upload)
+	}
+	id := upload.UploadID
+
+	// The connection drops after chunk 1, and chunk 5 went through on a
+	// retry of the batch; 2 to 4 never arrived
+	for _, n := range []int{0, 1, 5, 6} {
+		if err := svc.PutAttachmentChunk(ctx, alice, id, n, chunks[n], sums[n]); err != nil {
+			t.Fatalf("chunk %d: %v", n, err)
+		}
+	}
+	if _, err := svc.CompleteAttachment(ctx, alice, id); KindOf(err) != KindConflict {
+		t.Fatalf("completing with chunks missing: %v", err)
+	} else if e := err.(*Error); e.Details["code"] != CodeChunksMissing || !slices.Equal(e.Details["missing"].([]int), []int{2, 3, 4}) {
+		t.Errorf("completing with chunks missing: %+v", e.Details)
+	}
+
+	status, err := svc.AttachmentStatus(ctx, alice, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(status.Received, []int{0, 1, 5, 6}) || !slices.Equal(status.Missing, []int{2, 3, 4}) {
+		t.Fatalf("status: received %v, missing %v", status.Received, status.Missing)
+	}
+	// Sending a chunk twice is harmless
+	for _, n := range append(status.Missing, 1) {
+		if err := svc.PutAttachmentChunk(ctx, alice, id, n, chunks[n], sums[n]); err != nil {
+			t.Fatalf("chunk %d: %v", n, err)
+		}
+	}
+
+	done, err := svc.CompleteAttachment(ctx, alice, id)
+	if err != nil || !done.Complete || done.ExpiresAt != nil {
+		t.Fatalf("completing: %+v %v", done, err)
+	}
+	// A retry after a lost response gets the same answer
+	if again, err := svc.CompleteAttachment(ctx, alice, id); err != nil || !again.Complete {
+		t.Errorf("completing again: %+v %v", again, err)
+	}
+	if status, err := svc.AttachmentStatus(ctx, alice, id); err != nil || len(status.Received) != 7 || len(status.Missing) != 0 {
+		t.Errorf("status once complete: %+v %v", status, err)
+	}
+	if err := svc.PutAttachmentChunk(ctx, alice, id, 0, chunks[0], sums[0]); KindOf(err) != KindConflict {
+		t.Errorf("a chunk after completing: %v", err)
+	}
+
+	r, size, err := svc.OpenAttachment(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || size != int64(len(blob)) || !bytes.Equal(got, blob) {
+		t.Errorf("downloaded %d bytes (size %d), %v", len(got), size, err)
+	}
+
+	// bob can download it, but it isn't his to delete
+	if err := svc.DeleteAttachment(ctx, bob, id); KindOf(err) != KindNotFound {
+		t.Errorf("bob deleting alice's attachment: %v", err)
+	}
+	if err := svc.DeleteAttachment(ctx, alice, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := svc.OpenAttachment(ctx, id); KindOf(err) != KindNotFound {
+		t.Errorf("downloading a deleted attachment: %v", err)
+	}
+}
+
+// TestAttachmentChecks covers what a chunk and an upload are refused for.
+func TestAttachmentChecks(t *testing.T) {
+	svc, _, _, alice, bob := newAttachmentService(t)
+	ctx := context.Background()
+	blob := bytes.Repeat([]byte{7}, 100000) // A full chunk and one of 34464 bytes
+	sum := sha256.Sum256(blob)
+	chunks, sums := chunkSums(blob, 65536)
+
+	if _, err := svc.InitiateAttachment(ctx, alice, 1000001, hex.EncodeToString(sum[:])); KindOf(err) != KindTooLarge {
+		t.Errorf("over ATTACHMENT_MAX_BYTES: %v", err)
+	}
+	for _, bad := range []string{"", "abc", hex.EncodeToString(sum[:16])} {
+		if _, err := svc.InitiateAttachment(ctx, alice, 10, bad); KindOf(err) != KindInvalid {
+			t.Errorf("sha256 %q: %v", bad, err)
+		}
+	}
+	if _, err := svc.InitiateAttachment(ctx, alice, 0, hex.EncodeToString(sum[:])); KindOf(err) != KindInvalid {
+		t.Errorf("no size: %v", err)
+	}
+
+	upload, err := svc.InitiateAttachment(ctx, alice, int64(len(blob)), hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := upload.UploadID
+	put := func(n int, data []byte, sum string) error {
+		return svc.PutAttachmentChunk(ctx, alice, id, n, data, sum)
+	}
+	if err := put(2, chunks[1], sums[1]); KindOf(err) != KindInvalid {
+		t.Errorf("a chunk past the end: %v", err)
+	}
+	if err := put(0, chunks[1], sums[1]); KindOf(err) != KindInvalid {
+		t.Errorf("a short chunk that isn't the last: %v", err)
+	}
+	if err := put(1, chunks[0], sums[0]); KindOf(err) != KindInvalid {
+		t.Errorf("a last chunk of the wrong length: %v", err)
+	}
+	if err := put(0, chunks[0], ""); KindOf(err) != KindInvalid {
+		t.Errorf("no chunk digest: %v", err)
+	}
+	err = put(0, chunks[0], sums[1])
+	if e, ok := err.(*Error); !ok || e.Details["code"] != CodeChunkDigestMismatch {
+		t.Errorf("a wrong chunk digest: %v", err)
+	}
+	for _, other := range []string{"0123456789abcdef0123456789abcdef", "../etc", ""} {
+		if err := svc.PutAttachmentChunk(ctx, alice, other, 0, chunks[0], sums[0]); KindOf(err) != KindNotFound {
+			t.Errorf("upload %q: %v", other, err)
+		}
+	}
+	// Someone else's upload is as good as unknown
+	if err := svc.PutAttachmentChunk(ctx, bob, id, 0, chunks[0], sums[0]); KindOf(err) != KindNotFound {
+		t.Errorf("bob sending a chunk: %v", err)
+	}
+	if _, err := svc.AttachmentStatus(ctx, bob, id); KindOf(err) != KindNotFound {
+		t.Errorf("bob asking for the status: %v", err)
+	}
+	// Nor can an incomplete upload be downloaded
+	if _, _, err := svc.OpenAttachment(ctx, id); KindOf(err) != KindNotFound {
+		t.Errorf("downloading an incomplete upload: %v", err)
+	}
+
+	// Chunks that each match their digest but not the whole: the upload
+	// declared blob's digest, and chunk 1 carries other bytes
+	wrong := bytes.Repeat([]byte{8}, len(chunks[1]))
+	wrongSum := sha256.Sum256(wrong)
+	if err := put(0, chunks[0], sums[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(1, wrong, hex.EncodeToString(wrongSum[:])); err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.CompleteAttachment(ctx, alice, id)
+	if e, ok := err.(*Error); !ok || e.Details["code"] != CodeDigestMismatch {
+		t.Fatalf("completing with the wrong bytes: %v", err)
+	}
+	if _, err := svc.AttachmentStatus(ctx, alice, id); KindOf(err) != KindNotFound {
+		t.Errorf("the status of a mismatched upload: %v", err)
+	}
+
+	// Abandoned uploads count against the cap until they are deleted
+	for i := 0; i < maxOpenUploads; i++ {
+		if _, err := svc.InitiateAttachment(ctx, alice, 10, hex.EncodeToString(sum[:])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := svc.InitiateAttachment(ctx, alice, 10, hex.EncodeToString(sum[:])); KindOf(err) != KindConflict {
+		t.Errorf("one upload too many: %v", err)
+	}
+	if _, err := svc.InitiateAttachment(ctx, bob, 10, hex.EncodeToString(sum[:])); err != nil {
+		t.Errorf("bob's first upload: %v", err)
+	}
+}
+
+// TestAttachmentGC lets an upload expire and deletes an account with a
+// completed attachment, and checks the GC job removes both from the disk.
+func TestAttachmentGC(t *testing.T) {
+	svc, st, clk, alice, bob := newAttachmentService(t)
+	ctx := context.Background()
+	blob := []byte("a small attachment")
+	sum := sha256.Sum256(blob)
+	chunks, sums := chunkSums(blob, 65536)
+
+	start := func(user int) string {
+		t.Helper()
+		upload, err := svc.InitiateAttachment(ctx, user, int64(len(blob)), hex.EncodeToString(sum[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := svc.PutAttachmentChunk(ctx, user, upload.UploadID, 0, chunks[0], sums[0]); err != nil {
+			t.Fatal(err)
+		}
+		return upload.UploadID
+	}
+	abandoned := start(alice)
+	kept := start(alice)
+	if _, err := svc.CompleteAttachment(ctx, alice, kept); err != nil {
+		t.Fatal(err)
+	}
+	orphaned := start(bob)
+	if _, err := svc.CompleteAttachment(ctx, bob, orphaned); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.DeleteUser(ctx, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(24*time.Hour + time.Second)
+	// Expired, though the job hasn't run yet
+	if _, err := svc.AttachmentStatus(ctx, alice, abandoned); KindOf(err) != KindNotFound {
+		t.Errorf("an expired upload: %v", err)
+	}
+	svc.CollectAttachments(ctx)
+
+	ids, err := svc.blobs.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []string{kept}) {
+		t.Errorf("left on disk: %v, want only %s", ids, kept)
+	}
+	if r, _, err := svc.OpenAttachment(ctx, kept); err != nil {
+		t.Errorf("a completed attachment after the GC: %v", err)
+	} else {
+		r.Close()
+	}
+	runs := st.JobRuns()
+	if len(runs) != 1 || runs[0].Name != "attachment_gc" || runs[0].Failures != 0 {
+		t.Errorf("job runs: %+v", runs)
+	}
+}
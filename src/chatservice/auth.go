@@ -0,0 +1,406 @@
+// src/chatservice/auth.go
+package chatservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cryptachat-server/passwords"
+	"cryptachat-server/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims is the JWT payload issued by Login and checked by the auth middleware.
+// Username is informational: it was the name at issue time, and the
+// middleware puts the user loaded by UserID in the request context instead.
+// TokenVersion must match the user's current token_version; tokens from
+// before versions existed carry none, which matches the initial 0. The
+// audience says what a token is good for: AudienceAccess for the auth
+// middleware, AudienceTwoFactor for /2fa/login. Each is parsed requiring
+// its own, so one can't stand in for the other.
+type Claims struct {
+	UserID       int    `json:"user_id"`
+	Username     string `json:"username"`
+	TokenVersion int    `json:"token_version,omitempty"`
+	SessionID    int64  `json:"sid,omitempty"` // 0 for logins without a refresh token
+	jwt.RegisteredClaims
+}
+
+// Register creates a new account, unless registration is closed. When it
+// is invite-only, it redeems inviteCode for it, and refuses to register
+// without one that is unused. A non-empty email becomes the account's
+// recovery email, and is mailed a verification token. When the instance
+// requires proof of work, work must solve a challenge from
+// NewRegisterChallenge.
+func (s *Service) Register(ctx context.Context, username, password, inviteCode, email string, work RegistrationWork) error {
+	// Refused before any hashing, so a sign-up wave costs little once closed
+	mode := s.RegistrationMode(ctx)
+	if mode == RegistrationClosed {
+		return registrationClosed()
+	}
+	if username == "" || password == "" {
+		return invalid("Missing username or password")
+	}
+	username, err := normalizeUsername(username)
+	if err != nil {
+		return err
+	}
+	inviteHash, err := inviteHashFor(mode, inviteCode)
+	if err != nil {
+		return err
+	}
+	if email != "" {
+		if err := s.requireEmail(); err != nil {
+			return err
+		}
+		if email, err = normalizeEmail(email); err != nil {
+			return err
+		}
+	}
+	if err := s.checkNewPassword(username, password); err != nil {
+		return err
+	}
+	switch _, err := s.store.GetUserIDByUsername(ctx, username); {
+	case err == nil:
+		return conflict("Username already exists.")
+	case err.Error() != "user not found":
+		return internal(err)
+	}
+	// Checked last, so a request refused for anything else doesn't spend
+	// its challenge, and before hashing, which is what the work pays for
+	if err := s.checkRegistrationWork(ctx, work); err != nil {
+		return err
+	}
+
+	hash, err := s.hashPassword(ctx, username, password)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.RegisterUser(ctx, username, hash, inviteHash); err != nil {
+		// Taken since the check above
+		if err.Error() == "username already exists" {
+			return conflict("Username already exists.")
+		}
+		if ierr := inviteRedeemError(err); ierr != nil {
+			return ierr
+		}
+		return internal(err)
+	}
+	if email != "" {
+		// The account exists either way; the user can set the email again
+		user, err := s.store.GetUserByUsername(ctx, username)
+		if err == nil {
+			err = s.startEmailVerification(ctx, user, email)
+		}
+		if err != nil {
+			log.Printf("register: setting recovery email of %s: %v", username, err)
+		}
+	}
+	return nil
+}
+
+// ErrLoginFailed is the answer to a login with an unknown username and to
+// one with a wrong password. Both paths return this value itself, and
+// /login writes it as is, so the two can't drift apart in status, message
+// or fields: whatever is added to it reaches both. Don't modify it.
+var ErrLoginFailed error = &Error{Kind: KindUnauthorized, Message: "Could not verify! Check username/password."}
+
+// Login verifies credentials and returns a signed access token and, with
+// refresh, a refresh token starting a new family. refresh is false where
+// refresh tokens can't be stored (compatibility mode). A stored hash due
+// for replacement (see passwords.Hasher.NeedsRehash) is replaced. If the
+// user has two-factor authentication on, only TwoFactorToken is set, for
+// TwoFactorLogin.
+func (s *Service) Login(ctx context.Context, username, password string, client ClientInfo, refresh bool) (*TokenPair, error) {
+	if username == "" || password == "" {
+		return nil, unauthorized("Could not verify")
+	}
+
+	user, err := s.checkLoginPassword(ctx, username, password, client.IP)
+	if err != nil {
+		return nil, err
+	}
+	if refresh {
+		// Like refresh tokens, upgraded hashes aren't written in
+		// compatibility mode
+		s.upgradePasswordHash(ctx, user, password)
+	}
+
+	twoFactor, err := s.store.TOTPEnabled(ctx, user.ID)
+	if err != nil {
+		return nil, internal(err)
+	}
+	if twoFactor {
+		return s.pendingToken(user)
+	}
+	return s.completeLogin(ctx, user, client, refresh)
+}
+
+// ChangePassword replaces userID's password after checking the current
+// one. Every session is signed out, this one included, so it returns a
+// fresh token pair for the caller, in a new session.
+func (s *Service) ChangePassword(ctx context.Context, userID int, currentPassword, newPassword string, client ClientInfo) (*TokenPair, error) {
+	if currentPassword == "" || newPassword == "" {
+		return nil, invalid("Missing current_password or new_password")
+	}
+	if newPassword == currentPassword {
+		return nil, invalid("The new password must differ from the current one.")
+	}
+
+	user, err := s.store.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, internal(err)
+	}
+	if err := s.checkPassword(ctx, user, currentPassword); err != nil {
+		if KindOf(err) == KindUnavailable {
+			return nil, err
+		}
+		return nil, forbidden("Current password is incorrect.")
+	}
+
+	hash, err := s.hashPassword(ctx, user.Username, newPassword)
+	if err != nil {
+		return nil, err
+	}
+	if user.TokenVersion, err = s.store.UpdatePasswordHash(ctx, userID, hash); err != nil {
+		return nil, internal(err)
+	}
+	user.PasswordHash = hash
+
+	return s.issueTokens(ctx, user, client, true)
+}
+
+// completeLogin records a successful login as user's last_login and
+// issues its tokens. Like upgraded hashes, last_login isn't written in
+// compatibility mode (without refresh), and failing to write it only gets
+// logged.
+func (s *Service) completeLogin(ctx context.Context, user *store.User, client ClientInfo, refresh bool) (*TokenPair, error) {
+	if refresh {
+		if err := s.store.TouchLastLogin(ctx, user.ID, s.clock.Now()); err != nil {
+			log.Printf("login: recording last login for user %d: %v", user.ID, err)
+		}
+	}
+	return s.issueTokens(ctx, user, client, refresh)
+}
+
+// issueTokens returns an access token for user and, with refresh, a
+// refresh token starting a new family, with a session for client.
+func (s *Service) issueTokens(ctx context.Context, user *store.User, client ClientInfo, refresh bool) (*TokenPair, error) {
+	pair := &TokenPair{ExpiresIn: s.cfg.AccessTokenTTL}
+	var sessionID int64
+	if refresh {
+		family, err := newRefreshToken()
+		if err != nil {
+			return nil, internal(err)
+		}
+		if err := s.issueRefreshToken(ctx, pair, user.ID, family); err != nil {
+			return nil, err
+		}
+		sessionID, err = s.store.CreateSession(ctx, user.ID, family, client.label(), client.IP, pair.RefreshExpiresAt)
+		if err != nil {
+			return nil, internal(err)
+		}
+	}
+	token, err := s.accessToken(user, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	pair.AccessToken = token
+	return pair, nil
+}
+
+// AudienceAccess is the audience of access tokens, which the auth
+// middleware requires.
+const AudienceAccess = "access"
+
+// accessToken signs a JWT for the auth middleware, valid for
+// TOKEN_TTL (or ACCESS_TOKEN_TTL_MINUTES), in session sessionID.
+func (s *Service) accessToken(user *store.User, sessionID int64) (string, error) {
+	now := s.clock.Now()
+	claims := Claims{
+		UserID:       user.ID,
+		Username:     user.Username,
+		TokenVersion: user.TokenVersion,
+		SessionID:    sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{AudienceAccess},
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.cfg.AccessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	tokenString, err := s.cfg.TokenSigner.Sign(claims)
+	if err != nil {
+		return "", internal(fmt.Errorf("Error creating token: %v", err))
+	}
+	return tokenString, nil
+}
+
+// CodeWeakPassword is the error code of new passwords refused by the
+// password policy; the error's reason is the passwords.Reason* that failed.
+const CodeWeakPassword = "weak_password"
+
+// checkNewPassword checks a password username wants to start using against
+// the policy.
+func (s *Service) checkNewPassword(username, password string) error {
+	reason := s.cfg.PasswordPolicy.Check(username, password)
+	if reason == "" {
+		return nil
+	}
+	var msg string
+	switch reason {
+	case passwords.ReasonTooLong:
+		msg = fmt.Sprintf("Password must be at most %d bytes.", passwords.MaxBytes)
+	case passwords.ReasonTooShort:
+		msg = fmt.Sprintf("Password must be at least %d characters.", s.cfg.PasswordPolicy.MinLength)
+	case passwords.ReasonMatchesUsername:
+		msg = "Password must not be the same as the username."
+	case passwords.ReasonCommon:
+		msg = "This password is too common. Choose another."
+	}
+	return &Error{
+		Kind:    KindInvalid,
+		Message: msg,
+		Details: map[string]interface{}{
+			"code":       CodeWeakPassword,
+			"reason":     reason,
+			"min_length": s.cfg.PasswordPolicy.MinLength,
+		},
+	}
+}
+
+// hashPassword checks a new password for username against the policy and
+// hashes it with the configured algorithm. Returns an unavailable error if
+// hashing is saturated.
+func (s *Service) hashPassword(ctx context.Context, username, password string) (string, error) {
+	if err := s.checkNewPassword(username, password); err != nil {
+		return "", err
+	}
+	hash, err := s.hasher.Hash(ctx, password)
+	if err != nil {
+		if errors.Is(err, passwords.ErrBusy) {
+			return "", unavailable("Server is busy. Try again shortly.")
+		}
+		return "", internal(fmt.Errorf("Failed to hash password: %v", err))
+	}
+	return hash, nil
+}
+
+// checkPassword verifies password against the user's hash. Any failure other
+// than saturation (unavailable) means the password is wrong, including a
+// stored hash no algorithm accepts.
+func (s *Service) checkPassword(ctx context.Context, user *store.User, password string) error {
+	err := s.hasher.Compare(ctx, user.PasswordHash, password)
+	if errors.Is(err, passwords.ErrBusy) {
+		return unavailable("Server is busy. Try again shortly.")
+	}
+	if errors.Is(err, passwords.ErrMalformedHash) && user.PasswordHash != "" {
+		// Stand-ins for remote users have no hash; anything else is damage
+		log.Printf("password: user %d has a malformed password hash", user.ID)
+	}
+	if err != nil {
+		return unauthorized("Password does not match.")
+	}
+	return nil
+}
+
+// upgradePasswordHash re-hashes password, known to match, if the user's
+// stored hash uses another algorithm than new hashes, a lower bcrypt cost
+// or other Argon2id parameters. Failures only delay the upgrade to a later login, so they are logged.
+func (s *Service) upgradePasswordHash(ctx context.Context, user *store.User, password string) {
+	if !s.hasher.NeedsRehash(user.PasswordHash) {
+		return
+	}
+	hash, err := s.hasher.Hash(ctx, password)
+	if err != nil {
+		if !errors.Is(err, passwords.ErrBusy) {
+			log.Printf("password: re-hashing for user %d: %v", user.ID, err)
+		}
+		return
+	}
+	if err := s.store.UpgradePasswordHash(ctx, user.ID, user.PasswordHash, hash); err != nil {
+		log.Printf("password: storing re-hash for user %d: %v", user.ID, err)
+	}
+}
+
+// CodeLoginLocked is the error code of logins refused because of too many
+// recent failures for the account from the same address.
+const CodeLoginLocked = "login_locked"
+
+const auditLoginLocked = "login.locked"
+
+// checkLoginPassword looks username up and checks password against its
+// hash, with the per-username, per-address lockout of LoginMaxFailures and
+// LoginLockout. A username nobody has takes the same steps: it is counted
+// and locked like any other, and its password is compared against a dummy
+// hash, so neither the answer, the lockout nor the time taken reveals
+// whether it exists. The attempt is counted before the password is
+// checked, so parallel guesses can't outrun the lock; attempts that
+// couldn't be checked, because hashing was busy or the lookup failed, are
+// uncounted and answered as such rather than as a wrong password.
+func (s *Service) checkLoginPassword(ctx context.Context, username, password, sourceIP string) (*store.User, error) {
+	rc := s.cfg.Runtime()
+	lockout := rc.LoginMaxFailures > 0
+	var attempt store.LoginAttempt
+	if lockout {
+		var err error
+		attempt, err = s.store.BeginLoginAttempt(ctx, username, sourceIP, rc.LoginMaxFailures, rc.LoginLockout)
+		if err != nil {
+			return nil, internal(err)
+		}
+		if !attempt.Allowed {
+			e := rateLimited("Too many failed logins. Try again later.", attempt.LockedUntil.Sub(s.clock.Now())).(*Error)
+			e.Details["code"] = CodeLoginLocked
+			return nil, e
+		}
+	}
+
+	user, err := s.store.GetUserByUsername(ctx, username)
+	switch {
+	case err != nil && err.Error() == "user not found":
+		err = s.hasher.CompareDummy(ctx, password)
+		if errors.Is(err, passwords.ErrBusy) {
+			err = unavailable("Server is busy. Try again shortly.")
+		} else {
+			err = unauthorized("Password does not match.")
+		}
+	case err != nil:
+		// Not a wrong password: the database failed, and the client may
+		// be told to retry
+		err = internal(err)
+	default:
+		err = s.checkPassword(ctx, user, password)
+	}
+	if err != nil {
+		if kind := KindOf(err); kind == KindUnavailable || kind == KindInternal {
+			if lockout {
+				if err := s.store.UndoLoginAttempt(ctx, username, sourceIP, rc.LoginMaxFailures); err != nil {
+					log.Printf("login: uncounting attempt: %v", err)
+				}
+			}
+			return nil, err
+		}
+		if user != nil && !attempt.LockedUntil.IsZero() {
+			// In the background, so the failure that starts a lock takes
+			// no longer for an account than for a name nobody has
+			go s.audit(context.WithoutCancel(ctx), user.ID, auditLoginLocked, map[string]interface{}{
+				"failures":     attempt.Failures,
+				"source_ip":    sourceIP,
+				"locked_until": attempt.LockedUntil.UTC().Format(time.RFC3339),
+			})
+		}
+		return nil, ErrLoginFailed
+	}
+
+	if lockout {
+		if err := s.store.ResetLoginAttempts(ctx, username, sourceIP); err != nil {
+			log.Printf("login: resetting failure count for user %d: %v", user.ID, err)
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,254 @@
+// src/chatservice/auth_test.go
+package chatservice
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cryptachat-server/passwords"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestLoginRehashesOnlyLowerBcryptCost logs in users whose hashes were
+// made at a lower, the same and a higher cost than BCRYPT_COST. Only the
+// lower one is replaced; a higher one is kept, so lowering BCRYPT_COST
+// doesn't weaken it.
+func TestLoginRehashesOnlyLowerBcryptCost(t *testing.T) {
+	svc, st, _ := newTestService(t, "BCRYPT_COST", "5")
+	ctx := context.Background()
+	const password = "correct horse battery"
+
+	tests := []struct {
+		username string
+		cost     int
+		want     int // Cost of the stored hash after login
+	}{
+		{"lower", 4, 5},
+		{"same", 5, 5},
+		{"higher", 6, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			hash, err := passwords.Bcrypt{Cost: tt.cost}.Hash([]byte(password))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := st.RegisterUser(ctx, tt.username, hash, nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.Login(ctx, tt.username, password, ClientInfo{}, true); err != nil {
+				t.Fatalf("login: %v", err)
+			}
+
+			user, err := st.GetUserByUsername(ctx, tt.username)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cost, err := bcrypt.Cost([]byte(user.PasswordHash))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cost != tt.want {
+				t.Errorf("stored cost after login = %d, want %d", cost, tt.want)
+			}
+			if tt.cost == tt.want && user.PasswordHash != hash {
+				t.Error("the stored hash was replaced")
+			}
+		})
+	}
+}
+
+// countingHasher is a PasswordHasher that counts its calls.
+type countingHasher struct {
+	passwords.PasswordHasher
+	hashes, verifies atomic.Int64
+}
+
+func (c *countingHasher) Hash(password []byte) (string, error) {
+	c.hashes.Add(1)
+	return c.PasswordHasher.Hash(password)
+}
+
+func (c *countingHasher) Verify(encoded string, password []byte) error {
+	c.verifies.Add(1)
+	return c.PasswordHasher.Verify(encoded, password)
+}
+
+// TestLoginForUnknownUserComparesOnce logs in as a username that doesn't
+// exist and checks that it costs exactly one password comparison, with
+// the configured hasher, like a wrong password for one that does, and the
+// same answer.
+func TestLoginForUnknownUserComparesOnce(t *testing.T) {
+	counting := &countingHasher{PasswordHasher: passwords.Bcrypt{Cost: 4}}
+	cfg := newTestConfig(t)
+	cfg.PasswordHasher = counting
+	svc, st, _ := newTestServiceWith(t, cfg)
+	ctx := context.Background()
+
+	hash, err := passwords.Bcrypt{Cost: 4}.Hash([]byte("correct horse battery"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.RegisterUser(ctx, "alice", hash, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		_, err := svc.Login(ctx, "nobody", "correct horse battery", ClientInfo{}, true)
+		if !errors.Is(err, ErrLoginFailed) {
+			t.Fatalf("login %d as an unknown user: got %v, want ErrLoginFailed", i, err)
+		}
+		if got := counting.verifies.Load(); got != int64(i) {
+			t.Errorf("after %d logins: %d comparisons with the configured hasher, want %d", i, got, i)
+		}
+		stats := svc.HashingStats()
+		if stats.Compare.Count != int64(i) || stats.DummyCompares != int64(i) {
+			t.Errorf("after %d logins: %d comparisons, %d of them dummy; want %d each", i, stats.Compare.Count, stats.DummyCompares, i)
+		}
+	}
+	// The dummy hash is made once, on first use, and never again
+	if got := counting.hashes.Load(); got != 1 {
+		t.Errorf("%d dummy hashes made, want 1", got)
+	}
+
+	// A wrong password for a real user is one comparison too
+	before := svc.HashingStats().Compare.Count
+	if _, err := svc.Login(ctx, "alice", "wrong horse battery", ClientInfo{}, true); !errors.Is(err, ErrLoginFailed) {
+		t.Fatalf("wrong password: got %v, want ErrLoginFailed", err)
+	}
+	if got := svc.HashingStats().Compare.Count - before; got != 1 {
+		t.Errorf("wrong password: %d comparisons, want 1", got)
+	}
+}
+
+// TestLockoutTreatsUnknownNamesAlike fails logins as a registered user and
+// as a name nobody has, from one address, past LOGIN_MAX_FAILURES. Both
+// lock at the same attempt with the same wait, both comparisons are made
+// up to then, and both locks end together. Another address is never
+// locked.
+func TestLockoutTreatsUnknownNamesAlike(t *testing.T) {
+	svc, st, clk := newTestService(t, "LOGIN_MAX_FAILURES", "3", "LOGIN_LOCKOUT_MINUTES", "15")
+	ctx := context.Background()
+	hash, err := passwords.Bcrypt{Cost: 4}.Hash([]byte("correct horse battery"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.RegisterUser(ctx, "alice", hash, nil); err != nil {
+		t.Fatal(err)
+	}
+	from := ClientInfo{IP: "192.0.2.1"}
+
+	for i := 1; i <= 4; i++ {
+		for _, name := range []string{"alice", "nobody"} {
+			before := svc.HashingStats().Compare.Count
+			_, err := svc.Login(ctx, name, "wrong horse battery", from, true)
+			compared := svc.HashingStats().Compare.Count - before
+			if i <= 3 {
+				if err != ErrLoginFailed || compared != 1 {
+					t.Fatalf("%s, attempt %d: %v with %d comparisons; want ErrLoginFailed with 1", name, i, err, compared)
+				}
+				continue
+			}
+			var e *Error
+			if !errors.As(err, &e) || e.Kind != KindRateLimited || e.Details["code"] != CodeLoginLocked {
+				t.Fatalf("%s, attempt %d: got %v, want login_locked", name, i, err)
+			}
+			if wait := e.Details["retry_after_seconds"]; wait != 15*60 {
+				t.Errorf("%s: retry_after_seconds = %v, want %d", name, wait, 15*60)
+			}
+			if compared != 0 {
+				t.Errorf("%s: a locked attempt made %d comparisons", name, compared)
+			}
+		}
+	}
+
+	// Another address isn't locked, for either name
+	for _, name := range []string{"alice", "nobody"} {
+		if _, err := svc.Login(ctx, name, "wrong horse battery", ClientInfo{IP: "192.0.2.2"}, true); err != ErrLoginFailed {
+			t.Errorf("%s from another address: got %v, want ErrLoginFailed", name, err)
+		}
+	}
+
+	// Both locks end together, and a correct password then works
+	clk.Advance(15 * time.Minute)
+	if _, err := svc.Login(ctx, "nobody", "wrong horse battery", from, true); err != ErrLoginFailed {
+		t.Errorf("nobody after the lockout: got %v, want ErrLoginFailed", err)
+	}
+	if _, err := svc.Login(ctx, "alice", "correct horse battery", from, true); err != nil {
+		t.Errorf("alice after the lockout: %v", err)
+	}
+}
+
+// TestLockoutWindows moves the fake clock through a failure count and a
+// lock: a count expires once LOGIN_LOCKOUT_MINUTES pass without another
+// attempt, and a lock's Retry-After counts down until it ends.
+func TestLockoutWindows(t *testing.T) {
+	svc, _, clk := newTestService(t, "LOGIN_MAX_FAILURES", "3", "LOGIN_LOCKOUT_MINUTES", "15")
+	ctx := context.Background()
+	from := ClientInfo{IP: "192.0.2.1"}
+	fail := func() error {
+		_, err := svc.Login(ctx, "nobody", "wrong horse battery", from, true)
+		return err
+	}
+	retryAfter := func(err error) interface{} {
+		var e *Error
+		if !errors.As(err, &e) || e.Details["code"] != CodeLoginLocked {
+			return nil
+		}
+		return e.Details["retry_after_seconds"]
+	}
+
+	// Two failures, then a quiet window: the count starts over
+	for i := 0; i < 2; i++ {
+		if err := fail(); err != ErrLoginFailed {
+			t.Fatalf("early failure %d: %v", i+1, err)
+		}
+	}
+	clk.Advance(15 * time.Minute)
+	for i := 0; i < 3; i++ {
+		if err := fail(); err != ErrLoginFailed {
+			t.Fatalf("failure %d after the count expired: got %v, want ErrLoginFailed", i+1, err)
+		}
+	}
+
+	// That was three in a row, so the next attempt is locked out
+	if wait := retryAfter(fail()); wait != 15*60 {
+		t.Fatalf("locked: retry_after_seconds = %v, want %d", wait, 15*60)
+	}
+	clk.Advance(10 * time.Minute)
+	if wait := retryAfter(fail()); wait != 5*60 {
+		t.Errorf("10 minutes in: retry_after_seconds = %v, want %d", wait, 5*60)
+	}
+	clk.Advance(5*time.Minute - time.Second)
+	if wait := retryAfter(fail()); wait != 1 {
+		t.Errorf("a second before the end: retry_after_seconds = %v, want 1", wait)
+	}
+	clk.Advance(time.Second)
+	if err := fail(); err != ErrLoginFailed {
+		t.Errorf("after the lock: got %v, want ErrLoginFailed", err)
+	}
+}
+
+// TestLoginLookupFailureIsNotAWrongPassword logs in while the database is
+// unreachable. The answer must be an internal or unavailable error, so the
+// client can retry, and not ErrLoginFailed; no dummy comparison is made.
+func TestLoginLookupFailureIsNotAWrongPassword(t *testing.T) {
+	// Without the lockout, the user lookup is the first database call
+	svc, st, _ := newTestService(t, "LOGIN_MAX_FAILURES", "0")
+	st.Close()
+
+	_, err := svc.Login(context.Background(), "alice", "correct horse battery", ClientInfo{}, true)
+	if err == ErrLoginFailed {
+		t.Fatal("a failed lookup was answered as a wrong password")
+	}
+	if kind := KindOf(err); kind != KindInternal && kind != KindUnavailable {
+		t.Errorf("got %v (kind %d), want an internal or unavailable error", err, kind)
+	}
+	if n := svc.HashingStats().DummyCompares; n != 0 {
+		t.Errorf("%d dummy comparisons for a failed lookup", n)
+	}
+}
@@ -0,0 +1,113 @@
+// src/chatservice/backup.go
+package chatservice
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"cryptachat-server/store"
+)
+
+const (
+	// maxBackupBytes caps the stored (client-encrypted) backup blob.
+	maxBackupBytes = 1 << 20
+	// Backup retrieval is the most sensitive read on the server: the blob is
+	// an offline-crackable target, so fetches are few and every attempt is audited.
+	backupFetchLimit  = 5
+	backupFetchWindow = 24 * time.Hour
+)
+
+// Audit event types for backups.
+const (
+	auditBackupUploaded    = "backup.uploaded"
+	auditBackupFetched     = "backup.fetched"
+	auditBackupFetchDenied = "backup.fetch_denied"
+	auditBackupDeleted     = "backup.deleted"
+)
+
+// audit records an event, logging (but not failing on) store errors.
+func (s *Service) audit(ctx context.Context, userID int, eventType string, details map[string]interface{}) {
+	if err := s.store.RecordAuditEvent(ctx, userID, eventType, details); err != nil {
+		log.Printf("AUDIT: could not record %s for user %d: %v", eventType, userID, err)
+	}
+}
+
+// requireBackups fails if the instance has backups switched off.
+func (s *Service) requireBackups() error {
+	if !s.caps.KeyBackups.Enabled {
+		return forbidden("Key backups are disabled on this instance.")
+	}
+	return nil
+}
+
+// PutBackup stores a new version of the user's encrypted key backup.
+// Only the newest three versions are kept.
+func (s *Service) PutBackup(ctx context.Context, userID int, blob string) (int, error) {
+	if err := s.requireBackups(); err != nil {
+		return 0, err
+	}
+	if blob == "" {
+		return 0, invalid("Missing blob")
+	}
+	if len(blob) > maxBackupBytes {
+		return 0, tooLarge("Backup blob exceeds the 1048576 byte limit.")
+	}
+
+	version, err := s.store.PutKeyBackup(ctx, userID, blob)
+	if err != nil {
+		return 0, internal(err)
+	}
+	s.audit(ctx, userID, auditBackupUploaded, map[string]interface{}{"version": version, "bytes": len(blob)})
+	return version, nil
+}
+
+// GetBackup returns the newest backup after re-checking the user's password.
+// Attempts are rate-limited per user whether or not the password is right.
+func (s *Service) GetBackup(ctx context.Context, user *store.User, password string) (*store.KeyBackup, error) {
+	if err := s.requireBackups(); err != nil {
+		return nil, err
+	}
+
+	if ok, retryAfter := s.backupLimiter.Allow(strconv.Itoa(user.ID)); !ok {
+		s.audit(ctx, user.ID, auditBackupFetchDenied, map[string]interface{}{"reason": "rate_limited"})
+		return nil, rateLimited("Too many backup requests. Try again later.", retryAfter)
+	}
+
+	err := unauthorized("Password confirmation failed.")
+	if password != "" {
+		err = s.checkPassword(ctx, user, password)
+	}
+	if err != nil {
+		if KindOf(err) == KindUnavailable {
+			return nil, err
+		}
+		s.audit(ctx, user.ID, auditBackupFetchDenied, map[string]interface{}{"reason": "bad_password"})
+		return nil, unauthorized("Password confirmation failed.")
+	}
+
+	backup, err := s.store.GetLatestKeyBackup(ctx, user.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, notFound("No backup stored.")
+		}
+		return nil, internal(err)
+	}
+	s.audit(ctx, user.ID, auditBackupFetched, map[string]interface{}{"version": backup.Version})
+	return backup, nil
+}
+
+// DeleteBackup removes every stored backup version for the user.
+func (s *Service) DeleteBackup(ctx context.Context, userID int) error {
+	deleted, err := s.store.DeleteKeyBackups(ctx, userID)
+	if err != nil {
+		return internal(err)
+	}
+	if deleted == 0 {
+		return notFound("No backup stored.")
+	}
+	s.audit(ctx, userID, auditBackupDeleted, map[string]interface{}{"versions": deleted})
+	return nil
+}
@@ -0,0 +1,104 @@
+// src/chatservice/badges.go
+package chatservice
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cryptachat-server/integrations"
+	"cryptachat-server/store"
+)
+
+// badgeTTL is how long a user's badge counts are served from cache. It is
+// short because the counts change with every message, but long enough that a
+// burst of messages to one user costs one aggregate query.
+const badgeTTL = 2 * time.Second
+
+// badgeEntry is one user's cached counts.
+type badgeEntry struct {
+	counts store.BadgeCounts
+	at     time.Time
+}
+
+// badgeCache holds recently computed badge counts per user.
+type badgeCache struct {
+	mu      sync.Mutex
+	entries map[int]badgeEntry
+}
+
+func (c *badgeCache) get(userID int, now time.Time) (store.BadgeCounts, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[userID]
+	if !ok || now.Sub(entry.at) >= badgeTTL {
+		return store.BadgeCounts{}, false
+	}
+	return entry.counts, true
+}
+
+func (c *badgeCache) put(userID int, counts store.BadgeCounts, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[int]badgeEntry)
+	}
+	// Drop expired entries so the map doesn't grow with every user ever seen
+	for id, entry := range c.entries {
+		if now.Sub(entry.at) >= badgeTTL {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[userID] = badgeEntry{counts: counts, at: now}
+}
+
+// UnreadCounts returns the user's unread message and pending request counts,
+// cached for badgeTTL. GET /unread_counts and push payloads share it.
+func (s *Service) UnreadCounts(ctx context.Context, userID int) (store.BadgeCounts, error) {
+	now := s.clock.Now()
+	if counts, ok := s.badges.get(userID, now); ok {
+		return counts, nil
+	}
+
+	counts, err := s.store.CountBadge(ctx, userID)
+	if err != nil {
+		return store.BadgeCounts{}, internal(err)
+	}
+	s.badges.put(userID, counts, now)
+	return counts, nil
+}
+
+// PushPayload builds the push_ping fields for userID, before the privacy
+// filter. The badge counts are left out if the user turned them off, so the
+// ping then carries no numbers at all.
+func (s *Service) PushPayload(ctx context.Context, userID int) (map[string]interface{}, error) {
+	fields := map[string]interface{}{
+		"event":        integrations.EventPushPing,
+		"recipient_id": userID,
+		"timestamp":    store.NewTimestamp(s.clock.Now()),
+	}
+
+	settings, err := s.store.GetUserSettings(ctx, userID)
+	if err != nil {
+		return nil, internal(err)
+	}
+	if !settings.PushBadgeCounts {
+		return fields, nil
+	}
+
+	counts, err := s.UnreadCounts(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	fields["badge_unread"] = counts.Unread
+	fields["badge_pending_requests"] = counts.PendingRequests
+	return fields, nil
+}
+
+// SetPushBadgeCounts stores whether push payloads may carry the user's counts.
+func (s *Service) SetPushBadgeCounts(ctx context.Context, userID int, enabled bool) error {
+	if err := s.store.SetPushBadgeCounts(ctx, userID, enabled); err != nil {
+		return internal(err)
+	}
+	return nil
+}
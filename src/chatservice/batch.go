@@ -0,0 +1,171 @@
+// src/chatservice/batch.go
+package chatservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"cryptachat-server/store"
+)
+
+// MaxBatchSize is the most items a single batch request may contain.
+const MaxBatchSize = 100
+
+// Per-item batch statuses.
+const (
+	BatchOK          = "ok"
+	BatchInvalid     = "invalid"
+	BatchNotFound    = "not_found"
+	BatchConflict    = "conflict"
+	BatchForbidden   = "forbidden"
+	BatchRateLimited = "rate_limited"
+	BatchDuplicate   = "duplicate"
+	BatchError       = "error"
+)
+
+// BatchItem is the outcome for one item of a batch request. Key echoes the
+// item as the client sent it. Value carries per-item data on success
+// (e.g. a public key).
+type BatchItem struct {
+	Key     interface{} `json:"key"`
+	Status  string      `json:"status"`
+	Code    string      `json:"code,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+}
+
+// checkBatch validates the batch envelope. Errors here reject the whole
+// request; everything else is reported per item.
+func checkBatch(field string, n int) error {
+	if n == 0 {
+		return invalid("Missing %s", field)
+	}
+	if n > MaxBatchSize {
+		return invalid("Too many items in %s: %d (max %d)", field, n, MaxBatchSize)
+	}
+	return nil
+}
+
+// runBatch calls fn once per distinct key, in order. Repeats of a key are
+// not processed again and are reported as duplicates.
+func runBatch[K comparable](keys []K, fn func(K) BatchItem) []BatchItem {
+	results := make([]BatchItem, 0, len(keys))
+	seen := make(map[K]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			results = append(results, BatchItem{
+				Key:     k,
+				Status:  BatchDuplicate,
+				Code:    "duplicate_in_batch",
+				Message: "Item already appears earlier in this batch.",
+			})
+			continue
+		}
+		seen[k] = true
+		results = append(results, fn(k))
+	}
+	return results
+}
+
+// batchItemFromError converts a service error into a per-item result.
+// notFoundCode names what was missing for this endpoint.
+func batchItemFromError(key interface{}, err error, notFoundCode string) BatchItem {
+	item := BatchItem{Key: key, Message: err.Error()}
+	switch KindOf(err) {
+	case KindInvalid:
+		item.Status, item.Code = BatchInvalid, "invalid"
+	case KindNotFound:
+		item.Status, item.Code = BatchNotFound, notFoundCode
+	case KindConflict:
+		item.Status, item.Code = BatchConflict, "conflict"
+	case KindForbidden:
+		item.Status, item.Code = BatchForbidden, "forbidden"
+	case KindRateLimited:
+		item.Status, item.Code = BatchRateLimited, "rate_limited"
+		var svcErr *Error
+		if errors.As(err, &svcErr) {
+			if code, ok := svcErr.Details["code"].(string); ok {
+				item.Code = code
+			}
+		}
+	default:
+		// Don't leak store errors item by item
+		item.Status, item.Code, item.Message = BatchError, "internal", "Internal error."
+	}
+	return item
+}
+
+// AcceptChats accepts pending requests from each of requesterUsernames.
+func (s *Service) AcceptChats(ctx context.Context, userID int, requesterUsernames []string) ([]BatchItem, error) {
+	if err := checkBatch("requester_usernames", len(requesterUsernames)); err != nil {
+		return nil, err
+	}
+	return runBatch(requesterUsernames, func(name string) BatchItem {
+		if err := s.AcceptChat(ctx, userID, name); err != nil {
+			return batchItemFromError(name, err, "no_pending_request")
+		}
+		return BatchItem{Key: name, Status: BatchOK}
+	}), nil
+}
+
+// GetKeys fetches the public keys of each of usernames for userID. Each
+// non-contact counts against the key scraping limit; once it is reached the
+// remaining non-contacts fail with rate_limited.
+func (s *Service) GetKeys(ctx context.Context, userID int, usernames []string) ([]BatchItem, error) {
+	if err := checkBatch("usernames", len(usernames)); err != nil {
+		return nil, err
+	}
+	exempt, err := s.keyFetchExempt(ctx, userID)
+	if err != nil {
+		return nil, internal(err)
+	}
+	return runBatch(usernames, func(name string) BatchItem {
+		key, err := s.getKey(ctx, userID, name, exempt)
+		if err != nil {
+			return batchItemFromError(name, err, "key_not_found")
+		}
+		return BatchItem{Key: name, Status: BatchOK, Value: key}
+	}), nil
+}
+
+// MarkDelivered records that userID's client has received each of
+// messageIDs, optionally via the given transport (the message's "transport"
+// field). Only the recipient of a message can mark it; marking twice keeps
+// the first receipt.
+func (s *Service) MarkDelivered(ctx context.Context, userID int, messageIDs []int, via string) ([]BatchItem, error) {
+	if err := checkBatch("message_ids", len(messageIDs)); err != nil {
+		return nil, err
+	}
+	if via != "" && !store.ValidTransport(via) {
+		return nil, invalid("Unknown via %q (expected %s or %s)", via, store.TransportWSLive, store.TransportPoll)
+	}
+
+	// IDs outside the column's range can't exist; leave them out of the
+	// query so they fail as not found instead of failing the whole batch
+	valid := make([]int, 0, len(messageIDs))
+	for _, id := range messageIDs {
+		if id > 0 && id <= math.MaxInt32 {
+			valid = append(valid, id)
+		}
+	}
+
+	// Receipts are written behind, in batches with other users'
+	marked, err := s.store.QueueMessagesDelivered(ctx, userID, valid, via)
+	if err != nil {
+		return nil, internal(err)
+	}
+	s.observeDelivery(marked, via)
+	ok := make(map[int]bool, len(marked))
+	for _, r := range marked {
+		ok[r.MessageID] = true
+	}
+
+	return runBatch(messageIDs, func(id int) BatchItem {
+		if !ok[id] {
+			return batchItemFromError(id, notFound(fmt.Sprintf("No message %d addressed to you.", id)), "message_not_found")
+		}
+		return BatchItem{Key: id, Status: BatchOK}
+	}), nil
+}
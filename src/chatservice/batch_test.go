@@ -0,0 +1,144 @@
+// src/chatservice/batch_test.go
+package chatservice
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestBatchItemFromError checks the status and code each kind of error is
+// reported under, and that store errors aren't passed on.
+func TestBatchItemFromError(t *testing.T) {
+	tests := []struct {
+		err          error
+		status, code string
+	}{
+		{invalid("bad"), BatchInvalid, "invalid"},
+		{notFound("gone"), BatchNotFound, "thing_not_found"},
+		{conflict("taken"), BatchConflict, "conflict"},
+		{forbidden("no"), BatchForbidden, "forbidden"},
+		{rateLimited("slow down", 0), BatchRateLimited, "rate_limited"},
+		{recipientRateLimited(), BatchRateLimited, CodeRecipientRateLimited},
+		{errors.New("database error: connection refused"), BatchError, "internal"},
+	}
+	for _, tt := range tests {
+		item := batchItemFromError("k", tt.err, "thing_not_found")
+		if item.Key != "k" || item.Status != tt.status || item.Code != tt.code {
+			t.Errorf("%v: %+v, want status %s and code %s", tt.err, item, tt.status, tt.code)
+		}
+	}
+	if item := batchItemFromError("k", errors.New("database error: secret"), ""); strings.Contains(item.Message, "secret") {
+		t.Errorf("a store error was passed on: %q", item.Message)
+	}
+}
+
+// TestRunBatchReportsRepeats checks each key is handled once, in order,
+// and each repeat is reported where it appears.
+func TestRunBatchReportsRepeats(t *testing.T) {
+	var handled []string
+	items := runBatch([]string{"a", "b", "a", "c", "b", "a"}, func(k string) BatchItem {
+		handled = append(handled, k)
+		return BatchItem{Key: k, Status: BatchOK}
+	})
+	if strings.Join(handled, " ") != "a b c" {
+		t.Errorf("handled %v, want a b c", handled)
+	}
+	want := []string{BatchOK, BatchOK, BatchDuplicate, BatchOK, BatchDuplicate, BatchDuplicate}
+	for i, item := range items {
+		if item.Status != want[i] {
+			t.Errorf("item %d (%v): %s, want %s", i, item.Key, item.Status, want[i])
+		}
+	}
+
+	if err := checkBatch("usernames", 0); KindOf(err) != KindInvalid {
+		t.Errorf("an empty batch: %v, want it refused", err)
+	}
+	if err := checkBatch("usernames", MaxBatchSize+1); KindOf(err) != KindInvalid {
+		t.Errorf("%d items: %v, want it refused", MaxBatchSize+1, err)
+	}
+	if err := checkBatch("usernames", MaxBatchSize); err != nil {
+		t.Errorf("%d items: %v", MaxBatchSize, err)
+	}
+}
+
+// TestBatchEndpointsMixedOutcomes sends batches where every item has a
+// different outcome, with repeats, and checks each is reported on its own
+// without failing the others.
+func TestBatchEndpointsMixedOutcomes(t *testing.T) {
+	svc, st, _ := newTestService(t)
+	ctx := context.Background()
+	ids := make(map[string]int)
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		if err := st.RegisterUser(ctx, name, "hash", nil); err != nil {
+			t.Fatal(err)
+		}
+		id, err := st.GetUserIDByUsername(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+	for _, r := range [][2]string{{"alice", "bob"}, {"carol", "bob"}, {"bob", "dave"}} {
+		if _, err := svc.RequestChat(ctx, ids[r[0]], r[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := svc.DeclineChat(ctx, ids["bob"], "carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(what string, items []BatchItem, want [][2]string) {
+		t.Helper()
+		if len(items) != len(want) {
+			t.Fatalf("%s: %d results, want %d", what, len(items), len(want))
+		}
+		for i, item := range items {
+			if item.Status != want[i][0] || item.Code != want[i][1] {
+				t.Errorf("%s, item %d (%v): %s/%s, want %s/%s",
+					what, i, item.Key, item.Status, item.Code, want[i][0], want[i][1])
+			}
+		}
+	}
+
+	items, err := svc.AcceptChats(ctx, ids["bob"], []string{"alice", "carol", "dave", "erin", "nobody", "bob", "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("accepting", items, [][2]string{
+		{BatchOK, ""},
+		{BatchConflict, "conflict"},           // Declined
+		{BatchInvalid, "invalid"},             // bob sent it
+		{BatchNotFound, "no_pending_request"}, // No request
+		{BatchNotFound, "no_pending_request"}, // No such user
+		{BatchInvalid, "invalid"},             // bob's own name
+		{BatchDuplicate, "duplicate_in_batch"},
+	})
+	// The repeat didn't undo or redo the first
+	if contacts, err := svc.GetContacts(ctx, ids["bob"]); err != nil || len(contacts) != 1 || contacts[0] != "alice" {
+		t.Errorf("bob's contacts %v (%v), want alice", contacts, err)
+	}
+
+	sent, err := svc.SendMessage(ctx, ids["alice"], SendMessageRequest{RecipientUsername: "bob", SenderBlob: "c2VuZGVy", RecipientBlob: "cmVjaXBpZW50"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err = svc.MarkDelivered(ctx, ids["bob"], []int{sent.MessageID, sent.MessageID, 0, -1, sent.MessageID + 1000}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("marking delivered", items, [][2]string{
+		{BatchOK, ""},
+		{BatchDuplicate, "duplicate_in_batch"},
+		{BatchNotFound, "message_not_found"},
+		{BatchNotFound, "message_not_found"},
+		{BatchNotFound, "message_not_found"},
+	})
+	// Only the recipient can mark a message
+	items, err = svc.MarkDelivered(ctx, ids["alice"], []int{sent.MessageID}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("marking someone else's", items, [][2]string{{BatchNotFound, "message_not_found"}})
+}
@@ -0,0 +1,155 @@
+// src/chatservice/capabilities.go
+package chatservice
+
+import (
+	"cryptachat-server/config"
+	"cryptachat-server/contactdoc"
+)
+
+// capabilitiesSchema is bumped whenever the shape of Capabilities changes.
+const capabilitiesSchema = 8
+
+// Capabilities is the single registry of optional features for this instance.
+// GET /server_info advertises it, and handlers for optional features consult
+// it (not the raw config), so the advertisement can't drift from enforcement.
+type Capabilities struct {
+	Schema           int                    `json:"capabilities_schema"`
+	PaddingBuckets   []int                  `json:"padding_buckets"`
+	Prekeys          bool                   `json:"prekeys"`
+	Attachments      AttachmentsFeature     `json:"attachments"`
+	GroupChat        bool                   `json:"group_chat"`
+	RegistrationMode string                 `json:"registration_mode"` // See RegistrationMode
+	InviteRequired   bool                   `json:"invite_required_registration"`
+	MinClientVersion string                 `json:"min_client_version,omitempty"`
+	WSClusterMode    bool                   `json:"ws_cluster_mode"`
+	PayloadLimits    map[string]int64       `json:"payload_limits"`
+	KeyBackups       BackupsFeature         `json:"key_backups"`
+	RecoveryEmail    bool                   `json:"recovery_email"`
+	SealedSender     bool                   `json:"sealed_sender"`
+	ContactExport    ContactExportFeature   `json:"contact_export"`
+	SharePayload     SharePayloadFeature    `json:"share_payload"`
+	Federation       FederationFeature      `json:"federation"`
+	RegistrationPoW  RegistrationPoWFeature `json:"registration_pow"`
+}
+
+// RegistrationPoWFeature describes the proof of work /register requires
+// when enabled: a challenge from /register_challenge, solved at Bits
+// leading zero bits within TTLSeconds.
+type RegistrationPoWFeature struct {
+	Enabled    bool `json:"enabled"`
+	Bits       int  `json:"bits,omitempty"`
+	TTLSeconds int  `json:"ttl_seconds,omitempty"`
+}
+
+// FederationFeature describes relaying to other instances. Name is the
+// host in this instance's users' addresses; Peers are the hosts whose users
+// can be reached as user@host.
+type FederationFeature struct {
+	Enabled bool     `json:"enabled"`
+	Name    string   `json:"name,omitempty"`
+	Peers   []string `json:"peers,omitempty"`
+}
+
+// ContactExportFeature describes contact export and import. SignerKey is
+// the key this instance signs exports with, for comparing against a
+// document's signer_key.
+type ContactExportFeature struct {
+	SignerKey     string `json:"signer_key"`
+	MaxContacts   int    `json:"max_contacts"`
+	ImportPerHour int    `json:"import_per_hour"`
+}
+
+// SharePayloadFeature describes QR code and share link payloads. SignerKey
+// verifies them offline; it is the same key that signs contact exports.
+type SharePayloadFeature struct {
+	SignerKey  string `json:"signer_key"`
+	TTLSeconds int    `json:"ttl_seconds"`
+}
+
+// BackupsFeature describes encrypted key backup support.
+type BackupsFeature struct {
+	Enabled  bool `json:"enabled"`
+	MaxBytes int  `json:"max_bytes,omitempty"`
+}
+
+// AttachmentsFeature describes attachment uploads: up to MaxBytes, sent in
+// chunks of ChunkBytes that must all arrive within UploadTTLSeconds.
+type AttachmentsFeature struct {
+	Enabled          bool  `json:"enabled"`
+	MaxBytes         int64 `json:"max_bytes,omitempty"`
+	ChunkBytes       int   `json:"chunk_bytes,omitempty"`
+	UploadTTLSeconds int   `json:"upload_ttl_seconds,omitempty"`
+}
+
+// newCapabilities assembles the registry from config and compiled-in features.
+// Features that don't exist in this build are always advertised as off.
+func newCapabilities(cfg *config.Config) *Capabilities {
+	buckets := cfg.PaddingBuckets
+	if buckets == nil {
+		buckets = []int{}
+	}
+
+	return &Capabilities{
+		Schema:           capabilitiesSchema,
+		PaddingBuckets:   buckets,
+		Prekeys:          false,
+		Attachments:      attachmentsFeature(cfg),
+		GroupChat:        false,
+		MinClientVersion: cfg.MinClientVersion,
+		WSClusterMode:    false,
+		PayloadLimits:    cfg.PayloadLimits,
+		KeyBackups:       backupsFeature(cfg),
+		RecoveryEmail:    cfg.MailEnabled(),
+		SealedSender:     cfg.SealedSender,
+		ContactExport: ContactExportFeature{
+			SignerKey:     contactdoc.PublicKey(contactdoc.SigningKey(cfg.JWTSecret)),
+			MaxContacts:   contactdoc.MaxContacts,
+			ImportPerHour: cfg.ContactImportPerHour,
+		},
+		SharePayload: SharePayloadFeature{
+			SignerKey:  contactdoc.PublicKey(contactdoc.SigningKey(cfg.JWTSecret)),
+			TTLSeconds: int(sharePayloadTTL.Seconds()),
+		},
+		Federation: FederationFeature{
+			Enabled: cfg.FederationEnabled(),
+			Name:    cfg.FederationName,
+			Peers:   cfg.FederationPeerNames(),
+		},
+		RegistrationPoW: registrationPoWFeature(cfg),
+	}
+}
+
+// PaddingEnforced reports whether blobs must match a padding bucket.
+func (c *Capabilities) PaddingEnforced() bool {
+	return len(c.PaddingBuckets) > 0
+}
+
+func registrationPoWFeature(cfg *config.Config) RegistrationPoWFeature {
+	if cfg.RegistrationPoWBits == 0 {
+		return RegistrationPoWFeature{}
+	}
+	return RegistrationPoWFeature{
+		Enabled:    true,
+		Bits:       cfg.RegistrationPoWBits,
+		TTLSeconds: int(cfg.RegistrationPoWTTL.Seconds()),
+	}
+}
+
+func backupsFeature(cfg *config.Config) BackupsFeature {
+	if !cfg.BackupsEnabled {
+		return BackupsFeature{}
+	}
+	return BackupsFeature{Enabled: true, MaxBytes: maxBackupBytes}
+}
+
+func attachmentsFeature(cfg *config.Config) AttachmentsFeature {
+	if !cfg.AttachmentsEnabled() {
+		return AttachmentsFeature{}
+	}
+	return AttachmentsFeature{
+		Enabled:          true,
+		MaxBytes:         cfg.Attachments.MaxBytes,
+		ChunkBytes:       cfg.Attachments.ChunkBytes,
+		UploadTTLSeconds: int(cfg.Attachments.UploadTTL.Seconds()),
+	}
+}
@@ -0,0 +1,297 @@
+// src/chatservice/chat.go
+package chatservice
+
+import (
+	"context"
+	"strings"
+
+	"cryptachat-server/integrations"
+	"cryptachat-server/store"
+)
+
+// ---- Keys ----
+
+// UploadKey upserts the user's public key.
+func (s *Service) UploadKey(ctx context.Context, userID int, publicKey string) error {
+	if publicKey == "" {
+		return invalid("Missing public_key")
+	}
+	if err := s.store.UploadPublicKey(ctx, userID, publicKey); err != nil {
+		return internal(err)
+	}
+	s.keyed.add(userID)
+
+	if user, err := s.store.GetUserByID(ctx, userID); err == nil {
+		s.invalidateContacts(ctx, userID, ScopeContactKeys, user.Username)
+	}
+	return nil
+}
+
+// GetKey fetches another user's public key for userID. Fetches for anyone
+// but userID's contacts count against the key scraping limit.
+func (s *Service) GetKey(ctx context.Context, userID int, username string) (string, error) {
+	if username == "" {
+		return "", invalid("Missing username query parameter.")
+	}
+	exempt, err := s.keyFetchExempt(ctx, userID)
+	if err != nil {
+		return "", internal(err)
+	}
+	return s.getKey(ctx, userID, username, exempt)
+}
+
+func (s *Service) getKey(ctx context.Context, userID int, username string, exempt map[string]bool) (string, error) {
+	if username == "" {
+		return "", invalid("Missing username")
+	}
+	if err := s.checkKeyFetch(userID, username, exempt); err != nil {
+		return "", err
+	}
+	local, peer, err := s.resolveAddress(ctx, username, false)
+	if err != nil {
+		return "", err
+	}
+	if peer != "" {
+		return s.fetchRemoteKey(ctx, local, peer)
+	}
+	key, err := s.store.GetPublicKeyByUsername(ctx, local)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return "", notFound("User not found or has no public key.")
+		}
+		return "", internal(err)
+	}
+	return key, nil
+}
+
+// ---- Chat Requests ----
+
+// RequestChat sends a chat request from userID to recipientUsername.
+// Requests that trip the spam heuristics are stored but shadow-filtered;
+// the requester sees the same response either way. If recipientUsername
+// already has a pending request to userID, that request is accepted
+// instead and accepted is true. New accounts are subject to the fan-out
+// limit (see checkFanout).
+func (s *Service) RequestChat(ctx context.Context, userID int, recipientUsername string) (accepted bool, err error) {
+	return s.requestChat(ctx, userID, recipientUsername, true)
+}
+
+// requestChat is RequestChat, applying the fan-out limit only if
+// limitFanout is set.
+func (s *Service) requestChat(ctx context.Context, userID int, recipientUsername string, limitFanout bool) (accepted bool, err error) {
+	if recipientUsername == "" {
+		return false, invalid("Missing recipient_username")
+	}
+	recipientUsername, _, err = s.resolveAddress(ctx, recipientUsername, true)
+	if err != nil {
+		return false, err
+	}
+	if limitFanout {
+		if err := s.checkFanout(ctx, userID, recipientUsername); err != nil {
+			return false, err
+		}
+	}
+
+	filterReason, err := s.classifyRequest(ctx, userID, recipientUsername)
+	if err != nil {
+		return false, internal(err)
+	}
+
+	accepted, err = s.store.RequestChat(ctx, userID, recipientUsername, filterReason)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "recipient user not found"):
+			return false, notFound("Recipient user not found.")
+		case strings.Contains(err.Error(), "already pending"):
+			return false, conflict("Chat request already pending or accepted.")
+		case strings.Contains(err.Error(), "yourself"):
+			return false, invalid("Cannot send chat request to yourself.")
+		}
+		return false, internal(err)
+	}
+
+	recipientID, err := s.store.GetUserIDByUsername(ctx, recipientUsername)
+	if err != nil {
+		return accepted, nil
+	}
+	if accepted {
+		s.invalidate(ctx, []int{userID}, ScopeChatRequests, "")
+		s.invalidate(ctx, []int{userID, recipientID}, ScopeContacts, "")
+		// Auto-accepted: the recipient had asked first
+		s.publishChatRequest(ctx, integrations.EventChatRequestAccepted, recipientID, userID)
+	} else if filterReason == "" {
+		// Filtered requests stay invisible to the recipient
+		s.invalidate(ctx, []int{recipientID}, ScopeChatRequests, "")
+		s.publishChatRequest(ctx, integrations.EventChatRequestCreated, userID, recipientID)
+		s.queuePush(recipientID)
+	}
+	return accepted, nil
+}
+
+// RelationshipsVersion returns the version of the user's contact and
+// request lists. Read it before the list it describes: a change that lands
+// in between then shows in the list but not the version, so the client
+// fetches again rather than keeping a stale list.
+func (s *Service) RelationshipsVersion(ctx context.Context, userID int) (int64, error) {
+	version, err := s.store.GetRelationshipsVersion(ctx, userID)
+	if err != nil {
+		return 0, internal(err)
+	}
+	return version, nil
+}
+
+// GetChatRequests lists the user's pending incoming requests, optionally
+// including the shadow-filtered ones.
+func (s *Service) GetChatRequests(ctx context.Context, userID int, includeFiltered bool) ([]store.PendingRequest, error) {
+	requests, err := s.store.GetChatRequests(ctx, userID, includeFiltered)
+	if err != nil {
+		return nil, internal(err)
+	}
+	return requests, nil
+}
+
+// AcceptChat accepts a pending request from requesterUsername. Accepting
+// one already accepted succeeds again without effect, so a retried accept
+// doesn't fail; accepting a request the user sent is invalid, and one that
+// was declined is a conflict.
+func (s *Service) AcceptChat(ctx context.Context, userID int, requesterUsername string) error {
+	if requesterUsername == "" {
+		return invalid("Missing requester_username")
+	}
+
+	accepted, err := s.store.AcceptChat(ctx, userID, requesterUsername)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "not found"), strings.Contains(err.Error(), "no chat request"):
+			return notFound("No chat request found from that user.")
+		case strings.Contains(err.Error(), "yourself"):
+			return invalid("Cannot accept a chat request from yourself.")
+		case strings.Contains(err.Error(), "you sent"):
+			return invalid("Cannot accept a chat request you sent; the recipient must accept it.")
+		case strings.Contains(err.Error(), "no longer pending"):
+			return conflict("Chat request from that user is no longer pending.")
+		}
+		return internal(err)
+	}
+	if !accepted {
+		return nil
+	}
+
+	s.invalidate(ctx, []int{userID}, ScopeChatRequests, "")
+	if requesterID, err := s.store.GetUserIDByUsername(ctx, requesterUsername); err == nil {
+		s.invalidate(ctx, []int{userID, requesterID}, ScopeContacts, "")
+		s.publishChatRequest(ctx, integrations.EventChatRequestAccepted, requesterID, userID)
+	}
+	return nil
+}
+
+// DeclineChat declines a pending request from requesterUsername.
+func (s *Service) DeclineChat(ctx context.Context, userID int, requesterUsername string) error {
+	if requesterUsername == "" {
+		return invalid("Missing requester_username")
+	}
+
+	err := s.store.DeclineChat(ctx, userID, requesterUsername)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return notFound("No pending request found from that user.")
+		}
+		return internal(err)
+	}
+
+	s.invalidate(ctx, []int{userID}, ScopeChatRequests, "")
+	return nil
+}
+
+// GetContacts lists the user's accepted chat partners.
+func (s *Service) GetContacts(ctx context.Context, userID int) ([]string, error) {
+	contacts, err := s.store.GetContacts(ctx, userID)
+	if err != nil {
+		return nil, internal(err)
+	}
+	return contacts, nil
+}
+
+// Conversation list page sizes.
+const (
+	defaultConversationsLimit = 50
+	MaxConversationsLimit     = 200
+)
+
+// ConversationsPage is one page of ListConversations. NextBefore is the
+// cursor for the following page, or 0 on the last page.
+type ConversationsPage struct {
+	Conversations []store.Conversation `json:"conversations"`
+	NextBefore    int                  `json:"next_before,omitempty"`
+}
+
+// ListConversations lists the user's conversations, most recent message
+// first, from below last message ID before (0 for the start). limit 0
+// means the default.
+func (s *Service) ListConversations(ctx context.Context, userID, before, limit int) (*ConversationsPage, error) {
+	if limit == 0 {
+		limit = defaultConversationsLimit
+	}
+	if limit < 0 || limit > MaxConversationsLimit {
+		return nil, invalid("limit must be between 1 and %d", MaxConversationsLimit)
+	}
+	if before < 0 {
+		return nil, invalid("before must not be negative")
+	}
+
+	// Fetch one extra row to learn whether there is another page
+	conversations, err := s.store.ListConversations(ctx, userID, before, limit+1)
+	if err != nil {
+		return nil, internal(err)
+	}
+
+	page := &ConversationsPage{Conversations: conversations}
+	if len(conversations) > limit {
+		page.Conversations = conversations[:limit]
+		page.NextBefore = conversations[limit-1].LastMessageID
+	}
+	if page.Conversations == nil {
+		page.Conversations = []store.Conversation{}
+	}
+	return page, nil
+}
+
+// Relationship page sizes.
+const (
+	defaultRelationshipsLimit = 50
+	MaxRelationshipsLimit     = 200
+)
+
+// RelationshipsPage is one page of GetRelationships. NextAfter is the
+// cursor for the following page, or "" on the last page.
+type RelationshipsPage struct {
+	Relationships []store.Relationship `json:"relationships"`
+	NextAfter     string               `json:"next_after,omitempty"`
+}
+
+// GetRelationships lists everyone the user has a chat request with, in
+// either direction, labelled by state. limit 0 means the default.
+func (s *Service) GetRelationships(ctx context.Context, userID int, after string, limit int) (*RelationshipsPage, error) {
+	if limit == 0 {
+		limit = defaultRelationshipsLimit
+	}
+	if limit < 0 || limit > MaxRelationshipsLimit {
+		return nil, invalid("limit must be between 1 and %d", MaxRelationshipsLimit)
+	}
+
+	// Fetch one extra row to learn whether there is another page
+	rels, err := s.store.GetRelationships(ctx, userID, after, limit+1)
+	if err != nil {
+		return nil, internal(err)
+	}
+
+	page := &RelationshipsPage{Relationships: rels}
+	if len(rels) > limit {
+		page.Relationships = rels[:limit]
+		page.NextAfter = rels[limit-1].Username
+	}
+	if page.Relationships == nil {
+		page.Relationships = []store.Relationship{}
+	}
+	return page, nil
+}
@@ -0,0 +1,155 @@
+// src/chatservice/contactimport.go
+package chatservice
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"cryptachat-server/contactdoc"
+	"cryptachat-server/keylog"
+	"cryptachat-server/store"
+)
+
+// ---- Contact Export and Import ----
+//
+// An export is a signed list of the user's accepted contacts. Importing it
+// on another instance sends each listed username an ordinary chat request,
+// paced by ContactImportPerHour; nobody becomes a contact without accepting
+// on this instance. Usernames are only meaningful per instance, so the
+// import records whether each recipient's current key matches the exported
+// fingerprint and leaves the judgement to the people involved.
+
+// Audit event types for contact migration.
+const (
+	auditContactsExported = "contacts.exported"
+	auditContactsImported = "contacts.import_started"
+)
+
+// ExportContacts builds and signs the user's contact export. issuer names
+// this instance (the Host the request was made to, plus any BASE_PATH).
+func (s *Service) ExportContacts(ctx context.Context, user *store.User, issuer string) (*contactdoc.Document, error) {
+	contacts, err := s.store.ExportContacts(ctx, user.ID)
+	if err != nil {
+		return nil, internal(err)
+	}
+
+	doc := &contactdoc.Document{
+		Version:    contactdoc.Version,
+		Issuer:     issuer,
+		Username:   user.Username,
+		ExportedAt: s.clock.Now().UTC().Format(time.RFC3339),
+		Contacts:   make([]contactdoc.Contact, 0, len(contacts)),
+	}
+	for _, c := range contacts {
+		entry := contactdoc.Contact{Username: c.Username, KeyFingerprint: c.KeyFingerprint}
+		if c.AcceptedAt != nil {
+			entry.AcceptedAt = c.AcceptedAt.UTC().Format(time.RFC3339)
+		}
+		doc.Contacts = append(doc.Contacts, entry)
+	}
+	if len(doc.Contacts) > contactdoc.MaxContacts {
+		return nil, tooLarge("Too many contacts to export in one document.")
+	}
+	if err := doc.Sign(s.exportKey); err != nil {
+		return nil, internal(err)
+	}
+
+	s.audit(ctx, user.ID, auditContactsExported, map[string]interface{}{"contacts": len(doc.Contacts)})
+	return doc, nil
+}
+
+// ImportContacts verifies an export document and queues a chat request to
+// each contact it lists. It returns the new import's ID.
+func (s *Service) ImportContacts(ctx context.Context, user *store.User, doc contactdoc.Document) (int, error) {
+	if err := doc.Verify(); err != nil {
+		return 0, invalid("Invalid contact export: %v", err)
+	}
+	if doc.SignerKey == s.caps.ContactExport.SignerKey {
+		return 0, invalid("This contact export was made on this instance.")
+	}
+
+	imp := store.NewContactImport{
+		SourceIssuer:   doc.Issuer,
+		SourceUsername: doc.Username,
+		SignerKey:      doc.SignerKey,
+	}
+	seen := make(map[string]bool, len(doc.Contacts))
+	for _, c := range doc.Contacts {
+		key := store.CanonicalUsername(c.Username)
+		if c.Username == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		imp.Usernames = append(imp.Usernames, c.Username)
+		imp.Fingerprints = append(imp.Fingerprints, c.KeyFingerprint)
+	}
+
+	interval := time.Hour / time.Duration(s.cfg.ContactImportPerHour)
+	id, err := s.store.CreateContactImport(ctx, user.ID, imp, interval)
+	if err != nil {
+		if strings.Contains(err.Error(), "already running") {
+			return 0, conflict("A contact import is already in progress.")
+		}
+		return 0, internal(err)
+	}
+
+	s.audit(ctx, user.ID, auditContactsImported, map[string]interface{}{
+		"import_id":   id,
+		"issuer":      doc.Issuer,
+		"signer":      doc.SignerFingerprint(),
+		"contacts":    len(imp.Usernames),
+		"from_user":   doc.Username,
+		"per_hour":    s.cfg.ContactImportPerHour,
+		"exported_at": doc.ExportedAt,
+	})
+	return id, nil
+}
+
+// GetContactImport returns the progress of one of the user's imports.
+func (s *Service) GetContactImport(ctx context.Context, userID, importID int) (*store.ContactImport, error) {
+	imp, err := s.store.GetContactImport(ctx, userID, importID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, notFound("Import not found.")
+		}
+		return nil, internal(err)
+	}
+	return imp, nil
+}
+
+// ProcessContactImportItem sends the chat request for one claimed import
+// item and records the outcome. It goes through RequestChat, so the usual
+// spam filtering applies. The new-account fan-out limit doesn't: imports
+// have their own pace, and a moved account is new by definition.
+func (s *Service) ProcessContactImportItem(ctx context.Context, item store.ContactImportItem) error {
+	status, detail := store.ImportItemRequested, ""
+	accepted, err := s.requestChat(ctx, item.UserID, item.Username, false)
+	switch {
+	case err == nil && accepted:
+		status = store.ImportItemAccepted
+	case err == nil:
+	case KindOf(err) == KindNotFound:
+		status, detail = store.ImportItemFailed, "not_found"
+	case KindOf(err) == KindConflict:
+		status, detail = store.ImportItemSkipped, "already_requested"
+	case KindOf(err) == KindInvalid:
+		status, detail = store.ImportItemSkipped, "self"
+	default:
+		// Leave the item claimed; it is retried once the claim times out
+		return err
+	}
+
+	var keyMatches *bool
+	if status != store.ImportItemFailed && item.KeyFingerprint != "" {
+		if publicKey, err := s.store.GetPublicKeyByUsername(ctx, item.Username); err == nil {
+			match := keylog.KeyHash(publicKey) == item.KeyFingerprint
+			keyMatches = &match
+		}
+	}
+
+	if err := s.store.FinishContactImportItem(ctx, item.ID, status, detail, keyMatches); err != nil {
+		return internal(err)
+	}
+	return nil
+}
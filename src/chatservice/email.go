@@ -0,0 +1,281 @@
+// src/chatservice/email.go
+package chatservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"log"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"cryptachat-server/mailer"
+	"cryptachat-server/store"
+)
+
+// Recovery email lets a user who lost their password reset it through an
+// address they proved they can read. Tokens are mailed, not linked: the
+// user pastes them into the app.
+
+const (
+	// emailVerifyTTL is how long a verification token works.
+	emailVerifyTTL = 24 * time.Hour
+	// passwordResetTTL is how long a reset token works.
+	passwordResetTTL = 30 * time.Minute
+	// maxEmailBytes is the longest address that can be delivered to.
+	maxEmailBytes = 254
+
+	// emailChangesPerDay limits PUT /email per user, since each change
+	// mails an address the user chose.
+	emailChangesPerDay = 5
+	// passwordResetsPerHour limits reset mails per address. Requests past
+	// it are dropped silently, like requests for unknown addresses.
+	passwordResetsPerHour = 3
+	// passwordResetAddresses caps the addresses resetLimiter tracks, since
+	// whoever asks chooses them.
+	passwordResetAddresses = 100_000
+	// maxPendingResets caps the resets looked up and mailed at once.
+	// Requests past it are dropped silently too, and logged.
+	maxPendingResets = 16
+)
+
+// Error codes of refused email and reset requests.
+const (
+	CodeEmailTokenInvalid = "email_token_invalid"
+	CodeEmailTaken        = "email_taken"
+	CodeResetTokenInvalid = "reset_token_invalid"
+)
+
+const auditPasswordReset = "account.password_reset"
+
+// EnableEmail turns on recovery email, sent through m.
+func (s *Service) EnableEmail(m mailer.Mailer) {
+	s.mailer = m
+}
+
+// requireEmail fails if the instance has no mailer.
+func (s *Service) requireEmail() error {
+	if s.mailer == nil {
+		return forbidden("Recovery email is disabled on this instance.")
+	}
+	return nil
+}
+
+// normalizeEmail checks that email is a single bare address.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	a, err := mail.ParseAddress(email)
+	if err != nil || a.Name != "" || a.Address != email || len(email) > maxEmailBytes {
+		return "", invalid("email must be a valid email address.")
+	}
+	return email, nil
+}
+
+// GetRecoveryEmail returns the user's recovery email, or nil if they have
+// none.
+func (s *Service) GetRecoveryEmail(ctx context.Context, userID int) (*store.RecoveryEmail, error) {
+	e, err := s.store.GetRecoveryEmail(ctx, userID)
+	if err != nil {
+		return nil, internal(err)
+	}
+	return e, nil
+}
+
+// SetRecoveryEmail replaces the user's recovery email and mails the new
+// address a verification token; it can't be used for resets until
+// verified. An empty email removes it. Setting the address already
+// verified changes nothing.
+func (s *Service) SetRecoveryEmail(ctx context.Context, user *store.User, email string) (*store.RecoveryEmail, error) {
+	if err := s.requireEmail(); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(email) == "" {
+		if err := s.store.DeleteRecoveryEmail(ctx, user.ID); err != nil {
+			return nil, internal(err)
+		}
+		return nil, nil
+	}
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := s.store.GetRecoveryEmail(ctx, user.ID)
+	if err != nil {
+		return nil, internal(err)
+	}
+	if current != nil && current.Verified && strings.EqualFold(current.Email, email) {
+		return current, nil
+	}
+	if ok, retryAfter := s.emailLimiter.Allow(strconv.Itoa(user.ID)); !ok {
+		return nil, rateLimited("You have changed your email too often. Try again later.", retryAfter)
+	}
+	if err := s.startEmailVerification(ctx, user, email); err != nil {
+		return nil, err
+	}
+	return &store.RecoveryEmail{Email: email}, nil
+}
+
+// startEmailVerification stores email unverified for user and mails it a
+// verification token.
+func (s *Service) startEmailVerification(ctx context.Context, user *store.User, email string) error {
+	token, err := newEmailToken()
+	if err != nil {
+		return internal(err)
+	}
+	if err := s.store.SetRecoveryEmail(ctx, user.ID, email, hashEmailToken(token), s.clock.Now().Add(emailVerifyTTL)); err != nil {
+		return internal(err)
+	}
+	s.sendMail(email, "Verify your recovery email", fmt.Sprintf(
+		"Someone, hopefully you, added this address as the recovery email of the account %s.\n\n"+
+			"To confirm it, enter this code in the app within 24 hours:\n\n    %s\n\n"+
+			"If it wasn't you, ignore this email and the address won't be used.\n",
+		user.Username, token))
+	return nil
+}
+
+// VerifyRecoveryEmail marks the address a verification token was mailed to
+// verified.
+func (s *Service) VerifyRecoveryEmail(ctx context.Context, token string) error {
+	if err := s.requireEmail(); err != nil {
+		return err
+	}
+	if strings.TrimSpace(token) == "" {
+		return invalid("Missing token")
+	}
+	if _, err := s.store.VerifyRecoveryEmail(ctx, hashEmailToken(token)); err != nil {
+		switch err.Error() {
+		case "email token not found":
+			return codedError(KindInvalid, "Verification code is not valid or has expired.", CodeEmailTokenInvalid)
+		case "email already verified":
+			return codedError(KindConflict, "This email is already the recovery email of another account.", CodeEmailTaken)
+		}
+		return internal(err)
+	}
+	return nil
+}
+
+// RequestPasswordReset mails a reset token to email if an account has
+// verified it. The caller learns nothing either way: the lookup and the
+// mail happen after it returns, and unknown addresses, like addresses
+// asked for too often or requests past maxPendingResets, are skipped
+// silently.
+func (s *Service) RequestPasswordReset(ctx context.Context, email string) error {
+	if err := s.requireEmail(); err != nil {
+		return err
+	}
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	if ok, _ := s.resetLimiter.Allow(strings.ToLower(email)); !ok {
+		return nil
+	}
+	select {
+	case s.pendingResets <- struct{}{}:
+	default:
+		log.Printf("EMAIL: %d password resets already in progress; dropped one", maxPendingResets)
+		return nil
+	}
+
+	go func() {
+		defer func() { <-s.pendingResets }()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		token, err := newEmailToken()
+		if err != nil {
+			log.Printf("EMAIL: could not create reset token: %v", err)
+			return
+		}
+		username, to, err := s.store.CreatePasswordReset(ctx, email, hashEmailToken(token), s.clock.Now().Add(passwordResetTTL))
+		if err != nil {
+			if err.Error() != "email not found" {
+				log.Printf("EMAIL: could not store reset token: %v", err)
+			}
+			return
+		}
+		s.sendMail(to, "Reset your password", fmt.Sprintf(
+			"Someone, hopefully you, asked to reset the password of the account %s.\n\n"+
+				"To choose a new password, enter this code in the app within 30 minutes:\n\n    %s\n\n"+
+				"Resetting signs the account out everywhere. If it wasn't you, ignore this email; your password stays as it is.\n",
+			username, token))
+	}()
+	return nil
+}
+
+// ResetPassword sets a new password with a reset token and signs the user
+// out everywhere, returning their ID. The user logs in again afterwards,
+// so two-factor authentication still applies.
+func (s *Service) ResetPassword(ctx context.Context, token, newPassword string) (int, error) {
+	if err := s.requireEmail(); err != nil {
+		return 0, err
+	}
+	if strings.TrimSpace(token) == "" || newPassword == "" {
+		return 0, invalid("Missing token or new_password")
+	}
+	tokenErr := codedError(KindInvalid, "Reset code is not valid or has expired.", CodeResetTokenInvalid)
+
+	// Looked up first so the password is checked against the username
+	// before the token is used up
+	hash := hashEmailToken(token)
+	user, err := s.store.GetPasswordReset(ctx, hash)
+	if err != nil {
+		if err.Error() == "email token not found" {
+			return 0, tokenErr
+		}
+		return 0, internal(err)
+	}
+	passwordHash, err := s.hashPassword(ctx, user.Username, newPassword)
+	if err != nil {
+		return 0, err
+	}
+	userID, err := s.store.ResetPassword(ctx, hash, passwordHash)
+	if err != nil {
+		if err.Error() == "email token not found" {
+			return 0, tokenErr
+		}
+		return 0, internal(err)
+	}
+	s.audit(ctx, userID, auditPasswordReset, nil)
+	return userID, nil
+}
+
+// sendMail sends in the background, so slow relays hold up no request. A
+// failure is only logged; the user can ask again.
+func (s *Service) sendMail(to, subject, body string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := s.mailer.Send(ctx, to, subject, body); err != nil {
+			log.Printf("EMAIL: could not send %q: %v", subject, err)
+		}
+	}()
+}
+
+func codedError(kind Kind, msg, code string) error {
+	return &Error{Kind: kind, Message: msg, Details: map[string]interface{}{"code": code}}
+}
+
+// newEmailToken returns 20 random bytes as 32 base32 characters, in groups
+// of four like invite codes.
+func newEmailToken() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate email token: %w", err)
+	}
+	c := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	groups := make([]string, 0, len(c)/4)
+	for i := 0; i < len(c); i += 4 {
+		groups = append(groups, c[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// hashEmailToken is the form an email token is stored and looked up in.
+// As with invite codes, case and separators don't matter.
+func hashEmailToken(token string) []byte {
+	return hashInviteCode(token)
+}
@@ -0,0 +1,111 @@
+// src/chatservice/errors.go
+package chatservice
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"cryptachat-server/store"
+)
+
+// Kind classifies a service error so each transport can map it to its own
+// status codes.
+type Kind int
+
+const (
+	KindInternal Kind = iota
+	KindInvalid
+	KindUnauthorized
+	KindNotFound
+	KindConflict
+	KindForbidden
+	KindTooLarge
+	KindRateLimited
+	KindUnavailable
+)
+
+// Error is a service error with a client-safe message.
+type Error struct {
+	Kind    Kind
+	Message string
+	// Details are extra machine-readable fields for the client (optional).
+	Details map[string]interface{}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func invalid(format string, args ...interface{}) error {
+	return &Error{Kind: KindInvalid, Message: fmt.Sprintf(format, args...)}
+}
+
+func unauthorized(msg string) error {
+	return &Error{Kind: KindUnauthorized, Message: msg}
+}
+
+func notFound(msg string) error {
+	return &Error{Kind: KindNotFound, Message: msg}
+}
+
+func conflict(msg string) error {
+	return &Error{Kind: KindConflict, Message: msg}
+}
+
+func forbidden(msg string) error {
+	return &Error{Kind: KindForbidden, Message: msg}
+}
+
+func tooLarge(msg string) error {
+	return &Error{Kind: KindTooLarge, Message: msg}
+}
+
+// unavailable reports temporary overload; the client should retry shortly.
+func unavailable(msg string) error {
+	return &Error{Kind: KindUnavailable, Message: msg, Details: map[string]interface{}{"retry_after_seconds": 1}}
+}
+
+// rateLimited reports a rejected attempt; retryAfter is exposed to the client.
+func rateLimited(msg string, retryAfter time.Duration) error {
+	return &Error{
+		Kind:    KindRateLimited,
+		Message: msg,
+		Details: map[string]interface{}{"retry_after_seconds": int(math.Ceil(retryAfter.Seconds()))},
+	}
+}
+
+// CodeRecipientRateLimited is the error code of messages refused by the
+// recipient's inbound_messages_per_hour.
+const CodeRecipientRateLimited = "recipient_rate_limited"
+
+// recipientRateLimited refuses a message because the recipient's inbound
+// ceiling is reached. Neither the ceiling nor when it frees up is
+// disclosed, so senders can't probe the recipient's setting.
+func recipientRateLimited() error {
+	return &Error{
+		Kind:    KindRateLimited,
+		Message: "The recipient isn't accepting more messages right now. Try again later.",
+		Details: map[string]interface{}{"code": CodeRecipientRateLimited},
+	}
+}
+
+// internal wraps an unexpected error (usually from the store). Transient
+// database failures (store.IsTransient) become KindUnavailable instead, so
+// clients know the call is worth repeating.
+func internal(err error) error {
+	if store.IsTransient(err) {
+		return unavailable("The database is temporarily unavailable. Try again shortly.")
+	}
+	return &Error{Kind: KindInternal, Message: err.Error()}
+}
+
+// KindOf returns the kind of err, or KindInternal for non-service errors.
+func KindOf(err error) Kind {
+	var svcErr *Error
+	if errors.As(err, &svcErr) {
+		return svcErr.Kind
+	}
+	return KindInternal
+}
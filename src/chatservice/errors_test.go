@@ -0,0 +1,28 @@
+// src/chatservice/errors_test.go
+package chatservice
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// TestInternalTellsTransientFromPermanent checks a store failure worth
+// repeating becomes unavailable, with a retry hint that doesn't reveal the
+// database's error, and any other stays internal.
+func TestInternalTellsTransientFromPermanent(t *testing.T) {
+	transient := internal(fmt.Errorf("database error: %w", &pgconn.PgError{Code: "40001", Message: "could not serialize access"}))
+	e, ok := transient.(*Error)
+	if !ok || e.Kind != KindUnavailable || e.Details["retry_after_seconds"] != 1 {
+		t.Errorf("serialization failure: %#v, want unavailable with a retry hint", transient)
+	}
+	if strings.Contains(transient.Error(), "serialize") {
+		t.Errorf("the database's error was passed on: %q", transient)
+	}
+
+	if err := internal(fmt.Errorf("database error: %w", &pgconn.PgError{Code: "23505"})); KindOf(err) != KindInternal {
+		t.Errorf("unique violation: %v, want internal", err)
+	}
+}
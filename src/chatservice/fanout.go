@@ -0,0 +1,109 @@
+// src/chatservice/fanout.go
+package chatservice
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"cryptachat-server/store"
+)
+
+// CodeNewAccountFanoutLimited is the error code of chat requests and
+// messages refused because a new account has reached out to too many
+// people today.
+const CodeNewAccountFanoutLimited = "new_account_fanout_limited"
+
+// newAccountFanoutWindow is the period NewAccountFanoutLimit applies to.
+const newAccountFanoutWindow = 24 * time.Hour
+
+// FanoutStats counts how often the new-account fan-out limit has refused
+// a chat request or message.
+type FanoutStats struct {
+	Limit    int   `json:"limit"`     // Distinct recipients per day; 0 if disabled
+	AgeHours int   `json:"age_hours"` // Accounts older than this are exempt
+	Tripped  int64 `json:"tripped"`
+}
+
+// establishedUsers remembers accounts known to be past the fan-out age,
+// which stay past it, so they aren't looked up again.
+type establishedUsers struct {
+	mu  sync.RWMutex
+	ids map[int]struct{}
+}
+
+func (e *establishedUsers) has(userID int) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	_, ok := e.ids[userID]
+	return ok
+}
+
+func (e *establishedUsers) add(userID int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ids == nil {
+		e.ids = make(map[int]struct{})
+	}
+	e.ids[userID] = struct{}{}
+}
+
+// reset forgets every account, for when the fan-out age changes.
+func (e *establishedUsers) reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ids = nil
+}
+
+// FanoutStats returns the new-account fan-out settings and trip count.
+func (s *Service) FanoutStats() FanoutStats {
+	stats := FanoutStats{Tripped: s.fanoutTripped.Load()}
+	if rc := s.cfg.Runtime(); rc.NewAccountFanoutLimit > 0 {
+		stats.Limit = rc.NewAccountFanoutLimit
+		stats.AgeHours = int(rc.NewAccountFanoutAge.Hours())
+	}
+	return stats
+}
+
+// checkFanout counts recipient against userID's daily budget of distinct
+// new people if the account is younger than NewAccountFanoutAge.
+// Recipients already counted today and accepted contacts are free.
+// Recipients that turn out not to exist count too, as with key fetches.
+func (s *Service) checkFanout(ctx context.Context, userID int, recipient string) error {
+	rc := s.cfg.Runtime()
+	if rc.NewAccountFanoutLimit <= 0 || s.fanoutEstablished.has(userID) {
+		return nil
+	}
+	createdAt, err := s.store.GetUserCreatedAt(ctx, userID)
+	if err != nil {
+		return internal(err)
+	}
+	now := s.clock.Now()
+	graduates := createdAt.Add(rc.NewAccountFanoutAge)
+	if !now.Before(graduates) {
+		s.fanoutEstablished.add(userID)
+		return nil
+	}
+
+	contact, err := s.isContact(ctx, userID, recipient)
+	if err != nil {
+		return internal(err)
+	}
+	if contact {
+		return nil
+	}
+
+	ok, retryAfter := s.fanout.Allow(strconv.Itoa(userID), store.CanonicalUsername(recipient))
+	if ok {
+		return nil
+	}
+	s.fanoutTripped.Add(1)
+	// The budget may free up sooner by the account coming of age
+	if untilGraduation := graduates.Sub(now); untilGraduation < retryAfter {
+		retryAfter = untilGraduation
+	}
+	e := rateLimited("New accounts can only reach out to a few people a day. Try again later.", retryAfter).(*Error)
+	e.Details["code"] = CodeNewAccountFanoutLimited
+	return e
+}
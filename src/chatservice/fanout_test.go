@@ -0,0 +1,95 @@
+// src/chatservice/fanout_test.go
+package chatservice
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestNewAccountFanout has a new account reach out to more people than its
+// daily budget allows, by message and chat request. Repeats to the same
+// person and messages to contacts are free, established accounts are
+// never limited, and the new account graduates at the configured age.
+func TestNewAccountFanout(t *testing.T) {
+	svc, st, clk := newTestService(t, "NEW_ACCOUNT_FANOUT_LIMIT", "2", "NEW_ACCOUNT_FANOUT_AGE_HOURS", "12")
+	ctx := context.Background()
+	ids := make(map[string]int)
+	register := func(names ...string) {
+		for _, name := range names {
+			if err := st.RegisterUser(ctx, name, "hash", nil); err != nil {
+				t.Fatal(err)
+			}
+			id, err := st.GetUserIDByUsername(ctx, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids[name] = id
+			if err := st.UploadPublicKey(ctx, id, name+"-key"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send := func(from, to string) error {
+		_, err := svc.SendMessage(ctx, ids[from], SendMessageRequest{RecipientUsername: to, SenderBlob: "s", RecipientBlob: "r"})
+		return err
+	}
+
+	register("oldie", "bob", "carol", "dave", "erin", "frank")
+	clk.Advance(13 * time.Hour)
+	register("mallory")
+
+	for _, to := range []string{"bob", "carol", "dave", "erin", "frank"} {
+		if err := send("oldie", to); err != nil {
+			t.Fatalf("established account to %s: %v", to, err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := send("mallory", "Bob"); err != nil {
+			t.Fatalf("repeat %d to bob: %v", i+1, err)
+		}
+	}
+	if _, err := svc.RequestChat(ctx, ids["mallory"], "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if err := send("mallory", "carol"); err != nil {
+		t.Fatalf("message after a request to carol: %v", err)
+	}
+
+	err := send("mallory", "dave")
+	e, ok := err.(*Error)
+	if !ok || e.Kind != KindRateLimited || e.Details["code"] != CodeNewAccountFanoutLimited {
+		t.Fatalf("a third person: %v, want %s", err, CodeNewAccountFanoutLimited)
+	}
+	// Graduation comes before the window frees up
+	if got := e.Details["retry_after_seconds"]; got != int((12 * time.Hour).Seconds()) {
+		t.Errorf("retry_after_seconds %v, want the time until graduation", got)
+	}
+	if _, err := svc.RequestChat(ctx, ids["mallory"], "dave"); KindOf(err) != KindRateLimited {
+		t.Errorf("a request to a third person: %v, want rate limited", err)
+	}
+
+	// A contact is free, even one made after the budget ran out
+	if _, err := svc.RequestChat(ctx, ids["erin"], "mallory"); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.AcceptChat(ctx, ids["mallory"], "erin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := send("mallory", "erin"); err != nil {
+		t.Errorf("to a contact: %v", err)
+	}
+
+	if got := svc.FanoutStats(); got != (FanoutStats{Limit: 2, AgeHours: 12, Tripped: 2}) {
+		t.Errorf("stats %+v", got)
+	}
+
+	// Still inside the window, but no longer new
+	clk.Advance(12 * time.Hour)
+	for _, to := range []string{"dave", "frank"} {
+		if err := send("mallory", to); err != nil {
+			t.Errorf("after graduating, to %s: %v", to, err)
+		}
+	}
+}
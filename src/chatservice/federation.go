@@ -0,0 +1,181 @@
+// src/chatservice/federation.go
+package chatservice
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"cryptachat-server/federation"
+	"cryptachat-server/store"
+)
+
+// EnableFederation lets users reach users on peers as user@peer. Without
+// it, a username containing '@' is looked up locally like any other.
+func (s *Service) EnableFederation(peers *federation.Client) {
+	s.peers = peers
+}
+
+// resolveAddress maps a username as a client gave it to the local
+// username it refers to, and the peer it lives on ("" for local users).
+// An address with this instance's own name is the plain username; one
+// with a peer's is that user's stand-in, which is created if create is
+// set. Anything else is returned as given.
+func (s *Service) resolveAddress(ctx context.Context, addr string, create bool) (local, peer string, err error) {
+	if s.peers == nil {
+		return addr, "", nil
+	}
+	username, peer, ok := federation.SplitAddress(addr)
+	switch {
+	case !ok:
+		return addr, "", nil
+	case peer == s.cfg.FederationName:
+		return username, "", nil
+	case !s.peers.Known(peer):
+		return addr, "", nil
+	case username == "":
+		return "", "", invalid("Missing the username before '@'.")
+	case !create:
+		return store.RemoteAddress(username, peer), peer, nil
+	}
+	_, local, err = s.store.EnsureRemoteUser(ctx, peer, username)
+	if err != nil {
+		if strings.Contains(err.Error(), "username already exists") {
+			// A local account predating federation has the name
+			return addr, "", nil
+		}
+		return "", "", internal(err)
+	}
+	return local, peer, nil
+}
+
+// fetchRemoteKey proxies a public key lookup to the user's peer.
+func (s *Service) fetchRemoteKey(ctx context.Context, addr, peer string) (string, error) {
+	username, _, _ := federation.SplitAddress(addr)
+	key, err := s.peers.FetchKey(ctx, peer, username)
+	if errors.Is(err, federation.ErrUnknownUser) {
+		return "", notFound("User not found or has no public key.")
+	}
+	if err != nil {
+		log.Printf("FEDERATION: key lookup on %s failed: %v", peer, err)
+		return "", unavailable("The user's server could not be reached. Try again later.")
+	}
+	return key, nil
+}
+
+// isContact reports whether username is one of userID's accepted contacts.
+func (s *Service) isContact(ctx context.Context, userID int, username string) (bool, error) {
+	contacts, err := s.store.GetContacts(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	canonical := store.CanonicalUsername(username)
+	for _, name := range contacts {
+		if store.CanonicalUsername(name) == canonical {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// LocalKey returns a local user's public key for a peer.
+func (s *Service) LocalKey(ctx context.Context, username string) (string, error) {
+	if username == "" {
+		return "", invalid("Missing username query parameter.")
+	}
+	if strings.Contains(username, "@") {
+		// Stand-ins have no keys, and keys aren't relayed onward
+		return "", notFound("User not found or has no public key.")
+	}
+	key, err := s.store.GetPublicKeyByUsername(ctx, username)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return "", notFound("User not found or has no public key.")
+		}
+		return "", internal(err)
+	}
+	return key, nil
+}
+
+// ReceiveRelay applies a relay from peer to a local user. Relays that are
+// repeats, or that find the state they would create already in place, are
+// accepted without effect, so a peer retrying after a lost response does
+// no harm.
+func (s *Service) ReceiveRelay(ctx context.Context, peer string, env federation.Envelope) error {
+	if env.ID <= 0 {
+		return invalid("Missing id")
+	}
+	if env.From == "" || env.To == "" || strings.Contains(env.From, "@") || strings.Contains(env.To, "@") {
+		return invalid("from and to must be plain usernames on the sending and receiving server.")
+	}
+
+	recipientID, err := s.store.GetUserIDByUsername(ctx, env.To)
+	if err != nil {
+		return notFound("Recipient user not found.")
+	}
+	senderID, _, err := s.store.EnsureRemoteUser(ctx, peer, env.From)
+	if err != nil {
+		if strings.Contains(err.Error(), "username already exists") {
+			return conflict("A local account has this sender's address.")
+		}
+		return internal(err)
+	}
+
+	switch env.Kind {
+	case store.RelayChatRequest:
+		// Requests from peers skip the spam heuristics: the peer is trusted
+		// to have applied its own
+		accepted, err := s.store.RequestChat(ctx, senderID, env.To, "")
+		if err != nil {
+			if strings.Contains(err.Error(), "already pending") {
+				return nil
+			}
+			return internal(err)
+		}
+		s.invalidate(ctx, []int{recipientID}, ScopeChatRequests, "")
+		if accepted {
+			s.invalidate(ctx, []int{recipientID}, ScopeContacts, "")
+		}
+
+	case store.RelayChatAccept:
+		accepted, err := s.store.AcceptChat(ctx, senderID, env.To)
+		if err != nil {
+			if !strings.Contains(err.Error(), "database error") {
+				return nil // Withdrawn or declined here, or not a request from us
+			}
+			return internal(err)
+		}
+		if !accepted {
+			return nil // Already accepted
+		}
+		s.invalidate(ctx, []int{recipientID}, ScopeContacts, "")
+
+	case store.RelayMessage:
+		if env.Blob == "" {
+			return invalid("Missing blob")
+		}
+		if err := s.checkPadding("blob", env.Blob); err != nil {
+			return err
+		}
+		if err := s.checkRecipientKey(ctx, env.To); err != nil {
+			return err
+		}
+		_, _, err := s.store.ReceiveRelayedMessage(ctx, peer, env.ID, senderID, env.To, env.Blob)
+		if err != nil {
+			switch {
+			case strings.Contains(err.Error(), "recipient user not found"):
+				return notFound("Recipient user not found.")
+			case strings.Contains(err.Error(), "not a contact"):
+				return forbidden("The recipient has not accepted a chat with the sender.")
+			case strings.Contains(err.Error(), "recipient rate limited"):
+				return recipientRateLimited()
+			}
+			return internal(err)
+		}
+
+	default:
+		return invalid("Unknown relay kind %q.", env.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// src/chatservice/inbound_test.go
+package chatservice
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSetInboundLimitBounds(t *testing.T) {
+	svc := New(newTestConfig(t), nil, nil)
+	for _, bad := range []int{-1, 0, maxInboundMessagesPerHour + 1} {
+		if err := svc.SetInboundLimit(context.Background(), 1, &bad); KindOf(err) != KindInvalid {
+			t.Errorf("%d per hour: %v, want invalid", bad, err)
+		}
+	}
+}
+
+// TestRecipientRateLimitedDisclosesNothing fills a contact's inbound
+// ceiling and checks the refusal carries its code but neither the ceiling
+// nor when it frees up.
+func TestRecipientRateLimitedDisclosesNothing(t *testing.T) {
+	svc, st, _ := newTestService(t)
+	ctx := context.Background()
+	ids := make(map[string]int)
+	for _, name := range []string{"alice", "bob"} {
+		if err := st.RegisterUser(ctx, name, "hash", nil); err != nil {
+			t.Fatal(err)
+		}
+		id, err := st.GetUserIDByUsername(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+		if err := st.UploadPublicKey(ctx, id, name+"-key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := svc.RequestChat(ctx, ids["bob"], "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.AcceptChat(ctx, ids["alice"], "bob"); err != nil {
+		t.Fatal(err)
+	}
+	limit := 2
+	if err := svc.SetInboundLimit(ctx, ids["alice"], &limit); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := svc.GetSettings(ctx, ids["alice"])
+	if err != nil || settings.InboundMessagesPerHour == nil || *settings.InboundMessagesPerHour != limit {
+		t.Fatalf("settings %+v, %v; want a ceiling of %d", settings, err, limit)
+	}
+
+	req := SendMessageRequest{RecipientUsername: "alice", SenderBlob: "s", RecipientBlob: "r"}
+	for i := 0; i < limit; i++ {
+		if _, err := svc.SendMessage(ctx, ids["bob"], req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = svc.SendMessage(ctx, ids["bob"], req)
+	e, ok := err.(*Error)
+	if !ok || e.Kind != KindRateLimited || e.Details["code"] != CodeRecipientRateLimited {
+		t.Fatalf("past the ceiling: %v, want %s", err, CodeRecipientRateLimited)
+	}
+	if len(e.Details) != 1 {
+		t.Errorf("details %v disclose more than the code", e.Details)
+	}
+}
@@ -0,0 +1,88 @@
+// src/chatservice/invalidate.go
+package chatservice
+
+import (
+	"context"
+	"log"
+
+	"cryptachat-server/featureflags"
+	"cryptachat-server/store"
+)
+
+// Cache invalidation scopes. Clients that see a scope they don't know
+// should refresh everything.
+const (
+	// ScopeContactKeys: the named contact's identity key changed; re-fetch it.
+	ScopeContactKeys = "contact_keys"
+	// ScopeContacts: the contact list changed; re-fetch /get_contacts.
+	ScopeContacts = "contacts"
+	// ScopeChatRequests: incoming requests changed; re-fetch /get_chat_requests.
+	ScopeChatRequests = "chat_requests"
+	// ScopeProfile: the named user's profile (e.g. username) changed. Reserved.
+	ScopeProfile = "profile"
+	// ScopeServerPolicy: /server_info changed. Reserved.
+	ScopeServerPolicy = "server_policy"
+)
+
+// maxSyncInvalidations caps one /sync page.
+const maxSyncInvalidations = 500
+
+// invalidate is the single place mutating operations announce cache
+// invalidations. The mutation has already succeeded, so a failure here is
+// logged rather than returned; clients still converge on their next full
+// refresh. Invalidations of the contact and request lists carry the
+// version those lists' ETags are built from.
+func (s *Service) invalidate(ctx context.Context, userIDs []int, scope, username string) {
+	withVersion := scope == ScopeContacts || scope == ScopeChatRequests
+	if err := s.store.PublishInvalidation(ctx, userIDs, scope, username, withVersion); err != nil {
+		log.Printf("INVALIDATE: could not publish %s for %d users: %v", scope, len(userIDs), err)
+	}
+}
+
+// invalidateContacts sends an invalidation to every contact of userID.
+func (s *Service) invalidateContacts(ctx context.Context, userID int, scope, username string) {
+	contacts, err := s.store.GetContactRefs(ctx, userID)
+	if err != nil {
+		log.Printf("INVALIDATE: could not load contacts of user %d: %v", userID, err)
+		return
+	}
+	ids := make([]int, 0, len(contacts))
+	for _, c := range contacts {
+		ids = append(ids, c.ID)
+	}
+	s.invalidate(ctx, ids, scope, username)
+}
+
+// SyncResult is one page of /sync. NextSince is the cursor for the next call.
+type SyncResult struct {
+	Invalidations []store.Invalidation `json:"invalidations"`
+	NextSince     int64                `json:"next_since"`
+	HasMore       bool                 `json:"has_more"`
+}
+
+// Sync returns the user's invalidations after sinceID.
+func (s *Service) Sync(ctx context.Context, userID int, sinceID int64) (*SyncResult, error) {
+	if !s.flags.Enabled(ctx, featureflags.Sync, userID) {
+		return nil, forbidden("Sync is not available for this account yet.")
+	}
+	if sinceID < 0 {
+		return nil, invalid("since must not be negative")
+	}
+	invs, err := s.store.GetInvalidations(ctx, userID, sinceID, maxSyncInvalidations+1)
+	if err != nil {
+		return nil, internal(err)
+	}
+
+	res := &SyncResult{Invalidations: invs, NextSince: sinceID}
+	if len(invs) > maxSyncInvalidations {
+		res.Invalidations = invs[:maxSyncInvalidations]
+		res.HasMore = true
+	}
+	if res.Invalidations == nil {
+		res.Invalidations = []store.Invalidation{}
+	}
+	if n := len(res.Invalidations); n > 0 {
+		res.NextSince = res.Invalidations[n-1].ID
+	}
+	return res, nil
+}
@@ -0,0 +1,136 @@
+// src/chatservice/invalidate_test.go
+package chatservice
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptachat-server/passwords"
+)
+
+// TestMutationsPublishInvalidations runs each mutation that changes what
+// clients cache and checks who is told to invalidate what: the users
+// affected, and nobody else.
+func TestMutationsPublishInvalidations(t *testing.T) {
+	svc, st, clk := newTestService(t, "SPAM_REQUIRE_PUBLIC_KEY", "false")
+	ctx := context.Background()
+	const password = "correct horse battery"
+	hash, err := passwords.Bcrypt{Cost: 4}.Hash([]byte(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"bob", "carol", "dave", "erin", "mallory"}
+	ids := make(map[string]int)
+	register := func(name string) {
+		t.Helper()
+		if err := st.RegisterUser(ctx, name, hash, nil); err != nil {
+			t.Fatal(err)
+		}
+		id, err := st.GetUserIDByUsername(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+	for _, name := range names[:4] {
+		register(name)
+	}
+	// Old enough not to be filtered as new accounts
+	clk.Advance(2 * time.Hour)
+
+	since := make(map[string]int64)
+	// expect checks each user's invalidations since the last call, as
+	// "scope" or "scope:username", against want
+	expect := func(after string, want map[string][]string) {
+		t.Helper()
+		for _, name := range names {
+			invs, err := st.GetInvalidations(ctx, ids[name], since[name], 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, inv := range invs {
+				since[name] = inv.ID
+				entry := inv.Scope
+				if inv.Username != "" {
+					entry += ":" + inv.Username
+				}
+				got = append(got, entry)
+				versioned := inv.Scope == ScopeContacts || inv.Scope == ScopeChatRequests
+				if versioned != (inv.RelationshipsVersion != nil) {
+					t.Errorf("after %s, %s's %s: relationships_version %v", after, name, inv.Scope, inv.RelationshipsVersion)
+				}
+			}
+			if !slices.Equal(got, want[name]) {
+				t.Errorf("after %s, %s was told [%s], want [%s]",
+					after, name, strings.Join(got, " "), strings.Join(want[name], " "))
+			}
+		}
+	}
+	request := func(from, to string) {
+		t.Helper()
+		if _, err := svc.RequestChat(ctx, ids[from], to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	request("carol", "bob")
+	expect("a request", map[string][]string{"bob": {ScopeChatRequests}})
+
+	if err := svc.AcceptChat(ctx, ids["bob"], "carol"); err != nil {
+		t.Fatal(err)
+	}
+	expect("accepting", map[string][]string{
+		"bob":   {ScopeChatRequests, ScopeContacts},
+		"carol": {ScopeContacts},
+	})
+
+	request("dave", "bob")
+	expect("a second request", map[string][]string{"bob": {ScopeChatRequests}})
+	if err := svc.DeclineChat(ctx, ids["bob"], "dave"); err != nil {
+		t.Fatal(err)
+	}
+	expect("declining", map[string][]string{"bob": {ScopeChatRequests}})
+
+	// Asking someone who had already asked accepts their request
+	request("erin", "bob")
+	expect("a third request", map[string][]string{"bob": {ScopeChatRequests}})
+	request("bob", "erin")
+	expect("a request both ways", map[string][]string{
+		"bob":  {ScopeChatRequests, ScopeContacts},
+		"erin": {ScopeContacts},
+	})
+
+	// Only contacts hear of a new key; dave was declined
+	if err := svc.UploadKey(ctx, ids["bob"], "key"); err != nil {
+		t.Fatal(err)
+	}
+	expect("a key upload", map[string][]string{
+		"carol": {ScopeContactKeys + ":bob"},
+		"erin":  {ScopeContactKeys + ":bob"},
+	})
+
+	// A filtered request is kept from its recipient, and so is its
+	// invalidation
+	register("mallory")
+	request("mallory", "bob")
+	expect("a filtered request", nil)
+
+	// Everyone bob has a request with, in any state, refreshes
+	if _, err := svc.ChangeUsername(ctx, ids["bob"], password, "robert", ClientInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	renamed := []string{ScopeContacts + ":robert", ScopeChatRequests + ":robert"}
+	expect("a rename", map[string][]string{"carol": renamed, "dave": renamed, "erin": renamed, "mallory": renamed})
+
+	if err := svc.DeleteAccount(ctx, ids["carol"], password); err != nil {
+		t.Fatal(err)
+	}
+	expect("deleting an account", map[string][]string{
+		"bob": {ScopeContacts + ":carol", ScopeChatRequests + ":carol"},
+	})
+}
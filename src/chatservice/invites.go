@@ -0,0 +1,99 @@
+// src/chatservice/invites.go
+package chatservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cryptachat-server/store"
+)
+
+// inviteWindow is the period INVITES_PER_WEEK counts mints over.
+const inviteWindow = 7 * 24 * time.Hour
+
+// Error codes of refused registrations and invite mints.
+const (
+	CodeInviteRequired = "invite_required"
+	CodeInviteInvalid  = "invite_invalid" // No such code
+	CodeInviteUsed     = "invite_used"
+	CodeInviteLimit    = "invite_limit"
+)
+
+// Invite is a freshly minted invite code. Only its hash is stored, so this
+// is the only time the code is shown.
+type Invite struct {
+	Code      string          `json:"code"`
+	CreatedAt store.Timestamp `json:"created_at"`
+}
+
+// CreateInvite mints an invite code for user, at most cfg.InvitesPerWeek
+// per rolling week.
+func (s *Service) CreateInvite(ctx context.Context, user *store.User) (*Invite, error) {
+	code, err := newInviteCode()
+	if err != nil {
+		return nil, internal(err)
+	}
+	createdAt, err := s.store.CreateInvite(ctx, user.ID, hashInviteCode(code), s.cfg.InvitesPerWeek, inviteWindow)
+	var limit *store.InviteLimitError
+	if errors.As(err, &limit) {
+		rerr := rateLimited("You have created as many invites as you can this week. Try again later.", limit.RetryAt.Sub(s.clock.Now())).(*Error)
+		rerr.Details["code"] = CodeInviteLimit
+		rerr.Details["limit"] = s.cfg.InvitesPerWeek
+		return nil, rerr
+	}
+	if err != nil {
+		return nil, internal(err)
+	}
+	return &Invite{Code: code, CreatedAt: store.NewTimestamp(createdAt)}, nil
+}
+
+// inviteHashFor checks a registration's invite code against the
+// registration mode and returns its hash for the store to redeem, or nil
+// when invites aren't required (any code is then ignored).
+func inviteHashFor(mode, code string) ([]byte, error) {
+	if mode != RegistrationInviteOnly {
+		return nil, nil
+	}
+	if strings.TrimSpace(code) == "" {
+		return nil, inviteError("Registration on this server requires an invite code.", CodeInviteRequired)
+	}
+	return hashInviteCode(code), nil
+}
+
+// inviteRedeemError maps the store's refusal to redeem an invite.
+func inviteRedeemError(err error) error {
+	switch err.Error() {
+	case "invite code not found":
+		return inviteError("Invite code is not valid.", CodeInviteInvalid)
+	case "invite code already used":
+		return inviteError("Invite code has already been used.", CodeInviteUsed)
+	}
+	return nil
+}
+
+func inviteError(msg, code string) error {
+	return &Error{Kind: KindForbidden, Message: msg, Details: map[string]interface{}{"code": code}}
+}
+
+// newInviteCode returns 10 random bytes as 16 base32 characters, in four
+// groups for reading out.
+func newInviteCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate invite code: %w", err)
+	}
+	c := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return c[0:4] + "-" + c[4:8] + "-" + c[8:12] + "-" + c[12:16], nil
+}
+
+// hashInviteCode is the form an invite code is stored and looked up in.
+// Like recovery codes, case and separators don't matter.
+func hashInviteCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashRefreshToken(code)
+}
@@ -0,0 +1,63 @@
+// src/chatservice/keyfetch.go
+package chatservice
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"cryptachat-server/store"
+)
+
+// CodeKeyFetchLimit is the error code for a key fetch refused by the
+// scraping limit, so clients can explain it rather than show a bare 429.
+const CodeKeyFetchLimit = "key_fetch_limit"
+
+// keyFetchExempt returns the usernames userID may fetch keys for without
+// counting against the limit: their accepted contacts and themselves.
+// It returns nil when the limit is disabled.
+func (s *Service) keyFetchExempt(ctx context.Context, userID int) (map[string]bool, error) {
+	if s.cfg.Runtime().KeyFetchLimit <= 0 {
+		return nil, nil
+	}
+	user, err := s.store.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	contacts, err := s.store.GetContacts(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	exempt := make(map[string]bool, len(contacts)+1)
+	exempt[store.CanonicalUsername(user.Username)] = true
+	for _, name := range contacts {
+		exempt[store.CanonicalUsername(name)] = true
+	}
+	return exempt, nil
+}
+
+// checkKeyFetch counts a fetch of username's key against userID's limit
+// unless username is exempt. Usernames that don't exist count too, since
+// probing for them is part of scraping.
+func (s *Service) checkKeyFetch(userID int, username string, exempt map[string]bool) error {
+	rc := s.cfg.Runtime()
+	if rc.KeyFetchLimit <= 0 {
+		return nil
+	}
+	canonical := store.CanonicalUsername(username)
+	if exempt[canonical] {
+		return nil
+	}
+	if ok, retryAfter := s.keyFetches.Allow(strconv.Itoa(userID), canonical); !ok {
+		return keyFetchLimited(retryAfter, rc.KeyFetchLimit, rc.KeyFetchWindow)
+	}
+	return nil
+}
+
+func keyFetchLimited(retryAfter time.Duration, limit int, window time.Duration) error {
+	err := rateLimited("Too many key lookups for people who aren't your contacts. Try again later.", retryAfter).(*Error)
+	err.Details["code"] = CodeKeyFetchLimit
+	err.Details["limit"] = limit
+	err.Details["window_seconds"] = int(window.Seconds())
+	return err
+}
@@ -0,0 +1,109 @@
+// src/chatservice/keyfetch_test.go
+package chatservice
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestKeyFetchLimit fetches keys past the limit for non-contacts, singly
+// and in batches. Fetches of contacts' and one's own key never count, and
+// are allowed after the limit is reached.
+func TestKeyFetchLimit(t *testing.T) {
+	svc, st, clk := newTestService(t, "KEY_FETCH_LIMIT", "2")
+	ctx := context.Background()
+	ids := make(map[string]int)
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		if err := st.RegisterUser(ctx, name, "hash", nil); err != nil {
+			t.Fatal(err)
+		}
+		id, err := st.GetUserIDByUsername(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+		if err := st.UploadPublicKey(ctx, id, name+"-key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := svc.RequestChat(ctx, ids["bob"], "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.AcceptChat(ctx, ids["alice"], "bob"); err != nil {
+		t.Fatal(err)
+	}
+	alice := ids["alice"]
+
+	limited := func(what string, err error) {
+		t.Helper()
+		e, ok := err.(*Error)
+		if !ok || e.Kind != KindRateLimited || e.Details["code"] != CodeKeyFetchLimit || e.Details["limit"] != 2 {
+			t.Errorf("%s: %v, want refused with %s", what, err, CodeKeyFetchLimit)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := svc.GetKey(ctx, alice, "Bob"); err != nil {
+			t.Fatalf("contact fetch %d: %v", i+1, err)
+		}
+	}
+	if _, err := svc.GetKey(ctx, alice, "alice"); err != nil {
+		t.Fatalf("own key: %v", err)
+	}
+	items, err := svc.GetKeys(ctx, alice, []string{"bob", "alice", "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items[:2] {
+		if item.Status != BatchOK {
+			t.Errorf("batch of contacts, %v: %s", item.Key, item.Status)
+		}
+	}
+
+	// Two non-contacts are allowed, counting one that doesn't exist
+	if _, err := svc.GetKey(ctx, alice, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.GetKey(ctx, alice, "nobody"); KindOf(err) != KindNotFound {
+		t.Fatalf("missing user: %v", err)
+	}
+	_, err = svc.GetKey(ctx, alice, "dave")
+	limited("a third non-contact", err)
+	if _, err := svc.GetKey(ctx, alice, "carol"); err != nil {
+		t.Errorf("a non-contact already counted: %v", err)
+	}
+	if _, err := svc.GetKey(ctx, alice, "bob"); err != nil {
+		t.Errorf("a contact past the limit: %v", err)
+	}
+
+	items, err = svc.GetKeys(ctx, alice, []string{"bob", "erin", "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{BatchOK, BatchRateLimited, BatchOK}
+	for i, item := range items {
+		if item.Status != want[i] {
+			t.Errorf("mixed batch, %v: %s, want %s", item.Key, item.Status, want[i])
+		}
+	}
+	if items[1].Code != CodeKeyFetchLimit {
+		t.Errorf("refused batch item code %q, want %s", items[1].Code, CodeKeyFetchLimit)
+	}
+
+	// Becoming a contact exempts dave at once
+	if _, err := svc.RequestChat(ctx, ids["dave"], "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.AcceptChat(ctx, alice, "dave"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.GetKey(ctx, alice, "dave"); err != nil {
+		t.Errorf("a new contact: %v", err)
+	}
+
+	clk.Advance(time.Hour)
+	if _, err := svc.GetKey(ctx, alice, "erin"); err != nil {
+		t.Errorf("after the window: %v", err)
+	}
+}
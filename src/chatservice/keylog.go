@@ -0,0 +1,70 @@
+// src/chatservice/keylog.go
+package chatservice
+
+import (
+	"context"
+
+	"cryptachat-server/store"
+)
+
+// Key log page sizes when reading the whole log.
+const (
+	defaultKeyLogLimit = 100
+	MaxKeyLogLimit     = 1000
+)
+
+// KeyLogPage is part of the key transparency log plus the chain head. The
+// head is read after the entries, so it is never behind them. NextAfter is
+// the cursor for the following page of the full log, or 0 on the last page.
+type KeyLogPage struct {
+	Entries   []store.KeyLogEntry `json:"entries"`
+	Head      store.KeyLogHead    `json:"head"`
+	NextAfter int64               `json:"next_after,omitempty"`
+}
+
+// GetKeyLog returns every key change for username or, if username is empty,
+// a page of the whole log after sequence number after. limit 0 means the default.
+func (s *Service) GetKeyLog(ctx context.Context, username string, after int64, limit int) (*KeyLogPage, error) {
+	if limit == 0 {
+		limit = defaultKeyLogLimit
+	}
+	if limit < 0 || limit > MaxKeyLogLimit {
+		return nil, invalid("limit must be between 1 and %d", MaxKeyLogLimit)
+	}
+	if after < 0 {
+		return nil, invalid("after must not be negative")
+	}
+
+	page := &KeyLogPage{}
+	var err error
+	if username != "" {
+		page.Entries, err = s.store.GetKeyLogByUsername(ctx, username)
+	} else {
+		// Fetch one extra row to learn whether there is another page
+		page.Entries, err = s.store.GetKeyLog(ctx, after, limit+1)
+		if err == nil && len(page.Entries) > limit {
+			page.Entries = page.Entries[:limit]
+			page.NextAfter = page.Entries[limit-1].Seq
+		}
+	}
+	if err != nil {
+		return nil, internal(err)
+	}
+	if page.Entries == nil {
+		page.Entries = []store.KeyLogEntry{}
+	}
+
+	if page.Head, err = s.store.GetKeyLogHead(ctx); err != nil {
+		return nil, internal(err)
+	}
+	return page, nil
+}
+
+// KeyLogHead returns the current head of the key transparency log.
+func (s *Service) KeyLogHead(ctx context.Context) (store.KeyLogHead, error) {
+	head, err := s.store.GetKeyLogHead(ctx)
+	if err != nil {
+		return head, internal(err)
+	}
+	return head, nil
+}
@@ -0,0 +1,57 @@
+// src/chatservice/latency.go
+package chatservice
+
+import (
+	"cryptachat-server/metrics"
+	"cryptachat-server/store"
+)
+
+// Delivery paths of the end-to-end latency histogram, from the transport a
+// receipt names. Receipts without one are counted as pathUnknown.
+const (
+	pathLivePush = "live_push" // store.TransportWSLive
+	pathPoll     = "poll"      // store.TransportPoll
+	pathUnknown  = "unknown"
+)
+
+// deliveryLatencyBounds span live pushes (well under a second) to
+// recipients who were offline for a day.
+var deliveryLatencyBounds = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 1800, 3600, 21600, 86400}
+
+func newDeliveryLatency() *metrics.Histogram {
+	return metrics.NewHistogram("cryptachat_message_delivery_seconds",
+		"Time from a message being stored to its recipient's first delivery receipt.",
+		"path", deliveryLatencyBounds, pathLivePush, pathPoll, pathUnknown)
+}
+
+func deliveryPath(via string) string {
+	switch via {
+	case store.TransportWSLive:
+		return pathLivePush
+	case store.TransportPoll:
+		return pathPoll
+	}
+	return pathUnknown
+}
+
+// observeDelivery records the latency of each first receipt. Both times are
+// the server's, taken when the message was inserted and when the receipt
+// arrived.
+func (s *Service) observeDelivery(receipts []store.Receipt, via string) {
+	path := deliveryPath(via)
+	for _, r := range receipts {
+		if !r.First {
+			continue
+		}
+		took := r.At.Sub(r.SentAt)
+		if took < 0 {
+			took = 0
+		}
+		s.deliveryLatency.Observe(path, took)
+	}
+}
+
+// DeliveryLatency returns the end-to-end delivery latency histogram.
+func (s *Service) DeliveryLatency() *metrics.Histogram {
+	return s.deliveryLatency
+}
@@ -0,0 +1,141 @@
+// src/chatservice/messages.go
+package chatservice
+
+import (
+	"context"
+	"strings"
+
+	"cryptachat-server/store"
+)
+
+// SendMessageRequest is a message to deliver to RecipientUsername.
+type SendMessageRequest struct {
+	RecipientUsername string
+	SenderBlob        string
+	RecipientBlob     string
+	// Sealed stores the message without its sender. SenderBlob must be
+	// empty: the sender keeps their own copy.
+	Sealed bool
+}
+
+// SendMessageResult identifies the stored message.
+type SendMessageResult struct {
+	MessageID   int
+	RecipientID int
+	// Remote is set when the recipient is on a peer instance, so the
+	// message is relayed rather than pushed.
+	Remote bool
+}
+
+// SendMessage validates and stores a message. The real-time fan-out is
+// queued in the outbox by the store in the same transaction.
+func (s *Service) SendMessage(ctx context.Context, senderID int, req SendMessageRequest) (SendMessageResult, error) {
+	if req.Sealed {
+		return s.sendSealedMessage(ctx, senderID, req)
+	}
+	if req.RecipientUsername == "" || req.SenderBlob == "" || req.RecipientBlob == "" {
+		return SendMessageResult{}, invalid("Missing recipient_username, sender_blob, or recipient_blob")
+	}
+
+	// Enforce the padding bucket policy (if enabled) before touching the DB
+	if err := s.checkPadding("sender_blob", req.SenderBlob); err != nil {
+		return SendMessageResult{}, err
+	}
+	if err := s.checkPadding("recipient_blob", req.RecipientBlob); err != nil {
+		return SendMessageResult{}, err
+	}
+
+	recipient, peer, err := s.resolveAddress(ctx, req.RecipientUsername, false)
+	if err != nil {
+		return SendMessageResult{}, err
+	}
+	if peer != "" {
+		// The peer only takes messages between contacts; refuse now rather
+		// than after relaying
+		contact, err := s.isContact(ctx, senderID, recipient)
+		if err != nil {
+			return SendMessageResult{}, internal(err)
+		}
+		if !contact {
+			return SendMessageResult{}, forbidden("Messages to users on other servers need an accepted chat request.")
+		}
+	}
+
+	if err := s.checkRecipientKey(ctx, recipient); err != nil {
+		return SendMessageResult{}, err
+	}
+	if err := s.checkFanout(ctx, senderID, recipient); err != nil {
+		return SendMessageResult{}, err
+	}
+
+	newID, recipientID, err := s.store.SendMessage(ctx, senderID, recipient, req.SenderBlob, req.RecipientBlob)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "recipient user not found"):
+			return SendMessageResult{}, notFound("Recipient user not found.")
+		case strings.Contains(err.Error(), "yourself"):
+			return SendMessageResult{}, invalid("Cannot send a message to yourself.")
+		case strings.Contains(err.Error(), "recipient rate limited"):
+			return SendMessageResult{}, recipientRateLimited()
+		}
+		return SendMessageResult{}, internal(err)
+	}
+	s.publishMessageStored(ctx, newID, senderID, recipientID)
+	if peer == "" {
+		s.queuePush(recipientID)
+	}
+	return SendMessageResult{MessageID: newID, RecipientID: recipientID, Remote: peer != ""}, nil
+}
+
+// GetMessages returns messages exchanged with partnerUsername after sinceID,
+// which is exclusive. Pruned copies come back as stubs; see store.Message.
+// direction (a store.Direction constant, default both) limits them to the
+// ones the partner sent or the ones userID sent. sinceID is a message ID in
+// every direction, so a cursor from one works with the others.
+func (s *Service) GetMessages(ctx context.Context, userID int, partnerUsername string, sinceID int, direction string) ([]store.Message, store.MessageSnapshot, error) {
+	if partnerUsername == "" {
+		return nil, store.MessageSnapshot{}, invalid("Missing username query parameter.")
+	}
+	direction, ok := store.ParseDirection(direction)
+	if !ok {
+		return nil, store.MessageSnapshot{}, invalid("direction must be incoming, outgoing or both.")
+	}
+
+	messages, snapshot, err := s.store.GetMessages(ctx, userID, partnerUsername, sinceID, direction)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "partner user not found"):
+			return nil, store.MessageSnapshot{}, notFound("Partner user not found.")
+		case strings.Contains(err.Error(), "yourself"):
+			return nil, store.MessageSnapshot{}, invalid("Cannot fetch a conversation with yourself.")
+		}
+		return nil, store.MessageSnapshot{}, internal(err)
+	}
+	for i := range messages {
+		messages[i].Transport = store.TransportPoll
+	}
+	return messages, snapshot, nil
+}
+
+// LastMessageID returns the highest message ID handed out so far, the
+// bound on a valid since_id cursor.
+func (s *Service) LastMessageID(ctx context.Context) (int64, error) {
+	id, err := s.store.LastMessageID(ctx)
+	if err != nil {
+		return 0, internal(err)
+	}
+	return id, nil
+}
+
+// GetMessageStatus returns when and how a message userID sent or received
+// was delivered.
+func (s *Service) GetMessageStatus(ctx context.Context, userID, messageID int) (*store.MessageStatus, error) {
+	st, err := s.store.GetMessageStatus(ctx, userID, messageID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, notFound("Message not found.")
+		}
+		return nil, internal(err)
+	}
+	return st, nil
+}
@@ -0,0 +1,16 @@
+// src/chatservice/messages_test.go
+package chatservice
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGetMessagesRefusesUnknownDirection(t *testing.T) {
+	svc := New(newTestConfig(t), nil, nil)
+	for _, direction := range []string{"sideways", "Incoming", "both "} {
+		if _, _, err := svc.GetMessages(context.Background(), 1, "bob", 0, direction); KindOf(err) != KindInvalid {
+			t.Errorf("direction %q: %v, want invalid", direction, err)
+		}
+	}
+}
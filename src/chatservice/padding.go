@@ -0,0 +1,44 @@
+// src/chatservice/padding.go
+package chatservice
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// checkPadding enforces the padding bucket policy on a base64 blob.
+// It is a no-op unless the capability is enabled. Rejections carry the
+// nearest valid bucket in Details so clients can pad correctly.
+func (s *Service) checkPadding(field, blob string) error {
+	if !s.caps.PaddingEnforced() {
+		return nil
+	}
+	buckets := s.caps.PaddingBuckets
+
+	decoded, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return invalid("%s is not valid base64", field)
+	}
+
+	n := len(decoded)
+	nearest := 0 // 0 if the blob is larger than every bucket
+	for _, b := range buckets {
+		if n == b {
+			return nil
+		}
+		if n < b {
+			nearest = b
+			break
+		}
+	}
+
+	msg := fmt.Sprintf("%s is %d bytes, pad it to %d bytes", field, n, nearest)
+	if nearest == 0 {
+		msg = fmt.Sprintf("%s is %d bytes, larger than the biggest padding bucket", field, n)
+	}
+	return &Error{
+		Kind:    KindInvalid,
+		Message: msg,
+		Details: map[string]interface{}{"nearest_bucket": nearest},
+	}
+}
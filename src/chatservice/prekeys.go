@@ -0,0 +1,61 @@
+// src/chatservice/prekeys.go
+package chatservice
+
+import (
+	"context"
+	"strings"
+
+	"cryptachat-server/store"
+)
+
+// maxPrekeysPerUpload caps how many prekeys one upload may carry.
+const maxPrekeysPerUpload = 100
+
+// UploadPrekeys adds one-time prekeys for the user and returns how many
+// unused prekeys they now have.
+func (s *Service) UploadPrekeys(ctx context.Context, userID int, prekeys []store.Prekey) (int, error) {
+	if len(prekeys) == 0 {
+		return 0, invalid("Missing prekeys")
+	}
+	if len(prekeys) > maxPrekeysPerUpload {
+		return 0, invalid("Too many prekeys: %d (max %d)", len(prekeys), maxPrekeysPerUpload)
+	}
+	for _, pk := range prekeys {
+		if pk.PublicKey == "" {
+			return 0, invalid("Prekey %d has no public_key", pk.KeyID)
+		}
+	}
+
+	if _, err := s.store.AddPrekeys(ctx, userID, prekeys); err != nil {
+		return 0, internal(err)
+	}
+	remaining, err := s.store.CountPrekeys(ctx, userID)
+	if err != nil {
+		return 0, internal(err)
+	}
+	return remaining, nil
+}
+
+// GetPrekeyBundle returns another user's identity key and, if any are left,
+// one of their one-time prekeys. Each prekey is served at most once. Like
+// GetKey, bundles for non-contacts count against the key scraping limit.
+func (s *Service) GetPrekeyBundle(ctx context.Context, userID int, username string) (*store.PrekeyBundle, error) {
+	if username == "" {
+		return nil, invalid("Missing username query parameter.")
+	}
+	exempt, err := s.keyFetchExempt(ctx, userID)
+	if err != nil {
+		return nil, internal(err)
+	}
+	if err := s.checkKeyFetch(userID, username, exempt); err != nil {
+		return nil, err
+	}
+	bundle, err := s.store.GetPrekeyBundle(ctx, username)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, notFound("User not found or has no public key.")
+		}
+		return nil, internal(err)
+	}
+	return bundle, nil
+}
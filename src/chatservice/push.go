@@ -0,0 +1,128 @@
+// src/chatservice/push.go
+package chatservice
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cryptachat-server/integrations"
+)
+
+// pushTicks is how many times per coalescing window RunPush looks for
+// pings that are due, so a ping goes out at most a quarter window late.
+const pushTicks = 4
+
+// pushQueue holds the users due a push ping. The first event for a user
+// opens a window; events before it closes are folded into the same ping,
+// so a burst of messages costs one payload and one aggregate query.
+type pushQueue struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	due       map[int]time.Time // userID -> when the ping goes out
+	coalesced atomic.Int64      // Events folded into a ping already due
+}
+
+// add records an event for userID at now and reports whether it opened a
+// new window.
+func (q *pushQueue) add(userID int, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.due[userID]; ok {
+		q.coalesced.Add(1)
+		return false
+	}
+	if q.due == nil {
+		q.due = make(map[int]time.Time)
+	}
+	q.due[userID] = now.Add(q.window)
+	return true
+}
+
+// take removes and returns, in ID order, the users whose window has closed
+// by now.
+func (q *pushQueue) take(now time.Time) []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var users []int
+	for id, at := range q.due {
+		if !now.Before(at) {
+			users = append(users, id)
+			delete(q.due, id)
+		}
+	}
+	sort.Ints(users)
+	return users
+}
+
+func (q *pushQueue) pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.due)
+}
+
+// PushStats describes push pings for /admin/runtime.
+type PushStats struct {
+	Coalesced int64                    `json:"coalesced"` // Events folded into a ping already due
+	Pending   int                      `json:"pending"`   // Users with a ping due
+	Sender    integrations.SenderStats `json:"sender"`
+}
+
+// EnablePush sends push_ping events through p, at most one per user per
+// PUSH_COALESCE_MS. RunPush must be running for them to go out.
+func (s *Service) EnablePush(p *integrations.Sender) {
+	s.push = p
+	s.pushes.window = s.cfg.PushCoalesce
+}
+
+// PushStats returns the push counters, or nil if push is off.
+func (s *Service) PushStats() *PushStats {
+	if s.push == nil {
+		return nil
+	}
+	return &PushStats{
+		Coalesced: s.pushes.coalesced.Load(),
+		Pending:   s.pushes.pending(),
+		Sender:    s.push.Stats(),
+	}
+}
+
+// queuePush notes that userID has something new to be pinged about.
+func (s *Service) queuePush(userID int) {
+	if s.push == nil {
+		return
+	}
+	s.pushes.add(userID, s.clock.Now())
+}
+
+// RunPush sends the pings whose window has closed until ctx is done.
+func (s *Service) RunPush(ctx context.Context) {
+	ticker := s.clock.NewTicker(s.pushes.window / pushTicks)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			s.flushPushes(ctx)
+		}
+	}
+}
+
+// flushPushes builds and queues a ping for every user whose window has
+// closed. A user whose payload can't be built, e.g. because the account
+// was deleted, is skipped.
+func (s *Service) flushPushes(ctx context.Context) {
+	for _, userID := range s.pushes.take(s.clock.Now()) {
+		fields, err := s.PushPayload(ctx, userID)
+		if err != nil {
+			log.Printf("PUSH: ping for user %d: %v", userID, err)
+			continue
+		}
+		s.push.Publish(integrations.EventPushPing, fields)
+	}
+}
@@ -0,0 +1,150 @@
+// src/chatservice/push_test.go
+package chatservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"cryptachat-server/egress"
+	"cryptachat-server/integrations"
+)
+
+func TestPushQueueCoalesces(t *testing.T) {
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	q := pushQueue{window: 2 * time.Second}
+
+	if !q.add(1, start) {
+		t.Fatal("first event didn't open a window")
+	}
+	for i := 1; i <= 4; i++ {
+		if q.add(1, start.Add(time.Duration(i)*300*time.Millisecond)) {
+			t.Fatalf("event %d opened a second window", i+1)
+		}
+	}
+	q.add(2, start.Add(time.Second))
+
+	if got := q.take(start.Add(2*time.Second - time.Nanosecond)); len(got) != 0 {
+		t.Fatalf("pinged %v before the window closed", got)
+	}
+	if got := q.take(start.Add(2 * time.Second)); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("pinged %v when user 1's window closed, want [1]", got)
+	}
+	if got := q.coalesced.Load(); got != 4 {
+		t.Errorf("coalesced %d events, want 4", got)
+	}
+
+	// An event after the ping opens a new window
+	if !q.add(1, start.Add(2*time.Second)) {
+		t.Fatal("event after the ping was folded into it")
+	}
+	if got := q.take(start.Add(3 * time.Second)); !reflect.DeepEqual(got, []int{2}) {
+		t.Fatalf("pinged %v, want [2]", got)
+	}
+	if got := q.take(start.Add(4 * time.Second)); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("pinged %v, want [1]", got)
+	}
+	if q.pending() != 0 {
+		t.Errorf("%d users still pending", q.pending())
+	}
+}
+
+// TestPushPingCoalescesAndHonoursOptOut sends a burst of messages to one
+// user and checks that it produces one ping with their counts, and that
+// after they turn push_badge_counts off the ping carries no numbers.
+func TestPushPingCoalescesAndHonoursOptOut(t *testing.T) {
+	svc, st, clk := newTestService(t, "PUSH_COALESCE_MS", "1000", "REQUIRE_RECIPIENT_KEY", "false")
+	ctx := context.Background()
+
+	received := make(chan map[string]interface{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decoding ping: %v", err)
+		}
+		received <- body
+	}))
+	defer srv.Close()
+	policy := egress.Policy{
+		Allow:   []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")},
+		Timeout: 5 * time.Second,
+	}
+	sender := integrations.NewSender("push", srv.URL, "", integrations.NewFilter(integrations.ModeIDsOnly), policy)
+	svc.EnablePush(sender)
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go sender.Run(runCtx)
+
+	register := func(name string) int {
+		if err := st.RegisterUser(ctx, name, "hash", nil); err != nil {
+			t.Fatal(err)
+		}
+		id, err := st.GetUserIDByUsername(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	alice, bob := register("alice"), register("bob")
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			req := SendMessageRequest{RecipientUsername: "bob", SenderBlob: "c2VuZGVy", RecipientBlob: "cmVjaXBpZW50"}
+			if _, err := svc.SendMessage(ctx, alice, req); err != nil {
+				t.Fatalf("sending message %d: %v", i+1, err)
+			}
+		}
+	}
+	ping := func() map[string]interface{} {
+		t.Helper()
+		svc.flushPushes(ctx)
+		if stats := svc.PushStats(); stats.Pending != 0 {
+			t.Fatalf("%d pings still pending after the window", stats.Pending)
+		}
+		select {
+		case body := <-received:
+			return body
+		case <-time.After(5 * time.Second):
+			t.Fatal("no ping posted")
+			return nil
+		}
+	}
+
+	send(5)
+	svc.flushPushes(ctx)
+	if got := svc.PushStats(); got.Pending != 1 || got.Coalesced != 4 {
+		t.Fatalf("after a burst of 5: %+v, want 1 pending and 4 coalesced", got)
+	}
+	clk.Advance(time.Second)
+	body := ping()
+	if body["recipient_id"] != float64(bob) || body["badge_unread"] != float64(5) || body["badge_pending_requests"] != float64(0) {
+		t.Errorf("ping %v, want bob's counts", body)
+	}
+
+	if err := svc.SetPushBadgeCounts(ctx, bob, false); err != nil {
+		t.Fatal(err)
+	}
+	send(1)
+	clk.Advance(time.Second)
+	body = ping()
+	want := []string{"event", "recipient_id", "timestamp"}
+	var got []string
+	for _, k := range want {
+		if _, ok := body[k]; ok {
+			got = append(got, k)
+		}
+	}
+	if len(body) != len(want) || !reflect.DeepEqual(got, want) {
+		t.Errorf("ping after opting out: %v, want only %v", body, want)
+	}
+
+	select {
+	case extra := <-received:
+		t.Errorf("more pings than windows: %v", extra)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,100 @@
+// src/chatservice/recipientkey.go
+package chatservice
+
+import (
+	"context"
+	"sync"
+)
+
+// CodeRecipientHasNoKey is the error code of messages refused because the
+// recipient has never uploaded a public key, so the sender's client had
+// nothing to encrypt to.
+const CodeRecipientHasNoKey = "recipient_has_no_key"
+
+// keyedUsers remembers the users known to have a public key. Keys can be
+// replaced but not removed, so an entry never goes stale: only "no key"
+// answers are looked up again, and an upload is seen on the next send.
+type keyedUsers struct {
+	mu  sync.RWMutex
+	ids map[int]struct{}
+}
+
+func (k *keyedUsers) has(userID int) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	_, ok := k.ids[userID]
+	return ok
+}
+
+func (k *keyedUsers) add(userID int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.ids == nil {
+		k.ids = make(map[int]struct{})
+	}
+	k.ids[userID] = struct{}{}
+}
+
+// recipientHasKey reports whether messages to userID can be read: they
+// have a public key, or stand in for a user on a peer, whose key is there.
+func (s *Service) recipientHasKey(ctx context.Context, userID int) (bool, error) {
+	if s.keyed.has(userID) {
+		return true, nil
+	}
+	has, err := s.store.HasPublicKey(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	if !has {
+		if has, err = s.store.IsRemoteUser(ctx, userID); err != nil {
+			return false, err
+		}
+	}
+	if has {
+		s.keyed.add(userID)
+	}
+	return has, nil
+}
+
+// checkRecipientKey refuses a message to username if they have no public
+// key and REQUIRE_RECIPIENT_KEY is on. Unknown users pass, so the store
+// reports them as usual.
+func (s *Service) checkRecipientKey(ctx context.Context, username string) error {
+	if !s.cfg.RequireRecipientKey {
+		return nil
+	}
+	recipientID, err := s.store.GetUserIDByUsername(ctx, username)
+	if err != nil {
+		return nil
+	}
+	has, err := s.recipientHasKey(ctx, recipientID)
+	if err != nil {
+		return internal(err)
+	}
+	if !has {
+		return &Error{
+			Kind:    KindConflict,
+			Message: "The recipient hasn't set up encryption yet, so they couldn't read this message.",
+			Details: map[string]interface{}{"code": CodeRecipientHasNoKey},
+		}
+	}
+	return nil
+}
+
+// PartnerHasKey reports whether username can be sent messages yet, for
+// telling a user who just became their contact. Unknown users report true.
+func (s *Service) PartnerHasKey(ctx context.Context, username string) (bool, error) {
+	local, _, err := s.resolveAddress(ctx, username, false)
+	if err != nil {
+		return false, err
+	}
+	partnerID, err := s.store.GetUserIDByUsername(ctx, local)
+	if err != nil {
+		return true, nil
+	}
+	has, err := s.recipientHasKey(ctx, partnerID)
+	if err != nil {
+		return false, internal(err)
+	}
+	return has, nil
+}
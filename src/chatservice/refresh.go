@@ -0,0 +1,134 @@
+// src/chatservice/refresh.go
+package chatservice
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Error codes of refused refresh tokens. A reused token revoked its whole
+// family, so the client must log in again with the password either way.
+const (
+	CodeRefreshTokenInvalid = "refresh_token_invalid"
+	CodeRefreshTokenReused  = "refresh_token_reused"
+)
+
+// TokenPair is what /login and /refresh return. RefreshToken is empty when
+// Login was told not to issue one. When Login needs a second factor it sets
+// only TwoFactorToken, with ExpiresIn its lifetime.
+type TokenPair struct {
+	AccessToken      string
+	ExpiresIn        time.Duration
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+	TwoFactorToken   string
+}
+
+// newRefreshToken returns 32 random bytes, base64url encoded. Also used for
+// family IDs.
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate refresh token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashRefreshToken is the form a token is stored and looked up in. The
+// tokens are random, so a plain SHA-256 is enough.
+func hashRefreshToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// issueRefreshToken adds a new refresh token in family to pair.
+func (s *Service) issueRefreshToken(ctx context.Context, pair *TokenPair, userID int, family string) error {
+	token, err := newRefreshToken()
+	if err != nil {
+		return internal(err)
+	}
+	expiresAt := s.clock.Now().Add(s.cfg.RefreshTokenTTL).UTC()
+	if err := s.store.CreateRefreshToken(ctx, userID, family, hashRefreshToken(token), expiresAt); err != nil {
+		return internal(err)
+	}
+	pair.RefreshToken = token
+	pair.RefreshExpiresAt = expiresAt
+	return nil
+}
+
+// Refresh exchanges a refresh token for a new access token and a new
+// refresh token, which replaces it. Each refresh token works once: a second
+// exchange means it was copied, so it revokes every token of its login.
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	if refreshToken == "" {
+		return nil, invalid("Missing refresh_token")
+	}
+
+	next, err := newRefreshToken()
+	if err != nil {
+		return nil, internal(err)
+	}
+	expiresAt := s.clock.Now().Add(s.cfg.RefreshTokenTTL).UTC()
+	userID, sessionID, err := s.store.RotateRefreshToken(ctx, hashRefreshToken(refreshToken), hashRefreshToken(next), expiresAt)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "refresh token reused"):
+			return nil, refreshRefused(CodeRefreshTokenReused,
+				"Refresh token was already used. All sessions from this login were signed out; log in again.")
+		case strings.Contains(err.Error(), "refresh token"):
+			return nil, refreshRefused(CodeRefreshTokenInvalid,
+				"Refresh token is invalid, expired or revoked. Log in again.")
+		}
+		return nil, internal(err)
+	}
+
+	user, err := s.store.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, refreshRefused(CodeRefreshTokenInvalid, "Refresh token is invalid, expired or revoked. Log in again.")
+	}
+
+	pair := &TokenPair{RefreshToken: next, RefreshExpiresAt: expiresAt}
+	if pair.AccessToken, err = s.accessToken(user, sessionID); err != nil {
+		return nil, err
+	}
+	pair.ExpiresIn = s.cfg.AccessTokenTTL
+	return pair, nil
+}
+
+// Logout revokes refreshToken and every other token of its login, and
+// ends its session, so the login's access tokens are refused too.
+func (s *Service) Logout(ctx context.Context, refreshToken string) error {
+	if refreshToken == "" {
+		return invalid("Missing refresh_token")
+	}
+	if err := s.store.RevokeRefreshToken(ctx, hashRefreshToken(refreshToken)); err != nil {
+		return internal(err)
+	}
+	return nil
+}
+
+func refreshRefused(code, msg string) error {
+	return &Error{
+		Kind:    KindUnauthorized,
+		Message: msg,
+		Details: map[string]interface{}{"code": code},
+	}
+}
+
+// LogoutEverywhere signs userID out of every session: their access tokens
+// are rejected from the next request on, their refresh tokens revoked and
+// their sessions ended.
+func (s *Service) LogoutEverywhere(ctx context.Context, userID int) error {
+	if _, err := s.store.BumpTokenVersion(ctx, userID); err != nil {
+		return internal(err)
+	}
+	if _, err := s.store.RevokeUserRefreshTokens(ctx, userID); err != nil {
+		return internal(err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// src/chatservice/regchallenge.go
+package chatservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"cryptachat-server/pow"
+	"cryptachat-server/store"
+)
+
+// Error codes for registrations refused for their proof of work (see
+// package pow).
+const (
+	CodePoWDisabled         = "pow_disabled"          // /register_challenge with the feature off
+	CodePoWRequired         = "pow_required"          // No solution given
+	CodePoWChallengeInvalid = "pow_challenge_invalid" // Unknown, used or expired nonce
+	CodePoWInvalid          = "pow_invalid"           // Counter doesn't solve the nonce
+)
+
+// RegisterChallenge is a proof-of-work challenge for one registration.
+type RegisterChallenge struct {
+	Nonce      string          `json:"nonce"`
+	Difficulty int             `json:"difficulty"` // Leading zero bits
+	ExpiresAt  store.Timestamp `json:"expires_at"`
+}
+
+// RegistrationWork is a registration's solution to a RegisterChallenge.
+// It is ignored unless the instance requires proof of work.
+type RegistrationWork struct {
+	Nonce   string
+	Counter uint64
+}
+
+// NewRegisterChallenge issues a challenge at the configured difficulty.
+func (s *Service) NewRegisterChallenge(ctx context.Context) (*RegisterChallenge, error) {
+	feature := s.caps.RegistrationPoW
+	if !feature.Enabled {
+		return nil, powError("Proof of work is not required on this instance.", CodePoWDisabled)
+	}
+	nonce, err := newChallengeNonce()
+	if err != nil {
+		return nil, internal(err)
+	}
+	expiresAt := s.clock.Now().Add(s.cfg.RegistrationPoWTTL)
+	if err := s.store.CreateRegistrationChallenge(ctx, nonce, feature.Bits, expiresAt); err != nil {
+		return nil, internal(err)
+	}
+	return &RegisterChallenge{Nonce: nonce, Difficulty: feature.Bits, ExpiresAt: store.NewTimestamp(expiresAt)}, nil
+}
+
+// checkRegistrationWork redeems work's challenge and checks the solution
+// against the difficulty it was issued at. The challenge is spent even if
+// the solution is wrong or the registration then fails, so each guess
+// costs a fresh challenge.
+func (s *Service) checkRegistrationWork(ctx context.Context, work RegistrationWork) error {
+	if !s.caps.RegistrationPoW.Enabled {
+		return nil
+	}
+	if work.Nonce == "" {
+		return powError("Registration on this server requires a solved challenge from /register_challenge.", CodePoWRequired)
+	}
+	difficulty, err := s.store.ConsumeRegistrationChallenge(ctx, work.Nonce)
+	if err != nil {
+		if err.Error() == "challenge not found" {
+			return powError("Challenge is unknown, used or expired.", CodePoWChallengeInvalid)
+		}
+		return internal(err)
+	}
+	if !pow.Valid(work.Nonce, work.Counter, difficulty) {
+		return powError("Challenge solution is not valid.", CodePoWInvalid)
+	}
+	return nil
+}
+
+func powError(msg, code string) error {
+	return &Error{Kind: KindForbidden, Message: msg, Details: map[string]interface{}{"code": code}}
+}
+
+// newChallengeNonce returns 16 random bytes, base64url encoded.
+func newChallengeNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate challenge nonce: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
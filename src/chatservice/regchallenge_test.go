@@ -0,0 +1,68 @@
+// src/chatservice/regchallenge_test.go
+package chatservice
+
+import (
+	"context"
+	"testing"
+
+	"cryptachat-server/pow"
+)
+
+// TestRefusedRegistrationKeepsChallenge registers with a solved challenge
+// after a weak password and a taken name were refused with it. Neither
+// refusal may spend the challenge; a wrong solution does.
+func TestRefusedRegistrationKeepsChallenge(t *testing.T) {
+	svc, st, _ := newTestService(t, "REGISTRATION_POW_BITS", "4")
+	ctx := context.Background()
+	if err := st.RegisterUser(ctx, "alice", "hash", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	challenge, err := svc.NewRegisterChallenge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter, err := pow.Solve(ctx, challenge.Nonce, challenge.Difficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := RegistrationWork{Nonce: challenge.Nonce, Counter: counter}
+
+	err = svc.Register(ctx, "bob", "short", "", "", work)
+	if KindOf(err) != KindInvalid {
+		t.Fatalf("weak password: got %v, want invalid", err)
+	}
+	err = svc.Register(ctx, "Alice", "correct horse battery", "", "", work)
+	if KindOf(err) != KindConflict {
+		t.Fatalf("taken name: got %v, want conflict", err)
+	}
+	if err := svc.Register(ctx, "bob", "correct horse battery", "", "", work); err != nil {
+		t.Fatalf("registering with the challenge after both refusals: %v", err)
+	}
+	err = svc.Register(ctx, "carol", "correct horse battery", "", "", work)
+	if KindOf(err) != KindForbidden {
+		t.Fatalf("reused challenge: got %v, want forbidden", err)
+	}
+
+	// A wrong solution is the one refusal that spends it
+	challenge, err = svc.NewRegisterChallenge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter, err = pow.Solve(ctx, challenge.Nonce, challenge.Difficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := counter + 1
+	for pow.Valid(challenge.Nonce, wrong, challenge.Difficulty) {
+		wrong++
+	}
+	err = svc.Register(ctx, "carol", "correct horse battery", "", "", RegistrationWork{Nonce: challenge.Nonce, Counter: wrong})
+	if KindOf(err) != KindForbidden {
+		t.Fatalf("wrong solution: got %v, want forbidden", err)
+	}
+	err = svc.Register(ctx, "carol", "correct horse battery", "", "", RegistrationWork{Nonce: challenge.Nonce, Counter: counter})
+	if KindOf(err) != KindForbidden {
+		t.Fatalf("challenge after a wrong solution: got %v, want forbidden", err)
+	}
+}
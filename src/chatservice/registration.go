@@ -0,0 +1,136 @@
+// src/chatservice/registration.go
+package chatservice
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"cryptachat-server/store"
+)
+
+// Registration modes, set with SetRegistrationMode. Until one is set, the
+// mode is invite_only with INVITES_REQUIRED and open otherwise.
+const (
+	RegistrationOpen       = "open"
+	RegistrationInviteOnly = "invite_only"
+	RegistrationClosed     = "closed"
+)
+
+// CodeRegistrationClosed is the error code for a registration refused
+// because registration is closed. Invite-only refusals have the invite
+// codes.
+const CodeRegistrationClosed = "registration_closed"
+
+const auditRegistrationMode = "admin.registration_mode"
+
+// RegistrationModeTTL is how long the mode is served from memory. A change
+// made on this replica applies at once; one made on another takes up to
+// this long, or until this replica's config is reloaded.
+const RegistrationModeTTL = 5 * time.Second
+
+// ValidRegistrationMode reports whether mode is one of the modes.
+func ValidRegistrationMode(mode string) bool {
+	switch mode {
+	case RegistrationOpen, RegistrationInviteOnly, RegistrationClosed:
+		return true
+	}
+	return false
+}
+
+// registrationModeCache holds the mode last read from the store.
+type registrationModeCache struct {
+	mu   sync.Mutex
+	mode string    // "" if none has been set
+	at   time.Time // Zero when not loaded
+}
+
+// forget makes the next RegistrationMode read the store.
+func (c *registrationModeCache) forget() {
+	c.mu.Lock()
+	c.at = time.Time{}
+	c.mu.Unlock()
+}
+
+// RegistrationMode returns the current registration mode. If the database
+// can't be read, the last mode read, or failing that the default, is used.
+func (s *Service) RegistrationMode(ctx context.Context) string {
+	c := &s.registration
+	now := s.clock.Now()
+	c.mu.Lock()
+	mode, fresh := c.mode, !c.at.IsZero() && now.Sub(c.at) < RegistrationModeTTL
+	c.mu.Unlock()
+
+	if !fresh {
+		stored, err := s.store.GetRegistrationMode(ctx)
+		if err != nil {
+			log.Printf("REGISTRATION: could not load registration mode: %v", err)
+		} else {
+			mode = stored
+			c.mu.Lock()
+			c.mode, c.at = stored, now
+			c.mu.Unlock()
+		}
+	}
+	if mode == "" {
+		return s.defaultRegistrationMode()
+	}
+	return mode
+}
+
+// defaultRegistrationMode is the mode until an admin sets one.
+func (s *Service) defaultRegistrationMode() string {
+	if s.cfg.InvitesRequired {
+		return RegistrationInviteOnly
+	}
+	return RegistrationOpen
+}
+
+// RegistrationModeChange is the result of SetRegistrationMode.
+type RegistrationModeChange struct {
+	Mode     string `json:"mode"`
+	Previous string `json:"previous"`
+	// PropagationSeconds is how long other replicas may take to apply it.
+	PropagationSeconds int `json:"propagation_seconds"`
+}
+
+// SetRegistrationMode switches registration to mode for every replica, and
+// audits the change. admin is nil for the admin token.
+func (s *Service) SetRegistrationMode(ctx context.Context, admin *store.User, mode string) (*RegistrationModeChange, error) {
+	if !ValidRegistrationMode(mode) {
+		return nil, invalid("mode must be open, invite_only or closed.")
+	}
+	adminID, by := 0, "the admin token"
+	if admin != nil {
+		adminID, by = admin.ID, admin.Username
+	}
+	previous, err := s.store.SetRegistrationMode(ctx, mode, adminID)
+	if err != nil {
+		return nil, internal(err)
+	}
+	if previous == "" {
+		previous = s.defaultRegistrationMode()
+	}
+	c := &s.registration
+	c.mu.Lock()
+	c.mode, c.at = mode, s.clock.Now()
+	c.mu.Unlock()
+
+	log.Printf("REGISTRATION: %s changed registration from %s to %s", by, previous, mode)
+	s.audit(ctx, adminID, auditRegistrationMode, map[string]interface{}{"mode": mode, "previous": previous})
+	return &RegistrationModeChange{
+		Mode:               mode,
+		Previous:           previous,
+		PropagationSeconds: int(RegistrationModeTTL.Seconds()),
+	}, nil
+}
+
+// registrationClosed refuses a registration while registration is closed.
+func registrationClosed() error {
+	return &Error{
+		Kind:    KindForbidden,
+		Message: "Registration on this server is closed.",
+		Details: map[string]interface{}{"code": CodeRegistrationClosed},
+	}
+}
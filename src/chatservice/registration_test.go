@@ -0,0 +1,152 @@
+// src/chatservice/registration_test.go
+package chatservice
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// refusedWith checks err is a forbidden registration carrying code.
+func refusedWith(t *testing.T, what string, err error, code string) {
+	t.Helper()
+	e, ok := err.(*Error)
+	if !ok || e.Kind != KindForbidden || e.Details["code"] != code {
+		t.Errorf("%s: %v, want refused with %s", what, err, code)
+	}
+}
+
+func TestValidRegistrationMode(t *testing.T) {
+	for _, mode := range []string{RegistrationOpen, RegistrationInviteOnly, RegistrationClosed} {
+		if !ValidRegistrationMode(mode) {
+			t.Errorf("%s refused", mode)
+		}
+	}
+	for _, mode := range []string{"", "Open", "invite-only", "closed "} {
+		if ValidRegistrationMode(mode) {
+			t.Errorf("%q accepted", mode)
+		}
+	}
+}
+
+// TestRegistrationModes registers in each mode, with and without invite
+// codes, and checks the mode a server starts in follows INVITES_REQUIRED.
+func TestRegistrationModes(t *testing.T) {
+	svc, st, _ := newTestService(t, "INVITES_REQUIRED", "true")
+	ctx := context.Background()
+	register := func(name, invite string) error {
+		return svc.Register(ctx, name, "correct horse battery", invite, "", RegistrationWork{})
+	}
+
+	if got := svc.RegistrationMode(ctx); got != RegistrationInviteOnly {
+		t.Fatalf("default mode with INVITES_REQUIRED: %s", got)
+	}
+	if _, err := svc.SetRegistrationMode(ctx, nil, "sometimes"); KindOf(err) != KindInvalid {
+		t.Errorf("unknown mode: %v", err)
+	}
+
+	// alice can't register without an invite, so she is created directly
+	// to issue one
+	refusedWith(t, "invite_only without a code", register("alice", ""), CodeInviteRequired)
+	refusedWith(t, "invite_only with a made-up code", register("alice", "aaaa-bbbb-cccc-dddd"), CodeInviteInvalid)
+	if err := st.RegisterUser(ctx, "alice", "hash", nil); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := st.GetUserByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite, err := svc.CreateInvite(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := register("bob", invite.Code); err != nil {
+		t.Fatalf("invite_only with a code: %v", err)
+	}
+	refusedWith(t, "a used code", register("carol", invite.Code), CodeInviteUsed)
+
+	change, err := svc.SetRegistrationMode(ctx, alice, RegistrationClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Previous != RegistrationInviteOnly || change.Mode != RegistrationClosed || change.PropagationSeconds != 5 {
+		t.Errorf("change: %+v", change)
+	}
+	// Closed refuses even a good invite, and before checking anything else
+	spare, err := svc.CreateInvite(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusedWith(t, "closed with a code", register("carol", spare.Code), CodeRegistrationClosed)
+	refusedWith(t, "closed without a password", svc.Register(ctx, "carol", "", "", "", RegistrationWork{}), CodeRegistrationClosed)
+
+	change, err = svc.SetRegistrationMode(ctx, nil, RegistrationOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Previous != RegistrationClosed {
+		t.Errorf("previous mode %s, want closed", change.Previous)
+	}
+	if err := register("carol", ""); err != nil {
+		t.Errorf("open: %v", err)
+	}
+	// Open ignores a code, leaving it unused
+	if err := register("dave", spare.Code); err != nil {
+		t.Errorf("open with a code: %v", err)
+	}
+	if _, err := svc.SetRegistrationMode(ctx, nil, RegistrationInviteOnly); err != nil {
+		t.Fatal(err)
+	}
+	if err := register("erin", spare.Code); err != nil {
+		t.Errorf("a code ignored while open: %v", err)
+	}
+
+	caps := svc.Capabilities(ctx)
+	if caps.RegistrationMode != RegistrationInviteOnly || !caps.InviteRequired {
+		t.Errorf("capabilities: mode %s, invite required %v", caps.RegistrationMode, caps.InviteRequired)
+	}
+}
+
+// TestRegistrationModeAcrossReplicas runs two services on one database. A
+// change applies at once on the replica that made it, and on the other
+// within RegistrationModeTTL, or at once after a config reload.
+func TestRegistrationModeAcrossReplicas(t *testing.T) {
+	svc, st, clk := newTestService(t)
+	other := New(newTestConfig(t), st, nil)
+	other.SetClock(clk)
+	ctx := context.Background()
+
+	if got := other.RegistrationMode(ctx); got != RegistrationOpen {
+		t.Fatalf("default mode: %s", got)
+	}
+	if _, err := svc.SetRegistrationMode(ctx, nil, RegistrationClosed); err != nil {
+		t.Fatal(err)
+	}
+	if got := svc.RegistrationMode(ctx); got != RegistrationClosed {
+		t.Errorf("on the replica that closed it: %s", got)
+	}
+	if got := other.RegistrationMode(ctx); got != RegistrationOpen {
+		t.Errorf("on the other replica before its cache expires: %s", got)
+	}
+	clk.Advance(RegistrationModeTTL - time.Second)
+	if got := other.RegistrationMode(ctx); got != RegistrationOpen {
+		t.Errorf("on the other replica a second before the TTL: %s", got)
+	}
+	clk.Advance(time.Second)
+	if got := other.RegistrationMode(ctx); got != RegistrationClosed {
+		t.Errorf("on the other replica after the TTL: %s", got)
+	}
+	refusedWith(t, "registering on the other replica",
+		other.Register(ctx, "alice", "correct horse battery", "", "", RegistrationWork{}), CodeRegistrationClosed)
+
+	// A reload doesn't wait for the TTL
+	if _, err := svc.SetRegistrationMode(ctx, nil, RegistrationOpen); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.cfg.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := other.RegistrationMode(ctx); got != RegistrationOpen {
+		t.Errorf("on the other replica after a reload: %s", got)
+	}
+}
@@ -0,0 +1,107 @@
+// src/chatservice/sealed.go
+package chatservice
+
+import (
+	"context"
+	"strings"
+
+	"cryptachat-server/featureflags"
+	"cryptachat-server/store"
+)
+
+// ---- Sealed Sender ----
+
+// requireSealedSender fails unless the instance allows sealed sender and
+// its feature flag is on for userID.
+func (s *Service) requireSealedSender(ctx context.Context, userID int) error {
+	if !s.caps.SealedSender {
+		return forbidden("Sealed sender is disabled on this instance.")
+	}
+	if !s.flags.Enabled(ctx, featureflags.SealedSender, userID) {
+		return forbidden("Sealed sender is not available for this account yet.")
+	}
+	return nil
+}
+
+// SealedSenderState is a user's opt-in for one contact.
+type SealedSenderState struct {
+	Username string `json:"username"`
+	Enabled  bool   `json:"enabled"` // This user's opt-in
+	Mutual   bool   `json:"mutual"`  // Both sides opted in; sealed sends are allowed
+}
+
+// SetSealedSender opts the user in to (or out of) sealed-sender messages
+// with partnerUsername, who must be an accepted contact.
+func (s *Service) SetSealedSender(ctx context.Context, userID int, partnerUsername string, enabled bool) (*SealedSenderState, error) {
+	if err := s.requireSealedSender(ctx, userID); err != nil {
+		return nil, err
+	}
+	if partnerUsername == "" {
+		return nil, invalid("Missing username")
+	}
+
+	mutual, err := s.store.SetSealedSender(ctx, userID, partnerUsername, enabled)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "not found"):
+			return nil, notFound("User not found.")
+		case strings.Contains(err.Error(), "not a contact"):
+			return nil, forbidden("Sealed sender is only available between accepted contacts.")
+		}
+		return nil, internal(err)
+	}
+	return &SealedSenderState{Username: partnerUsername, Enabled: enabled, Mutual: mutual}, nil
+}
+
+// sendSealedMessage stores a message without recording its sender. The
+// sender is only checked here, against the authenticated session.
+func (s *Service) sendSealedMessage(ctx context.Context, senderID int, req SendMessageRequest) (SendMessageResult, error) {
+	if err := s.requireSealedSender(ctx, senderID); err != nil {
+		return SendMessageResult{}, err
+	}
+	if req.RecipientUsername == "" || req.RecipientBlob == "" {
+		return SendMessageResult{}, invalid("Missing recipient_username or recipient_blob")
+	}
+	if req.SenderBlob != "" {
+		return SendMessageResult{}, invalid("Sealed messages have no sender_blob; keep your copy on the device.")
+	}
+	if err := s.checkPadding("recipient_blob", req.RecipientBlob); err != nil {
+		return SendMessageResult{}, err
+	}
+
+	if err := s.checkRecipientKey(ctx, req.RecipientUsername); err != nil {
+		return SendMessageResult{}, err
+	}
+
+	newID, recipientID, err := s.store.SendSealedMessage(ctx, senderID, req.RecipientUsername, req.RecipientBlob)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "recipient user not found"):
+			return SendMessageResult{}, notFound("Recipient user not found.")
+		case strings.Contains(err.Error(), "yourself"):
+			return SendMessageResult{}, invalid("Cannot send a message to yourself.")
+		case strings.Contains(err.Error(), "not a contact"),
+			strings.Contains(err.Error(), "not enabled"):
+			return SendMessageResult{}, forbidden("Sealed sender needs an accepted contact who has also opted in.")
+		case strings.Contains(err.Error(), "recipient rate limited"):
+			return SendMessageResult{}, recipientRateLimited()
+		}
+		return SendMessageResult{}, internal(err)
+	}
+	s.queuePush(recipientID)
+	return SendMessageResult{MessageID: newID, RecipientID: recipientID}, nil
+}
+
+// GetSealedMessages returns sealed-sender messages the user received after
+// sinceID. They carry no sender; clients find it inside the blob. Reading
+// works even if the instance has since disabled sealed sender.
+func (s *Service) GetSealedMessages(ctx context.Context, userID, sinceID int) ([]store.Message, store.MessageSnapshot, error) {
+	messages, snapshot, err := s.store.GetSealedMessages(ctx, userID, sinceID)
+	if err != nil {
+		return nil, store.MessageSnapshot{}, internal(err)
+	}
+	for i := range messages {
+		messages[i].Transport = store.TransportPoll
+	}
+	return messages, snapshot, nil
+}
@@ -0,0 +1,131 @@
+// src/chatservice/service.go
+package chatservice
+
+import (
+	"context"
+	"crypto/ed25519"
+	"sync/atomic"
+	"time"
+
+	"cryptachat-server/attachments"
+	"cryptachat-server/clock"
+	"cryptachat-server/config"
+	"cryptachat-server/contactdoc"
+	"cryptachat-server/featureflags"
+	"cryptachat-server/federation"
+	"cryptachat-server/integrations"
+	"cryptachat-server/mailer"
+	"cryptachat-server/metrics"
+	"cryptachat-server/passwords"
+	"cryptachat-server/ratelimit"
+	"cryptachat-server/store"
+)
+
+// Service holds the transport-agnostic business logic: validation, store
+// orchestration, and event publication. HTTP handlers (and any future WS,
+// gRPC or CLI entry points) are thin adapters around it.
+type Service struct {
+	store *store.PostgresStore
+	cfg   *config.Config
+	clock clock.Clock
+	caps  *Capabilities
+	flags *featureflags.Checker
+
+	hasher    *passwords.Hasher     // Bounded-concurrency password hashing
+	exportKey ed25519.PrivateKey    // Signs contact exports
+	peers     *federation.Client    // Federation peers; nil if federation is off
+	mailer    mailer.Mailer         // Recovery email; nil if email is off
+	webhooks  *integrations.Sender  // Event webhooks; nil if WEBHOOK_URL is unset
+	push      *integrations.Sender  // Push pings; nil if PUSH_URL is unset
+	blobs     attachments.BlobStore // Attachment uploads; nil if attachments are off
+
+	summaries         summaryCache               // Per-user cache for AccountSummary
+	badges            badgeCache                 // Per-user cache for UnreadCounts
+	pushes            pushQueue                  // Users due a push ping
+	keyed             keyedUsers                 // Users known to have a public key
+	backupLimiter     *ratelimit.Limiter         // Per-user limit on backup retrieval
+	emailLimiter      *ratelimit.Limiter         // Per-user limit on recovery email changes
+	resetLimiter      *ratelimit.Limiter         // Per-address limit on password reset mails
+	pendingResets     chan struct{}              // One slot per reset being looked up and mailed
+	twoFactorLimiter  *ratelimit.Limiter         // Per-user limit on two-factor code attempts
+	keyFetches        *ratelimit.DistinctLimiter // Per-user limit on non-contact key fetches
+	fanout            *ratelimit.DistinctLimiter // Per-user limit on new people contacted by new accounts
+	fanoutEstablished establishedUsers           // Users past the fan-out age
+	fanoutTripped     atomic.Int64               // Attempts refused by fanout
+	spam              spamCounters               // Chat request heuristic outcomes
+	bootstrapOpen     atomic.Bool                // Whether POST /bootstrap_admin may still be used
+	registration      registrationModeCache      // Registration mode last read from the store
+	deliveryLatency   *metrics.Histogram         // Insert to first receipt, by delivery path
+}
+
+// New creates a service backed by store.
+func New(cfg *config.Config, store *store.PostgresStore, flags *featureflags.Checker) *Service {
+	s := &Service{
+		store: store,
+		cfg:   cfg,
+		clock: clock.Real,
+		caps:  newCapabilities(cfg),
+		flags: flags,
+
+		hasher:    passwords.NewHasher(cfg.PasswordHasher, cfg.BcryptConcurrency, cfg.BcryptQueueTimeout),
+		exportKey: contactdoc.SigningKey(cfg.JWTSecret),
+
+		backupLimiter:    ratelimit.New(backupFetchLimit, backupFetchWindow),
+		emailLimiter:     ratelimit.New(emailChangesPerDay, 24*time.Hour),
+		resetLimiter:     ratelimit.NewCapped(passwordResetsPerHour, time.Hour, passwordResetAddresses),
+		pendingResets:    make(chan struct{}, maxPendingResets),
+		twoFactorLimiter: ratelimit.New(twoFactorAttempts, twoFactorWindow),
+		deliveryLatency:  newDeliveryLatency(),
+	}
+	rc := cfg.Runtime()
+	s.keyFetches = ratelimit.NewDistinct(rc.KeyFetchLimit, rc.KeyFetchWindow)
+	s.fanout = ratelimit.NewDistinct(rc.NewAccountFanoutLimit, newAccountFanoutWindow)
+	cfg.OnReload(s.applyRuntime)
+	return s
+}
+
+// applyRuntime passes reloaded limits to the limiters. Lookups and contacts
+// already counted stay counted. Accounts are judged against the fan-out age
+// afresh, since it may have changed. The registration mode is read again,
+// so a reload also picks up a mode set on another replica at once.
+func (s *Service) applyRuntime(rc *config.RuntimeConfig) {
+	s.keyFetches.SetLimit(rc.KeyFetchLimit, rc.KeyFetchWindow)
+	s.fanout.SetLimit(rc.NewAccountFanoutLimit, newAccountFanoutWindow)
+	s.fanoutEstablished.reset()
+	s.registration.forget()
+}
+
+// SetClock replaces the service's clock. Intended for tests.
+func (s *Service) SetClock(c clock.Clock) {
+	s.clock = c
+	s.backupLimiter.SetClock(c)
+	s.emailLimiter.SetClock(c)
+	s.resetLimiter.SetClock(c)
+	s.twoFactorLimiter.SetClock(c)
+	s.keyFetches.SetClock(c)
+	s.fanout.SetClock(c)
+}
+
+// Clock returns the service's clock so adapters validate tokens against the same time.
+func (s *Service) Clock() clock.Clock {
+	return s.clock
+}
+
+// HashingStats reports password hashing load and durations.
+func (s *Service) HashingStats() passwords.Stats {
+	return s.hasher.Stats()
+}
+
+// Capabilities returns the instance's optional-feature registry, with the
+// registration mode as it is now.
+func (s *Service) Capabilities(ctx context.Context) *Capabilities {
+	caps := *s.caps
+	caps.RegistrationMode = s.RegistrationMode(ctx)
+	caps.InviteRequired = caps.RegistrationMode == RegistrationInviteOnly
+	return &caps
+}
+
+// Flags returns the per-user feature flag checker.
+func (s *Service) Flags() *featureflags.Checker {
+	return s.flags
+}
@@ -0,0 +1,64 @@
+// src/chatservice/service_test.go
+package chatservice
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cryptachat-server/config"
+	"cryptachat-server/store"
+	"cryptachat-server/testutil"
+)
+
+// newTestConfig loads a configuration from the environment as the server
+// does, with placeholders for the variables it requires. vars are set
+// first, as name/value pairs, and may override them.
+func newTestConfig(t *testing.T, vars ...string) *config.Config {
+	t.Helper()
+	if len(vars)%2 != 0 {
+		t.Fatal("newTestConfig: vars must be name/value pairs")
+	}
+	env := map[string]string{
+		"DB_HOST":       "localhost",
+		"DB_PORT":       "5432",
+		"POSTGRES_USER": "test",
+		"POSTGRES_DB":   "test",
+		"SECRET_KEY":    "test-secret-0123456789abcdef0123456789",
+		"BCRYPT_COST":   "4", // The minimum, so tests that hash passwords stay fast
+	}
+	for i := 0; i < len(vars); i += 2 {
+		env[vars[i]] = vars[i+1]
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := config.LoadConfig(filepath.Join(t.TempDir(), ".env"))
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	return cfg
+}
+
+// newTestService returns a Service on a fresh schema of the test database,
+// and skips t without one.
+func newTestService(t *testing.T, vars ...string) (*Service, *store.PostgresStore, *testutil.FakeClock) {
+	t.Helper()
+	return newTestServiceWith(t, newTestConfig(t, vars...))
+}
+
+// newTestServiceWith is newTestService with cfg, for tests that change
+// what the environment can't set.
+func newTestServiceWith(t *testing.T, cfg *config.Config) (*Service, *store.PostgresStore, *testutil.FakeClock) {
+	t.Helper()
+	st, err := store.NewPostgresStore(testutil.DatabaseURL(t), "../store/schema.sql")
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(st.Close)
+	clk := testutil.NewFakeClock(time.Now().UTC().Truncate(time.Second))
+	st.SetClock(clk)
+	svc := New(cfg, st, nil)
+	svc.SetClock(clk)
+	return svc, st, clk
+}
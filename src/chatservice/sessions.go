@@ -0,0 +1,68 @@
+// src/chatservice/sessions.go
+package chatservice
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"cryptachat-server/store"
+)
+
+// MaxDeviceLabelLength is the longest device label kept, in characters;
+// longer ones are cut short.
+const MaxDeviceLabelLength = 64
+
+// ClientInfo describes where a login comes from, for its session.
+type ClientInfo struct {
+	IP          string
+	DeviceLabel string // Chosen by the client, e.g. "Alice's phone"
+}
+
+// label returns the device label as stored: trimmed and cut to
+// MaxDeviceLabelLength characters.
+func (c ClientInfo) label() string {
+	label := strings.TrimSpace(c.DeviceLabel)
+	if utf8.RuneCountInString(label) <= MaxDeviceLabelLength {
+		return label
+	}
+	return string([]rune(label)[:MaxDeviceLabelLength])
+}
+
+// SessionInfo is one of the user's sessions, marking the caller's own.
+type SessionInfo struct {
+	store.Session
+	Current bool `json:"current"`
+	// Whether the session holds the user's WebSocket, and since when and
+	// when it was last heard from. Filled in by the HTTP layer from the hub.
+	WSConnected    bool             `json:"ws_connected"`
+	WSConnectedAt  *store.Timestamp `json:"ws_connected_at,omitempty"`
+	WSLastActivity *store.Timestamp `json:"ws_last_activity,omitempty"`
+}
+
+// ListSessions lists userID's sessions, most recently used first. current
+// is the caller's session, 0 if their token has none.
+func (s *Service) ListSessions(ctx context.Context, userID int, current int64) ([]SessionInfo, error) {
+	sessions, err := s.store.ListSessions(ctx, userID)
+	if err != nil {
+		return nil, internal(err)
+	}
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, SessionInfo{Session: session, Current: session.ID == current})
+	}
+	return infos, nil
+}
+
+// RevokeSession signs userID out of one of their sessions: its refresh
+// tokens are revoked, and its access tokens refused from the next request
+// on.
+func (s *Service) RevokeSession(ctx context.Context, userID int, sessionID int64) error {
+	if err := s.store.DeleteSession(ctx, userID, sessionID); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return notFound("No such session.")
+		}
+		return internal(err)
+	}
+	return nil
+}
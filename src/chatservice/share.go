@@ -0,0 +1,134 @@
+// src/chatservice/share.go
+package chatservice
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cryptachat-server/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Share payloads are what a client puts in a QR code or share link: enough
+// to start a chat with the user and to notice if the key changed on the
+// way. They are compact JWS (EdDSA JWTs) signed with the instance key that
+// signs contact exports, advertised as share_payload.signer_key.
+
+// sharePayloadTTL is how long a share payload stays valid.
+const sharePayloadTTL = 24 * time.Hour
+
+// sharePayloadType is the JWS "typ" header, so a share payload can't be
+// mistaken for another kind of token.
+const sharePayloadType = "cryptachat-share+jwt"
+
+// Error codes for POST /verify_share_payload.
+const (
+	CodeSharePayloadInvalid = "share_payload_invalid" // Malformed, tampered with or signed by another key
+	CodeSharePayloadExpired = "share_payload_expired"
+)
+
+// ShareClaims are the claims of a share payload. The username is the
+// subject and the issuing server's base URL the issuer.
+type ShareClaims struct {
+	KeyFingerprint string `json:"fp"` // Hex SHA-256 of the public key, as in the key log
+	KeyVersion     int    `json:"kv"` // Key log version of that key
+	jwt.RegisteredClaims
+}
+
+// SharePayload is the body of GET /share_payload.
+type SharePayload struct {
+	Payload   string          `json:"payload"` // Compact JWS to encode in the QR code or link
+	ExpiresAt store.Timestamp `json:"expires_at"`
+}
+
+// SharePayloadCheck is the body of POST /verify_share_payload. KeyCurrent
+// is false if the user has uploaded a different key since the payload was
+// made; the client should confirm the new key out of band.
+type SharePayloadCheck struct {
+	Username       string          `json:"username"`
+	KeyFingerprint string          `json:"key_fingerprint"`
+	KeyVersion     int             `json:"key_version"`
+	ServerURL      string          `json:"server_url"`
+	ExpiresAt      store.Timestamp `json:"expires_at"`
+	KeyCurrent     bool            `json:"key_current"`
+}
+
+// CreateSharePayload signs a share payload for user's current key.
+// serverURL is the base URL clients reach this instance at.
+func (s *Service) CreateSharePayload(ctx context.Context, user *store.User, serverURL string) (*SharePayload, error) {
+	current, err := s.currentKeyEntry(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, conflict("Upload a public key before sharing your contact details.")
+	}
+
+	now := s.clock.Now().Truncate(time.Second) // JWT times are whole seconds
+	expires := now.Add(sharePayloadTTL)
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, ShareClaims{
+		KeyFingerprint: current.KeyHash,
+		KeyVersion:     current.Version,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.Username,
+			Issuer:    serverURL,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	})
+	token.Header["typ"] = sharePayloadType
+	signed, err := token.SignedString(s.exportKey)
+	if err != nil {
+		return nil, internal(err)
+	}
+	return &SharePayload{Payload: signed, ExpiresAt: store.NewTimestamp(expires)}, nil
+}
+
+// VerifySharePayload checks a scanned payload's signature and expiry, and
+// whether the key it names is still the user's current one.
+func (s *Service) VerifySharePayload(ctx context.Context, payload string) (*SharePayloadCheck, error) {
+	var claims ShareClaims
+	token, err := jwt.ParseWithClaims(payload, &claims,
+		func(*jwt.Token) (interface{}, error) { return s.exportKey.Public(), nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(s.clock.Now),
+	)
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return nil, &Error{Kind: KindInvalid, Message: "This share code has expired. Ask for a new one.",
+			Details: map[string]interface{}{"code": CodeSharePayloadExpired}}
+	case err != nil, token.Header["typ"] != sharePayloadType, claims.Subject == "":
+		return nil, &Error{Kind: KindInvalid, Message: "This share code is not valid for this server.",
+			Details: map[string]interface{}{"code": CodeSharePayloadInvalid}}
+	}
+
+	check := &SharePayloadCheck{
+		Username:       claims.Subject,
+		KeyFingerprint: claims.KeyFingerprint,
+		KeyVersion:     claims.KeyVersion,
+		ServerURL:      claims.Issuer,
+		ExpiresAt:      store.NewTimestamp(claims.ExpiresAt.Time),
+	}
+	current, err := s.currentKeyEntry(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	check.KeyCurrent = current != nil && current.KeyHash == claims.KeyFingerprint
+	return check, nil
+}
+
+// currentKeyEntry returns username's newest key log entry, or nil if they
+// have never uploaded a key (or no longer exist).
+func (s *Service) currentKeyEntry(ctx context.Context, username string) (*store.KeyLogEntry, error) {
+	entries, err := s.store.GetKeyLogByUsername(ctx, username)
+	if err != nil {
+		return nil, internal(err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return &entries[len(entries)-1], nil
+}
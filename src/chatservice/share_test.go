@@ -0,0 +1,138 @@
+// src/chatservice/share_test.go
+package chatservice
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptachat-server/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signShare signs claims as a share payload would be, with key and typ
+// open to change.
+func signShare(t *testing.T, method jwt.SigningMethod, key interface{}, typ string, claims ShareClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["typ"] = typ
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// TestVerifySharePayloadRefusals checks expired and tampered payloads, and
+// ones signed by another key, with another algorithm or for another
+// purpose, are refused with the right code.
+func TestVerifySharePayloadRefusals(t *testing.T) {
+	svc, now := New(newTestConfig(t), nil, nil), time.Now()
+	claims := func(expires time.Time) ShareClaims {
+		return ShareClaims{
+			KeyFingerprint: "ab12",
+			KeyVersion:     1,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   "alice",
+				Issuer:    "https://chat.example",
+				IssuedAt:  jwt.NewNumericDate(expires.Add(-sharePayloadTTL)),
+				ExpiresAt: jwt.NewNumericDate(expires),
+			},
+		}
+	}
+	valid := signShare(t, jwt.SigningMethodEdDSA, svc.exportKey, sharePayloadType, claims(now.Add(time.Hour)))
+	parts := strings.Split(valid, ".")
+
+	// alice's signature over another user's claims
+	mallory := claims(now.Add(time.Hour))
+	mallory.Subject = "mallory"
+	forged := parts[0] + "." + strings.Split(signShare(t, jwt.SigningMethodEdDSA, svc.exportKey, sharePayloadType, mallory), ".")[1] + "." + parts[2]
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig[0] ^= 1
+	flipped := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(sig)
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noExpiry := claims(now.Add(time.Hour))
+	noExpiry.ExpiresAt = nil
+
+	tests := []struct {
+		name, payload, code string
+	}{
+		{"expired", signShare(t, jwt.SigningMethodEdDSA, svc.exportKey, sharePayloadType, claims(now.Add(-time.Second))), CodeSharePayloadExpired},
+		{"claims swapped", forged, CodeSharePayloadInvalid},
+		{"signature flipped", flipped, CodeSharePayloadInvalid},
+		{"another key", signShare(t, jwt.SigningMethodEdDSA, otherKey, sharePayloadType, claims(now.Add(time.Hour))), CodeSharePayloadInvalid},
+		{"HS256 with the public key", signShare(t, jwt.SigningMethodHS256, []byte(svc.exportKey.Public().(ed25519.PublicKey)), sharePayloadType, claims(now.Add(time.Hour))), CodeSharePayloadInvalid},
+		{"another typ", signShare(t, jwt.SigningMethodEdDSA, svc.exportKey, "JWT", claims(now.Add(time.Hour))), CodeSharePayloadInvalid},
+		{"no expiry", signShare(t, jwt.SigningMethodEdDSA, svc.exportKey, sharePayloadType, noExpiry), CodeSharePayloadInvalid},
+		{"garbage", "not.a.jws", CodeSharePayloadInvalid},
+	}
+	for _, tt := range tests {
+		_, err := svc.VerifySharePayload(context.Background(), tt.payload)
+		if e, ok := err.(*Error); !ok || e.Kind != KindInvalid || e.Details["code"] != tt.code {
+			t.Errorf("%s: %v, want %s", tt.name, err, tt.code)
+		}
+	}
+}
+
+// TestSharePayloadRoundTrip creates a payload, verifies it, then changes
+// the key it names and lets it expire.
+func TestSharePayloadRoundTrip(t *testing.T) {
+	svc, st, clk := newTestService(t)
+	ctx := context.Background()
+	if err := st.RegisterUser(ctx, "alice", "hash", nil); err != nil {
+		t.Fatal(err)
+	}
+	id, err := st.GetUserIDByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &store.User{ID: id, Username: "alice"}
+
+	if _, err := svc.CreateSharePayload(ctx, user, "https://chat.example"); KindOf(err) != KindConflict {
+		t.Errorf("without a key: %v, want conflict", err)
+	}
+	if err := st.UploadPublicKey(ctx, id, "alice-key-1"); err != nil {
+		t.Fatal(err)
+	}
+	share, err := svc.CreateSharePayload(ctx, user, "https://chat.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !share.ExpiresAt.Time.Equal(clk.Now().Truncate(time.Second).Add(sharePayloadTTL)) {
+		t.Errorf("expires at %v", share.ExpiresAt)
+	}
+
+	check, err := svc.VerifySharePayload(ctx, share.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Username != "alice" || check.ServerURL != "https://chat.example" || check.KeyVersion != 1 || check.KeyFingerprint == "" || !check.KeyCurrent {
+		t.Errorf("verified %+v", check)
+	}
+
+	if err := st.UploadPublicKey(ctx, id, "alice-key-2"); err != nil {
+		t.Fatal(err)
+	}
+	if check, err := svc.VerifySharePayload(ctx, share.Payload); err != nil || check.KeyCurrent {
+		t.Errorf("after a new key: %+v, %v; want valid but not current", check, err)
+	}
+
+	clk.Advance(sharePayloadTTL + time.Second)
+	_, err = svc.VerifySharePayload(ctx, share.Payload)
+	if e, ok := err.(*Error); !ok || e.Details["code"] != CodeSharePayloadExpired {
+		t.Errorf("after a day: %v, want %s", err, CodeSharePayloadExpired)
+	}
+}
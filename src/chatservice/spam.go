@@ -0,0 +1,87 @@
+// src/chatservice/spam.go
+package chatservice
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"cryptachat-server/store"
+)
+
+// Reasons a chat request was shadow-filtered.
+const (
+	filterNewAccount   = "new_account"
+	filterNoPublicKey  = "no_public_key"
+	filterManyDeclines = "recently_declined"
+)
+
+// SpamStats counts how many requests each heuristic has caught.
+type SpamStats struct {
+	NewAccount       int64 `json:"new_account"`
+	NoPublicKey      int64 `json:"no_public_key"`
+	RecentlyDeclined int64 `json:"recently_declined"`
+	Bypassed         int64 `json:"bypassed_contact_of_contact"`
+}
+
+type spamCounters struct {
+	newAccount  atomic.Int64
+	noPublicKey atomic.Int64
+	declined    atomic.Int64
+	bypassed    atomic.Int64
+}
+
+// SpamStats returns the heuristic counters.
+func (s *Service) SpamStats() SpamStats {
+	return SpamStats{
+		NewAccount:       s.spam.newAccount.Load(),
+		NoPublicKey:      s.spam.noPublicKey.Load(),
+		RecentlyDeclined: s.spam.declined.Load(),
+		Bypassed:         s.spam.bypassed.Load(),
+	}
+}
+
+// classifyRequest decides whether a new chat request should be shadow-filtered
+// and returns the reason, or "" to deliver it normally. Requests from someone
+// who shares a contact with the recipient are never filtered.
+func (s *Service) classifyRequest(ctx context.Context, requesterID int, recipientUsername string) (string, error) {
+	now := s.clock.Now()
+	sig, err := s.store.GetRequesterSignals(ctx, requesterID, recipientUsername, now.Add(-s.cfg.Runtime().SpamDeclineWindow))
+	if err != nil {
+		return "", err
+	}
+
+	reason := s.spamReason(sig, now.Sub(sig.CreatedAt))
+	if reason == "" {
+		return "", nil
+	}
+	if sig.SharesContact {
+		s.spam.bypassed.Add(1)
+		return "", nil
+	}
+
+	switch reason {
+	case filterNewAccount:
+		s.spam.newAccount.Add(1)
+	case filterNoPublicKey:
+		s.spam.noPublicKey.Add(1)
+	case filterManyDeclines:
+		s.spam.declined.Add(1)
+	}
+	return reason, nil
+}
+
+// spamReason applies the rules in order and returns the first that matches.
+func (s *Service) spamReason(sig store.RequesterSignals, accountAge time.Duration) string {
+	rc := s.cfg.Runtime()
+	if rc.SpamMinAccountAge > 0 && accountAge < rc.SpamMinAccountAge {
+		return filterNewAccount
+	}
+	if rc.SpamRequirePublicKey && !sig.HasPublicKey {
+		return filterNoPublicKey
+	}
+	if rc.SpamMaxRecentDeclines > 0 && sig.RecentDeclines >= rc.SpamMaxRecentDeclines {
+		return filterManyDeclines
+	}
+	return ""
+}
@@ -0,0 +1,161 @@
+// src/chatservice/spam_test.go
+package chatservice
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"cryptachat-server/store"
+)
+
+// TestSpamReasonRules checks each heuristic on its own and that the first
+// to match is the reason given, and that each can be turned off.
+func TestSpamReasonRules(t *testing.T) {
+	good := store.RequesterSignals{HasPublicKey: true, RecentDeclines: 2}
+	noKey := good
+	noKey.HasPublicKey = false
+	declined := good
+	declined.RecentDeclines = 3
+	everything := store.RequesterSignals{RecentDeclines: 10}
+
+	tests := []struct {
+		name string
+		sig  store.RequesterSignals
+		age  time.Duration
+		want string
+	}{
+		{"established", good, 2 * time.Hour, ""},
+		{"new account", good, 59 * time.Minute, filterNewAccount},
+		{"exactly the minimum age", good, time.Hour, ""},
+		{"no public key", noKey, 2 * time.Hour, filterNoPublicKey},
+		{"declines at the limit", declined, 2 * time.Hour, filterManyDeclines},
+		{"every rule, first wins", everything, time.Minute, filterNewAccount},
+	}
+	svc := New(newTestConfig(t), nil, nil)
+	for _, tt := range tests {
+		if got := svc.spamReason(tt.sig, tt.age); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	off := New(newTestConfig(t,
+		"SPAM_MIN_ACCOUNT_AGE_HOURS", "0",
+		"SPAM_REQUIRE_PUBLIC_KEY", "false",
+		"SPAM_MAX_RECENT_DECLINES", "0",
+	), nil, nil)
+	if got := off.spamReason(everything, 0); got != "" {
+		t.Errorf("every rule off: %q, want none", got)
+	}
+}
+
+// TestFilteredRequests sends requests that trip each rule, and one that
+// would but is from a contact of a contact. Filtered requests are left out
+// of the recipient's list unless asked for, and can be accepted as usual.
+func TestFilteredRequests(t *testing.T) {
+	svc, st, clk := newTestService(t)
+	ctx := context.Background()
+	ids := make(map[string]int)
+	for _, name := range []string{"bob", "carol", "dave", "erin", "mallory", "x", "y", "z", "eve", "frank"} {
+		if err := st.RegisterUser(ctx, name, "hash", nil); err != nil {
+			t.Fatal(err)
+		}
+		id, err := st.GetUserIDByUsername(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+	request := func(from, to string) {
+		t.Helper()
+		if _, err := svc.RequestChat(ctx, ids[from], to); err != nil {
+			t.Fatalf("%s requesting %s: %v", from, to, err)
+		}
+	}
+	accept := func(by, from string) {
+		t.Helper()
+		if err := svc.AcceptChat(ctx, ids[by], from); err != nil {
+			t.Fatalf("%s accepting %s: %v", by, from, err)
+		}
+	}
+	// filtered returns the reason to's request from from was filtered for,
+	// checking it is in to's main list only if it wasn't filtered
+	filtered := func(from, to string) string {
+		t.Helper()
+		all, err := svc.GetChatRequests(ctx, ids[to], true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		visible, err := svc.GetChatRequests(ctx, ids[to], false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range all {
+			if r.RequesterUsername != from {
+				continue
+			}
+			listed := slices.ContainsFunc(visible, func(v store.PendingRequest) bool { return v.RequesterUsername == from })
+			if listed == r.Filtered {
+				t.Errorf("%s's request to %s: filtered %v, in the main list %v", from, to, r.Filtered, listed)
+			}
+			return r.FilterReason
+		}
+		t.Fatalf("%s has no request from %s", to, from)
+		return ""
+	}
+
+	// Everyone is new to begin with; carol is a contact of bob and dave
+	request("carol", "bob")
+	request("carol", "dave")
+	accept("bob", "carol")
+	accept("dave", "carol")
+	stats := svc.SpamStats()
+
+	request("mallory", "bob")
+	if got := filtered("mallory", "bob"); got != filterNewAccount {
+		t.Errorf("new account: filtered for %q", got)
+	}
+	request("dave", "bob")
+	if got := filtered("dave", "bob"); got != "" {
+		t.Errorf("contact of a contact: filtered for %q", got)
+	}
+	accept("bob", "mallory")
+
+	clk.Advance(2 * time.Hour)
+	request("mallory", "erin")
+	if got := filtered("mallory", "erin"); got != filterNoPublicKey {
+		t.Errorf("no public key: filtered for %q", got)
+	}
+
+	if err := st.UploadPublicKey(ctx, ids["eve"], "key"); err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []string{"x", "y", "z"} {
+		request("eve", to)
+		if err := svc.DeclineChat(ctx, ids[to], "eve"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request("eve", "bob")
+	if got := filtered("eve", "bob"); got != filterManyDeclines {
+		t.Errorf("declined three times: filtered for %q", got)
+	}
+	// The declines age out of the window
+	clk.Advance(7*24*time.Hour + time.Minute)
+	request("eve", "frank")
+	if got := filtered("eve", "frank"); got != "" {
+		t.Errorf("declines outside the window: filtered for %q", got)
+	}
+
+	got := svc.SpamStats()
+	want := SpamStats{
+		NewAccount:       stats.NewAccount + 1,
+		NoPublicKey:      stats.NoPublicKey + 1,
+		RecentlyDeclined: stats.RecentlyDeclined + 1,
+		Bypassed:         stats.Bypassed + 1,
+	}
+	if got != want {
+		t.Errorf("stats %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,280 @@
+// src/chatservice/twofactor.go
+package chatservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cryptachat-server/store"
+	"cryptachat-server/totp"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Two-factor authentication: /2fa/enable hands out a TOTP secret and
+// recovery codes, /2fa/verify turns it on with a first code, and from then
+// on /login only returns a pending token that /2fa/login exchanges, with a
+// code, for the real ones.
+
+const (
+	// totpIssuer names the account in authenticator apps.
+	totpIssuer = "Cryptachat"
+	// totpSkew is how many 30 second steps a code may be off by.
+	totpSkew = 1
+	// twoFactorPendingTTL is how long a pending token from /login is valid.
+	twoFactorPendingTTL = 5 * time.Minute
+	// recoveryCodeCount is how many recovery codes setup generates.
+	recoveryCodeCount = 10
+	// twoFactorAttempts codes may be tried per user per twoFactorWindow,
+	// which keeps guessing a 6 digit code out of reach.
+	twoFactorAttempts = 5
+	twoFactorWindow   = 5 * time.Minute
+)
+
+// AudienceTwoFactor is the audience of the pending token from /login,
+// which is only good for /2fa/login. The auth middleware refuses it, as it
+// accepts only AudienceAccess.
+const AudienceTwoFactor = "2fa_pending"
+
+// CodeTwoFactorInvalid is the error code of a wrong or reused code, or an
+// invalid or expired pending token.
+const CodeTwoFactorInvalid = "two_factor_invalid"
+
+// Audit event types for two-factor changes.
+const (
+	auditTwoFactorEnabled      = "two_factor.enabled"
+	auditTwoFactorDisabled     = "two_factor.disabled"
+	auditTwoFactorRecoveryUsed = "two_factor.recovery_code_used"
+)
+
+// TwoFactorSetup is what /2fa/enable returns. The recovery codes are shown
+// this once; only their hashes are stored.
+type TwoFactorSetup struct {
+	OTPAuthURI    string   `json:"otpauth_uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+	Secret        string   `json:"secret"`
+}
+
+// EnableTwoFactor starts two-factor setup for user with a new secret and
+// new recovery codes. It stays off until VerifyTwoFactor confirms a code,
+// and calling this again before then starts over.
+func (s *Service) EnableTwoFactor(ctx context.Context, user *store.User) (*TwoFactorSetup, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, internal(err)
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = newRecoveryCode(); err != nil {
+			return nil, internal(err)
+		}
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	if err := s.store.StartTOTP(ctx, user.ID, secret, hashes); err != nil {
+		if strings.Contains(err.Error(), "already enabled") {
+			return nil, conflict("Two-factor authentication is already on. Disable it first to start over.")
+		}
+		return nil, internal(err)
+	}
+	return &TwoFactorSetup{
+		OTPAuthURI:    totp.URI(totpIssuer, user.Username, secret),
+		RecoveryCodes: codes,
+		Secret:        secret,
+	}, nil
+}
+
+// VerifyTwoFactor turns two-factor authentication on once the user proves
+// their authenticator app has the secret.
+func (s *Service) VerifyTwoFactor(ctx context.Context, userID int, code string) error {
+	if code == "" {
+		return invalid("Missing code")
+	}
+	setup, err := s.store.GetTOTP(ctx, userID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not set up") {
+			return conflict("Start two-factor setup with POST /2fa/enable first.")
+		}
+		return internal(err)
+	}
+	if setup.Enabled {
+		return conflict("Two-factor authentication is already on.")
+	}
+
+	if err := s.checkTOTP(ctx, userID, setup, code); err != nil {
+		return err
+	}
+	s.audit(ctx, userID, auditTwoFactorEnabled, nil)
+	return nil
+}
+
+// DisableTwoFactor turns two-factor authentication off. Both the password
+// and a current code (or a recovery code) are required.
+func (s *Service) DisableTwoFactor(ctx context.Context, user *store.User, password, code string) error {
+	if password == "" || code == "" {
+		return invalid("Missing password or code")
+	}
+	if err := s.checkPassword(ctx, user, password); err != nil {
+		if KindOf(err) == KindUnavailable {
+			return err
+		}
+		return forbidden("Password is incorrect.")
+	}
+	setup, err := s.store.GetTOTP(ctx, user.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not set up") {
+			return conflict("Two-factor authentication is not on.")
+		}
+		return internal(err)
+	}
+	if !setup.Enabled {
+		return conflict("Two-factor authentication is not on.")
+	}
+
+	if err := s.checkSecondFactor(ctx, user.ID, setup, code); err != nil {
+		return err
+	}
+	if err := s.store.DeleteTOTP(ctx, user.ID); err != nil {
+		return internal(err)
+	}
+	s.audit(ctx, user.ID, auditTwoFactorDisabled, nil)
+	return nil
+}
+
+// TwoFactorLogin completes a login that /login answered with a pending
+// token, given a current code or an unused recovery code.
+func (s *Service) TwoFactorLogin(ctx context.Context, pendingToken, code string, client ClientInfo, refresh bool) (*TokenPair, error) {
+	if pendingToken == "" || code == "" {
+		return nil, invalid("Missing pending_token or code")
+	}
+
+	claims := &Claims{}
+	_, err := s.cfg.TokenSigner.Parse(pendingToken, claims, jwt.WithTimeFunc(s.clock.Now), jwt.WithAudience(AudienceTwoFactor))
+	if err != nil {
+		return nil, twoFactorRefused(KindUnauthorized, "Pending token is invalid or expired. Log in again.")
+	}
+
+	user, err := s.store.GetUserByID(ctx, claims.UserID)
+	if err != nil || claims.TokenVersion != user.TokenVersion {
+		return nil, twoFactorRefused(KindUnauthorized, "Pending token is invalid or expired. Log in again.")
+	}
+	setup, err := s.store.GetTOTP(ctx, user.ID)
+	if err != nil && !strings.Contains(err.Error(), "not set up") {
+		return nil, internal(err)
+	}
+	if setup == nil || !setup.Enabled {
+		// Turned off since /login; the password was already checked
+		return s.completeLogin(ctx, user, client, refresh)
+	}
+
+	if err := s.checkSecondFactor(ctx, user.ID, setup, code); err != nil {
+		if KindOf(err) == KindForbidden {
+			return nil, twoFactorRefused(KindUnauthorized, "Code is incorrect or was already used.")
+		}
+		return nil, err
+	}
+	return s.completeLogin(ctx, user, client, refresh)
+}
+
+// pendingToken signs the JWT /login returns instead of an access token
+// when the user has two-factor authentication on.
+func (s *Service) pendingToken(user *store.User) (*TokenPair, error) {
+	now := s.clock.Now()
+	claims := Claims{
+		UserID:       user.ID,
+		Username:     user.Username,
+		TokenVersion: user.TokenVersion,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{AudienceTwoFactor},
+			ExpiresAt: jwt.NewNumericDate(now.Add(twoFactorPendingTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	token, err := s.cfg.TokenSigner.Sign(claims)
+	if err != nil {
+		return nil, internal(fmt.Errorf("Error creating token: %v", err))
+	}
+	return &TokenPair{TwoFactorToken: token, ExpiresIn: twoFactorPendingTTL}, nil
+}
+
+// checkSecondFactor accepts a current TOTP code or, failing that, an
+// unused recovery code, which it uses up.
+func (s *Service) checkSecondFactor(ctx context.Context, userID int, setup *store.TOTP, code string) error {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) == totp.Digits {
+		return s.checkTOTP(ctx, userID, setup, code)
+	}
+
+	if err := s.allowTwoFactorAttempt(userID); err != nil {
+		return err
+	}
+	remaining, err := s.store.UseRecoveryCode(ctx, userID, hashRecoveryCode(code))
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return twoFactorRefused(KindForbidden, "Recovery code is incorrect or was already used.")
+		}
+		return internal(err)
+	}
+	s.audit(ctx, userID, auditTwoFactorRecoveryUsed, map[string]interface{}{"remaining": remaining})
+	return nil
+}
+
+// checkTOTP accepts code if it is current and no code for the same or a
+// later step was accepted before.
+func (s *Service) checkTOTP(ctx context.Context, userID int, setup *store.TOTP, code string) error {
+	if err := s.allowTwoFactorAttempt(userID); err != nil {
+		return err
+	}
+	step, ok := totp.Verify(setup.Secret, code, s.clock.Now(), totpSkew)
+	if !ok || step <= setup.LastStep {
+		return twoFactorRefused(KindForbidden, "Code is incorrect or was already used.")
+	}
+	if err := s.store.UseTOTPStep(ctx, userID, step); err != nil {
+		if strings.Contains(err.Error(), "already used") {
+			return twoFactorRefused(KindForbidden, "Code is incorrect or was already used.")
+		}
+		return internal(err)
+	}
+	return nil
+}
+
+// allowTwoFactorAttempt counts a code attempt against the user's limit.
+func (s *Service) allowTwoFactorAttempt(userID int) error {
+	if ok, retryAfter := s.twoFactorLimiter.Allow(strconv.Itoa(userID)); !ok {
+		return rateLimited("Too many two-factor attempts. Try again later.", retryAfter)
+	}
+	return nil
+}
+
+func twoFactorRefused(kind Kind, msg string) error {
+	return &Error{
+		Kind:    kind,
+		Message: msg,
+		Details: map[string]interface{}{"code": CodeTwoFactorInvalid},
+	}
+}
+
+// newRecoveryCode returns 10 random bytes as 16 base32 characters, in four
+// groups for reading out.
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate recovery code: %w", err)
+	}
+	c := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return c[0:4] + "-" + c[4:8] + "-" + c[8:12] + "-" + c[12:16], nil
+}
+
+// hashRecoveryCode is the form a recovery code is stored and looked up in.
+// Case and separators don't matter, and the codes are random enough for a
+// plain SHA-256.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashRefreshToken(code)
+}
@@ -0,0 +1,56 @@
+// src/chatservice/twofactor_test.go
+package chatservice
+
+import (
+	"context"
+	"testing"
+)
+
+// TestTwoFactorLoginTakesOnlyPendingTokens hands /2fa/login an access
+// token, which is signed with the same key as pending tokens but carries
+// the access audience, then a real pending token, and one that expired.
+func TestTwoFactorLoginTakesOnlyPendingTokens(t *testing.T) {
+	svc, st, clk := newTestService(t)
+	ctx := context.Background()
+	if err := st.RegisterUser(ctx, "alice", "hash", nil); err != nil {
+		t.Fatal(err)
+	}
+	id, err := st.GetUserIDByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := st.GetUserByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	access, err := svc.accessToken(user, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.TwoFactorLogin(ctx, access, "123456", ClientInfo{}, false)
+	if KindOf(err) != KindUnauthorized {
+		t.Fatalf("access token as a pending token: got %v, want unauthorized", err)
+	}
+
+	// Two-factor is off, so a valid pending token completes the login
+	// without checking the code
+	pending, err := svc.pendingToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := svc.TwoFactorLogin(ctx, pending.TwoFactorToken, "123456", ClientInfo{}, false)
+	if err != nil || pair.AccessToken == "" {
+		t.Fatalf("pending token: %+v, %v", pair, err)
+	}
+
+	pending, err = svc.pendingToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(twoFactorPendingTTL)
+	_, err = svc.TwoFactorLogin(ctx, pending.TwoFactorToken, "123456", ClientInfo{}, false)
+	if KindOf(err) != KindUnauthorized {
+		t.Errorf("expired pending token: got %v, want unauthorized", err)
+	}
+}
@@ -0,0 +1,135 @@
+// src/chatservice/username.go
+package chatservice
+
+import (
+	"context"
+	"fmt"
+	"unicode/utf8"
+
+	"cryptachat-server/store"
+)
+
+// New usernames are lowercased (store.CanonicalUsername) and must then be
+// MinUsernameLength to MaxUsernameLength characters of a-z, 0-9, '_', '.'
+// and '-', starting and ending with a letter or digit. '@' in particular is
+// reserved for addressing users on other instances. Accounts registered
+// before the rule keep their names, and every lookup compares canonical
+// forms, so "Alice" and "alice" always find the same account.
+const (
+	MinUsernameLength = 3
+	MaxUsernameLength = 32
+)
+
+// CodeInvalidUsername is the error code of usernames refused at
+// registration; the error's rule is the one that failed.
+const CodeInvalidUsername = "invalid_username"
+
+// Rules a new username can break, checked in this order.
+const (
+	usernameTooShort     = "too_short"
+	usernameTooLong      = "too_long"
+	usernameBadCharacter = "invalid_characters"
+	usernameBadEdge      = "leading_or_trailing_punctuation"
+)
+
+// normalizeUsername checks a username for a new account and returns the
+// form it is stored in.
+func normalizeUsername(username string) (string, error) {
+	username = store.CanonicalUsername(username)
+	var rule, msg string
+	switch n := utf8.RuneCountInString(username); {
+	case n < MinUsernameLength:
+		rule, msg = usernameTooShort, fmt.Sprintf("Username must be at least %d characters.", MinUsernameLength)
+	case n > MaxUsernameLength:
+		rule, msg = usernameTooLong, fmt.Sprintf("Username must be at most %d characters.", MaxUsernameLength)
+	case !usernameChars(username):
+		rule, msg = usernameBadCharacter, "Username may only contain a-z, 0-9, '_', '.' and '-'."
+	case !usernameEdge(username[0]) || !usernameEdge(username[len(username)-1]):
+		rule, msg = usernameBadEdge, "Username must start and end with a letter or digit."
+	default:
+		return username, nil
+	}
+	return "", &Error{
+		Kind:    KindInvalid,
+		Message: msg,
+		Details: map[string]interface{}{
+			"code":       CodeInvalidUsername,
+			"rule":       rule,
+			"min_length": MinUsernameLength,
+			"max_length": MaxUsernameLength,
+		},
+	}
+}
+
+func usernameChars(username string) bool {
+	for i := 0; i < len(username); i++ {
+		if c := username[i]; !usernameEdge(c) && c != '_' && c != '.' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func usernameEdge(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+const auditUsernameChanged = "account.username_changed"
+
+// UsernameChange is the result of ChangeUsername.
+type UsernameChange struct {
+	Username         string
+	PreviousUsername string
+	Tokens           *TokenPair // For a new session; the old ones were signed out
+}
+
+// ChangeUsername renames userID to newUsername, after checking their
+// password. The new name follows the registration rules. Contacts, requests
+// and messages refer to the user by ID, so they follow the rename; the
+// store tells connected contacts, and offline ones are told to refresh
+// their lists. Tokens carry the old name, so every session is signed out,
+// as after a password change, and tokens for a new one are returned.
+func (s *Service) ChangeUsername(ctx context.Context, userID int, password, newUsername string, client ClientInfo) (*UsernameChange, error) {
+	if password == "" || newUsername == "" {
+		return nil, invalid("Missing password or new_username")
+	}
+	username, err := normalizeUsername(newUsername)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.store.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, internal(err)
+	}
+	if err := s.checkPassword(ctx, user, password); err != nil {
+		if KindOf(err) == KindUnavailable {
+			return nil, err
+		}
+		return nil, forbidden("Password is incorrect.")
+	}
+	if username == user.Username {
+		return nil, invalid("The new username must differ from the current one.")
+	}
+
+	previous, version, partners, err := s.store.RenameUser(ctx, userID, username)
+	if err != nil {
+		switch err.Error() {
+		case "username already exists":
+			return nil, conflict("Username already exists.")
+		case "user not found":
+			return nil, notFound("User not found.")
+		}
+		return nil, internal(err)
+	}
+	s.audit(ctx, userID, auditUsernameChanged, map[string]interface{}{"previous": previous, "username": username})
+
+	s.invalidate(ctx, partners, ScopeContacts, username)
+	s.invalidate(ctx, partners, ScopeChatRequests, username)
+
+	user.Username, user.TokenVersion = username, version
+	pair, err := s.issueTokens(ctx, user, client, true)
+	if err != nil {
+		return nil, err
+	}
+	return &UsernameChange{Username: username, PreviousUsername: previous, Tokens: pair}, nil
+}
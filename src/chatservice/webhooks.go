@@ -0,0 +1,73 @@
+// src/chatservice/webhooks.go
+package chatservice
+
+import (
+	"context"
+
+	"cryptachat-server/integrations"
+	"cryptachat-server/store"
+)
+
+// EnableWebhooks sends message and chat request events through w.
+func (s *Service) EnableWebhooks(w *integrations.Sender) {
+	s.webhooks = w
+}
+
+// WebhookStats returns the webhook sender's counters, or nil if webhooks
+// are off.
+func (s *Service) WebhookStats() *integrations.SenderStats {
+	if s.webhooks == nil {
+		return nil
+	}
+	st := s.webhooks.Stats()
+	return &st
+}
+
+// publishMessageStored sends message_stored for a message senderID sent
+// recipientID. Sealed messages send nothing, since the event would name
+// their sender.
+func (s *Service) publishMessageStored(ctx context.Context, messageID, senderID, recipientID int) {
+	if s.webhooks == nil {
+		return
+	}
+	fields := map[string]interface{}{
+		"event":        integrations.EventMessageStored,
+		"message_id":   messageID,
+		"sender_id":    senderID,
+		"recipient_id": recipientID,
+		"timestamp":    store.NewTimestamp(s.clock.Now()),
+	}
+	s.addUsernames(ctx, fields, "sender_username", senderID, "recipient_username", recipientID)
+	s.webhooks.Publish(integrations.EventMessageStored, fields)
+}
+
+// publishChatRequest sends event (chat_request_created or
+// chat_request_accepted) for requesterID's request to requestedID.
+func (s *Service) publishChatRequest(ctx context.Context, event string, requesterID, requestedID int) {
+	if s.webhooks == nil {
+		return
+	}
+	fields := map[string]interface{}{
+		"event":        event,
+		"requester_id": requesterID,
+		"requested_id": requestedID,
+		"timestamp":    store.NewTimestamp(s.clock.Now()),
+	}
+	s.addUsernames(ctx, fields, "requester_username", requesterID, "requested_username", requestedID)
+	s.webhooks.Publish(event, fields)
+}
+
+// addUsernames sets the two users' usernames in fields when the privacy
+// mode lets them through, so ids_only doesn't cost the lookups. A user
+// who can't be read is left out.
+func (s *Service) addUsernames(ctx context.Context, fields map[string]interface{}, keyA string, idA int, keyB string, idB int) {
+	if s.webhooks.Filter().Mode() != integrations.ModeIDsAndUsernames {
+		return
+	}
+	if u, err := s.store.GetAuthUser(ctx, idA); err == nil {
+		fields[keyA] = u.Username
+	}
+	if u, err := s.store.GetAuthUser(ctx, idB); err == nil {
+		fields[keyB] = u.Username
+	}
+}
@@ -0,0 +1,942 @@
+// src/client/client.go
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cryptachat-server/pow"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client is a Go client for the CryptaChat API.
+// A Client is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+
+	mu           sync.Mutex
+	token        string
+	refreshToken string
+	pendingToken string // From a Login that needs a second factor
+
+	// refreshing is held while the refresh token is exchanged, so at most
+	// one exchange is in flight: the server treats a second exchange of
+	// the same refresh token as theft and signs the whole login out
+	refreshing chan struct{}
+}
+
+// apiPrefix is prepended to every API path.
+const apiPrefix = "/api/v1"
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient replaces the default *http.Client (15s timeout).
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithToken starts the client with an existing JWT instead of calling Login.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// New creates a client for the server at baseURL (e.g. "http://localhost:5000").
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 15 * time.Second},
+		refreshing: make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Sentinel errors matched by APIError via errors.Is.
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrServer       = errors.New("server error")
+	// ErrSignedOut means this login is over: its token was revoked, its
+	// session signed out, or its refresh token refused. Log in again.
+	ErrSignedOut = errors.New("signed out")
+)
+
+// Error codes the client acts on, as sent in APIError.Code.
+const (
+	CodeTokenExpired        = "token_expired"         // Renewed with the refresh token
+	CodeTokenRevoked        = "token_revoked"         // Token version bumped or session revoked
+	CodeRefreshTokenInvalid = "refresh_token_invalid" // Invalid, expired or revoked
+	CodeRefreshTokenReused  = "refresh_token_reused"  // Every session of the login was signed out
+)
+
+// APIError is returned when the server answers with a non-2xx status.
+// Use errors.Is(err, client.ErrNotFound) etc. to branch on the kind of failure.
+type APIError struct {
+	Status  int
+	Message string
+	Code    string // Machine-readable reason, if the server gave one (e.g. "key_fetch_limit")
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.Status, e.Message)
+}
+
+// Is maps the HTTP status onto the package's sentinel errors.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.Status == http.StatusBadRequest
+	case ErrUnauthorized:
+		return e.Status == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.Status == http.StatusForbidden
+	case ErrNotFound:
+		return e.Status == http.StatusNotFound
+	case ErrConflict:
+		return e.Status == http.StatusConflict
+	case ErrRateLimited:
+		return e.Status == http.StatusTooManyRequests
+	case ErrServer:
+		return e.Status >= 500
+	case ErrSignedOut:
+		switch e.Code {
+		case CodeTokenRevoked, CodeRefreshTokenInvalid, CodeRefreshTokenReused:
+			return e.Status == http.StatusUnauthorized
+		}
+	}
+	return false
+}
+
+// BatchResult is the outcome for one item of a batch call. Key echoes the
+// item as sent (a string, or a float64 for message IDs). Status is "ok" on
+// success; otherwise Code says why, e.g. "user_not_found" or "duplicate_in_batch".
+type BatchResult struct {
+	Key     interface{} `json:"key"`
+	Status  string      `json:"status"`
+	Code    string      `json:"code,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+}
+
+// OK reports whether the item succeeded.
+func (r BatchResult) OK() bool {
+	return r.Status == "ok"
+}
+
+// batch posts a batch request and returns the per-item results.
+func (c *Client) batch(ctx context.Context, path string, body interface{}) ([]BatchResult, error) {
+	var resp struct {
+		Results []BatchResult `json:"results"`
+	}
+	if err := c.do(ctx, http.MethodPost, path, nil, body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
+
+// Message mirrors the message object returned by /get_messages and pushed over the WebSocket.
+type Message struct {
+	ID             int       `json:"id"`
+	SenderID       int       `json:"sender_id"`
+	RecipientID    int       `json:"recipient_id"`
+	Timestamp      time.Time `json:"timestamp"`
+	SenderUsername string    `json:"sender_username"`
+	EncryptedBlob  string    `json:"encrypted_blob"`
+	Deleted        bool      `json:"deleted"`   // Your copy was pruned; EncryptedBlob is empty but ID still counts as a cursor
+	Transport      string    `json:"transport"` // "ws_live" or "poll"
+	Sealed         bool      `json:"sealed"`    // Sealed sender: SenderID and SenderUsername are empty
+	Seq            int64     `json:"seq"`       // 1, 2, 3... within the conversation; 0 if Sealed
+}
+
+// MessagePage is one message read. MaxID and MaxSeq are the conversation's
+// highest message ID and Seq when the server read it: a pushed message at
+// or below MaxSeq was already visible to this read, one above it is newer.
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	MaxID    int       `json:"max_id"`
+	MaxSeq   int64     `json:"max_seq"`
+}
+
+// Token returns the JWT obtained by the last successful Login.
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// do sends a JSON request and decodes a JSON response into out (if non-nil).
+// If the server found the access token expired, it renews the token with
+// the refresh token and retries the request once. A refused refresh is
+// returned, matching ErrSignedOut; any other 401, such as a revoked token,
+// is returned as is. The client never logs in again by itself, so
+// revoking a session or logging out everywhere sticks.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	token := c.Token()
+	err := c.doOnce(ctx, method, path, query, body, out, token)
+	if retry, err := c.renewIfExpired(ctx, token, err); !retry {
+		return err
+	}
+	return c.doOnce(ctx, method, path, query, body, out, c.Token())
+}
+
+// renewIfExpired renews the access token if err, from a request sent with
+// token, says the token expired, and reports whether to retry the request
+// with the new one. If not, it returns the error to give up with: err, or
+// the refresh's error if the server signed the login out.
+func (c *Client) renewIfExpired(ctx context.Context, token string, err error) (bool, error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized || apiErr.Code != CodeTokenExpired {
+		return false, err
+	}
+	if renewErr := c.renew(ctx, token); renewErr != nil {
+		if errors.Is(renewErr, ErrSignedOut) {
+			return false, renewErr
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// renew replaces stale, an access token the server found expired, using
+// the refresh token. Callers that hit the same expired token at once share
+// one exchange: those that get their turn after it find the token already
+// replaced and return at once.
+func (c *Client) renew(ctx context.Context, stale string) error {
+	if err := c.lockRefresh(ctx); err != nil {
+		return err
+	}
+	defer c.unlockRefresh()
+	if c.Token() != stale {
+		return nil
+	}
+	return c.refresh(ctx)
+}
+
+// lockRefresh waits for any refresh in flight to finish, or ctx to end.
+func (c *Client) lockRefresh(ctx context.Context) error {
+	select {
+	case c.refreshing <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) unlockRefresh() {
+	<-c.refreshing
+}
+
+// doOnce sends one request with token, if not empty, as its bearer token.
+func (c *Client) doOnce(ctx context.Context, method, path string, query url.Values, body, out interface{}, token string) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return fmt.Errorf("could not encode request: %v", err)
+		}
+	}
+
+	u := c.baseURL + apiPrefix + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, &reqBody)
+	if err != nil {
+		return fmt.Errorf("could not build request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return responseError(resp)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("could not decode response: %v", err)
+		}
+	}
+	return nil
+}
+
+// responseError decodes the error envelope of a non-2xx response.
+func responseError(resp *http.Response) *APIError {
+	var envelope struct {
+		Error struct {
+			Message string `json:"message"`
+			Code    string `json:"code"`
+		} `json:"error"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&envelope)
+	return &APIError{Status: resp.StatusCode, Message: envelope.Error.Message, Code: envelope.Error.Code}
+}
+
+// ---- Auth ----
+
+// Register creates a new account.
+func (c *Client) Register(ctx context.Context, username, password string) error {
+	return c.register(ctx, map[string]interface{}{"username": username, "password": password})
+}
+
+// RegisterWithInvite creates a new account on a server that requires
+// invites, redeeming inviteCode.
+func (c *Client) RegisterWithInvite(ctx context.Context, username, password, inviteCode string) error {
+	return c.register(ctx, map[string]interface{}{"username": username, "password": password, "invite_code": inviteCode})
+}
+
+// register posts body to /register, first solving a registration challenge
+// if the server requires proof of work. That can take a while at high
+// difficulties; ctx bounds it.
+func (c *Client) register(ctx context.Context, body map[string]interface{}) error {
+	var challenge struct {
+		Nonce      string `json:"nonce"`
+		Difficulty int    `json:"difficulty"`
+	}
+	err := c.do(ctx, http.MethodGet, "/register_challenge", nil, nil, &challenge)
+	var apiErr *APIError
+	switch {
+	case err == nil:
+		counter, err := pow.Solve(ctx, challenge.Nonce, challenge.Difficulty)
+		if err != nil {
+			return err
+		}
+		body["pow_nonce"] = challenge.Nonce
+		body["pow_counter"] = counter
+	case errors.As(err, &apiErr) && (apiErr.Code == "pow_disabled" || apiErr.Status == http.StatusNotFound):
+		// Not required here, or a server from before challenges
+	default:
+		return err
+	}
+	return c.do(ctx, http.MethodPost, "/register", nil, body, nil)
+}
+
+// CreateInvite mints a single-use invite code for someone else to register
+// with.
+func (c *Client) CreateInvite(ctx context.Context) (string, error) {
+	var resp struct {
+		Code string `json:"code"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/invites", nil, nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Code, nil
+}
+
+// tokenResponse is the body of /login and /refresh.
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+
+	// Set instead of the tokens when two-factor authentication is on
+	PendingToken      string `json:"pending_token"`
+	TwoFactorRequired bool   `json:"two_factor_required"`
+}
+
+// Login authenticates and stores the returned tokens on the client. An
+// expired access token is renewed with the refresh token; the password
+// isn't kept. If the user has two-factor authentication on, Login returns
+// ErrTwoFactorRequired; finish with LoginTwoFactor.
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	var resp tokenResponse
+	err := c.do(ctx, http.MethodPost, "/login", nil,
+		map[string]string{"username": username, "password": password}, &resp)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if resp.TwoFactorRequired {
+		c.pendingToken = resp.PendingToken
+		return ErrTwoFactorRequired
+	}
+	c.token = resp.Token
+	c.refreshToken = resp.RefreshToken
+	return nil
+}
+
+// Refresh exchanges the stored refresh token for a new access token and
+// refresh token. It fails with ErrUnauthorized if there is none, and with
+// an error matching ErrSignedOut if the server refused it; log in again
+// then. Calls never overlap, with each other or with the client's own
+// renewals.
+func (c *Client) Refresh(ctx context.Context) error {
+	if err := c.lockRefresh(ctx); err != nil {
+		return err
+	}
+	defer c.unlockRefresh()
+	return c.refresh(ctx)
+}
+
+// refresh is Refresh for callers holding the refresh lock.
+func (c *Client) refresh(ctx context.Context) error {
+	c.mu.Lock()
+	refreshToken := c.refreshToken
+	c.mu.Unlock()
+	if refreshToken == "" {
+		return fmt.Errorf("no refresh token: %w", ErrUnauthorized)
+	}
+
+	var resp tokenResponse
+	err := c.doOnce(ctx, http.MethodPost, "/refresh", nil,
+		map[string]string{"refresh_token": refreshToken}, &resp, "")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if errors.Is(err, ErrUnauthorized) {
+			c.refreshToken = ""
+		}
+		return err
+	}
+	c.token = resp.Token
+	c.refreshToken = resp.RefreshToken
+	return nil
+}
+
+// Logout revokes the stored refresh token and forgets the tokens. The access token stays valid on the server until it expires.
+func (c *Client) Logout(ctx context.Context) error {
+	c.mu.Lock()
+	refreshToken := c.refreshToken
+	c.mu.Unlock()
+	if refreshToken != "" {
+		err := c.do(ctx, http.MethodPost, "/logout", nil,
+			map[string]string{"refresh_token": refreshToken}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	c.token, c.refreshToken = "", ""
+	c.mu.Unlock()
+	return nil
+}
+
+// LogoutEverywhere signs the user out of every session, including this
+// one: all their access and refresh tokens stop working. The client
+// forgets its tokens.
+func (c *Client) LogoutEverywhere(ctx context.Context) error {
+	if err := c.do(ctx, http.MethodPost, "/logout_all", nil, nil, nil); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.token, c.refreshToken = "", ""
+	c.mu.Unlock()
+	return nil
+}
+
+// Profile is the user's own account, from GET /me.
+type Profile struct {
+	ID           int             `json:"id"`
+	Username     string          `json:"username"`
+	IsAdmin      bool            `json:"is_admin"`
+	HasPublicKey bool            `json:"has_public_key"` // If not, upload one before chatting
+	CreatedAt    time.Time       `json:"created_at"`
+	LastLogin    *time.Time      `json:"last_login"`
+	FeatureFlags map[string]bool `json:"feature_flags"`
+}
+
+// Me fetches the user's own profile.
+func (c *Client) Me(ctx context.Context) (*Profile, error) {
+	var profile Profile
+	if err := c.do(ctx, http.MethodGet, "/me", nil, nil, &profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// Session is one of the places the user is logged in.
+type Session struct {
+	ID          int64     `json:"id"`
+	DeviceLabel string    `json:"device_label"`
+	IP          string    `json:"ip"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Current     bool      `json:"current"` // This client's own session
+	// Whether the session holds the user's WebSocket
+	WSConnected    bool       `json:"ws_connected"`
+	WSConnectedAt  *time.Time `json:"ws_connected_at,omitempty"`
+	WSLastActivity *time.Time `json:"ws_last_activity,omitempty"`
+}
+
+// Sessions lists the user's sessions, most recently used first.
+func (c *Client) Sessions(ctx context.Context) ([]Session, error) {
+	var resp struct {
+		Sessions []Session `json:"sessions"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/sessions", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Sessions, nil
+}
+
+// RevokeSession signs the user out of one of their sessions. Revoking the
+// client's own leaves it unable to refresh; log in again.
+func (c *Client) RevokeSession(ctx context.Context, sessionID int64) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/sessions/%d", sessionID), nil, nil, nil)
+}
+
+// ChangePassword replaces the user's password. The server signs out every
+// session, so the client stores the new tokens it returns.
+func (c *Client) ChangePassword(ctx context.Context, currentPassword, newPassword string) error {
+	var resp tokenResponse
+	err := c.do(ctx, http.MethodPost, "/change_password", nil,
+		map[string]string{"current_password": currentPassword, "new_password": newPassword}, &resp)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.token = resp.Token
+	c.refreshToken = resp.RefreshToken
+	c.mu.Unlock()
+	return nil
+}
+
+// ChangeUsername renames the current user, confirmed by their password,
+// and returns the name it was stored as. Like ChangePassword, it signs out
+// every session, so the client stores the new tokens it returns.
+func (c *Client) ChangeUsername(ctx context.Context, password, newUsername string) (string, error) {
+	var resp struct {
+		tokenResponse
+		Username string `json:"username"`
+	}
+	err := c.do(ctx, http.MethodPost, "/change_username", nil,
+		map[string]string{"password": password, "new_username": newUsername}, &resp)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.token = resp.Token
+	c.refreshToken = resp.RefreshToken
+	c.mu.Unlock()
+	return resp.Username, nil
+}
+
+// RecoveryEmail is the user's recovery email. Email is empty if they have
+// none.
+type RecoveryEmail struct {
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
+}
+
+// SetRecoveryEmail sets the user's recovery email, or removes it with "".
+// A new address is unverified until VerifyEmail is called with the code
+// mailed to it.
+func (c *Client) SetRecoveryEmail(ctx context.Context, email string) (*RecoveryEmail, error) {
+	var resp struct {
+		Email    *string `json:"email"`
+		Verified bool    `json:"verified"`
+	}
+	if err := c.do(ctx, http.MethodPut, "/email", nil, map[string]string{"email": email}, &resp); err != nil {
+		return nil, err
+	}
+	e := &RecoveryEmail{Verified: resp.Verified}
+	if resp.Email != nil {
+		e.Email = *resp.Email
+	}
+	return e, nil
+}
+
+// VerifyEmail redeems the verification code mailed to a new recovery
+// email.
+func (c *Client) VerifyEmail(ctx context.Context, code string) error {
+	return c.do(ctx, http.MethodPost, "/verify_email", nil, map[string]string{"token": code}, nil)
+}
+
+// RequestPasswordReset asks for a reset code to be mailed to email. It
+// succeeds whether or not any account has that address.
+func (c *Client) RequestPasswordReset(ctx context.Context, email string) error {
+	return c.do(ctx, http.MethodPost, "/request_password_reset", nil, map[string]string{"email": email}, nil)
+}
+
+// ResetPassword sets a new password with a mailed reset code. Every session
+// of that account is signed out; log in again afterwards.
+func (c *Client) ResetPassword(ctx context.Context, code, newPassword string) error {
+	return c.do(ctx, http.MethodPost, "/reset_password", nil,
+		map[string]string{"token": code, "new_password": newPassword}, nil)
+}
+
+// DeleteAccount deletes the user's account and everything stored for it.
+// The client forgets its tokens.
+func (c *Client) DeleteAccount(ctx context.Context, password string) error {
+	err := c.do(ctx, http.MethodDelete, "/account", nil,
+		map[string]string{"password": password}, nil)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.token, c.refreshToken = "", ""
+	c.mu.Unlock()
+	return nil
+}
+
+// ---- Keys ----
+
+// UploadKey uploads or replaces the current user's public key.
+func (c *Client) UploadKey(ctx context.Context, publicKey string) error {
+	return c.do(ctx, http.MethodPost, "/upload_key", nil,
+		map[string]string{"public_key": publicKey}, nil)
+}
+
+// GetKey fetches the public key of another user.
+func (c *Client) GetKey(ctx context.Context, username string) (string, error) {
+	var resp struct {
+		PublicKey string `json:"public_key"`
+	}
+	err := c.do(ctx, http.MethodGet, "/get_key", url.Values{"username": {username}}, nil, &resp)
+	if err != nil {
+		return "", err
+	}
+	return resp.PublicKey, nil
+}
+
+// GetKeys fetches the public keys of several users in one call. Each
+// successful result carries the key as its Value.
+func (c *Client) GetKeys(ctx context.Context, usernames []string) ([]BatchResult, error) {
+	return c.batch(ctx, "/get_keys", map[string][]string{"usernames": usernames})
+}
+
+// Prekey is a one-time prekey, as uploaded and as served in a bundle.
+type Prekey struct {
+	KeyID     int    `json:"key_id"`
+	PublicKey string `json:"public_key"`
+}
+
+// PrekeyBundle is another user's identity key plus, if any were left, one of
+// their one-time prekeys.
+type PrekeyBundle struct {
+	Username      string  `json:"username"`
+	IdentityKey   string  `json:"identity_key"`
+	OneTimePrekey *Prekey `json:"one_time_prekey"`
+}
+
+// UploadPrekeys adds one-time prekeys and returns how many unused ones the
+// server now holds.
+func (c *Client) UploadPrekeys(ctx context.Context, prekeys []Prekey) (int, error) {
+	var resp struct {
+		Remaining int `json:"prekeys_remaining"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/prekeys", nil, map[string][]Prekey{"prekeys": prekeys}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Remaining, nil
+}
+
+// GetPrekeyBundle fetches a bundle for username, consuming one of their prekeys.
+func (c *Client) GetPrekeyBundle(ctx context.Context, username string) (*PrekeyBundle, error) {
+	var bundle PrekeyBundle
+	if err := c.do(ctx, http.MethodGet, "/prekey_bundle", url.Values{"username": {username}}, nil, &bundle); err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// ---- Chat requests ----
+
+// RequestChat sends a chat request to recipient.
+func (c *Client) RequestChat(ctx context.Context, recipient string) error {
+	return c.do(ctx, http.MethodPost, "/request_chat", nil,
+		map[string]string{"recipient_username": recipient}, nil)
+}
+
+// AcceptChat accepts a pending chat request from requester.
+func (c *Client) AcceptChat(ctx context.Context, requester string) error {
+	return c.do(ctx, http.MethodPost, "/accept_chat", nil,
+		map[string]string{"requester_username": requester}, nil)
+}
+
+// AcceptChats accepts pending chat requests from several users in one call.
+func (c *Client) AcceptChats(ctx context.Context, requesters []string) ([]BatchResult, error) {
+	return c.batch(ctx, "/accept_chat/batch", map[string][]string{"requester_usernames": requesters})
+}
+
+// DeclineChat declines a pending chat request from requester.
+func (c *Client) DeclineChat(ctx context.Context, requester string) error {
+	return c.do(ctx, http.MethodPost, "/decline_chat", nil,
+		map[string]string{"requester_username": requester}, nil)
+}
+
+// ChatRequest is one pending incoming chat request.
+type ChatRequest struct {
+	RequesterUsername string    `json:"requester_username"`
+	Status            string    `json:"status"`
+	CreatedAt         time.Time `json:"created_at"`
+	Filtered          bool      `json:"filtered"`
+	FilterReason      string    `json:"filter_reason"`
+}
+
+// GetChatRequests lists the current user's pending incoming chat requests,
+// oldest first. includeFiltered also returns those the spam heuristics hid.
+func (c *Client) GetChatRequests(ctx context.Context, includeFiltered bool) ([]ChatRequest, error) {
+	var query url.Values
+	if includeFiltered {
+		query = url.Values{"include_filtered": {"true"}}
+	}
+	var resp struct {
+		Requests []ChatRequest `json:"pending_requests"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/get_chat_requests", query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Requests, nil
+}
+
+// GetContacts lists the current user's accepted contacts.
+func (c *Client) GetContacts(ctx context.Context) ([]string, error) {
+	var resp struct {
+		Contacts []string `json:"contacts"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/get_contacts", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Contacts, nil
+}
+
+// Relationship is one entry of GetRelationships.
+type Relationship struct {
+	Username     string     `json:"username"`
+	State        string     `json:"state"` // accepted, incoming_pending, outgoing_pending or declined_by_me
+	HasPublicKey bool       `json:"has_public_key"`
+	LastActivity *time.Time `json:"last_activity"`
+	AcceptedAt   *time.Time `json:"accepted_at"` // Set only for accepted contacts
+	// InitiatedByMe is true if the current user sent the request.
+	InitiatedByMe bool `json:"initiated_by_me"`
+}
+
+// GetRelationships returns one page of everyone the current user has a chat
+// request with. Pass the returned cursor as after to get the next page; it
+// is "" on the last page. limit 0 uses the server default.
+func (c *Client) GetRelationships(ctx context.Context, after string, limit int) ([]Relationship, string, error) {
+	var resp struct {
+		Relationships []Relationship `json:"relationships"`
+		NextAfter     string         `json:"next_after"`
+	}
+	query := url.Values{}
+	if after != "" {
+		query.Set("after", after)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if err := c.do(ctx, http.MethodGet, "/relationships", query, nil, &resp); err != nil {
+		return nil, "", err
+	}
+	return resp.Relationships, resp.NextAfter, nil
+}
+
+// ---- Messages ----
+
+// SendMessage sends an encrypted message to recipient.
+func (c *Client) SendMessage(ctx context.Context, recipient, senderBlob, recipientBlob string) error {
+	return c.do(ctx, http.MethodPost, "/send_message", nil, map[string]string{
+		"recipient_username": recipient,
+		"sender_blob":        senderBlob,
+		"recipient_blob":     recipientBlob,
+	}, nil)
+}
+
+// GetMessages fetches messages exchanged with partner that have an ID greater
+// than sinceID. Pass the highest ID returned, deleted stubs included, as the
+// next sinceID.
+func (c *Client) GetMessages(ctx context.Context, partner string, sinceID int) ([]Message, error) {
+	return c.GetMessagesDirection(ctx, partner, sinceID, "")
+}
+
+// GetMessagesDirection is GetMessages limited to one direction: "incoming"
+// (sent by partner), "outgoing" (sent by you) or "both". "" means both.
+func (c *Client) GetMessagesDirection(ctx context.Context, partner string, sinceID int, direction string) ([]Message, error) {
+	page, err := c.GetMessagePage(ctx, partner, sinceID, direction)
+	if err != nil {
+		return nil, err
+	}
+	return page.Messages, nil
+}
+
+// GetMessagePage is GetMessagesDirection with the read's snapshot, for
+// clients that merge polls with pushed messages.
+func (c *Client) GetMessagePage(ctx context.Context, partner string, sinceID int, direction string) (*MessagePage, error) {
+	var page MessagePage
+	query := url.Values{"username": {partner}, "since_id": {strconv.Itoa(sinceID)}}
+	if direction != "" {
+		query.Set("direction", direction)
+	}
+	if err := c.do(ctx, http.MethodGet, "/get_messages", query, nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// SetSealedSender opts in to (or out of) sealed-sender messages with the
+// contact partner. It returns whether both sides have opted in.
+func (c *Client) SetSealedSender(ctx context.Context, partner string, enabled bool) (bool, error) {
+	var resp struct {
+		Mutual bool `json:"mutual"`
+	}
+	err := c.do(ctx, http.MethodPost, "/sealed_sender", nil,
+		map[string]interface{}{"username": partner, "enabled": enabled}, &resp)
+	return resp.Mutual, err
+}
+
+// SendSealedMessage sends a message that is stored without its sender. The
+// server keeps no copy for the sender, so recipientBlob should identify the
+// sender to the recipient and the caller should keep its own copy.
+func (c *Client) SendSealedMessage(ctx context.Context, recipient, recipientBlob string) error {
+	return c.do(ctx, http.MethodPost, "/send_message", nil, map[string]interface{}{
+		"recipient_username": recipient,
+		"recipient_blob":     recipientBlob,
+		"sealed":             true,
+	}, nil)
+}
+
+// GetSealedMessages fetches sealed-sender messages received after sinceID.
+func (c *Client) GetSealedMessages(ctx context.Context, sinceID int) ([]Message, error) {
+	var resp struct {
+		Messages []Message `json:"messages"`
+	}
+	query := url.Values{"since_id": {strconv.Itoa(sinceID)}}
+	if err := c.do(ctx, http.MethodGet, "/messages/sealed", query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
+
+// MarkDelivered tells the server these received messages reached the client.
+func (c *Client) MarkDelivered(ctx context.Context, messageIDs []int) ([]BatchResult, error) {
+	return c.MarkDeliveredVia(ctx, messageIDs, "")
+}
+
+// MarkDeliveredVia is MarkDelivered for messages that all arrived by the
+// given transport (their Message.Transport), so senders can see how they
+// were delivered.
+func (c *Client) MarkDeliveredVia(ctx context.Context, messageIDs []int, via string) ([]BatchResult, error) {
+	return c.batch(ctx, "/messages/delivered", struct {
+		MessageIDs []int  `json:"message_ids"`
+		Via        string `json:"via,omitempty"`
+	}{messageIDs, via})
+}
+
+// MessageStatus is the delivery status of a message you sent or received.
+type MessageStatus struct {
+	MessageID    int        `json:"message_id"`
+	SentAt       time.Time  `json:"sent_at"`
+	DeliveredAt  *time.Time `json:"delivered_at"`
+	DeliveredVia *string    `json:"delivered_via"`
+}
+
+// GetMessageStatus returns when and how a message was delivered.
+func (c *Client) GetMessageStatus(ctx context.Context, messageID int) (*MessageStatus, error) {
+	var status MessageStatus
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/messages/%d/status", messageID), nil, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Messages iterates over every message exchanged with partner after sinceID,
+// fetching further pages until the server returns an empty one.
+// Iteration stops at the first error, which is yielded with a zero Message.
+func (c *Client) Messages(ctx context.Context, partner string, sinceID int) iter.Seq2[Message, error] {
+	return func(yield func(Message, error) bool) {
+		for {
+			page, err := c.GetMessages(ctx, partner, sinceID)
+			if err != nil {
+				yield(Message{}, err)
+				return
+			}
+			if len(page) == 0 {
+				return
+			}
+			for _, msg := range page {
+				if !yield(msg, nil) {
+					return
+				}
+				if msg.ID > sinceID {
+					sinceID = msg.ID
+				}
+			}
+		}
+	}
+}
+
+// ---- Sync ----
+
+// Sync returns the cache invalidations after since (0 for all retained ones)
+// and the cursor to pass next time. more is true if another call would
+// return further entries.
+func (c *Client) Sync(ctx context.Context, since int64) (invs []Invalidation, next int64, more bool, err error) {
+	var resp struct {
+		Invalidations []Invalidation `json:"invalidations"`
+		NextSince     int64          `json:"next_since"`
+		HasMore       bool           `json:"has_more"`
+	}
+	query := url.Values{"since": {strconv.FormatInt(since, 10)}}
+	if err := c.do(ctx, http.MethodGet, "/sync", query, nil, &resp); err != nil {
+		return nil, since, false, err
+	}
+	return resp.Invalidations, resp.NextSince, resp.HasMore, nil
+}
+
+// ---- WebSocket ----
+
+// DialWS opens an authenticated WebSocket connection to /ws, renewing an
+// expired access token like any other call. A refused upgrade is returned
+// as an *APIError. The caller owns the returned connection and must close
+// it.
+func (c *Client) DialWS(ctx context.Context) (*websocket.Conn, error) {
+	token := c.Token()
+	conn, err := c.dialWS(ctx, token)
+	if retry, err := c.renewIfExpired(ctx, token, err); !retry {
+		return conn, err
+	}
+	return c.dialWS(ctx, c.Token())
+}
+
+func (c *Client) dialWS(ctx context.Context, token string) (*websocket.Conn, error) {
+	wsURL := c.baseURL + apiPrefix + "/ws"
+	if strings.HasPrefix(wsURL, "https://") {
+		wsURL = "wss://" + strings.TrimPrefix(wsURL, "https://")
+	} else {
+		wsURL = "ws://" + strings.TrimPrefix(wsURL, "http://")
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		if errors.Is(err, websocket.ErrBadHandshake) && resp != nil {
+			defer resp.Body.Close()
+			return nil, responseError(resp)
+		}
+		return nil, fmt.Errorf("websocket dial failed: %v", err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,635 @@
+// src/client/client_test.go
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cryptachat-server/pow"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeServer stands in for the API's auth. It issues access tokens
+// "access-N" and refresh tokens "refresh-N", answers expired and revoked
+// tokens with the server's codes, and treats a second exchange of a
+// refresh token as reuse, as the real one does. Handlers added with handle
+// run after the token check.
+type fakeServer struct {
+	t   *testing.T
+	srv *httptest.Server
+	mux *http.ServeMux
+
+	mu       sync.Mutex
+	next     int
+	valid    map[string]bool // Access tokens accepted
+	expired  map[string]bool
+	revoked  map[string]bool
+	refresh  map[string]bool // Refresh tokens not yet exchanged
+	refuse   string          // If set, every refresh is refused with this code
+	refreshN atomic.Int64    // Calls to /refresh
+	loginN   atomic.Int64    // Calls to /login
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	f := &fakeServer{
+		t:       t,
+		mux:     http.NewServeMux(),
+		valid:   make(map[string]bool),
+		expired: make(map[string]bool),
+		revoked: make(map[string]bool),
+		refresh: make(map[string]bool),
+	}
+	f.mux.HandleFunc("POST /api/v1/login", f.handleLogin)
+	f.mux.HandleFunc("POST /api/v1/refresh", f.handleRefresh)
+	f.srv = httptest.NewServer(f.mux)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+// issue returns a new valid access token and refresh token.
+func (f *fakeServer) issue() (access, refresh string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.next++
+	access, refresh = "access-"+strconv.Itoa(f.next), "refresh-"+strconv.Itoa(f.next)
+	f.valid[access] = true
+	f.refresh[refresh] = true
+	return access, refresh
+}
+
+// expire makes access answer token_expired from now on.
+func (f *fakeServer) expire(access string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expired[access] = true
+}
+
+// revoke makes access answer token_revoked from now on.
+func (f *fakeServer) revoke(access string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revoked[access] = true
+}
+
+// login returns a client logged in to f.
+func (f *fakeServer) login() *Client {
+	f.t.Helper()
+	c := New(f.srv.URL)
+	if err := c.Login(context.Background(), "alice", "correct horse battery"); err != nil {
+		f.t.Fatal(err)
+	}
+	return c
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "code": code, "retryable": false},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	f.loginN.Add(1)
+	access, refresh := f.issue()
+	writeJSON(w, map[string]string{"token": access, "refresh_token": refresh})
+}
+
+func (f *fakeServer) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	f.refreshN.Add(1)
+	// Slow enough that requests failing together overlap with it
+	time.Sleep(20 * time.Millisecond)
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	f.mu.Lock()
+	unused, refuse := f.refresh[body.RefreshToken], f.refuse
+	delete(f.refresh, body.RefreshToken)
+	f.mu.Unlock()
+	switch {
+	case refuse != "":
+		writeError(w, http.StatusUnauthorized, refuse, "Refresh token refused.")
+	case !unused:
+		writeError(w, http.StatusUnauthorized, CodeRefreshTokenReused, "Refresh token was already used.")
+	default:
+		access, refresh := f.issue()
+		writeJSON(w, map[string]string{"token": access, "refresh_token": refresh})
+	}
+}
+
+// handle serves pattern with h for requests whose access token is valid.
+func (f *fakeServer) handle(pattern string, h http.HandlerFunc) {
+	f.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		f.mu.Lock()
+		valid, expired, revoked := f.valid[token], f.expired[token], f.revoked[token]
+		f.mu.Unlock()
+		switch {
+		case revoked:
+			writeError(w, http.StatusUnauthorized, CodeTokenRevoked, "Session has been signed out. Log in again.")
+		case expired:
+			writeError(w, http.StatusUnauthorized, CodeTokenExpired, "Token has expired.")
+		case !valid:
+			writeError(w, http.StatusUnauthorized, "token_malformed", "Token is invalid.")
+		default:
+			h(w, r)
+		}
+	})
+}
+
+// handleMe serves /me as alice.
+func (f *fakeServer) handleMe() {
+	f.handle("GET /api/v1/me", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"id": 1, "username": "alice"})
+	})
+}
+
+func TestAPIErrorEnvelope(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+		want   error
+	}{
+		{http.StatusBadRequest, "invalid_username", ErrBadRequest},
+		{http.StatusUnauthorized, "token_malformed", ErrUnauthorized},
+		{http.StatusForbidden, "pow_required", ErrForbidden},
+		{http.StatusNotFound, "", ErrNotFound},
+		{http.StatusConflict, "", ErrConflict},
+		{http.StatusTooManyRequests, "ip_rate_limited", ErrRateLimited},
+		{http.StatusServiceUnavailable, "", ErrServer},
+		{http.StatusUnauthorized, CodeTokenRevoked, ErrSignedOut},
+		{http.StatusUnauthorized, CodeRefreshTokenReused, ErrSignedOut},
+		{http.StatusUnauthorized, CodeRefreshTokenInvalid, ErrSignedOut},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d %s", tt.status, tt.code), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeError(w, tt.status, tt.code, "nope")
+			}))
+			defer srv.Close()
+
+			_, err := New(srv.URL).Me(context.Background())
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("got %v, want an *APIError", err)
+			}
+			if apiErr.Status != tt.status || apiErr.Code != tt.code || apiErr.Message != "nope" {
+				t.Errorf("got %+v", apiErr)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%v doesn't match %v", err, tt.want)
+			}
+		})
+	}
+
+	// An expired token on its own isn't a signed-out login
+	err := &APIError{Status: http.StatusUnauthorized, Code: CodeTokenExpired}
+	if errors.Is(err, ErrSignedOut) {
+		t.Error("token_expired matches ErrSignedOut")
+	}
+}
+
+// TestConcurrentExpiredTokensRefreshOnce has many calls find the access
+// token expired at once. They must share one refresh, since a second
+// exchange of the refresh token would sign the login out, and all
+// succeed with the new token.
+func TestConcurrentExpiredTokensRefreshOnce(t *testing.T) {
+	f := newFakeServer(t)
+	f.handleMe()
+	c := f.login()
+	f.expire(c.Token())
+
+	const calls = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.Me(context.Background())
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("call failed: %v", err)
+		}
+	}
+	if n := f.refreshN.Load(); n != 1 {
+		t.Errorf("%d refreshes, want 1", n)
+	}
+	if n := f.loginN.Load(); n != 1 {
+		t.Errorf("%d logins, want only the first", n)
+	}
+	if c.Token() != "access-2" {
+		t.Errorf("token %q after the refresh, want access-2", c.Token())
+	}
+}
+
+// TestRefreshCallsDontOverlap calls Refresh from several goroutines. Each
+// exchanges the refresh token the one before it received, so none is
+// reused.
+func TestRefreshCallsDontOverlap(t *testing.T) {
+	f := newFakeServer(t)
+	c := f.login()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Refresh(context.Background()); err != nil {
+				t.Errorf("refresh: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := f.refreshN.Load(); n != 5 {
+		t.Errorf("%d refreshes, want 5", n)
+	}
+}
+
+// TestRevokedTokenIsNotRenewed gets token_revoked, as after a session is
+// revoked or the user logs out everywhere. The client must report it
+// without refreshing or logging in again.
+func TestRevokedTokenIsNotRenewed(t *testing.T) {
+	f := newFakeServer(t)
+	f.handleMe()
+	c := f.login()
+	f.revoke(c.Token())
+
+	_, err := c.Me(context.Background())
+	if !errors.Is(err, ErrSignedOut) {
+		t.Fatalf("got %v, want ErrSignedOut", err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != CodeTokenRevoked {
+		t.Errorf("got %v, want code %s", err, CodeTokenRevoked)
+	}
+	if n := f.refreshN.Load(); n != 0 {
+		t.Errorf("%d refreshes for a revoked token", n)
+	}
+	if n := f.loginN.Load(); n != 1 {
+		t.Errorf("%d logins, want only the first", n)
+	}
+}
+
+// TestRefusedRefreshSignsOut has the server refuse the refresh of an
+// expired token. The refusal is returned, and the client neither logs in
+// again nor tries the dead refresh token a second time.
+func TestRefusedRefreshSignsOut(t *testing.T) {
+	for _, code := range []string{CodeRefreshTokenReused, CodeRefreshTokenInvalid} {
+		t.Run(code, func(t *testing.T) {
+			f := newFakeServer(t)
+			f.handleMe()
+			c := f.login()
+			f.expire(c.Token())
+			f.refuse = code
+
+			_, err := c.Me(context.Background())
+			var apiErr *APIError
+			if !errors.Is(err, ErrSignedOut) || !errors.As(err, &apiErr) || apiErr.Code != code {
+				t.Fatalf("got %v, want ErrSignedOut with code %s", err, code)
+			}
+
+			// The refresh token is gone, so the expired token is all that's left
+			_, err = c.Me(context.Background())
+			if !errors.As(err, &apiErr) || apiErr.Code != CodeTokenExpired {
+				t.Errorf("second call: got %v, want token_expired", err)
+			}
+			if n := f.refreshN.Load(); n != 1 {
+				t.Errorf("%d refreshes, want 1", n)
+			}
+			if n := f.loginN.Load(); n != 1 {
+				t.Errorf("%d logins, want only the first", n)
+			}
+		})
+	}
+}
+
+// TestWithTokenExpires starts from a bare access token. With no refresh
+// token, its expiry is returned as is.
+func TestWithTokenExpires(t *testing.T) {
+	f := newFakeServer(t)
+	f.handleMe()
+	access, _ := f.issue()
+	f.expire(access)
+
+	_, err := New(f.srv.URL, WithToken(access)).Me(context.Background())
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != CodeTokenExpired || errors.Is(err, ErrSignedOut) {
+		t.Errorf("got %v, want token_expired", err)
+	}
+	if n := f.refreshN.Load(); n != 0 {
+		t.Errorf("%d refreshes without a refresh token", n)
+	}
+}
+
+func TestLogoutForgetsTokens(t *testing.T) {
+	f := newFakeServer(t)
+	var revoked string
+	f.handle("POST /api/v1/logout", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		revoked = body.RefreshToken
+		writeJSON(w, map[string]string{"message": "ok"})
+	})
+	c := f.login()
+	if err := c.Logout(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if revoked != "refresh-1" {
+		t.Errorf("revoked %q, want refresh-1", revoked)
+	}
+	if c.Token() != "" {
+		t.Errorf("token %q kept after logout", c.Token())
+	}
+	if err := c.Refresh(context.Background()); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("refresh after logout: got %v, want ErrUnauthorized", err)
+	}
+}
+
+// TestChangeUsernameKeepsNewTokens checks the client switches to the
+// tokens a rename returns, since the server signs out the old ones.
+func TestChangeUsernameKeepsNewTokens(t *testing.T) {
+	f := newFakeServer(t)
+	f.handle("POST /api/v1/change_username", func(w http.ResponseWriter, r *http.Request) {
+		f.revoke(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		access, refresh := f.issue()
+		writeJSON(w, map[string]string{"username": "alicia", "previous_username": "alice", "token": access, "refresh_token": refresh})
+	})
+	f.handleMe()
+	c := f.login()
+
+	name, err := c.ChangeUsername(context.Background(), "correct horse battery", "Alicia")
+	if err != nil || name != "alicia" {
+		t.Fatalf("got %q, %v", name, err)
+	}
+	if c.Token() != "access-2" {
+		t.Errorf("token %q after the rename, want access-2", c.Token())
+	}
+	if _, err := c.Me(context.Background()); err != nil {
+		t.Errorf("call after the rename: %v", err)
+	}
+}
+
+// TestMessagesIteratesPages serves messages 1 to 7 three at a time and
+// checks Messages walks every page in order, asking from the last ID it
+// saw, and stops when told to.
+func TestMessagesIteratesPages(t *testing.T) {
+	f := newFakeServer(t)
+	var sinceIDs []string
+	f.handle("GET /api/v1/get_messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("username") != "bob" {
+			t.Errorf("username %q", r.URL.Query().Get("username"))
+		}
+		since, _ := strconv.Atoi(r.URL.Query().Get("since_id"))
+		sinceIDs = append(sinceIDs, strconv.Itoa(since))
+		var page []Message
+		for id := since + 1; id <= 7 && len(page) < 3; id++ {
+			page = append(page, Message{ID: id, EncryptedBlob: "blob " + strconv.Itoa(id)})
+		}
+		writeJSON(w, MessagePage{Messages: page, MaxID: 7})
+	})
+	c := f.login()
+
+	var got []int
+	for msg, err := range c.Messages(context.Background(), "bob", 0) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, msg.ID)
+	}
+	if fmt.Sprint(got) != "[1 2 3 4 5 6 7]" {
+		t.Errorf("got %v", got)
+	}
+	if strings.Join(sinceIDs, ",") != "0,3,6,7" {
+		t.Errorf("since_id per page: %v, want 0,3,6,7", sinceIDs)
+	}
+
+	// Stopping early fetches no further page
+	sinceIDs = nil
+	for msg := range c.Messages(context.Background(), "bob", 0) {
+		if msg.ID == 2 {
+			break
+		}
+	}
+	if len(sinceIDs) != 1 {
+		t.Errorf("%d pages fetched before stopping, want 1", len(sinceIDs))
+	}
+}
+
+func TestMessagesYieldsErrors(t *testing.T) {
+	f := newFakeServer(t)
+	f.handle("GET /api/v1/get_messages", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusForbidden, "", "Not a contact.")
+	})
+	c := f.login()
+
+	n := 0
+	for msg, err := range c.Messages(context.Background(), "bob", 0) {
+		n++
+		if !errors.Is(err, ErrForbidden) || msg.ID != 0 {
+			t.Errorf("got %+v, %v; want a zero message and ErrForbidden", msg, err)
+		}
+	}
+	if n != 1 {
+		t.Errorf("%d values yielded, want 1", n)
+	}
+}
+
+// TestRegisterSolvesChallenge has the server ask for proof of work, and
+// checks the registration carries a valid solution.
+func TestRegisterSolvesChallenge(t *testing.T) {
+	for _, required := range []bool{true, false} {
+		t.Run(fmt.Sprintf("required=%v", required), func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /api/v1/register_challenge", func(w http.ResponseWriter, r *http.Request) {
+				if !required {
+					writeError(w, http.StatusForbidden, "pow_disabled", "Not required.")
+					return
+				}
+				writeJSON(w, map[string]interface{}{"nonce": "n0nce", "difficulty": 8})
+			})
+			var body map[string]interface{}
+			mux.HandleFunc("POST /api/v1/register", func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&body)
+				w.WriteHeader(http.StatusCreated)
+				writeJSON(w, map[string]string{"message": "ok"})
+			})
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			if err := New(srv.URL).Register(context.Background(), "alice", "correct horse battery"); err != nil {
+				t.Fatal(err)
+			}
+			if body["username"] != "alice" || body["password"] != "correct horse battery" {
+				t.Errorf("registered %v", body)
+			}
+			counter, ok := body["pow_counter"].(float64)
+			if !required {
+				if ok || body["pow_nonce"] != nil {
+					t.Errorf("sent a solution nobody asked for: %v", body)
+				}
+				return
+			}
+			if body["pow_nonce"] != "n0nce" || !ok || !pow.Valid("n0nce", uint64(counter), 8) {
+				t.Errorf("sent %v, want a valid solution for n0nce at 8 bits", body)
+			}
+		})
+	}
+}
+
+// TestCallsHonourContext cancels a call stuck waiting on the server.
+func TestCallsHonourContext(t *testing.T) {
+	f := newFakeServer(t)
+	release := make(chan struct{})
+	f.handle("GET /api/v1/me", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer close(release)
+	c := f.login()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Me(ctx); err == nil {
+		t.Fatal("no error from a cancelled call")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("cancelled call returned after %v", d)
+	}
+}
+
+// handleWS serves /ws, calling session for each accepted connection.
+func (f *fakeServer) handleWS(session func(n int, conn *websocket.Conn)) {
+	var n atomic.Int64
+	upgrader := websocket.Upgrader{}
+	f.handle("GET /api/v1/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		session(int(n.Add(1)), conn)
+	})
+}
+
+// next returns the next event, failing the test after five seconds.
+func next(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("events closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return Event{}
+}
+
+// TestSubscribeDeliversAndReconnects serves a hello, a message and an
+// invalidation, then drops the connection. The client must deliver them
+// typed, reconnect, and then stop for good once its session is revoked.
+func TestSubscribeDeliversAndReconnects(t *testing.T) {
+	f := newFakeServer(t)
+	var c *Client
+	f.handleWS(func(n int, conn *websocket.Conn) {
+		if n > 1 {
+			// The second connection is signed out at once
+			f.revoke(c.Token())
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4001, "session revoked"))
+			return
+		}
+		conn.WriteJSON(map[string]interface{}{"type": "hello", "payload": map[string]interface{}{"pending_requests": 2}})
+		conn.WriteJSON(map[string]interface{}{"event_id": 1, "id": 9, "sender_username": "bob", "encrypted_blob": "hi"})
+		conn.WriteJSON(map[string]interface{}{"event_id": 2, "type": "invalidate", "payload": map[string]interface{}{"id": 3, "scope": "contacts"}})
+	})
+	c = f.login()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := c.Subscribe(ctx)
+
+	if ev := next(t, events); ev.Type != EventConnected {
+		t.Fatalf("first event %v, want connected", ev.Type)
+	}
+	if ev := next(t, events); ev.Type != EventHello || ev.Hello.PendingRequests != 2 {
+		t.Errorf("got %+v, want hello with 2 pending requests", ev)
+	}
+	if ev := next(t, events); ev.Type != EventMessage || ev.EventID != 1 || ev.Message.ID != 9 || ev.Message.SenderUsername != "bob" {
+		t.Errorf("got %+v, want message 9 from bob", ev)
+	}
+	if ev := next(t, events); ev.Type != EventInvalidate || ev.EventID != 2 || ev.Invalidation.Scope != "contacts" {
+		t.Errorf("got %+v, want a contacts invalidation", ev)
+	}
+	if ev := next(t, events); ev.Type != EventDisconnected || ev.Err == nil {
+		t.Errorf("got %+v, want disconnected with its cause", ev)
+	}
+
+	if ev := next(t, events); ev.Type != EventConnected {
+		t.Fatalf("got %v, want a reconnection", ev.Type)
+	}
+	if ev := next(t, events); ev.Type != EventDisconnected || !websocket.IsCloseError(ev.Err, 4001) {
+		t.Errorf("got %+v, want disconnected by close 4001", ev)
+	}
+	// The next dial is refused as signed out, which ends the subscription
+	ev := next(t, events)
+	if ev.Type != EventDisconnected || !errors.Is(ev.Err, ErrSignedOut) {
+		t.Errorf("got %+v, want disconnected as signed out", ev)
+	}
+	select {
+	case ev, ok := <-events:
+		if ok {
+			t.Errorf("got %+v after signing out, want the channel closed", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("events still open after signing out")
+	}
+	if n := f.loginN.Load(); n != 1 {
+		t.Errorf("%d logins, want only the first", n)
+	}
+}
+
+// TestDialWSRenewsExpiredToken dials with an expired access token. The
+// refused upgrade renews it, and the second dial succeeds.
+func TestDialWSRenewsExpiredToken(t *testing.T) {
+	f := newFakeServer(t)
+	f.handleWS(func(n int, conn *websocket.Conn) {
+		conn.ReadMessage()
+	})
+	c := f.login()
+	f.expire(c.Token())
+
+	conn, err := c.DialWS(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if n := f.refreshN.Load(); n != 1 {
+		t.Errorf("%d refreshes, want 1", n)
+	}
+}
@@ -0,0 +1,68 @@
+// src/client/contacts.go
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cryptachat-server/contactdoc"
+)
+
+// ExportContacts fetches the caller's signed contact export and checks its
+// signature. Whether the signer is really the old instance is for the
+// caller to decide, e.g. against that instance's /server_info.
+func (c *Client) ExportContacts(ctx context.Context) (*contactdoc.Document, error) {
+	var doc contactdoc.Document
+	if err := c.do(ctx, http.MethodGet, "/export/contacts", nil, nil, &doc); err != nil {
+		return nil, err
+	}
+	if err := doc.Verify(); err != nil {
+		return nil, fmt.Errorf("contact export: %w", err)
+	}
+	return &doc, nil
+}
+
+// ImportContacts queues a chat request to each contact in doc and returns
+// the import ID to poll with GetContactImport.
+func (c *Client) ImportContacts(ctx context.Context, doc *contactdoc.Document) (int, error) {
+	var resp struct {
+		ImportID int `json:"import_id"`
+	}
+	err := c.do(ctx, http.MethodPost, "/import/contacts", nil, doc, &resp)
+	return resp.ImportID, err
+}
+
+// ContactImportItem is one contact of an import.
+type ContactImportItem struct {
+	ID             int        `json:"id"`
+	Username       string     `json:"username"`
+	KeyFingerprint string     `json:"key_fingerprint"`
+	NotBefore      time.Time  `json:"not_before"`
+	Status         string     `json:"status"`
+	Detail         string     `json:"detail,omitempty"`
+	KeyMatches     *bool      `json:"key_matches"` // nil if either side had no key
+	ProcessedAt    *time.Time `json:"processed_at"`
+}
+
+// ContactImport is the progress of an import.
+type ContactImport struct {
+	ID             int                 `json:"id"`
+	SourceIssuer   string              `json:"source_issuer"`
+	SourceUsername string              `json:"source_username"`
+	SignerKey      string              `json:"signer_key"`
+	CreatedAt      time.Time           `json:"created_at"`
+	FinishedAt     *time.Time          `json:"finished_at"`
+	Counts         map[string]int      `json:"counts"`
+	Items          []ContactImportItem `json:"items"`
+}
+
+// GetContactImport fetches the progress of an import.
+func (c *Client) GetContactImport(ctx context.Context, importID int) (*ContactImport, error) {
+	var imp ContactImport
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/import/contacts/%d", importID), nil, nil, &imp); err != nil {
+		return nil, err
+	}
+	return &imp, nil
+}
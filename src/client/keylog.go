@@ -0,0 +1,114 @@
+// src/client/keylog.go
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"cryptachat-server/keylog"
+)
+
+// KeyLogEntry is one public key change in the server's transparency log.
+type KeyLogEntry struct {
+	Seq       int64     `json:"seq"`
+	Username  string    `json:"username"`
+	Version   int       `json:"version"`
+	KeyHash   string    `json:"key_hash"`
+	CreatedAt time.Time `json:"created_at"`
+	PrevHash  string    `json:"prev_hash"`
+	EntryHash string    `json:"entry_hash"`
+}
+
+// KeyLogHead identifies the newest log entry.
+type KeyLogHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// KeyLog is what GET /key_log returns.
+type KeyLog struct {
+	Entries   []KeyLogEntry `json:"entries"`
+	Head      KeyLogHead    `json:"head"`
+	NextAfter int64         `json:"next_after"`
+}
+
+func toChain(entries []KeyLogEntry) []keylog.Entry {
+	chain := make([]keylog.Entry, len(entries))
+	for i, e := range entries {
+		chain[i] = keylog.Entry(e)
+	}
+	return chain
+}
+
+// GetKeyLog returns every key change for username and the current head.
+func (c *Client) GetKeyLog(ctx context.Context, username string) (*KeyLog, error) {
+	var log KeyLog
+	if err := c.do(ctx, http.MethodGet, "/key_log", url.Values{"username": {username}}, nil, &log); err != nil {
+		return nil, err
+	}
+	return &log, nil
+}
+
+// GetKeyLogPage returns up to limit entries of the whole log after sequence
+// number after. limit 0 uses the server default.
+func (c *Client) GetKeyLogPage(ctx context.Context, after int64, limit int) (*KeyLog, error) {
+	query := url.Values{"after": {strconv.FormatInt(after, 10)}}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var log KeyLog
+	if err := c.do(ctx, http.MethodGet, "/key_log", query, nil, &log); err != nil {
+		return nil, err
+	}
+	return &log, nil
+}
+
+// AuditKey checks that publicKey, as served for username, is the newest key
+// recorded for them in the transparency log, and that their entries are
+// intact. Compare the returned head with other clients (or AuditKeyLog) to
+// confirm everyone sees the same log.
+func (c *Client) AuditKey(ctx context.Context, username, publicKey string) (KeyLogHead, error) {
+	log, err := c.GetKeyLog(ctx, username)
+	if err != nil {
+		return KeyLogHead{}, err
+	}
+	if err := keylog.VerifyEntries(toChain(log.Entries)); err != nil {
+		return log.Head, err
+	}
+	if len(log.Entries) == 0 {
+		return log.Head, fmt.Errorf("no key log entries for %s", username)
+	}
+	latest := log.Entries[len(log.Entries)-1]
+	if latest.Username != username || latest.KeyHash != keylog.KeyHash(publicKey) {
+		return log.Head, fmt.Errorf("key for %s is not the latest logged key (version %d)", username, latest.Version)
+	}
+	return log.Head, nil
+}
+
+// AuditKeyLog downloads the whole log and verifies every link up to the head
+// reported with the final page. It returns that head.
+func (c *Client) AuditKeyLog(ctx context.Context) (KeyLogHead, error) {
+	var all []KeyLogEntry
+	var after int64
+	for {
+		page, err := c.GetKeyLogPage(ctx, after, 0)
+		if err != nil {
+			return KeyLogHead{}, err
+		}
+		all = append(all, page.Entries...)
+		if len(all) > 0 {
+			after = all[len(all)-1].Seq
+		}
+		// Keys uploaded while paging move the head past the last page
+		if page.NextAfter == 0 && page.Head.Seq <= after {
+			return page.Head, keylog.VerifyChain(toChain(all), page.Head.Seq, page.Head.Hash)
+		}
+		if page.NextAfter == 0 && len(page.Entries) == 0 {
+			return page.Head, fmt.Errorf("head is at %d but the log ends at %d", page.Head.Seq, after)
+		}
+	}
+}
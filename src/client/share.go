@@ -0,0 +1,46 @@
+// src/client/share.go
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// SharePayload is a signed payload to encode in a QR code or share link.
+type SharePayload struct {
+	Payload   string    `json:"payload"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// GetSharePayload fetches a share payload for the caller's current key.
+func (c *Client) GetSharePayload(ctx context.Context) (*SharePayload, error) {
+	var p SharePayload
+	if err := c.do(ctx, http.MethodGet, "/share_payload", nil, nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// SharePayloadCheck is what the server found in a scanned share payload.
+type SharePayloadCheck struct {
+	Username       string    `json:"username"`
+	KeyFingerprint string    `json:"key_fingerprint"`
+	KeyVersion     int       `json:"key_version"`
+	ServerURL      string    `json:"server_url"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	KeyCurrent     bool      `json:"key_current"` // False if the user has changed keys since
+}
+
+// VerifySharePayload asks the server to check a scanned payload's
+// signature and expiry before the caller requests a chat with its user.
+func (c *Client) VerifySharePayload(ctx context.Context, payload string) (*SharePayloadCheck, error) {
+	body := struct {
+		Payload string `json:"payload"`
+	}{payload}
+	var check SharePayloadCheck
+	if err := c.do(ctx, http.MethodPost, "/verify_share_payload", nil, body, &check); err != nil {
+		return nil, err
+	}
+	return &check, nil
+}
@@ -0,0 +1,210 @@
+// src/client/subscribe.go
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// EventType identifies what an Event carries.
+type EventType string
+
+const (
+	// EventConnected is sent each time the WebSocket (re)connects.
+	EventConnected EventType = "connected"
+	// EventDisconnected is sent when the connection drops; Err holds the cause.
+	EventDisconnected EventType = "disconnected"
+	// EventMessage carries a message pushed by the server.
+	EventMessage EventType = "message"
+	// EventHello carries the state snapshot sent right after connecting.
+	EventHello EventType = "hello"
+	// EventStreamDegraded means the server dropped frames for this connection;
+	// re-sync over HTTP (e.g. GetMessages from the last seen ID).
+	EventStreamDegraded EventType = "stream_degraded"
+	// EventInvalidate tells the client to drop part of its cache; see Invalidation.
+	EventInvalidate EventType = "invalidate"
+	// EventUsernameChanged means the user or one of their contacts was
+	// renamed; see Rename.
+	EventUsernameChanged EventType = "username_changed"
+)
+
+// Event is delivered on the channel returned by Subscribe.
+type Event struct {
+	Type EventType
+	// EventID is the event's place in the user's sequence, for events the
+	// server pushes (messages and invalidations). A jump of more than one
+	// from the last event, or from Hello.Replay.LastEventID, means events
+	// were missed; re-sync over HTTP. Events at or below the last one seen
+	// are repeats and can be ignored.
+	EventID int64
+	Message *Message
+	Hello   *Hello
+	// Invalidation is set for EventInvalidate.
+	Invalidation *Invalidation
+	// Rename is set for EventUsernameChanged.
+	Rename *Rename
+	Err    error
+}
+
+// Invalidation names cached data that changed on the server. Scope is one
+// of "contact_keys" (Username's key), "contacts", "chat_requests",
+// "profile" (Username's profile) or "server_policy"; treat any other scope
+// as "refresh everything".
+type Invalidation struct {
+	ID       int64  `json:"id"`
+	Scope    string `json:"scope"`
+	Username string `json:"username"`
+	// RelationshipsVersion is set for "contacts" and "chat_requests": the
+	// version the lists' ETags (W/"<version>") reached with this change.
+	RelationshipsVersion *int64 `json:"relationships_version"`
+}
+
+// Rename tells the client that OldUsername is now called Username.
+type Rename struct {
+	OldUsername string    `json:"old_username"`
+	Username    string    `json:"username"`
+	ChangedAt   time.Time `json:"changed_at"`
+}
+
+// Hello is the initial state snapshot sent by the server on connect.
+type Hello struct {
+	PendingRequests int      `json:"pending_requests"`
+	OnlineContacts  []string `json:"online_contacts"`
+	Replay          struct {
+		Supported   bool  `json:"supported"`
+		LastEventID int64 `json:"last_event_id"`
+	} `json:"replay"`
+	Degraded   []string  `json:"degraded"`
+	ServerTime time.Time `json:"server_time"`
+}
+
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// Subscribe keeps a WebSocket to /ws open until ctx is cancelled, reconnecting
+// with exponential backoff, and delivers typed events on the returned channel.
+// The channel is closed once ctx is done, or after an EventDisconnected whose
+// Err matches ErrSignedOut: reconnecting can't help then, so log in again
+// and subscribe anew.
+func (c *Client) Subscribe(ctx context.Context) <-chan Event {
+	events := make(chan Event, 16)
+
+	go func() {
+		defer close(events)
+		backoff := minBackoff
+
+		for {
+			err := c.runSubscription(ctx, events, func() { backoff = minBackoff })
+			if ctx.Err() != nil {
+				return
+			}
+			if !send(ctx, events, Event{Type: EventDisconnected, Err: err}) || errors.Is(err, ErrSignedOut) {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}()
+
+	return events
+}
+
+// runSubscription holds one connection open and forwards its events.
+// It returns the error that ended the connection.
+func (c *Client) runSubscription(ctx context.Context, events chan<- Event, onConnect func()) error {
+	conn, err := c.DialWS(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Close the connection when ctx is cancelled so ReadMessage unblocks.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	onConnect()
+	if !send(ctx, events, Event{Type: EventConnected}) {
+		return ctx.Err()
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		ev, ok := decodeFrame(data)
+		if !ok {
+			// Skip frames we don't understand rather than dropping the connection.
+			continue
+		}
+		if !send(ctx, events, ev) {
+			return ctx.Err()
+		}
+	}
+}
+
+// decodeFrame turns a WebSocket frame into an Event. Typed frames carry a
+// "type" and "payload"; untyped frames are pushed messages.
+func decodeFrame(data []byte) (Event, bool) {
+	var envelope struct {
+		EventID int64           `json:"event_id"`
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return Event{}, false
+	}
+
+	switch envelope.Type {
+	case "":
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return Event{}, false
+		}
+		return Event{Type: EventMessage, EventID: envelope.EventID, Message: &msg}, true
+	case string(EventHello):
+		var hello Hello
+		if err := json.Unmarshal(envelope.Payload, &hello); err != nil {
+			return Event{}, false
+		}
+		return Event{Type: EventHello, Hello: &hello}, true
+	case string(EventStreamDegraded):
+		return Event{Type: EventStreamDegraded}, true
+	case string(EventInvalidate):
+		var inv Invalidation
+		if err := json.Unmarshal(envelope.Payload, &inv); err != nil {
+			return Event{}, false
+		}
+		return Event{Type: EventInvalidate, EventID: envelope.EventID, Invalidation: &inv}, true
+	case string(EventUsernameChanged):
+		var rename Rename
+		if err := json.Unmarshal(envelope.Payload, &rename); err != nil {
+			return Event{}, false
+		}
+		return Event{Type: EventUsernameChanged, EventID: envelope.EventID, Rename: &rename}, true
+	}
+	return Event{}, false
+}
+
+// send delivers ev unless ctx is cancelled first.
+func send(ctx context.Context, events chan<- Event, ev Event) bool {
+	select {
+	case events <- ev:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,67 @@
+// src/client/twofactor.go
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrTwoFactorRequired is returned by Login when the user has two-factor
+// authentication on. Call LoginTwoFactor with a code to finish logging in.
+var ErrTwoFactorRequired = errors.New("two-factor code required")
+
+// TwoFactorSetup is returned by EnableTwoFactor. Show RecoveryCodes to the
+// user once; the server can't show them again.
+type TwoFactorSetup struct {
+	OTPAuthURI    string   `json:"otpauth_uri"` // For a QR code
+	RecoveryCodes []string `json:"recovery_codes"`
+	Secret        string   `json:"secret"` // Base32, for typing in by hand
+}
+
+// LoginTwoFactor finishes a Login that returned ErrTwoFactorRequired, with
+// a code from the authenticator app or a recovery code. The pending login
+// expires after a few minutes; call Login again then.
+func (c *Client) LoginTwoFactor(ctx context.Context, code string) error {
+	c.mu.Lock()
+	pendingToken := c.pendingToken
+	c.mu.Unlock()
+	if pendingToken == "" {
+		return errors.New("no pending two-factor login; call Login first")
+	}
+
+	var resp tokenResponse
+	err := c.do(ctx, http.MethodPost, "/2fa/login", nil,
+		map[string]string{"pending_token": pendingToken, "code": code}, &resp)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.token = resp.Token
+	c.refreshToken = resp.RefreshToken
+	c.pendingToken = ""
+	c.mu.Unlock()
+	return nil
+}
+
+// EnableTwoFactor starts two-factor setup. It isn't on until
+// VerifyTwoFactor succeeds with a code from the app the secret was added to.
+func (c *Client) EnableTwoFactor(ctx context.Context) (*TwoFactorSetup, error) {
+	var setup TwoFactorSetup
+	if err := c.do(ctx, http.MethodPost, "/2fa/enable", nil, nil, &setup); err != nil {
+		return nil, err
+	}
+	return &setup, nil
+}
+
+// VerifyTwoFactor turns two-factor authentication on with a first code.
+func (c *Client) VerifyTwoFactor(ctx context.Context, code string) error {
+	return c.do(ctx, http.MethodPost, "/2fa/verify", nil, map[string]string{"code": code}, nil)
+}
+
+// DisableTwoFactor turns two-factor authentication off. code may be a
+// recovery code.
+func (c *Client) DisableTwoFactor(ctx context.Context, password, code string) error {
+	return c.do(ctx, http.MethodPost, "/2fa/disable", nil,
+		map[string]string{"password": password, "code": code}, nil)
+}
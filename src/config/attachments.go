@@ -0,0 +1,74 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Bounds on ATTACHMENT_CHUNK_BYTES. Smaller chunks mean more requests per
+// upload; larger ones more to send again after a dropped connection.
+const (
+	MinAttachmentChunkBytes = 64 << 10
+	MaxAttachmentChunkBytes = 16 << 20
+)
+
+// AttachmentsConfig is where attachment uploads are stored and how they
+// are cut up (see chatservice/attachments.go).
+type AttachmentsConfig struct {
+	Dir        string        // "" turns attachments off
+	MaxBytes   int64         // Largest attachment accepted
+	ChunkBytes int           // Size of every chunk but the last
+	UploadTTL  time.Duration // How long an upload has to complete
+}
+
+// loadAttachments reads the attachment settings. Attachments are off
+// unless ATTACHMENTS_DIR is set, e.g.
+//
+//	ATTACHMENTS_DIR=/var/lib/cryptachat/attachments
+//	ATTACHMENT_MAX_BYTES=104857600
+//	ATTACHMENT_CHUNK_BYTES=1048576
+//	ATTACHMENT_UPLOAD_TTL_HOURS=24
+//
+// Every replica must see the same directory.
+func loadAttachments(cfg *Config) error {
+	a := AttachmentsConfig{
+		Dir:        os.Getenv("ATTACHMENTS_DIR"),
+		MaxBytes:   100 << 20,
+		ChunkBytes: 1 << 20,
+		UploadTTL:  24 * time.Hour,
+	}
+	if a.Dir == "" {
+		return nil
+	}
+	if v := os.Getenv("ATTACHMENT_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("err: ATTACHMENT_MAX_BYTES must be a positive integer")
+		}
+		a.MaxBytes = n
+	}
+	if v := os.Getenv("ATTACHMENT_CHUNK_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < MinAttachmentChunkBytes || n > MaxAttachmentChunkBytes {
+			return fmt.Errorf("err: ATTACHMENT_CHUNK_BYTES must be an integer from %d to %d",
+				MinAttachmentChunkBytes, MaxAttachmentChunkBytes)
+		}
+		a.ChunkBytes = n
+	}
+	if v := os.Getenv("ATTACHMENT_UPLOAD_TTL_HOURS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("err: ATTACHMENT_UPLOAD_TTL_HOURS must be a positive integer")
+		}
+		a.UploadTTL = time.Duration(n) * time.Hour
+	}
+	cfg.Attachments = a
+	return nil
+}
+
+// AttachmentsEnabled reports whether an attachment directory is configured.
+func (c *Config) AttachmentsEnabled() bool {
+	return c.Attachments.Dir != ""
+}
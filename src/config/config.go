@@ -2,14 +2,187 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/joho/godotenv"
+	"cryptachat-server/blobcrypt"
+	"cryptachat-server/egress"
+	"cryptachat-server/passwords"
+	"cryptachat-server/tokensign"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
+// MaxRegistrationPoWBits caps REGISTRATION_POW_BITS. Each bit doubles the
+// work expected of a client; at 32 that is billions of hashes.
+const MaxRegistrationPoWBits = 32
+
 type Config struct {
 	DatabaseURL string
 	JWTSecret   string
+	// TokenSigner signs and verifies JWTs: HS256 with JWTSecret unless
+	// JWT_ALGORITHM picks RS256 or EdDSA (see tokens.go).
+	TokenSigner *tokensign.Signer
+
+	// BasePath is the prefix the API is served under, e.g. "/chat", or ""
+	// for the root.
+	BasePath string
+
+	// Listener settings
+	BindAddr    string // Interface to bind, "" means all interfaces
+	Port        string
+	TLSCertFile string
+	TLSKeyFile  string
+
+	BcryptCost int
+	// PasswordHasher makes new password hashes: bcrypt at BcryptCost unless
+	// PASSWORD_HASH_ALGORITHM picks argon2id (see passwords.go).
+	PasswordHasher passwords.PasswordHasher
+	// PasswordPolicy is what new passwords must satisfy (see passwords.go).
+	PasswordPolicy *passwords.Policy
+	// BcryptConcurrency caps simultaneous password hashing operations, of
+	// either algorithm; callers wait up to BcryptQueueTimeout for a slot and
+	// then get 503.
+	BcryptConcurrency  int
+	BcryptQueueTimeout time.Duration
+
+	// AccessTokenTTL is how long a JWT from /login or /refresh is valid;
+	// RefreshTokenTTL how long its refresh token can renew it.
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// PaddingBuckets, if non-empty, are the only decoded blob sizes (in bytes)
+	// accepted by /send_message. Sorted ascending.
+	PaddingBuckets []int
+
+	// Write-behind batching of last_seen_at and delivery receipts (see
+	// store/writebehind.go): flushed every WriteBehindInterval or once
+	// WriteBehindMaxBatch updates are pending.
+	WriteBehindInterval time.Duration
+	WriteBehindMaxBatch int
+	// The auth middleware's user lookups are cached for UserCacheTTL, up
+	// to UserCacheMax users (see store/usercache.go). A zero TTL turns the
+	// cache off.
+	UserCacheTTL time.Duration
+	UserCacheMax int
+	// Migration backfills (see store/backfill.go) update BackfillBatchSize
+	// rows at a time and wait BackfillPause between batches.
+	BackfillBatchSize int
+	BackfillPause     time.Duration
+
+	// IntegrationPrivacyMode limits what outbound integrations may send:
+	// "ids_only" or "ids_and_usernames" (see integrations/privacy.go).
+	IntegrationPrivacyMode string
+	// WebhookURL, if set, receives message and chat request events as JSON
+	// POSTs, filtered by IntegrationPrivacyMode. WebhookSecret, if set, is
+	// sent as a bearer token.
+	WebhookURL    string
+	WebhookSecret string
+	// PushURL, if set, receives push_ping events for users with new
+	// messages or chat requests. PushSecret works like WebhookSecret. A
+	// user gets at most one ping per PushCoalesce (see chatservice/push.go).
+	PushURL      string
+	PushSecret   string
+	PushCoalesce time.Duration
+
+	// PayloadLimits caps request body sizes per payload type (see limits.go).
+	PayloadLimits map[string]int64
+
+	// TrustedProxies are the reverse proxies whose TrustedProxyHeader
+	// (X-Forwarded-For by default) is believed when attributing requests to
+	// client IPs.
+	TrustedProxies     []netip.Prefix
+	TrustedProxyHeader string
+	// IPRateLimitMaxIPs is how many client IPs each per-IP rate limit
+	// (RuntimeConfig.IPRateLimits) tracks.
+	IPRateLimitMaxIPs int
+
+	// BackupsEnabled allows users to store encrypted key backups.
+	BackupsEnabled bool
+	// SealedSender allows contacts who both opt in to send messages whose
+	// sender is not stored.
+	SealedSender bool
+	// InvitesRequired refuses registrations without an unused invite code,
+	// minted by existing users at most InvitesPerWeek at a time.
+	InvitesRequired bool
+	InvitesPerWeek  int
+	// RegistrationPoWBits, when above 0, makes /register require a solved
+	// challenge from /register_challenge: a counter whose SHA-256 with the
+	// challenge's nonce starts with that many zero bits. Challenges expire
+	// after RegistrationPoWTTL.
+	RegistrationPoWBits int
+	RegistrationPoWTTL  time.Duration
+	// RequireRecipientKey refuses messages to users who have never uploaded
+	// a public key, since nothing sent to them can be read.
+	RequireRecipientKey bool
+	// ContactImportPerHour paces contact imports: each queues one chat
+	// request per 1/ContactImportPerHour of an hour.
+	ContactImportPerHour int
+
+	// BlobMasterKey wraps the data keys that encrypt blobs at rest. nil
+	// stores blobs as clients sent them.
+	BlobMasterKey blobcrypt.KeyWrapper
+	// BlobPreviousMasterKeys can still unwrap older data keys during a
+	// master key rotation.
+	BlobPreviousMasterKeys []blobcrypt.KeyWrapper
+
+	// FederationName is how peer instances address this one: the host part
+	// of user@host. Empty disables federation (see federation.go).
+	FederationName string
+	// FederationPeers are the only instances relayed to and accepted from,
+	// keyed by name. There is no discovery and no relaying onward.
+	FederationPeers map[string]FederationPeer
+	// Client certificate presented to peers, and the CA that signs peers'
+	// client certificates, for mutual TLS with peers that have no secret.
+	FederationCertFile string
+	FederationKeyFile  string
+	FederationCAFile   string
+
+	// Egress is the policy for every outbound request: federation,
+	// webhooks, recovery email, and push providers once they exist (see
+	// egress.go).
+	Egress egress.Policy
+	// SMTP relays recovery email; see mail.go.
+	SMTP SMTPConfig
+	// Attachments stores attachment uploads; see attachments.go.
+	Attachments AttachmentsConfig
+
+	// MinClientVersion is advertised on /server_info. Empty means no minimum.
+	MinClientVersion string
+
+	// AllowInsecure lets the server start despite fatal hygiene findings.
+	AllowInsecure bool
+	// AllowSchemaAhead serves writes even when the database schema is newer
+	// than this binary, instead of the read-mostly compatibility mode.
+	AllowSchemaAhead bool
+	// AdminToken guards the /admin routes. Empty disables them.
+	AdminToken string
+	// BootstrapAdminToken enables POST /bootstrap_admin while no admin user exists.
+	BootstrapAdminToken string
+
+	// Deprecations holds the announced dates per deprecated surface.
+	Deprecations map[string]DeprecationDates
+	// DeprecationWarnings adds a "warnings" array to JSON responses that use
+	// a deprecated surface.
+	DeprecationWarnings bool
+
+	// runtime holds the settings a reload can change (see runtime.go).
+	runtime atomic.Pointer[RuntimeConfig]
+
+	// envPath is the .env file read at startup and again on reload, and
+	// fileVars the variables it set.
+	envPath  string
+	fileVars map[string]bool
+	reloadMu sync.Mutex
+	onReload []func(*RuntimeConfig)
 
 	dbHost     string
 	dbPort     string
@@ -18,9 +191,22 @@ type Config struct {
 	dbName     string
 }
 
+// LoadConfig reads the configuration from the environment, after setting
+// the variables in the .env file at path that aren't set already.
 func LoadConfig(path string) (*Config, error) {
-	_ = godotenv.Load(path)
+	fileVars, _ := setEnvFile(path, nil)
 
+	cfg, err := load()
+	if err != nil {
+		return nil, err
+	}
+	cfg.envPath = path
+	cfg.fileVars = fileVars
+	return cfg, nil
+}
+
+// load reads the configuration from the environment.
+func load() (*Config, error) {
 	cfg := &Config{
 		dbHost:     os.Getenv("DB_HOST"),
 		dbPort:     os.Getenv("DB_PORT"),
@@ -28,6 +214,282 @@ func LoadConfig(path string) (*Config, error) {
 		dbPassword: os.Getenv("POSTGRES_PASSWORD"),
 		dbName:     os.Getenv("POSTGRES_DB"),
 		JWTSecret:  os.Getenv("SECRET_KEY"),
+
+		BindAddr:    os.Getenv("BIND_ADDR"),
+		Port:        os.Getenv("PORT"),
+		TLSCertFile: os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:  os.Getenv("TLS_KEY_FILE"),
+		BcryptCost:  bcrypt.DefaultCost,
+		AdminToken:  os.Getenv("ADMIN_TOKEN"),
+
+		BootstrapAdminToken: os.Getenv("BOOTSTRAP_ADMIN_TOKEN"),
+
+		MinClientVersion: os.Getenv("MIN_CLIENT_VERSION"),
+
+		IntegrationPrivacyMode: os.Getenv("INTEGRATION_PRIVACY_MODE"),
+	}
+
+	if cfg.Port == "" {
+		cfg.Port = "5000"
+	}
+	if v := os.Getenv("BCRYPT_COST"); v != "" {
+		cost, err := strconv.Atoi(v)
+		if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("err: BCRYPT_COST must be an integer between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		cfg.BcryptCost = cost
+	}
+	if err := loadPasswordHashing(cfg); err != nil {
+		return nil, err
+	}
+	if err := loadPasswordPolicy(cfg); err != nil {
+		return nil, err
+	}
+	cfg.BcryptConcurrency = runtime.GOMAXPROCS(0)
+	if v := os.Getenv("BCRYPT_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("err: BCRYPT_CONCURRENCY must be a positive integer")
+		}
+		cfg.BcryptConcurrency = n
+	}
+	cfg.BcryptQueueTimeout = time.Second
+	if v := os.Getenv("BCRYPT_QUEUE_TIMEOUT_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("err: BCRYPT_QUEUE_TIMEOUT_MS must be a non-negative integer")
+		}
+		cfg.BcryptQueueTimeout = time.Duration(ms) * time.Millisecond
+	}
+	cfg.AccessTokenTTL = 15 * time.Minute
+	if v := os.Getenv("ACCESS_TOKEN_TTL_MINUTES"); v != "" {
+		minutes, err := strconv.Atoi(v)
+		if err != nil || minutes <= 0 {
+			return nil, fmt.Errorf("err: ACCESS_TOKEN_TTL_MINUTES must be a positive integer")
+		}
+		cfg.AccessTokenTTL = time.Duration(minutes) * time.Minute
+	}
+	// TOKEN_TTL is the same setting as a duration ("15m", "24h"). expires_in
+	// is in whole seconds, so anything shorter is refused.
+	if v := os.Getenv("TOKEN_TTL"); v != "" {
+		if os.Getenv("ACCESS_TOKEN_TTL_MINUTES") != "" {
+			return nil, fmt.Errorf("err: set only one of TOKEN_TTL and ACCESS_TOKEN_TTL_MINUTES")
+		}
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl < time.Second {
+			return nil, fmt.Errorf("err: TOKEN_TTL must be a duration of at least 1s, like \"15m\" or \"24h\"")
+		}
+		cfg.AccessTokenTTL = ttl
+	}
+	cfg.RefreshTokenTTL = 30 * 24 * time.Hour
+	if v := os.Getenv("REFRESH_TOKEN_TTL_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("err: REFRESH_TOKEN_TTL_DAYS must be a positive integer")
+		}
+		cfg.RefreshTokenTTL = time.Duration(days) * 24 * time.Hour
+	}
+	cfg.WriteBehindInterval = 2 * time.Second
+	if v := os.Getenv("WRITE_BEHIND_INTERVAL_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("err: WRITE_BEHIND_INTERVAL_MS must be a positive integer")
+		}
+		cfg.WriteBehindInterval = time.Duration(ms) * time.Millisecond
+	}
+	cfg.WriteBehindMaxBatch = 500
+	if v := os.Getenv("WRITE_BEHIND_MAX_BATCH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("err: WRITE_BEHIND_MAX_BATCH must be a positive integer")
+		}
+		cfg.WriteBehindMaxBatch = n
+	}
+	cfg.UserCacheTTL = 30 * time.Second
+	if v := os.Getenv("USER_CACHE_TTL_SECONDS"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 0 {
+			return nil, fmt.Errorf("err: USER_CACHE_TTL_SECONDS must be a non-negative integer")
+		}
+		cfg.UserCacheTTL = time.Duration(secs) * time.Second
+	}
+	cfg.UserCacheMax = 10000
+	if v := os.Getenv("USER_CACHE_MAX"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("err: USER_CACHE_MAX must be a positive integer")
+		}
+		cfg.UserCacheMax = n
+	}
+	cfg.BackfillBatchSize = 5000
+	if v := os.Getenv("BACKFILL_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("err: BACKFILL_BATCH_SIZE must be a positive integer")
+		}
+		cfg.BackfillBatchSize = n
+	}
+	cfg.BackfillPause = 100 * time.Millisecond
+	if v := os.Getenv("BACKFILL_PAUSE_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("err: BACKFILL_PAUSE_MS must be a non-negative integer")
+		}
+		cfg.BackfillPause = time.Duration(ms) * time.Millisecond
+	}
+	if cfg.IntegrationPrivacyMode == "" {
+		cfg.IntegrationPrivacyMode = "ids_only"
+	}
+	if v := os.Getenv("WEBHOOK_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("err: WEBHOOK_URL must be an http or https URL")
+		}
+		cfg.WebhookURL = v
+	}
+	cfg.WebhookSecret = os.Getenv("WEBHOOK_SECRET")
+	if v := os.Getenv("PUSH_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("err: PUSH_URL must be an http or https URL")
+		}
+		cfg.PushURL = v
+	}
+	cfg.PushSecret = os.Getenv("PUSH_SECRET")
+	cfg.PushCoalesce = 2 * time.Second
+	if v := os.Getenv("PUSH_COALESCE_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("err: PUSH_COALESCE_MS must be a positive integer")
+		}
+		cfg.PushCoalesce = time.Duration(ms) * time.Millisecond
+	}
+	rc, err := loadRuntime()
+	if err != nil {
+		return nil, err
+	}
+	cfg.runtime.Store(rc)
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		proxies, err := parsePrefixList(v)
+		if err != nil {
+			return nil, fmt.Errorf("err: TRUSTED_PROXIES: %v", err)
+		}
+		cfg.TrustedProxies = proxies
+	}
+	if err := loadClientIPSettings(cfg); err != nil {
+		return nil, err
+	}
+
+	cfg.BackupsEnabled = true
+	if v := os.Getenv("BACKUPS_ENABLED"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("err: BACKUPS_ENABLED must be true or false")
+		}
+		cfg.BackupsEnabled = enabled
+	}
+	if v := os.Getenv("SEALED_SENDER_ENABLED"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("err: SEALED_SENDER_ENABLED must be true or false")
+		}
+		cfg.SealedSender = enabled
+	}
+	if v := os.Getenv("INVITES_REQUIRED"); v != "" {
+		required, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("err: INVITES_REQUIRED must be true or false")
+		}
+		cfg.InvitesRequired = required
+	}
+	cfg.InvitesPerWeek = 3
+	if v := os.Getenv("INVITES_PER_WEEK"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("err: INVITES_PER_WEEK must be a positive integer")
+		}
+		cfg.InvitesPerWeek = n
+	}
+	if v := os.Getenv("REGISTRATION_POW_BITS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > MaxRegistrationPoWBits {
+			return nil, fmt.Errorf("err: REGISTRATION_POW_BITS must be an integer from 0 to %d", MaxRegistrationPoWBits)
+		}
+		cfg.RegistrationPoWBits = n
+	}
+	cfg.RegistrationPoWTTL = 5 * time.Minute
+	if v := os.Getenv("REGISTRATION_POW_TTL_SECONDS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("err: REGISTRATION_POW_TTL_SECONDS must be a positive integer")
+		}
+		cfg.RegistrationPoWTTL = time.Duration(n) * time.Second
+	}
+	cfg.RequireRecipientKey = true
+	if v := os.Getenv("REQUIRE_RECIPIENT_KEY"); v != "" {
+		required, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("err: REQUIRE_RECIPIENT_KEY must be true or false")
+		}
+		cfg.RequireRecipientKey = required
+	}
+	cfg.ContactImportPerHour = 20
+	if v := os.Getenv("CONTACT_IMPORT_PER_HOUR"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("err: CONTACT_IMPORT_PER_HOUR must be a positive integer")
+		}
+		cfg.ContactImportPerHour = n
+	}
+	if v := os.Getenv("BLOB_MASTER_KEY"); v != "" {
+		key, err := blobcrypt.ParseMasterKey(v)
+		if err != nil {
+			return nil, fmt.Errorf("err: BLOB_MASTER_KEY: %v", err)
+		}
+		cfg.BlobMasterKey = key
+	}
+	if v := os.Getenv("BLOB_PREVIOUS_MASTER_KEYS"); v != "" {
+		if cfg.BlobMasterKey == nil {
+			return nil, fmt.Errorf("err: BLOB_PREVIOUS_MASTER_KEYS needs BLOB_MASTER_KEY")
+		}
+		for _, part := range strings.Split(v, ",") {
+			key, err := blobcrypt.ParseMasterKey(part)
+			if err != nil {
+				return nil, fmt.Errorf("err: BLOB_PREVIOUS_MASTER_KEYS: %v", err)
+			}
+			if key.ID() == cfg.BlobMasterKey.ID() {
+				return nil, fmt.Errorf("err: BLOB_PREVIOUS_MASTER_KEYS repeats the id of BLOB_MASTER_KEY")
+			}
+			cfg.BlobPreviousMasterKeys = append(cfg.BlobPreviousMasterKeys, key)
+		}
+	}
+	if v := os.Getenv("BASE_PATH"); v != "" {
+		if err := validateBasePath(v); err != nil {
+			return nil, fmt.Errorf("err: BASE_PATH %v", err)
+		}
+		cfg.BasePath = v
+	}
+	if err := loadFederation(cfg); err != nil {
+		return nil, err
+	}
+	if err := loadEgress(cfg); err != nil {
+		return nil, err
+	}
+	if err := loadMail(cfg); err != nil {
+		return nil, err
+	}
+	if err := loadAttachments(cfg); err != nil {
+		return nil, err
+	}
+	cfg.AllowInsecure, _ = strconv.ParseBool(os.Getenv("ALLOW_INSECURE"))
+	cfg.AllowSchemaAhead, _ = strconv.ParseBool(os.Getenv("ALLOW_SCHEMA_AHEAD"))
+
+	if v := os.Getenv("PADDING_BUCKETS"); v != "" {
+		buckets, err := parseIntList(v)
+		if err != nil {
+			return nil, fmt.Errorf("err: PADDING_BUCKETS: %v", err)
+		}
+		cfg.PaddingBuckets = buckets
 	}
 
 	if cfg.dbHost == "" || cfg.dbPort == "" || cfg.dbUser == "" || cfg.dbName == "" {
@@ -36,6 +498,24 @@ func LoadConfig(path string) (*Config, error) {
 	if cfg.JWTSecret == "" {
 		return nil, fmt.Errorf("err: SECRET_KEY env variable is missing")
 	}
+	if err := loadTokenSigning(cfg); err != nil {
+		return nil, err
+	}
+
+	limits, err := loadPayloadLimits()
+	if err != nil {
+		return nil, fmt.Errorf("err: PAYLOAD_LIMITS: %v", err)
+	}
+	cfg.PayloadLimits = limits
+
+	deprecations, err := loadDeprecations()
+	if err != nil {
+		return nil, fmt.Errorf("err: DEPRECATION_SCHEDULE: %v", err)
+	}
+	cfg.Deprecations = deprecations
+	if cfg.DeprecationWarnings, err = loadDeprecationWarnings(); err != nil {
+		return nil, fmt.Errorf("err: DEPRECATION_WARNINGS must be true or false")
+	}
 
 	cfg.DatabaseURL = fmt.Sprintf("postgresql://%s:%s@%s:%s/%s",
 		cfg.dbUser, cfg.dbPassword, cfg.dbHost, cfg.dbPort, cfg.dbName,
@@ -43,3 +523,79 @@ func LoadConfig(path string) (*Config, error) {
 
 	return cfg, nil
 }
+
+// parseIntList parses a comma-separated list of positive integers and sorts it.
+func parseIntList(v string) ([]int, error) {
+	var out []int
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%q is not a positive integer", part)
+		}
+		out = append(out, n)
+	}
+	slices.Sort(out)
+	return slices.Compact(out), nil
+}
+
+// validateBasePath rejects base paths that could be read more than one way.
+// Only the "/chat" form is accepted.
+func validateBasePath(p string) error {
+	if !strings.HasPrefix(p, "/") {
+		return fmt.Errorf("must start with '/', e.g. /chat")
+	}
+	if strings.HasSuffix(p, "/") {
+		return fmt.Errorf("must not end with '/' (leave it unset to serve at the root)")
+	}
+	for _, seg := range strings.Split(p[1:], "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return fmt.Errorf("must not contain empty, '.' or '..' segments")
+		}
+		for _, c := range seg {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-._~", c)) {
+				return fmt.Errorf("may only contain letters, digits, '-', '.', '_', '~' and '/'")
+			}
+		}
+	}
+	return nil
+}
+
+// parsePrefixList parses a comma-separated list of IPs and CIDR prefixes.
+func parsePrefixList(v string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.Contains(part, "/") {
+			p, err := netip.ParsePrefix(part)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not an IP or CIDR prefix", part)
+			}
+			out = append(out, p.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR prefix", part)
+		}
+		ip = ip.Unmap()
+		out = append(out, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return out, nil
+}
+
+// TLSEnabled reports whether both a certificate and key were configured.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// ListenAddr is the address passed to the HTTP listener.
+func (c *Config) ListenAddr() string {
+	return c.BindAddr + ":" + c.Port
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deprecated API surfaces. Each is always marked deprecated; the schedule
+// only adds dates.
+const (
+	// DeprecationRootRoutes covers every route served without the /api/v1 prefix.
+	DeprecationRootRoutes = "root_routes"
+	// DeprecationErrorMessage covers the top-level "message" field of error
+	// responses, superseded by "error.message".
+	DeprecationErrorMessage = "error_message"
+)
+
+var deprecationSurfaces = []string{DeprecationRootRoutes, DeprecationErrorMessage}
+
+// DeprecationDates is the published schedule for one surface. Zero values
+// mean "not announced".
+type DeprecationDates struct {
+	Deprecated time.Time
+	Sunset     time.Time
+}
+
+// loadDeprecations parses DEPRECATION_SCHEDULE, e.g.
+// "root_routes=2025-06-01:2026-01-01,error_message=2025-06-01". Dates are
+// YYYY-MM-DD in UTC; the sunset part is optional.
+func loadDeprecations() (map[string]DeprecationDates, error) {
+	schedule := make(map[string]DeprecationDates, len(deprecationSurfaces))
+	for _, name := range deprecationSurfaces {
+		schedule[name] = DeprecationDates{}
+	}
+
+	raw := os.Getenv("DEPRECATION_SCHEDULE")
+	if raw == "" {
+		return schedule, nil
+	}
+	for _, part := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not of the form surface=date[:sunset]", part)
+		}
+		if _, known := schedule[name]; !known {
+			return nil, fmt.Errorf("unknown surface %q", name)
+		}
+		deprecated, sunset, _ := strings.Cut(value, ":")
+
+		var dates DeprecationDates
+		var err error
+		if dates.Deprecated, err = time.Parse(time.DateOnly, deprecated); err != nil {
+			return nil, fmt.Errorf("%q is not a YYYY-MM-DD date", deprecated)
+		}
+		if sunset != "" {
+			if dates.Sunset, err = time.Parse(time.DateOnly, sunset); err != nil {
+				return nil, fmt.Errorf("%q is not a YYYY-MM-DD date", sunset)
+			}
+			if dates.Sunset.Before(dates.Deprecated) {
+				return nil, fmt.Errorf("%s: sunset is before the deprecation date", name)
+			}
+		}
+		schedule[name] = dates
+	}
+	return schedule, nil
+}
+
+// loadDeprecationWarnings reads DEPRECATION_WARNINGS (default false).
+func loadDeprecationWarnings() (bool, error) {
+	v := os.Getenv("DEPRECATION_WARNINGS")
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loadEgress reads the policy for outbound requests (see egress). Private,
+// loopback and link-local addresses are refused unless listed, e.g.
+//
+//	EGRESS_ALLOW_CIDRS=10.0.5.0/24,fd00:5::/64
+//	EGRESS_TIMEOUT_SECONDS=15
+//	EGRESS_MAX_RESPONSE_BYTES=1048576
+func loadEgress(cfg *Config) error {
+	if v := os.Getenv("EGRESS_ALLOW_CIDRS"); v != "" {
+		for _, part := range strings.Split(v, ",") {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(part))
+			if err != nil {
+				return fmt.Errorf("err: EGRESS_ALLOW_CIDRS: %q is not a CIDR range", part)
+			}
+			cfg.Egress.Allow = append(cfg.Egress.Allow, prefix.Masked())
+		}
+	}
+	cfg.Egress.Timeout = 15 * time.Second
+	if v := os.Getenv("EGRESS_TIMEOUT_SECONDS"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("err: EGRESS_TIMEOUT_SECONDS must be a positive integer")
+		}
+		cfg.Egress.Timeout = time.Duration(seconds) * time.Second
+	}
+	cfg.Egress.MaxResponseBytes = 1 << 20
+	if v := os.Getenv("EGRESS_MAX_RESPONSE_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("err: EGRESS_MAX_RESPONSE_BYTES must be a positive integer")
+		}
+		cfg.Egress.MaxResponseBytes = n
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// minPeerSecretLength is the shortest shared secret accepted for a peer.
+const minPeerSecretLength = 32
+
+// FederationPeer is another instance this one relays chat requests and
+// messages to and accepts them from.
+type FederationPeer struct {
+	Name   string // Host part of its users' addresses (user@name), lower case
+	URL    string // Base URL of its API, e.g. "https://chat.example.org/api/v1"
+	Secret string // Shared secret; "" means it authenticates with a client certificate
+}
+
+// loadFederation reads the federation settings. Federation is off unless
+// FEDERATION_NAME is set, e.g.
+//
+//	FEDERATION_NAME=chat.example.com
+//	FEDERATION_PEERS=chat.example.org=https://chat.example.org/api/v1
+//	FEDERATION_PEER_SECRETS=chat.example.org=<at least 32 bytes>
+//
+// Peers without a secret must present a client certificate for their name,
+// signed by FEDERATION_CA_FILE.
+func loadFederation(cfg *Config) error {
+	name := strings.ToLower(strings.TrimSpace(os.Getenv("FEDERATION_NAME")))
+	peers := os.Getenv("FEDERATION_PEERS")
+	if name == "" {
+		if peers != "" {
+			return fmt.Errorf("err: FEDERATION_PEERS needs FEDERATION_NAME")
+		}
+		return nil
+	}
+	if err := validatePeerName(name); err != nil {
+		return fmt.Errorf("err: FEDERATION_NAME %v", err)
+	}
+	if peers == "" {
+		return fmt.Errorf("err: FEDERATION_PEERS is required with FEDERATION_NAME")
+	}
+	cfg.FederationName = name
+	cfg.FederationPeers = make(map[string]FederationPeer)
+
+	for _, part := range strings.Split(peers, ",") {
+		peerName, rawURL, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return fmt.Errorf("err: FEDERATION_PEERS: %q is not of the form name=url", part)
+		}
+		peerName = strings.ToLower(peerName)
+		if err := validatePeerName(peerName); err != nil {
+			return fmt.Errorf("err: FEDERATION_PEERS: peer %q %v", peerName, err)
+		}
+		if peerName == name {
+			return fmt.Errorf("err: FEDERATION_PEERS: %q is this instance's own FEDERATION_NAME", peerName)
+		}
+		if _, dup := cfg.FederationPeers[peerName]; dup {
+			return fmt.Errorf("err: FEDERATION_PEERS: %q is listed twice", peerName)
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("err: FEDERATION_PEERS: %q must be an https URL without query", rawURL)
+		}
+		cfg.FederationPeers[peerName] = FederationPeer{Name: peerName, URL: strings.TrimSuffix(rawURL, "/")}
+	}
+
+	if v := os.Getenv("FEDERATION_PEER_SECRETS"); v != "" {
+		for _, part := range strings.Split(v, ",") {
+			peerName, secret, ok := strings.Cut(strings.TrimSpace(part), "=")
+			peerName = strings.ToLower(peerName)
+			if !ok {
+				return fmt.Errorf("err: FEDERATION_PEER_SECRETS: entries must be of the form name=secret")
+			}
+			peer, known := cfg.FederationPeers[peerName]
+			if !known {
+				return fmt.Errorf("err: FEDERATION_PEER_SECRETS: %q is not in FEDERATION_PEERS", peerName)
+			}
+			if len(secret) < minPeerSecretLength {
+				return fmt.Errorf("err: FEDERATION_PEER_SECRETS: the secret for %q is shorter than %d bytes", peerName, minPeerSecretLength)
+			}
+			peer.Secret = secret
+			cfg.FederationPeers[peerName] = peer
+		}
+	}
+
+	cfg.FederationCertFile = os.Getenv("FEDERATION_TLS_CERT_FILE")
+	cfg.FederationKeyFile = os.Getenv("FEDERATION_TLS_KEY_FILE")
+	cfg.FederationCAFile = os.Getenv("FEDERATION_CA_FILE")
+	if (cfg.FederationCertFile == "") != (cfg.FederationKeyFile == "") {
+		return fmt.Errorf("err: FEDERATION_TLS_CERT_FILE and FEDERATION_TLS_KEY_FILE must be set together")
+	}
+	for _, peer := range cfg.FederationPeers {
+		if peer.Secret != "" {
+			continue
+		}
+		// Mutual TLS: we present a certificate and check theirs, which
+		// needs this server to terminate TLS itself
+		if cfg.FederationCertFile == "" || cfg.FederationCAFile == "" || !cfg.TLSEnabled() {
+			return fmt.Errorf("err: peer %q has no shared secret, so mutual TLS needs FEDERATION_TLS_CERT_FILE, "+
+				"FEDERATION_TLS_KEY_FILE, FEDERATION_CA_FILE and TLS_CERT_FILE/TLS_KEY_FILE", peer.Name)
+		}
+	}
+	return nil
+}
+
+// validatePeerName accepts host names, optionally with a port.
+func validatePeerName(name string) error {
+	if name == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == ':') {
+			return fmt.Errorf("must be a host name, e.g. chat.example.com")
+		}
+	}
+	return nil
+}
+
+// FederationEnabled reports whether messages may be relayed to other instances.
+func (c *Config) FederationEnabled() bool {
+	return c.FederationName != ""
+}
+
+// FederationPeerNames returns the configured peers' names, sorted.
+func (c *Config) FederationPeerNames() []string {
+	names := make([]string, 0, len(c.FederationPeers))
+	for name := range c.FederationPeers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"cryptachat-server/passwords"
+)
+
+// Severity of a deployment hygiene finding.
+const (
+	SeverityFatal = "fatal" // Refuse to start unless ALLOW_INSECURE=true
+	SeverityWarn  = "warn"
+)
+
+// Finding is one result of the deployment hygiene check.
+type Finding struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Detail   string `json:"detail"`
+}
+
+// minSecretLength is the shortest JWT secret we accept (256 bits for HS256).
+const minSecretLength = 32
+
+// knownDefaultSecrets are values people copy out of tutorials and examples.
+var knownDefaultSecrets = []string{
+	"secret",
+	"secret_key",
+	"secretkey",
+	"supersecret",
+	"changeme",
+	"change-me",
+	"password",
+	"your-secret-key",
+	"your_secret_key",
+	"jwt-secret",
+	"example",
+	"example-secret",
+	"cryptachat",
+}
+
+// CheckDeployment inspects the configuration for settings that make the
+// instance unsafe to run. It does no I/O, so it is cheap to call repeatedly.
+func CheckDeployment(c *Config) []Finding {
+	var findings []Finding
+
+	for _, known := range knownDefaultSecrets {
+		if strings.EqualFold(c.JWTSecret, known) {
+			findings = append(findings, Finding{
+				Check:    "jwt_secret_default",
+				Severity: SeverityFatal,
+				Detail:   "SECRET_KEY matches a well-known default value",
+			})
+			break
+		}
+	}
+	if len(c.JWTSecret) < minSecretLength {
+		findings = append(findings, Finding{
+			Check:    "jwt_secret_length",
+			Severity: SeverityFatal,
+			Detail:   "SECRET_KEY is shorter than 32 bytes",
+		})
+	}
+
+	if !c.TLSEnabled() && !isLoopback(c.BindAddr) {
+		findings = append(findings, Finding{
+			Check:    "tls_disabled",
+			Severity: SeverityWarn,
+			Detail:   "TLS is off and the server is not bound to loopback; terminate TLS in front of it or set TLS_CERT_FILE/TLS_KEY_FILE",
+		})
+	}
+
+	switch h := c.PasswordHasher.(type) {
+	case passwords.Argon2id:
+		// OWASP's weakest acceptable settings trade memory for passes,
+		// from 46 MiB x 1 to 7 MiB x 5; all cost about this much
+		if uint64(h.Memory)*uint64(h.Iterations) < 7*1024*5 {
+			findings = append(findings, Finding{
+				Check:    "argon2_params",
+				Severity: SeverityWarn,
+				Detail:   "ARGON2_MEMORY_KIB x ARGON2_ITERATIONS is below 35840",
+			})
+		}
+	default:
+		if c.BcryptCost < 10 {
+			findings = append(findings, Finding{
+				Check:    "bcrypt_cost",
+				Severity: SeverityWarn,
+				Detail:   "BCRYPT_COST is below 10",
+			})
+		}
+	}
+
+	if c.dbPassword != "" && strings.ContainsAny(c.dbPassword, "@:/?#[]%") &&
+		strings.Contains(c.DatabaseURL, c.dbPassword) {
+		findings = append(findings, Finding{
+			Check:    "database_url_encoding",
+			Severity: SeverityWarn,
+			Detail:   "POSTGRES_PASSWORD contains URL special characters and appears unencoded in the database URL",
+		})
+	}
+
+	// Only literal addresses can be checked without resolving names
+	for _, name := range c.FederationPeerNames() {
+		if addr, ok := literalAddr(c.FederationPeers[name].URL); ok && c.Egress.Check(addr) != nil {
+			findings = append(findings, Finding{
+				Check:    "egress_blocked_peer",
+				Severity: SeverityWarn,
+				Detail:   "federation peer " + name + " has a private, loopback or link-local address outside EGRESS_ALLOW_CIDRS; requests to it will be refused",
+			})
+		}
+	}
+
+	return findings
+}
+
+// literalAddr returns the address of rawURL's host if it is an IP literal
+// or localhost. The port doesn't matter to the egress policy.
+func literalAddr(rawURL string) (netip.AddrPort, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		host = "127.0.0.1"
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ip, 0), true
+}
+
+// HasFatal reports whether any finding should block startup.
+func HasFatal(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Severity == SeverityFatal {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopback reports whether addr is a loopback host. Empty means all interfaces.
+func isLoopback(addr string) bool {
+	if addr == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
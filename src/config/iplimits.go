@@ -0,0 +1,104 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Unauthenticated routes with a per-IP rate limit, by name in
+// IP_RATE_LIMITS.
+const (
+	IPLimitRegister          = "register"
+	IPLimitLogin             = "login"
+	IPLimitTwoFactorLogin    = "2fa_login"
+	IPLimitRefresh           = "refresh"
+	IPLimitBootstrapAdmin    = "bootstrap_admin"
+	IPLimitVerifyEmail       = "verify_email"
+	IPLimitPasswordReset     = "request_password_reset"
+	IPLimitResetPassword     = "reset_password"
+	IPLimitRegisterChallenge = "register_challenge"
+)
+
+// IPRateLimit lets one client IP make Burst requests at once, regaining
+// them at Burst per Per. A zero Burst means no limit.
+type IPRateLimit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// defaultIPRateLimits are the per-IP limits of the unauthenticated routes.
+// Login is generous enough for a household or office behind one address;
+// per-account guessing is held back by the login lockout as well.
+var defaultIPRateLimits = map[string]IPRateLimit{
+	IPLimitRegister:          {Burst: 10, Per: time.Hour},
+	IPLimitLogin:             {Burst: 30, Per: time.Minute},
+	IPLimitTwoFactorLogin:    {Burst: 30, Per: time.Minute},
+	IPLimitRefresh:           {Burst: 60, Per: time.Minute},
+	IPLimitBootstrapAdmin:    {Burst: 10, Per: time.Hour},
+	IPLimitVerifyEmail:       {Burst: 20, Per: time.Hour},
+	IPLimitPasswordReset:     {Burst: 10, Per: time.Hour},
+	IPLimitResetPassword:     {Burst: 20, Per: time.Hour},
+	IPLimitRegisterChallenge: {Burst: 30, Per: time.Hour},
+}
+
+// loadIPRateLimits starts from the defaults and applies overrides from
+// IP_RATE_LIMITS, e.g. "register=5/1h,login=0". Periods are Go durations.
+func loadIPRateLimits() (map[string]IPRateLimit, error) {
+	limits := make(map[string]IPRateLimit, len(defaultIPRateLimits))
+	for k, v := range defaultIPRateLimits {
+		limits[k] = v
+	}
+
+	raw := os.Getenv("IP_RATE_LIMITS")
+	if raw == "" {
+		return limits, nil
+	}
+	for _, part := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not of the form route=count/period", part)
+		}
+		if _, known := limits[name]; !known {
+			return nil, fmt.Errorf("unknown route %q", name)
+		}
+		if value == "0" {
+			limits[name] = IPRateLimit{}
+			continue
+		}
+		count, period, ok := strings.Cut(value, "/")
+		n, err := strconv.Atoi(count)
+		if !ok || err != nil || n <= 0 {
+			return nil, fmt.Errorf("%q is not a positive count and a period, or 0", value)
+		}
+		per, err := time.ParseDuration(period)
+		if err != nil || per <= 0 {
+			return nil, fmt.Errorf("%q is not a positive duration", period)
+		}
+		limits[name] = IPRateLimit{Burst: n, Per: per}
+	}
+	return limits, nil
+}
+
+// loadClientIPSettings reads how client IPs are found and how many the rate
+// limits track. The limits themselves are reloadable; see loadRuntime.
+func loadClientIPSettings(cfg *Config) error {
+	cfg.TrustedProxyHeader = "X-Forwarded-For"
+	if v := os.Getenv("TRUSTED_PROXY_HEADER"); v != "" {
+		if strings.ContainsAny(v, " \t\r\n:,") {
+			return fmt.Errorf("err: TRUSTED_PROXY_HEADER must be a header name")
+		}
+		cfg.TrustedProxyHeader = v
+	}
+	cfg.IPRateLimitMaxIPs = 100000
+	if v := os.Getenv("IP_RATE_LIMIT_MAX_IPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("err: IP_RATE_LIMIT_MAX_IPS must be a positive integer")
+		}
+		cfg.IPRateLimitMaxIPs = n
+	}
+	return nil
+}
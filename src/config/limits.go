@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Payload types with their own request body size limits. Cheap endpoints get
+// small limits so they can't be used to dodge message quotas.
+const (
+	PayloadAuth        = "auth"
+	PayloadKey         = "key"
+	PayloadChatRequest = "chat_request"
+	PayloadMessage     = "message"
+	PayloadIntro       = "intro"
+	PayloadReaction    = "reaction"
+	PayloadDraft       = "draft"
+	PayloadProfile     = "profile"
+	PayloadSettings    = "settings"
+	PayloadBackup      = "backup"
+	PayloadBatch       = "batch"
+	PayloadContacts    = "contacts"
+	PayloadAttachment  = "attachment"
+)
+
+// defaultPayloadLimits are the body size caps in bytes per payload type.
+var defaultPayloadLimits = map[string]int64{
+	PayloadAuth:        4 << 10,
+	PayloadKey:         16 << 10,
+	PayloadChatRequest: 4 << 10,
+	PayloadMessage:     1 << 20,
+	PayloadIntro:       4 << 10,
+	PayloadReaction:    512,
+	PayloadDraft:       16 << 10,
+	PayloadProfile:     64 << 10,
+	PayloadSettings:    8 << 10,
+	PayloadBackup:      2 << 20, // JSON-wrapped; the blob itself is capped at 1 MB
+	PayloadBatch:       16 << 10,
+	PayloadContacts:    512 << 10, // An export document of up to 1000 contacts
+	PayloadAttachment:  1 << 10,   // Starting an upload; chunks are capped by ATTACHMENT_CHUNK_BYTES
+}
+
+// loadPayloadLimits starts from the defaults and applies overrides from
+// PAYLOAD_LIMITS, e.g. "message=2097152,intro=2048".
+func loadPayloadLimits() (map[string]int64, error) {
+	limits := make(map[string]int64, len(defaultPayloadLimits))
+	for k, v := range defaultPayloadLimits {
+		limits[k] = v
+	}
+
+	raw := os.Getenv("PAYLOAD_LIMITS")
+	if raw == "" {
+		return limits, nil
+	}
+	for _, part := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not of the form type=bytes", part)
+		}
+		if _, known := limits[name]; !known {
+			return nil, fmt.Errorf("unknown payload type %q", name)
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%q is not a positive byte count", value)
+		}
+		limits[name] = n
+	}
+	return limits, nil
+}
+
+// PayloadLimit returns the body size cap for a payload type.
+// Unknown types fall back to the message limit.
+func (c *Config) PayloadLimit(payloadType string) int64 {
+	if n, ok := c.PayloadLimits[payloadType]; ok {
+		return n
+	}
+	return c.PayloadLimits[PayloadMessage]
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+)
+
+// SMTPConfig is the relay recovery email is sent through (see mailer).
+type SMTPConfig struct {
+	Addr     string // host:port; "" turns email off
+	From     string // Envelope and header sender
+	Username string // "" sends without authenticating
+	Password string
+}
+
+// loadMail reads the SMTP relay. Recovery email is off unless SMTP_ADDR is
+// set, e.g.
+//
+//	SMTP_ADDR=smtp.example.com:587
+//	SMTP_FROM=no-reply@example.com
+//	SMTP_USERNAME=no-reply@example.com
+//	SMTP_PASSWORD=...
+//
+// The relay is dialed through the egress policy, so one on a private
+// network must be in EGRESS_ALLOW_CIDRS.
+func loadMail(cfg *Config) error {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("err: SMTP_ADDR must be host:port")
+	}
+	from := os.Getenv("SMTP_FROM")
+	if a, err := mail.ParseAddress(from); err != nil || a.Name != "" || a.Address != from {
+		return fmt.Errorf("err: SMTP_FROM must be a bare email address")
+	}
+	cfg.SMTP = SMTPConfig{
+		Addr:     addr,
+		From:     from,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}
+	if (cfg.SMTP.Username == "") != (cfg.SMTP.Password == "") {
+		return fmt.Errorf("err: SMTP_USERNAME and SMTP_PASSWORD must be set together")
+	}
+	return nil
+}
+
+// MailEnabled reports whether an SMTP relay is configured.
+func (c *Config) MailEnabled() bool {
+	return c.SMTP.Addr != ""
+}
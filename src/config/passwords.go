@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"cryptachat-server/passwords"
+)
+
+// loadPasswordHashing reads how new password hashes are made. The default
+// is bcrypt at BCRYPT_COST; argon2id takes its parameters from the
+// environment, e.g.
+//
+//	PASSWORD_HASH_ALGORITHM=argon2id
+//	ARGON2_MEMORY_KIB=65536
+//	ARGON2_ITERATIONS=3
+//	ARGON2_PARALLELISM=2
+//
+// Existing hashes of either algorithm keep working whatever is set here.
+func loadPasswordHashing(cfg *Config) error {
+	argon2Vars := os.Getenv("ARGON2_MEMORY_KIB") != "" || os.Getenv("ARGON2_ITERATIONS") != "" ||
+		os.Getenv("ARGON2_PARALLELISM") != ""
+
+	switch alg := os.Getenv("PASSWORD_HASH_ALGORITHM"); alg {
+	case "", passwords.AlgorithmBcrypt:
+		if argon2Vars {
+			return fmt.Errorf("err: ARGON2_* are only used with PASSWORD_HASH_ALGORITHM=%s", passwords.AlgorithmArgon2id)
+		}
+		cfg.PasswordHasher = passwords.Bcrypt{Cost: cfg.BcryptCost}
+	case passwords.AlgorithmArgon2id:
+		h := passwords.Argon2id{Memory: 64 * 1024, Iterations: 3, Parallelism: 2}
+		if v := os.Getenv("ARGON2_MEMORY_KIB"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil || n < 8*1024 || n > 1<<20 {
+				return fmt.Errorf("err: ARGON2_MEMORY_KIB must be an integer between %d and %d", 8*1024, 1<<20)
+			}
+			h.Memory = uint32(n)
+		}
+		if v := os.Getenv("ARGON2_ITERATIONS"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil || n < 1 || n > 64 {
+				return fmt.Errorf("err: ARGON2_ITERATIONS must be an integer between 1 and 64")
+			}
+			h.Iterations = uint32(n)
+		}
+		if v := os.Getenv("ARGON2_PARALLELISM"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 8)
+			if err != nil || n < 1 {
+				return fmt.Errorf("err: ARGON2_PARALLELISM must be an integer between 1 and 255")
+			}
+			h.Parallelism = uint8(n)
+		}
+		cfg.PasswordHasher = h
+	default:
+		return fmt.Errorf("err: PASSWORD_HASH_ALGORITHM must be %s or %s", passwords.AlgorithmBcrypt, passwords.AlgorithmArgon2id)
+	}
+	return nil
+}
+
+// loadPasswordPolicy reads the rules for new passwords: at least
+// PASSWORD_MIN_LENGTH characters (default 10), not the username, and
+// unless PASSWORD_REJECT_COMMON=false, not on the common password list,
+// which PASSWORD_COMMON_LIST_FILE replaces.
+func loadPasswordPolicy(cfg *Config) error {
+	minLength := 10
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > passwords.MaxBytes {
+			return fmt.Errorf("err: PASSWORD_MIN_LENGTH must be an integer between 1 and %d", passwords.MaxBytes)
+		}
+		minLength = n
+	}
+	rejectCommon := true
+	if v := os.Getenv("PASSWORD_REJECT_COMMON"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("err: PASSWORD_REJECT_COMMON must be true or false")
+		}
+		rejectCommon = b
+	}
+	listFile := os.Getenv("PASSWORD_COMMON_LIST_FILE")
+	if listFile != "" && !rejectCommon {
+		return fmt.Errorf("err: PASSWORD_COMMON_LIST_FILE is set but PASSWORD_REJECT_COMMON is false")
+	}
+
+	policy, err := passwords.NewPolicy(minLength, rejectCommon, listFile)
+	if err != nil {
+		return fmt.Errorf("err: PASSWORD_COMMON_LIST_FILE: %v", err)
+	}
+	cfg.PasswordPolicy = policy
+	return nil
+}
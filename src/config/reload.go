@@ -0,0 +1,121 @@
+// src/config/reload.go
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// startEnv holds the names of the variables the process was started with,
+// before a .env file added to them. As with godotenv.Load, these win over
+// the file, on every reload too.
+var startEnv = func() map[string]bool {
+	names := make(map[string]bool)
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		names[name] = true
+	}
+	return names
+}()
+
+// ReloadResult lists the settings a reload found changed, by field name.
+type ReloadResult struct {
+	// Applied are RuntimeConfig fields now in effect.
+	Applied []string `json:"applied"`
+	// RestartRequired are Config fields that changed but keep their
+	// running values until the server is restarted.
+	RestartRequired []string `json:"restart_required"`
+}
+
+// Reload reads the configuration again: the process environment, plus the
+// .env file given to LoadConfig as it is now. If the result is valid, the
+// runtime settings are swapped in and OnReload callbacks run; anything else
+// that changed is left as it is and logged as needing a restart. If not,
+// nothing changes and the error says why.
+func (c *Config) Reload() (ReloadResult, error) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	fileVars, err := setEnvFile(c.envPath, c.fileVars)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	c.fileVars = fileVars
+	next, err := load()
+	if err != nil {
+		return ReloadResult{}, err
+	}
+
+	res := ReloadResult{
+		Applied:         changedFields(c.Runtime(), next.Runtime()),
+		RestartRequired: changedFields(c, next),
+	}
+	for _, name := range res.RestartRequired {
+		log.Printf("CONFIG: %s changed; restart to apply it (keeping the running value)", name)
+	}
+
+	rc := next.Runtime()
+	c.runtime.Store(rc)
+	for _, fn := range c.onReload {
+		fn(rc)
+	}
+	if len(res.Applied) > 0 {
+		log.Printf("CONFIG: reloaded %s", strings.Join(res.Applied, ", "))
+	} else {
+		log.Printf("CONFIG: reloaded, no runtime settings changed")
+	}
+	return res, nil
+}
+
+// setEnvFile sets the variables in the .env file at path, except those the
+// process was started with, and unsets those in previous (what the file set
+// last time) that are gone from it. It returns the variables it set. A
+// missing file sets none.
+func setEnvFile(path string, previous map[string]bool) (map[string]bool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	vars, err := godotenv.Read(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		vars = nil
+	} else if err != nil {
+		return previous, err
+	}
+	for name := range previous {
+		if _, ok := vars[name]; !ok {
+			os.Unsetenv(name)
+		}
+	}
+	set := make(map[string]bool, len(vars))
+	for name, value := range vars {
+		if startEnv[name] {
+			continue
+		}
+		os.Setenv(name, value)
+		set[name] = true
+	}
+	return set, nil
+}
+
+// changedFields returns the names of the exported fields that differ
+// between *a and *b.
+func changedFields[T any](a, b *T) []string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	var changed []string
+	for i := 0; i < va.NumField(); i++ {
+		f := va.Type().Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, f.Name)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,112 @@
+// src/config/reload_test.go
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestReload changes the .env file and the environment between reloads
+// and checks runtime settings are swapped in, other settings are reported
+// but keep their running values, and an invalid configuration changes
+// nothing.
+func TestReload(t *testing.T) {
+	for name, value := range map[string]string{
+		"DB_HOST":       "localhost",
+		"DB_PORT":       "5432",
+		"POSTGRES_USER": "test",
+		"POSTGRES_DB":   "test",
+		"SECRET_KEY":    "test-secret-0123456789abcdef0123456789",
+		"PORT":          "8080",
+		// Restored when the test ends, whatever the file sets
+		"KEY_FETCH_LIMIT": "",
+		"LOG_LEVEL":       "",
+	} {
+		t.Setenv(name, value)
+	}
+	envPath := filepath.Join(t.TempDir(), ".env")
+	writeEnv := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(envPath, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeEnv("KEY_FETCH_LIMIT=5\n")
+	cfg, err := LoadConfig(envPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Runtime().KeyFetchLimit; got != 5 {
+		t.Fatalf("KEY_FETCH_LIMIT from the file: %d", got)
+	}
+	var notified []*RuntimeConfig
+	cfg.OnReload(func(rc *RuntimeConfig) { notified = append(notified, rc) })
+
+	writeEnv("KEY_FETCH_LIMIT=7\n")
+	t.Setenv("PORT", "9090")
+	res, err := cfg.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(res.Applied, []string{"KeyFetchLimit"}) || !slices.Equal(res.RestartRequired, []string{"Port"}) {
+		t.Errorf("reload: %+v, want KeyFetchLimit applied and Port needing a restart", res)
+	}
+	if cfg.Runtime().KeyFetchLimit != 7 || cfg.Port != "8080" {
+		t.Errorf("after reloading: key fetch limit %d, port %s; want 7 and the running 8080", cfg.Runtime().KeyFetchLimit, cfg.Port)
+	}
+	if len(notified) != 1 || notified[0] != cfg.Runtime() {
+		t.Errorf("OnReload called %d times", len(notified))
+	}
+
+	// Invalid: nothing changes and nobody is told
+	before := cfg.Runtime()
+	writeEnv("KEY_FETCH_LIMIT=9\nLOG_LEVEL=loud\n")
+	if _, err := cfg.Reload(); err == nil {
+		t.Fatal("LOG_LEVEL=loud was accepted")
+	}
+	if cfg.Runtime() != before || len(notified) != 1 {
+		t.Error("a failed reload changed the running configuration")
+	}
+
+	// A variable gone from the file goes back to its default
+	writeEnv("")
+	res, err = cfg.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults, err := loadRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Runtime().KeyFetchLimit != defaults.KeyFetchLimit || os.Getenv("KEY_FETCH_LIMIT") != "" || os.Getenv("LOG_LEVEL") != "" {
+		t.Errorf("after emptying the file: key fetch limit %d, want the default %d; LOG_LEVEL %q",
+			cfg.Runtime().KeyFetchLimit, defaults.KeyFetchLimit, os.Getenv("LOG_LEVEL"))
+	}
+	if !slices.Equal(res.Applied, []string{"KeyFetchLimit"}) {
+		t.Errorf("applied %v", res.Applied)
+	}
+}
+
+// TestSetEnvFileKeepsStartEnv checks the environment the process started
+// with wins over the file, as with godotenv.Load.
+func TestSetEnvFileKeepsStartEnv(t *testing.T) {
+	t.Setenv("KEY_FETCH_LIMIT", "3")
+	startEnv["KEY_FETCH_LIMIT"] = true
+	defer delete(startEnv, "KEY_FETCH_LIMIT")
+	t.Setenv("LOG_LEVEL", "")
+
+	envPath := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(envPath, []byte("KEY_FETCH_LIMIT=7\nLOG_LEVEL=debug\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	set, err := setEnvFile(envPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("KEY_FETCH_LIMIT") != "3" || os.Getenv("LOG_LEVEL") != "debug" || len(set) != 1 || !set["LOG_LEVEL"] {
+		t.Errorf("KEY_FETCH_LIMIT %q, LOG_LEVEL %q, set %v", os.Getenv("KEY_FETCH_LIMIT"), os.Getenv("LOG_LEVEL"), set)
+	}
+}
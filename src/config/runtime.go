@@ -0,0 +1,265 @@
+// src/config/runtime.go
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"cryptachat-server/featureflags"
+	"cryptachat-server/websockets"
+)
+
+// RuntimeConfig holds the settings that can change while the server runs.
+// Reload swaps in a new one on SIGHUP or POST /admin/reload. Code that uses
+// them reads Config.Runtime() each time rather than keeping a copy, and
+// components that keep state derived from them register with OnReload.
+type RuntimeConfig struct {
+	// LogLevel is the lowest level slog writes.
+	LogLevel slog.Level
+
+	// MessageRetentionDays is the default retention for users without a
+	// preference. 0 keeps messages forever.
+	MessageRetentionDays int
+	// AuditRetentionDays is how long audit events are kept. 0 keeps them
+	// forever.
+	AuditRetentionDays int
+
+	// WebSocket slow-consumer handling. WSSendBuffer applies to clients
+	// that connect after it changes.
+	WSBackpressurePolicy websockets.BackpressurePolicy
+	WSSendBuffer         int
+	// WSClientQueueBytes and WSQueueBytes cap the bytes of frames queued for
+	// one WebSocket client and for all of them together. 0 means no cap.
+	WSClientQueueBytes int64
+	WSQueueBytes       int64
+
+	// FeatureFlags are the flag defaults, the built-in ones with FEATURE_FLAGS
+	// applied (see featureflags).
+	FeatureFlags map[string]bool
+
+	// Chat request spam heuristics (see chatservice/spam.go). Zero disables a rule.
+	SpamMinAccountAge     time.Duration
+	SpamRequirePublicKey  bool
+	SpamMaxRecentDeclines int
+	SpamDeclineWindow     time.Duration
+
+	// Key scraping deterrent: each user may fetch the keys of at most
+	// KeyFetchLimit distinct non-contacts per KeyFetchWindow. Zero disables it.
+	KeyFetchLimit  int
+	KeyFetchWindow time.Duration
+
+	// New-account fan-out limit: accounts younger than NewAccountFanoutAge
+	// may contact at most NewAccountFanoutLimit distinct non-contacts per
+	// day. Zero disables it.
+	NewAccountFanoutLimit int
+	NewAccountFanoutAge   time.Duration
+
+	// Login lockout: after LoginMaxFailures failed logins in a row for one
+	// account from one address, that address may not log in to it for
+	// LoginLockout. Zero disables it.
+	LoginMaxFailures int
+	LoginLockout     time.Duration
+
+	// Open connections allowed per client IP; 0 means no cap. HTTP counts
+	// connections from direct clients and in-flight requests from clients
+	// behind TrustedProxies. Connections already open are kept when a cap
+	// is lowered.
+	HTTPConnsPerIP int
+	WSConnsPerIP   int
+
+	// IPRateLimits limits requests per client IP to the unauthenticated
+	// routes (see iplimits.go), by route name.
+	IPRateLimits map[string]IPRateLimit
+}
+
+// Runtime returns the current runtime settings. Read it again for each
+// request or pass; a reload may replace it at any time.
+func (c *Config) Runtime() *RuntimeConfig {
+	return c.runtime.Load()
+}
+
+// OnReload registers fn to be called with the new runtime settings after
+// every successful reload. fn must not block.
+func (c *Config) OnReload(fn func(*RuntimeConfig)) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	c.onReload = append(c.onReload, fn)
+}
+
+// loadRuntime reads the settings that can be reloaded.
+func loadRuntime() (*RuntimeConfig, error) {
+	rc := &RuntimeConfig{}
+
+	rc.LogLevel = slog.LevelInfo
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := rc.LogLevel.UnmarshalText([]byte(v)); err != nil {
+			return nil, fmt.Errorf("err: LOG_LEVEL must be debug, info, warn or error")
+		}
+	}
+	if v := os.Getenv("MESSAGE_RETENTION_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("err: MESSAGE_RETENTION_DAYS must be a non-negative integer")
+		}
+		rc.MessageRetentionDays = days
+	}
+	rc.AuditRetentionDays = 180
+	if v := os.Getenv("AUDIT_RETENTION_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("err: AUDIT_RETENTION_DAYS must be a non-negative integer")
+		}
+		rc.AuditRetentionDays = days
+	}
+	rc.WSBackpressurePolicy = websockets.PolicyDisconnect
+	if v := os.Getenv("WS_BACKPRESSURE_POLICY"); v != "" {
+		policy, err := websockets.ParseBackpressurePolicy(v)
+		if err != nil {
+			return nil, fmt.Errorf("err: WS_BACKPRESSURE_POLICY: %v", err)
+		}
+		rc.WSBackpressurePolicy = policy
+	}
+	rc.WSSendBuffer = websockets.DefaultSendBuffer
+	if v := os.Getenv("WS_SEND_BUFFER"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("err: WS_SEND_BUFFER must be a positive integer")
+		}
+		rc.WSSendBuffer = n
+	}
+	rc.WSClientQueueBytes = 8 << 20
+	if v := os.Getenv("WS_CLIENT_QUEUE_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("err: WS_CLIENT_QUEUE_BYTES must be a non-negative integer")
+		}
+		rc.WSClientQueueBytes = n
+	}
+	rc.WSQueueBytes = 512 << 20
+	if v := os.Getenv("WS_QUEUE_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("err: WS_QUEUE_BYTES must be a non-negative integer")
+		}
+		rc.WSQueueBytes = n
+	}
+	if err := loadSpamConfig(rc); err != nil {
+		return nil, err
+	}
+	rc.KeyFetchLimit = 30
+	rc.KeyFetchWindow = time.Hour
+	if v := os.Getenv("KEY_FETCH_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("err: KEY_FETCH_LIMIT must be a non-negative integer")
+		}
+		rc.KeyFetchLimit = n
+	}
+	if v := os.Getenv("KEY_FETCH_WINDOW_MINUTES"); v != "" {
+		minutes, err := strconv.Atoi(v)
+		if err != nil || minutes <= 0 {
+			return nil, fmt.Errorf("err: KEY_FETCH_WINDOW_MINUTES must be a positive integer")
+		}
+		rc.KeyFetchWindow = time.Duration(minutes) * time.Minute
+	}
+	rc.NewAccountFanoutLimit = 20
+	rc.NewAccountFanoutAge = 7 * 24 * time.Hour
+	if v := os.Getenv("NEW_ACCOUNT_FANOUT_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("err: NEW_ACCOUNT_FANOUT_LIMIT must be a non-negative integer")
+		}
+		rc.NewAccountFanoutLimit = n
+	}
+	if v := os.Getenv("NEW_ACCOUNT_FANOUT_AGE_HOURS"); v != "" {
+		hours, err := strconv.Atoi(v)
+		if err != nil || hours <= 0 {
+			return nil, fmt.Errorf("err: NEW_ACCOUNT_FANOUT_AGE_HOURS must be a positive integer")
+		}
+		rc.NewAccountFanoutAge = time.Duration(hours) * time.Hour
+	}
+	rc.LoginMaxFailures = 5
+	rc.LoginLockout = 15 * time.Minute
+	if v := os.Getenv("LOGIN_MAX_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("err: LOGIN_MAX_FAILURES must be a non-negative integer")
+		}
+		rc.LoginMaxFailures = n
+	}
+	if v := os.Getenv("LOGIN_LOCKOUT_MINUTES"); v != "" {
+		minutes, err := strconv.Atoi(v)
+		if err != nil || minutes <= 0 {
+			return nil, fmt.Errorf("err: LOGIN_LOCKOUT_MINUTES must be a positive integer")
+		}
+		rc.LoginLockout = time.Duration(minutes) * time.Minute
+	}
+	rc.HTTPConnsPerIP = 100
+	if v := os.Getenv("HTTP_CONNS_PER_IP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("err: HTTP_CONNS_PER_IP must be a non-negative integer")
+		}
+		rc.HTTPConnsPerIP = n
+	}
+	rc.WSConnsPerIP = 20
+	if v := os.Getenv("WS_CONNS_PER_IP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("err: WS_CONNS_PER_IP must be a non-negative integer")
+		}
+		rc.WSConnsPerIP = n
+	}
+	limits, err := loadIPRateLimits()
+	if err != nil {
+		return nil, fmt.Errorf("err: IP_RATE_LIMITS: %v", err)
+	}
+	rc.IPRateLimits = limits
+	flags, err := featureflags.ParseDefaults(os.Getenv("FEATURE_FLAGS"))
+	if err != nil {
+		return nil, fmt.Errorf("err: FEATURE_FLAGS: %v", err)
+	}
+	rc.FeatureFlags = flags
+	return rc, nil
+}
+
+// loadSpamConfig reads the chat request spam thresholds.
+func loadSpamConfig(rc *RuntimeConfig) error {
+	rc.SpamMinAccountAge = time.Hour
+	rc.SpamRequirePublicKey = true
+	rc.SpamMaxRecentDeclines = 3
+	rc.SpamDeclineWindow = 7 * 24 * time.Hour
+
+	if v := os.Getenv("SPAM_MIN_ACCOUNT_AGE_HOURS"); v != "" {
+		hours, err := strconv.Atoi(v)
+		if err != nil || hours < 0 {
+			return fmt.Errorf("err: SPAM_MIN_ACCOUNT_AGE_HOURS must be a non-negative integer")
+		}
+		rc.SpamMinAccountAge = time.Duration(hours) * time.Hour
+	}
+	if v := os.Getenv("SPAM_REQUIRE_PUBLIC_KEY"); v != "" {
+		required, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("err: SPAM_REQUIRE_PUBLIC_KEY must be true or false")
+		}
+		rc.SpamRequirePublicKey = required
+	}
+	if v := os.Getenv("SPAM_MAX_RECENT_DECLINES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("err: SPAM_MAX_RECENT_DECLINES must be a non-negative integer")
+		}
+		rc.SpamMaxRecentDeclines = n
+	}
+	if v := os.Getenv("SPAM_DECLINE_WINDOW_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days <= 0 {
+			return fmt.Errorf("err: SPAM_DECLINE_WINDOW_DAYS must be a positive integer")
+		}
+		rc.SpamDeclineWindow = time.Duration(days) * 24 * time.Hour
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"cryptachat-server/tokensign"
+)
+
+// loadTokenSigning reads how JWTs are signed. The default is HS256 with
+// SECRET_KEY; asymmetric signing needs a private key, e.g.
+//
+//	JWT_ALGORITHM=EdDSA
+//	JWT_PRIVATE_KEY_FILE=/run/secrets/jwt.pem
+//	JWT_PUBLIC_KEY_FILE=/run/secrets/jwt.pub.pem (optional, checked against the private key)
+func loadTokenSigning(cfg *Config) error {
+	signer, err := tokensign.Load(
+		os.Getenv("JWT_ALGORITHM"),
+		[]byte(cfg.JWTSecret),
+		os.Getenv("JWT_PRIVATE_KEY_FILE"),
+		os.Getenv("JWT_PUBLIC_KEY_FILE"),
+	)
+	if err != nil {
+		return fmt.Errorf("err: JWT_ALGORITHM: %v", err)
+	}
+	cfg.TokenSigner = signer
+	return nil
+}
@@ -0,0 +1,230 @@
+// src/connlimit/tracker.go
+
+// Package connlimit caps the connections a single client IP can hold open,
+// so one host can't exhaust the server's file descriptors.
+//
+// Direct clients are counted per TCP connection, through
+// http.Server.ConnState. Connections from trusted proxies are shared by
+// many clients, so they aren't counted; instead each request through them
+// is counted against the forwarded client IP while it runs.
+// WebSocket connections are counted separately from their upgrade until
+// they close. Like ratelimit, counts are per process.
+package connlimit
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Tracker counts open connections per client IP and enforces the caps.
+type Tracker struct {
+	httpCap atomic.Int64 // Per IP; 0 means no cap
+	wsCap   atomic.Int64
+	proxies []netip.Prefix
+	header  string // Where trusted proxies put the client IP
+
+	mu  sync.Mutex
+	ips map[netip.Addr]*counts // Entries are removed when both counts reach zero
+
+	rejectedHTTP atomic.Int64
+	rejectedWS   atomic.Int64
+}
+
+type counts struct {
+	http int
+	ws   int
+}
+
+// New creates a tracker allowing httpCap concurrent HTTP connections and
+// wsCap WebSocket connections per client IP; 0 means no cap. Requests from
+// trustedProxies are attributed to the client IP they forward in header,
+// which holds a comma-separated list like X-Forwarded-For.
+func New(httpCap, wsCap int, trustedProxies []netip.Prefix, header string) *Tracker {
+	t := &Tracker{
+		proxies: trustedProxies,
+		header:  header,
+		ips:     make(map[netip.Addr]*counts),
+	}
+	t.SetCaps(httpCap, wsCap)
+	return t
+}
+
+// SetCaps changes the caps. Connections already open are kept, even if an
+// IP now holds more than its cap.
+func (t *Tracker) SetCaps(httpCap, wsCap int) {
+	t.httpCap.Store(int64(httpCap))
+	t.wsCap.Store(int64(wsCap))
+}
+
+// ConnState is the http.Server.ConnState hook. It counts direct
+// connections from StateNew until they close or are hijacked; hijacked
+// WebSocket connections are counted by AcquireWS instead.
+func (t *Tracker) ConnState(c net.Conn, state http.ConnState) {
+	ip, ok := parseAddr(c.RemoteAddr().String())
+	if !ok || t.trusted(ip) {
+		return
+	}
+	switch state {
+	case http.StateNew:
+		t.adjust(ip, func(n *counts) { n.http++ })
+	case http.StateHijacked, http.StateClosed:
+		t.adjust(ip, func(n *counts) { n.http-- })
+	}
+}
+
+// AcquireHTTP admits a request if its client IP is within the HTTP cap.
+// The caller must call release when the request finishes.
+func (t *Tracker) AcquireHTTP(r *http.Request) (release func(), ok bool) {
+	ip, proxied := t.ClientIP(r)
+	if !proxied {
+		// ConnState has already counted this connection
+		t.mu.Lock()
+		limit := int(t.httpCap.Load())
+		over := limit > 0 && t.ips[ip] != nil && t.ips[ip].http > limit
+		t.mu.Unlock()
+		if over {
+			t.rejectedHTTP.Add(1)
+			return nil, false
+		}
+		return func() {}, true
+	}
+	return t.acquire(ip, int(t.httpCap.Load()), &t.rejectedHTTP, func(n *counts) *int { return &n.http })
+}
+
+// AcquireWS reserves a WebSocket connection for the request's client IP.
+// The caller must call release once the connection closes, or straight
+// away if it is never upgraded. release may be called more than once.
+func (t *Tracker) AcquireWS(r *http.Request) (release func(), ok bool) {
+	ip, _ := t.ClientIP(r)
+	return t.acquire(ip, int(t.wsCap.Load()), &t.rejectedWS, func(n *counts) *int { return &n.ws })
+}
+
+// acquire increments the counter field picks for ip unless it is at limit.
+func (t *Tracker) acquire(ip netip.Addr, limit int, rejected *atomic.Int64, field func(*counts) *int) (func(), bool) {
+	t.mu.Lock()
+	n := t.ips[ip]
+	if n == nil {
+		n = &counts{}
+		t.ips[ip] = n
+	}
+	if limit > 0 && *field(n) >= limit {
+		t.mu.Unlock()
+		rejected.Add(1)
+		return nil, false
+	}
+	*field(n)++
+	t.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { t.adjust(ip, func(n *counts) { *field(n)-- }) })
+	}, true
+}
+
+// adjust applies change to ip's counts and drops the entry once it is empty.
+func (t *Tracker) adjust(ip netip.Addr, change func(*counts)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.ips[ip]
+	if n == nil {
+		n = &counts{}
+		t.ips[ip] = n
+	}
+	change(n)
+	if n.http <= 0 && n.ws <= 0 {
+		delete(t.ips, ip)
+	}
+}
+
+// ClientIP returns the IP a request is attributed to, and whether it came
+// through a trusted proxy. For those it is the rightmost forwarded entry
+// that isn't itself a trusted proxy, since entries to the left of that are
+// supplied by the client and can be forged.
+func (t *Tracker) ClientIP(r *http.Request) (netip.Addr, bool) {
+	peer, ok := parseAddr(r.RemoteAddr)
+	if !ok || !t.trusted(peer) {
+		return peer, false
+	}
+	hops := strings.Split(strings.Join(r.Header.Values(t.header), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		ip = ip.Unmap()
+		if !t.trusted(ip) {
+			return ip, true
+		}
+	}
+	// No usable header: the proxy's own request, such as a health check
+	return peer, true
+}
+
+func (t *Tracker) trusted(ip netip.Addr) bool {
+	for _, p := range t.proxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddr parses a "host:port" remote address.
+func parseAddr(remote string) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+// topTalkers is how many IPs Stats lists.
+const topTalkers = 10
+
+// IPCount is one client IP's open connections.
+type IPCount struct {
+	IP   string `json:"ip"`
+	HTTP int    `json:"http"`
+	WS   int    `json:"ws"`
+}
+
+// Stats describes connection tracking for /admin/runtime.
+type Stats struct {
+	HTTPPerIP    int       `json:"http_per_ip"` // Caps; 0 means none
+	WSPerIP      int       `json:"ws_per_ip"`
+	TrackedIPs   int       `json:"tracked_ips"`
+	RejectedHTTP int64     `json:"rejected_http"`
+	RejectedWS   int64     `json:"rejected_ws"`
+	TopTalkers   []IPCount `json:"top_talkers"` // Most open connections first
+}
+
+// Stats returns the caps, rejection counters and the IPs holding the most
+// connections.
+func (t *Tracker) Stats() Stats {
+	t.mu.Lock()
+	all := make([]IPCount, 0, len(t.ips))
+	for ip, n := range t.ips {
+		all = append(all, IPCount{IP: ip.String(), HTTP: n.http, WS: n.ws})
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(all, func(a, b IPCount) int {
+		if d := (b.HTTP + b.WS) - (a.HTTP + a.WS); d != 0 {
+			return d
+		}
+		return strings.Compare(a.IP, b.IP)
+	})
+	return Stats{
+		HTTPPerIP:    int(t.httpCap.Load()),
+		WSPerIP:      int(t.wsCap.Load()),
+		TrackedIPs:   len(all),
+		RejectedHTTP: t.rejectedHTTP.Load(),
+		RejectedWS:   t.rejectedWS.Load(),
+		TopTalkers:   all[:min(len(all), topTalkers)],
+	}
+}
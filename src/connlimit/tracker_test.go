@@ -0,0 +1,199 @@
+// src/connlimit/tracker_test.go
+package connlimit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+var proxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+// fakeConn is a connection from addr, for ConnState.
+type fakeConn struct {
+	net.Conn
+	addr string
+}
+
+func (c fakeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(c.addr), Port: 40000}
+}
+
+func request(remote string, forwarded ...string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = remote
+	for _, f := range forwarded {
+		r.Header.Add("X-Forwarded-For", f)
+	}
+	return r
+}
+
+func TestClientIP(t *testing.T) {
+	tr := New(0, 0, proxies, "X-Forwarded-For")
+	tests := []struct {
+		name     string
+		r        *http.Request
+		want     string
+		viaProxy bool
+	}{
+		{"direct", request("203.0.113.5:1234"), "203.0.113.5", false},
+		{"direct, header ignored", request("203.0.113.5:1234", "198.51.100.7"), "203.0.113.5", false},
+		{"proxied", request("10.0.0.1:1234", "198.51.100.7"), "198.51.100.7", true},
+		{"forged entries on the left", request("10.0.0.1:1234", "192.0.2.1, 198.51.100.7"), "198.51.100.7", true},
+		{"through two proxies", request("10.0.0.1:1234", "198.51.100.7, 10.0.0.2"), "198.51.100.7", true},
+		{"header repeated", request("10.0.0.1:1234", "192.0.2.1", "198.51.100.7"), "198.51.100.7", true},
+		{"mapped", request("10.0.0.1:1234", "::ffff:198.51.100.7"), "198.51.100.7", true},
+		{"unparseable", request("10.0.0.1:1234", "198.51.100.7, junk"), "10.0.0.1", true},
+		{"only proxies", request("10.0.0.1:1234", "10.0.0.2"), "10.0.0.1", true},
+		{"no header", request("10.0.0.1:1234"), "10.0.0.1", true},
+		{"mapped peer", request("[::ffff:10.0.0.1]:1234", "198.51.100.7"), "198.51.100.7", true},
+	}
+	for _, tt := range tests {
+		ip, viaProxy := tr.ClientIP(tt.r)
+		if ip.String() != tt.want || viaProxy != tt.viaProxy {
+			t.Errorf("%s: %s (proxied %v), want %s (proxied %v)", tt.name, ip, viaProxy, tt.want, tt.viaProxy)
+		}
+	}
+}
+
+// TestDirectConnections counts connections through ConnState. A request
+// is refused while its IP holds more connections than the cap, counting
+// its own.
+func TestDirectConnections(t *testing.T) {
+	tr := New(2, 0, proxies, "X-Forwarded-For")
+	conn := fakeConn{addr: "203.0.113.5"}
+	r := request("203.0.113.5:40000")
+
+	tr.ConnState(conn, http.StateNew)
+	tr.ConnState(conn, http.StateNew)
+	if _, ok := tr.AcquireHTTP(r); !ok {
+		t.Error("refused at the cap")
+	}
+	tr.ConnState(conn, http.StateNew)
+	if _, ok := tr.AcquireHTTP(r); ok {
+		t.Error("allowed over the cap")
+	}
+	if _, ok := tr.AcquireHTTP(request("203.0.113.6:40000")); !ok {
+		t.Error("another IP was refused")
+	}
+
+	// A hijacked connection is handed to AcquireWS
+	tr.ConnState(conn, http.StateHijacked)
+	if _, ok := tr.AcquireHTTP(r); !ok {
+		t.Error("refused once a connection was hijacked")
+	}
+
+	// Connections from a trusted proxy aren't counted
+	for i := 0; i < 5; i++ {
+		tr.ConnState(fakeConn{addr: "10.0.0.1"}, http.StateNew)
+	}
+	tr.ConnState(conn, http.StateClosed)
+	tr.ConnState(conn, http.StateClosed)
+	if st := tr.Stats(); st.TrackedIPs != 0 || st.RejectedHTTP != 1 {
+		t.Errorf("after closing: %+v", st)
+	}
+}
+
+// TestProxiedRequests counts requests through a proxy against the client
+// IP it forwards, for as long as each runs.
+func TestProxiedRequests(t *testing.T) {
+	tr := New(2, 0, proxies, "X-Forwarded-For")
+	r := request("10.0.0.1:1234", "198.51.100.7")
+
+	first, ok := tr.AcquireHTTP(r)
+	if !ok {
+		t.Fatal("first request refused")
+	}
+	if _, ok := tr.AcquireHTTP(r); !ok {
+		t.Fatal("second request refused")
+	}
+	if _, ok := tr.AcquireHTTP(r); ok {
+		t.Error("third request allowed over the cap")
+	}
+	if _, ok := tr.AcquireHTTP(request("10.0.0.1:1234", "198.51.100.8")); !ok {
+		t.Error("another client behind the proxy was refused")
+	}
+
+	// Releasing twice frees one slot
+	first()
+	first()
+	if _, ok := tr.AcquireHTTP(r); !ok {
+		t.Error("refused after a request finished")
+	}
+	if _, ok := tr.AcquireHTTP(r); ok {
+		t.Error("a double release freed two slots")
+	}
+}
+
+// TestWebSocketsAndCaps fills the WebSocket cap, then changes the caps
+// with connections open.
+func TestWebSocketsAndCaps(t *testing.T) {
+	tr := New(0, 2, proxies, "X-Forwarded-For")
+	r := request("203.0.113.5:40000")
+
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, ok := tr.AcquireWS(r)
+		if !ok {
+			t.Fatalf("WebSocket %d refused", i+1)
+		}
+		releases = append(releases, release)
+	}
+	if _, ok := tr.AcquireWS(r); ok {
+		t.Error("a third WebSocket was allowed")
+	}
+
+	tr.SetCaps(0, 0)
+	release, ok := tr.AcquireWS(r)
+	if !ok {
+		t.Fatal("refused without a cap")
+	}
+	releases = append(releases, release)
+
+	// Lowering the cap keeps the three open, and refuses more until they close
+	tr.SetCaps(0, 1)
+	if _, ok := tr.AcquireWS(r); ok {
+		t.Error("allowed over the lowered cap")
+	}
+	st := tr.Stats()
+	if st.WSPerIP != 1 || st.RejectedWS != 2 || len(st.TopTalkers) != 1 || st.TopTalkers[0].WS != 3 {
+		t.Errorf("stats: %+v", st)
+	}
+	for _, release := range releases {
+		release()
+	}
+	if _, ok := tr.AcquireWS(r); !ok {
+		t.Error("refused once the others closed")
+	}
+}
+
+func TestTopTalkers(t *testing.T) {
+	tr := New(0, 0, proxies, "X-Forwarded-For")
+	for i := 0; i < topTalkers+2; i++ {
+		addr := netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}).String()
+		for j := 0; j <= i%3; j++ {
+			tr.ConnState(fakeConn{addr: addr}, http.StateNew)
+		}
+	}
+	tr.AcquireWS(request("192.0.2.0:40000"))
+	tr.AcquireWS(request("192.0.2.0:40000"))
+
+	st := tr.Stats()
+	if st.TrackedIPs != topTalkers+2 || len(st.TopTalkers) != topTalkers {
+		t.Fatalf("tracking %d, listing %d", st.TrackedIPs, len(st.TopTalkers))
+	}
+	want := []IPCount{
+		{IP: "192.0.2.0", HTTP: 1, WS: 2},
+		{IP: "192.0.2.11", HTTP: 3},
+		{IP: "192.0.2.2", HTTP: 3},
+		{IP: "192.0.2.5", HTTP: 3},
+		{IP: "192.0.2.8", HTTP: 3},
+	}
+	for i, w := range want {
+		if st.TopTalkers[i] != w {
+			t.Errorf("top talker %d: %+v, want %+v", i, st.TopTalkers[i], w)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// src/contactdoc/contactdoc.go
+
+// Package contactdoc defines the signed, portable contact list a user takes
+// from one instance to another. Like keylog it has no dependencies, so a
+// client can check a document with the same code the server signed it with.
+//
+// The signature proves the document hasn't been altered since the issuing
+// instance signed it. It doesn't prove who runs that instance: compare
+// SignerKey with the issuer's /server_info before trusting it.
+package contactdoc
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Version is the document format this package writes and accepts.
+const Version = 1
+
+// MaxContacts bounds the size of a document.
+const MaxContacts = 1000
+
+// Contact is one accepted contact at the time of export.
+type Contact struct {
+	Username string `json:"username"`
+	// KeyFingerprint is the hex SHA-256 of the contact's public key as
+	// uploaded (keylog.KeyHash), or "" if they had none.
+	KeyFingerprint string `json:"key_fingerprint"`
+	AcceptedAt     string `json:"accepted_at,omitempty"` // RFC3339; empty if unknown
+}
+
+// Document is an exported contact list. Timestamps are strings so the
+// signed bytes survive any JSON round trip unchanged.
+type Document struct {
+	Version    int       `json:"version"`
+	Issuer     string    `json:"issuer"` // Host of the exporting instance
+	Username   string    `json:"username"`
+	ExportedAt string    `json:"exported_at"`
+	Contacts   []Contact `json:"contacts"`
+	SignerKey  string    `json:"signer_key"` // Base64 Ed25519 public key
+	Signature  string    `json:"signature"`  // Base64 Ed25519 signature
+}
+
+// signedBytes is what the signature covers: the document without its
+// signature, as compact JSON.
+func (d Document) signedBytes() ([]byte, error) {
+	d.Signature = ""
+	return json.Marshal(d)
+}
+
+// Sign sets SignerKey and Signature using key.
+func (d *Document) Sign(key ed25519.PrivateKey) error {
+	d.SignerKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	msg, err := d.signedBytes()
+	if err != nil {
+		return err
+	}
+	d.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, msg))
+	return nil
+}
+
+// Verify checks the document's shape and that Signature is valid for
+// SignerKey.
+func (d Document) Verify() error {
+	if d.Version != Version {
+		return fmt.Errorf("unsupported document version %d", d.Version)
+	}
+	if d.Username == "" || d.Issuer == "" {
+		return errors.New("document has no username or issuer")
+	}
+	if len(d.Contacts) > MaxContacts {
+		return fmt.Errorf("document lists %d contacts; at most %d are allowed", len(d.Contacts), MaxContacts)
+	}
+	pub, err := base64.StdEncoding.DecodeString(d.SignerKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("signer_key is not a base64 Ed25519 public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(d.Signature)
+	if err != nil {
+		return errors.New("signature is not base64")
+	}
+	msg, err := d.signedBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), msg, sig) {
+		return errors.New("signature does not match the document")
+	}
+	return nil
+}
+
+// SignerFingerprint returns a short hex fingerprint of the signer key for
+// people to compare.
+func (d Document) SignerFingerprint() string {
+	sum := sha256.Sum256([]byte(d.SignerKey))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// SigningKey derives an instance's Ed25519 signing key from a secret, so
+// the key needs no storage of its own. Rotating the secret rotates the key.
+func SigningKey(secret string) ed25519.PrivateKey {
+	seed := sha256.Sum256([]byte("cryptachat contact export v1\x00" + secret))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// PublicKey returns the base64 public half of key, as it appears in SignerKey.
+func PublicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
@@ -0,0 +1,78 @@
+// src/contactimport/worker.go
+package contactimport
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"cryptachat-server/chatservice"
+	"cryptachat-server/clock"
+	"cryptachat-server/store"
+)
+
+const (
+	// workInterval is how often due import items are looked for.
+	workInterval = time.Minute
+	// claimBatch caps the items processed per pass.
+	claimBatch = 100
+)
+
+// Worker turns due contact import items into chat requests.
+type Worker struct {
+	store *store.PostgresStore
+	svc   *chatservice.Service
+	clock clock.Clock
+}
+
+// NewWorker creates a worker. Several replicas may run one each; items are
+// claimed with SKIP LOCKED.
+func NewWorker(store *store.PostgresStore, svc *chatservice.Service) *Worker {
+	return &Worker{
+		store: store,
+		svc:   svc,
+		clock: clock.Real,
+	}
+}
+
+// SetClock replaces the worker's clock. Must be called before Run. Intended for tests.
+func (w *Worker) SetClock(c clock.Clock) {
+	w.clock = c
+}
+
+// Run works once immediately and then every workInterval until ctx is cancelled.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := w.clock.NewTicker(workInterval)
+	defer ticker.Stop()
+
+	for {
+		w.WorkOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// WorkOnce processes the items that are due now and logs the result.
+func (w *Worker) WorkOnce(ctx context.Context) {
+	finish := w.store.StartJobRun("contact_import")
+	items, err := w.store.ClaimContactImportItems(ctx, claimBatch)
+	if err != nil {
+		log.Printf("CONTACT_IMPORT: claim failed: %v", err)
+		finish(err)
+		return
+	}
+	failed := 0
+	for _, item := range items {
+		if err := w.svc.ProcessContactImportItem(ctx, item); err != nil {
+			log.Printf("CONTACT_IMPORT: item %d of import %d failed, will retry: %v", item.ID, item.ImportID, err)
+			failed++
+		}
+	}
+	if len(items) > 0 {
+		log.Printf("CONTACT_IMPORT: processed %d items (%d to retry)", len(items), failed)
+	}
+	finish(nil)
+}
@@ -0,0 +1,120 @@
+// src/deliverylog/recorder.go
+package deliverylog
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"cryptachat-server/clock"
+	"cryptachat-server/store"
+)
+
+const (
+	// Entries waiting to be written. When full, new entries are dropped
+	// rather than slowing down delivery.
+	queueSize = 4096
+	// How often queued entries are flushed.
+	flushInterval = time.Second
+	// Entries written per COPY.
+	maxBatch = 500
+	// Entries are kept this long, then pruned.
+	retention = 7 * 24 * time.Hour
+	// How often old entries are pruned.
+	pruneInterval = time.Hour
+)
+
+// Recorder writes message delivery outcomes to the store in the background.
+// Record never blocks, so it is safe to call from the hub's event loop.
+type Recorder struct {
+	store   *store.PostgresStore
+	clock   clock.Clock
+	queue   chan store.DeliveryLogEntry
+	dropped atomic.Int64
+}
+
+func NewRecorder(db *store.PostgresStore) *Recorder {
+	return &Recorder{
+		store: db,
+		clock: clock.Real,
+		queue: make(chan store.DeliveryLogEntry, queueSize),
+	}
+}
+
+// SetClock replaces the recorder's clock. Must be called before Run. Intended for tests.
+func (r *Recorder) SetClock(c clock.Clock) {
+	r.clock = c
+}
+
+// Record queues an entry, stamping it with the current time. If the queue
+// is full the entry is dropped and counted.
+func (r *Recorder) Record(e store.DeliveryLogEntry) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = store.NewTimestamp(r.clock.Now())
+	}
+	select {
+	case r.queue <- e:
+	default:
+		r.dropped.Add(1)
+	}
+}
+
+// Run flushes queued entries every flushInterval and prunes old ones every
+// pruneInterval until ctx is cancelled.
+func (r *Recorder) Run(ctx context.Context) {
+	flush := r.clock.NewTicker(flushInterval)
+	defer flush.Stop()
+	prune := r.clock.NewTicker(pruneInterval)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flush.C():
+			r.flush(ctx)
+		case <-prune.C():
+			n, err := r.store.PruneDeliveryLog(ctx, r.clock.Now().Add(-retention))
+			if err != nil {
+				log.Printf("DELIVERYLOG: prune failed: %v", err)
+			} else if n > 0 {
+				log.Printf("DELIVERYLOG: pruned %d entries", n)
+			}
+		}
+	}
+}
+
+// flush writes everything currently queued, in batches of maxBatch.
+func (r *Recorder) flush(ctx context.Context) {
+	finish := r.store.StartJobRun("delivery_log")
+	if n := r.dropped.Swap(0); n > 0 {
+		log.Printf("DELIVERYLOG: queue full, dropped %d entries", n)
+	}
+
+	for {
+		batch := make([]store.DeliveryLogEntry, 0, maxBatch)
+	fill:
+		for len(batch) < maxBatch {
+			select {
+			case e := <-r.queue:
+				batch = append(batch, e)
+			default:
+				break fill
+			}
+		}
+		if len(batch) == 0 {
+			finish(nil)
+			return
+		}
+		if err := r.store.InsertDeliveryLog(ctx, batch); err != nil {
+			log.Printf("DELIVERYLOG: could not write %d entries: %v", len(batch), err)
+			finish(err)
+			return
+		}
+		if len(batch) < maxBatch {
+			finish(nil)
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// src/egress/egress.go
+package egress
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// Every outbound request the server makes (federation, webhooks and push
+// pings) goes through a Client from this package,
+// so that a URL from config or an admin can't be pointed at internal
+// services. The address check runs when the connection is dialed, on the IP
+// actually being connected to, so a name that resolves to a public address
+// when checked and a private one when dialed (DNS rebinding) is still
+// caught, as are redirects.
+
+// maxRedirects is how many redirects a Client follows.
+const maxRedirects = 3
+
+// Policy is what outbound requests are allowed to do.
+type Policy struct {
+	// Allow lists ranges that may be dialed even though they are private,
+	// loopback or link-local, e.g. a federation peer on the same network.
+	Allow []netip.Prefix
+	// Timeout bounds each request, including reading the body.
+	Timeout time.Duration
+	// MaxResponseBytes caps response bodies; reading past it fails with
+	// ErrResponseTooLarge. 0 means no cap.
+	MaxResponseBytes int64
+	// Resolver looks up host names when dialing; nil means the system's.
+	Resolver *net.Resolver
+}
+
+// BlockedError is a connection refused by the policy.
+type BlockedError struct {
+	Addr   netip.AddrPort
+	Reason string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("egress: blocked connection to %s (%s address)", e.Addr, e.Reason)
+}
+
+// ErrResponseTooLarge is returned when reading a response body past
+// Policy.MaxResponseBytes.
+var ErrResponseTooLarge = errors.New("egress: response body too large")
+
+// sharedAddressSpace (RFC 6598, carrier-grade NAT) and "this network"
+// aren't covered by the netip predicates.
+var (
+	sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+	thisNetwork        = netip.MustParsePrefix("0.0.0.0/8")
+)
+
+// Check returns a *BlockedError if the policy doesn't allow dialing addr.
+func (p Policy) Check(addr netip.AddrPort) error {
+	ip := addr.Addr().Unmap()
+	for _, prefix := range p.Allow {
+		if prefix.Contains(ip) {
+			return nil
+		}
+	}
+
+	var reason string
+	switch {
+	case ip.IsLoopback():
+		reason = "loopback"
+	case ip.IsPrivate(), sharedAddressSpace.Contains(ip):
+		reason = "private"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast(), ip.IsInterfaceLocalMulticast():
+		reason = "link-local"
+	case ip.IsUnspecified(), thisNetwork.Contains(ip):
+		reason = "unspecified"
+	case ip.IsMulticast():
+		reason = "multicast"
+	default:
+		return nil
+	}
+	return &BlockedError{Addr: addr, Reason: reason}
+}
+
+// Dialer returns a dialer that refuses connections the policy doesn't
+// allow. It checks the address after resolution, right before connecting.
+func (p Policy) Dialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   p.dialTimeout(),
+		KeepAlive: 30 * time.Second,
+		Resolver:  p.Resolver,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("egress: unexpected dial address %q: %v", address, err)
+			}
+			return p.Check(addr)
+		},
+	}
+}
+
+// Transport returns an http.Transport that dials through the policy. tlsCfg
+// may be nil. Proxies from the environment are not used, since the policy
+// would then only see the proxy's address.
+func (p Policy) Transport(tlsCfg *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = p.Dialer().DialContext
+	transport.TLSClientConfig = tlsCfg
+	return transport
+}
+
+// Client returns an http.Client for outbound requests under the policy.
+// Redirects are dialed through the same policy; at most maxRedirects are
+// followed, and never from https to http.
+func (p Policy) Client(tlsCfg *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &limitedTransport{next: p.Transport(tlsCfg), max: p.MaxResponseBytes},
+		Timeout:   p.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("egress: stopped after %d redirects", maxRedirects)
+			}
+			if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+				return fmt.Errorf("egress: refusing redirect from https to %s", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// dialTimeout is the connect timeout: the request timeout, capped at the
+// default transport's 30 seconds.
+func (p Policy) dialTimeout() time.Duration {
+	if p.Timeout > 0 && p.Timeout < 30*time.Second {
+		return p.Timeout
+	}
+	return 30 * time.Second
+}
+
+// limitedTransport caps response bodies.
+type limitedTransport struct {
+	next http.RoundTripper
+	max  int64
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || t.max <= 0 {
+		return resp, err
+	}
+	if resp.ContentLength > t.max {
+		resp.Body.Close()
+		return nil, ErrResponseTooLarge
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: t.max}
+	return resp, nil
+}
+
+// limitedBody fails with ErrResponseTooLarge instead of returning more
+// than remaining bytes.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Past the cap only if there is more to read
+		var probe [1]byte
+		if n, _ := b.ReadCloser.Read(probe[:]); n > 0 {
+			return 0, ErrResponseTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
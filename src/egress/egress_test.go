@@ -0,0 +1,222 @@
+// src/egress/egress_test.go
+package egress
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubDNS is a DNS server on loopback that answers every A query with the
+// next of its addresses, repeating the last, and other queries with no
+// records. It stands in for an attacker's name server in rebinding tests.
+type stubDNS struct {
+	conn    net.PacketConn
+	mu      sync.Mutex
+	answers []netip.Addr
+	asked   int // A queries answered
+}
+
+func newStubDNS(t *testing.T, answers ...netip.Addr) *stubDNS {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	d := &stubDNS{conn: conn, answers: answers}
+	go d.serve()
+	return d
+}
+
+// resolver returns a resolver that sends every query to d.
+func (d *stubDNS) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp4", d.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (d *stubDNS) queries() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.asked
+}
+
+func (d *stubDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := d.answer(buf[:n]); resp != nil {
+			d.conn.WriteTo(resp, from)
+		}
+	}
+}
+
+// answer builds the response to one query, or returns nil for a packet it
+// can't parse.
+func (d *stubDNS) answer(query []byte) []byte {
+	if len(query) < 12 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return nil
+	}
+	// Skip the question's name to reach its type and class
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		i += int(query[i]) + 1
+	}
+	if i+5 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	question := query[12 : i+5]
+
+	var addr netip.Addr
+	if qtype == 1 {
+		d.mu.Lock()
+		addr = d.answers[min(d.asked, len(d.answers)-1)]
+		d.asked++
+		d.mu.Unlock()
+	}
+
+	resp := append([]byte{}, query[:2]...) // ID
+	resp = append(resp, 0x81, 0x80)        // Response, recursion desired and available
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	if addr.IsValid() {
+		resp = binary.BigEndian.AppendUint16(resp, 1)
+	} else {
+		resp = binary.BigEndian.AppendUint16(resp, 0)
+	}
+	resp = append(resp, 0, 0, 0, 0) // No authority or additional records
+	resp = append(resp, question...)
+	if addr.IsValid() {
+		// The name is a pointer to the question's; TTL 0, so nothing caches it
+		resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4)
+		resp = append(resp, addr.AsSlice()...)
+	}
+	return resp
+}
+
+// TestDialerChecksEveryResolution resolves one name to a public address and
+// then to a private one, as a rebinding name server would. The check runs
+// on the address each dial connects to, so the second dial is refused.
+func TestDialerChecksEveryResolution(t *testing.T) {
+	public, private := netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("10.0.0.1")
+	dns := newStubDNS(t, public, private)
+	p := Policy{Timeout: 200 * time.Millisecond, Resolver: dns.resolver()}
+	ctx := context.Background()
+
+	// Nothing listens at the public address, so the dial fails or times
+	// out; it must not be the policy that refuses it
+	conn, err := p.Dialer().DialContext(ctx, "tcp4", "rebind.example.:80")
+	if conn != nil {
+		conn.Close()
+	}
+	var blocked *BlockedError
+	if errors.As(err, &blocked) {
+		t.Fatalf("public address refused: %v", err)
+	}
+
+	_, err = p.Dialer().DialContext(ctx, "tcp4", "rebind.example.:80")
+	if !errors.As(err, &blocked) {
+		t.Fatalf("private address after rebinding: got %v, want a BlockedError", err)
+	}
+	if want := netip.AddrPortFrom(private, 80); blocked.Addr != want || blocked.Reason != "private" {
+		t.Errorf("blocked %s (%s), want %s (private)", blocked.Addr, blocked.Reason, want)
+	}
+	if got := dns.queries(); got != 2 {
+		t.Errorf("resolved %d times, want once per dial", got)
+	}
+}
+
+// TestClientChecksRebindingBetweenRequests makes the same request twice
+// through a Client. The first resolves to an allowed address and
+// succeeds; by the second the name points at the cloud metadata address.
+func TestClientChecksRebindingBetweenRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No keep-alive, so the second request dials and resolves again
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	port := netip.MustParseAddrPort(srv.Listener.Addr().String()).Port()
+
+	dns := newStubDNS(t, netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("169.254.169.254"))
+	p := Policy{
+		Allow:    []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+		Timeout:  2 * time.Second,
+		Resolver: dns.resolver(),
+	}
+	client := p.Client(nil)
+	target := "http://" + net.JoinHostPort("rebind.example.", strconv.Itoa(int(port))) + "/"
+
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatalf("allowed address: %v", err)
+	}
+	resp.Body.Close()
+
+	_, err = client.Get(target)
+	var blocked *BlockedError
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) || !errors.As(err, &blocked) {
+		t.Fatalf("metadata address after rebinding: got %v, want a BlockedError", err)
+	}
+	if blocked.Reason != "link-local" {
+		t.Errorf("blocked as %s, want link-local", blocked.Reason)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	allow := Policy{Allow: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}}
+	tests := []struct {
+		addr   string
+		policy Policy
+		reason string // "" if allowed
+	}{
+		{"93.184.216.34:443", Policy{}, ""},
+		{"[2606:4700::1111]:443", Policy{}, ""},
+		{"127.0.0.1:80", Policy{}, "loopback"},
+		{"[::1]:80", Policy{}, "loopback"},
+		{"[::ffff:127.0.0.1]:80", Policy{}, "loopback"},
+		{"10.0.0.1:80", Policy{}, "private"},
+		{"172.16.5.4:80", Policy{}, "private"},
+		{"192.168.1.1:80", Policy{}, "private"},
+		{"[fd00::1]:80", Policy{}, "private"},
+		{"100.64.0.1:80", Policy{}, "private"},
+		{"169.254.169.254:80", Policy{}, "link-local"},
+		{"[fe80::1]:80", Policy{}, "link-local"},
+		{"0.0.0.0:80", Policy{}, "unspecified"},
+		{"0.1.2.3:80", Policy{}, "unspecified"},
+		{"224.0.0.1:80", Policy{}, "link-local"},
+		{"239.1.1.1:80", Policy{}, "multicast"},
+		{"10.1.2.3:80", allow, ""},
+		{"10.2.0.1:80", allow, "private"},
+	}
+	for _, tt := range tests {
+		err := tt.policy.Check(netip.MustParseAddrPort(tt.addr))
+		var blocked *BlockedError
+		switch {
+		case tt.reason == "" && err != nil:
+			t.Errorf("%s refused: %v", tt.addr, err)
+		case tt.reason != "" && !errors.As(err, &blocked):
+			t.Errorf("%s allowed, want refused as %s", tt.addr, tt.reason)
+		case tt.reason != "" && blocked.Reason != tt.reason:
+			t.Errorf("%s refused as %s, want %s", tt.addr, blocked.Reason, tt.reason)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// src/featureflags/checker.go
+package featureflags
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cryptachat-server/clock"
+	"cryptachat-server/store"
+)
+
+// Feature flags let a risky feature reach some users before everyone. A
+// flag is on for a user if they have an override saying so, otherwise if
+// they fall inside its rollout percentage, otherwise if FEATURE_FLAGS turns
+// it on. Flags only narrow what the instance offers: a feature switched off
+// in config stays off whatever its flag says.
+
+// Flags.
+const (
+	// SealedSender gates opting in to and sending sealed-sender messages.
+	SealedSender = "sealed_sender"
+	// Sync gates GET /sync.
+	Sync = "sync"
+)
+
+// defaults are the flags and their defaults when FEATURE_FLAGS doesn't
+// mention them. Both features predate flags, so they default to on.
+var defaults = map[string]bool{
+	SealedSender: true,
+	Sync:         true,
+}
+
+// cacheTTL is how long rollouts and a user's overrides are served from
+// memory. Changes made through this Checker apply at once; changes made on
+// another replica take up to this long.
+const cacheTTL = 30 * time.Second
+
+// Known returns every flag name, sorted.
+func Known() []string {
+	names := make([]string, 0, len(defaults))
+	for name := range defaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsKnown reports whether flag exists.
+func IsKnown(flag string) bool {
+	_, ok := defaults[flag]
+	return ok
+}
+
+// ParseDefaults reads FEATURE_FLAGS, e.g. "sync=false,sealed_sender=true",
+// on top of the built-in defaults.
+func ParseDefaults(raw string) (map[string]bool, error) {
+	out := make(map[string]bool, len(defaults))
+	for name, on := range defaults {
+		out[name] = on
+	}
+	if raw == "" {
+		return out, nil
+	}
+	for _, part := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not of the form flag=true|false", part)
+		}
+		if !IsKnown(name) {
+			return nil, fmt.Errorf("unknown flag %q", name)
+		}
+		on, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not true or false", name, value)
+		}
+		out[name] = on
+	}
+	return out, nil
+}
+
+// Bucket places userID in 0-99 for flag. It is stable, and differs per
+// flag so the same users aren't always first.
+func Bucket(flag string, userID int) int {
+	h := fnv.New32a()
+	h.Write([]byte(flag + ":" + strconv.Itoa(userID)))
+	return int(h.Sum32() % 100)
+}
+
+// userEntry is one user's cached overrides.
+type userEntry struct {
+	overrides map[string]bool
+	at        time.Time
+}
+
+// Checker evaluates flags for users. It is safe for concurrent use.
+type Checker struct {
+	store    *store.PostgresStore
+	clock    clock.Clock
+	defaults atomic.Pointer[map[string]bool]
+
+	mu         sync.Mutex
+	rollouts   map[string]int // Flag -> percent
+	rolloutsAt time.Time      // Zero when not loaded
+	users      map[int]userEntry
+}
+
+// New creates a checker with the defaults from ParseDefaults.
+func New(store *store.PostgresStore, defaults map[string]bool) *Checker {
+	c := &Checker{
+		store: store,
+		clock: clock.Real,
+		users: make(map[int]userEntry),
+	}
+	c.SetDefaults(defaults)
+	return c
+}
+
+// SetDefaults replaces the defaults from ParseDefaults. Overrides and
+// rollouts still take precedence.
+func (c *Checker) SetDefaults(defaults map[string]bool) {
+	c.defaults.Store(&defaults)
+}
+
+// SetClock replaces the checker's clock. Intended for tests.
+func (c *Checker) SetClock(clk clock.Clock) {
+	c.clock = clk
+}
+
+// Enabled reports whether flag is on for userID. If the database can't be
+// read, the last values read, or failing that the default, are used.
+func (c *Checker) Enabled(ctx context.Context, flag string, userID int) bool {
+	rollouts := c.loadRollouts(ctx)
+	overrides := c.loadUser(ctx, userID)
+	return c.evaluate(flag, userID, rollouts, overrides)
+}
+
+// ForUser returns every flag's value for userID.
+func (c *Checker) ForUser(ctx context.Context, userID int) map[string]bool {
+	rollouts := c.loadRollouts(ctx)
+	overrides := c.loadUser(ctx, userID)
+	defaults := *c.defaults.Load()
+	out := make(map[string]bool, len(defaults))
+	for name := range defaults {
+		out[name] = c.evaluate(name, userID, rollouts, overrides)
+	}
+	return out
+}
+
+// Defaults returns every flag's default, for clients that aren't logged in.
+func (c *Checker) Defaults() map[string]bool {
+	defaults := *c.defaults.Load()
+	out := make(map[string]bool, len(defaults))
+	for name, on := range defaults {
+		out[name] = on
+	}
+	return out
+}
+
+// evaluate applies override > rollout > default.
+func (c *Checker) evaluate(flag string, userID int, rollouts map[string]int, overrides map[string]bool) bool {
+	if on, ok := overrides[flag]; ok {
+		return on
+	}
+	if percent, ok := rollouts[flag]; ok {
+		return Bucket(flag, userID) < percent
+	}
+	return (*c.defaults.Load())[flag]
+}
+
+// SetOverride forces flag on or off for userID, or removes the override
+// with nil.
+func (c *Checker) SetOverride(ctx context.Context, userID int, flag string, enabled *bool) error {
+	if !IsKnown(flag) {
+		return fmt.Errorf("unknown flag %q", flag)
+	}
+	if err := c.store.SetFlagOverride(ctx, userID, flag, enabled); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	delete(c.users, userID)
+	c.mu.Unlock()
+	return nil
+}
+
+// SetRollout turns flag on for percent of users (0-100), or removes the
+// rollout with nil so the default applies again.
+func (c *Checker) SetRollout(ctx context.Context, flag string, percent *int) error {
+	if !IsKnown(flag) {
+		return fmt.Errorf("unknown flag %q", flag)
+	}
+	if percent != nil && (*percent < 0 || *percent > 100) {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	if err := c.store.SetFlagRollout(ctx, flag, percent); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.rolloutsAt = time.Time{}
+	c.mu.Unlock()
+	return nil
+}
+
+// Rollouts returns the current rollout percentages.
+func (c *Checker) Rollouts(ctx context.Context) map[string]int {
+	rollouts := c.loadRollouts(ctx)
+	out := make(map[string]int, len(rollouts))
+	for name, percent := range rollouts {
+		out[name] = percent
+	}
+	return out
+}
+
+func (c *Checker) loadRollouts(ctx context.Context) map[string]int {
+	now := c.clock.Now()
+	c.mu.Lock()
+	if !c.rolloutsAt.IsZero() && now.Sub(c.rolloutsAt) < cacheTTL {
+		rollouts := c.rollouts
+		c.mu.Unlock()
+		return rollouts
+	}
+	c.mu.Unlock()
+
+	rollouts, err := c.store.GetFlagRollouts(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		log.Printf("FEATUREFLAGS: could not load rollouts: %v", err)
+		return c.rollouts
+	}
+	c.rollouts = rollouts
+	c.rolloutsAt = now
+	return rollouts
+}
+
+func (c *Checker) loadUser(ctx context.Context, userID int) map[string]bool {
+	now := c.clock.Now()
+	c.mu.Lock()
+	entry, ok := c.users[userID]
+	c.mu.Unlock()
+	if ok && now.Sub(entry.at) < cacheTTL {
+		return entry.overrides
+	}
+
+	overrides, err := c.store.GetUserFlagOverrides(ctx, userID)
+	if err != nil {
+		log.Printf("FEATUREFLAGS: could not load overrides of user %d: %v", userID, err)
+		return entry.overrides
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Drop expired entries so the map doesn't grow with every user ever seen
+	for id, e := range c.users {
+		if now.Sub(e.at) >= cacheTTL {
+			delete(c.users, id)
+		}
+	}
+	c.users[userID] = userEntry{overrides: overrides, at: now}
+	return overrides
+}
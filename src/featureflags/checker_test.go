@@ -0,0 +1,161 @@
+// src/featureflags/checker_test.go
+package featureflags
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cryptachat-server/store"
+	"cryptachat-server/testutil"
+)
+
+func TestParseDefaults(t *testing.T) {
+	got, err := ParseDefaults("")
+	if err != nil || !got[Sync] || !got[SealedSender] {
+		t.Errorf("no FEATURE_FLAGS: %v, %v; want the built-in defaults", got, err)
+	}
+	got, err = ParseDefaults(" sync=false , sealed_sender=1")
+	if err != nil || got[Sync] || !got[SealedSender] {
+		t.Errorf("sync off: %v, %v", got, err)
+	}
+	for _, bad := range []string{"sync", "sync=maybe", "teleport=true", "sync=false,"} {
+		if _, err := ParseDefaults(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+// TestBucketIsStableAndSpread checks a user's bucket doesn't change, that
+// a percentage takes about that share of users, and that each flag picks
+// different ones.
+func TestBucketIsStableAndSpread(t *testing.T) {
+	const users = 10000
+	in, both := 0, 0
+	for id := 1; id <= users; id++ {
+		b := Bucket(Sync, id)
+		if b < 0 || b > 99 || Bucket(Sync, id) != b {
+			t.Fatalf("user %d: bucket %d, then %d", id, b, Bucket(Sync, id))
+		}
+		if b < 30 {
+			in++
+			if Bucket(SealedSender, id) < 30 {
+				both++
+			}
+		}
+	}
+	if in < users*27/100 || in > users*33/100 {
+		t.Errorf("%d of %d users in a 30%% rollout", in, users)
+	}
+	if both > in/2 {
+		t.Errorf("%d of the %d users in one 30%% rollout are in the other's", both, in)
+	}
+}
+
+// TestPrecedence checks an override beats a rollout, which beats the
+// default.
+func TestPrecedence(t *testing.T) {
+	c := New(nil, map[string]bool{Sync: false, SealedSender: true})
+	var inside, outside int
+	for id := 1; inside == 0 || outside == 0; id++ {
+		if Bucket(Sync, id) < 50 {
+			inside = id
+		} else {
+			outside = id
+		}
+	}
+	half := map[string]int{Sync: 50}
+	tests := []struct {
+		name      string
+		userID    int
+		rollouts  map[string]int
+		overrides map[string]bool
+		want      bool
+	}{
+		{"default", inside, nil, nil, false},
+		{"inside the rollout", inside, half, nil, true},
+		{"outside the rollout", outside, half, nil, false},
+		{"a 0% rollout beats the default", inside, map[string]int{Sync: 0}, nil, false},
+		{"override on, outside the rollout", outside, half, map[string]bool{Sync: true}, true},
+		{"override off, inside the rollout", inside, half, map[string]bool{Sync: false}, false},
+		{"another flag's override", inside, nil, map[string]bool{SealedSender: true}, false},
+	}
+	for _, tt := range tests {
+		if got := c.evaluate(Sync, tt.userID, tt.rollouts, tt.overrides); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestChangesInvalidateTheCache flips a flag through one replica's checker
+// and checks it applies there at once and on another replica once the
+// cache expires.
+func TestChangesInvalidateTheCache(t *testing.T) {
+	st, err := store.NewPostgresStore(testutil.DatabaseURL(t), "../store/schema.sql")
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(st.Close)
+	ctx := context.Background()
+	if err := st.RegisterUser(ctx, "alice", "hash", nil); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := st.GetUserIDByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clk := testutil.NewFakeClock(time.Now())
+	defaults, _ := ParseDefaults("")
+	here, there := New(st, defaults), New(st, defaults)
+	here.SetClock(clk)
+	there.SetClock(clk)
+	both := func(what string, want bool) {
+		t.Helper()
+		if got := here.Enabled(ctx, Sync, alice); got != want {
+			t.Errorf("%s, here: %v, want %v", what, got, want)
+		}
+		if got := there.Enabled(ctx, Sync, alice); got != want {
+			t.Errorf("%s, there: %v, want %v", what, got, want)
+		}
+	}
+	both("by default", true)
+
+	off := false
+	if err := here.SetOverride(ctx, alice, Sync, &off); err != nil {
+		t.Fatal(err)
+	}
+	if here.Enabled(ctx, Sync, alice) {
+		t.Error("the override didn't apply at once where it was made")
+	}
+	if !there.Enabled(ctx, Sync, alice) {
+		t.Error("another replica didn't serve its cache")
+	}
+	clk.Advance(cacheTTL)
+	both("after the override expires from the cache", false)
+
+	if err := here.SetOverride(ctx, alice, Sync, nil); err != nil {
+		t.Fatal(err)
+	}
+	zero := 0
+	if err := here.SetRollout(ctx, Sync, &zero); err != nil {
+		t.Fatal(err)
+	}
+	if here.Enabled(ctx, Sync, alice) {
+		t.Error("the 0% rollout didn't apply at once where it was made")
+	}
+	clk.Advance(cacheTTL)
+	both("after the rollout expires from the cache", false)
+	if got := there.Rollouts(ctx); got[Sync] != 0 || len(got) != 1 {
+		t.Errorf("rollouts %v", got)
+	}
+
+	for _, bad := range []int{-1, 101} {
+		if err := here.SetRollout(ctx, Sync, &bad); err == nil {
+			t.Errorf("a %d%% rollout was accepted", bad)
+		}
+	}
+	if err := here.SetOverride(ctx, alice, "teleport", &off); err == nil {
+		t.Error("an unknown flag was accepted")
+	}
+}
@@ -0,0 +1,18 @@
+// src/federation/address.go
+
+// Package federation relays chat requests, acceptances and messages to
+// statically configured peer instances, and authenticates peers relaying
+// to this one. Users on a peer are addressed as user@peer.
+package federation
+
+import "strings"
+
+// SplitAddress splits "user@peer" into its parts, with the peer in lower
+// case. ok is false for a plain local username.
+func SplitAddress(addr string) (username, peer string, ok bool) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return addr, "", false
+	}
+	return addr[:i], strings.ToLower(addr[i+1:]), true
+}
@@ -0,0 +1,243 @@
+// src/federation/client.go
+package federation
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"cryptachat-server/config"
+)
+
+// HeaderPeer names the sending instance on server-to-server requests. The
+// request must also carry that peer's shared secret as a bearer token, or
+// come with a client certificate for its name.
+const HeaderPeer = "X-Cryptachat-Peer"
+
+// maxErrorBody is how much of a peer's error response is kept.
+const maxErrorBody = 4 << 10
+
+// Envelope is a relay as sent to POST /federation/inbox. From and To are
+// plain usernames, on the sending and the receiving instance; an address
+// with a host in either is refused, so nothing is relayed onward.
+type Envelope struct {
+	ID   int64  `json:"id"`   // The sender's relay ID; repeats of a message are dropped
+	Kind string `json:"kind"` // A store.Relay* kind
+	From string `json:"from"`
+	To   string `json:"to"`
+	Blob string `json:"blob,omitempty"` // The recipient's copy, for messages
+}
+
+// ErrUnknownUser is returned by FetchKey when the peer has no such user
+// or the user has no key.
+var ErrUnknownUser = errors.New("no such user on the peer, or no public key")
+
+// RefusedError is a peer rejecting a relay in a way retrying won't fix.
+type RefusedError struct {
+	Status  int
+	Message string
+}
+
+func (e *RefusedError) Error() string {
+	return fmt.Sprintf("peer refused with %d: %s", e.Status, e.Message)
+}
+
+// Client sends requests to the configured peers.
+type Client struct {
+	self  string // Our FEDERATION_NAME, sent in HeaderPeer
+	peers map[string]config.FederationPeer
+	names []string // Sorted keys of peers
+	http  *http.Client
+}
+
+// NewClient creates a client for cfg's peers. It presents
+// FEDERATION_TLS_CERT_FILE when set, and trusts FEDERATION_CA_FILE besides
+// the system roots.
+func NewClient(cfg *config.Config) (*Client, error) {
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.FederationCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.FederationCertFile, cfg.FederationKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load federation client certificate: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.FederationCAFile != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if err := appendCAFile(roots, cfg.FederationCAFile); err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = roots
+	}
+
+	// Peers are dialed under the egress policy, so one on a private
+	// address must be in EGRESS_ALLOW_CIDRS
+	client := cfg.Egress.Client(tlsCfg)
+	// A peer's API doesn't redirect; following one could leak the secret
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	return &Client{
+		self:  cfg.FederationName,
+		peers: cfg.FederationPeers,
+		names: cfg.FederationPeerNames(),
+		http:  client,
+	}, nil
+}
+
+// ServerTLSConfig returns the listener TLS settings that let peers
+// authenticate with client certificates signed by FEDERATION_CA_FILE, or
+// nil if none is configured. Certificates are requested but not required,
+// so ordinary clients are unaffected.
+func ServerTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	if !cfg.FederationEnabled() || cfg.FederationCAFile == "" {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if err := appendCAFile(pool, cfg.FederationCAFile); err != nil {
+		return nil, err
+	}
+	return &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}, nil
+}
+
+func appendCAFile(pool *x509.CertPool, path string) error {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read FEDERATION_CA_FILE: %v", err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("FEDERATION_CA_FILE contains no PEM certificates")
+	}
+	return nil
+}
+
+// AuthenticatePeer returns the configured peer that sent r: the one named
+// in HeaderPeer, if r carries its shared secret or, for peers without one,
+// a verified client certificate for its name.
+func AuthenticatePeer(cfg *config.Config, r *http.Request) (config.FederationPeer, bool) {
+	peer, ok := cfg.FederationPeers[strings.ToLower(r.Header.Get(HeaderPeer))]
+	if !ok {
+		return config.FederationPeer{}, false
+	}
+	if peer.Secret != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return peer, ok && subtle.ConstantTimeCompare([]byte(token), []byte(peer.Secret)) == 1
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return peer, false
+	}
+	return peer, r.TLS.VerifiedChains[0][0].VerifyHostname(hostOnly(peer.Name)) == nil
+}
+
+// hostOnly strips a port from a peer name for certificate checks.
+func hostOnly(name string) string {
+	if i := strings.LastIndexByte(name, ':'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// Peers returns the configured peer names, sorted.
+func (c *Client) Peers() []string {
+	return c.names
+}
+
+// Known reports whether peer is configured.
+func (c *Client) Known(peer string) bool {
+	_, ok := c.peers[peer]
+	return ok
+}
+
+// Deliver sends a relay to peer. A *RefusedError means the peer rejected
+// it for good; any other error is worth retrying later.
+func (c *Client) Deliver(ctx context.Context, peer string, env Envelope) error {
+	body, err := json.Marshal(env)
+	if err != nil {
+		return &RefusedError{Message: fmt.Sprintf("could not encode relay: %v", err)}
+	}
+	resp, err := c.do(ctx, peer, http.MethodPost, "/federation/inbox", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg := errorMessage(resp)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		// Most likely a secret or certificate being rotated; keep the relays
+		return fmt.Errorf("peer rejected our credentials: %s", msg)
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return fmt.Errorf("peer answered %d: %s", resp.StatusCode, msg)
+	}
+	return &RefusedError{Status: resp.StatusCode, Message: msg}
+}
+
+// FetchKey returns the public key of username on peer.
+func (c *Client) FetchKey(ctx context.Context, peer, username string) (string, error) {
+	resp, err := c.do(ctx, peer, http.MethodGet, "/federation/key?username="+url.QueryEscape(username), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrUnknownUser
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("peer answered %d: %s", resp.StatusCode, errorMessage(resp))
+	}
+	var body struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil || body.PublicKey == "" {
+		return "", fmt.Errorf("peer sent an unreadable key response")
+	}
+	return body.PublicKey, nil
+}
+
+// do sends an authenticated request to peer.
+func (c *Client) do(ctx context.Context, peerName, method, path string, body []byte) (*http.Response, error) {
+	peer, ok := c.peers[peerName]
+	if !ok {
+		return nil, &RefusedError{Message: fmt.Sprintf("%q is not a configured peer", peerName)}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, peer.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(HeaderPeer, c.self)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if peer.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+peer.Secret)
+	}
+	return c.http.Do(req)
+}
+
+// errorMessage extracts the message of a peer's error response.
+func errorMessage(resp *http.Response) string {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil && body.Error.Message != "" {
+		return body.Error.Message
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,301 @@
+// src/federation/client_test.go
+package federation
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptachat-server/config"
+	"cryptachat-server/egress"
+)
+
+const (
+	testPeer   = "peer.example"
+	testSecret = "peer-secret-0123456789abcdef0123456789"
+)
+
+// newPeer starts a TLS server standing in for testPeer's API, and returns
+// a config that relays to it with testSecret and trusts its certificate.
+func newPeer(t *testing.T, handler http.Handler) *config.Config {
+	t.Helper()
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(ca, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &config.Config{
+		FederationName: "here.example",
+		FederationPeers: map[string]config.FederationPeer{
+			testPeer: {Name: testPeer, URL: srv.URL + "/api/v1", Secret: testSecret},
+		},
+		FederationCAFile: ca,
+		Egress: egress.Policy{
+			Allow:   []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")},
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+func newTestClient(t *testing.T, cfg *config.Config) *Client {
+	t.Helper()
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSplitAddress(t *testing.T) {
+	tests := []struct {
+		addr, user, peer string
+		remote           bool
+	}{
+		{"alice", "alice", "", false},
+		{"alice@Chat.Example.ORG", "alice", "chat.example.org", true},
+		{"alice@chat.example.org:8443", "alice", "chat.example.org:8443", true},
+		{"a@b@peer.example", "a@b", "peer.example", true},
+		{"@peer.example", "", "peer.example", true},
+	}
+	for _, tt := range tests {
+		user, peer, remote := SplitAddress(tt.addr)
+		if user != tt.user || peer != tt.peer || remote != tt.remote {
+			t.Errorf("%s: %q %q %v, want %q %q %v", tt.addr, user, peer, remote, tt.user, tt.peer, tt.remote)
+		}
+	}
+}
+
+// TestDeliver relays to a peer answering with each kind of status, and
+// checks which refusals are final and which are kept for a retry.
+func TestDeliver(t *testing.T) {
+	var got []Envelope
+	redirectFollowed := false
+	cfg := newPeer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/elsewhere" {
+			redirectFollowed = true
+			return
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/federation/inbox" ||
+			r.Header.Get(HeaderPeer) != "here.example" || r.Header.Get("Authorization") != "Bearer "+testSecret ||
+			r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request %s %s with headers %v", r.Method, r.URL.Path, r.Header)
+		}
+		var env Envelope
+		if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
+			t.Errorf("decoding the envelope: %v", err)
+		}
+		got = append(got, env)
+		switch env.To {
+		case "ok":
+			w.WriteHeader(http.StatusAccepted)
+		case "unknown":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"message":"No such user."}}`))
+		case "plain":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte("  not json\n"))
+		case "redirect":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		default:
+			status := map[string]int{"busy": 503, "slow": 429, "timeout": 408, "rotating": 401}[env.To]
+			w.WriteHeader(status)
+		}
+	}))
+	c := newTestClient(t, cfg)
+	ctx := context.Background()
+
+	env := Envelope{ID: 7, Kind: "message", From: "alice", To: "ok", Blob: "b64"}
+	if err := c.Deliver(ctx, testPeer, env); err != nil {
+		t.Fatalf("delivering: %v", err)
+	}
+	if len(got) != 1 || got[0] != env {
+		t.Errorf("the peer received %+v, want %+v", got, env)
+	}
+
+	refusals := map[string]string{"unknown": "No such user.", "plain": "not json", "redirect": ""}
+	for to, msg := range refusals {
+		err := c.Deliver(ctx, testPeer, Envelope{ID: 8, Kind: "chat_request", From: "alice", To: to})
+		var refused *RefusedError
+		if !errors.As(err, &refused) {
+			t.Errorf("%s: %v, want refused for good", to, err)
+			continue
+		}
+		if msg != "" && refused.Message != msg {
+			t.Errorf("%s: message %q, want %q", to, refused.Message, msg)
+		}
+	}
+	if redirectFollowed {
+		t.Error("a redirect was followed")
+	}
+
+	for _, to := range []string{"busy", "slow", "timeout", "rotating"} {
+		err := c.Deliver(ctx, testPeer, Envelope{ID: 9, Kind: "chat_request", From: "alice", To: to})
+		var refused *RefusedError
+		if err == nil || errors.As(err, &refused) {
+			t.Errorf("%s: %v, want an error worth retrying", to, err)
+		}
+	}
+
+	var refused *RefusedError
+	if err := c.Deliver(ctx, "stranger.example", env); !errors.As(err, &refused) {
+		t.Errorf("an unknown peer: %v, want refused", err)
+	}
+}
+
+// TestEgressAppliesToPeers checks a peer on a loopback address can't be
+// reached unless the egress policy allows it.
+func TestEgressAppliesToPeers(t *testing.T) {
+	reached := false
+	cfg := newPeer(t, http.HandlerFunc(func(http.ResponseWriter, *http.Request) { reached = true }))
+	cfg.Egress.Allow = nil
+	err := newTestClient(t, cfg).Deliver(context.Background(), testPeer, Envelope{ID: 1, Kind: "chat_request", From: "a", To: "b"})
+	var blocked *egress.BlockedError
+	if !errors.As(err, &blocked) || reached {
+		t.Errorf("%v (reached %v), want blocked", err, reached)
+	}
+}
+
+func TestFetchKey(t *testing.T) {
+	cfg := newPeer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/api/v1/federation/key" || r.Header.Get("Authorization") != "Bearer "+testSecret {
+			t.Errorf("request %s %s", r.Method, r.URL)
+		}
+		switch r.URL.Query().Get("username") {
+		case "bob & co":
+			w.Write([]byte(`{"public_key":"bob-key"}`))
+		case "nokey":
+			w.WriteHeader(http.StatusNotFound)
+		case "empty":
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	c := newTestClient(t, cfg)
+	ctx := context.Background()
+
+	if key, err := c.FetchKey(ctx, testPeer, "bob & co"); err != nil || key != "bob-key" {
+		t.Errorf("fetching: %q %v", key, err)
+	}
+	if _, err := c.FetchKey(ctx, testPeer, "nokey"); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("no key: %v", err)
+	}
+	for _, name := range []string{"empty", "broken"} {
+		if _, err := c.FetchKey(ctx, testPeer, name); err == nil || errors.Is(err, ErrUnknownUser) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+// peerCert returns a certificate for dnsName, as a verified chain would
+// hold it.
+func peerCert(t *testing.T, dnsName string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestAuthenticatePeer(t *testing.T) {
+	cfg := &config.Config{FederationPeers: map[string]config.FederationPeer{
+		testPeer:            {Name: testPeer, Secret: testSecret},
+		"mtls.example:8443": {Name: "mtls.example:8443"},
+	}}
+	request := func(peer, auth string, chain *x509.Certificate) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/federation/inbox", nil)
+		r.Header.Set(HeaderPeer, peer)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		if chain != nil {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{chain}}}
+		}
+		return r
+	}
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		want bool
+	}{
+		{"the secret", request(testPeer, "Bearer "+testSecret, nil), true},
+		{"the secret, peer in capitals", request("PEER.Example", "Bearer "+testSecret, nil), true},
+		{"a wrong secret", request(testPeer, "Bearer "+strings.ToUpper(testSecret), nil), false},
+		{"no secret", request(testPeer, "", nil), false},
+		{"the secret without Bearer", request(testPeer, testSecret, nil), false},
+		{"a certificate instead of the secret", request(testPeer, "", peerCert(t, testPeer)), false},
+		{"an unknown peer", request("stranger.example", "Bearer "+testSecret, nil), false},
+		{"no peer", request("", "Bearer "+testSecret, nil), false},
+		{"a certificate for the peer", request("mtls.example:8443", "", peerCert(t, "mtls.example")), true},
+		{"a certificate for another name", request("mtls.example:8443", "", peerCert(t, "other.example")), false},
+		{"no certificate", request("mtls.example:8443", "Bearer "+testSecret, nil), false},
+	}
+	for _, tt := range tests {
+		if _, ok := AuthenticatePeer(cfg, tt.r); ok != tt.want {
+			t.Errorf("%s: authenticated %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("nothing here"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewClient(&config.Config{FederationCAFile: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("a missing CA file was accepted")
+	}
+	if _, err := NewClient(&config.Config{FederationCAFile: notPEM}); err == nil {
+		t.Error("a CA file without certificates was accepted")
+	}
+	if _, err := NewClient(&config.Config{FederationCertFile: notPEM, FederationKeyFile: notPEM}); err == nil {
+		t.Error("an unreadable client certificate was accepted")
+	}
+
+	cfg := newPeer(t, http.NotFoundHandler())
+	tlsCfg, err := ServerTLSConfig(cfg)
+	if err != nil || tlsCfg == nil || tlsCfg.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("server TLS config %v, %v", tlsCfg, err)
+	}
+	cfg.FederationCAFile = ""
+	if tlsCfg, err := ServerTLSConfig(cfg); tlsCfg != nil || err != nil {
+		t.Errorf("without a CA: %v, %v", tlsCfg, err)
+	}
+}
@@ -0,0 +1,189 @@
+// src/federation/relayer.go
+package federation
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"cryptachat-server/clock"
+	"cryptachat-server/deliverylog"
+	"cryptachat-server/store"
+)
+
+const (
+	// relayInterval is how often queued relays are looked for.
+	relayInterval = time.Second
+	// relayBatch is the most relays claimed per peer per pass.
+	relayBatch = 100
+	// retryBase and retryMax bound the backoff for an unreachable peer:
+	// retryBase doubled per consecutive failure, at most retryMax.
+	retryBase = 10 * time.Second
+	retryMax  = time.Hour
+	// relayMaxAge is how long a relay is retried before it is given up.
+	relayMaxAge = 7 * 24 * time.Hour
+	// relayRetention is how long finished relays, and the IDs of relays
+	// received, are kept. Longer than relayMaxAge, so a peer's late retry
+	// is still recognized as a repeat.
+	relayRetention = 30 * 24 * time.Hour
+	// maintenanceInterval is how often relays are expired and pruned.
+	maintenanceInterval = time.Hour
+)
+
+// Relayer sends queued relays to peers, store-and-forward: a relay the
+// peer couldn't take is retried with backoff until relayMaxAge, and a
+// peer's relays are sent in the order they were queued.
+type Relayer struct {
+	store    *store.PostgresStore
+	client   *Client
+	recorder *deliverylog.Recorder
+	clock    clock.Clock
+}
+
+// NewRelayer creates a relayer. Several replicas may run one each; a peer's
+// relays are claimed by one at a time.
+func NewRelayer(store *store.PostgresStore, client *Client, recorder *deliverylog.Recorder) *Relayer {
+	return &Relayer{
+		store:    store,
+		client:   client,
+		recorder: recorder,
+		clock:    clock.Real,
+	}
+}
+
+// SetClock replaces the relayer's clock. Must be called before Run. Intended for tests.
+func (r *Relayer) SetClock(c clock.Clock) {
+	r.clock = c
+}
+
+// Run relays until ctx is cancelled.
+func (r *Relayer) Run(ctx context.Context) {
+	poll := r.clock.NewTicker(relayInterval)
+	defer poll.Stop()
+	maintain := r.clock.NewTicker(maintenanceInterval)
+	defer maintain.Stop()
+
+	r.maintain(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C():
+			r.RelayOnce(ctx)
+		case <-maintain.C():
+			r.maintain(ctx)
+		}
+	}
+}
+
+// RelayOnce sends what each peer has queued, stopping at a peer's first
+// failure to be reached.
+func (r *Relayer) RelayOnce(ctx context.Context) {
+	finish := r.store.StartJobRun("federation_relay")
+	var claimErr error
+	for _, peer := range r.client.Peers() {
+		relays, err := r.store.ClaimRelays(ctx, peer, relayBatch)
+		if err != nil {
+			log.Printf("FEDERATION: claim for %s failed: %v", peer, err)
+			claimErr = err
+			continue
+		}
+		for i, relay := range relays {
+			if err := r.send(ctx, relay); err != nil {
+				r.deferRest(ctx, peer, relays[i:], err)
+				break
+			}
+		}
+	}
+	// A peer that can't be reached is the peer's problem, not the job's
+	finish(claimErr)
+}
+
+// send delivers one relay and records the outcome. It returns an error if
+// the peer couldn't be reached and the relay should wait.
+func (r *Relayer) send(ctx context.Context, relay store.Relay) error {
+	env := Envelope{ID: relay.ID, Kind: relay.Kind, From: relay.FromUsername, To: relay.ToUsername}
+	if relay.Kind == store.RelayMessage {
+		msg, err := r.store.GetMessageForUser(ctx, relay.MessageID, relay.ToUserID)
+		if err != nil || msg.Deleted {
+			r.fail(ctx, relay, "message is no longer stored")
+			return nil
+		}
+		env.Blob = msg.EncryptedBlob
+	}
+
+	err := r.client.Deliver(ctx, relay.Peer, env)
+	var refused *RefusedError
+	switch {
+	case err == nil:
+		if err := r.store.CompleteRelay(ctx, relay); err != nil {
+			// It was delivered; a resend is dropped by the peer as a repeat
+			log.Printf("FEDERATION: could not record relay %d as delivered: %v", relay.ID, err)
+		}
+		r.record(relay, "relayed", nil)
+		return nil
+	case errors.As(err, &refused):
+		r.fail(ctx, relay, refused.Error())
+		return nil
+	}
+	return err
+}
+
+// fail gives up on a relay the peer refused.
+func (r *Relayer) fail(ctx context.Context, relay store.Relay, detail string) {
+	log.Printf("FEDERATION: %s %d to %s failed: %s", relay.Kind, relay.ID, relay.Peer, detail)
+	if err := r.store.FailRelay(ctx, relay, detail); err != nil {
+		log.Printf("FEDERATION: could not record relay %d as failed: %v", relay.ID, err)
+	}
+	r.record(relay, "failed", map[string]interface{}{"error": detail})
+}
+
+// deferRest puts back the relays that weren't sent and backs the peer off.
+func (r *Relayer) deferRest(ctx context.Context, peer string, rest []store.Relay, cause error) {
+	ids := make([]int64, len(rest))
+	for i, relay := range rest {
+		ids[i] = relay.ID
+	}
+	retryAt, err := r.store.DeferRelays(ctx, peer, ids, cause.Error(), retryBase, retryMax)
+	if err != nil {
+		log.Printf("FEDERATION: could not defer relays to %s: %v", peer, err)
+		return
+	}
+	log.Printf("FEDERATION: %s unreachable (%s); %d relays wait until %s",
+		peer, cause, len(rest), retryAt.Format(time.RFC3339))
+}
+
+// record adds a message relay's outcome to the delivery log.
+func (r *Relayer) record(relay store.Relay, outcome string, details map[string]interface{}) {
+	if relay.Kind != store.RelayMessage {
+		return
+	}
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	details["peer"] = relay.Peer
+	details["relay_id"] = relay.ID
+	r.recorder.Record(store.DeliveryLogEntry{
+		MessageID: relay.MessageID,
+		UserID:    relay.ToUserID,
+		Stage:     store.StageFederation,
+		Outcome:   outcome,
+		Details:   details,
+	})
+}
+
+// maintain gives up on relays that are too old and prunes finished ones.
+func (r *Relayer) maintain(ctx context.Context) {
+	now := r.clock.Now()
+	if n, err := r.store.ExpireRelays(ctx, now.Add(-relayMaxAge)); err != nil {
+		log.Printf("FEDERATION: expiry failed: %v", err)
+	} else if n > 0 {
+		log.Printf("FEDERATION: gave up on %d relays older than %s", n, relayMaxAge)
+	}
+	if n, err := r.store.PruneRelays(ctx, now.Add(-relayRetention)); err != nil {
+		log.Printf("FEDERATION: prune failed: %v", err)
+	} else if n > 0 {
+		log.Printf("FEDERATION: pruned %d finished relays", n)
+	}
+}
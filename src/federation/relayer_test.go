@@ -0,0 +1,169 @@
+// src/federation/relayer_test.go
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"cryptachat-server/deliverylog"
+	"cryptachat-server/store"
+	"cryptachat-server/testutil"
+)
+
+// fakePeer records relays and answers them with status.
+type fakePeer struct {
+	mu       sync.Mutex
+	status   int
+	received []Envelope
+}
+
+func (p *fakePeer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var env Envelope
+	json.NewDecoder(r.Body).Decode(&env)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.received = append(p.received, env)
+	w.WriteHeader(p.status)
+}
+
+func (p *fakePeer) answer(status int) {
+	p.mu.Lock()
+	p.status = status
+	p.mu.Unlock()
+}
+
+// take returns the relays received since the last call.
+func (p *fakePeer) take() []Envelope {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	got := p.received
+	p.received = nil
+	return got
+}
+
+// TestRelayer queues a chat request and a message for a peer that is down,
+// and checks they wait out the backoff, then go in order once it is up.
+// A refused request is withdrawn, and relays left too long expire.
+func TestRelayer(t *testing.T) {
+	st, err := store.NewPostgresStore(testutil.DatabaseURL(t), "../store/schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(st.Close)
+	clk := testutil.NewFakeClock(time.Now().UTC().Truncate(time.Second))
+	st.SetClock(clk)
+	ctx := context.Background()
+
+	peer := &fakePeer{status: http.StatusServiceUnavailable}
+	r := NewRelayer(st, newTestClient(t, newPeer(t, peer)), deliverylog.NewRecorder(st))
+	r.SetClock(clk)
+	status := func() store.PeerStatus {
+		t.Helper()
+		statuses, err := st.GetPeerStatuses(ctx, []string{testPeer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return statuses[0]
+	}
+
+	if err := st.RegisterUser(ctx, "alice", "hash", nil); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := st.GetUserIDByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, bobAddr, err := st.EnsureRemoteUser(ctx, testPeer, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.RequestChat(ctx, alice, bobAddr, ""); err != nil {
+		t.Fatal(err)
+	}
+	// bob's acceptance arrives from the peer, so isn't relayed back
+	if _, err := st.AcceptChat(ctx, bob, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	messageID, _, err := st.SendMessage(ctx, alice, bobAddr, "alice's copy", "bob's copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.RelayOnce(ctx)
+	if got := peer.take(); len(got) != 1 || got[0].Kind != store.RelayChatRequest {
+		t.Fatalf("the first attempt sent %+v", got)
+	}
+	st1 := status()
+	if st1.Pending != 2 || st1.Failures != 1 || st1.RetryAt == nil || !st1.RetryAt.Time.Equal(clk.Now().Add(retryBase)) {
+		t.Errorf("after the peer was down: %+v", st1)
+	}
+
+	// Nothing is tried during the backoff
+	peer.answer(http.StatusOK)
+	clk.Advance(retryBase - time.Second)
+	r.RelayOnce(ctx)
+	if got := peer.take(); len(got) != 0 {
+		t.Errorf("sent %d relays while backing off", len(got))
+	}
+
+	clk.Advance(time.Second)
+	r.RelayOnce(ctx)
+	got := peer.take()
+	if len(got) != 2 || got[0].Kind != store.RelayChatRequest || got[1].Kind != store.RelayMessage ||
+		got[0].From != "alice" || got[0].To != "bob" || got[1].Blob != "bob's copy" || got[0].ID >= got[1].ID {
+		t.Fatalf("once the peer was up: %+v", got)
+	}
+	if st2 := status(); st2.Pending != 0 || st2.Failures != 0 || st2.RetryAt != nil || st2.LastSuccessAt == nil {
+		t.Errorf("after delivering: %+v", st2)
+	}
+
+	// The peer holds bob's copy now, and the conversation's bytes say so
+	if msg, err := st.GetMessageForUser(ctx, messageID, bob); err == nil && !msg.Deleted {
+		t.Errorf("bob's copy is still stored: %+v", msg)
+	}
+	convs, err := st.ListConversationStats(ctx, store.ConversationSortMessages, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(convs) != 1 || convs[0].TotalBlobBytes != int64(len("alice's copy")) {
+		t.Errorf("conversation stats after relaying: %+v", convs)
+	}
+
+	// A refused request is withdrawn, so it can be sent again
+	_, carolAddr, err := st.EnsureRemoteUser(ctx, testPeer, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.RequestChat(ctx, alice, carolAddr, ""); err != nil {
+		t.Fatal(err)
+	}
+	peer.answer(http.StatusNotFound)
+	r.RelayOnce(ctx)
+	if st3 := status(); st3.Pending != 0 || st3.Failed != 1 || st3.Failures != 0 {
+		t.Errorf("after a refusal: %+v", st3)
+	}
+	if _, err := st.RequestChat(ctx, alice, carolAddr, ""); err != nil {
+		t.Errorf("asking again after a refusal: %v", err)
+	}
+
+	// That one waits out an outage until it expires
+	peer.answer(http.StatusBadGateway)
+	r.RelayOnce(ctx)
+	clk.Advance(relayMaxAge + time.Second)
+	r.maintain(ctx)
+	if st4 := status(); st4.Pending != 0 || st4.Failed != 2 {
+		t.Errorf("after expiry: %+v", st4)
+	}
+	if _, err := st.RequestChat(ctx, alice, carolAddr, ""); err != nil {
+		t.Errorf("asking again after expiry: %v", err)
+	}
+
+	runs := st.JobRuns()
+	if len(runs) != 1 || runs[0].Name != "federation_relay" || runs[0].Failures != 0 {
+		t.Errorf("job runs: %+v", runs)
+	}
+}
@@ -6,9 +6,12 @@ require (
 	github.com/golang-jwt/jwt/v5 v5.3.0
 	github.com/jackc/pgx/v5 v5.7.6
 	github.com/joho/godotenv v1.5.1
+	go.uber.org/goleak v1.3.0
 	golang.org/x/crypto v0.37.0
 )
 
+require golang.org/x/sys v0.32.0 // indirect
+
 require (
 	github.com/gorilla/websocket v1.5.3 // direct
 	github.com/jackc/pgpassfile v1.0.0 // indirect
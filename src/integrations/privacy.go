@@ -0,0 +1,205 @@
+// src/integrations/privacy.go
+package integrations
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// PrivacyMode decides how much identifying data outbound integrations
+// (webhooks, push notifications) may carry.
+type PrivacyMode string
+
+const (
+	// ModeIDsOnly sends numeric IDs and timestamps only.
+	ModeIDsOnly PrivacyMode = "ids_only"
+	// ModeIDsAndUsernames additionally allows the usernames of the parties.
+	ModeIDsAndUsernames PrivacyMode = "ids_and_usernames"
+)
+
+// ParsePrivacyMode validates a mode name from config.
+func ParsePrivacyMode(name string) (PrivacyMode, error) {
+	switch m := PrivacyMode(name); m {
+	case ModeIDsOnly, ModeIDsAndUsernames:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown integration privacy mode %q", name)
+}
+
+// Outbound event types.
+const (
+	EventMessageStored       = "message_stored"
+	EventChatRequestCreated  = "chat_request_created"
+	EventChatRequestAccepted = "chat_request_accepted"
+	EventPushPing            = "push_ping"
+)
+
+// allowList is the set of fields an event may carry, per mode.
+type allowList struct {
+	ids       []string // Allowed in every mode
+	usernames []string // Allowed in ModeIDsAndUsernames only
+}
+
+// allowLists is the only place fields are permitted to leave the server.
+// Ciphertext, keys and anything not listed here never do.
+var allowLists = map[string]allowList{
+	EventMessageStored: {
+		ids:       []string{"event", "message_id", "sender_id", "recipient_id", "timestamp"},
+		usernames: []string{"sender_username", "recipient_username"},
+	},
+	EventChatRequestCreated: {
+		ids:       []string{"event", "requester_id", "requested_id", "timestamp"},
+		usernames: []string{"requester_username", "requested_username"},
+	},
+	EventChatRequestAccepted: {
+		ids:       []string{"event", "requester_id", "requested_id", "timestamp"},
+		usernames: []string{"requester_username", "requested_username"},
+	},
+	// Content-free ping; the badge counts are aggregates and absent if the
+	// user turned them off
+	EventPushPing: {
+		ids: []string{"event", "recipient_id", "timestamp", "badge_unread", "badge_pending_requests"},
+	},
+}
+
+// Filter is the privacy stage every outbound integration payload passes
+// through. It strips fields outside the allow-list and counts them.
+type Filter struct {
+	mode PrivacyMode
+
+	mu       sync.Mutex
+	stripped map[string]map[string]int64 // event -> field -> count
+}
+
+// NewFilter creates a filter for mode.
+func NewFilter(mode PrivacyMode) *Filter {
+	return &Filter{mode: mode, stripped: make(map[string]map[string]int64)}
+}
+
+// Mode returns the filter's privacy mode.
+func (f *Filter) Mode() PrivacyMode {
+	return f.mode
+}
+
+// Apply returns the allow-listed subset of fields for event, plus the sorted
+// names of the fields it removed. Removed fields are counted as violations.
+// Unknown events are an error: nothing is sent for them.
+func (f *Filter) Apply(event string, fields map[string]interface{}) (map[string]interface{}, []string, error) {
+	out, stripped, err := f.apply(event, fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(stripped) > 0 {
+		f.mu.Lock()
+		if f.stripped[event] == nil {
+			f.stripped[event] = make(map[string]int64)
+		}
+		for _, name := range stripped {
+			f.stripped[event][name]++
+		}
+		f.mu.Unlock()
+	}
+	return out, stripped, nil
+}
+
+// Preview filters a synthetic payload for event without counting violations.
+func (f *Filter) Preview(event string) (in, out map[string]interface{}, stripped []string, err error) {
+	in = syntheticEvent(event)
+	out, stripped, err = f.apply(event, in)
+	return in, out, stripped, err
+}
+
+func (f *Filter) apply(event string, fields map[string]interface{}) (map[string]interface{}, []string, error) {
+	list, ok := allowLists[event]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown integration event %q", event)
+	}
+
+	allowed := make(map[string]bool, len(list.ids)+len(list.usernames))
+	for _, name := range list.ids {
+		allowed[name] = true
+	}
+	if f.mode == ModeIDsAndUsernames {
+		for _, name := range list.usernames {
+			allowed[name] = true
+		}
+	}
+
+	out := make(map[string]interface{}, len(fields))
+	var stripped []string
+	for name, v := range fields {
+		if allowed[name] {
+			out[name] = v
+		} else {
+			stripped = append(stripped, name)
+		}
+	}
+	sort.Strings(stripped)
+	return out, stripped, nil
+}
+
+// Stats reports the mode and how often each field has been stripped.
+func (f *Filter) Stats() map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stripped := make(map[string]map[string]int64, len(f.stripped))
+	for event, fields := range f.stripped {
+		stripped[event] = make(map[string]int64, len(fields))
+		for name, n := range fields {
+			stripped[event][name] = n
+		}
+	}
+	return map[string]interface{}{"mode": f.mode, "stripped": stripped}
+}
+
+// Events returns the known event types, sorted.
+func Events() []string {
+	events := make([]string, 0, len(allowLists))
+	for event := range allowLists {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	return events
+}
+
+// syntheticEvent builds a payload for event containing every field a careless
+// producer might include, so previews show what gets removed.
+func syntheticEvent(event string) map[string]interface{} {
+	const ts = "2024-01-01T00:00:00.000Z"
+	switch event {
+	case EventMessageStored:
+		return map[string]interface{}{
+			"event":              event,
+			"message_id":         1,
+			"sender_id":          2,
+			"recipient_id":       3,
+			"timestamp":          ts,
+			"sender_username":    "alice",
+			"recipient_username": "bob",
+			"ciphertext":         "c2VjcmV0",
+			"sender_public_key":  "cHVibGljLWtleQ==",
+		}
+	case EventChatRequestCreated, EventChatRequestAccepted:
+		return map[string]interface{}{
+			"event":              event,
+			"requester_id":       2,
+			"requested_id":       3,
+			"timestamp":          ts,
+			"requester_username": "alice",
+			"requested_username": "bob",
+			"filter_reason":      "new_account",
+		}
+	case EventPushPing:
+		return map[string]interface{}{
+			"event":                  event,
+			"recipient_id":           3,
+			"timestamp":              ts,
+			"badge_unread":           4,
+			"badge_pending_requests": 1,
+			"recipient_username":     "bob",
+			"sender_id":              2,
+		}
+	}
+	return map[string]interface{}{"event": event}
+}
@@ -0,0 +1,85 @@
+// src/integrations/privacy_test.go
+package integrations
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterApplyStripsByMode(t *testing.T) {
+	tests := []struct {
+		mode     PrivacyMode
+		event    string
+		kept     []string
+		stripped []string
+	}{
+		{
+			mode:     ModeIDsOnly,
+			event:    EventMessageStored,
+			kept:     []string{"event", "message_id", "recipient_id", "sender_id", "timestamp"},
+			stripped: []string{"ciphertext", "recipient_username", "sender_public_key", "sender_username"},
+		},
+		{
+			mode:     ModeIDsAndUsernames,
+			event:    EventMessageStored,
+			kept:     []string{"event", "message_id", "recipient_id", "recipient_username", "sender_id", "sender_username", "timestamp"},
+			stripped: []string{"ciphertext", "sender_public_key"},
+		},
+		{
+			mode:     ModeIDsOnly,
+			event:    EventChatRequestCreated,
+			kept:     []string{"event", "requested_id", "requester_id", "timestamp"},
+			stripped: []string{"filter_reason", "requested_username", "requester_username"},
+		},
+		{
+			mode:     ModeIDsAndUsernames,
+			event:    EventChatRequestAccepted,
+			kept:     []string{"event", "requested_id", "requested_username", "requester_id", "requester_username", "timestamp"},
+			stripped: []string{"filter_reason"},
+		},
+		{
+			// Push pings never carry usernames, whatever the mode
+			mode:     ModeIDsAndUsernames,
+			event:    EventPushPing,
+			kept:     []string{"badge_pending_requests", "badge_unread", "event", "recipient_id", "timestamp"},
+			stripped: []string{"recipient_username", "sender_id"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode)+"/"+tt.event, func(t *testing.T) {
+			f := NewFilter(tt.mode)
+			out, stripped, err := f.Apply(tt.event, syntheticEvent(tt.event))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sortedKeys(out); !reflect.DeepEqual(got, tt.kept) {
+				t.Errorf("kept %v, want %v", got, tt.kept)
+			}
+			if !reflect.DeepEqual(stripped, tt.stripped) {
+				t.Errorf("stripped %v, want %v", stripped, tt.stripped)
+			}
+			counts := f.Stats()["stripped"].(map[string]map[string]int64)[tt.event]
+			for _, name := range tt.stripped {
+				if counts[name] != 1 {
+					t.Errorf("%s counted %d times, want 1", name, counts[name])
+				}
+			}
+		})
+	}
+}
+
+func TestFilterApplyUnknownEvent(t *testing.T) {
+	if _, _, err := NewFilter(ModeIDsOnly).Apply("message_read", map[string]interface{}{"event": "message_read"}); err == nil {
+		t.Fatal("unknown event was let through")
+	}
+}
+
+func TestFilterPreviewDoesNotCount(t *testing.T) {
+	f := NewFilter(ModeIDsOnly)
+	if _, _, _, err := f.Preview(EventMessageStored); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(f.Stats()["stripped"].(map[string]map[string]int64)); n != 0 {
+		t.Errorf("preview counted violations for %d events", n)
+	}
+}
@@ -0,0 +1,132 @@
+// src/integrations/sender.go
+package integrations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"cryptachat-server/egress"
+)
+
+// senderQueueSize bounds the payloads waiting to be posted. Past it new
+// ones are dropped: a slow or dead endpoint must not hold memory or hold
+// up the requests that produce events.
+const senderQueueSize = 1000
+
+// Sender posts event payloads as JSON to one URL. Every payload passes the
+// Filter before it is queued, so nothing outside the allow-lists is ever
+// sent. Payloads are posted one at a time by Run, in the order published;
+// a failed post is logged and counted, not retried.
+type Sender struct {
+	name   string // For logs, e.g. "webhook"
+	url    string
+	secret string // Sent as a bearer token if set
+	filter *Filter
+	client *http.Client
+	queue  chan []byte
+
+	sent    atomic.Int64
+	failed  atomic.Int64
+	dropped atomic.Int64
+}
+
+// SenderStats describes a Sender for /admin/runtime.
+type SenderStats struct {
+	Queued  int   `json:"queued"`
+	Sent    int64 `json:"sent"`
+	Failed  int64 `json:"failed"`  // Refused by the endpoint or not delivered
+	Dropped int64 `json:"dropped"` // Discarded because the queue was full
+}
+
+// NewSender returns a sender posting to url through the egress policy.
+// name labels its log lines.
+func NewSender(name, url, secret string, filter *Filter, policy egress.Policy) *Sender {
+	return &Sender{
+		name:   name,
+		url:    url,
+		secret: secret,
+		filter: filter,
+		client: policy.Client(nil),
+		queue:  make(chan []byte, senderQueueSize),
+	}
+}
+
+// Publish filters fields for event and queues the result. It never
+// blocks.
+func (s *Sender) Publish(event string, fields map[string]interface{}) {
+	out, _, err := s.filter.Apply(event, fields)
+	if err != nil {
+		log.Printf("INTEGRATIONS: %s: %v", s.name, err)
+		return
+	}
+	body, err := json.Marshal(out)
+	if err != nil {
+		log.Printf("INTEGRATIONS: %s: encoding %s: %v", s.name, event, err)
+		return
+	}
+	select {
+	case s.queue <- body:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Run posts queued payloads until ctx is done.
+func (s *Sender) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case body := <-s.queue:
+			if err := s.post(ctx, body); err != nil {
+				s.failed.Add(1)
+				log.Printf("INTEGRATIONS: %s: %v", s.name, err)
+				continue
+			}
+			s.sent.Add(1)
+		}
+	}
+}
+
+// post sends one payload. Any 2xx status is success.
+func (s *Sender) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+s.secret)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Filter returns the privacy filter payloads pass.
+func (s *Sender) Filter() *Filter {
+	return s.filter
+}
+
+// Stats returns the sender's counters.
+func (s *Sender) Stats() SenderStats {
+	return SenderStats{
+		Queued:  len(s.queue),
+		Sent:    s.sent.Load(),
+		Failed:  s.failed.Load(),
+		Dropped: s.dropped.Load(),
+	}
+}
@@ -0,0 +1,115 @@
+// src/integrations/sender_test.go
+package integrations
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"cryptachat-server/egress"
+)
+
+// loopbackPolicy lets a sender reach an httptest server.
+var loopbackPolicy = egress.Policy{
+	Allow:   []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")},
+	Timeout: 5 * time.Second,
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestSenderPostsFilteredPayload(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+		received <- body
+	}))
+	defer srv.Close()
+
+	s := NewSender("webhook", srv.URL, "s3cret", NewFilter(ModeIDsOnly), loopbackPolicy)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	s.Publish(EventMessageStored, syntheticEvent(EventMessageStored))
+	select {
+	case body := <-received:
+		want := []string{"event", "message_id", "recipient_id", "sender_id", "timestamp"}
+		if got := sortedKeys(body); !reflect.DeepEqual(got, want) {
+			t.Errorf("posted fields %v, want %v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing posted")
+	}
+	if auth != "Bearer s3cret" {
+		t.Errorf("Authorization = %q", auth)
+	}
+	waitFor(t, func() bool { return s.Stats().Sent == 1 })
+}
+
+func TestSenderCountsFailuresAndDrops(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	s := NewSender("webhook", srv.URL, "", NewFilter(ModeIDsOnly), loopbackPolicy)
+	// Not running yet, so the queue fills up
+	for i := 0; i < senderQueueSize+5; i++ {
+		s.Publish(EventPushPing, map[string]interface{}{"event": EventPushPing})
+	}
+	if st := s.Stats(); st.Queued != senderQueueSize || st.Dropped != 5 {
+		t.Fatalf("stats %+v, want %d queued and 5 dropped", st, senderQueueSize)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	waitFor(t, func() bool { return s.Stats().Failed == senderQueueSize })
+	if st := s.Stats(); st.Sent != 0 {
+		t.Errorf("stats %+v, want nothing sent", st)
+	}
+}
+
+func TestSenderRespectsEgressPolicy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached a loopback endpoint the policy blocks")
+	}))
+	defer srv.Close()
+
+	s := NewSender("webhook", srv.URL, "", NewFilter(ModeIDsOnly), egress.Policy{Timeout: 5 * time.Second})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	s.Publish(EventPushPing, map[string]interface{}{"event": EventPushPing})
+	waitFor(t, func() bool { return s.Stats().Failed == 1 })
+}
+
+// waitFor polls cond for up to five seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not reached")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
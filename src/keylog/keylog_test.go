@@ -0,0 +1,250 @@
+// src/keylog/keylog_test.go
+package keylog
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildChain returns a valid log of n key changes spread over three users.
+func buildChain(n int) []Entry {
+	users := []string{"alice", "bob", "carol"}
+	versions := make(map[string]int)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	var entries []Entry
+	prev := Genesis
+	for i := 0; i < n; i++ {
+		user := users[i%len(users)]
+		versions[user]++
+		e := Entry{
+			Seq:       int64(i + 1),
+			Username:  user,
+			Version:   versions[user],
+			KeyHash:   KeyHash(user + "-key-" + string(rune('a'+versions[user]))),
+			CreatedAt: Truncate(start.Add(time.Duration(i) * time.Minute)),
+			PrevHash:  prev,
+		}
+		e.EntryHash = e.ComputeHash()
+		prev = e.EntryHash
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// flipHexByte changes the character at i of a hex string to a different
+// hex digit.
+func flipHexByte(s string, i int) string {
+	b := []byte(s)
+	if b[i] == '0' {
+		b[i] = '1'
+	} else {
+		b[i] = '0'
+	}
+	return string(b)
+}
+
+func TestVerifyChainDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func([]Entry) []Entry
+		headSeq func(orig []Entry) int64 // Defaults to the untampered head
+		wantErr string
+	}{
+		{
+			name:   "untouched",
+			tamper: func(e []Entry) []Entry { return e },
+		},
+		{
+			name: "flipped byte in key hash",
+			tamper: func(e []Entry) []Entry {
+				e[3].KeyHash = flipHexByte(e[3].KeyHash, 10)
+				return e
+			},
+			wantErr: "entry 4: hash mismatch",
+		},
+		{
+			name: "flipped byte in entry hash",
+			tamper: func(e []Entry) []Entry {
+				e[3].EntryHash = flipHexByte(e[3].EntryHash, 0)
+				return e
+			},
+			wantErr: "entry 4: hash mismatch",
+		},
+		{
+			name: "flipped byte in prev hash",
+			tamper: func(e []Entry) []Entry {
+				e[5].PrevHash = flipHexByte(e[5].PrevHash, 63)
+				return e
+			},
+			wantErr: "entry 6: prev_hash does not match",
+		},
+		{
+			name: "renamed user",
+			tamper: func(e []Entry) []Entry {
+				e[2].Username = "mallory"
+				return e
+			},
+			wantErr: "entry 3: hash mismatch",
+		},
+		{
+			name: "changed version",
+			tamper: func(e []Entry) []Entry {
+				e[2].Version++
+				return e
+			},
+			wantErr: "entry 3: hash mismatch",
+		},
+		{
+			name: "backdated entry",
+			tamper: func(e []Entry) []Entry {
+				e[2].CreatedAt = e[2].CreatedAt.Add(-time.Millisecond)
+				return e
+			},
+			wantErr: "entry 3: hash mismatch",
+		},
+		{
+			name: "rewritten entry with recomputed hash",
+			tamper: func(e []Entry) []Entry {
+				e[4].KeyHash = KeyHash("substituted key")
+				e[4].EntryHash = e[4].ComputeHash()
+				return e
+			},
+			wantErr: "entry 6: prev_hash does not match",
+		},
+		{
+			name: "rewritten tail with recomputed hashes",
+			tamper: func(e []Entry) []Entry {
+				e[4].KeyHash = KeyHash("substituted key")
+				for i := 4; i < len(e); i++ {
+					e[i].PrevHash = e[i-1].EntryHash
+					e[i].EntryHash = e[i].ComputeHash()
+				}
+				return e
+			},
+			wantErr: "head is",
+		},
+		{
+			name: "swapped entries",
+			tamper: func(e []Entry) []Entry {
+				e[2], e[3] = e[3], e[2]
+				return e
+			},
+			wantErr: "entry 4: expected sequence number 3",
+		},
+		{
+			name: "swapped entries with renumbered sequence",
+			tamper: func(e []Entry) []Entry {
+				e[2], e[3] = e[3], e[2]
+				e[2].Seq, e[3].Seq = 3, 4
+				return e
+			},
+			wantErr: "entry 3: prev_hash does not match",
+		},
+		{
+			name:    "truncated at the end",
+			tamper:  func(e []Entry) []Entry { return e[:len(e)-2] },
+			wantErr: "chain ends at 8/",
+		},
+		{
+			name:    "truncated at the start",
+			tamper:  func(e []Entry) []Entry { return e[2:] },
+			wantErr: "entry 3: expected sequence number 1",
+		},
+		{
+			name:    "entry removed from the middle",
+			tamper:  func(e []Entry) []Entry { return append(e[:4:4], e[5:]...) },
+			wantErr: "entry 6: expected sequence number 5",
+		},
+		{
+			name:    "empty log against a head",
+			tamper:  func(e []Entry) []Entry { return nil },
+			wantErr: "chain ends at 0/" + Genesis,
+		},
+		{
+			name:    "truncated log with a matching stale head",
+			tamper:  func(e []Entry) []Entry { return e[:len(e)-2] },
+			headSeq: func(orig []Entry) int64 { return int64(len(orig)) },
+			wantErr: "chain ends at 8/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := buildChain(10)
+			head := orig[len(orig)-1]
+			headSeq := head.Seq
+			if tt.headSeq != nil {
+				headSeq = tt.headSeq(orig)
+			}
+
+			entries := tt.tamper(append([]Entry(nil), orig...))
+			err := VerifyChain(entries, headSeq, head.EntryHash)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("valid chain rejected: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatal("tampered chain accepted")
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Fatalf("error %q, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyEntriesSingleUserHistory(t *testing.T) {
+	chain := buildChain(9)
+	var bob []Entry
+	for _, e := range chain {
+		if e.Username == "bob" {
+			bob = append(bob, e)
+		}
+	}
+	if err := VerifyEntries(bob); err != nil {
+		t.Fatalf("bob's history rejected: %v", err)
+	}
+
+	tampered := append([]Entry(nil), bob...)
+	tampered[1].KeyHash = flipHexByte(tampered[1].KeyHash, 5)
+	if err := VerifyEntries(tampered); err == nil || !strings.Contains(err.Error(), "hash mismatch") {
+		t.Errorf("flipped key hash: %v", err)
+	}
+
+	reordered := []Entry{bob[1], bob[0], bob[2]}
+	if err := VerifyEntries(reordered); err == nil || !strings.Contains(err.Error(), "out of order") {
+		t.Errorf("reordered history: %v", err)
+	}
+
+	// Consecutive entries must link even when they are a slice of the log
+	run := append([]Entry(nil), chain[3:6]...)
+	run[1].PrevHash = flipHexByte(run[1].PrevHash, 1)
+	run[1].EntryHash = run[1].ComputeHash()
+	if err := VerifyEntries(run); err == nil || !strings.Contains(err.Error(), "prev_hash does not match") {
+		t.Errorf("relinked entry: %v", err)
+	}
+}
+
+func TestComputeHashIsUnambiguous(t *testing.T) {
+	// Without length prefixes these would encode the same bytes
+	a := Entry{Seq: 1, Username: "ab", Version: 1, KeyHash: "c", PrevHash: Genesis}
+	b := Entry{Seq: 1, Username: "a", Version: 1, KeyHash: "bc", PrevHash: Genesis}
+	if a.ComputeHash() == b.ComputeHash() {
+		t.Fatal("different entries hash the same")
+	}
+}
+
+func TestHashSurvivesJSONPrecision(t *testing.T) {
+	e := buildChain(1)[0]
+	e.CreatedAt = Truncate(time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.FixedZone("x", 3600)))
+	e.EntryHash = e.ComputeHash()
+
+	parsed, err := time.Parse(timeFormat, e.CreatedAt.Format(timeFormat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTripped := e
+	roundTripped.CreatedAt = parsed
+	if roundTripped.ComputeHash() != e.EntryHash {
+		t.Fatal("hash changed after a round trip through the API's timestamp format")
+	}
+}
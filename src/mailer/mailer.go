@@ -0,0 +1,122 @@
+// src/mailer/mailer.go
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"cryptachat-server/config"
+	"cryptachat-server/egress"
+)
+
+// Mailer sends plain-text email. The service only knows this interface, so
+// tests can pass a fake and deployments an SMTP relay.
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// SMTP sends mail through the relay in config.SMTPConfig, one connection
+// per message. It dials through the egress policy, upgrades to TLS with
+// STARTTLS when the relay offers it, and only authenticates over TLS.
+type SMTP struct {
+	cfg    config.SMTPConfig
+	policy egress.Policy
+}
+
+// NewSMTP returns a mailer for cfg's relay.
+func NewSMTP(cfg *config.Config) *SMTP {
+	return &SMTP{cfg: cfg.SMTP, policy: cfg.Egress}
+}
+
+// Send delivers one message to to. The whole exchange must finish within
+// the egress timeout.
+func (m *SMTP) Send(ctx context.Context, to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("mailer: header contains a line break")
+	}
+	msg, err := m.compose(to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	timeout := m.policy.Timeout
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := m.policy.Dialer().DialContext(ctx, "tcp", m.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(m.cfg.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}); err != nil {
+			return fmt.Errorf("mailer: %w", err)
+		}
+	}
+	if m.cfg.Username != "" {
+		// PlainAuth refuses to send the password without TLS
+		if err := c.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, host)); err != nil {
+			return fmt.Errorf("mailer: %w", err)
+		}
+	}
+	if err := c.Mail(m.cfg.From); err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	if err := c.Rcpt(to); err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	return c.Quit()
+}
+
+// compose builds the message with its headers.
+func (m *SMTP) compose(to, subject, body string) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("mailer: %w", err)
+	}
+	_, domain, _ := strings.Cut(m.cfg.From, "@")
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", m.cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	// SMTP wants CRLF line endings
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes(), nil
+}
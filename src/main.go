@@ -1,17 +1,60 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"cryptachat-server/attachments"
+	"cryptachat-server/blobrekey"
+	"cryptachat-server/chatservice"
 	"cryptachat-server/config"
+	"cryptachat-server/contactimport"
+	"cryptachat-server/deliverylog"
+	"cryptachat-server/featureflags"
+	"cryptachat-server/federation"
+	"cryptachat-server/integrations"
+	"cryptachat-server/mailer"
 	"cryptachat-server/myhttp" // Your http package
+	"cryptachat-server/outbox"
+	"cryptachat-server/retention"
+	"cryptachat-server/smoketest"
 	"cryptachat-server/store"
 	"cryptachat-server/websockets" // <-- Import the new websocket package
 )
 
+const schemaPath = "./store/schema.sql"
+
+// shutdownTimeout bounds draining requests and the final write-behind flush.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
+	smokeURL := flag.String("smoke-test", "", "run the smoke test against the server at this base URL and exit")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "print pending migrations and their SQL without applying them, then exit")
+	migrateDown := flag.Int("migrate-down", -1, "revert migrations newer than this version, then exit")
+	reencryptBlobs := flag.Bool("reencrypt-blobs", false, "encrypt every blob under the current data key (backfill or master key rotation), then exit")
+	decryptBlobs := flag.Bool("decrypt-blobs", false, "decrypt every blob at rest, then exit")
+	backfillOnly := flag.Bool("backfill-only", false, "run pending migration backfills to completion in the foreground, then exit")
+	flag.Parse()
+
+	// --- Smoke test mode ---
+	// Doesn't need a database or config, only a running instance.
+	if *smokeURL != "" {
+		if err := smoketest.Run(context.Background(), *smokeURL, os.Stdout); err != nil {
+			log.Printf("Smoke test against %s failed: %v", *smokeURL, err)
+			os.Exit(1)
+		}
+		log.Printf("Smoke test against %s passed.", *smokeURL)
+		return
+	}
+
 	cfg, err := config.LoadConfig("../.config/docker.env")
 	if err != nil {
 		log.Printf("Warning: could not load .env file. Will rely on environment variables. Error: %v", err)
@@ -21,36 +64,357 @@ func main() {
 		}
 	}
 
+	// --- Runtime settings ---
+	// Read per request, or passed on here when a reload (SIGHUP or POST
+	// /admin/reload) changes them; see config/runtime.go.
+	rc := cfg.Runtime()
+	slog.SetLogLoggerLevel(rc.LogLevel)
+	cfg.OnReload(func(rc *config.RuntimeConfig) { slog.SetLogLoggerLevel(rc.LogLevel) })
+
+	// --- Migration commands ---
+	// Never run automatically; startup only ever migrates up.
+	if *migrateDryRun || *migrateDown >= 0 {
+		if err := runMigrationCommand(cfg.DatabaseURL, schemaPath, *migrateDryRun, *migrateDown); err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+		return
+	}
+
+	// --- Deployment hygiene ---
+	findings := config.CheckDeployment(cfg)
+	for _, f := range findings {
+		slog.Warn("deployment hygiene finding", "check", f.Check, "severity", f.Severity, "detail", f.Detail)
+	}
+	if config.HasFatal(findings) {
+		if !cfg.AllowInsecure {
+			log.Fatalf("FATAL: refusing to start with an insecure configuration (set ALLOW_INSECURE=true to override)")
+		}
+		log.Println("WARNING: starting despite fatal hygiene findings because ALLOW_INSECURE=true")
+	}
+
 	// ... (database connection logic)
-	dbStore, err := store.NewPostgresStore(cfg.DatabaseURL, "./store/schema.sql")
+	dbStore, err := store.NewPostgresStore(cfg.DatabaseURL, schemaPath)
 	if err != nil {
 		log.Fatalf("FATAL: could not connect to database: %v", err)
 	}
 	defer dbStore.Close()
-	log.Println("Database connection established and schema initialized.")
+
+	// --- Schema compatibility ---
+	// A database migrated past this binary (a rolled-back deploy) gets no
+	// schema changes, and unless ALLOW_SCHEMA_AHEAD is set the server runs
+	// read-mostly: writes are refused, and the key log backfill, pruner and
+	// contact import worker don't run. The outbox dispatcher still drains
+	// events queued before the rollback.
+	compatMode := false
+	if ahead := dbStore.SchemaAhead(); ahead != nil {
+		slog.Error("database schema is newer than this binary",
+			"database_version", ahead.DatabaseVersion, "binary_version", ahead.BinaryVersion)
+		if cfg.AllowSchemaAhead {
+			log.Printf("WARNING: %v. Serving writes anyway because ALLOW_SCHEMA_AHEAD=true.", ahead)
+		} else {
+			compatMode = true
+			log.Printf("WARNING: %v. Starting in read-only compatibility mode: writes get 503 schema_ahead "+
+				"(set ALLOW_SCHEMA_AHEAD=true to override).", ahead)
+		}
+	} else {
+		log.Println("Database connection established and schema initialized.")
+	}
+
+	// --- Blob encryption ---
+	// With BLOB_MASTER_KEY set, new blobs are sealed at rest and existing
+	// plaintext ones are sealed by the rekeyer below (or -reencrypt-blobs).
+	if cfg.BlobMasterKey != nil {
+		if err := dbStore.EnableBlobEncryption(context.Background(), cfg.BlobMasterKey, cfg.BlobPreviousMasterKeys); err != nil {
+			log.Fatalf("FATAL: could not enable blob encryption: %v", err)
+		}
+		log.Printf("Blob encryption enabled with data key %s.", dbStore.BlobEncryption().CurrentKeyID)
+	} else if err := dbStore.CheckBlobsReadable(context.Background()); err != nil {
+		log.Fatalf("FATAL: %v (set BLOB_MASTER_KEY, or run -decrypt-blobs with it set first)", err)
+	}
+
+	if *reencryptBlobs || *decryptBlobs {
+		if err := runBlobCommand(dbStore, compatMode, *decryptBlobs); err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+		return
+	}
+
+	// --- Migration backfills ---
+	// Fill in columns added by migrations (see store/backfill.go), in the
+	// background unless -backfill-only
+	backfillOpts := store.BackfillOptions{BatchSize: cfg.BackfillBatchSize, Pause: cfg.BackfillPause}
+	if *backfillOnly {
+		if compatMode {
+			log.Fatalf("FATAL: the database schema is newer than this binary; run -backfill-only with a matching binary")
+		}
+		backfillOpts.Wait = true
+		if err := dbStore.RunBackfills(context.Background(), backfillOpts); err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+		log.Println("Backfills complete.")
+		return
+	}
+	if !compatMode {
+		go func() {
+			if err := dbStore.RunBackfills(context.Background(), backfillOpts); err != nil {
+				log.Printf("BACKFILL: %v (resumes on the next start, or run -backfill-only)", err)
+			}
+		}()
+	}
+
+	// Log keys uploaded before the key transparency log existed
+	if !compatMode {
+		if n, err := dbStore.BackfillKeyLog(context.Background()); err != nil {
+			log.Fatalf("FATAL: could not backfill key log: %v", err)
+		} else if n > 0 {
+			log.Printf("Added %d existing public keys to the key log.", n)
+		}
+	}
 
 	// --- WebSocket Hub ---
 	// 1. Create the new hub
 	hub := websockets.NewHub()
+	hub.SetBackpressure(rc.WSBackpressurePolicy, rc.WSSendBuffer)
+	hub.SetQueueBudgets(rc.WSClientQueueBytes, rc.WSQueueBytes)
+	cfg.OnReload(func(rc *config.RuntimeConfig) {
+		hub.SetBackpressure(rc.WSBackpressurePolicy, rc.WSSendBuffer)
+		hub.SetQueueBudgets(rc.WSClientQueueBytes, rc.WSQueueBytes)
+	})
 	// 2. Run the hub in its own goroutine
 	go hub.Run()
 	log.Println("WebSocket hub initialized and running.")
 	// ---------------------
 
+	// --- Delivery Log ---
+	// Records per-message delivery outcomes for /admin/messages/{id}/trace.
+	recorder := deliverylog.NewRecorder(dbStore)
+	go recorder.Run(context.Background())
+
+	// --- Outbox Dispatcher ---
+	// Performs side effects (WebSocket pushes) queued by writes.
+	dispatcher := outbox.NewDispatcher(dbStore, hub, recorder)
+	go dispatcher.Run(context.Background())
+	log.Println("Outbox dispatcher running.")
+
+	// --- Write-behind ---
+	// Batches last_seen_at and delivery receipt updates; flushed again on
+	// shutdown below.
+	if !compatMode {
+		dbStore.EnableWriteBehind(cfg.WriteBehindInterval, cfg.WriteBehindMaxBatch)
+		go dbStore.RunWriteBehind(context.Background())
+		log.Printf("Write-behind running, flushing every %v.", cfg.WriteBehindInterval)
+	}
+
+	// --- User Cache ---
+	// Serves the auth middleware's user lookups; this process's own
+	// writes invalidate it, other replicas' show up within the TTL.
+	if cfg.UserCacheTTL > 0 {
+		dbStore.EnableUserCache(cfg.UserCacheTTL, cfg.UserCacheMax)
+		log.Printf("User cache on, keeping up to %d users for %v.", cfg.UserCacheMax, cfg.UserCacheTTL)
+	}
+
+	// --- Retention Pruner ---
+	if !compatMode {
+		pruner := retention.NewPruner(dbStore, rc.MessageRetentionDays, rc.AuditRetentionDays)
+		cfg.OnReload(func(rc *config.RuntimeConfig) {
+			pruner.SetRetention(rc.MessageRetentionDays, rc.AuditRetentionDays)
+		})
+		go pruner.Run(context.Background())
+		log.Println("Retention pruner running.")
+	}
+
+	// --- Blob Rekeyer ---
+	// Seals plaintext and old-key blobs under the current data key.
+	if cfg.BlobMasterKey != nil && !compatMode {
+		rekeyer := blobrekey.NewRekeyer(dbStore)
+		go rekeyer.Run(context.Background())
+		log.Println("Blob rekeyer running.")
+	}
+
+	// --- Integration privacy filter ---
+	// Every outbound webhook/push payload passes through this.
+	privacyMode, err := integrations.ParsePrivacyMode(cfg.IntegrationPrivacyMode)
+	if err != nil {
+		log.Fatalf("FATAL: INTEGRATION_PRIVACY_MODE: %v", err)
+	}
+	privacy := integrations.NewFilter(privacyMode)
+
 	// Init http
 	// 3. Pass the hub to the server
-	server := myhttp.NewServer(cfg, dbStore, hub)
+	flags := featureflags.New(dbStore, rc.FeatureFlags)
+	cfg.OnReload(func(rc *config.RuntimeConfig) { flags.SetDefaults(rc.FeatureFlags) })
+	svc := chatservice.New(cfg, dbStore, flags)
+	if err := svc.InitAdminBootstrap(context.Background()); err != nil {
+		log.Fatalf("FATAL: could not check for admin users: %v", err)
+	}
+
+	// --- Recovery email ---
+	// Verification and password reset codes go out through SMTP_ADDR.
+	if cfg.MailEnabled() {
+		svc.EnableEmail(mailer.NewSMTP(cfg))
+		log.Printf("Recovery email enabled, sending through %s.", cfg.SMTP.Addr)
+	}
+
+	// --- Webhooks ---
+	// Message and chat request events go to WEBHOOK_URL, filtered above.
+	if cfg.WebhookURL != "" {
+		webhooks := integrations.NewSender("webhook", cfg.WebhookURL, cfg.WebhookSecret, privacy, cfg.Egress)
+		svc.EnableWebhooks(webhooks)
+		go webhooks.Run(context.Background())
+		log.Println("Webhooks enabled.")
+	}
+
+	// --- Push pings ---
+	// Content-free pings with badge counts go to PUSH_URL, coalesced per user.
+	if cfg.PushURL != "" {
+		pushes := integrations.NewSender("push", cfg.PushURL, cfg.PushSecret, privacy, cfg.Egress)
+		svc.EnablePush(pushes)
+		go pushes.Run(context.Background())
+		go svc.RunPush(context.Background())
+		log.Printf("Push pings enabled, coalesced over %v.", cfg.PushCoalesce)
+	}
+
+	// --- Federation ---
+	// Relays chats with users on the FEDERATION_PEERS instances.
+	if cfg.FederationEnabled() {
+		peers, err := federation.NewClient(cfg)
+		if err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+		svc.EnableFederation(peers)
+		if !compatMode {
+			relayer := federation.NewRelayer(dbStore, peers, recorder)
+			go relayer.Run(context.Background())
+			log.Printf("Federation relayer running as %s for %d peers.", cfg.FederationName, len(peers.Peers()))
+		}
+	}
+	// --- Attachments ---
+	// Chunked uploads of encrypted attachments, stored in ATTACHMENTS_DIR.
+	if cfg.AttachmentsEnabled() {
+		blobs, err := attachments.NewFSStore(cfg.Attachments.Dir)
+		if err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+		svc.EnableAttachments(blobs)
+		if !compatMode {
+			go svc.RunAttachmentGC(context.Background())
+		}
+		log.Printf("Attachments enabled in %s, up to %d bytes.", cfg.Attachments.Dir, cfg.Attachments.MaxBytes)
+	}
+	federationTLS, err := federation.ServerTLSConfig(cfg)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+
+	server := myhttp.NewServer(cfg, dbStore, svc, hub, privacy)
 	log.Println("HTTP server initialized.")
 
-	// ... (port logic)
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "5000"
+	// --- Contact Import Worker ---
+	// Sends the paced chat requests queued by POST /import/contacts.
+	if !compatMode {
+		importer := contactimport.NewWorker(dbStore, svc)
+		go importer.Run(context.Background())
+		log.Println("Contact import worker running.")
 	}
 
 	// Start server
-	log.Printf("Starting server on :%s", port)
-	if err := http.ListenAndServe(":"+port, server); err != nil {
+	httpServer := &http.Server{
+		Addr:    cfg.ListenAddr(),
+		Handler: server,
+		// Counts connections per client IP for HTTP_CONNS_PER_IP
+		ConnState: server.ConnState,
+		// Asks peers for client certificates when mutual TLS is configured
+		TLSConfig: federationTLS,
+	}
+	// Serve until SIGINT/SIGTERM, then stop taking requests and write out
+	// what the write-behind still holds
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	serveErr := make(chan error, 1)
+	go func() {
+		if cfg.TLSEnabled() {
+			log.Printf("Starting server with TLS on %s", httpServer.Addr)
+			serveErr <- httpServer.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+		} else {
+			log.Printf("Starting server on %s", httpServer.Addr)
+			serveErr <- httpServer.ListenAndServe()
+		}
+	}()
+
+	// SIGHUP reloads the runtime settings; open connections are untouched
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, err := cfg.Reload(); err != nil {
+				log.Printf("CONFIG: reload failed, keeping the running configuration: %v", err)
+			}
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
 		log.Fatalf("FATAL: could not start server: %v", err)
+	case <-stop.Done():
+	}
+
+	log.Println("Shutting down...")
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	// WebSocket connections are hijacked and not waited for
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
+	}
+	if err := dbStore.FlushWriteBehind(ctx); err != nil {
+		log.Printf("WRITEBEHIND: final %v", err)
+	}
+}
+
+// runBlobCommand seals every blob under the current data key, or with
+// decrypt stores them all in plaintext again.
+func runBlobCommand(dbStore *store.PostgresStore, compatMode, decrypt bool) error {
+	if compatMode {
+		return fmt.Errorf("the database schema is newer than this binary; run blob commands with a matching binary")
+	}
+	if !dbStore.BlobEncryption().Enabled {
+		return fmt.Errorf("blob commands need BLOB_MASTER_KEY")
+	}
+	messages, backups, err := blobrekey.RekeyAll(context.Background(), dbStore, decrypt)
+	verb := "Encrypted"
+	if decrypt {
+		verb = "Decrypted"
+	}
+	log.Printf("%s %d messages and %d key backups.", verb, messages, backups)
+	return err
+}
+
+// runMigrationCommand prints pending migrations (dryRun) or reverts to
+// version downTo.
+func runMigrationCommand(databaseURL, schemaPath string, dryRun bool, downTo int) error {
+	ctx := context.Background()
+	m, err := store.NewMigrator(databaseURL, schemaPath)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if dryRun {
+		pending, err := m.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		return store.WriteDryRun(os.Stdout, schemaPath, pending)
+	}
+
+	reverted, err := m.Down(ctx, downTo)
+	for _, mig := range reverted {
+		log.Printf("MIGRATE: reverted %04d_%s", mig.Version, mig.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(reverted) == 0 {
+		log.Printf("MIGRATE: nothing to revert above version %d", downTo)
 	}
+	return nil
 }
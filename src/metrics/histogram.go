@@ -0,0 +1,115 @@
+// src/metrics/histogram.go
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Histogram is a Prometheus histogram of durations, in seconds, with one
+// label. The label's values are fixed when it is created, so a caller
+// can't grow the number of series: observations with any other value are
+// counted under OtherValue.
+type Histogram struct {
+	name   string
+	help   string
+	label  string
+	bounds []float64 // Upper bounds in seconds, ascending
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// OtherValue is the label value of observations with an unknown one.
+const OtherValue = "other"
+
+type series struct {
+	count  int64
+	sum    float64
+	counts []int64 // One per bound, plus +Inf
+}
+
+// NewHistogram returns a histogram with buckets at bounds (in seconds) and a
+// series for each of values, plus OtherValue.
+func NewHistogram(name, help, label string, bounds []float64, values ...string) *Histogram {
+	h := &Histogram{
+		name:   name,
+		help:   help,
+		label:  label,
+		bounds: append([]float64(nil), bounds...),
+		series: make(map[string]*series, len(values)+1),
+	}
+	sort.Float64s(h.bounds)
+	for _, v := range append(values, OtherValue) {
+		h.series[v] = &series{counts: make([]int64, len(h.bounds)+1)}
+	}
+	return h
+}
+
+// Observe records took under the label value.
+func (h *Histogram) Observe(value string, took time.Duration) {
+	seconds := took.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[value]
+	if !ok {
+		s = h.series[OtherValue]
+	}
+	s.count++
+	s.sum += seconds
+	i := sort.SearchFloat64s(h.bounds, seconds) // First bound >= seconds
+	s.counts[i]++
+}
+
+// WriteTo writes the histogram in the Prometheus text format, series in
+// label order.
+func (h *Histogram) WriteTo(w io.Writer) (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	values := make([]string, 0, len(h.series))
+	for v := range h.series {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	cw := &countingWriter{w: w}
+	fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, v := range values {
+		s := h.series[v]
+		label := fmt.Sprintf("%s=%q", h.label, v)
+		var cumulative int64
+		for i, n := range s.counts {
+			cumulative += n
+			le := "+Inf"
+			if i < len(h.bounds) {
+				le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(cw, "%s_bucket{%s,le=%q} %d\n", h.name, label, le, cumulative)
+		}
+		fmt.Fprintf(cw, "%s_sum{%s} %s\n", h.name, label, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(cw, "%s_count{%s} %d\n", h.name, label, s.count)
+	}
+	return cw.n, cw.err
+}
+
+// countingWriter keeps the first write error, so WriteTo can ignore the
+// errors of each Fprintf and report it once.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
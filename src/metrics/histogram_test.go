@@ -0,0 +1,69 @@
+// src/metrics/histogram_test.go
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramWriteTo(t *testing.T) {
+	h := NewHistogram("test_seconds", "Test latency.", "path", []float64{1, 0.5}, "a", "b")
+	h.Observe("a", 100*time.Millisecond)
+	h.Observe("a", 500*time.Millisecond) // On a bound: counted in it
+	h.Observe("a", 2*time.Second)
+	h.Observe("b", time.Second)
+	h.Observe("made-up", time.Millisecond)
+
+	var out strings.Builder
+	n, err := h.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_seconds Test latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{path="a",le="0.5"} 2
+test_seconds_bucket{path="a",le="1"} 2
+test_seconds_bucket{path="a",le="+Inf"} 3
+test_seconds_sum{path="a"} 2.6
+test_seconds_count{path="a"} 3
+test_seconds_bucket{path="b",le="0.5"} 0
+test_seconds_bucket{path="b",le="1"} 1
+test_seconds_bucket{path="b",le="+Inf"} 1
+test_seconds_sum{path="b"} 1
+test_seconds_count{path="b"} 1
+test_seconds_bucket{path="other",le="0.5"} 1
+test_seconds_bucket{path="other",le="1"} 1
+test_seconds_bucket{path="other",le="+Inf"} 1
+test_seconds_sum{path="other"} 0.001
+test_seconds_count{path="other"} 1
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+	if n != int64(out.Len()) {
+		t.Errorf("reported %d bytes, wrote %d", n, out.Len())
+	}
+}
+
+// failingWriter accepts limit bytes, then fails.
+type failingWriter struct{ limit int }
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.limit {
+		n := f.limit
+		f.limit = 0
+		return n, errors.New("connection reset")
+	}
+	f.limit -= len(p)
+	return len(p), nil
+}
+
+func TestHistogramWriteToReportsTheFirstError(t *testing.T) {
+	h := NewHistogram("test_seconds", "Test latency.", "path", []float64{1})
+	n, err := h.WriteTo(&failingWriter{limit: 10})
+	if err == nil || err.Error() != "connection reset" || n != 10 {
+		t.Errorf("got %d bytes, %v; want 10 and the write error", n, err)
+	}
+}
@@ -2,8 +2,12 @@ package myhttp
 
 import (
 	"context"
+	"cryptachat-server/chatservice"
 	"cryptachat-server/store" // Import the store package
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
 
@@ -15,62 +19,197 @@ type contextKey string
 
 const userContextKey = contextKey("user")
 
+// sessionContextKey holds the session ID of the request's access token.
+const sessionContextKey = contextKey("session")
+
+// Auth error codes, sent as "code" in the error envelope and as the
+// error_description of the WWW-Authenticate header. Clients use them to
+// tell "log in again" from "check your clock" from "fix your integration".
+const (
+	CodeAuthMissing       = "auth_missing"        // No Authorization header
+	CodeAuthSchemeInvalid = "auth_scheme_invalid" // Not "Bearer <token>"
+	CodeTokenMalformed    = "token_malformed"     // Unparseable, badly signed or not yet valid
+	CodeTokenExpired      = "token_expired"
+	CodeTokenRevoked      = "token_revoked" // Issued before the user's token version was bumped, or its session revoked
+	CodeUserGone          = "user_gone"     // Valid token for a deleted account
+)
+
+// authError is a failed authentication with a client-safe message.
+type authError struct {
+	code    string
+	message string
+	status  int
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+func newAuthError(code, message string) *authError {
+	status := http.StatusUnauthorized
+	if code == CodeUserGone {
+		status = http.StatusForbidden
+	}
+	return &authError{code: code, message: message, status: status}
+}
+
+// writeAuthError writes an authentication failure with its code and the
+// RFC 6750 challenge.
+func (s *Server) writeAuthError(w http.ResponseWriter, err error) {
+	var authErr *authError
+	if !errors.As(err, &authErr) {
+		if timedOut(w) {
+			s.writeJSONError(w, "Request timed out.", http.StatusGatewayTimeout)
+			return
+		}
+		log.Printf("Auth check failed: %v", err)
+		s.writeJSONError(w, "Could not verify token.", http.StatusInternalServerError)
+		return
+	}
+
+	challenge := `Bearer realm="cryptachat"`
+	switch authErr.code {
+	case CodeAuthMissing:
+		// RFC 6750 3.1: no error attribute when no credentials were sent
+	case CodeAuthSchemeInvalid:
+		challenge += `, error="invalid_request", error_description="` + authErr.code + `"`
+	default:
+		challenge += `, error="invalid_token", error_description="` + authErr.code + `"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	s.writeErrorBody(w, authErr.message, map[string]interface{}{"code": authErr.code}, authErr.status)
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>"
+// header. The scheme is matched case-insensitively.
+func bearerToken(r *http.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", newAuthError(CodeAuthMissing, "Token is missing!")
+	}
+	scheme, token, ok := strings.Cut(authHeader, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", newAuthError(CodeAuthSchemeInvalid, "Invalid token format")
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", newAuthError(CodeTokenMalformed, "Token is invalid: empty token")
+	}
+	return token, nil
+}
+
 // jwtAuthMiddleware is the Go equivalent of your @token_required decorator
 func (s *Server) jwtAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			s.writeJSONError(w, "Token is missing!", http.StatusUnauthorized)
+		tokenString, err := bearerToken(r)
+		if err != nil {
+			s.writeAuthError(w, err)
 			return
 		}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		if tokenString == authHeader {
-			s.writeJSONError(w, "Invalid token format", http.StatusUnauthorized)
+		user, sessionID, err := s.userFromToken(r.Context(), tokenString)
+		if err != nil {
+			s.writeAuthError(w, err)
 			return
 		}
+		// Batched by the store's write-behind; nothing is written while
+		// the schema is ahead
+		if !s.compat.enabled {
+			if err := s.store.UpdateLastSeen(r.Context(), user.ID, s.now()); err != nil {
+				log.Printf("Could not update last seen for user %d: %v", user.ID, err)
+			}
+		}
+
+		// This is the Go way to pass "current_user" to the next handler
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = context.WithValue(ctx, sessionContextKey, sessionID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// userFromToken validates a JWT and loads its user, and returns the
+// token's session (0 if none). Rejections are *authError with a
+// client-safe message; anything else is a server fault.
+func (s *Server) userFromToken(ctx context.Context, tokenString string) (*store.User, int64, error) {
+	// The claims struct must match what the service issues at login
+	// The signer refuses tokens signed with any other algorithm, and only
+	// access tokens, not e.g. the pending token of a two-factor login, have
+	// this audience
+	token, err := s.cfg.TokenSigner.Parse(tokenString, &chatservice.Claims{},
+		jwt.WithTimeFunc(s.now), jwt.WithAudience(chatservice.AudienceAccess))
 
-		// Define your claims struct (must match what you create at login)
-		type AppClaims struct {
-			UserID   int    `json:"user_id"`
-			Username string `json:"username"`
-			jwt.RegisteredClaims
+	if err != nil {
+		// Access tokens from before audiences have none. They count as
+		// expired, so clients refresh them instead of signing out.
+		if errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, jwt.ErrTokenRequiredClaimMissing) {
+			return nil, 0, newAuthError(CodeTokenExpired, "Token has expired!")
+		}
+		if errors.Is(err, jwt.ErrTokenInvalidAudience) {
+			return nil, 0, newAuthError(CodeTokenMalformed, "Token is not an access token.")
 		}
+		return nil, 0, newAuthError(CodeTokenMalformed, fmt.Sprintf("Token is invalid: %v", err))
+	}
 
-		token, err := jwt.ParseWithClaims(tokenString, &AppClaims{}, func(token *jwt.Token) (interface{}, error) {
-			// Validate the signing method
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			// Return the secret key (from your config)
-			return []byte(s.cfg.JWTSecret), nil
-		})
+	claims, ok := token.Claims.(*chatservice.Claims)
+	if !ok || !token.Valid {
+		return nil, 0, newAuthError(CodeTokenMalformed, "Token is invalid!")
+	}
 
+	// In your Python code, you double-check the user against the DB.
+	// This is critical, and we do it here. The row may come from the
+	// store's user cache, which this replica's own writes invalidate.
+	user, err := s.store.GetAuthUser(ctx, claims.UserID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, 0, newAuthError(CodeUserGone, "This account no longer exists.")
+		}
+		return nil, 0, err
+	}
+	// The user row, not the claims, is what handlers see, so a stale
+	// username claim can't leak into a request. Tokens from before a
+	// version bump (logout everywhere) are refused outright.
+	if claims.TokenVersion != user.TokenVersion {
+		return nil, 0, newAuthError(CodeTokenRevoked, "Token has been revoked. Log in again.")
+	}
+	// Tokens from logins without a refresh token, and from before
+	// sessions, have none. Nothing is written while the schema is ahead.
+	if claims.SessionID != 0 {
+		ok, err := s.store.CheckSession(ctx, user.ID, claims.SessionID, s.now(), !s.compat.enabled)
 		if err != nil {
-			if err == jwt.ErrTokenExpired {
-				s.writeJSONError(w, "Token has expired!", http.StatusUnauthorized)
-			} else {
-				s.writeJSONError(w, fmt.Sprintf("Token is invalid: %v", err), http.StatusUnauthorized)
-			}
-			return
+			return nil, 0, err
+		}
+		if !ok {
+			return nil, 0, newAuthError(CodeTokenRevoked, "Session has been signed out. Log in again.")
 		}
+	}
+	return user, claims.SessionID, nil
+}
+
+// adminAuthMiddleware guards operator routes. It accepts the static
+// ADMIN_TOKEN or the JWT of an admin user. Without an ADMIN_TOKEN the routes
+// are hidden from everyone else.
+func (s *Server) adminAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
 
-		if claims, ok := token.Claims.(*AppClaims); ok && token.Valid {
-			// In your Python code, you double-check the user against the DB.
-			// This is critical, and we do it here.
-			user, err := s.store.GetUserByID(r.Context(), claims.UserID)
-			if err != nil || user == nil {
-				s.writeJSONError(w, "Token is invalid!", http.StatusUnauthorized)
+		if s.cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(tokenString), []byte(s.cfg.AdminToken)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if tokenString != "" {
+			if user, _, err := s.userFromToken(r.Context(), tokenString); err == nil && user.IsAdmin {
+				// Admin handlers find the acting admin with getUserFromContext
+				ctx := context.WithValue(r.Context(), userContextKey, user)
+				next.ServeHTTP(w, r.WithContext(ctx))
 				return
 			}
+		}
 
-			// This is the Go way to pass "current_user" to the next handler
-			ctx := context.WithValue(r.Context(), userContextKey, user)
-			next.ServeHTTP(w, r.WithContext(ctx))
-
-		} else {
-			s.writeJSONError(w, "Token is invalid!", http.StatusUnauthorized)
+		if s.cfg.AdminToken == "" {
+			http.NotFound(w, r)
+			return
 		}
+		s.writeJSONError(w, "Admin token is invalid!", http.StatusUnauthorized)
 	}
 }
 
@@ -0,0 +1,235 @@
+// src/myhttp/auth_test.go
+package myhttp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"cryptachat-server/chatservice"
+	"cryptachat-server/tokensign"
+)
+
+// authResult is what jwtAuthMiddleware did with one request.
+type authResult struct {
+	status    int
+	code      string // "code" of the error envelope
+	challenge string // WWW-Authenticate
+	passed    bool   // The wrapped handler ran
+	userID    int    // The user it saw
+}
+
+func runAuth(s *Server, header string) authResult {
+	var res authResult
+	h := s.jwtAuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		res.passed = true
+		if user, ok := s.getUserFromContext(r); ok {
+			res.userID = user.ID
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r := httptest.NewRequest(http.MethodGet, "/get_contacts", nil)
+	if header != "" {
+		r.Header.Set("Authorization", header)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	res.status = w.Code
+	res.challenge = w.Header().Get("WWW-Authenticate")
+	var body struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if !res.passed {
+		json.Unmarshal(w.Body.Bytes(), &body)
+		res.code = body.Error.Code
+	}
+	return res
+}
+
+// checkRefused checks that res is a refusal with code, status and the
+// matching RFC 6750 challenge.
+func checkRefused(t *testing.T, res authResult, status int, code string) {
+	t.Helper()
+	if res.passed {
+		t.Fatal("request reached the handler")
+	}
+	if res.status != status || res.code != code {
+		t.Fatalf("got %d %q, want %d %q", res.status, res.code, status, code)
+	}
+	want := `Bearer realm="cryptachat"`
+	switch code {
+	case CodeAuthMissing:
+	case CodeAuthSchemeInvalid:
+		want += `, error="invalid_request", error_description="` + code + `"`
+	default:
+		want += `, error="invalid_token", error_description="` + code + `"`
+	}
+	if res.challenge != want {
+		t.Errorf("WWW-Authenticate = %q, want %q", res.challenge, want)
+	}
+}
+
+func TestAuthMiddlewareRefusesBadTokens(t *testing.T) {
+	s, clk := newOfflineServer(t)
+	now := clk.Now()
+	claims := func(issued, expires time.Time) chatservice.Claims {
+		return chatservice.Claims{
+			UserID:   1,
+			Username: "alice",
+			RegisteredClaims: jwt.RegisteredClaims{
+				Audience:  jwt.ClaimStrings{chatservice.AudienceAccess},
+				IssuedAt:  jwt.NewNumericDate(issued),
+				ExpiresAt: jwt.NewNumericDate(expires),
+			},
+		}
+	}
+	expired := signToken(t, s.cfg, claims(now.Add(-time.Hour), now.Add(-time.Second)))
+	notYetValid := claims(now, now.Add(time.Hour))
+	notYetValid.NotBefore = jwt.NewNumericDate(now.Add(time.Minute))
+	pending := claims(now, now.Add(time.Hour))
+	pending.Audience = jwt.ClaimStrings{chatservice.AudienceTwoFactor}
+	noAudience := claims(now, now.Add(time.Hour))
+	noAudience.Audience = nil
+	otherKey, err := tokensign.NewHMAC([]byte("some other secret")).Sign(claims(now, now.Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims(now, now.Add(time.Hour))).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := signToken(t, s.cfg, claims(now, now.Add(time.Hour)))
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+		code   string
+	}{
+		{"no header", "", http.StatusUnauthorized, CodeAuthMissing},
+		{"basic auth", "Basic YWxpY2U6cHc=", http.StatusUnauthorized, CodeAuthSchemeInvalid},
+		{"token without scheme", valid, http.StatusUnauthorized, CodeAuthSchemeInvalid},
+		{"scheme without token", "Bearer ", http.StatusUnauthorized, CodeTokenMalformed},
+		{"garbage", "Bearer not.a.jwt", http.StatusUnauthorized, CodeTokenMalformed},
+		{"truncated signature", "Bearer " + valid[:len(valid)-4], http.StatusUnauthorized, CodeTokenMalformed},
+		{"signed with another key", "Bearer " + otherKey, http.StatusUnauthorized, CodeTokenMalformed},
+		{"alg none", "Bearer " + unsigned, http.StatusUnauthorized, CodeTokenMalformed},
+		{"not yet valid", "Bearer " + signToken(t, s.cfg, notYetValid), http.StatusUnauthorized, CodeTokenMalformed},
+		{"two-factor pending token", "Bearer " + signToken(t, s.cfg, pending), http.StatusUnauthorized, CodeTokenMalformed},
+		{"no audience, from before audiences", "Bearer " + signToken(t, s.cfg, noAudience), http.StatusUnauthorized, CodeTokenExpired},
+		{"expired", "Bearer " + expired, http.StatusUnauthorized, CodeTokenExpired},
+		{"expired, lower-case scheme", "bearer " + expired, http.StatusUnauthorized, CodeTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkRefused(t, runAuth(s, tt.header), tt.status, tt.code)
+		})
+	}
+}
+
+// TestAuthMiddlewareChecksTheUserRow covers the refusals that depend on
+// the database: tokens of a deleted account, tokens from before a token
+// version bump (logout everywhere or a rename), and tokens of a signed-out
+// session.
+func TestAuthMiddlewareChecksTheUserRow(t *testing.T) {
+	s, st, clk := newTestServer(t)
+	ctx := context.Background()
+
+	register := func(name string) int {
+		if err := st.RegisterUser(ctx, name, "hash", nil); err != nil {
+			t.Fatal(err)
+		}
+		id, err := st.GetUserIDByUsername(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	token := func(userID int, version int, sessionID int64) string {
+		now := clk.Now()
+		return "Bearer " + signToken(t, s.cfg, chatservice.Claims{
+			UserID:       userID,
+			TokenVersion: version,
+			SessionID:    sessionID,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Audience:  jwt.ClaimStrings{chatservice.AudienceAccess},
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			},
+		})
+	}
+
+	alice := register("alice")
+	if res := runAuth(s, token(alice, 0, 0)); !res.passed || res.userID != alice {
+		t.Fatalf("valid token: %+v", res)
+	}
+
+	t.Run("stale token version", func(t *testing.T) {
+		bob := register("bob")
+		stale := token(bob, 0, 0)
+		version, err := st.BumpTokenVersion(ctx, bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRefused(t, runAuth(s, stale), http.StatusUnauthorized, CodeTokenRevoked)
+		if res := runAuth(s, token(bob, version, 0)); !res.passed {
+			t.Fatalf("token with the new version: %+v", res)
+		}
+	})
+
+	t.Run("renamed account", func(t *testing.T) {
+		erin := register("erin")
+		session, err := st.CreateSession(ctx, erin, "family", "laptop", "127.0.0.1", clk.Now().Add(24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := token(erin, 0, session)
+		_, version, _, err := st.RenameUser(ctx, erin, "erin2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRefused(t, runAuth(s, old), http.StatusUnauthorized, CodeTokenRevoked)
+		// The session is gone too, so only a token without one passes
+		checkRefused(t, runAuth(s, token(erin, version, session)), http.StatusUnauthorized, CodeTokenRevoked)
+		if res := runAuth(s, token(erin, version, 0)); !res.passed {
+			t.Fatalf("token with the new version: %+v", res)
+		}
+	})
+
+	t.Run("signed-out session", func(t *testing.T) {
+		carol := register("carol")
+		session, err := st.CreateSession(ctx, carol, "family", "laptop", "127.0.0.1", clk.Now().Add(24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok := token(carol, 0, session)
+		if res := runAuth(s, tok); !res.passed {
+			t.Fatalf("token of a live session: %+v", res)
+		}
+		if err := st.DeleteSession(ctx, carol, session); err != nil {
+			t.Fatal(err)
+		}
+		checkRefused(t, runAuth(s, tok), http.StatusUnauthorized, CodeTokenRevoked)
+	})
+
+	t.Run("deleted account", func(t *testing.T) {
+		dave := register("dave")
+		tok := token(dave, 0, 0)
+		if _, err := st.DeleteUser(ctx, dave); err != nil {
+			t.Fatal(err)
+		}
+		checkRefused(t, runAuth(s, tok), http.StatusForbidden, CodeUserGone)
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		checkRefused(t, runAuth(s, token(alice+1000, 0, 0)), http.StatusForbidden, CodeUserGone)
+	})
+}
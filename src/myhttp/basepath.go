@@ -0,0 +1,106 @@
+// src/myhttp/basepath.go
+package myhttp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// BASE_PATH mounts the whole API under a prefix, for reverse proxies that
+// forward https://example.com/chat/... unchanged. Requests outside the
+// prefix get 404. Everything inside has the prefix removed before routing,
+// so routes, deadlines and deprecation aliases are unaware of it. Paths the
+// server hands out in bodies and Link headers go through publicPath.
+// Location headers stay root-relative, and basePathWriter adds the prefix
+// to them, including the mux's own redirects.
+
+// publicPath returns the path clients must use for path, a root-relative
+// path as the routes see it.
+func (s *Server) publicPath(path string) string {
+	return s.cfg.BasePath + path
+}
+
+// publicURL returns the absolute URL clients reached this instance at,
+// including the base path. The scheme comes from X-Forwarded-Proto only
+// when the request came through a trusted proxy.
+func (s *Server) publicURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if _, proxied := s.conns.ClientIP(r); proxied && r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + s.publicPath("")
+}
+
+// stripBasePath returns r with basePath removed from its path, or false
+// if r is outside basePath. Only whole segments match, so "/chat" doesn't
+// capture "/chatroom". Unlike http.StripPrefix, the bare prefix
+// ("/chat") maps to "/" rather than 404.
+func stripBasePath(basePath string, r *http.Request) (*http.Request, bool) {
+	p, ok := cutSegmentPrefix(r.URL.Path, basePath)
+	if !ok {
+		return nil, false
+	}
+	rp := ""
+	if r.URL.RawPath != "" {
+		// BASE_PATH has no characters that need escaping, so the raw path
+		// starts with it too
+		if rp, ok = cutSegmentPrefix(r.URL.RawPath, basePath); !ok {
+			return nil, false
+		}
+	}
+
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = p
+	r2.URL.RawPath = rp
+	return r2, true
+}
+
+// cutSegmentPrefix removes prefix from path if it is followed by "/" or
+// nothing, returning at least "/".
+func cutSegmentPrefix(path, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return "", false
+	}
+	if rest == "" {
+		rest = "/"
+	}
+	return rest, true
+}
+
+// basePathWriter puts the base path back in front of root-relative
+// redirect locations, such as the mux's path-cleaning redirects.
+type basePathWriter struct {
+	http.ResponseWriter
+	basePath string
+}
+
+func (w *basePathWriter) WriteHeader(status int) {
+	if loc := w.Header().Get("Location"); strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+		w.Header().Set("Location", w.basePath+loc)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *basePathWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack is needed for the WebSocket upgrade.
+func (w *basePathWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return hj.Hijack()
+}
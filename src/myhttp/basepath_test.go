@@ -0,0 +1,117 @@
+// src/myhttp/basepath_test.go
+package myhttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cryptachat-server/config"
+	"cryptachat-server/deliverylog"
+	"cryptachat-server/outbox"
+	"cryptachat-server/smoketest"
+)
+
+func TestStripBasePath(t *testing.T) {
+	tests := []struct {
+		path, rawPath string
+		want, wantRaw string // want "" for outside the prefix
+	}{
+		{"/chat", "", "/", ""},
+		{"/chat/", "", "/", ""},
+		{"/chat/api/v1/login", "", "/api/v1/login", ""},
+		{"/chat/a%2Fb", "/chat/a%252Fb", "/a%2Fb", "/a%252Fb"},
+		{"/chatroom/api/v1/login", "", "", ""},
+		{"/api/v1/login", "", "", ""},
+		{"/", "", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.URL.Path, r.URL.RawPath = tt.path, tt.rawPath
+		got, ok := stripBasePath("/chat", r)
+		if !ok {
+			if tt.want != "" {
+				t.Errorf("%s: refused, want %s", tt.path, tt.want)
+			}
+			continue
+		}
+		if got.URL.Path != tt.want || got.URL.RawPath != tt.wantRaw {
+			t.Errorf("%s: %q (raw %q), want %q (raw %q)", tt.path, got.URL.Path, got.URL.RawPath, tt.want, tt.wantRaw)
+		}
+		if r.URL.Path != tt.path {
+			t.Errorf("%s: the original request was changed", tt.path)
+		}
+	}
+}
+
+func TestBasePathWriterPrefixesRedirects(t *testing.T) {
+	tests := map[string]string{
+		"/api/v1/login":                 "/chat/api/v1/login",
+		"//evil.example/":               "//evil.example/",
+		"https://example.com/elsewhere": "https://example.com/elsewhere",
+		"relative":                      "relative",
+	}
+	for loc, want := range tests {
+		rec := httptest.NewRecorder()
+		w := &basePathWriter{ResponseWriter: rec, basePath: "/chat"}
+		w.Header().Set("Location", loc)
+		w.WriteHeader(http.StatusMovedPermanently)
+		if got := rec.Header().Get("Location"); got != want {
+			t.Errorf("Location %s became %s, want %s", loc, got, want)
+		}
+	}
+}
+
+func TestBasePathValidation(t *testing.T) {
+	newTestConfig(t, "BASE_PATH", "/chat/v2")
+	for _, bad := range []string{"chat", "/chat/", "/", "/chat//x", "/chat/../x", "/chat/./x", "/chat room", "/chät"} {
+		t.Setenv("BASE_PATH", bad)
+		if _, err := config.LoadConfig(filepath.Join(t.TempDir(), ".env")); err == nil {
+			t.Errorf("BASE_PATH=%q was accepted", bad)
+		}
+	}
+}
+
+// TestSmokeUnderBasePath runs the smoke test, WebSocket included, against
+// a server mounted under /chat, and checks nothing is served outside it.
+func TestSmokeUnderBasePath(t *testing.T) {
+	s, st, _ := newTestServer(t, "BASE_PATH", "/chat")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go s.hub.Run()
+	recorder := deliverylog.NewRecorder(st)
+	go recorder.Run(ctx)
+	go outbox.NewDispatcher(st, s.hub, recorder).Run(ctx)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	var out strings.Builder
+	err := smoketest.Run(ctx, srv.URL+"/chat", &out)
+	t.Log("\n" + out.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/api/v1/server_info", "/server_info", "/chatroom/api/v1/server_info"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s outside the base path: %d, want 404", path, resp.StatusCode)
+		}
+	}
+	resp, err := http.Get(srv.URL + "/chat/api/v1/server_info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/chat/api/v1/server_info: %d", resp.StatusCode)
+	}
+}
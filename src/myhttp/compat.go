@@ -0,0 +1,89 @@
+// src/myhttp/compat.go
+package myhttp
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"cryptachat-server/store"
+)
+
+// Compatibility mode: when the database has been migrated past this binary
+// (usually a rolled-back deploy), the server keeps serving reads and logins
+// but refuses anything that would write, since this binary doesn't know what
+// the newer schema expects. ALLOW_SCHEMA_AHEAD=true turns the mode off.
+
+// CodeSchemaAhead is the error code of writes refused in compatibility mode.
+const CodeSchemaAhead = "schema_ahead"
+
+// compatReadRoutes are non-GET routes that only read, so they stay up.
+// /2fa/login records the step of the code it accepts, so it can't be
+// replayed; without it users with two-factor authentication couldn't log in.
+// /admin/reload only changes settings in memory.
+var compatReadRoutes = map[string]bool{
+	"POST /login":        true,
+	"POST /get_keys":     true,
+	"POST /2fa/login":    true,
+	"POST /admin/reload": true,
+}
+
+// compatWriteRoutes are GET routes that can't work without writing: a
+// prekey bundle consumes a prekey, a registration challenge is stored, and
+// backup fetches, message traces and audit log reads must be audited.
+var compatWriteRoutes = map[string]bool{
+	"GET /prekey_bundle":             true,
+	"GET /register_challenge":        true,
+	"GET /backup":                    true,
+	"GET /admin/messages/{id}/trace": true,
+	"GET /admin/audit":               true,
+	"GET /admin/audit/daily":         true,
+	"GET /admin/audit/export":        true,
+}
+
+// writesData reports whether the route pattern changes stored data.
+func writesData(pattern string) bool {
+	if compatWriteRoutes[pattern] {
+		return true
+	}
+	if compatReadRoutes[pattern] {
+		return false
+	}
+	method, _, _ := strings.Cut(pattern, " ")
+	return method != http.MethodGet && method != http.MethodHead
+}
+
+// compatState tracks compatibility mode for /admin/runtime.
+type compatState struct {
+	ahead   *store.SchemaAheadError // nil unless the schema is newer than this binary
+	enabled bool                    // Writes are being refused
+	refused atomic.Int64
+}
+
+// SchemaStats describes schema compatibility for /admin/runtime.
+type SchemaStats struct {
+	Ahead             *store.SchemaAheadError `json:"ahead"`
+	CompatibilityMode bool                    `json:"compatibility_mode"`
+	RefusedWrites     int64                   `json:"refused_writes"`
+}
+
+func (c *compatState) snapshot() SchemaStats {
+	return SchemaStats{
+		Ahead:             c.ahead,
+		CompatibilityMode: c.enabled,
+		RefusedWrites:     c.refused.Load(),
+	}
+}
+
+// refuseSchemaAhead replaces a writing route's handler in compatibility mode.
+func (s *Server) refuseSchemaAhead() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.compat.refused.Add(1)
+		s.writeErrorBody(w, "This server is read-only until it is upgraded to match the database.",
+			map[string]interface{}{
+				"code":             CodeSchemaAhead,
+				"database_version": s.compat.ahead.DatabaseVersion,
+				"binary_version":   s.compat.ahead.BinaryVersion,
+			}, http.StatusServiceUnavailable)
+	}
+}
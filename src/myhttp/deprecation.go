@@ -0,0 +1,177 @@
+package myhttp
+
+import (
+	"bufio"
+	"context"
+	"cryptachat-server/config"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// apiPrefix is where the current API is served. The same routes at the root
+// are deprecated aliases.
+const apiPrefix = "/api/v1"
+
+// Warnings added to responses that use a deprecated surface.
+var deprecationWarnings = map[string]string{
+	config.DeprecationRootRoutes:   "Unprefixed routes are deprecated; use the same path under " + apiPrefix + ".",
+	config.DeprecationErrorMessage: `The top-level "message" field of errors is deprecated; read "error.message" instead.`,
+}
+
+// deprecationCounters counts requests per deprecated surface and route, so
+// operators can see when a surface is no longer used.
+type deprecationCounters struct {
+	mu   sync.Mutex
+	hits map[string]map[string]int64 // surface -> route -> count
+}
+
+func (d *deprecationCounters) hit(surface, route string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.hits == nil {
+		d.hits = make(map[string]map[string]int64)
+	}
+	if d.hits[surface] == nil {
+		d.hits[surface] = make(map[string]int64)
+	}
+	d.hits[surface][route]++
+}
+
+// snapshot returns a copy of the counters.
+func (d *deprecationCounters) snapshot() map[string]map[string]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[string]map[string]int64, len(d.hits))
+	for surface, routes := range d.hits {
+		out[surface] = make(map[string]int64, len(routes))
+		for route, n := range routes {
+			out[surface][route] = n
+		}
+	}
+	return out
+}
+
+// apiWriter carries per-request API metadata to the write helpers.
+type apiWriter struct {
+	http.ResponseWriter
+	ctx      context.Context // Request context bounded by the route deadline, if any
+	route    string          // Route pattern, e.g. "POST /login"
+	legacy   bool            // Served from a deprecated root path
+	warnings []string        // Deprecation warnings for this response
+	status   int             // Status sent, or 0 before the header is written
+}
+
+// WriteHeader records the status for the dashboard.
+func (w *apiWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write records an implicit 200.
+func (w *apiWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *apiWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack is needed for the WebSocket upgrade.
+func (w *apiWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// route registers pattern (e.g. "GET /get_key") under apiPrefix and, as a
+// deprecated alias, at the root. The handler runs under the route's deadline
+// from routeTimeouts. In compatibility mode, routes that write are refused.
+func (s *Server) route(pattern string, h http.HandlerFunc) {
+	if s.compat.enabled && writesData(pattern) {
+		h = s.refuseSchemaAhead()
+	}
+	h = withTimeout(routeTimeout(pattern), h)
+	method, path, _ := strings.Cut(pattern, " ")
+	s.mux.HandleFunc(method+" "+apiPrefix+path, s.withAPIWriter(pattern, false, h))
+	s.mux.HandleFunc(pattern, s.withAPIWriter(pattern, true, h))
+}
+
+// withAPIWriter also times the request for the dashboard, except on routes
+// without a deadline, whose time is how long a client stayed connected.
+func (s *Server) withAPIWriter(route string, legacy bool, next http.HandlerFunc) http.HandlerFunc {
+	timed := routeTimeout(route) > 0
+	return func(w http.ResponseWriter, r *http.Request) {
+		aw := &apiWriter{ResponseWriter: w, route: route, legacy: legacy}
+		if legacy {
+			s.deprecate(aw, config.DeprecationRootRoutes)
+			aw.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, s.publicPath(apiPrefix+r.URL.Path)))
+		}
+		start := s.now()
+		next(aw, r)
+		if timed {
+			status := aw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			now := s.now()
+			s.traffic.observe(route, status, now.Sub(start), now)
+		}
+	}
+}
+
+// deprecate records a use of surface on this response: it counts the hit,
+// sets the Deprecation and Sunset headers and queues the warning.
+func (s *Server) deprecate(aw *apiWriter, surface string) {
+	s.deprecations.hit(surface, aw.route)
+
+	dates := s.cfg.Deprecations[surface]
+	if aw.Header().Get("Deprecation") == "" {
+		if dates.Deprecated.IsZero() {
+			aw.Header().Set("Deprecation", "true")
+		} else {
+			aw.Header().Set("Deprecation", fmt.Sprintf("@%d", dates.Deprecated.Unix()))
+		}
+	}
+	if !dates.Sunset.IsZero() && aw.Header().Get("Sunset") == "" {
+		aw.Header().Set("Sunset", dates.Sunset.UTC().Format(http.TimeFormat))
+	}
+	aw.warnings = append(aw.warnings, deprecationWarnings[surface])
+}
+
+// withWarnings adds a "warnings" array to a JSON object. Other values are
+// returned unchanged. The array is appended after the object's own fields,
+// so their order is the same with or without warnings.
+func withWarnings(data interface{}, warnings []string) interface{} {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return data
+	}
+	if len(encoded) < 2 || encoded[0] != '{' || encoded[len(encoded)-1] != '}' {
+		return data
+	}
+	w, err := json.Marshal(warnings)
+	if err != nil {
+		return data
+	}
+	out := make([]byte, 0, len(encoded)+len(w)+len(`,"warnings":`))
+	out = append(out, encoded[:len(encoded)-1]...)
+	if len(encoded) > 2 {
+		out = append(out, ',')
+	}
+	out = append(out, `"warnings":`...)
+	out = append(out, w...)
+	out = append(out, '}')
+	return json.RawMessage(out)
+}
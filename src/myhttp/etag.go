@@ -0,0 +1,45 @@
+package myhttp
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// relationshipsETag is the ETag of /get_contacts and /get_chat_requests: the
+// user's relationship version. It is weak, since the same version can be
+// encoded in a different order.
+func relationshipsETag(version int64) string {
+	return `W/"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// setETag marks a response as cacheable by the client alone, and only
+// after revalidating with etag.
+func setETag(w http.ResponseWriter, etag string) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+}
+
+// writeNotModified answers 304 if the request's If-None-Match already holds
+// etag, and reports whether it did. Tags are compared weakly, as
+// If-None-Match requires.
+func writeNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if !matchesETag(r, etag) {
+		return false
+	}
+	setETag(w, etag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+func matchesETag(r *http.Request, etag string) bool {
+	for _, v := range r.Header.Values("If-None-Match") {
+		for _, tag := range strings.Split(v, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+// src/myhttp/etag_test.go
+package myhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchesETag(t *testing.T) {
+	etag := relationshipsETag(7) // W/"7"
+	tests := []struct {
+		name        string
+		ifNoneMatch []string // One If-None-Match header each
+		want        bool
+	}{
+		{"no header", nil, false},
+		{"same weak tag", []string{`W/"7"`}, true},
+		{"strong form of the tag", []string{`"7"`}, true},
+		{"other version", []string{`W/"6"`}, false},
+		{"other strong version", []string{`"70"`}, false},
+		{"unquoted", []string{`7`}, false},
+		{"empty", []string{``}, false},
+		{"in a list", []string{`W/"5", W/"7", "8"`}, true},
+		{"in a list without spaces", []string{`"5",W/"7"`}, true},
+		{"not in a list", []string{`W/"5", W/"6"`}, false},
+		{"in a second header", []string{`W/"5"`, `W/"7"`}, true},
+		{"any", []string{`*`}, true},
+		{"any in a list", []string{`W/"5", *`}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/get_contacts", nil)
+			for _, v := range tt.ifNoneMatch {
+				r.Header.Add("If-None-Match", v)
+			}
+			if got := matchesETag(r, etag); got != tt.want {
+				t.Errorf("If-None-Match %q against %s = %v, want %v", tt.ifNoneMatch, etag, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestWriteNotModified checks a match answers 304 with the tag and cache
+// headers a 200 would have had, and a mismatch writes nothing.
+func TestWriteNotModified(t *testing.T) {
+	etag := relationshipsETag(7)
+
+	r := httptest.NewRequest(http.MethodGet, "/get_contacts", nil)
+	r.Header.Set("If-None-Match", `W/"6"`)
+	w := httptest.NewRecorder()
+	if writeNotModified(w, r, etag) {
+		t.Fatal("answered 304 for another version")
+	}
+	if len(w.Header()) != 0 || w.Body.Len() != 0 {
+		t.Errorf("a mismatch wrote headers %v, body %q", w.Header(), w.Body)
+	}
+
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	if !writeNotModified(w, r, etag) {
+		t.Fatal("no 304 for the current version")
+	}
+	if w.Code != http.StatusNotModified {
+		t.Errorf("status %d, want %d", w.Code, http.StatusNotModified)
+	}
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("ETag %q, want %q", got, etag)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "private, no-cache" {
+		t.Errorf("Cache-Control %q", got)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("304 with a body: %q", w.Body)
+	}
+}
@@ -0,0 +1,56 @@
+// src/myhttp/expiry_test.go
+package myhttp
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestTokensExpireOnTheClock moves the fake clock to the edges of the
+// access and refresh token lifetimes, so the expiry checks are exercised
+// without waiting for either.
+func TestTokensExpireOnTheClock(t *testing.T) {
+	s, _, clk := newTestServer(t, "TOKEN_TTL", "10m", "REFRESH_TOKEN_TTL_DAYS", "1")
+	registerAlice(t, s, 4, "correct horse battery")
+
+	login := postLogin(s, "alice", "correct horse battery")
+	if login.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", login.Code, login.Body)
+	}
+	var tokens tokenResponse
+	decodeBody(t, login, &tokens)
+
+	var refused struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	clk.Advance(10*time.Minute - time.Second)
+	if w := serveAs(s, http.MethodGet, "/me", tokens.Token, ""); w.Code != http.StatusOK {
+		t.Fatalf("a second before expiry: %d %s", w.Code, w.Body)
+	}
+	clk.Advance(time.Second)
+	w := serveAs(s, http.MethodGet, "/me", tokens.Token, "")
+	decodeBody(t, w, &refused)
+	if w.Code != http.StatusUnauthorized || refused.Error.Code != CodeTokenExpired {
+		t.Fatalf("at expiry: %d %s, want 401 %s", w.Code, w.Body, CodeTokenExpired)
+	}
+
+	// The refresh token outlives the access token, and the pair it is
+	// exchanged for starts its own lifetimes
+	w = serveAs(s, http.MethodPost, "/refresh", "", `{"refresh_token":"`+tokens.RefreshToken+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("refresh: %d %s", w.Code, w.Body)
+	}
+	decodeBody(t, w, &tokens)
+	if w := serveAs(s, http.MethodGet, "/me", tokens.Token, ""); w.Code != http.StatusOK {
+		t.Fatalf("refreshed access token: %d %s", w.Code, w.Body)
+	}
+
+	clk.Advance(24 * time.Hour)
+	w = serveAs(s, http.MethodPost, "/refresh", "", `{"refresh_token":"`+tokens.RefreshToken+`"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("refresh token at expiry: %d %s, want 401", w.Code, w.Body)
+	}
+}
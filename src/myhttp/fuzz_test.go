@@ -0,0 +1,194 @@
+// src/myhttp/fuzz_test.go
+package myhttp
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"cryptachat-server/config"
+	"cryptachat-server/store"
+)
+
+// fuzzPayloadLimit is small so the fuzzer reaches the size limit too.
+const fuzzPayloadLimit = 512
+
+// newFuzzServer returns a Server with just enough set up for request
+// parsing: no store, service or hub.
+func newFuzzServer() *Server {
+	s := &Server{cfg: &config.Config{PayloadLimits: map[string]int64{
+		config.PayloadAuth:        fuzzPayloadLimit,
+		config.PayloadChatRequest: fuzzPayloadLimit,
+		config.PayloadMessage:     fuzzPayloadLimit,
+	}}}
+	// Every since_id in range is below the bound, so no lookup is needed
+	s.messageIDs.last.Store(math.MaxInt32)
+	return s
+}
+
+// fuzzDecode feeds body to decodeJSON as payloadType into a fresh dst and
+// checks that it either accepts a well-formed body or answers 400 or 413
+// with the error envelope.
+func fuzzDecode(t *testing.T, payloadType string, dst interface{}, body []byte) {
+	s := newFuzzServer()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body)))
+
+	if s.decodeJSON(w, r, payloadType, dst) {
+		if w.Body.Len() != 0 {
+			t.Fatalf("accepted, but wrote %q", w.Body)
+		}
+		if len(body) > fuzzPayloadLimit {
+			t.Fatalf("accepted a %d byte body over the %d byte limit", len(body), fuzzPayloadLimit)
+		}
+		if !json.Valid(body) {
+			t.Fatalf("accepted invalid JSON %q", body)
+		}
+		if containsNUL(reflect.ValueOf(dst)) {
+			t.Fatalf("accepted a NUL: %+v", dst)
+		}
+		return
+	}
+
+	if w.Code != http.StatusBadRequest && w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("refused with %d, want 400 or 413", w.Code)
+	}
+	var resp struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error.Message == "" {
+		t.Fatalf("refused without an error envelope: %q", w.Body)
+	}
+}
+
+// addBodySeeds adds the inputs every decoder target starts from: bodies
+// the handlers accept, and the ones that used to reach the store.
+func addBodySeeds(f *testing.F, valid ...string) {
+	for _, b := range valid {
+		f.Add([]byte(b))
+	}
+	for _, b := range []string{
+		``,
+		`null`,
+		`[]`,
+		`{"username":"a\u0000b"}`,
+		`{"recipient_username":"bob"} {"recipient_username":"carol"}`,
+		`{"recipient_username":"bob"}garbage`,
+		`{"username":"` + strings.Repeat("a", fuzzPayloadLimit) + `"}`,
+		`{"username":"\ud800"}`,
+	} {
+		f.Add([]byte(b))
+	}
+}
+
+func FuzzDecodeRegister(f *testing.F) {
+	addBodySeeds(f,
+		`{"username":"alice","password":"correct horse battery"}`,
+		`{"username":"alice","password":"pw","invite_code":"abc","email":"a@example.com","pow_nonce":"n","pow_counter":18446744073709551615}`,
+	)
+	f.Add([]byte(`{"pow_counter":18446744073709551616}`))
+	f.Add([]byte(`{"pow_counter":-1}`))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		fuzzDecode(t, config.PayloadAuth, &authPayload{}, body)
+	})
+}
+
+func FuzzDecodeSendMessage(f *testing.F) {
+	addBodySeeds(f,
+		`{"recipient_username":"bob","sender_blob":"c2VuZGVy","recipient_blob":"cmVjaXBpZW50"}`,
+		`{"recipient_username":"bob","recipient_blob":"cmVjaXBpZW50","sealed":true}`,
+	)
+	f.Add([]byte(`{"sealed":"yes"}`))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		fuzzDecode(t, config.PayloadMessage, &sendMessagePayload{}, body)
+	})
+}
+
+func FuzzDecodeRequestChat(f *testing.F) {
+	addBodySeeds(f,
+		`{"recipient_username":"bob"}`,
+		`{"requester_username":"alice"}`,
+	)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		fuzzDecode(t, config.PayloadChatRequest, &chatRequestPayload{}, body)
+	})
+}
+
+// FuzzGetMessagesQuery parses /get_messages query strings the way the
+// handler and service do: since_id must be a message ID or refused with
+// 422, and direction one of the Direction constants.
+func FuzzGetMessagesQuery(f *testing.F) {
+	for _, q := range []string{
+		"",
+		"username=bob",
+		"username=bob&since_id=10&direction=incoming",
+		"since_id=0&direction=outgoing",
+		"since_id=2147483647",
+		"since_id=2147483648",
+		"since_id=99999999999999999999",
+		"since_id=-1",
+		"since_id=%2B5",
+		"since_id=0x10",
+		"since_id=1.5",
+		"since_id=007",
+		"since_id=1&since_id=2",
+		"direction=BOTH",
+		"direction=both%00",
+		"since_id=%zz",
+	} {
+		f.Add(q)
+	}
+	f.Fuzz(func(t *testing.T, rawQuery string) {
+		s := newFuzzServer()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/get_messages", nil)
+		r.URL.RawQuery = rawQuery
+		q, _ := url.ParseQuery(rawQuery)
+		raw := q.Get("since_id")
+
+		sinceID, ok := s.sinceIDParam(w, r)
+		if ok {
+			if sinceID < 0 || sinceID > math.MaxInt32 {
+				t.Fatalf("since_id %q parsed as %d, outside the ID range", raw, sinceID)
+			}
+			if raw == "" && sinceID != 0 {
+				t.Fatalf("absent since_id parsed as %d", sinceID)
+			}
+			if n, err := strconv.ParseInt(raw, 10, 64); raw != "" && (err != nil || n != int64(sinceID)) {
+				t.Fatalf("since_id %q parsed as %d", raw, sinceID)
+			}
+		} else {
+			var resp struct {
+				Error struct {
+					Code  string `json:"code"`
+					Field string `json:"field"`
+				} `json:"error"`
+			}
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("since_id %q refused with %d, want 422", raw, w.Code)
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error.Code != CodeInvalidParameter || resp.Error.Field != "since_id" {
+				t.Fatalf("since_id %q refused with %q", raw, w.Body)
+			}
+		}
+
+		raw = q.Get("direction")
+		direction, ok := store.ParseDirection(raw)
+		switch {
+		case !ok && (raw == "" || raw == store.DirectionBoth || raw == store.DirectionIncoming || raw == store.DirectionOutgoing):
+			t.Fatalf("direction %q refused", raw)
+		case ok && raw == "" && direction != store.DirectionBoth:
+			t.Fatalf("absent direction is %q, want both", direction)
+		case ok && raw != "" && direction != raw:
+			t.Fatalf("direction %q parsed as %q", raw, direction)
+		}
+	})
+}
@@ -2,137 +2,340 @@ package myhttp
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math"
 	"net/http"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
+	"cryptachat-server/chatservice"
+	"cryptachat-server/config"
 	"cryptachat-server/store" // Import store
-
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"cryptachat-server/websockets"
 )
 
 // A helper function to write JSON errors
 func (s *Server) writeJSONError(w http.ResponseWriter, message string, status int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]string{"message": message})
+	s.writeErrorBody(w, message, nil, status)
+}
+
+// writeErrorBody writes the error envelope {"error": {"message": ..., ...}}.
+// Requests on the deprecated root paths also get the legacy top-level
+// "message" (and details), which is counted as a deprecated surface.
+func (s *Server) writeErrorBody(w http.ResponseWriter, message string, details map[string]interface{}, status int) {
+	errObj := map[string]interface{}{"message": message, "retryable": retryableStatus(status)}
+	for k, v := range details {
+		errObj[k] = v
+	}
+	body := map[string]interface{}{"error": errObj}
+
+	aw, ok := w.(*apiWriter)
+	if !ok || aw.legacy {
+		body["message"] = message
+		for k, v := range details {
+			body[k] = v
+		}
+		if ok {
+			s.deprecate(aw, config.DeprecationErrorMessage)
+		}
+	}
+	s.writeJSON(w, body, status)
+}
+
+// retryableStatus reports whether repeating a request that got status may
+// succeed: after Retry-After for 429, shortly for 503 and 504. Other errors
+// will recur until the request or the server's state changes.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// writeServiceError maps a chatservice error onto an HTTP status and writes it.
+// Any Details on the error are included alongside the message.
+func (s *Server) writeServiceError(w http.ResponseWriter, err error) {
+	// A transient failure caused by the route deadline is still a timeout
+	if kind := chatservice.KindOf(err); (kind == chatservice.KindInternal || kind == chatservice.KindUnavailable) && timedOut(w) {
+		s.writeJSONError(w, "Request timed out.", http.StatusGatewayTimeout)
+		return
+	}
+
+	status := http.StatusInternalServerError
+	switch chatservice.KindOf(err) {
+	case chatservice.KindInvalid:
+		status = http.StatusBadRequest
+	case chatservice.KindUnauthorized:
+		status = http.StatusUnauthorized
+	case chatservice.KindNotFound:
+		status = http.StatusNotFound
+	case chatservice.KindConflict:
+		status = http.StatusConflict
+	case chatservice.KindForbidden:
+		status = http.StatusForbidden
+	case chatservice.KindTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case chatservice.KindRateLimited:
+		status = http.StatusTooManyRequests
+	case chatservice.KindUnavailable:
+		status = http.StatusServiceUnavailable
+	}
+
+	var svcErr *chatservice.Error
+	if errors.As(err, &svcErr) {
+		if secs, ok := svcErr.Details["retry_after_seconds"].(int); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+		}
+		s.writeErrorBody(w, svcErr.Message, svcErr.Details, status)
+		return
+	}
+	s.writeJSONError(w, err.Error(), status)
+}
+
+// writeBatch writes the shared multi-status body for batch endpoints.
+// The envelope was valid, so the status is 200 even if every item failed;
+// clients must check each result.
+func (s *Server) writeBatch(w http.ResponseWriter, results []chatservice.BatchItem) {
+	s.writeJSON(w, batchResponse{Results: results}, http.StatusOK)
+}
+
+// decodeJSON reads the request body into dst, enforcing the size limit for
+// payloadType. On failure it writes the error response and returns false.
+func (s *Server) decodeJSON(w http.ResponseWriter, r *http.Request, payloadType string, dst interface{}) bool {
+	limit := s.cfg.PayloadLimit(payloadType)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	dec := json.NewDecoder(r.Body)
+	err := dec.Decode(dst)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("trailing data after JSON body")
+	}
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			s.writeJSONError(w, fmt.Sprintf("Request body exceeds the %d byte limit for %s payloads.", limit, payloadType), http.StatusRequestEntityTooLarge)
+		} else {
+			s.writeJSONError(w, "Invalid JSON body", http.StatusBadRequest)
+		}
+		return false
+	}
+	// Postgres can't store NUL in text, so reject it here rather than
+	// letting the query fail with a 500
+	if containsNUL(reflect.ValueOf(dst)) {
+		s.writeJSONError(w, "Strings must not contain NUL characters.", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// containsNUL reports whether any string reachable from v contains a NUL byte.
+func containsNUL(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return strings.ContainsRune(v.String(), 0)
+	case reflect.Pointer, reflect.Interface:
+		return !v.IsNil() && containsNUL(v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() && containsNUL(v.Field(i)) {
+				return true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if containsNUL(v.Index(i)) {
+				return true
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if containsNUL(iter.Key()) || containsNUL(iter.Value()) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-// A helper function to write JSON responses
-func (s *Server) writeJSON(w http.ResponseWriter, data interface{}, status int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(data)
+// parseID parses a positive database ID (a Postgres integer) from a path or
+// query parameter.
+func parseID(s string) (int, bool) {
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return int(n), true
 }
 
 // --- Auth Handlers ---
 
 // Define the expected JSON payload for registration/login
 type authPayload struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	DeviceLabel string `json:"device_label"` // Login only; optional
+	InviteCode  string `json:"invite_code"`  // Register only; required if invites are
+	Email       string `json:"email"`        // Register only; optional recovery email
+	PowNonce    string `json:"pow_nonce"`    // Register only; required if proof of work is
+	PowCounter  uint64 `json:"pow_counter"`  // Register only; solves PowNonce
+}
+
+// handleRegisterChallenge returns the handler for the /register_challenge
+// route, which issues the proof-of-work challenge /register requires when
+// REGISTRATION_POW_BITS is set.
+func (s *Server) handleRegisterChallenge() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		challenge, err := s.svc.NewRegisterChallenge(r.Context())
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		s.writeJSON(w, challenge, http.StatusOK)
+	}
 }
 
 // handleRegister returns the handler function for the /register route
 func (s *Server) handleRegister() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var payload authPayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
+			return
+		}
 
-		// 1. Parse the JSON body
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			s.writeJSONError(w, "Invalid JSON body", http.StatusBadRequest)
+		work := chatservice.RegistrationWork{Nonce: payload.PowNonce, Counter: payload.PowCounter}
+		if err := s.svc.Register(r.Context(), payload.Username, payload.Password, payload.InviteCode, payload.Email, work); err != nil {
+			s.writeServiceError(w, err)
 			return
 		}
 
-		// 2. Validate input
-		if payload.Username == "" || payload.Password == "" {
-			s.writeJSONError(w, "Missing username or password", http.StatusBadRequest)
+		s.writeJSON(w, messageResponse{Message: "New user registered successfully!"}, http.StatusCreated)
+	}
+}
+
+// handleLogin returns the handler for the /login route
+func (s *Server) handleLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload authPayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
 			return
 		}
 
-		// 3. Hash the password (using bcrypt)
-		hash, err := bcrypt.GenerateFromPassword([]byte(payload.Password), bcrypt.DefaultCost)
+		// Failures are counted per account and client address; refresh
+		// tokens are written, so compatibility mode issues none
+		pair, err := s.svc.Login(r.Context(), payload.Username, payload.Password, s.clientInfo(r, payload.DeviceLabel), !s.compat.enabled)
+		if errors.Is(err, chatservice.ErrLoginFailed) {
+			// Unknown username or wrong password: written from the one
+			// shared value, never a variant, so the two look the same
+			s.writeServiceError(w, chatservice.ErrLoginFailed)
+			return
+		}
 		if err != nil {
-			s.writeJSONError(w, fmt.Sprintf("Failed to hash password: %v", err), http.StatusInternalServerError)
+			s.writeServiceError(w, err)
+			return
+		}
+		if pair.TwoFactorToken != "" {
+			s.writeTwoFactorPending(w, pair.TwoFactorToken, pair.ExpiresIn)
+			return
+		}
+
+		s.writeJSON(w, newTokenResponse(pair), http.StatusOK)
+	}
+}
+
+type refreshPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// handleRefresh returns the handler for the /refresh route
+func (s *Server) handleRefresh() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload refreshPayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
 			return
 		}
 
-		// 4. Call the database logic
-		err = s.store.RegisterUser(r.Context(), payload.Username, string(hash))
+		pair, err := s.svc.Refresh(r.Context(), payload.RefreshToken)
 		if err != nil {
-			if err.Error() == "username already exists" {
-				s.writeJSONError(w, "Username already exists.", http.StatusConflict) // 409
-			} else {
-				s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
-			}
+			s.writeServiceError(w, err)
 			return
 		}
 
-		// 5. Send success response
-		s.writeJSON(w, map[string]string{"message": "New user registered successfully!"}, http.StatusCreated)
+		s.writeJSON(w, newTokenResponse(pair), http.StatusOK)
 	}
 }
 
-// handleLogin returns the handler for the /login route
-func (s *Server) handleLogin() http.HandlerFunc {
+// handleLogout returns the handler for the /logout route
+func (s *Server) handleLogout() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var payload authPayload
-
-		// 1. Parse the JSON body
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			s.writeJSONError(w, "Invalid JSON body", http.StatusBadRequest)
+		var payload refreshPayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
 			return
 		}
 
-		// 2. Validate input
-		if payload.Username == "" || payload.Password == "" {
-			s.writeJSONError(w, "Could not verify", http.StatusUnauthorized) // 401
+		if err := s.svc.Logout(r.Context(), payload.RefreshToken); err != nil {
+			s.writeServiceError(w, err)
 			return
 		}
 
-		// 3. Get user from DB
-		user, err := s.store.GetUserByUsername(r.Context(), payload.Username)
-		if err != nil {
-			s.writeJSONError(w, "Could not verify! Check username/password.", http.StatusUnauthorized)
+		s.writeJSON(w, messageResponse{Message: "Logged out."}, http.StatusOK)
+	}
+}
+
+// handleLogoutAll returns the handler for the /logout_all route
+func (s *Server) handleLogoutAll() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
 			return
 		}
 
-		// 4. Check password
-		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(payload.Password)); err != nil {
-			s.writeJSONError(w, "Could not verify! Check username/password.", http.StatusUnauthorized)
+		if err := s.svc.LogoutEverywhere(r.Context(), currentUser.ID); err != nil {
+			s.writeServiceError(w, err)
 			return
 		}
+		s.hub.Disconnect(currentUser.ID)
+
+		s.writeJSON(w, messageResponse{Message: "Logged out everywhere."}, http.StatusOK)
+	}
+}
 
-		// 5. Create JWT token
-		// Define your claims struct (must match what auth middleware expects)
-		type AppClaims struct {
-			UserID   int    `json:"user_id"`
-			Username string `json:"username"`
-			jwt.RegisteredClaims
+type changePasswordPayload struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+	DeviceLabel     string `json:"device_label"` // For the new session; optional
+}
+
+// handleChangePassword returns the handler for the /change_password route.
+// All sessions are signed out, so the response carries new tokens.
+func (s *Server) handleChangePassword() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
 		}
 
-		claims := AppClaims{
-			UserID:   user.ID,
-			Username: user.Username,
-			RegisteredClaims: jwt.RegisteredClaims{
-				ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-				IssuedAt:  jwt.NewNumericDate(time.Now()),
-			},
+		var payload changePasswordPayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
+			return
 		}
 
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err := token.SignedString([]byte(s.cfg.JWTSecret))
+		pair, err := s.svc.ChangePassword(r.Context(), currentUser.ID, payload.CurrentPassword, payload.NewPassword, s.clientInfo(r, payload.DeviceLabel))
 		if err != nil {
-			s.writeJSONError(w, fmt.Sprintf("Error creating token: %v", err), http.StatusInternalServerError)
+			s.writeServiceError(w, err)
 			return
 		}
+		s.hub.Disconnect(currentUser.ID)
 
-		// 6. Send token
-		s.writeJSON(w, map[string]string{"token": tokenString}, http.StatusOK)
+		s.writeJSON(w, newTokenResponse(pair), http.StatusOK)
 	}
 }
 
@@ -151,47 +354,107 @@ func (s *Server) handleUploadKey() http.HandlerFunc {
 		}
 
 		var payload keyPayload
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			s.writeJSONError(w, "Invalid JSON body", http.StatusBadRequest)
+		if !s.decodeJSON(w, r, config.PayloadKey, &payload) {
+			return
+		}
+
+		if err := s.svc.UploadKey(r.Context(), currentUser.ID, payload.PublicKey); err != nil {
+			s.writeServiceError(w, err)
 			return
 		}
 
-		if payload.PublicKey == "" {
-			s.writeJSONError(w, "Missing public_key", http.StatusBadRequest)
+		s.writeJSON(w, messageResponse{Message: "Public key uploaded successfully."}, http.StatusOK)
+	}
+}
+
+type getKeysPayload struct {
+	Usernames []string `json:"usernames"`
+}
+
+func (s *Server) handleGetKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
 			return
 		}
 
-		if err := s.store.UploadPublicKey(r.Context(), currentUser.ID, payload.PublicKey); err != nil {
-			s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		var payload getKeysPayload
+		if !s.decodeJSON(w, r, config.PayloadBatch, &payload) {
 			return
 		}
 
-		s.writeJSON(w, map[string]string{"message": "Public key uploaded successfully."}, http.StatusOK)
+		results, err := s.svc.GetKeys(r.Context(), currentUser.ID, payload.Usernames)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		s.writeBatch(w, results)
 	}
 }
 
 func (s *Server) handleGetKey() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
 		usernameToFind := r.URL.Query().Get("username")
-		if usernameToFind == "" {
-			s.writeJSONError(w, "Missing username query parameter.", http.StatusBadRequest)
+
+		key, err := s.svc.GetKey(r.Context(), currentUser.ID, usernameToFind)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, publicKeyResponse{Username: usernameToFind, PublicKey: key}, http.StatusOK)
+	}
+}
+
+type prekeysPayload struct {
+	Prekeys []store.Prekey `json:"prekeys"`
+}
+
+func (s *Server) handleUploadPrekeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
 			return
 		}
 
-		key, err := s.store.GetPublicKeyByUsername(r.Context(), usernameToFind)
+		var payload prekeysPayload
+		if !s.decodeJSON(w, r, config.PayloadKey, &payload) {
+			return
+		}
+
+		remaining, err := s.svc.UploadPrekeys(r.Context(), currentUser.ID, payload.Prekeys)
 		if err != nil {
-			if strings.Contains(err.Error(), "not found") {
-				s.writeJSONError(w, "User not found or has no public key.", http.StatusNotFound)
-			} else {
-				s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
-			}
+			s.writeServiceError(w, err)
 			return
 		}
 
-		s.writeJSON(w, map[string]string{
-			"username":   usernameToFind,
-			"public_key": key,
-		}, http.StatusOK)
+		s.writeJSON(w, prekeysRemainingResponse{PrekeysRemaining: remaining}, http.StatusOK)
+	}
+}
+
+func (s *Server) handleGetPrekeyBundle() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		bundle, err := s.svc.GetPrekeyBundle(r.Context(), currentUser.ID, r.URL.Query().Get("username"))
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, bundle, http.StatusOK)
 	}
 }
 
@@ -211,31 +474,33 @@ func (s *Server) handleRequestChat() http.HandlerFunc {
 		}
 
 		var payload chatRequestPayload
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			s.writeJSONError(w, "Invalid JSON body", http.StatusBadRequest)
+		if !s.decodeJSON(w, r, config.PayloadChatRequest, &payload) {
 			return
 		}
 
-		if payload.RecipientUsername == "" {
-			s.writeJSONError(w, "Missing recipient_username", http.StatusBadRequest)
+		accepted, err := s.svc.RequestChat(r.Context(), currentUser.ID, payload.RecipientUsername)
+		if err != nil {
+			s.writeServiceError(w, err)
 			return
 		}
 
-		err := s.store.RequestChat(r.Context(), currentUser.ID, payload.RecipientUsername)
-		if err != nil {
-			if strings.Contains(err.Error(), "recipient user not found") {
-				s.writeJSONError(w, "Recipient user not found.", http.StatusNotFound)
-			} else if strings.Contains(err.Error(), "already pending") {
-				s.writeJSONError(w, "Chat request already pending or accepted.", http.StatusConflict)
-			} else if strings.Contains(err.Error(), "yourself") {
-				s.writeJSONError(w, "Cannot send chat request to yourself.", http.StatusBadRequest)
-			} else {
-				s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		if accepted {
+			hasKey, err := s.svc.PartnerHasKey(r.Context(), payload.RecipientUsername)
+			if err != nil {
+				s.writeServiceError(w, err)
+				return
 			}
+			s.writeJSON(w, requestChatResponse{
+				Message:       fmt.Sprintf("%s had already requested a chat with you; you are now contacts.", payload.RecipientUsername),
+				PartnerHasKey: &hasKey,
+				Status:        "accepted",
+			}, http.StatusOK)
 			return
 		}
-
-		s.writeJSON(w, map[string]string{"message": fmt.Sprintf("Chat request sent to %s.", payload.RecipientUsername)}, http.StatusCreated)
+		s.writeJSON(w, requestChatResponse{
+			Message: fmt.Sprintf("Chat request sent to %s.", payload.RecipientUsername),
+			Status:  "pending",
+		}, http.StatusCreated)
 	}
 }
 
@@ -247,13 +512,26 @@ func (s *Server) handleGetChatRequests() http.HandlerFunc {
 			return
 		}
 
-		requests, err := s.store.GetChatRequests(r.Context(), currentUser.ID)
+		includeFiltered, _ := strconv.ParseBool(r.URL.Query().Get("include_filtered"))
+
+		version, err := s.svc.RelationshipsVersion(r.Context(), currentUser.ID)
 		if err != nil {
-			s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			s.writeServiceError(w, err)
+			return
+		}
+		etag := relationshipsETag(version)
+		if writeNotModified(w, r, etag) {
 			return
 		}
 
-		s.writeJSON(w, map[string][]store.PendingRequest{"pending_requests": requests}, http.StatusOK)
+		requests, err := s.svc.GetChatRequests(r.Context(), currentUser.ID, includeFiltered)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		setETag(w, etag)
+		s.writeJSON(w, pendingRequestsResponse{PendingRequests: requests}, http.StatusOK)
 	}
 }
 
@@ -266,27 +544,72 @@ func (s *Server) handleAcceptChat() http.HandlerFunc {
 		}
 
 		var payload chatRequestPayload
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			s.writeJSONError(w, "Invalid JSON body", http.StatusBadRequest)
+		if !s.decodeJSON(w, r, config.PayloadChatRequest, &payload) {
 			return
 		}
 
-		if payload.RequesterUsername == "" {
-			s.writeJSONError(w, "Missing requester_username", http.StatusBadRequest)
+		if err := s.svc.AcceptChat(r.Context(), currentUser.ID, payload.RequesterUsername); err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		hasKey, err := s.svc.PartnerHasKey(r.Context(), payload.RequesterUsername)
+		if err != nil {
+			s.writeServiceError(w, err)
 			return
 		}
 
-		err := s.store.AcceptChat(r.Context(), currentUser.ID, payload.RequesterUsername)
+		s.writeJSON(w, acceptChatResponse{
+			Message:       fmt.Sprintf("Chat request from %s accepted!", payload.RequesterUsername),
+			PartnerHasKey: hasKey,
+		}, http.StatusOK)
+	}
+}
+
+type acceptChatsPayload struct {
+	RequesterUsernames []string `json:"requester_usernames"`
+}
+
+func (s *Server) handleAcceptChats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		var payload acceptChatsPayload
+		if !s.decodeJSON(w, r, config.PayloadBatch, &payload) {
+			return
+		}
+
+		results, err := s.svc.AcceptChats(r.Context(), currentUser.ID, payload.RequesterUsernames)
 		if err != nil {
-			if strings.Contains(err.Error(), "not found") {
-				s.writeJSONError(w, "No pending request found from that user.", http.StatusNotFound)
-			} else {
-				s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
-			}
+			s.writeServiceError(w, err)
+			return
+		}
+		s.writeBatch(w, results)
+	}
+}
+
+func (s *Server) handleDeclineChat() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		var payload chatRequestPayload
+		if !s.decodeJSON(w, r, config.PayloadChatRequest, &payload) {
+			return
+		}
+
+		if err := s.svc.DeclineChat(r.Context(), currentUser.ID, payload.RequesterUsername); err != nil {
+			s.writeServiceError(w, err)
 			return
 		}
 
-		s.writeJSON(w, map[string]string{"message": fmt.Sprintf("Chat request from %s accepted!", payload.RequesterUsername)}, http.StatusOK)
+		s.writeJSON(w, messageResponse{Message: fmt.Sprintf("Chat request from %s declined.", payload.RequesterUsername)}, http.StatusOK)
 	}
 }
 
@@ -298,22 +621,117 @@ func (s *Server) handleGetContacts() http.HandlerFunc {
 			return
 		}
 
-		contacts, err := s.store.GetContacts(r.Context(), currentUser.ID)
+		version, err := s.svc.RelationshipsVersion(r.Context(), currentUser.ID)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		etag := relationshipsETag(version)
+		if writeNotModified(w, r, etag) {
+			return
+		}
+
+		contacts, err := s.svc.GetContacts(r.Context(), currentUser.ID)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		setETag(w, etag)
+		s.writeJSON(w, contactsResponse{Contacts: contacts}, http.StatusOK)
+	}
+}
+
+func (s *Server) handleGetRelationships() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		q := r.URL.Query()
+		limit, ok := s.intParam(w, q, "limit", 0, 1, chatservice.MaxRelationshipsLimit)
+		if !ok {
+			return
+		}
+
+		page, err := s.svc.GetRelationships(r.Context(), currentUser.ID, q.Get("after"), int(limit))
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, page, http.StatusOK)
+	}
+}
+
+// handleListConversations returns the user's conversations, most recent
+// first, paged with ?before=&limit=.
+func (s *Server) handleListConversations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		q := r.URL.Query()
+		limit, ok := s.intParam(w, q, "limit", 0, 1, chatservice.MaxConversationsLimit)
+		if !ok {
+			return
+		}
+		before, ok := s.intParam(w, q, "before", 0, 0, maxMessageIDParam)
+		if !ok {
+			return
+		}
+
+		page, err := s.svc.ListConversations(r.Context(), currentUser.ID, int(before), int(limit))
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, page, http.StatusOK)
+	}
+}
+
+// handleGetKeyLog returns key transparency log entries for ?username=, or
+// pages through the whole log with ?after=&limit=.
+func (s *Server) handleGetKeyLog() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		after, ok := s.intParam(w, q, "after", 0, 0, math.MaxInt64)
+		if !ok {
+			return
+		}
+		limit, ok := s.intParam(w, q, "limit", 0, 1, chatservice.MaxKeyLogLimit)
+		if !ok {
+			return
+		}
+
+		page, err := s.svc.GetKeyLog(r.Context(), q.Get("username"), after, int(limit))
 		if err != nil {
-			s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			s.writeServiceError(w, err)
 			return
 		}
 
-		s.writeJSON(w, map[string][]string{"contacts": contacts}, http.StatusOK)
+		s.writeJSON(w, page, http.StatusOK)
 	}
 }
 
 // --- Message Handlers ---
 
+// deliveryHintTimeout bounds how long /send_message waits on the hub for
+// its delivery_hint before answering "unknown".
+const deliveryHintTimeout = 5 * time.Millisecond
+
 type sendMessagePayload struct {
 	RecipientUsername string `json:"recipient_username"`
 	SenderBlob        string `json:"sender_blob"`
 	RecipientBlob     string `json:"recipient_blob"`
+	Sealed            bool   `json:"sealed"` // Store without the sender; sender_blob must be omitted
 }
 
 func (s *Server) handleSendMessage() http.HandlerFunc {
@@ -325,54 +743,116 @@ func (s *Server) handleSendMessage() http.HandlerFunc {
 		}
 
 		var payload sendMessagePayload
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			s.writeJSONError(w, "Invalid JSON body", http.StatusBadRequest)
+		if !s.decodeJSON(w, r, config.PayloadMessage, &payload) {
 			return
 		}
 
-		if payload.RecipientUsername == "" || payload.SenderBlob == "" || payload.RecipientBlob == "" {
-			s.writeJSONError(w, "Missing recipient_username, sender_blob, or recipient_blob", http.StatusBadRequest)
+		res, err := s.svc.SendMessage(r.Context(), currentUser.ID, chatservice.SendMessageRequest{
+			RecipientUsername: payload.RecipientUsername,
+			SenderBlob:        payload.SenderBlob,
+			RecipientBlob:     payload.RecipientBlob,
+			Sealed:            payload.Sealed,
+		})
+		if err != nil {
+			s.writeServiceError(w, err)
 			return
 		}
 
-		// 1. Send message and get back the new message's ID and the recipient's ID
-		newID, recipientID, err := s.store.SendMessage(r.Context(), currentUser.ID, payload.RecipientUsername, payload.SenderBlob, payload.RecipientBlob)
+		hint := websockets.HintUnknown
+		if !res.Remote {
+			hint = s.hub.DeliveryHint(res.RecipientID, deliveryHintTimeout)
+		}
+		s.writeJSON(w, sendMessageResponse{DeliveryHint: hint, Message: "Message sent successfully."}, http.StatusCreated)
+	}
+}
+
+func (s *Server) handleGetMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		partnerUsername := r.URL.Query().Get("username")
+
+		sinceID, ok := s.sinceIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		direction := r.URL.Query().Get("direction")
+		messages, snapshot, err := s.svc.GetMessages(r.Context(), currentUser.ID, partnerUsername, sinceID, direction)
 		if err != nil {
-			if strings.Contains(err.Error(), "recipient user not found") {
-				s.writeJSONError(w, "Recipient user not found.", http.StatusNotFound)
-			} else {
-				s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
-			}
+			s.writeServiceError(w, err)
+			return
+		}
+
+		// Message pages can be large; stream rather than buffer them
+		s.writeJSONStream(w, messagesResponse{MessageSnapshot: snapshot, Messages: messages}, http.StatusOK)
+	}
+}
+
+// handleGetSealedMessages returns sealed-sender messages received after ?since_id=.
+func (s *Server) handleGetSealedMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
 			return
 		}
 
-		// --- WebSocket Push Logic ---
-		// 2. Get the message object as the SENDER sees it
-		msgForSender, err := s.store.GetMessageForUser(r.Context(), newID, currentUser.ID)
+		sinceID, ok := s.sinceIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		messages, snapshot, err := s.svc.GetSealedMessages(r.Context(), currentUser.ID, sinceID)
 		if err != nil {
-			// Log this, but don't fail the HTTP request. The message is saved.
-			log.Printf("WS: could not get message %d for sender %d: %v", newID, currentUser.ID, err)
-		} else {
-			// 3. Push to sender's websocket (so all their devices get the new message)
-			s.hub.PushToUser(currentUser.ID, msgForSender)
+			s.writeServiceError(w, err)
+			return
 		}
 
-		// 4. Get the message object as the RECIPIENT sees it
-		msgForRecipient, err := s.store.GetMessageForUser(r.Context(), newID, recipientID)
+		// Message pages can be large; stream rather than buffer them
+		s.writeJSONStream(w, messagesResponse{MessageSnapshot: snapshot, Messages: messages}, http.StatusOK)
+	}
+}
+
+type sealedSenderPayload struct {
+	Username string `json:"username"`
+	Enabled  bool   `json:"enabled"`
+}
+
+// handleSetSealedSender sets the user's sealed-sender opt-in for one contact.
+func (s *Server) handleSetSealedSender() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		var payload sealedSenderPayload
+		if !s.decodeJSON(w, r, config.PayloadChatRequest, &payload) {
+			return
+		}
+
+		state, err := s.svc.SetSealedSender(r.Context(), currentUser.ID, payload.Username, payload.Enabled)
 		if err != nil {
-			log.Printf("WS: could not get message %d for recipient %d: %v", newID, recipientID, err)
-		} else {
-			// 5. Push to recipient's websocket
-			s.hub.PushToUser(recipientID, msgForRecipient)
+			s.writeServiceError(w, err)
+			return
 		}
-		// --- End WebSocket Push Logic ---
 
-		// 6. Send original HTTP success response
-		s.writeJSON(w, map[string]string{"message": "Message sent successfully."}, http.StatusCreated)
+		s.writeJSON(w, state, http.StatusOK)
 	}
 }
 
-func (s *Server) handleGetMessages() http.HandlerFunc {
+type markDeliveredPayload struct {
+	MessageIDs []int  `json:"message_ids"`
+	Via        string `json:"via"` // Optional: the "transport" the messages arrived by
+}
+
+func (s *Server) handleMarkDelivered() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		currentUser, ok := s.getUserFromContext(r)
 		if !ok {
@@ -380,32 +860,64 @@ func (s *Server) handleGetMessages() http.HandlerFunc {
 			return
 		}
 
-		partnerUsername := r.URL.Query().Get("username")
-		if partnerUsername == "" {
-			s.writeJSONError(w, "Missing username query parameter.", http.StatusBadRequest)
+		var payload markDeliveredPayload
+		if !s.decodeJSON(w, r, config.PayloadBatch, &payload) {
 			return
 		}
 
-		sinceIDStr := r.URL.Query().Get("since_id")
-		if sinceIDStr == "" {
-			sinceIDStr = "0"
+		results, err := s.svc.MarkDelivered(r.Context(), currentUser.ID, payload.MessageIDs, payload.Via)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
 		}
-		sinceID, err := strconv.Atoi(sinceIDStr)
+		s.writeBatch(w, results)
+	}
+}
+
+func (s *Server) handleGetMessageStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		messageID, ok := parseID(r.PathValue("id"))
+		if !ok {
+			s.writeJSONError(w, "Invalid message ID.", http.StatusBadRequest)
+			return
+		}
+
+		status, err := s.svc.GetMessageStatus(r.Context(), currentUser.ID, messageID)
 		if err != nil {
-			s.writeJSONError(w, "Invalid since_id parameter, must be an integer.", http.StatusBadRequest)
+			s.writeServiceError(w, err)
 			return
 		}
+		s.writeJSON(w, status, http.StatusOK)
+	}
+}
+
+// --- Sync Handlers ---
 
-		messages, err := s.store.GetMessages(r.Context(), currentUser.ID, partnerUsername, sinceID)
+func (s *Server) handleSync() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		since, ok := s.intParam(w, r.URL.Query(), "since", 0, 0, math.MaxInt64)
+		if !ok {
+			return
+		}
+
+		res, err := s.svc.Sync(r.Context(), currentUser.ID, since)
 		if err != nil {
-			if strings.Contains(err.Error(), "partner user not found") {
-				s.writeJSONError(w, "Partner user not found.", http.StatusNotFound)
-			} else {
-				s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
-			}
+			s.writeServiceError(w, err)
 			return
 		}
 
-		s.writeJSON(w, map[string][]store.Message{"messages": messages}, http.StatusOK)
+		s.writeJSON(w, res, http.StatusOK)
 	}
 }
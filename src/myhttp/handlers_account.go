@@ -0,0 +1,90 @@
+// src/myhttp/handlers_account.go
+package myhttp
+
+import (
+	"net/http"
+
+	"cryptachat-server/config"
+)
+
+// handleAccountSummary returns counts and dates describing the current user's data.
+func (s *Server) handleAccountSummary() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		summary, err := s.svc.AccountSummary(r.Context(), currentUser)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		s.writeJSON(w, summary, http.StatusOK)
+	}
+}
+
+type deleteAccountPayload struct {
+	Password string `json:"password"`
+}
+
+// handleDeleteAccount deletes the current user's account, confirmed by
+// their password, and closes their WebSocket.
+func (s *Server) handleDeleteAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		var payload deleteAccountPayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
+			return
+		}
+
+		if err := s.svc.DeleteAccount(r.Context(), currentUser.ID, payload.Password); err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		s.hub.Disconnect(currentUser.ID)
+
+		s.writeJSON(w, messageResponse{Message: "Account deleted."}, http.StatusOK)
+	}
+}
+
+type changeUsernamePayload struct {
+	Password    string `json:"password"`
+	NewUsername string `json:"new_username"`
+	DeviceLabel string `json:"device_label"` // For the new session; optional
+}
+
+// handleChangeUsername renames the current user, confirmed by their
+// password. As with /change_password, all sessions are signed out and the
+// WebSocket closed, so the response carries new tokens.
+func (s *Server) handleChangeUsername() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		var payload changeUsernamePayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
+			return
+		}
+
+		res, err := s.svc.ChangeUsername(r.Context(), currentUser.ID, payload.Password, payload.NewUsername, s.clientInfo(r, payload.DeviceLabel))
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		s.hub.Disconnect(currentUser.ID)
+
+		s.writeJSON(w, newChangeUsernameResponse(res), http.StatusOK)
+	}
+}
@@ -0,0 +1,85 @@
+// src/myhttp/handlers_account_test.go
+package myhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveAs sends a request with an optional bearer token and JSON body
+// through the server's full handler chain.
+func serveAs(s *Server, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// decodeBody decodes w's body into v, failing t if it isn't JSON.
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+}
+
+// TestChangeUsernameSignsOut renames alice and checks the tokens from
+// before the rename, which carry her old name, no longer work, while the
+// ones the rename returned do.
+func TestChangeUsernameSignsOut(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	registerAlice(t, s, 4, "correct horse battery")
+
+	login := postLogin(s, "alice", "correct horse battery")
+	if login.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", login.Code, login.Body)
+	}
+	var before tokenResponse
+	decodeBody(t, login, &before)
+
+	w := serveAs(s, http.MethodPost, "/change_username", before.Token,
+		`{"password":"correct horse battery","new_username":"Alicia"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("change_username: %d %s", w.Code, w.Body)
+	}
+	var after changeUsernameResponse
+	decodeBody(t, w, &after)
+	if after.Username != "alicia" || after.PreviousUsername != "alice" || after.Token == "" || after.RefreshToken == "" {
+		t.Fatalf("got %+v", after)
+	}
+
+	var refused struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	w = serveAs(s, http.MethodGet, "/me", before.Token, "")
+	decodeBody(t, w, &refused)
+	if w.Code != http.StatusUnauthorized || refused.Error.Code != CodeTokenRevoked {
+		t.Errorf("old access token: %d %s, want 401 %s", w.Code, w.Body, CodeTokenRevoked)
+	}
+	w = serveAs(s, http.MethodPost, "/refresh", "", `{"refresh_token":"`+before.RefreshToken+`"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("old refresh token: %d %s, want 401", w.Code, w.Body)
+	}
+
+	w = serveAs(s, http.MethodGet, "/me", after.Token, "")
+	var me meResponse
+	decodeBody(t, w, &me)
+	if w.Code != http.StatusOK || me.Username != "alicia" {
+		t.Errorf("new access token: %d %s, want alicia", w.Code, w.Body)
+	}
+	w = serveAs(s, http.MethodPost, "/refresh", "", `{"refresh_token":"`+after.RefreshToken+`"}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("new refresh token: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,416 @@
+// src/myhttp/handlers_admin.go
+package myhttp
+
+import (
+	"cryptachat-server/config"
+	"cryptachat-server/integrations"
+	"cryptachat-server/store"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleAdminRuntime reports what the instance thinks of its own deployment.
+func (s *Server) handleAdminRuntime() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		outboxStats, err := s.store.GetOutboxStats(r.Context())
+		if err != nil {
+			s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var peers []store.PeerStatus
+		if s.cfg.FederationEnabled() {
+			peers, err = s.store.GetPeerStatuses(r.Context(), s.cfg.FederationPeerNames())
+			if err != nil {
+				s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		findings := config.CheckDeployment(s.cfg)
+		if findings == nil {
+			findings = []config.Finding{}
+		}
+
+		s.writeJSON(w, adminRuntimeResponse{
+			HygieneFindings:    findings,
+			AllowInsecure:      s.cfg.AllowInsecure,
+			TLSEnabled:         s.cfg.TLSEnabled(),
+			ListenAddr:         s.cfg.ListenAddr(),
+			BcryptCost:         s.cfg.BcryptCost,
+			Outbox:             outboxStats,
+			WSBackpressure:     string(s.cfg.Runtime().WSBackpressurePolicy),
+			WSPushStats:        s.hub.Stats(),
+			WSGoroutines:       s.hub.Goroutines(),
+			SpamFilter:         s.svc.SpamStats(),
+			NewAccountFanout:   s.svc.FanoutStats(),
+			DeprecatedHits:     s.deprecations.snapshot(),
+			Federation:         peers,
+			HTTPResponses:      s.responses.snapshot(),
+			IntegrationPrivacy: s.privacy.Stats(),
+			Webhooks:           s.svc.WebhookStats(),
+			Push:               s.svc.PushStats(),
+			PasswordHashing:    s.svc.HashingStats(),
+			Schema:             s.compat.snapshot(),
+			BlobEncryption:     s.store.BlobEncryption(),
+			Connections:        s.conns.Stats(),
+			WriteBehind:        s.store.WriteBehindStats(),
+			UserCache:          s.store.UserCacheStats(),
+			IPRateLimits:       s.ipRateLimitStats(),
+		}, http.StatusOK)
+	}
+}
+
+// handleAdminReload reads the configuration again, like SIGHUP, and lists
+// the runtime settings applied and the changed settings that need a
+// restart. An invalid configuration gets 400 and changes nothing.
+func (s *Server) handleAdminReload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := s.cfg.Reload()
+		if err != nil {
+			log.Printf("CONFIG: reload failed, keeping the running configuration: %v", err)
+			s.writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if res.Applied == nil {
+			res.Applied = []string{}
+		}
+		if res.RestartRequired == nil {
+			res.RestartRequired = []string{}
+		}
+		s.writeJSON(w, res, http.StatusOK)
+	}
+}
+
+// handleAdminMetrics exports metrics in the Prometheus text format, for
+// scraping with the admin token as a bearer token.
+func (s *Server) handleAdminMetrics() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if _, err := s.svc.DeliveryLatency().WriteTo(w); err != nil {
+			log.Printf("HTTP: metrics response broke off: %v", err)
+		}
+	}
+}
+
+// handleAdminDashboard sums up the instance's health in one document, for
+// operators who don't scrape /admin/metrics. Everything but the queue
+// depths comes from this process's memory.
+func (s *Server) handleAdminDashboard() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		outboxStats, err := s.store.GetOutboxStats(r.Context())
+		if err != nil {
+			s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		queues := dashboardQueues{
+			OutboxPending:      outboxStats.Pending,
+			OutboxLagSeconds:   outboxStats.LagSeconds,
+			WriteBehindPending: s.store.WriteBehindStats().Pending,
+			WSQueuedBytes:      s.hub.Stats().QueuedBytes,
+		}
+		if s.cfg.FederationEnabled() {
+			peers, err := s.store.GetPeerStatuses(r.Context(), s.cfg.FederationPeerNames())
+			if err != nil {
+				s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, p := range peers {
+				queues.FederationPending += p.Pending
+			}
+		}
+
+		now := s.now()
+		conns := s.conns.Stats()
+		s.writeJSON(w, adminDashboardResponse{
+			Connections: dashboardConnections{
+				WebSockets:   s.hub.Connected(),
+				TrackedIPs:   conns.TrackedIPs,
+				RejectedHTTP: conns.RejectedHTTP,
+				RejectedWS:   conns.RejectedWS,
+			},
+			Database:    s.store.PoolStats(),
+			GeneratedAt: store.NewTimestamp(now),
+			Jobs:        s.store.JobRuns(),
+			Queues:      queues,
+			Requests:    s.traffic.summary(now),
+		}, http.StatusOK)
+	}
+}
+
+type legalHoldPayload struct {
+	Username string `json:"username"`
+	Hold     bool   `json:"hold"`
+}
+
+// handleAdminLegalHold sets or clears a user's legal hold, which exempts
+// their data from retention pruning.
+func (s *Server) handleAdminLegalHold() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload legalHoldPayload
+		if !s.decodeJSON(w, r, config.PayloadSettings, &payload) {
+			return
+		}
+		if payload.Username == "" {
+			s.writeJSONError(w, "Missing username", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.store.SetLegalHold(r.Context(), payload.Username, payload.Hold); err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				s.writeJSONError(w, "User not found.", http.StatusNotFound)
+			} else {
+				s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		s.writeJSON(w, legalHoldResponse{Username: payload.Username, LegalHold: payload.Hold}, http.StatusOK)
+	}
+}
+
+type registrationModePayload struct {
+	Mode string `json:"mode"` // open, invite_only or closed
+}
+
+// handleAdminRegistrationMode opens or closes registration, or makes it
+// invite-only, on every replica without a restart.
+func (s *Server) handleAdminRegistrationMode() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, _ := s.getUserFromContext(r) // nil with the admin token
+		var payload registrationModePayload
+		if !s.decodeJSON(w, r, config.PayloadSettings, &payload) {
+			return
+		}
+
+		change, err := s.svc.SetRegistrationMode(r.Context(), admin, payload.Mode)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		s.writeJSON(w, change, http.StatusOK)
+	}
+}
+
+// retentionState describes when one participant's copy of a message expires.
+type retentionState struct {
+	UserID        int              `json:"user_id"`
+	Pruned        bool             `json:"pruned"`
+	LegalHold     bool             `json:"legal_hold"`
+	RetentionDays int              `json:"retention_days"` // 0 = forever
+	ExpiresAt     *store.Timestamp `json:"expires_at"`
+}
+
+func (s *Server) retentionStateFor(r *http.Request, userID int, pruned, hold bool, insertedAt time.Time) (retentionState, error) {
+	settings, err := s.store.GetUserSettings(r.Context(), userID)
+	if err != nil {
+		return retentionState{}, err
+	}
+	st := retentionState{
+		UserID:        userID,
+		Pruned:        pruned,
+		LegalHold:     hold,
+		RetentionDays: store.EffectiveRetentionDays(settings, s.cfg.Runtime().MessageRetentionDays),
+	}
+	if !pruned && !hold && st.RetentionDays > 0 {
+		expires := store.NewTimestamp(insertedAt.AddDate(0, 0, st.RetentionDays))
+		st.ExpiresAt = &expires
+	}
+	return st, nil
+}
+
+// handleAdminMessageTrace follows one message through the delivery pipeline:
+// the stored row, its outbox event, every logged push outcome and the
+// retention state of each copy. Blob contents are never returned. Each
+// lookup is recorded in both participants' audit trail.
+func (s *Server) handleAdminMessageTrace() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		messageID, ok := parseID(r.PathValue("id"))
+		if !ok {
+			s.writeJSONError(w, "Invalid message id", http.StatusBadRequest)
+			return
+		}
+
+		trace, err := s.store.GetMessageTrace(r.Context(), messageID)
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				s.writeJSONError(w, "Message not found.", http.StatusNotFound)
+			} else {
+				s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		participants := []int{trace.SenderID, trace.RecipientID}
+		if trace.Sealed {
+			participants = []int{trace.RecipientID}
+		}
+		for _, userID := range participants {
+			if err := s.store.RecordAuditEvent(r.Context(), userID, "admin.message_trace",
+				map[string]interface{}{"message_id": messageID}); err != nil {
+				log.Printf("ADMIN: could not audit trace of message %d: %v", messageID, err)
+				s.writeJSONError(w, "Could not record audit event", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		deliveryLog, err := s.store.GetDeliveryLog(r.Context(), messageID)
+		if err != nil {
+			s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if deliveryLog == nil {
+			deliveryLog = []store.DeliveryLogEntry{}
+		}
+
+		// Sealed-sender messages never had a sender copy
+		senderRetention := retentionState{Pruned: true}
+		if !trace.Sealed {
+			senderRetention, err = s.retentionStateFor(r, trace.SenderID, trace.SenderCopyPruned, trace.SenderLegalHold, trace.InsertedAt.Time)
+			if err != nil {
+				s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		recipientRetention, err := s.retentionStateFor(r, trace.RecipientID, trace.RecipientCopyPruned, trace.RecipientLegalHold, trace.InsertedAt.Time)
+		if err != nil {
+			s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// The first successful push to the recipient is the closest thing to
+		// a delivery time the server knows about.
+		var firstPushedAt *store.Timestamp
+		for _, e := range deliveryLog {
+			if e.Stage == store.StageWSPush && e.UserID == trace.RecipientID && e.Outcome == "delivered" {
+				t := e.CreatedAt
+				firstPushedAt = &t
+				break
+			}
+		}
+
+		s.writeJSON(w, messageTraceResponse{
+			Message:                trace,
+			DeliveryLog:            deliveryLog,
+			RecipientFirstPushedAt: firstPushedAt,
+			Retention: map[string]retentionState{
+				"sender":    senderRetention,
+				"recipient": recipientRetention,
+			},
+			// Not recorded by this server: push pings are per user and
+			// coalesced, not per message, and clients do not send read
+			// receipts.
+			Untracked: []string{"push_notifications", "read_at"},
+		}, http.StatusOK)
+	}
+}
+
+type bootstrapAdminPayload struct {
+	Token    string `json:"token"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// handleBootstrapAdmin creates the first admin user. It is only routed when
+// BOOTSTRAP_ADMIN_TOKEN is set and answers 404 once an admin exists.
+func (s *Server) handleBootstrapAdmin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload bootstrapAdminPayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
+			return
+		}
+
+		if err := s.svc.BootstrapAdmin(r.Context(), payload.Token, payload.Username, payload.Password); err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, messageResponse{Message: "Admin user created. Bootstrap is now disabled."}, http.StatusCreated)
+	}
+}
+
+// handleAdminIntegrationPreview shows exactly what an outbound integration
+// would send for a synthetic event under the current privacy mode.
+func (s *Server) handleAdminIntegrationPreview() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		event := r.URL.Query().Get("event")
+		if event == "" {
+			s.writeErrorBody(w, "Missing event", map[string]interface{}{"events": integrations.Events()}, http.StatusBadRequest)
+			return
+		}
+
+		in, out, stripped, err := s.privacy.Preview(event)
+		if err != nil {
+			s.writeErrorBody(w, "Unknown event.", map[string]interface{}{"events": integrations.Events()}, http.StatusBadRequest)
+			return
+		}
+		if stripped == nil {
+			stripped = []string{}
+		}
+
+		s.writeJSON(w, integrationPreviewResponse{
+			Event:     event,
+			Mode:      s.privacy.Mode(),
+			Synthetic: in,
+			Payload:   out,
+			Stripped:  stripped,
+		}, http.StatusOK)
+	}
+}
+
+// Page sizes for /admin/conversations.
+const (
+	defaultConversationsLimit = 50
+	maxConversationsLimit     = 200
+)
+
+// handleAdminConversations lists per-conversation counters, largest first,
+// so operators can spot runaway conversations without scanning messages.
+// ?sort= is messages (default), bytes or recent; page with ?limit=&offset=.
+func (s *Server) handleAdminConversations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		sort := q.Get("sort")
+		if sort == "" {
+			sort = store.ConversationSortMessages
+		}
+		if !store.ValidConversationSort(sort) {
+			s.writeJSONError(w, "Invalid sort parameter, must be messages, bytes or recent.", http.StatusBadRequest)
+			return
+		}
+
+		n, ok := s.intParam(w, q, "limit", defaultConversationsLimit, 1, maxConversationsLimit)
+		if !ok {
+			return
+		}
+		limit := int(n)
+		n, ok = s.intParam(w, q, "offset", 0, 0, math.MaxInt32)
+		if !ok {
+			return
+		}
+		offset := int(n)
+
+		// Fetch one extra row to learn whether there is another page
+		conversations, err := s.store.ListConversationStats(r.Context(), sort, limit+1, offset)
+		if err != nil {
+			s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp := conversationsResponse{Sort: sort}
+		if len(conversations) > limit {
+			conversations = conversations[:limit]
+			next := offset + limit
+			resp.NextOffset = &next
+		}
+		if conversations == nil {
+			conversations = []store.ConversationStats{}
+		}
+		resp.Conversations = conversations
+		s.writeJSON(w, resp, http.StatusOK)
+	}
+}
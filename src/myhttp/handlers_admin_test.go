@@ -0,0 +1,95 @@
+// src/myhttp/handlers_admin_test.go
+package myhttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestBootstrapAdminRoute checks POST /bootstrap_admin only exists with
+// BOOTSTRAP_ADMIN_TOKEN set, and answers 404 once it has been used.
+func TestBootstrapAdminRoute(t *testing.T) {
+	const body = `{"token":"bootstrap-token-0123456789","username":"root","password":"correct horse battery"}`
+
+	s, _, _ := newTestServer(t)
+	if w := serveAs(s, http.MethodPost, "/bootstrap_admin", "", body); w.Code != http.StatusNotFound {
+		t.Errorf("without the token set: %d, want 404", w.Code)
+	}
+
+	s, st, _ := newTestServer(t, "BOOTSTRAP_ADMIN_TOKEN", "bootstrap-token-0123456789")
+	if err := s.svc.InitAdminBootstrap(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveAs(s, http.MethodPost, "/bootstrap_admin", "", body); w.Code != http.StatusCreated {
+		t.Fatalf("bootstrapping: %d %s", w.Code, w.Body)
+	}
+	if user, err := st.GetUserByUsername(context.Background(), "root"); err != nil || !user.IsAdmin {
+		t.Errorf("root is %+v (%v), want an admin", user, err)
+	}
+	if w := serveAs(s, http.MethodPost, "/bootstrap_admin", "", body); w.Code != http.StatusNotFound {
+		t.Errorf("reuse: %d %s, want 404", w.Code, w.Body)
+	}
+}
+
+// TestAdminRegistrationMode closes registration over POST
+// /admin/registration_mode and checks /server_info and /register follow.
+func TestAdminRegistrationMode(t *testing.T) {
+	const adminToken = "admin-token-0123456789abcdef"
+	s, _, _ := newTestServer(t, "ADMIN_TOKEN", adminToken)
+	setMode := func(body string) *httptest.ResponseRecorder {
+		return serveAs(s, http.MethodPost, apiPrefix+"/admin/registration_mode", adminToken, body)
+	}
+	mode := func() string {
+		t.Helper()
+		var info struct {
+			Mode           string `json:"registration_mode"`
+			InviteRequired bool   `json:"invite_required_registration"`
+		}
+		decodeBody(t, serveAs(s, http.MethodGet, apiPrefix+"/server_info", "", ""), &info)
+		if info.InviteRequired != (info.Mode == "invite_only") {
+			t.Errorf("mode %s with invite_required_registration %v", info.Mode, info.InviteRequired)
+		}
+		return info.Mode
+	}
+
+	if got := mode(); got != "open" {
+		t.Fatalf("starting mode %s", got)
+	}
+	if w := serveAs(s, http.MethodPost, apiPrefix+"/admin/registration_mode", "", `{"mode":"closed"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("without the admin token: %d", w.Code)
+	}
+	if w := setMode(`{"mode":"shut"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown mode: %d", w.Code)
+	}
+
+	w := setMode(`{"mode":"closed"}`)
+	var change struct {
+		Mode        string `json:"mode"`
+		Previous    string `json:"previous"`
+		Propagation int    `json:"propagation_seconds"`
+	}
+	decodeBody(t, w, &change)
+	if w.Code != http.StatusOK || change.Mode != "closed" || change.Previous != "open" || change.Propagation != 5 {
+		t.Errorf("closing: %d %+v", w.Code, change)
+	}
+	if got := mode(); got != "closed" {
+		t.Errorf("server_info after closing: %s", got)
+	}
+	w = serveAs(s, http.MethodPost, apiPrefix+"/register", "", `{"username":"alice","password":"correct horse battery"}`)
+	var refused struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	decodeBody(t, w, &refused)
+	if w.Code != http.StatusForbidden || refused.Error.Code != "registration_closed" {
+		t.Errorf("registering while closed: %d %s", w.Code, w.Body)
+	}
+
+	setMode(`{"mode":"invite_only"}`)
+	if got := mode(); got != "invite_only" {
+		t.Errorf("server_info after requiring invites: %s", got)
+	}
+}
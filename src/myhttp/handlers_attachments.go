@@ -0,0 +1,158 @@
+// src/myhttp/handlers_attachments.go
+package myhttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"cryptachat-server/config"
+)
+
+type initiateAttachmentPayload struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// handleInitiateAttachment starts a chunked upload of the caller's
+// encrypted attachment.
+func (s *Server) handleInitiateAttachment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		var payload initiateAttachmentPayload
+		if !s.decodeJSON(w, r, config.PayloadAttachment, &payload) {
+			return
+		}
+
+		upload, err := s.svc.InitiateAttachment(r.Context(), currentUser.ID, payload.Size, payload.SHA256)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, upload, http.StatusCreated)
+	}
+}
+
+// handlePutAttachmentChunk stores one chunk of an upload. The body is the
+// raw chunk, and X-Chunk-SHA256 its SHA-256 in hex.
+func (s *Server) handlePutAttachmentChunk() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		n, err := strconv.Atoi(r.PathValue("n"))
+		if err != nil {
+			s.writeJSONError(w, "Invalid chunk number.", http.StatusBadRequest)
+			return
+		}
+		limit := int64(s.cfg.Attachments.ChunkBytes)
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				s.writeJSONError(w, fmt.Sprintf("Chunks are at most %d bytes.", limit), http.StatusRequestEntityTooLarge)
+			} else {
+				s.writeJSONError(w, "Could not read the chunk.", http.StatusBadRequest)
+			}
+			return
+		}
+
+		err = s.svc.PutAttachmentChunk(r.Context(), currentUser.ID, r.PathValue("id"), n, data, r.Header.Get("X-Chunk-SHA256"))
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, messageResponse{Message: "Chunk stored."}, http.StatusOK)
+	}
+}
+
+// handleAttachmentStatus reports which chunks of an upload have arrived.
+func (s *Server) handleAttachmentStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		status, err := s.svc.AttachmentStatus(r.Context(), currentUser.ID, r.PathValue("id"))
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, status, http.StatusOK)
+	}
+}
+
+// handleCompleteAttachment assembles an upload once all its chunks are in.
+func (s *Server) handleCompleteAttachment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		upload, err := s.svc.CompleteAttachment(r.Context(), currentUser.ID, r.PathValue("id"))
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, upload, http.StatusOK)
+	}
+}
+
+// handleGetAttachment streams a completed attachment to any signed-in
+// user who has its ID.
+func (s *Server) handleGetAttachment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		blob, size, err := s.svc.OpenAttachment(r.Context(), r.PathValue("id"))
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		defer blob.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.Copy(w, blob); err != nil {
+			s.responses.streamFailed.Add(1)
+			log.Printf("HTTP: attachment download broke off: %v", err)
+		}
+	}
+}
+
+// handleDeleteAttachment deletes the caller's attachment or upload.
+func (s *Server) handleDeleteAttachment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		if err := s.svc.DeleteAttachment(r.Context(), currentUser.ID, r.PathValue("id")); err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, messageResponse{Message: "Attachment deleted."}, http.StatusOK)
+	}
+}
@@ -0,0 +1,124 @@
+// src/myhttp/handlers_attachments_test.go
+package myhttp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"cryptachat-server/attachments"
+	"cryptachat-server/chatservice"
+)
+
+// TestAttachmentUpload uploads an attachment over HTTP with its first
+// chunk lost, resumes it, and downloads it.
+func TestAttachmentUpload(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "attachments")
+	s, _, _ := newTestServer(t, "ATTACHMENTS_DIR", dir, "ATTACHMENT_CHUNK_BYTES", "65536")
+	blobs, err := attachments.NewFSStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.svc.EnableAttachments(blobs)
+	registerAlice(t, s, 4, "correct horse battery")
+	var login tokenResponse
+	decodeBody(t, postLogin(s, "alice", "correct horse battery"), &login)
+
+	var info struct {
+		Attachments chatservice.AttachmentsFeature `json:"attachments"`
+	}
+	decodeBody(t, serveAs(s, http.MethodGet, apiPrefix+"/server_info", "", ""), &info)
+	if !info.Attachments.Enabled || info.Attachments.ChunkBytes != 65536 || info.Attachments.UploadTTLSeconds != 86400 {
+		t.Errorf("server_info: %+v", info.Attachments)
+	}
+
+	blob := bytes.Repeat([]byte("sealed"), 20000) // 120000 bytes in two chunks
+	sum := sha256.Sum256(blob)
+	w := serveAs(s, http.MethodPost, apiPrefix+"/attachments/initiate", login.Token,
+		fmt.Sprintf(`{"size":%d,"sha256":"%x"}`, len(blob), sum))
+	var upload chatservice.AttachmentUpload
+	decodeBody(t, w, &upload)
+	if w.Code != http.StatusCreated || upload.ChunkCount != 2 {
+		t.Fatalf("initiating: %d %s", w.Code, w.Body)
+	}
+	base := apiPrefix + "/attachments/" + upload.UploadID
+
+	putChunk := func(n int, data []byte, digest bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, fmt.Sprintf("%s/chunks/%d", base, n), bytes.NewReader(data))
+		r.Header.Set("Authorization", "Bearer "+login.Token)
+		if digest {
+			sum := sha256.Sum256(data)
+			r.Header.Set("X-Chunk-SHA256", hex.EncodeToString(sum[:]))
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	if w := putChunk(1, blob[65536:], false); w.Code != http.StatusBadRequest {
+		t.Errorf("a chunk without its digest: %d %s", w.Code, w.Body)
+	}
+	if w := putChunk(0, blob[:65537], true); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("a chunk over ATTACHMENT_CHUNK_BYTES: %d %s", w.Code, w.Body)
+	}
+	if w := putChunk(1, blob[65536:], true); w.Code != http.StatusOK {
+		t.Fatalf("chunk 1: %d %s", w.Code, w.Body)
+	}
+
+	w = serveAs(s, http.MethodPost, base+"/complete", login.Token, "")
+	var refused struct {
+		Error struct {
+			Code    string `json:"code"`
+			Missing []int  `json:"missing"`
+		} `json:"error"`
+	}
+	decodeBody(t, w, &refused)
+	if w.Code != http.StatusConflict || refused.Error.Code != chatservice.CodeChunksMissing || !slices.Equal(refused.Error.Missing, []int{0}) {
+		t.Errorf("completing without chunk 0: %d %s", w.Code, w.Body)
+	}
+	var status chatservice.AttachmentStatus
+	decodeBody(t, serveAs(s, http.MethodGet, base+"/status", login.Token, ""), &status)
+	if !slices.Equal(status.Received, []int{1}) || !slices.Equal(status.Missing, []int{0}) {
+		t.Errorf("status: %+v", status)
+	}
+
+	if w := putChunk(0, blob[:65536], true); w.Code != http.StatusOK {
+		t.Fatalf("chunk 0: %d %s", w.Code, w.Body)
+	}
+	if w := serveAs(s, http.MethodPost, base+"/complete", login.Token, ""); w.Code != http.StatusOK {
+		t.Fatalf("completing: %d %s", w.Code, w.Body)
+	}
+
+	w = serveAs(s, http.MethodGet, base, login.Token, "")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), blob) ||
+		w.Header().Get("Content-Length") != "120000" || w.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("downloading: %d, %d bytes, headers %v", w.Code, w.Body.Len(), w.Header())
+	}
+	if w := serveAs(s, http.MethodGet, base, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("downloading signed out: %d", w.Code)
+	}
+	if w := serveAs(s, http.MethodDelete, base, login.Token, ""); w.Code != http.StatusOK {
+		t.Errorf("deleting: %d %s", w.Code, w.Body)
+	}
+	if w := serveAs(s, http.MethodGet, base, login.Token, ""); w.Code != http.StatusNotFound {
+		t.Errorf("downloading a deleted attachment: %d", w.Code)
+	}
+}
+
+func TestAttachmentsDisabled(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	registerAlice(t, s, 4, "correct horse battery")
+	var login tokenResponse
+	decodeBody(t, postLogin(s, "alice", "correct horse battery"), &login)
+
+	w := serveAs(s, http.MethodPost, apiPrefix+"/attachments/initiate", login.Token,
+		`{"size":10,"sha256":"`+hex.EncodeToString(make([]byte, 32))+`"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("initiating without ATTACHMENTS_DIR: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,282 @@
+// src/myhttp/handlers_audit.go
+package myhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cryptachat-server/store"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+	// defaultAuditDays is the range of /admin/audit/daily without ?since=.
+	defaultAuditDays = 30
+)
+
+// Reading the audit log is itself audited, as auditAccessed. Repeats of
+// the same read by the same admin within auditAccessDedup are recorded
+// once, so a dashboard polling the log, or paging through it, doesn't
+// flood it with records of its own reads.
+const (
+	auditAccessed    = "admin.audit_accessed"
+	auditAccessDedup = 10 * time.Minute
+)
+
+// auditReads remembers recorded audit log reads for auditAccessDedup.
+type auditReads struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// recent reports whether key was recorded within auditAccessDedup of now.
+func (a *auditReads) recent(key string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	at, ok := a.seen[key]
+	return ok && now.Sub(at) < auditAccessDedup
+}
+
+// mark records key at now and forgets keys past auditAccessDedup.
+func (a *auditReads) mark(key string, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.seen == nil {
+		a.seen = make(map[string]time.Time)
+	}
+	for k, at := range a.seen {
+		if now.Sub(at) >= auditAccessDedup {
+			delete(a.seen, k)
+		}
+	}
+	a.seen[key] = now
+}
+
+// auditQuery is the parsed filter of the /admin/audit routes.
+type auditQuery struct {
+	filter store.AuditFilter
+	params map[string]string // As given, for the access record
+}
+
+// parseAuditQuery reads ?user=&type=&since=&until=. type is a comma-separated
+// list of event types; since and until are RFC 3339 times or YYYY-MM-DD
+// dates (UTC midnight). It writes the error response and returns false on
+// bad input.
+func (s *Server) parseAuditQuery(w http.ResponseWriter, r *http.Request) (auditQuery, bool) {
+	q := r.URL.Query()
+	aq := auditQuery{params: map[string]string{}}
+
+	if v := q.Get("user"); v != "" {
+		userID, err := s.store.GetUserIDByUsername(r.Context(), v)
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				s.writeJSONError(w, "User not found.", http.StatusNotFound)
+			} else {
+				s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			}
+			return auditQuery{}, false
+		}
+		aq.filter.UserID = userID
+		aq.params["user"] = v
+	}
+	for _, v := range q["type"] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				aq.filter.Types = append(aq.filter.Types, t)
+			}
+		}
+	}
+	if len(aq.filter.Types) > 0 {
+		aq.params["type"] = strings.Join(aq.filter.Types, ",")
+	}
+	for _, bound := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &aq.filter.Since}, {"until", &aq.filter.Until}} {
+		v := q.Get(bound.name)
+		if v == "" {
+			continue
+		}
+		t, err := parseAuditTime(v)
+		if err != nil {
+			s.writeJSONError(w, fmt.Sprintf("Invalid %s parameter, must be an RFC 3339 time or YYYY-MM-DD.", bound.name), http.StatusBadRequest)
+			return auditQuery{}, false
+		}
+		*bound.dst = t
+		aq.params[bound.name] = v
+	}
+	if !aq.filter.Since.IsZero() && !aq.filter.Until.IsZero() && !aq.filter.Since.Before(aq.filter.Until) {
+		s.writeJSONError(w, "since must be before until.", http.StatusBadRequest)
+		return auditQuery{}, false
+	}
+	return aq, true
+}
+
+func parseAuditTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// recordAuditAccess audits a read of the audit log, unless the same admin
+// made the same read within auditAccessDedup. Admins authenticated with the
+// admin token have no user, so their reads are recorded without one.
+func (s *Server) recordAuditAccess(r *http.Request, endpoint string, aq auditQuery, dedup bool) error {
+	actorID, via := 0, "admin_token"
+	if user, ok := s.getUserFromContext(r); ok {
+		actorID, via = user.ID, "admin_user"
+	}
+
+	params, _ := json.Marshal(aq.params) // Map keys are sorted
+	key := strconv.Itoa(actorID) + " " + endpoint + " " + string(params)
+	now := s.now()
+	if dedup && s.auditReads.recent(key, now) {
+		return nil
+	}
+	err := s.store.RecordAuditEvent(r.Context(), actorID, auditAccessed, map[string]interface{}{
+		"endpoint": endpoint,
+		"filter":   aq.params,
+		"via":      via,
+	})
+	if err != nil {
+		return err
+	}
+	s.auditReads.mark(key, now)
+	return nil
+}
+
+// handleAdminAudit lists audit events matching the filter (see
+// parseAuditQuery), newest first. Page with ?limit= and ?before=, passing
+// the previous page's next_before.
+func (s *Server) handleAdminAudit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		aq, ok := s.parseAuditQuery(w, r)
+		if !ok {
+			return
+		}
+		q := r.URL.Query()
+		n, ok := s.intParam(w, q, "limit", defaultAuditLimit, 1, maxAuditLimit)
+		if !ok {
+			return
+		}
+		limit := int(n)
+		before, ok := s.intParam(w, q, "before", 0, 1, math.MaxInt64)
+		if !ok {
+			return
+		}
+
+		if err := s.recordAuditAccess(r, "list", aq, true); err != nil {
+			log.Printf("ADMIN: could not audit audit log read: %v", err)
+			s.writeJSONError(w, "Could not record audit event", http.StatusInternalServerError)
+			return
+		}
+
+		// Fetch one extra row to learn whether there is another page
+		events, err := s.store.ListAuditEvents(r.Context(), aq.filter, before, limit+1)
+		if err != nil {
+			s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var resp auditEventsResponse
+		if len(events) > limit {
+			events = events[:limit]
+			next := events[limit-1].ID
+			resp.NextBefore = &next
+		}
+		if events == nil {
+			events = []store.AuditEvent{}
+		}
+		resp.Events = events
+		s.writeJSON(w, resp, http.StatusOK)
+	}
+}
+
+// handleAdminAuditDaily counts audit events matching the filter per UTC day
+// and event type, for dashboards. Without ?since= it covers the last
+// defaultAuditDays days.
+func (s *Server) handleAdminAuditDaily() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		aq, ok := s.parseAuditQuery(w, r)
+		if !ok {
+			return
+		}
+		if aq.filter.Since.IsZero() {
+			end := s.now()
+			if !aq.filter.Until.IsZero() {
+				end = aq.filter.Until
+			}
+			y, m, d := end.UTC().AddDate(0, 0, -defaultAuditDays).Date()
+			aq.filter.Since = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		}
+
+		if err := s.recordAuditAccess(r, "daily", aq, true); err != nil {
+			log.Printf("ADMIN: could not audit audit log read: %v", err)
+			s.writeJSONError(w, "Could not record audit event", http.StatusInternalServerError)
+			return
+		}
+
+		counts, err := s.store.CountAuditEventsByDay(r.Context(), aq.filter)
+		if err != nil {
+			s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if counts == nil {
+			counts = []store.AuditDayCount{}
+		}
+		resp := auditDailyResponse{Counts: counts, Since: store.NewTimestamp(aq.filter.Since)}
+		if !aq.filter.Until.IsZero() {
+			until := store.NewTimestamp(aq.filter.Until)
+			resp.Until = &until
+		}
+		s.writeJSON(w, resp, http.StatusOK)
+	}
+}
+
+// handleAdminAuditExport streams every audit event matching the filter,
+// oldest first, as NDJSON: one event per line, in the same form as
+// /admin/audit. Exports are always recorded. If the export breaks off, the
+// last line may be cut short; resume with ?since= at the last complete
+// event's created_at and drop the repeats by id.
+func (s *Server) handleAdminAuditExport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		aq, ok := s.parseAuditQuery(w, r)
+		if !ok {
+			return
+		}
+		if err := s.recordAuditAccess(r, "export", aq, false); err != nil {
+			log.Printf("ADMIN: could not audit audit log export: %v", err)
+			s.writeJSONError(w, "Could not record audit event", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="audit-%s.ndjson"`, s.now().UTC().Format("2006-01-02")))
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w) // Encode ends each event with a newline
+		rc := http.NewResponseController(w)
+		n := 0
+		err := s.store.ExportAuditEvents(r.Context(), aq.filter, func(e store.AuditEvent) error {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+			if n++; n%1000 == 0 {
+				_ = rc.Flush()
+			}
+			return nil
+		})
+		if err != nil {
+			s.responses.streamFailed.Add(1)
+			log.Printf("HTTP: audit export broke off after %d events: %v", n, err)
+		}
+	}
+}
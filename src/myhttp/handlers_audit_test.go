@@ -0,0 +1,88 @@
+// src/myhttp/handlers_audit_test.go
+package myhttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cryptachat-server/store"
+)
+
+// TestAuditLogReadsAreAudited reads the audit log as an admin and checks
+// each distinct read is recorded once per auditAccessDedup, exports every
+// time, and bad filters are refused before anything is recorded.
+func TestAuditLogReadsAreAudited(t *testing.T) {
+	const adminToken = "admin-token-0123456789abcdef"
+	s, st, clk := newTestServer(t, "ADMIN_TOKEN", adminToken)
+	accesses := func() int {
+		t.Helper()
+		events, err := st.ListAuditEvents(context.Background(), store.AuditFilter{Types: []string{auditAccessed}}, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(events)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		t.Helper()
+		return serveAs(s, http.MethodGet, apiPrefix+path, adminToken, "")
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := get("/admin/audit?type=login"); w.Code != http.StatusOK {
+			t.Fatalf("list: %d %s", w.Code, w.Body)
+		}
+	}
+	if n := accesses(); n != 1 {
+		t.Errorf("three identical reads recorded %d times, want once", n)
+	}
+	get("/admin/audit?type=password_changed")
+	get("/admin/audit/daily?type=login")
+	if n := accesses(); n != 3 {
+		t.Errorf("two more distinct reads: %d recorded, want 3", n)
+	}
+	clk.Advance(auditAccessDedup)
+	get("/admin/audit?type=login")
+	if n := accesses(); n != 4 {
+		t.Errorf("a repeat after the dedup window: %d recorded, want 4", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		w := get("/admin/audit/export?type=" + auditAccessed)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("export: %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		lines := 0
+		for sc := bufio.NewScanner(strings.NewReader(w.Body.String())); sc.Scan(); lines++ {
+			var e store.AuditEvent
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil || e.EventType != auditAccessed {
+				t.Errorf("export line %q: %v", sc.Text(), err)
+			}
+		}
+		// Each export records itself before reading
+		if want := 5 + i; lines != want {
+			t.Errorf("export %d: %d lines, want %d", i+1, lines, want)
+		}
+	}
+
+	for _, bad := range []string{
+		"/admin/audit?since=yesterday",
+		"/admin/audit?since=2026-03-02&until=2026-03-01",
+		"/admin/audit?limit=0",
+		"/admin/audit/export?until=soon",
+	} {
+		if w := get(bad); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", bad, w.Code)
+		}
+	}
+	if w := get("/admin/audit?user=nobody"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown user: %d, want 404", w.Code)
+	}
+	if n := accesses(); n != 6 {
+		t.Errorf("refused reads were recorded: %d, want 6", n)
+	}
+}
@@ -0,0 +1,75 @@
+// src/myhttp/handlers_backup.go
+package myhttp
+
+import (
+	"net/http"
+
+	"cryptachat-server/config"
+)
+
+type backupPayload struct {
+	Blob string `json:"blob"`
+}
+
+// handlePutBackup stores a new version of the caller's encrypted key backup.
+func (s *Server) handlePutBackup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		var payload backupPayload
+		if !s.decodeJSON(w, r, config.PayloadBackup, &payload) {
+			return
+		}
+
+		version, err := s.svc.PutBackup(r.Context(), currentUser.ID, payload.Blob)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, backupStoredResponse{Message: "Backup stored.", Version: version}, http.StatusOK)
+	}
+}
+
+// handleGetBackup returns the newest backup. The caller must re-confirm their
+// password in the X-Confirm-Password header.
+func (s *Server) handleGetBackup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		backup, err := s.svc.GetBackup(r.Context(), currentUser, r.Header.Get("X-Confirm-Password"))
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		s.writeJSON(w, backup, http.StatusOK)
+	}
+}
+
+// handleDeleteBackup removes all stored backup versions.
+func (s *Server) handleDeleteBackup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		if err := s.svc.DeleteBackup(r.Context(), currentUser.ID); err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, messageResponse{Message: "Backup deleted."}, http.StatusOK)
+	}
+}
@@ -0,0 +1,84 @@
+// src/myhttp/handlers_contacts.go
+package myhttp
+
+import (
+	"net/http"
+
+	"cryptachat-server/config"
+	"cryptachat-server/contactdoc"
+)
+
+// handleExportContacts returns the caller's contacts as a signed document
+// for importing on another instance.
+func (s *Server) handleExportContacts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		doc, err := s.svc.ExportContacts(r.Context(), currentUser, r.Host+s.publicPath(""))
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, doc, http.StatusOK)
+	}
+}
+
+// handleImportContacts verifies an export document from another instance and
+// queues a chat request to each contact in it. The requests go out over time;
+// poll GET /import/contacts/{id} for progress.
+func (s *Server) handleImportContacts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		var doc contactdoc.Document
+		if !s.decodeJSON(w, r, config.PayloadContacts, &doc) {
+			return
+		}
+
+		id, err := s.svc.ImportContacts(r.Context(), currentUser, doc)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, contactImportQueuedResponse{
+			Message:  "Contact import queued.",
+			ImportID: id,
+			Contacts: len(doc.Contacts),
+		}, http.StatusAccepted)
+	}
+}
+
+// handleGetContactImport reports the progress of one of the caller's imports.
+func (s *Server) handleGetContactImport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		importID, ok := parseID(r.PathValue("id"))
+		if !ok {
+			s.writeJSONError(w, "Invalid import ID.", http.StatusBadRequest)
+			return
+		}
+
+		imp, err := s.svc.GetContactImport(r.Context(), currentUser.ID, importID)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, imp, http.StatusOK)
+	}
+}
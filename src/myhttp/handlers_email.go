@@ -0,0 +1,121 @@
+// src/myhttp/handlers_email.go
+package myhttp
+
+import (
+	"net/http"
+
+	"cryptachat-server/config"
+)
+
+// handleGetEmail returns the user's recovery email (Protected).
+func (s *Server) handleGetEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		e, err := s.svc.GetRecoveryEmail(r.Context(), currentUser.ID)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		s.writeJSON(w, newEmailResponse(e), http.StatusOK)
+	}
+}
+
+type emailPayload struct {
+	Email string `json:"email"` // "" or null removes it
+}
+
+// handleSetEmail sets or removes the user's recovery email (Protected). A
+// new address comes back unverified, and is mailed a verification code.
+func (s *Server) handleSetEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+		var payload emailPayload
+		if !s.decodeJSON(w, r, config.PayloadSettings, &payload) {
+			return
+		}
+
+		e, err := s.svc.SetRecoveryEmail(r.Context(), currentUser, payload.Email)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		s.writeJSON(w, newEmailResponse(e), http.StatusOK)
+	}
+}
+
+type emailTokenPayload struct {
+	Token string `json:"token"`
+}
+
+// handleVerifyEmail redeems a verification code from the mail PUT /email
+// sent. The code identifies the account, so no login is needed.
+func (s *Server) handleVerifyEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload emailTokenPayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
+			return
+		}
+
+		if err := s.svc.VerifyRecoveryEmail(r.Context(), payload.Token); err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		s.writeJSON(w, messageResponse{Message: "Recovery email verified."}, http.StatusOK)
+	}
+}
+
+type passwordResetRequestPayload struct {
+	Email string `json:"email"`
+}
+
+// handleRequestPasswordReset mails a reset code to a verified recovery
+// email. The answer is the same whether or not any account has it.
+func (s *Server) handleRequestPasswordReset() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload passwordResetRequestPayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
+			return
+		}
+
+		if err := s.svc.RequestPasswordReset(r.Context(), payload.Email); err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		s.writeJSON(w, messageResponse{Message: "If an account has this verified recovery email, a reset code has been sent to it."}, http.StatusAccepted)
+	}
+}
+
+type resetPasswordPayload struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// handleResetPassword sets a new password with a reset code. Every session
+// is signed out, and no tokens are issued: the user logs in again, with
+// their second factor if they have one.
+func (s *Server) handleResetPassword() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload resetPasswordPayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
+			return
+		}
+
+		userID, err := s.svc.ResetPassword(r.Context(), payload.Token, payload.NewPassword)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		s.hub.Disconnect(userID)
+
+		s.writeJSON(w, messageResponse{Message: "Password reset. Log in with the new password."}, http.StatusOK)
+	}
+}
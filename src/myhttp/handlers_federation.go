@@ -0,0 +1,74 @@
+// src/myhttp/handlers_federation.go
+package myhttp
+
+import (
+	"context"
+	"net/http"
+
+	"cryptachat-server/config"
+	"cryptachat-server/federation"
+)
+
+const peerContextKey = contextKey("peer")
+
+// peerAuthMiddleware guards server-to-server routes: only configured
+// peers, by shared secret or client certificate, get through.
+func (s *Server) peerAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := federation.AuthenticatePeer(s.cfg, r)
+		if !ok {
+			s.writeJSONError(w, "Peer authentication failed.", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerContextKey, peer)))
+	}
+}
+
+// getPeerFromContext retrieves the peer set by peerAuthMiddleware.
+func (s *Server) getPeerFromContext(r *http.Request) (config.FederationPeer, bool) {
+	peer, ok := r.Context().Value(peerContextKey).(config.FederationPeer)
+	return peer, ok
+}
+
+// handleFederationInbox takes a chat request, acceptance or message
+// relayed by a peer.
+func (s *Server) handleFederationInbox() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := s.getPeerFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get peer from context", http.StatusInternalServerError)
+			return
+		}
+
+		var env federation.Envelope
+		if !s.decodeJSON(w, r, config.PayloadMessage, &env) {
+			return
+		}
+
+		if err := s.svc.ReceiveRelay(r.Context(), peer.Name, env); err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, messageResponse{Message: "Relay accepted."}, http.StatusOK)
+	}
+}
+
+// handleFederationKey returns a local user's public key to a peer.
+func (s *Server) handleFederationKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.getPeerFromContext(r); !ok {
+			s.writeJSONError(w, "Could not get peer from context", http.StatusInternalServerError)
+			return
+		}
+
+		username := r.URL.Query().Get("username")
+		key, err := s.svc.LocalKey(r.Context(), username)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, publicKeyResponse{Username: username, PublicKey: key}, http.StatusOK)
+	}
+}
@@ -0,0 +1,132 @@
+// src/myhttp/handlers_flags.go
+package myhttp
+
+import (
+	"net/http"
+	"strings"
+
+	"cryptachat-server/config"
+	"cryptachat-server/featureflags"
+)
+
+// handleMe returns the current user and the feature flags that apply to
+// them (Protected).
+func (s *Server) handleMe() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		// The auth middleware's lookup already has every field
+		s.writeJSON(w, meResponse{
+			CreatedAt:    currentUser.CreatedAt,
+			FeatureFlags: s.svc.Flags().ForUser(r.Context(), currentUser.ID),
+			HasPublicKey: currentUser.HasPublicKey,
+			ID:           currentUser.ID,
+			IsAdmin:      currentUser.IsAdmin,
+			LastLogin:    currentUser.LastLogin,
+			Username:     currentUser.Username,
+		}, http.StatusOK)
+	}
+}
+
+// handleAdminFeatureFlags lists every flag with its default, rollout and
+// how many users have overrides.
+func (s *Server) handleAdminFeatureFlags() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		counts, err := s.store.CountFlagOverrides(r.Context())
+		if err != nil {
+			s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		flags := s.svc.Flags()
+		defaults := flags.Defaults()
+		rollouts := flags.Rollouts(r.Context())
+
+		resp := adminFeatureFlagsResponse{Flags: []featureFlagState{}}
+		for _, name := range featureflags.Known() {
+			st := featureFlagState{
+				Default:      defaults[name],
+				Name:         name,
+				OverridesOff: counts[name].Disabled,
+				OverridesOn:  counts[name].Enabled,
+			}
+			if percent, ok := rollouts[name]; ok {
+				st.RolloutPercent = &percent
+			}
+			resp.Flags = append(resp.Flags, st)
+		}
+		s.writeJSON(w, resp, http.StatusOK)
+	}
+}
+
+type flagOverridePayload struct {
+	Enabled *bool `json:"enabled"` // null removes the override
+}
+
+// handleAdminSetFlagOverride forces a flag on or off for one user.
+func (s *Server) handleAdminSetFlagOverride() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flag := r.PathValue("flag")
+		if !featureflags.IsKnown(flag) {
+			s.writeJSONError(w, "Unknown feature flag.", http.StatusNotFound)
+			return
+		}
+		var payload flagOverridePayload
+		if !s.decodeJSON(w, r, config.PayloadSettings, &payload) {
+			return
+		}
+
+		user, err := s.store.GetUserByUsername(r.Context(), r.PathValue("username"))
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				s.writeJSONError(w, "User not found.", http.StatusNotFound)
+			} else {
+				s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		if err := s.svc.Flags().SetOverride(r.Context(), user.ID, flag, payload.Enabled); err != nil {
+			s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		s.writeJSON(w, flagOverrideResponse{
+			Enabled:  s.svc.Flags().Enabled(r.Context(), flag, user.ID),
+			Flag:     flag,
+			Override: payload.Enabled,
+			Username: user.Username,
+		}, http.StatusOK)
+	}
+}
+
+type flagRolloutPayload struct {
+	Percent *int `json:"percent"` // null removes the rollout
+}
+
+// handleAdminSetFlagRollout turns a flag on for a percentage of users.
+func (s *Server) handleAdminSetFlagRollout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flag := r.PathValue("flag")
+		if !featureflags.IsKnown(flag) {
+			s.writeJSONError(w, "Unknown feature flag.", http.StatusNotFound)
+			return
+		}
+		var payload flagRolloutPayload
+		if !s.decodeJSON(w, r, config.PayloadSettings, &payload) {
+			return
+		}
+		if payload.Percent != nil && (*payload.Percent < 0 || *payload.Percent > 100) {
+			s.writeJSONError(w, "percent must be between 0 and 100, or null.", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.svc.Flags().SetRollout(r.Context(), flag, payload.Percent); err != nil {
+			s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.writeJSON(w, flagRolloutResponse{Flag: flag, Percent: payload.Percent}, http.StatusOK)
+	}
+}
@@ -0,0 +1,51 @@
+// src/myhttp/handlers_info.go
+package myhttp
+
+import (
+	"log"
+	"net/http"
+
+	"cryptachat-server/chatservice"
+	"cryptachat-server/store"
+)
+
+// serverInfo is the /server_info body: the capability registry, the
+// feature flag defaults (GET /me has a user's actual values) and the current
+// key log head, so clients can compare heads with each other.
+type serverInfo struct {
+	*chatservice.Capabilities
+	FeatureFlags map[string]bool   `json:"feature_flags"`
+	KeyLogHead   *store.KeyLogHead `json:"key_log_head"`
+}
+
+// handleServerInfo lets clients discover the instance's capabilities (Unprotected).
+func (s *Server) handleServerInfo() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := serverInfo{
+			Capabilities: s.svc.Capabilities(r.Context()),
+			FeatureFlags: s.svc.Flags().Defaults(),
+		}
+		if head, err := s.svc.KeyLogHead(r.Context()); err == nil {
+			info.KeyLogHead = &head
+		} else {
+			// Capabilities are still useful without the head
+			log.Printf("SERVER_INFO: could not read key log head: %v", err)
+		}
+		s.writeJSON(w, info, http.StatusOK)
+	}
+}
+
+// handleJWKS publishes the public key access tokens are signed with, so
+// other services can verify them (Unprotected). With HS256 there is no
+// public key and the route answers 404.
+func (s *Server) handleJWKS() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jwks := s.cfg.TokenSigner.JWKS()
+		if jwks == nil {
+			s.writeJSONError(w, "Tokens are signed with a shared secret; there is no public key.", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		s.writeJSON(w, jwks, http.StatusOK)
+	}
+}
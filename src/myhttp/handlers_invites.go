@@ -0,0 +1,25 @@
+// src/myhttp/handlers_invites.go
+package myhttp
+
+import (
+	"net/http"
+)
+
+// handleCreateInvite mints an invite code for the user to hand to someone
+// who wants to register.
+func (s *Server) handleCreateInvite() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		invite, err := s.svc.CreateInvite(r.Context(), currentUser)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		s.writeJSON(w, invite, http.StatusCreated)
+	}
+}
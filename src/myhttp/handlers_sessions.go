@@ -0,0 +1,93 @@
+// src/myhttp/handlers_sessions.go
+package myhttp
+
+import (
+	"net/http"
+	"strconv"
+
+	"cryptachat-server/chatservice"
+	"cryptachat-server/store"
+)
+
+// deviceLabelHeader names the device of a login when its payload doesn't.
+const deviceLabelHeader = "X-Device-Label"
+
+// clientInfo describes the client of a login request for its session. The
+// payload's device label wins over the header's.
+func (s *Server) clientInfo(r *http.Request, deviceLabel string) chatservice.ClientInfo {
+	if deviceLabel == "" {
+		deviceLabel = r.Header.Get(deviceLabelHeader)
+	}
+	ip, _ := s.conns.ClientIP(r)
+	return chatservice.ClientInfo{IP: ip.String(), DeviceLabel: deviceLabel}
+}
+
+// getSessionFromContext returns the session of the request's access token,
+// 0 if it has none.
+func (s *Server) getSessionFromContext(r *http.Request) int64 {
+	sessionID, _ := r.Context().Value(sessionContextKey).(int64)
+	return sessionID
+}
+
+// handleListSessions lists the user's sessions, marking the caller's own
+// as current.
+func (s *Server) handleListSessions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		sessions, err := s.svc.ListSessions(r.Context(), currentUser.ID, s.getSessionFromContext(r))
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		s.markWSSession(currentUser.ID, sessions)
+		s.writeJSON(w, sessionsResponse{Sessions: sessions}, http.StatusOK)
+	}
+}
+
+// markWSSession marks the session holding userID's WebSocket, if it is
+// one of sessions.
+func (s *Server) markWSSession(userID int, sessions []chatservice.SessionInfo) {
+	conn, ok := s.hub.SessionConnection(userID)
+	if !ok {
+		return
+	}
+	for i := range sessions {
+		if sessions[i].ID == conn.SessionID {
+			connectedAt := store.NewTimestamp(conn.ConnectedAt)
+			lastActivity := store.NewTimestamp(conn.LastActivity)
+			sessions[i].WSConnected = true
+			sessions[i].WSConnectedAt = &connectedAt
+			sessions[i].WSLastActivity = &lastActivity
+		}
+	}
+}
+
+// handleRevokeSession signs the user out of one of their sessions, which
+// may be the caller's own. A WebSocket opened in that session is closed
+// with websockets.CloseSessionRevoked before it answers.
+func (s *Server) handleRevokeSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		sessionID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || sessionID <= 0 {
+			s.writeJSONError(w, "Invalid session ID.", http.StatusBadRequest)
+			return
+		}
+		if err := s.svc.RevokeSession(r.Context(), currentUser.ID, sessionID); err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+		s.hub.DisconnectSession(currentUser.ID, sessionID)
+		s.writeJSON(w, messageResponse{Message: "Session signed out."}, http.StatusOK)
+	}
+}
@@ -0,0 +1,108 @@
+// src/myhttp/handlers_settings.go
+package myhttp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"cryptachat-server/config"
+)
+
+func (s *Server) handleGetSettings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		settings, err := s.svc.GetSettings(r.Context(), currentUser.ID)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, settings, http.StatusOK)
+	}
+}
+
+// handleUpdateSettings applies a partial update. Only fields present in the
+// body change; "retention_days": null reverts to the server default and
+// "inbound_messages_per_hour": null removes the ceiling. push_badge_counts
+// can't be null.
+func (s *Server) handleUpdateSettings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		var payload map[string]json.RawMessage
+		if !s.decodeJSON(w, r, config.PayloadSettings, &payload) {
+			return
+		}
+
+		if raw, present := payload["retention_days"]; present {
+			var days *int
+			if err := json.Unmarshal(raw, &days); err != nil {
+				s.writeJSONError(w, "retention_days must be an integer or null", http.StatusBadRequest)
+				return
+			}
+			if err := s.svc.SetRetentionDays(r.Context(), currentUser.ID, days); err != nil {
+				s.writeServiceError(w, err)
+				return
+			}
+		}
+		if raw, present := payload["inbound_messages_per_hour"]; present {
+			var perHour *int
+			if err := json.Unmarshal(raw, &perHour); err != nil {
+				s.writeJSONError(w, "inbound_messages_per_hour must be an integer or null", http.StatusBadRequest)
+				return
+			}
+			if err := s.svc.SetInboundLimit(r.Context(), currentUser.ID, perHour); err != nil {
+				s.writeServiceError(w, err)
+				return
+			}
+		}
+		if raw, present := payload["push_badge_counts"]; present {
+			var enabled bool
+			if err := json.Unmarshal(raw, &enabled); err != nil || string(raw) == "null" {
+				s.writeJSONError(w, "push_badge_counts must be true or false", http.StatusBadRequest)
+				return
+			}
+			if err := s.svc.SetPushBadgeCounts(r.Context(), currentUser.ID, enabled); err != nil {
+				s.writeServiceError(w, err)
+				return
+			}
+		}
+
+		settings, err := s.svc.GetSettings(r.Context(), currentUser.ID)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, settings, http.StatusOK)
+	}
+}
+
+// handleUnreadCounts returns the numbers for an app icon badge. They are
+// cached for a couple of seconds and are what push payloads carry.
+func (s *Server) handleUnreadCounts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		counts, err := s.svc.UnreadCounts(r.Context(), currentUser.ID)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, counts, http.StatusOK)
+	}
+}
@@ -0,0 +1,60 @@
+// src/myhttp/handlers_share.go
+package myhttp
+
+import (
+	"net/http"
+
+	"cryptachat-server/config"
+)
+
+// handleGetSharePayload returns a signed payload naming the caller and
+// their current key, for a QR code or share link.
+func (s *Server) handleGetSharePayload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		payload, err := s.svc.CreateSharePayload(r.Context(), currentUser, s.publicURL(r))
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, payload, http.StatusOK)
+	}
+}
+
+type verifySharePayload struct {
+	Payload string `json:"payload"`
+}
+
+// handleVerifySharePayload checks a scanned share payload before the
+// client sends a chat request to the user it names.
+func (s *Server) handleVerifySharePayload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.getUserFromContext(r); !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		var p verifySharePayload
+		if !s.decodeJSON(w, r, config.PayloadKey, &p) {
+			return
+		}
+		if p.Payload == "" {
+			s.writeJSONError(w, "Payload is required.", http.StatusBadRequest)
+			return
+		}
+
+		check, err := s.svc.VerifySharePayload(r.Context(), p.Payload)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, check, http.StatusOK)
+	}
+}
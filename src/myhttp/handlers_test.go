@@ -0,0 +1,46 @@
+// src/myhttp/handlers_test.go
+package myhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cryptachat-server/chatservice"
+)
+
+// TestServiceErrorRetryGuidance checks each kind of service error is
+// served with its status and tells the client whether repeating the call
+// may help.
+func TestServiceErrorRetryGuidance(t *testing.T) {
+	s, _ := newOfflineServer(t)
+	tests := []struct {
+		err        *chatservice.Error
+		status     int
+		retryable  bool
+		retryAfter string
+	}{
+		{&chatservice.Error{Kind: chatservice.KindUnavailable, Message: "busy", Details: map[string]interface{}{"retry_after_seconds": 1}},
+			http.StatusServiceUnavailable, true, "1"},
+		{&chatservice.Error{Kind: chatservice.KindRateLimited, Message: "slow down", Details: map[string]interface{}{"retry_after_seconds": 30}},
+			http.StatusTooManyRequests, true, "30"},
+		{&chatservice.Error{Kind: chatservice.KindInternal, Message: "broken"}, http.StatusInternalServerError, false, ""},
+		{&chatservice.Error{Kind: chatservice.KindConflict, Message: "taken"}, http.StatusConflict, false, ""},
+		{&chatservice.Error{Kind: chatservice.KindNotFound, Message: "gone"}, http.StatusNotFound, false, ""},
+		{&chatservice.Error{Kind: chatservice.KindInvalid, Message: "bad"}, http.StatusBadRequest, false, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.writeServiceError(w, tt.err)
+		var body struct {
+			Error struct {
+				Retryable bool `json:"retryable"`
+			} `json:"error"`
+		}
+		decodeBody(t, w, &body)
+		if w.Code != tt.status || body.Error.Retryable != tt.retryable || w.Header().Get("Retry-After") != tt.retryAfter {
+			t.Errorf("%s: %d, retryable %v, Retry-After %q; want %d, %v, %q", tt.err.Message,
+				w.Code, body.Error.Retryable, w.Header().Get("Retry-After"), tt.status, tt.retryable, tt.retryAfter)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// src/myhttp/handlers_twofactor.go
+package myhttp
+
+import (
+	"net/http"
+	"time"
+
+	"cryptachat-server/config"
+)
+
+type twoFactorCodePayload struct {
+	Code string `json:"code"`
+}
+
+type twoFactorDisablePayload struct {
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+type twoFactorLoginPayload struct {
+	Code         string `json:"code"`
+	PendingToken string `json:"pending_token"`
+	DeviceLabel  string `json:"device_label"` // Optional
+}
+
+// handleEnableTwoFactor starts two-factor setup and returns the secret,
+// its otpauth:// URI and the recovery codes.
+func (s *Server) handleEnableTwoFactor() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		setup, err := s.svc.EnableTwoFactor(r.Context(), currentUser)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		// The secret and recovery codes must not end up in a cache
+		w.Header().Set("Cache-Control", "no-store")
+		s.writeJSON(w, setup, http.StatusOK)
+	}
+}
+
+// handleVerifyTwoFactor turns two-factor authentication on with a first code.
+func (s *Server) handleVerifyTwoFactor() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		var payload twoFactorCodePayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
+			return
+		}
+
+		if err := s.svc.VerifyTwoFactor(r.Context(), currentUser.ID, payload.Code); err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, messageResponse{Message: "Two-factor authentication is on."}, http.StatusOK)
+	}
+}
+
+// handleDisableTwoFactor turns two-factor authentication off, confirmed by
+// the password and a code.
+func (s *Server) handleDisableTwoFactor() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currentUser, ok := s.getUserFromContext(r)
+		if !ok {
+			s.writeJSONError(w, "Could not get user from context", http.StatusInternalServerError)
+			return
+		}
+
+		var payload twoFactorDisablePayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
+			return
+		}
+
+		if err := s.svc.DisableTwoFactor(r.Context(), currentUser, payload.Password, payload.Code); err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, messageResponse{Message: "Two-factor authentication is off."}, http.StatusOK)
+	}
+}
+
+// handleTwoFactorLogin exchanges the pending token from /login and a code
+// for the tokens /login would otherwise have returned.
+func (s *Server) handleTwoFactorLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload twoFactorLoginPayload
+		if !s.decodeJSON(w, r, config.PayloadAuth, &payload) {
+			return
+		}
+
+		pair, err := s.svc.TwoFactorLogin(r.Context(), payload.PendingToken, payload.Code, s.clientInfo(r, payload.DeviceLabel), !s.compat.enabled)
+		if err != nil {
+			s.writeServiceError(w, err)
+			return
+		}
+
+		s.writeJSON(w, newTokenResponse(pair), http.StatusOK)
+	}
+}
+
+// writeTwoFactorPending answers /login for a user with two-factor
+// authentication on.
+func (s *Server) writeTwoFactorPending(w http.ResponseWriter, pendingToken string, expiresIn time.Duration) {
+	s.writeJSON(w, twoFactorPendingResponse{
+		ExpiresIn:         int64(expiresIn / time.Second),
+		PendingToken:      pendingToken,
+		TwoFactorRequired: true,
+	}, http.StatusOK)
+}
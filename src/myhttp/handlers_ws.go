@@ -2,6 +2,7 @@
 package myhttp
 
 import (
+	"context"
 	"cryptachat-server/websockets"
 	"log"
 	"net/http"
@@ -22,6 +23,38 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// CodeTooManyConnections is the error code of requests and WebSocket
+// upgrades refused because their IP has too many connections open.
+const CodeTooManyConnections = "too_many_connections"
+
+const wsSlotContextKey = contextKey("ws_slot")
+
+// wsSlot is a WebSocket connection reserved for a client IP. The handler
+// keeps it once the upgrade succeeds; otherwise it is released on return.
+type wsSlot struct {
+	release func()
+	kept    bool
+}
+
+// wsConnLimitMiddleware refuses the upgrade with 429 when the client IP
+// already has its cap of WebSocket connections. It runs before auth so an
+// over-cap client costs no token check or store lookup.
+func (s *Server) wsConnLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, ok := s.conns.AcquireWS(r)
+		if !ok {
+			s.writeErrorBody(w, "Too many WebSocket connections from your address.",
+				map[string]interface{}{"code": CodeTooManyConnections}, http.StatusTooManyRequests)
+			return
+		}
+		slot := &wsSlot{release: release}
+		next(w, r.WithContext(context.WithValue(r.Context(), wsSlotContextKey, slot)))
+		if !slot.kept {
+			release()
+		}
+	}
+}
+
 // handleServeWS upgrades the connection and registers the client
 func (s *Server) handleServeWS() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -39,11 +72,21 @@ func (s *Server) handleServeWS() http.HandlerFunc {
 			return
 		}
 
-		// 3. Create and register the client
+		// 3. Create the client and queue the hello snapshot as its first frame
 		client := websockets.NewClient(s.hub, conn, currentUser.ID)
+		client.SetSession(s.getSessionFromContext(r))
+		if slot, ok := r.Context().Value(wsSlotContextKey).(*wsSlot); ok {
+			slot.kept = true
+			client.OnClose(slot.release)
+		}
+		if hello := s.buildHello(r.Context(), currentUser); hello != nil {
+			client.Enqueue(hello)
+		}
+
+		// 4. Register the client
 		client.Register() // This will send the client to the hub's register channel
 
-		// 4. Start the client's read/write pumps in separate goroutines
+		// 5. Start the client's read/write pumps in separate goroutines
 		go client.WritePump()
 		go client.ReadPump()
 	}
@@ -0,0 +1,116 @@
+package myhttp
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"cryptachat-server/config"
+	"cryptachat-server/ratelimit"
+)
+
+// CodeIPRateLimited is the error code of requests refused by a per-IP rate
+// limit on an unauthenticated route.
+const CodeIPRateLimited = "ip_rate_limited"
+
+// ipLimiter is one route's per-IP rate limit.
+type ipLimiter struct {
+	mu       sync.Mutex
+	limit    config.IPRateLimit     // What buckets is set to
+	buckets  *ratelimit.TokenBucket // Nil until the limit is first on
+	rejected atomic.Int64
+}
+
+// bucketsFor returns l's buckets set to limit, making them on first use.
+// The first request after a reload that changed the limit applies it; IPs
+// already tracked keep their tokens, up to the new burst.
+func (l *ipLimiter) bucketsFor(s *Server, limit config.IPRateLimit) *ratelimit.TokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.buckets == nil:
+		l.buckets = ratelimit.NewTokenBucket(limit.Burst, limit.Per, s.cfg.IPRateLimitMaxIPs)
+		l.buckets.SetClock(s.svc.Clock())
+	case limit != l.limit:
+		l.buckets.SetLimit(limit.Burst, limit.Per)
+	}
+	l.limit = limit
+	return l.buckets
+}
+
+// IPRateLimitStats describes one route's per-IP limit for /admin/runtime.
+type IPRateLimitStats struct {
+	Burst         int     `json:"burst"`
+	PeriodSeconds float64 `json:"period_seconds"`
+	TrackedIPs    int     `json:"tracked_ips"`
+	Evicted       int64   `json:"evicted"` // IPs forgotten to stay under IP_RATE_LIMIT_MAX_IPS
+	Rejected      int64   `json:"rejected"`
+}
+
+// ipRateLimit applies the per-IP limit named in RuntimeConfig.IPRateLimits
+// to h, answering 429 with Retry-After once a client IP has used its burst.
+// The limit is read on each request, so a reload changes or lifts it.
+// Client IPs are found like the connection limits find them, so both
+// honour TRUSTED_PROXIES.
+func (s *Server) ipRateLimit(name string, h http.HandlerFunc) http.HandlerFunc {
+	l := &ipLimiter{}
+	s.ipLimits[name] = l
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := s.cfg.Runtime().IPRateLimits[name]
+		if limit.Burst == 0 {
+			h(w, r)
+			return
+		}
+		ip, _ := s.conns.ClientIP(r)
+		if ok, wait := l.bucketsFor(s, limit).Allow(ipKey(ip)); !ok {
+			l.rejected.Add(1)
+			secs := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			s.writeErrorBody(w, "Too many requests from your address. Try again later.",
+				map[string]interface{}{"code": CodeIPRateLimited, "retry_after_seconds": secs},
+				http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// ipKey is the rate limit key of ip. IPv6 clients usually get a /64 each,
+// so the whole /64 shares one bucket.
+func ipKey(ip netip.Addr) string {
+	if ip.Is6() {
+		if p, err := ip.Prefix(64); err == nil {
+			return p.String()
+		}
+	}
+	return ip.String()
+}
+
+// ipRateLimitStats returns each limited route's current settings and
+// counters. Routes whose limit is off are left out.
+func (s *Server) ipRateLimitStats() map[string]IPRateLimitStats {
+	limits := s.cfg.Runtime().IPRateLimits
+	out := make(map[string]IPRateLimitStats, len(s.ipLimits))
+	for name, l := range s.ipLimits {
+		limit := limits[name]
+		if limit.Burst == 0 {
+			continue
+		}
+		st := IPRateLimitStats{
+			Burst:         limit.Burst,
+			PeriodSeconds: limit.Per.Seconds(),
+			Rejected:      l.rejected.Load(),
+		}
+		l.mu.Lock()
+		if l.buckets != nil {
+			st.TrackedIPs, st.Evicted = l.buckets.Stats()
+		}
+		l.mu.Unlock()
+		out[name] = st
+	}
+	return out
+}
@@ -0,0 +1,172 @@
+// src/myhttp/iplimit_test.go
+package myhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"cryptachat-server/config"
+	"cryptachat-server/connlimit"
+	"cryptachat-server/testutil"
+)
+
+// newIPLimitedLogin returns an offline server with the per-IP limit of
+// /login in front of a handler that does nothing, and a function sending
+// that handler a request from an address.
+func newIPLimitedLogin(t *testing.T, vars ...string) (*Server, *testutil.FakeClock, func(addr string) *httptest.ResponseRecorder) {
+	t.Helper()
+	s, clk := newOfflineServer(t, vars...)
+	s.conns = connlimit.New(0, 0, nil, s.cfg.TrustedProxyHeader)
+	s.ipLimits = make(map[string]*ipLimiter)
+	h := s.ipRateLimit(config.IPLimitLogin, func(w http.ResponseWriter, r *http.Request) {})
+	return s, clk, func(addr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/login", nil)
+		r.RemoteAddr = addr + ":1234"
+		h(w, r)
+		return w
+	}
+}
+
+// TestIPRateLimitFollowsReload reloads IP_RATE_LIMITS under a running
+// route and checks each request is judged by the limit then in force:
+// raised, lifted and put back, without restarting.
+func TestIPRateLimitFollowsReload(t *testing.T) {
+	s, _, send := newIPLimitedLogin(t, "IP_RATE_LIMITS", "login=2/1h")
+
+	// allowed sends n requests from addr and counts those let through
+	allowed := func(addr string, n int) int {
+		ok := 0
+		for i := 0; i < n; i++ {
+			w := send(addr)
+			if w.Code == http.StatusOK {
+				ok++
+			} else if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("status %d", w.Code)
+			}
+		}
+		return ok
+	}
+	reload := func(limits string) {
+		t.Helper()
+		t.Setenv("IP_RATE_LIMITS", limits)
+		if _, err := s.cfg.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := allowed("192.0.2.1", 5); got != 2 {
+		t.Fatalf("burst 2: %d of 5 allowed", got)
+	}
+
+	// A new address gets the higher burst. The first refills at the new
+	// rate, but has no tokens left, and time doesn't pass on the fake clock
+	reload("login=5/1h")
+	if got := allowed("192.0.2.2", 6); got != 5 {
+		t.Errorf("raised, new address: %d of 6 allowed, want 5", got)
+	}
+	if got := allowed("192.0.2.1", 5); got != 0 {
+		t.Errorf("raised, spent address: %d of 5 allowed, want 0", got)
+	}
+	if got := s.ipRateLimitStats()[config.IPLimitLogin]; got.Burst != 5 || got.TrackedIPs != 2 || got.Rejected != 9 {
+		t.Errorf("stats after raising: %+v", got)
+	}
+
+	reload("login=0")
+	if got := allowed("192.0.2.1", 10); got != 10 {
+		t.Errorf("lifted: %d of 10 allowed", got)
+	}
+	if _, ok := s.ipRateLimitStats()[config.IPLimitLogin]; ok {
+		t.Error("a lifted limit is still listed")
+	}
+
+	// Back on, the address is where it was
+	reload("login=5/1h")
+	if got := allowed("192.0.2.1", 5); got != 0 {
+		t.Errorf("back on: %d of 5 allowed, want 0", got)
+	}
+}
+
+// TestIPRateLimitRefills spends an address's burst and moves the fake clock
+// through the refill. Retry-After counts down to the next token, and a long
+// wait refills no more than the burst. 4 per 64s is a token every 16s,
+// which keeps the arithmetic exact.
+func TestIPRateLimitRefills(t *testing.T) {
+	_, clk, send := newIPLimitedLogin(t, "IP_RATE_LIMITS", "login=4/64s")
+	spend := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if w := send("192.0.2.1"); w.Code != http.StatusOK {
+				t.Fatalf("request %d of %d: %d", i+1, n, w.Code)
+			}
+		}
+	}
+	refused := func(wantWait string) {
+		t.Helper()
+		w := send("192.0.2.1")
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("status %d, want 429", w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != wantWait {
+			t.Errorf("Retry-After = %q, want %q", got, wantWait)
+		}
+		var body struct {
+			Error struct {
+				Code       string `json:"code"`
+				RetryAfter int    `json:"retry_after_seconds"`
+			} `json:"error"`
+		}
+		decodeBody(t, w, &body)
+		if body.Error.Code != CodeIPRateLimited || strconv.Itoa(body.Error.RetryAfter) != wantWait {
+			t.Errorf("body %s, want %s with retry_after_seconds %s", w.Body, CodeIPRateLimited, wantWait)
+		}
+	}
+
+	spend(4)
+	refused("16")
+	clk.Advance(4 * time.Second)
+	refused("12")
+	clk.Advance(11 * time.Second)
+	refused("1")
+	clk.Advance(time.Second)
+	spend(1)
+	refused("16")
+
+	// Ten periods later the bucket holds the burst, not ten of them
+	clk.Advance(640 * time.Second)
+	spend(4)
+	refused("16")
+}
+
+// TestIPRateLimitEvictsIdleIPs fills a limit capped at two addresses.
+// Addresses whose buckets have refilled are dropped first, as they are no
+// different from new ones; then the fullest bucket goes, so the address
+// that spent its burst stays limited.
+func TestIPRateLimitEvictsIdleIPs(t *testing.T) {
+	s, clk, send := newIPLimitedLogin(t, "IP_RATE_LIMITS", "login=4/64s", "IP_RATE_LIMIT_MAX_IPS", "2")
+	stats := func() IPRateLimitStats { return s.ipRateLimitStats()[config.IPLimitLogin] }
+
+	for i := 0; i < 4; i++ {
+		send("192.0.2.1")
+	}
+	send("192.0.2.2")
+	clk.Advance(64 * time.Second)
+	send("192.0.2.3")
+	if got := stats(); got.TrackedIPs != 1 || got.Evicted != 2 {
+		t.Fatalf("after both refilled: %d tracked, %d evicted; want 1 and 2", got.TrackedIPs, got.Evicted)
+	}
+
+	for i := 0; i < 4; i++ {
+		send("192.0.2.1")
+	}
+	send("192.0.2.4")
+	if got := stats(); got.TrackedIPs != 2 || got.Evicted != 3 {
+		t.Fatalf("at the cap: %d tracked, %d evicted; want 2 and 3", got.TrackedIPs, got.Evicted)
+	}
+	if w := send("192.0.2.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("the spent address got %d after an eviction, want 429", w.Code)
+	}
+}
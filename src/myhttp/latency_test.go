@@ -0,0 +1,86 @@
+// src/myhttp/latency_test.go
+package myhttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptachat-server/client"
+	"cryptachat-server/deliverylog"
+	"cryptachat-server/outbox"
+)
+
+// TestDeliveryLatencyObservedOnce sends a message to bob over a running
+// server, has bob acknowledge the push twice, and checks /admin/metrics
+// has exactly one live_push sample and none elsewhere.
+func TestDeliveryLatencyObservedOnce(t *testing.T) {
+	const adminToken = "admin-token-0123456789abcdef"
+	const password = "correct horse battery staple"
+	s, st, _ := newTestServer(t, "ADMIN_TOKEN", adminToken)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go s.hub.Run()
+	recorder := deliverylog.NewRecorder(st)
+	go recorder.Run(ctx)
+	go outbox.NewDispatcher(st, s.hub, recorder).Run(ctx)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	alice, bob := client.New(srv.URL), client.New(srv.URL)
+	for name, c := range map[string]*client.Client{"alice": alice, "bob": bob} {
+		if err := c.Register(ctx, name, password); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Login(ctx, name, password); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.UploadKey(ctx, name+"-key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var pushed *client.Message
+	for ev := range bob.Subscribe(ctx) {
+		if ev.Type == client.EventHello {
+			if err := alice.SendMessage(ctx, "bob", "s", "r"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ev.Type == client.EventMessage {
+			pushed = ev.Message
+			break
+		}
+	}
+	if pushed == nil {
+		t.Fatalf("no push: %v", ctx.Err())
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := bob.MarkDeliveredVia(ctx, []int{pushed.ID}, pushed.Transport); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := serveAs(s, http.MethodGet, apiPrefix+"/admin/metrics", adminToken, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics: %d %s", w.Code, w.Body)
+	}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if !strings.HasPrefix(line, "cryptachat_message_delivery_seconds_count") {
+			continue
+		}
+		want := " 0"
+		if strings.Contains(line, `path="live_push"`) {
+			want = " 1"
+		}
+		if !strings.HasSuffix(line, want) {
+			t.Errorf("%s, want%s", line, want)
+		}
+	}
+	if !strings.Contains(w.Body.String(), `cryptachat_message_delivery_seconds_count{path="live_push"}`) {
+		t.Errorf("no live_push series in\n%s", w.Body)
+	}
+}
@@ -0,0 +1,82 @@
+// src/myhttp/limits_test.go
+package myhttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cryptachat-server/config"
+)
+
+// jsonOfSize returns a JSON object of exactly n bytes.
+func jsonOfSize(n int64) string {
+	return `{"b":"` + strings.Repeat("a", int(n)-8) + `"}`
+}
+
+// TestPayloadLimits sends each payload type a body at its limit, one byte
+// over and far over. Only the first is decoded, and the refusals are 413s
+// naming the type and its limit.
+func TestPayloadLimits(t *testing.T) {
+	s, _ := newOfflineServer(t)
+	for payloadType, limit := range s.cfg.PayloadLimits {
+		t.Run(payloadType, func(t *testing.T) {
+			for _, tt := range []struct {
+				name string
+				size int64
+			}{
+				{"at the limit", limit},
+				{"just over", limit + 1},
+				{"grossly over", 64 * limit},
+			} {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(jsonOfSize(tt.size)))
+				var dst map[string]string
+				ok := s.decodeJSON(w, r, payloadType, &dst)
+				if tt.size <= limit {
+					if !ok || len(dst["b"]) != int(tt.size)-8 {
+						t.Errorf("%s: refused with %d %s", tt.name, w.Code, w.Body)
+					}
+					continue
+				}
+				want := fmt.Sprintf("exceeds the %d byte limit for %s payloads", limit, payloadType)
+				if ok || w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), want) {
+					t.Errorf("%s: %d %s, want 413 saying %q", tt.name, w.Code, w.Body, want)
+				}
+			}
+		})
+	}
+}
+
+// TestPayloadLimitOverride lowers one type's limit with PAYLOAD_LIMITS and
+// checks the others keep their defaults. Unknown types fall back to the
+// message limit. Overrides that aren't a known type and a positive size
+// stop the server from starting.
+func TestPayloadLimitOverride(t *testing.T) {
+	s, _ := newOfflineServer(t, "PAYLOAD_LIMITS", "reaction=100")
+	if got := s.cfg.PayloadLimit(config.PayloadReaction); got != 100 {
+		t.Errorf("reaction limit %d, want 100", got)
+	}
+	if got := s.cfg.PayloadLimit(config.PayloadIntro); got != 4<<10 {
+		t.Errorf("intro limit %d, want the default %d", got, 4<<10)
+	}
+	if got, want := s.cfg.PayloadLimit("no_such_type"), s.cfg.PayloadLimit(config.PayloadMessage); got != want {
+		t.Errorf("unknown type's limit %d, want the message limit %d", got, want)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(jsonOfSize(101)))
+	if s.decodeJSON(w, r, config.PayloadReaction, &map[string]string{}) || w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("101 bytes over the lowered limit: %d %s", w.Code, w.Body)
+	}
+
+	for _, bad := range []string{"reaction=0", "reaction=-1", "reaction", "emoji=100"} {
+		t.Setenv("PAYLOAD_LIMITS", bad)
+		if _, err := config.LoadConfig(filepath.Join(t.TempDir(), ".env")); err == nil {
+			t.Errorf("PAYLOAD_LIMITS=%s was accepted", bad)
+		}
+	}
+}
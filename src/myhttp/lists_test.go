@@ -0,0 +1,60 @@
+// src/myhttp/lists_test.go
+package myhttp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// TestEmptyListsAreArrays calls every list endpoint as a new user with no
+// data, and checks each list comes back as [] rather than null.
+func TestEmptyListsAreArrays(t *testing.T) {
+	const adminToken = "admin-token-0123456789abcdef"
+	s, _, _ := newTestServer(t, "ADMIN_TOKEN", adminToken)
+	registerAlice(t, s, 4, "correct horse battery")
+	if err := s.store.RegisterUser(context.Background(), "bob", "hash", nil); err != nil {
+		t.Fatal(err)
+	}
+	login := postLogin(s, "alice", "correct horse battery")
+	if login.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", login.Code, login.Body)
+	}
+	var tokens tokenResponse
+	decodeBody(t, login, &tokens)
+
+	tests := []struct {
+		path  string
+		token string
+		list  string
+		len   int
+	}{
+		{"/get_chat_requests", tokens.Token, "pending_requests", 0},
+		{"/get_chat_requests?include_filtered=true", tokens.Token, "pending_requests", 0},
+		{"/get_contacts", tokens.Token, "contacts", 0},
+		{"/relationships", tokens.Token, "relationships", 0},
+		{"/conversations", tokens.Token, "conversations", 0},
+		{"/get_messages?username=bob", tokens.Token, "messages", 0},
+		{"/messages/sealed", tokens.Token, "messages", 0},
+		{"/sync", tokens.Token, "invalidations", 0},
+		{"/key_log?username=alice", tokens.Token, "entries", 0},
+		{"/export/contacts", tokens.Token, "contacts", 0},
+		{"/sessions", tokens.Token, "sessions", 1},
+		{"/admin/conversations", adminToken, "conversations", 0},
+		{"/admin/audit?type=no.such.event", adminToken, "events", 0},
+	}
+	for _, tt := range tests {
+		w := serveAs(s, http.MethodGet, apiPrefix+tt.path, tt.token, "")
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: %d %s", tt.path, w.Code, w.Body)
+			continue
+		}
+		var body map[string]json.RawMessage
+		decodeBody(t, w, &body)
+		var list []json.RawMessage
+		if raw := body[tt.list]; len(raw) == 0 || raw[0] != '[' || json.Unmarshal(raw, &list) != nil || len(list) != tt.len {
+			t.Errorf("%s: %q is %s, want a list of %d", tt.path, tt.list, raw, tt.len)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// src/myhttp/login_test.go
+package myhttp
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptachat-server/chatservice"
+	"cryptachat-server/passwords"
+)
+
+// TestLoginFailedGolden pins the body of a failed login. Whatever is added
+// to chatservice.ErrLoginFailed shows up here, for both failure classes.
+func TestLoginFailedGolden(t *testing.T) {
+	s, _ := newOfflineServer(t)
+	w := httptest.NewRecorder()
+	s.writeServiceError(w, chatservice.ErrLoginFailed)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	checkGolden(t, "loginFailedResponse", w.Body.Bytes())
+}
+
+// postLogin sends a /login request through the server's full handler
+// chain and returns the response.
+func postLogin(s *Server, username, password string) *httptest.ResponseRecorder {
+	body := `{"username":"` + username + `","password":"` + password + `"}`
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// registerAlice stores alice with a cheap hash of password.
+func registerAlice(tb testing.TB, s *Server, cost int, password string) {
+	tb.Helper()
+	hash, err := passwords.Bcrypt{Cost: cost}.Hash([]byte(password))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := s.store.RegisterUser(context.Background(), "alice", hash, nil); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// TestLoginFailuresAreIdentical logs in with a username that doesn't
+// exist and with a wrong password for one that does, up to the lockout and
+// past it. The two responses must match byte for byte, status, headers and
+// body, so neither reveals which usernames are registered. A change that
+// tells them apart, such as a lockout on one path only, fails here and has
+// to be a deliberate decision.
+func TestLoginFailuresAreIdentical(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	registerAlice(t, s, 4, "correct horse battery")
+
+	maxFailures := s.cfg.Runtime().LoginMaxFailures
+	for i := 0; i < maxFailures+2; i++ {
+		unknown := postLogin(s, "nobody", "correct horse battery")
+		wrong := postLogin(s, "alice", "wrong horse battery")
+
+		want := http.StatusUnauthorized
+		if i >= maxFailures {
+			want = http.StatusTooManyRequests
+		}
+		if unknown.Code != want || wrong.Code != unknown.Code {
+			t.Fatalf("attempt %d: status %d for an unknown user, %d for a wrong password; want both %d",
+				i+1, unknown.Code, wrong.Code, want)
+		}
+		if !reflect.DeepEqual(unknown.Header(), wrong.Header()) {
+			t.Errorf("attempt %d: headers differ\nunknown user:   %v\nwrong password: %v", i+1, unknown.Header(), wrong.Header())
+		}
+		if !bytes.Equal(unknown.Body.Bytes(), wrong.Body.Bytes()) {
+			t.Errorf("attempt %d: bodies differ\nunknown user:   %s\nwrong password: %s", i+1, unknown.Body, wrong.Body)
+		}
+		if want == http.StatusUnauthorized {
+			checkGolden(t, "loginFailedResponse", wrong.Body.Bytes())
+		}
+	}
+}
+
+// loginFailureTimings times n logins of each failure class, interleaved
+// so drift in the machine's load affects both alike.
+func loginFailureTimings(b *testing.B, s *Server, n int) (unknown, wrong []time.Duration) {
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		if w := postLogin(s, "nobody", "correct horse battery"); w.Code != http.StatusUnauthorized {
+			b.Fatalf("unknown user: status %d", w.Code)
+		}
+		unknown = append(unknown, time.Since(start))
+
+		start = time.Now()
+		if w := postLogin(s, "alice", "wrong horse battery"); w.Code != http.StatusUnauthorized {
+			b.Fatalf("wrong password: status %d", w.Code)
+		}
+		wrong = append(wrong, time.Since(start))
+	}
+	return unknown, wrong
+}
+
+// quantile returns the q-quantile of sorted durations.
+func quantile(sorted []time.Duration, q float64) time.Duration {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// BenchmarkLoginFailures times failed logins for an unknown username and
+// for a wrong password, at the default bcrypt cost, and reports the median
+// and 90th percentile of each. With enough iterations it fails if either
+// median falls outside the other's 10th to 90th percentile: the dummy
+// comparison should make the two indistinguishable by latency.
+//
+//	go test ./myhttp -run '^$' -bench BenchmarkLoginFailures -benchtime 100x
+func BenchmarkLoginFailures(b *testing.B) {
+	// The lockout counts every attempt but never trips, so each one pays
+	// for the count and reaches the password check. No per-IP limit.
+	s, _, _ := newTestServer(b, "BCRYPT_COST", "10", "LOGIN_MAX_FAILURES", "1000000000", "IP_RATE_LIMITS", "login=0")
+	registerAlice(b, s, 10, "correct horse battery")
+	// Makes the dummy hash, which only the first unknown-user login pays for
+	postLogin(s, "nobody", "correct horse battery")
+
+	b.ResetTimer()
+	unknown, wrong := loginFailureTimings(b, s, b.N)
+	b.StopTimer()
+
+	slices.Sort(unknown)
+	slices.Sort(wrong)
+	b.ReportMetric(ms(quantile(unknown, 0.5)), "unknown-p50-ms")
+	b.ReportMetric(ms(quantile(unknown, 0.9)), "unknown-p90-ms")
+	b.ReportMetric(ms(quantile(wrong, 0.5)), "wrong-p50-ms")
+	b.ReportMetric(ms(quantile(wrong, 0.9)), "wrong-p90-ms")
+
+	// Too few samples say nothing about the distributions
+	if b.N < 20 {
+		return
+	}
+	overlaps := func(sample, within []time.Duration) bool {
+		median := quantile(sample, 0.5)
+		return median >= quantile(within, 0.1) && median <= quantile(within, 0.9)
+	}
+	if !overlaps(unknown, wrong) || !overlaps(wrong, unknown) {
+		b.Errorf("latencies tell the failures apart: unknown user p50 %.1fms, wrong password p10-p90 %.1f-%.1fms; wrong password p50 %.1fms, unknown user p10-p90 %.1f-%.1fms",
+			ms(quantile(unknown, 0.5)), ms(quantile(wrong, 0.1)), ms(quantile(wrong, 0.9)),
+			ms(quantile(wrong, 0.5)), ms(quantile(unknown, 0.1)), ms(quantile(unknown, 0.9)))
+	}
+}
@@ -0,0 +1,39 @@
+// src/myhttp/ordering_test.go
+package myhttp
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cryptachat-server/deliverylog"
+	"cryptachat-server/outbox"
+	"cryptachat-server/smoketest"
+)
+
+// TestSendPollPushOrdering runs the smoke test against a fully wired
+// in-process server, hub and outbox dispatcher included. Its ordering step
+// is the stress test for the guarantees on store.Message: both users send
+// from several goroutines at once while one of them polls and listens on
+// /ws, and it fails on a seq gap in a poll, a push a poll can't see yet, or
+// a message missing or repeated at the end.
+func TestSendPollPushOrdering(t *testing.T) {
+	s, st, _ := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go s.hub.Run()
+	recorder := deliverylog.NewRecorder(st)
+	go recorder.Run(ctx)
+	go outbox.NewDispatcher(st, s.hub, recorder).Run(ctx)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	var out strings.Builder
+	err := smoketest.Run(ctx, srv.URL, &out)
+	t.Log("\n" + out.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
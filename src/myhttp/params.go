@@ -0,0 +1,129 @@
+// src/myhttp/params.go
+package myhttp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+)
+
+// Query parameters are parsed with parseIntParam, so every endpoint rejects
+// a malformed number the same way: 422 with the error code
+// invalid_parameter, the parameter's name in "field", why it was refused in
+// "reason", and the accepted range in "min" and "max". An absent or empty
+// parameter takes its default; anything else must be a plain base-10
+// integer in range. Hex, fractions, and values that overflow are refused,
+// never clamped or read as the default.
+
+// CodeInvalidParameter is the error code for a malformed query parameter.
+const CodeInvalidParameter = "invalid_parameter"
+
+// Why a query parameter was refused, in the error's "reason".
+const (
+	paramNotInteger = "not_integer"
+	paramOutOfRange = "out_of_range"
+)
+
+// maxMessageIDParam is the largest message ID, which is a Postgres integer.
+const maxMessageIDParam = math.MaxInt32
+
+// sinceIDSlack is how far above the last message ID handed out a since_id
+// may be. The check is there to catch garbage cursors, not to be exact, so
+// a cursor within the slack of the remembered ID (see messageIDBound) is
+// let through without reading the sequence again.
+const sinceIDSlack = 1000
+
+// paramError is a query parameter that failed to parse.
+type paramError struct {
+	Field    string
+	Reason   string
+	Min, Max int64
+}
+
+func (e *paramError) Error() string {
+	return fmt.Sprintf("Invalid %s parameter, must be an integer between %d and %d.", e.Field, e.Min, e.Max)
+}
+
+// parseIntParam parses query parameter name as an integer between lo and
+// hi, inclusive, returning def if it is absent or empty.
+func parseIntParam(q url.Values, name string, def, lo, hi int64) (int64, *paramError) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	perr := &paramError{Field: name, Reason: paramNotInteger, Min: lo, Max: hi}
+	// ParseInt would also take a leading "+"
+	if v[0] == '+' {
+		return 0, perr
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		perr.Reason = paramOutOfRange
+		return 0, perr
+	}
+	if err != nil {
+		return 0, perr
+	}
+	if n < lo || n > hi {
+		perr.Reason = paramOutOfRange
+		return 0, perr
+	}
+	return n, nil
+}
+
+// writeParamError writes err as a 422.
+func (s *Server) writeParamError(w http.ResponseWriter, err *paramError) {
+	s.writeErrorBody(w, err.Error(), map[string]interface{}{
+		"code":   CodeInvalidParameter,
+		"field":  err.Field,
+		"reason": err.Reason,
+		"min":    err.Min,
+		"max":    err.Max,
+	}, http.StatusUnprocessableEntity)
+}
+
+// intParam parses a query parameter with parseIntParam, writing the error
+// if it fails.
+func (s *Server) intParam(w http.ResponseWriter, q url.Values, name string, def, lo, hi int64) (int64, bool) {
+	n, perr := parseIntParam(q, name, def, lo, hi)
+	if perr != nil {
+		s.writeParamError(w, perr)
+		return 0, false
+	}
+	return n, true
+}
+
+// messageIDBound remembers the last message ID read from the database, so
+// a since_id at or below it needs no query.
+type messageIDBound struct {
+	last atomic.Int64
+}
+
+// sinceIDParam parses the since_id query parameter, a message ID cursor:
+// absent is 0, and it may not be above the last message ID handed out, plus
+// sinceIDSlack.
+func (s *Server) sinceIDParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	q := r.URL.Query()
+	n, ok := s.intParam(w, q, "since_id", 0, 0, maxMessageIDParam)
+	if !ok {
+		return 0, false
+	}
+	if n <= s.messageIDs.last.Load()+sinceIDSlack {
+		return int(n), true
+	}
+	last, err := s.svc.LastMessageID(r.Context())
+	if err != nil {
+		s.writeServiceError(w, err)
+		return 0, false
+	}
+	s.messageIDs.last.Store(last)
+	if hi := min(last+sinceIDSlack, maxMessageIDParam); n > hi {
+		s.writeParamError(w, &paramError{Field: "since_id", Reason: paramOutOfRange, Min: 0, Max: hi})
+		return 0, false
+	}
+	return int(n), true
+}
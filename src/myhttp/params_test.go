@@ -0,0 +1,114 @@
+// src/myhttp/params_test.go
+package myhttp
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseIntParam(t *testing.T) {
+	tests := []struct {
+		raw    string
+		want   int64
+		reason string // "" if accepted
+	}{
+		{"", 7, ""}, // Absent takes the default
+		{"1", 1, ""},
+		{"100", 100, ""},
+		{"0", 0, paramOutOfRange},
+		{"101", 0, paramOutOfRange},
+		{"-1", 0, paramOutOfRange},
+		{"99999999999999999999", 0, paramOutOfRange},
+		{"-99999999999999999999", 0, paramOutOfRange},
+		{"0x10", 0, paramNotInteger},
+		{"1.5", 0, paramNotInteger},
+		{"1e3", 0, paramNotInteger},
+		{"+3", 0, paramNotInteger},
+		{" 5", 0, paramNotInteger},
+		{"5 ", 0, paramNotInteger},
+		{"five", 0, paramNotInteger},
+	}
+	for _, tt := range tests {
+		q := url.Values{}
+		if tt.raw != "" {
+			q.Set("limit", tt.raw)
+		}
+		got, perr := parseIntParam(q, "limit", 7, 1, 100)
+		switch {
+		case tt.reason == "" && (perr != nil || got != tt.want):
+			t.Errorf("%q: %d, %v; want %d", tt.raw, got, perr, tt.want)
+		case tt.reason != "" && (perr == nil || perr.Reason != tt.reason || perr.Field != "limit" || perr.Min != 1 || perr.Max != 100):
+			t.Errorf("%q: %d, %+v; want refused as %s", tt.raw, got, perr, tt.reason)
+		}
+	}
+}
+
+// TestSinceIDParam checks since_id is refused with a field-scoped 422 when
+// malformed, and let through without a query when it is within the slack
+// of the last message ID known.
+func TestSinceIDParam(t *testing.T) {
+	s, _ := newOfflineServer(t)
+	s.messageIDs.last.Store(5000)
+	sinceID := func(raw string) (int, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/get_messages?since_id="+url.QueryEscape(raw), nil)
+		n, _ := s.sinceIDParam(w, r)
+		return n, w
+	}
+
+	// 6000 is at the end of the slack
+	for raw, want := range map[string]int{"": 0, "0": 0, "5000": 5000, "6000": 6000} {
+		if n, w := sinceID(raw); w.Code != http.StatusOK || n != want {
+			t.Errorf("since_id=%q: %d, %d; want %d", raw, w.Code, n, want)
+		}
+	}
+
+	for raw, reason := range map[string]string{
+		"-1":                   paramOutOfRange,
+		"99999999999999999999": paramOutOfRange,
+		"2147483648":           paramOutOfRange,
+		"0x10":                 paramNotInteger,
+	} {
+		_, w := sinceID(raw)
+		var body struct {
+			Error struct {
+				Code   string `json:"code"`
+				Field  string `json:"field"`
+				Reason string `json:"reason"`
+				Min    int64  `json:"min"`
+				Max    int64  `json:"max"`
+			} `json:"error"`
+		}
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("since_id=%s: %d, want 422", raw, w.Code)
+			continue
+		}
+		decodeBody(t, w, &body)
+		if e := body.Error; e.Code != CodeInvalidParameter || e.Field != "since_id" || e.Reason != reason || e.Min != 0 || e.Max != math.MaxInt32 {
+			t.Errorf("since_id=%s: %+v, want %s", raw, e, reason)
+		}
+	}
+}
+
+// TestSinceIDAboveLastMessage asks for messages after an ID far past any
+// handed out, which is refused with the bound in "max".
+func TestSinceIDAboveLastMessage(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/get_messages?since_id=100000", nil)
+	if _, ok := s.sinceIDParam(w, r); ok || w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("since_id=100000 on an empty database: %d", w.Code)
+	}
+	var body struct {
+		Error struct {
+			Max int64 `json:"max"`
+		} `json:"error"`
+	}
+	decodeBody(t, w, &body)
+	if body.Error.Max != sinceIDSlack {
+		t.Errorf("max %d, want %d", body.Error.Max, sinceIDSlack)
+	}
+}
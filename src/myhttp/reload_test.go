@@ -0,0 +1,112 @@
+// src/myhttp/reload_test.go
+package myhttp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptachat-server/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestReloadKeepsWebSockets lifts the login rate limit with POST
+// /admin/reload while alice has /ws open. The next login is judged by the
+// new limit, and the socket stays open and still receives pushes. A reload
+// with an invalid setting is refused and changes nothing.
+func TestReloadKeepsWebSockets(t *testing.T) {
+	const adminToken = "admin-token-0123456789abcdef"
+	const password = "correct horse battery"
+	s, st, _ := newTestServer(t, "ADMIN_TOKEN", adminToken, "IP_RATE_LIMITS", "login=2/1h")
+	s.cfg.OnReload(func(rc *config.RuntimeConfig) {
+		s.hub.SetBackpressure(rc.WSBackpressurePolicy, rc.WSSendBuffer)
+	})
+	go s.hub.Run()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	registerAlice(t, s, 4, password)
+	alice, err := st.GetUserIDByUsername(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := postLogin(s, "alice", password)
+	if login.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", login.Code, login.Body)
+	}
+	var tokens tokenResponse
+	decodeBody(t, login, &tokens)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+tokens.Token)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+apiPrefix+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	read := func() map[string]interface{} {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading from /ws: %v", err)
+		}
+		var msg map[string]interface{}
+		if err := json.Unmarshal(frame, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	if msg := read(); msg["type"] != "hello" {
+		t.Fatalf("first frame %v, want hello", msg)
+	}
+
+	postLogin(s, "alice", password)
+	if w := postLogin(s, "alice", password); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("third login: %d, want 429", w.Code)
+	}
+
+	reload := func(want int) map[string][]string {
+		t.Helper()
+		w := serveAs(s, http.MethodPost, apiPrefix+"/admin/reload", adminToken, "")
+		if w.Code != want {
+			t.Fatalf("reload: %d %s, want %d", w.Code, w.Body, want)
+		}
+		var res map[string][]string
+		if want == http.StatusOK {
+			decodeBody(t, w, &res)
+		}
+		return res
+	}
+	t.Setenv("IP_RATE_LIMITS", "login=0")
+	t.Setenv("WS_SEND_BUFFER", "512")
+	t.Setenv("PORT", "9999")
+	res := reload(http.StatusOK)
+	if !slices.Equal(res["applied"], []string{"WSSendBuffer", "IPRateLimits"}) || !slices.Equal(res["restart_required"], []string{"Port"}) {
+		t.Errorf("reload: %v", res)
+	}
+	if w := postLogin(s, "alice", password); w.Code != http.StatusOK {
+		t.Errorf("login after lifting the limit: %d", w.Code)
+	}
+
+	if !s.hub.IsOnline(alice) {
+		t.Fatal("the reload dropped alice's connection")
+	}
+	s.hub.PushToUser(alice, map[string]string{"type": "after_reload"})
+	// Other frames, e.g. about the new logins, may come first
+	for msg := read(); msg["type"] != "after_reload"; msg = read() {
+	}
+
+	t.Setenv("WS_SEND_BUFFER", "-1")
+	t.Setenv("IP_RATE_LIMITS", "login=2/1h")
+	reload(http.StatusBadRequest)
+	if got := s.cfg.Runtime(); got.WSSendBuffer != 512 || got.IPRateLimits[config.IPLimitLogin].Burst != 0 {
+		t.Errorf("a refused reload changed the settings: %+v", got)
+	}
+}
@@ -0,0 +1,87 @@
+package myhttp
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// encodeFailedBody replaces a response that could not be encoded. It is a
+// constant so writing it can't fail the same way.
+var encodeFailedBody = []byte(`{"error":{"message":"Could not encode response."}}` + "\n")
+
+// responseCounters count responses that didn't reach the client as intended.
+type responseCounters struct {
+	encodeFailed atomic.Int64 // Marshalling failed; a 500 was sent instead
+	writeFailed  atomic.Int64 // The client went away before the body was written
+	streamFailed atomic.Int64 // A streamed body broke off after the status was sent
+}
+
+// ResponseStats is a snapshot of responseCounters.
+type ResponseStats struct {
+	EncodeFailed int64 `json:"encode_failed"`
+	WriteFailed  int64 `json:"write_failed"`
+	StreamFailed int64 `json:"stream_failed"`
+}
+
+func (c *responseCounters) snapshot() ResponseStats {
+	return ResponseStats{
+		EncodeFailed: c.encodeFailed.Load(),
+		WriteFailed:  c.writeFailed.Load(),
+		StreamFailed: c.streamFailed.Load(),
+	}
+}
+
+// routeOf names the route behind w for logs.
+func routeOf(w http.ResponseWriter) string {
+	if aw, ok := w.(*apiWriter); ok {
+		return aw.route
+	}
+	return "unknown route"
+}
+
+// writeJSON writes data as a JSON response. The body is encoded in full
+// before anything is sent, so an encoding failure becomes a clean 500 rather
+// than a 200 with half a body, and the response carries a Content-Length.
+func (s *Server) writeJSON(w http.ResponseWriter, data interface{}, status int) {
+	if aw, ok := w.(*apiWriter); ok && s.cfg.DeprecationWarnings && len(aw.warnings) > 0 {
+		data = withWarnings(data, aw.warnings)
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		s.responses.encodeFailed.Add(1)
+		log.Printf("HTTP: could not encode response for %s: %v", routeOf(w), err)
+		body, status = encodeFailedBody, http.StatusInternalServerError
+	} else {
+		body = append(body, '\n')
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		// Nothing more can be sent; the client has gone
+		s.responses.writeFailed.Add(1)
+	}
+}
+
+// writeJSONStream encodes data straight to the client without buffering it,
+// for responses too large to hold twice in memory. The tradeoff: the status
+// is sent first, so if encoding fails part-way the client gets that status
+// with a truncated body (and no Content-Length), which it can only detect as
+// invalid JSON. Failures are logged and counted. Prefer writeJSON.
+func (s *Server) writeJSONStream(w http.ResponseWriter, data interface{}, status int) {
+	if aw, ok := w.(*apiWriter); ok && s.cfg.DeprecationWarnings && len(aw.warnings) > 0 {
+		data = withWarnings(data, aw.warnings)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		s.responses.streamFailed.Add(1)
+		log.Printf("HTTP: streamed response for %s broke off: %v", routeOf(w), err)
+	}
+}
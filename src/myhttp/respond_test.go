@@ -0,0 +1,69 @@
+// src/myhttp/respond_test.go
+package myhttp
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// disconnectingWriter stands in for a client that goes away after n bytes
+// of the body.
+type disconnectingWriter struct {
+	*httptest.ResponseRecorder
+	n int
+}
+
+func (w *disconnectingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		written, _ := w.ResponseRecorder.Write(p[:w.n])
+		w.n = 0
+		return written, errors.New("write: broken pipe")
+	}
+	w.n -= len(p)
+	return w.ResponseRecorder.Write(p)
+}
+
+// TestWriteJSONSendsWholeBodiesOrNone writes a payload that can't be
+// encoded and one to a client that disconnects part-way. The first must be
+// a complete 500, never a 200 with half a body; both are counted.
+func TestWriteJSONSendsWholeBodiesOrNone(t *testing.T) {
+	s, _ := newOfflineServer(t)
+
+	w := httptest.NewRecorder()
+	s.writeJSON(w, map[string]float64{"ok": 1}, http.StatusCreated)
+	if w.Code != http.StatusCreated || w.Body.String() != "{\"ok\":1}\n" {
+		t.Errorf("got %d %q", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Length"); got != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("Content-Length %s for a %d byte body", got, w.Body.Len())
+	}
+
+	w = httptest.NewRecorder()
+	s.writeJSON(w, map[string]float64{"ok": 1, "bad": math.NaN()}, http.StatusOK)
+	if w.Code != http.StatusInternalServerError || w.Body.String() != string(encodeFailedBody) {
+		t.Errorf("unencodable payload: %d %q, want a 500 with the fixed error body", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(encodeFailedBody)) {
+		t.Errorf("Content-Length %s for the error body", got)
+	}
+
+	gone := &disconnectingWriter{ResponseRecorder: httptest.NewRecorder(), n: 5}
+	s.writeJSON(gone, map[string]string{"message": strings.Repeat("x", 100)}, http.StatusOK)
+
+	// A stream can only break off, with its status already sent
+	stream := &disconnectingWriter{ResponseRecorder: httptest.NewRecorder(), n: 5}
+	s.writeJSONStream(stream, map[string]string{"message": strings.Repeat("x", 100)}, http.StatusOK)
+	if stream.Code != http.StatusOK || stream.Body.Len() != 5 {
+		t.Errorf("stream: %d with %d bytes, want 200 cut off at 5", stream.Code, stream.Body.Len())
+	}
+
+	want := ResponseStats{EncodeFailed: 1, WriteFailed: 1, StreamFailed: 1}
+	if got := s.responses.snapshot(); got != want {
+		t.Errorf("counted %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,293 @@
+// src/myhttp/responses.go
+package myhttp
+
+import (
+	"time"
+
+	"cryptachat-server/chatservice"
+	"cryptachat-server/config"
+	"cryptachat-server/connlimit"
+	"cryptachat-server/integrations"
+	"cryptachat-server/passwords"
+	"cryptachat-server/store"
+	"cryptachat-server/websockets"
+)
+
+// Response bodies for handlers that don't return a store or service type
+// directly. Every success body is a named struct so its shape is visible in
+// one place and can't drift from one call site to another.
+//
+// encoding/json writes struct fields in declaration order. These bodies
+// used to be maps, which encode with their keys sorted, so fields are
+// declared alphabetically by JSON name to keep the bytes on the wire
+// unchanged. Keep new fields in that order too.
+
+// messageResponse is the body of writes that only confirm what they did.
+type messageResponse struct {
+	Message string `json:"message"`
+}
+
+// sendMessageResponse is the body of /send_message. delivery_hint is a
+// guess, see websockets.DeliveryHint.
+type sendMessageResponse struct {
+	DeliveryHint websockets.DeliveryHint `json:"delivery_hint"`
+	Message      string                  `json:"message"`
+}
+
+// tokenResponse is the body of /login and /refresh. token is the access
+// token, for backwards compatibility with clients that only read it.
+type tokenResponse struct {
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshExpiresAt string `json:"refresh_expires_at,omitempty"`
+	RefreshToken     string `json:"refresh_token,omitempty"`
+	Token            string `json:"token"`
+}
+
+func newTokenResponse(pair *chatservice.TokenPair) tokenResponse {
+	resp := tokenResponse{
+		ExpiresIn:    int64(pair.ExpiresIn / time.Second),
+		RefreshToken: pair.RefreshToken,
+		Token:        pair.AccessToken,
+	}
+	if pair.RefreshToken != "" {
+		resp.RefreshExpiresAt = pair.RefreshExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return resp
+}
+
+// changeUsernameResponse is the body of /change_username: the names and
+// the new tokens, with the fields of tokenResponse.
+type changeUsernameResponse struct {
+	ExpiresIn        int64  `json:"expires_in"`
+	PreviousUsername string `json:"previous_username"`
+	RefreshExpiresAt string `json:"refresh_expires_at,omitempty"`
+	RefreshToken     string `json:"refresh_token,omitempty"`
+	Token            string `json:"token"`
+	Username         string `json:"username"`
+}
+
+func newChangeUsernameResponse(res *chatservice.UsernameChange) changeUsernameResponse {
+	tokens := newTokenResponse(res.Tokens)
+	return changeUsernameResponse{
+		ExpiresIn:        tokens.ExpiresIn,
+		PreviousUsername: res.PreviousUsername,
+		RefreshExpiresAt: tokens.RefreshExpiresAt,
+		RefreshToken:     tokens.RefreshToken,
+		Token:            tokens.Token,
+		Username:         res.Username,
+	}
+}
+
+// twoFactorPendingResponse is the body of /login for users with two-factor
+// authentication on. It has no token field, so clients that don't know
+// about two-factor authentication fail to log in rather than carry on.
+type twoFactorPendingResponse struct {
+	ExpiresIn         int64  `json:"expires_in"`
+	PendingToken      string `json:"pending_token"`
+	TwoFactorRequired bool   `json:"two_factor_required"`
+}
+
+type publicKeyResponse struct {
+	PublicKey string `json:"public_key"`
+	Username  string `json:"username"`
+}
+
+type prekeysRemainingResponse struct {
+	PrekeysRemaining int `json:"prekeys_remaining"`
+}
+
+// requestChatResponse reports whether a chat request is pending or was
+// accepted straight away.
+type requestChatResponse struct {
+	Message       string `json:"message"`
+	PartnerHasKey *bool  `json:"partner_has_key,omitempty"` // Only when accepted
+	Status        string `json:"status"`                    // "pending" or "accepted"
+}
+
+// acceptChatResponse confirms an acceptance. PartnerHasKey is false while
+// the new contact has no public key, so messages to them would be refused.
+type acceptChatResponse struct {
+	Message       string `json:"message"`
+	PartnerHasKey bool   `json:"partner_has_key"`
+}
+
+// sessionsResponse is the body of GET /sessions.
+type sessionsResponse struct {
+	Sessions []chatservice.SessionInfo `json:"sessions"`
+}
+
+// batchResponse is the shared multi-status body of the batch endpoints.
+type batchResponse struct {
+	Results []chatservice.BatchItem `json:"results"`
+}
+
+type pendingRequestsResponse struct {
+	PendingRequests []store.PendingRequest `json:"pending_requests"`
+}
+
+type contactsResponse struct {
+	Contacts []string `json:"contacts"`
+}
+
+// messagesResponse is the body of message reads. The snapshot fields
+// (max_id, max_seq) sit beside messages.
+type messagesResponse struct {
+	store.MessageSnapshot
+	Messages []store.Message `json:"messages"`
+}
+
+type backupStoredResponse struct {
+	Message string `json:"message"`
+	Version int    `json:"version"`
+}
+
+type contactImportQueuedResponse struct {
+	Contacts int    `json:"contacts"` // As listed in the document, before duplicates are dropped
+	ImportID int    `json:"import_id"`
+	Message  string `json:"message"`
+}
+
+// ---- Admin ----
+
+type adminRuntimeResponse struct {
+	AllowInsecure      bool                        `json:"allow_insecure"`
+	BcryptCost         int                         `json:"bcrypt_cost"`
+	BlobEncryption     store.BlobEncryptionInfo    `json:"blob_encryption"`
+	Connections        connlimit.Stats             `json:"connections"`
+	DeprecatedHits     map[string]map[string]int64 `json:"deprecated_hits"`
+	Federation         []store.PeerStatus          `json:"federation,omitempty"` // Per peer; absent if federation is off
+	HTTPResponses      ResponseStats               `json:"http_responses"`
+	HygieneFindings    []config.Finding            `json:"hygiene_findings"`
+	IntegrationPrivacy map[string]interface{}      `json:"integration_privacy"`
+	IPRateLimits       map[string]IPRateLimitStats `json:"ip_rate_limits"`
+	ListenAddr         string                      `json:"listen_addr"`
+	NewAccountFanout   chatservice.FanoutStats     `json:"new_account_fanout"`
+	Outbox             store.OutboxStats           `json:"outbox"`
+	PasswordHashing    passwords.Stats             `json:"password_hashing"`
+	Push               *chatservice.PushStats      `json:"push,omitempty"` // Absent if push is off
+	Schema             SchemaStats                 `json:"schema"`
+	SpamFilter         chatservice.SpamStats       `json:"spam_filter"`
+	TLSEnabled         bool                        `json:"tls_enabled"`
+	UserCache          store.UserCacheStats        `json:"user_cache"`
+	Webhooks           *integrations.SenderStats   `json:"webhooks,omitempty"` // Absent if webhooks are off
+	WriteBehind        store.WriteBehindStats      `json:"write_behind"`
+	WSBackpressure     string                      `json:"ws_backpressure"`
+	WSGoroutines       websockets.GoroutineStats   `json:"ws_goroutines"`
+	WSPushStats        websockets.PushStats        `json:"ws_push_stats"`
+}
+
+// adminDashboardResponse is the body of /admin/dashboard.
+type adminDashboardResponse struct {
+	Connections dashboardConnections `json:"connections"`
+	Database    store.PoolStats      `json:"database"`
+	GeneratedAt store.Timestamp      `json:"generated_at"`
+	Jobs        []store.JobRun       `json:"jobs"` // Background jobs that have run since start
+	Queues      dashboardQueues      `json:"queues"`
+	Requests    TrafficStats         `json:"requests"` // The last five minutes
+}
+
+type dashboardConnections struct {
+	RejectedHTTP int64 `json:"rejected_http"`
+	RejectedWS   int64 `json:"rejected_ws"`
+	TrackedIPs   int   `json:"tracked_ips"`
+	WebSockets   int   `json:"websockets"`
+}
+
+type dashboardQueues struct {
+	FederationPending  int     `json:"federation_pending"`
+	OutboxLagSeconds   float64 `json:"outbox_lag_seconds"`
+	OutboxPending      int     `json:"outbox_pending"`
+	WriteBehindPending int     `json:"write_behind_pending"`
+	WSQueuedBytes      int64   `json:"ws_queued_bytes"`
+}
+
+type legalHoldResponse struct {
+	LegalHold bool   `json:"legal_hold"`
+	Username  string `json:"username"`
+}
+
+// messageTraceResponse is the body of /admin/messages/{id}/trace.
+type messageTraceResponse struct {
+	DeliveryLog            []store.DeliveryLogEntry  `json:"delivery_log"`
+	Message                *store.MessageTrace       `json:"message"`
+	RecipientFirstPushedAt *store.Timestamp          `json:"recipient_first_pushed_at"`
+	Retention              map[string]retentionState `json:"retention"` // "sender" and "recipient"
+	Untracked              []string                  `json:"untracked"`
+}
+
+type integrationPreviewResponse struct {
+	Event     string                   `json:"event"`
+	Mode      integrations.PrivacyMode `json:"mode"`
+	Payload   map[string]interface{}   `json:"payload"`
+	Stripped  []string                 `json:"stripped"`
+	Synthetic map[string]interface{}   `json:"synthetic"`
+}
+
+// auditEventsResponse is the body of /admin/audit.
+type auditEventsResponse struct {
+	Events     []store.AuditEvent `json:"events"`
+	NextBefore *int64             `json:"next_before,omitempty"` // Absent on the last page
+}
+
+// auditDailyResponse is the body of /admin/audit/daily.
+type auditDailyResponse struct {
+	Counts []store.AuditDayCount `json:"counts"`
+	Since  store.Timestamp       `json:"since"`
+	Until  *store.Timestamp      `json:"until,omitempty"` // Absent if open-ended
+}
+
+type conversationsResponse struct {
+	Conversations []store.ConversationStats `json:"conversations"`
+	NextOffset    *int                      `json:"next_offset,omitempty"` // Absent on the last page
+	Sort          string                    `json:"sort"`
+}
+
+// meResponse is the body of GET /me.
+type meResponse struct {
+	CreatedAt    store.Timestamp  `json:"created_at"`
+	FeatureFlags map[string]bool  `json:"feature_flags"`
+	HasPublicKey bool             `json:"has_public_key"`
+	ID           int              `json:"id"`
+	IsAdmin      bool             `json:"is_admin"`
+	LastLogin    *store.Timestamp `json:"last_login"` // null before the first login
+	Username     string           `json:"username"`
+}
+
+// emailResponse is the body of GET and PUT /email. email is null when the
+// user has none.
+type emailResponse struct {
+	Email    *string `json:"email"`
+	Verified bool    `json:"verified"`
+}
+
+func newEmailResponse(e *store.RecoveryEmail) emailResponse {
+	if e == nil {
+		return emailResponse{}
+	}
+	return emailResponse{Email: &e.Email, Verified: e.Verified}
+}
+
+// featureFlagState is one flag in GET /admin/feature_flags.
+type featureFlagState struct {
+	Default        bool   `json:"default"`
+	Name           string `json:"name"`
+	OverridesOff   int    `json:"overrides_off"`
+	OverridesOn    int    `json:"overrides_on"`
+	RolloutPercent *int   `json:"rollout_percent"` // null when no rollout is set
+}
+
+type adminFeatureFlagsResponse struct {
+	Flags []featureFlagState `json:"flags"`
+}
+
+type flagOverrideResponse struct {
+	Enabled  bool   `json:"enabled"` // The flag's value for the user now
+	Flag     string `json:"flag"`
+	Override *bool  `json:"override"` // null when the override was removed
+	Username string `json:"username"`
+}
+
+type flagRolloutResponse struct {
+	Flag    string `json:"flag"`
+	Percent *int   `json:"percent"`
+}
@@ -0,0 +1,211 @@
+// src/myhttp/responses_test.go
+package myhttp
+
+import (
+	"bytes"
+	"flag"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptachat-server/chatservice"
+	"cryptachat-server/config"
+	"cryptachat-server/store"
+	"cryptachat-server/websockets"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/responses")
+
+// goldenTime is the one timestamp the golden bodies use.
+var goldenTime = time.Date(2025, 3, 1, 12, 30, 45, 123456789, time.UTC)
+
+func boolPtr(b bool) *bool { return &b }
+func intPtr(n int) *int    { return &n }
+
+// goldenResponses are the bodies pinned by the golden files, by file name.
+// Each name is a response type, and a suffix when the type has more than
+// one interesting shape.
+func goldenResponses() map[string]interface{} {
+	ts := store.NewTimestamp(goldenTime)
+	email := "alice@example.com"
+	return map[string]interface{}{
+		"messageResponse":     messageResponse{Message: "Logged out."},
+		"sendMessageResponse": sendMessageResponse{DeliveryHint: websockets.HintPushed, Message: "Message sent successfully."},
+		"tokenResponse": newTokenResponse(&chatservice.TokenPair{
+			AccessToken:      "access.token.jwt",
+			ExpiresIn:        15 * time.Minute,
+			RefreshToken:     "refresh-token",
+			RefreshExpiresAt: goldenTime.Add(30 * 24 * time.Hour),
+		}),
+		"tokenResponse_access_only": newTokenResponse(&chatservice.TokenPair{AccessToken: "access.token.jwt", ExpiresIn: 15 * time.Minute}),
+		"changeUsernameResponse": newChangeUsernameResponse(&chatservice.UsernameChange{
+			Username:         "alicia",
+			PreviousUsername: "alice",
+			Tokens: &chatservice.TokenPair{
+				AccessToken:      "access.token.jwt",
+				ExpiresIn:        15 * time.Minute,
+				RefreshToken:     "refresh-token",
+				RefreshExpiresAt: goldenTime.Add(30 * 24 * time.Hour),
+			},
+		}),
+		"twoFactorPendingResponse": twoFactorPendingResponse{ExpiresIn: 300, PendingToken: "pending.token.jwt", TwoFactorRequired: true},
+		"publicKeyResponse":        publicKeyResponse{PublicKey: "cHVibGljIGtleQ==", Username: "bob"},
+		"prekeysRemainingResponse": prekeysRemainingResponse{PrekeysRemaining: 42},
+		"requestChatResponse_pending": requestChatResponse{
+			Message: "Chat request sent to bob.",
+			Status:  "pending",
+		},
+		"requestChatResponse_accepted": requestChatResponse{
+			Message:       "bob had already requested a chat with you; you are now contacts.",
+			PartnerHasKey: boolPtr(true),
+			Status:        "accepted",
+		},
+		"acceptChatResponse": acceptChatResponse{Message: "Chat with bob accepted.", PartnerHasKey: false},
+		"sessionsResponse": sessionsResponse{Sessions: []chatservice.SessionInfo{{
+			Session:     store.Session{ID: 7, DeviceLabel: "laptop", IP: "203.0.113.9", CreatedAt: ts, LastSeenAt: ts, ExpiresAt: ts},
+			Current:     true,
+			WSConnected: true, WSConnectedAt: &ts, WSLastActivity: &ts,
+		}}},
+		"batchResponse": batchResponse{Results: []chatservice.BatchItem{
+			{Key: 12, Status: "ok"},
+			{Key: 13, Status: "error", Code: "not_found", Message: "Message not found."},
+		}},
+		"pendingRequestsResponse": pendingRequestsResponse{PendingRequests: []store.PendingRequest{
+			{RequesterUsername: "carol", Status: "pending", CreatedAt: ts},
+			{RequesterUsername: "mallory", Status: "pending", CreatedAt: ts, Filtered: true, FilterReason: "new_account"},
+		}},
+		"contactsResponse":       contactsResponse{Contacts: []string{"bob", "carol"}},
+		"contactsResponse_empty": contactsResponse{Contacts: []string{}},
+		"messagesResponse": messagesResponse{
+			MessageSnapshot: store.MessageSnapshot{MaxID: 101, MaxSeq: 9},
+			Messages: []store.Message{
+				{ID: 100, SenderID: 2, RecipientID: 1, Timestamp: ts, SenderUsername: "bob", EncryptedBlob: "YmxvYg==", Transport: store.TransportPoll, Seq: 8},
+				{ID: 101, SenderID: 1, RecipientID: 2, Timestamp: ts, SenderUsername: "alice", Deleted: true, Transport: store.TransportPoll, Seq: 9},
+			},
+		},
+		"messagesResponse_sealed": messagesResponse{
+			MessageSnapshot: store.MessageSnapshot{MaxID: 5},
+			Messages:        []store.Message{{ID: 5, RecipientID: 1, Timestamp: ts, EncryptedBlob: "c2VhbGVk", Transport: store.TransportPoll, Sealed: true}},
+		},
+		"backupStoredResponse":        backupStoredResponse{Message: "Backup stored.", Version: 3},
+		"contactImportQueuedResponse": contactImportQueuedResponse{Contacts: 12, ImportID: 4, Message: "Import queued."},
+		"legalHoldResponse":           legalHoldResponse{LegalHold: true, Username: "bob"},
+		"meResponse": meResponse{
+			CreatedAt:    ts,
+			FeatureFlags: map[string]bool{"sealed_sender": true, "drafts": false},
+			HasPublicKey: true,
+			ID:           1,
+			Username:     "alice",
+		},
+		"emailResponse":      newEmailResponse(&store.RecoveryEmail{Email: email, Verified: true}),
+		"emailResponse_none": newEmailResponse(nil),
+		"adminFeatureFlagsResponse": adminFeatureFlagsResponse{Flags: []featureFlagState{
+			{Default: false, Name: "drafts", OverridesOff: 1, OverridesOn: 2, RolloutPercent: intPtr(25)},
+			{Default: true, Name: "sealed_sender"},
+		}},
+		"flagOverrideResponse":         flagOverrideResponse{Enabled: true, Flag: "drafts", Override: boolPtr(true), Username: "bob"},
+		"flagOverrideResponse_removed": flagOverrideResponse{Enabled: false, Flag: "drafts", Username: "bob"},
+		"flagRolloutResponse":          flagRolloutResponse{Flag: "drafts", Percent: intPtr(50)},
+		"auditDailyResponse":           auditDailyResponse{Counts: []store.AuditDayCount{}, Since: ts},
+		"conversationsResponse":        conversationsResponse{Conversations: []store.ConversationStats{}, NextOffset: intPtr(50), Sort: "last_message"},
+	}
+}
+
+// checkGolden compares got with testdata/responses/name.golden, or writes
+// it there with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", "responses", name+".golden")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test ./myhttp -run TestResponseGolden -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("body changed; clients see the bytes, so update the golden file only on purpose\ngot:  %s\nwant: %s", got, want)
+	}
+}
+
+// TestResponseGolden pins the bytes writeJSON sends for each response
+// type: field names, order, omitted fields and number and time formats.
+func TestResponseGolden(t *testing.T) {
+	s, _ := newOfflineServer(t)
+	for name, body := range goldenResponses() {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.writeJSON(w, body, 200)
+			checkGolden(t, name, w.Body.Bytes())
+		})
+	}
+}
+
+// TestResponseGoldenWithWarnings pins where deprecation warnings go: after
+// the body's own fields, whatever their order.
+func TestResponseGoldenWithWarnings(t *testing.T) {
+	s, _ := newOfflineServer(t, "DEPRECATION_WARNINGS", "true")
+	if !s.cfg.DeprecationWarnings {
+		t.Fatal("DEPRECATION_WARNINGS didn't turn warnings on")
+	}
+	w := httptest.NewRecorder()
+	aw := &apiWriter{ResponseWriter: w, warnings: []string{deprecationWarnings[config.DeprecationRootRoutes]}}
+	s.writeJSON(aw, sendMessageResponse{DeliveryHint: websockets.HintQueuedOffline, Message: "Message sent successfully."}, 201)
+	checkGolden(t, "sendMessageResponse_warnings", w.Body.Bytes())
+}
+
+// TestGoldenFilesAreUsed fails on golden files no test writes, which are
+// left behind when a case is renamed.
+func TestGoldenFilesAreUsed(t *testing.T) {
+	if *update {
+		t.Skip("files are being rewritten")
+	}
+	names := map[string]bool{"sendMessageResponse_warnings": true, "loginFailedResponse": true}
+	for name := range goldenResponses() {
+		names[name] = true
+	}
+	files, err := filepath.Glob(filepath.Join("testdata", "responses", "*.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if name := strings.TrimSuffix(filepath.Base(f), ".golden"); !names[name] {
+			t.Errorf("%s has no test", f)
+		}
+	}
+}
+
+// TestResponseFieldsAreAlphabetical checks the rule in responses.go:
+// fields are declared in the order of their JSON names, as the maps these
+// bodies replaced encoded them.
+func TestResponseFieldsAreAlphabetical(t *testing.T) {
+	types := map[reflect.Type]bool{reflect.TypeOf(adminRuntimeResponse{}): true, reflect.TypeOf(adminDashboardResponse{}): true}
+	for _, body := range goldenResponses() {
+		types[reflect.TypeOf(body)] = true
+	}
+	for typ := range types {
+		var names []string
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if f.Anonymous {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			names = append(names, name)
+		}
+		if !sort.StringsAreSorted(names) {
+			t.Errorf("%s fields are not in JSON name order: %v", typ.Name(), names)
+		}
+	}
+}
@@ -1,63 +1,219 @@
 package myhttp
 
 import (
+	"cryptachat-server/chatservice"
 	"cryptachat-server/config"
+	"cryptachat-server/connlimit"
+	"cryptachat-server/integrations"
 	"cryptachat-server/store" // Your store package
 	"cryptachat-server/websockets"
+	"net"
 	"net/http"
+	"time"
 )
 
 // Server holds the dependencies for your HTTP handlers.
 type Server struct {
 	store *store.PostgresStore
+	svc   *chatservice.Service // Business logic; handlers are thin adapters around it
 	cfg   *config.Config
 	mux   *http.ServeMux
 	hub   *websockets.Hub // <-- Add the hub
+
+	privacy *integrations.Filter // Privacy stage for outbound integrations
+
+	deprecations deprecationCounters   // Hits on deprecated API surfaces
+	responses    responseCounters      // Responses that failed to encode or send
+	compat       compatState           // Read-mostly mode when the schema is ahead
+	conns        *connlimit.Tracker    // Open connections per client IP
+	auditReads   auditReads            // Recent audit log reads, recorded once per window
+	messageIDs   messageIDBound        // Last message ID seen, for checking since_id
+	traffic      trafficRecorder       // Requests of the last few minutes, for the dashboard
+	ipLimits     map[string]*ipLimiter // Per-IP limits on unauthenticated routes, by name
+	hello        helloSources          // Queries behind the WebSocket hello frame
 }
 
 // NewServer creates a new server instance.
-func NewServer(cfg *config.Config, store *store.PostgresStore, hub *websockets.Hub) *Server {
+func NewServer(cfg *config.Config, store *store.PostgresStore, svc *chatservice.Service, hub *websockets.Hub, privacy *integrations.Filter) *Server {
+	rc := cfg.Runtime()
 	s := &Server{
-		store: store,
-		cfg:   cfg,
-		mux:   http.NewServeMux(),
-		hub:   hub, // <-- Set the hub
+		store:    store,
+		svc:      svc,
+		cfg:      cfg,
+		mux:      http.NewServeMux(),
+		hub:      hub, // <-- Set the hub
+		privacy:  privacy,
+		ipLimits: make(map[string]*ipLimiter),
+		conns:    connlimit.New(rc.HTTPConnsPerIP, rc.WSConnsPerIP, cfg.TrustedProxies, cfg.TrustedProxyHeader),
+		hello: helloSources{
+			timeout:         helloTimeout,
+			pendingRequests: store.CountPendingRequests,
+			contactRefs:     store.GetContactRefs,
+		},
 	}
+	cfg.OnReload(func(rc *config.RuntimeConfig) {
+		s.conns.SetCaps(rc.HTTPConnsPerIP, rc.WSConnsPerIP)
+	})
+	s.compat.ahead = store.SchemaAhead()
+	s.compat.enabled = s.compat.ahead != nil && !cfg.AllowSchemaAhead
 	s.registerRoutes() // Call the method to register all routes
 	return s
 }
 
+// now returns the current time from the service's clock.
+func (s *Server) now() time.Time {
+	return s.svc.Clock().Now()
+}
+
 // ServeHTTP makes our Server usable as an http.Handler.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// TODO: Add logging middleware here
+	// Over-cap clients are turned away before routing, auth or any store call
+	release, ok := s.conns.AcquireHTTP(r)
+	if !ok {
+		w.Header().Set("Connection", "close")
+		s.writeErrorBody(w, "Too many open connections from your address.",
+			map[string]interface{}{"code": CodeTooManyConnections}, http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	if s.cfg.BasePath != "" {
+		stripped, ok := stripBasePath(s.cfg.BasePath, r)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w, r = &basePathWriter{ResponseWriter: w, basePath: s.cfg.BasePath}, stripped
+	}
 	s.mux.ServeHTTP(w, r)
 }
 
+// ConnState must be set as the http.Server's ConnState hook so direct
+// connections are counted per IP.
+func (s *Server) ConnState(c net.Conn, state http.ConnState) {
+	s.conns.ConnState(c, state)
+}
+
 // registerRoutes is the Go equivalent of all your @app.route decorators.
 // TODO: Add rate limiting, similar to the Python server's 'flask-limiter'.
 // This can be done by wrapping handlers with a rate-limiting middleware.
 func (s *Server) registerRoutes() {
+	// Discovery route
+	s.route("GET /server_info", s.handleServerInfo())
+	// Well-known URIs live at the root only, not under /api/v1
+	const jwksRoute = "GET /.well-known/jwks.json"
+	s.mux.HandleFunc(jwksRoute, s.withAPIWriter(jwksRoute, false, withTimeout(routeTimeout(jwksRoute), s.handleJWKS())))
+
 	// Auth routes
-	s.mux.HandleFunc("POST /register", s.handleRegister())
-	s.mux.HandleFunc("POST /login", s.handleLogin())
+	s.route("GET /register_challenge", s.ipRateLimit(config.IPLimitRegisterChallenge, s.handleRegisterChallenge()))
+	s.route("POST /register", s.ipRateLimit(config.IPLimitRegister, s.handleRegister()))
+	s.route("POST /login", s.ipRateLimit(config.IPLimitLogin, s.handleLogin()))
+	s.route("POST /refresh", s.ipRateLimit(config.IPLimitRefresh, s.handleRefresh()))
+	s.route("POST /logout", s.handleLogout())
+	s.route("POST /logout_all", s.jwtAuthMiddleware(s.handleLogoutAll()))
+	s.route("GET /sessions", s.jwtAuthMiddleware(s.handleListSessions()))
+	s.route("DELETE /sessions/{id}", s.jwtAuthMiddleware(s.handleRevokeSession()))
+	s.route("POST /change_password", s.jwtAuthMiddleware(s.handleChangePassword()))
+	s.route("POST /change_username", s.jwtAuthMiddleware(s.handleChangeUsername()))
+	s.route("POST /invites", s.jwtAuthMiddleware(s.handleCreateInvite()))
+	s.route("GET /email", s.jwtAuthMiddleware(s.handleGetEmail()))
+	s.route("PUT /email", s.jwtAuthMiddleware(s.handleSetEmail()))
+	s.route("POST /verify_email", s.ipRateLimit(config.IPLimitVerifyEmail, s.handleVerifyEmail()))
+	s.route("POST /request_password_reset", s.ipRateLimit(config.IPLimitPasswordReset, s.handleRequestPasswordReset()))
+	s.route("POST /reset_password", s.ipRateLimit(config.IPLimitResetPassword, s.handleResetPassword()))
+
+	// Two-factor routes
+	s.route("POST /2fa/enable", s.jwtAuthMiddleware(s.handleEnableTwoFactor()))
+	s.route("POST /2fa/verify", s.jwtAuthMiddleware(s.handleVerifyTwoFactor()))
+	s.route("POST /2fa/disable", s.jwtAuthMiddleware(s.handleDisableTwoFactor()))
+	s.route("POST /2fa/login", s.ipRateLimit(config.IPLimitTwoFactorLogin, s.handleTwoFactorLogin()))
 
 	// Key routes (Protected)
-	s.mux.HandleFunc("POST /upload_key", s.jwtAuthMiddleware(s.handleUploadKey()))
-	s.mux.HandleFunc("GET /get_key", s.jwtAuthMiddleware(s.handleGetKey()))
+	s.route("POST /upload_key", s.jwtAuthMiddleware(s.handleUploadKey()))
+	s.route("GET /get_key", s.jwtAuthMiddleware(s.handleGetKey()))
+	s.route("POST /get_keys", s.jwtAuthMiddleware(s.handleGetKeys()))
+	s.route("POST /prekeys", s.jwtAuthMiddleware(s.handleUploadPrekeys()))
+	s.route("GET /prekey_bundle", s.jwtAuthMiddleware(s.handleGetPrekeyBundle()))
+	s.route("GET /key_log", s.jwtAuthMiddleware(s.handleGetKeyLog()))
 
 	// Chat/Contact routes (Protected)
-	s.mux.HandleFunc("POST /request_chat", s.jwtAuthMiddleware(s.handleRequestChat()))
-	s.mux.HandleFunc("GET /get_chat_requests", s.jwtAuthMiddleware(s.handleGetChatRequests()))
-	s.mux.HandleFunc("POST /accept_chat", s.jwtAuthMiddleware(s.handleAcceptChat()))
-	s.mux.HandleFunc("GET /get_contacts", s.jwtAuthMiddleware(s.handleGetContacts()))
+	s.route("POST /request_chat", s.jwtAuthMiddleware(s.handleRequestChat()))
+	s.route("GET /get_chat_requests", s.jwtAuthMiddleware(s.handleGetChatRequests()))
+	s.route("POST /accept_chat", s.jwtAuthMiddleware(s.handleAcceptChat()))
+	s.route("POST /accept_chat/batch", s.jwtAuthMiddleware(s.handleAcceptChats()))
+	s.route("POST /decline_chat", s.jwtAuthMiddleware(s.handleDeclineChat()))
+	s.route("GET /get_contacts", s.jwtAuthMiddleware(s.handleGetContacts()))
+	s.route("GET /relationships", s.jwtAuthMiddleware(s.handleGetRelationships()))
+	s.route("GET /conversations", s.jwtAuthMiddleware(s.handleListConversations()))
+
+	// Account routes (Protected)
+	s.route("GET /account/summary", s.jwtAuthMiddleware(s.handleAccountSummary()))
+	s.route("DELETE /account", s.jwtAuthMiddleware(s.handleDeleteAccount()))
+	s.route("GET /settings", s.jwtAuthMiddleware(s.handleGetSettings()))
+	s.route("PATCH /settings", s.jwtAuthMiddleware(s.handleUpdateSettings()))
+	s.route("GET /unread_counts", s.jwtAuthMiddleware(s.handleUnreadCounts()))
+	s.route("GET /me", s.jwtAuthMiddleware(s.handleMe()))
+
+	// Key backup routes (Protected)
+	s.route("PUT /backup", s.jwtAuthMiddleware(s.handlePutBackup()))
+	s.route("GET /backup", s.jwtAuthMiddleware(s.handleGetBackup()))
+	s.route("DELETE /backup", s.jwtAuthMiddleware(s.handleDeleteBackup()))
+
+	// Attachment routes (Protected)
+	s.route("POST /attachments/initiate", s.jwtAuthMiddleware(s.handleInitiateAttachment()))
+	s.route("PUT /attachments/{id}/chunks/{n}", s.jwtAuthMiddleware(s.handlePutAttachmentChunk()))
+	s.route("GET /attachments/{id}/status", s.jwtAuthMiddleware(s.handleAttachmentStatus()))
+	s.route("POST /attachments/{id}/complete", s.jwtAuthMiddleware(s.handleCompleteAttachment()))
+	s.route("GET /attachments/{id}", s.jwtAuthMiddleware(s.handleGetAttachment()))
+	s.route("DELETE /attachments/{id}", s.jwtAuthMiddleware(s.handleDeleteAttachment()))
+
+	// Contact migration routes (Protected)
+	s.route("GET /export/contacts", s.jwtAuthMiddleware(s.handleExportContacts()))
+	s.route("POST /import/contacts", s.jwtAuthMiddleware(s.handleImportContacts()))
+	s.route("GET /import/contacts/{id}", s.jwtAuthMiddleware(s.handleGetContactImport()))
+	s.route("GET /share_payload", s.jwtAuthMiddleware(s.handleGetSharePayload()))
+	s.route("POST /verify_share_payload", s.jwtAuthMiddleware(s.handleVerifySharePayload()))
 
 	// Message routes (Protected)
-	s.mux.HandleFunc("POST /send_message", s.jwtAuthMiddleware(s.handleSendMessage()))
+	s.route("POST /send_message", s.jwtAuthMiddleware(s.handleSendMessage()))
 	// The /get_messages route is still useful for loading history
-	s.mux.HandleFunc("GET /get_messages", s.jwtAuthMiddleware(s.handleGetMessages()))
+	s.route("GET /get_messages", s.jwtAuthMiddleware(s.handleGetMessages()))
+	s.route("POST /messages/delivered", s.jwtAuthMiddleware(s.handleMarkDelivered()))
+	s.route("GET /messages/{id}/status", s.jwtAuthMiddleware(s.handleGetMessageStatus()))
+	s.route("GET /messages/sealed", s.jwtAuthMiddleware(s.handleGetSealedMessages()))
+	s.route("POST /sealed_sender", s.jwtAuthMiddleware(s.handleSetSealedSender()))
+	s.route("GET /sync", s.jwtAuthMiddleware(s.handleSync()))
 
 	// --- New WebSocket Route ---
 	// This route is protected by JWT auth.
 	// It will upgrade the connection and register the client with the hub.
-	s.mux.HandleFunc("GET /ws", s.jwtAuthMiddleware(s.handleServeWS()))
+	s.route("GET /ws", s.wsConnLimitMiddleware(s.jwtAuthMiddleware(s.handleServeWS())))
+
+	// Admin routes (Protected by ADMIN_TOKEN)
+	s.route("GET /admin/runtime", s.adminAuthMiddleware(s.handleAdminRuntime()))
+	s.route("POST /admin/reload", s.adminAuthMiddleware(s.handleAdminReload()))
+	s.route("GET /admin/metrics", s.adminAuthMiddleware(s.handleAdminMetrics()))
+	s.route("GET /admin/dashboard", s.adminAuthMiddleware(s.handleAdminDashboard()))
+	s.route("POST /admin/legal_hold", s.adminAuthMiddleware(s.handleAdminLegalHold()))
+	s.route("POST /admin/registration_mode", s.adminAuthMiddleware(s.handleAdminRegistrationMode()))
+	s.route("GET /admin/messages/{id}/trace", s.adminAuthMiddleware(s.handleAdminMessageTrace()))
+	s.route("GET /admin/integrations/preview", s.adminAuthMiddleware(s.handleAdminIntegrationPreview()))
+	s.route("GET /admin/conversations", s.adminAuthMiddleware(s.handleAdminConversations()))
+	s.route("GET /admin/feature_flags", s.adminAuthMiddleware(s.handleAdminFeatureFlags()))
+	s.route("PUT /admin/feature_flags/{flag}/users/{username}", s.adminAuthMiddleware(s.handleAdminSetFlagOverride()))
+	s.route("PUT /admin/feature_flags/{flag}/rollout", s.adminAuthMiddleware(s.handleAdminSetFlagRollout()))
+	s.route("GET /admin/audit", s.adminAuthMiddleware(s.handleAdminAudit()))
+	s.route("GET /admin/audit/daily", s.adminAuthMiddleware(s.handleAdminAuditDaily()))
+	s.route("GET /admin/audit/export", s.adminAuthMiddleware(s.handleAdminAuditExport()))
+
+	// Federation routes (Protected by peer credentials)
+	if s.cfg.FederationEnabled() {
+		s.route("POST /federation/inbox", s.peerAuthMiddleware(s.handleFederationInbox()))
+		s.route("GET /federation/key", s.peerAuthMiddleware(s.handleFederationKey()))
+	}
+
+	if s.cfg.BootstrapAdminToken != "" {
+		s.route("POST /bootstrap_admin", s.ipRateLimit(config.IPLimitBootstrapAdmin, s.handleBootstrapAdmin()))
+	}
 }
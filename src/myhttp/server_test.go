@@ -0,0 +1,90 @@
+// src/myhttp/server_test.go
+package myhttp
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cryptachat-server/chatservice"
+	"cryptachat-server/config"
+	"cryptachat-server/featureflags"
+	"cryptachat-server/integrations"
+	"cryptachat-server/store"
+	"cryptachat-server/testutil"
+	"cryptachat-server/websockets"
+)
+
+// testStart is the fake clock's start in server tests.
+var testStart = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestConfig loads a configuration from the environment as the server
+// does, with placeholders for the variables it requires. vars are set
+// first, as name/value pairs, and may override them. The database
+// settings are never used to connect; newTestServer takes
+// testutil.DatabaseURL instead.
+func newTestConfig(t testing.TB, vars ...string) *config.Config {
+	t.Helper()
+	if len(vars)%2 != 0 {
+		t.Fatal("newTestConfig: vars must be name/value pairs")
+	}
+	env := map[string]string{
+		"DB_HOST":       "localhost",
+		"DB_PORT":       "5432",
+		"POSTGRES_USER": "test",
+		"POSTGRES_DB":   "test",
+		"SECRET_KEY":    "test-secret-0123456789abcdef0123456789",
+		"BCRYPT_COST":   "4", // The minimum, so tests that hash passwords stay fast
+	}
+	for i := 0; i < len(vars); i += 2 {
+		env[vars[i]] = vars[i+1]
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := config.LoadConfig(filepath.Join(t.TempDir(), ".env"))
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	return cfg
+}
+
+// newOfflineServer returns a Server without a store or routes, for
+// exercising code that fails or answers before touching the database.
+func newOfflineServer(t *testing.T, vars ...string) (*Server, *testutil.FakeClock) {
+	t.Helper()
+	cfg := newTestConfig(t, vars...)
+	svc := chatservice.New(cfg, nil, nil)
+	clk := testutil.NewFakeClock(testStart)
+	svc.SetClock(clk)
+	return &Server{cfg: cfg, svc: svc}, clk
+}
+
+// newTestServer returns a fully wired Server on a fresh schema of the
+// test database, and skips t without one.
+func newTestServer(t testing.TB, vars ...string) (*Server, *store.PostgresStore, *testutil.FakeClock) {
+	t.Helper()
+	cfg := newTestConfig(t, vars...)
+	st, err := store.NewPostgresStore(testutil.DatabaseURL(t), "../store/schema.sql")
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(st.Close)
+	clk := testutil.NewFakeClock(time.Now().UTC().Truncate(time.Second))
+	st.SetClock(clk)
+	svc := chatservice.New(cfg, st, featureflags.New(st, cfg.Runtime().FeatureFlags))
+	svc.SetClock(clk)
+	hub := websockets.NewHub()
+	hub.SetClock(clk)
+	return NewServer(cfg, st, svc, hub, integrations.NewFilter(integrations.PrivacyMode(cfg.IntegrationPrivacyMode))), st, clk
+}
+
+// signToken signs claims with the server's key.
+func signToken(t *testing.T, cfg *config.Config, claims chatservice.Claims) string {
+	t.Helper()
+	token, err := cfg.TokenSigner.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
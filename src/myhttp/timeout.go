@@ -0,0 +1,63 @@
+package myhttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Per-route deadlines. A handler whose store call outlives its deadline gets
+// a cancelled context and answers 504 instead of hanging until the client
+// gives up.
+const (
+	defaultRouteTimeout = 10 * time.Second
+	authRouteTimeout    = 5 * time.Second
+	// Chunks come over slow mobile links, and completing an upload reads
+	// every chunk back
+	attachmentRouteTimeout = 2 * time.Minute
+)
+
+// routeTimeouts overrides defaultRouteTimeout by route pattern. Zero means no
+// deadline, for routes that stream or hold the connection open.
+var routeTimeouts = map[string]time.Duration{
+	"POST /register":        authRouteTimeout,
+	"POST /login":           authRouteTimeout,
+	"POST /bootstrap_admin": authRouteTimeout,
+
+	"PUT /attachments/{id}/chunks/{n}": attachmentRouteTimeout,
+	"POST /attachments/{id}/complete":  attachmentRouteTimeout,
+
+	"GET /ws":                 0,
+	"GET /admin/audit/export": 0,
+	"GET /attachments/{id}":   0,
+}
+
+// routeTimeout returns the deadline for route, or 0 for none.
+func routeTimeout(route string) time.Duration {
+	if d, ok := routeTimeouts[route]; ok {
+		return d
+	}
+	return defaultRouteTimeout
+}
+
+// withTimeout bounds the request context by the route's deadline.
+func withTimeout(timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	if timeout <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		if aw, ok := w.(*apiWriter); ok {
+			aw.ctx = ctx
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// timedOut reports whether the request behind w ran past its route deadline.
+func timedOut(w http.ResponseWriter) bool {
+	aw, ok := w.(*apiWriter)
+	return ok && aw.ctx != nil && errors.Is(aw.ctx.Err(), context.DeadlineExceeded)
+}
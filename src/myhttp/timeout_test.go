@@ -0,0 +1,79 @@
+// src/myhttp/timeout_test.go
+package myhttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestRouteTimeouts registers routes whose handler stands in for a store
+// call that never returns: it waits on the request context, as pgx does,
+// and reports what that fails with. Past the route's deadline that is a
+// 504 in the error envelope; a route without a deadline has none to wait
+// on, and an error before the deadline is still a 500.
+func TestRouteTimeouts(t *testing.T) {
+	for route, want := range map[string]time.Duration{
+		"POST /login":             authRouteTimeout,
+		"POST /send_message":      defaultRouteTimeout,
+		"GET /ws":                 0,
+		"GET /admin/audit/export": 0,
+	} {
+		if got := routeTimeout(route); got != want {
+			t.Errorf("%s: deadline %v, want %v", route, got, want)
+		}
+	}
+
+	routeTimeouts["GET /slow"] = 50 * time.Millisecond
+	routeTimeouts["GET /stream"] = 0
+	t.Cleanup(func() {
+		delete(routeTimeouts, "GET /slow")
+		delete(routeTimeouts, "GET /stream")
+	})
+	s, _ := newOfflineServer(t)
+	s.mux = http.NewServeMux()
+	slowStore := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			s.writeJSON(w, messageResponse{Message: "no deadline"}, http.StatusOK)
+			return
+		}
+		<-r.Context().Done()
+		s.writeServiceError(w, fmt.Errorf("database error: %w", r.Context().Err()))
+	}
+	s.route("GET /slow", slowStore)
+	s.route("GET /stream", slowStore)
+	s.route("GET /broken", func(w http.ResponseWriter, r *http.Request) {
+		s.writeServiceError(w, fmt.Errorf("database error: relation does not exist"))
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, apiPrefix+path, nil))
+		return w
+	}
+
+	start := time.Now()
+	w := get("/slow")
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("a 50ms deadline took %v", took)
+	}
+	var body struct {
+		Error struct {
+			Message   string `json:"message"`
+			Retryable bool   `json:"retryable"`
+		} `json:"error"`
+	}
+	decodeBody(t, w, &body)
+	if w.Code != http.StatusGatewayTimeout || body.Error.Message != "Request timed out." || !body.Error.Retryable {
+		t.Errorf("past the deadline: %d %s, want a retryable 504", w.Code, w.Body)
+	}
+
+	if w := get("/stream"); w.Code != http.StatusOK {
+		t.Errorf("a route without a deadline: %d %s", w.Code, w.Body)
+	}
+	if w := get("/broken"); w.Code != http.StatusInternalServerError {
+		t.Errorf("an error within the deadline: %d %s, want 500", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,217 @@
+package myhttp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The dashboard's request figures cover the last trafficWindow, kept as a
+// ring of trafficSlot-long slots. A slot holds counters and a latency
+// histogram per route, and routes are the registered patterns, so memory
+// is bounded by slots times routes however much traffic arrives. The window
+// moves a slot at a time: it covers between trafficWindow-trafficSlot and
+// trafficWindow of history.
+const (
+	trafficWindow = 5 * time.Minute
+	trafficSlot   = 10 * time.Second
+	trafficSlots  = int(trafficWindow / trafficSlot)
+	slowestRoutes = 5 // Routes listed in TrafficStats.Slowest
+)
+
+// latencyBounds are the upper bounds of the latency buckets. Percentiles
+// are reported as the bound of the bucket they fall in, or the slowest
+// request seen for the last, open-ended bucket.
+var latencyBounds = [...]time.Duration{
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// routeCounts is one route's requests in one slot.
+type routeCounts struct {
+	requests     int64
+	clientErrors int64 // 4xx
+	serverErrors int64 // 5xx
+	total        time.Duration
+	max          time.Duration
+	latency      [len(latencyBounds) + 1]int64
+}
+
+func (c *routeCounts) add(o *routeCounts) {
+	c.requests += o.requests
+	c.clientErrors += o.clientErrors
+	c.serverErrors += o.serverErrors
+	c.total += o.total
+	if o.max > c.max {
+		c.max = o.max
+	}
+	for i, n := range o.latency {
+		c.latency[i] += n
+	}
+}
+
+// percentile returns the latency below which q of the requests fell.
+func (c *routeCounts) percentile(q float64) time.Duration {
+	if c.requests == 0 {
+		return 0
+	}
+	rank := int64(q*float64(c.requests) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range c.latency {
+		seen += n
+		if seen >= rank {
+			if i < len(latencyBounds) && latencyBounds[i] < c.max {
+				return latencyBounds[i]
+			}
+			return c.max
+		}
+	}
+	return c.max
+}
+
+type trafficSlotCounts struct {
+	index  int64 // Unix time / trafficSlot; the slot is stale if it isn't current
+	routes map[string]*routeCounts
+}
+
+// trafficRecorder records requests into the ring of slots.
+type trafficRecorder struct {
+	mu      sync.Mutex
+	started time.Time
+	slots   [trafficSlots]trafficSlotCounts
+}
+
+func slotIndex(t time.Time) int64 {
+	return t.UnixNano() / int64(trafficSlot)
+}
+
+// observe records a request to route that was answered with status after
+// took.
+func (t *trafficRecorder) observe(route string, status int, took time.Duration, now time.Time) {
+	idx := slotIndex(now)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.started.IsZero() {
+		t.started = now
+	}
+	slot := &t.slots[int(idx%int64(trafficSlots))]
+	if slot.index != idx || slot.routes == nil {
+		slot.index = idx
+		slot.routes = make(map[string]*routeCounts)
+	}
+	c, ok := slot.routes[route]
+	if !ok {
+		c = &routeCounts{}
+		slot.routes[route] = c
+	}
+	c.requests++
+	switch {
+	case status >= 500:
+		c.serverErrors++
+	case status >= 400:
+		c.clientErrors++
+	}
+	c.total += took
+	if took > c.max {
+		c.max = took
+	}
+	c.latency[sort.Search(len(latencyBounds), func(i int) bool { return latencyBounds[i] >= took })]++
+}
+
+// TrafficStats summarizes the requests of the last few minutes for
+// /admin/dashboard.
+type TrafficStats struct {
+	WindowSeconds     float64        `json:"window_seconds"` // Shorter than the full window after a start
+	Requests          int64          `json:"requests"`
+	RequestsPerSecond float64        `json:"requests_per_second"`
+	ClientErrors      int64          `json:"client_errors"` // 4xx
+	ServerErrors      int64          `json:"server_errors"` // 5xx
+	ErrorRate         float64        `json:"error_rate"`    // Server errors per request
+	P50Ms             float64        `json:"p50_ms"`
+	P99Ms             float64        `json:"p99_ms"`
+	Slowest           []RouteLatency `json:"slowest_endpoints"` // By mean latency, slowest first
+}
+
+// RouteLatency is one route's requests in the window.
+type RouteLatency struct {
+	Route    string  `json:"route"`
+	Requests int64   `json:"requests"`
+	MeanMs   float64 `json:"mean_ms"`
+	P99Ms    float64 `json:"p99_ms"`
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// summary adds up the slots still in the window at now.
+func (t *trafficRecorder) summary(now time.Time) TrafficStats {
+	oldest := slotIndex(now) - int64(trafficSlots) + 1
+	var all routeCounts
+	routes := make(map[string]*routeCounts)
+
+	t.mu.Lock()
+	for i := range t.slots {
+		slot := &t.slots[i]
+		if slot.routes == nil || slot.index < oldest {
+			continue
+		}
+		for route, c := range slot.routes {
+			sum, ok := routes[route]
+			if !ok {
+				sum = &routeCounts{}
+				routes[route] = sum
+			}
+			sum.add(c)
+			all.add(c)
+		}
+	}
+	started := t.started
+	t.mu.Unlock()
+
+	window := trafficWindow
+	if !started.IsZero() && now.Sub(started) < window {
+		window = now.Sub(started)
+	}
+	if window < trafficSlot {
+		window = trafficSlot // Don't report a burst at start as a huge rate
+	}
+	stats := TrafficStats{
+		WindowSeconds:     window.Seconds(),
+		Requests:          all.requests,
+		RequestsPerSecond: float64(all.requests) / window.Seconds(),
+		ClientErrors:      all.clientErrors,
+		ServerErrors:      all.serverErrors,
+		P50Ms:             millis(all.percentile(0.50)),
+		P99Ms:             millis(all.percentile(0.99)),
+		Slowest:           []RouteLatency{},
+	}
+	if all.requests > 0 {
+		stats.ErrorRate = float64(all.serverErrors) / float64(all.requests)
+	}
+
+	for route, c := range routes {
+		stats.Slowest = append(stats.Slowest, RouteLatency{
+			Route:    route,
+			Requests: c.requests,
+			MeanMs:   millis(c.total) / float64(c.requests),
+			P99Ms:    millis(c.percentile(0.99)),
+		})
+	}
+	sort.Slice(stats.Slowest, func(i, j int) bool {
+		a, b := stats.Slowest[i], stats.Slowest[j]
+		if a.MeanMs != b.MeanMs {
+			return a.MeanMs > b.MeanMs
+		}
+		return a.Route < b.Route
+	})
+	if len(stats.Slowest) > slowestRoutes {
+		stats.Slowest = stats.Slowest[:slowestRoutes]
+	}
+	return stats
+}
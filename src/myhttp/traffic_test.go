@@ -0,0 +1,140 @@
+// src/myhttp/traffic_test.go
+package myhttp
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestTrafficSummary records synthetic traffic and checks the counts,
+// rates, percentiles and slowest routes, then lets the window pass.
+func TestTrafficSummary(t *testing.T) {
+	var tr trafficRecorder
+	start := time.Unix(1_700_000_000, 0) // On a slot boundary
+	observe := func(route string, status int, took time.Duration, n int, at time.Time) {
+		for i := 0; i < n; i++ {
+			tr.observe(route, status, took, at)
+		}
+	}
+
+	empty := tr.summary(start)
+	if empty.Requests != 0 || empty.P50Ms != 0 || empty.Slowest == nil || len(empty.Slowest) != 0 {
+		t.Errorf("before any traffic: %+v", empty)
+	}
+
+	observe("GET /a", http.StatusOK, 3*time.Millisecond, 98, start)
+	observe("GET /b", http.StatusInternalServerError, 700*time.Millisecond, 2, start)
+	observe("GET /c", http.StatusNotFound, 2*time.Millisecond, 1, start)
+	for _, route := range []string{"GET /g", "GET /f", "GET /e", "GET /d"} {
+		observe(route, http.StatusOK, time.Millisecond, 1, start.Add(trafficSlot))
+	}
+
+	got := tr.summary(start.Add(trafficSlot))
+	if got.Requests != 105 || got.ClientErrors != 1 || got.ServerErrors != 2 {
+		t.Errorf("counts: %+v", got)
+	}
+	if got.ErrorRate != 2.0/105 {
+		t.Errorf("error rate %v, want 2/105", got.ErrorRate)
+	}
+	if got.WindowSeconds != 10 || got.RequestsPerSecond != 10.5 {
+		t.Errorf("window %vs at %v/s, want 10s at 10.5/s", got.WindowSeconds, got.RequestsPerSecond)
+	}
+	// p50 is the bound of the 5ms bucket; p99 is in the bucket past the
+	// slowest request, so it is that request
+	if got.P50Ms != 5 || got.P99Ms != 700 {
+		t.Errorf("p50 %vms, p99 %vms; want 5 and 700", got.P50Ms, got.P99Ms)
+	}
+	want := []RouteLatency{
+		{Route: "GET /b", Requests: 2, MeanMs: 700, P99Ms: 700},
+		{Route: "GET /a", Requests: 98, MeanMs: 3, P99Ms: 3},
+		{Route: "GET /c", Requests: 1, MeanMs: 2, P99Ms: 2},
+		{Route: "GET /d", Requests: 1, MeanMs: 1, P99Ms: 1},
+		{Route: "GET /e", Requests: 1, MeanMs: 1, P99Ms: 1},
+	}
+	if len(got.Slowest) != len(want) {
+		t.Fatalf("slowest: %+v", got.Slowest)
+	}
+	for i := range want {
+		if got.Slowest[i] != want[i] {
+			t.Errorf("slowest %d: %+v, want %+v", i, got.Slowest[i], want[i])
+		}
+	}
+
+	// The rate spreads over the time since the first request
+	if got := tr.summary(start.Add(time.Minute)); got.WindowSeconds != 60 || got.RequestsPerSecond != 1.75 {
+		t.Errorf("a minute in: %vs at %v/s", got.WindowSeconds, got.RequestsPerSecond)
+	}
+
+	// The first slot stays in the window until it has been a whole window
+	if got := tr.summary(start.Add(trafficWindow - time.Second)); got.Requests != 105 {
+		t.Errorf("just inside the window: %d requests", got.Requests)
+	}
+	later := start.Add(trafficWindow)
+	if got := tr.summary(later); got.Requests != 4 || got.ServerErrors != 0 || got.WindowSeconds != trafficWindow.Seconds() {
+		t.Errorf("once the first slot has left the window: %+v", got)
+	}
+
+	// A request a window later reuses the first slot, without its old counts
+	observe("GET /a", http.StatusOK, 20*time.Millisecond, 1, later)
+	got = tr.summary(later.Add(trafficWindow - time.Second))
+	if got.Requests != 1 || len(got.Slowest) != 1 || got.Slowest[0].MeanMs != 20 || got.P50Ms != 20 {
+		t.Errorf("the reused slot: %+v", got)
+	}
+}
+
+// TestDashboardCountsRequests sends requests through the server and checks
+// /admin/dashboard counts them by outcome and route.
+func TestDashboardCountsRequests(t *testing.T) {
+	const adminToken = "admin-token-0123456789abcdef"
+	s, st, clk := newTestServer(t, "ADMIN_TOKEN", adminToken)
+	registerAlice(t, s, 4, "correct horse battery")
+
+	for i := 0; i < 3; i++ {
+		serveAs(s, http.MethodGet, apiPrefix+"/server_info", "", "")
+	}
+	if w := postLogin(s, "alice", "wrong password"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("bad login: %d", w.Code)
+	}
+	finish := st.StartJobRun("retention")
+	clk.Advance(2 * time.Second)
+	finish(nil)
+
+	dashboard := func() adminDashboardResponse {
+		t.Helper()
+		var d adminDashboardResponse
+		w := serveAs(s, http.MethodGet, apiPrefix+"/admin/dashboard", adminToken, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("dashboard: %d %s", w.Code, w.Body)
+		}
+		decodeBody(t, w, &d)
+		return d
+	}
+	d := dashboard()
+	// Three server_info and the failed login; alice was stored directly
+	if d.Requests.Requests != 4 || d.Requests.ClientErrors != 1 || d.Requests.ServerErrors != 0 {
+		t.Errorf("requests: %+v", d.Requests)
+	}
+	routes := make(map[string]int64)
+	for _, r := range d.Requests.Slowest {
+		routes[r.Route] = r.Requests
+	}
+	if routes["GET /server_info"] != 3 || routes["POST /login"] != 1 {
+		t.Errorf("slowest routes: %+v", d.Requests.Slowest)
+	}
+	if len(d.Jobs) != 1 || d.Jobs[0].Name != "retention" || d.Jobs[0].LastDurationMs != 2000 {
+		t.Errorf("jobs: %+v", d.Jobs)
+	}
+	if d.Connections.WebSockets != 0 || d.Database.Max == 0 {
+		t.Errorf("connections %+v, database %+v", d.Connections, d.Database)
+	}
+
+	// The first dashboard read is counted by the second
+	if got := dashboard().Requests.Requests; got != 5 {
+		t.Errorf("after reading the dashboard: %d requests, want 5", got)
+	}
+	clk.Advance(trafficWindow + trafficSlot)
+	if got := dashboard().Requests.Requests; got != 0 {
+		t.Errorf("a window later: %d requests", got)
+	}
+}
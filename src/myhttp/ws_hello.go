@@ -0,0 +1,140 @@
+// src/myhttp/ws_hello.go
+package myhttp
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"cryptachat-server/store"
+)
+
+const (
+	// helloTimeout bounds how long snapshot queries may delay a new connection.
+	helloTimeout = 2 * time.Second
+	// maxOnlineContacts keeps the hello frame small for users with many contacts.
+	maxOnlineContacts = 200
+)
+
+// helloSources are the queries behind the hello frame and how long they
+// get, kept on the Server so tests can stand in slow or failing ones.
+type helloSources struct {
+	timeout         time.Duration
+	pendingRequests func(ctx context.Context, userID int) (store.RequestCounts, error)
+	contactRefs     func(ctx context.Context, userID int) ([]store.ContactRef, error)
+}
+
+// wsFrame is the envelope for typed (non-message) WebSocket frames.
+type wsFrame struct {
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload"`
+}
+
+// helloPayload is the initial state snapshot sent right after connecting.
+// It only contains counts and small lists.
+type helloPayload struct {
+	PendingRequests int             `json:"pending_requests"`
+	OnlineContacts  []string        `json:"online_contacts"`
+	Replay          replayStatus    `json:"replay"`
+	Degraded        []string        `json:"degraded,omitempty"` // Parts that timed out or failed
+	ServerTime      store.Timestamp `json:"server_time"`
+}
+
+// replayStatus tells clients whether they can resume from an event ID.
+// LastEventID is the user's last event before this connection; the first
+// event it receives should be the next one.
+type replayStatus struct {
+	Supported   bool  `json:"supported"`
+	LastEventID int64 `json:"last_event_id,omitempty"`
+}
+
+// buildHello assembles the hello frame. The queries run concurrently under a
+// shared deadline; anything that doesn't finish in time is left at its zero
+// value and listed in Degraded, so the connection is never held up for long.
+func (s *Server) buildHello(ctx context.Context, user *store.User) []byte {
+	sources := s.hello
+	ctx, cancel := context.WithTimeout(ctx, sources.timeout)
+	defer cancel()
+
+	hello := helloPayload{
+		OnlineContacts: []string{},
+		Replay:         replayStatus{LastEventID: s.hub.LastEventID(user.ID)},
+		ServerTime:     store.NewTimestamp(s.now()),
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		pending  int
+		online   []string
+		degraded []string
+	)
+	fail := func(part string, err error) {
+		log.Printf("WS: hello %s for user %d: %v", part, user.ID, err)
+		mu.Lock()
+		degraded = append(degraded, part)
+		mu.Unlock()
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		counts, err := sources.pendingRequests(ctx, user.ID)
+		if err != nil {
+			fail("pending_requests", err)
+			return
+		}
+		mu.Lock()
+		pending = counts.Incoming
+		mu.Unlock()
+	}()
+	go func() {
+		defer wg.Done()
+		contacts, err := sources.contactRefs(ctx, user.ID)
+		if err != nil {
+			fail("online_contacts", err)
+			return
+		}
+		var names []string
+		for _, c := range contacts {
+			if s.hub.IsOnline(c.ID) {
+				names = append(names, c.Username)
+				if len(names) == maxOnlineContacts {
+					break
+				}
+			}
+		}
+		mu.Lock()
+		online = names
+		mu.Unlock()
+	}()
+
+	// Wait for both queries or the deadline, whichever comes first
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		fail("snapshot", ctx.Err())
+	}
+
+	mu.Lock()
+	hello.PendingRequests = pending
+	if online != nil {
+		hello.OnlineContacts = online
+	}
+	hello.Degraded = degraded
+	mu.Unlock()
+
+	frame, err := json.Marshal(wsFrame{Type: "hello", Payload: hello})
+	if err != nil {
+		log.Printf("WS: could not encode hello for user %d: %v", user.ID, err)
+		return nil
+	}
+	return frame
+}
@@ -0,0 +1,98 @@
+// src/myhttp/ws_hello_test.go
+package myhttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"cryptachat-server/store"
+	"cryptachat-server/websockets"
+)
+
+// decodeHello decodes a hello frame, failing t if it isn't one.
+func decodeHello(t *testing.T, frame []byte) helloPayload {
+	t.Helper()
+	var hello struct {
+		Type    string       `json:"type"`
+		Payload helloPayload `json:"payload"`
+	}
+	if err := json.Unmarshal(frame, &hello); err != nil || hello.Type != "hello" {
+		t.Fatalf("not a hello frame: %s (%v)", frame, err)
+	}
+	return hello.Payload
+}
+
+// TestHelloDegradesInsteadOfWaiting builds the hello frame with one
+// snapshot query stalled far past the deadline and with one failing. The
+// frame must come at the deadline, with what did finish, and name the
+// parts left out.
+func TestHelloDegradesInsteadOfWaiting(t *testing.T) {
+	s, _ := newOfflineServer(t)
+	s.hub = websockets.NewHub()
+	user := &store.User{ID: 1, Username: "alice"}
+	contacts := func(context.Context, int) ([]store.ContactRef, error) {
+		return []store.ContactRef{{ID: 2, Username: "bob"}}, nil
+	}
+
+	t.Run("slow query", func(t *testing.T) {
+		stalled := make(chan struct{})
+		defer close(stalled)
+		s.hello = helloSources{
+			timeout: 50 * time.Millisecond,
+			// Ignores its context, like a query stuck on the network
+			pendingRequests: func(context.Context, int) (store.RequestCounts, error) {
+				<-stalled
+				return store.RequestCounts{Incoming: 3}, nil
+			},
+			contactRefs: contacts,
+		}
+		start := time.Now()
+		hello := decodeHello(t, s.buildHello(context.Background(), user))
+		if took := time.Since(start); took > time.Second {
+			t.Errorf("the hello took %v with a %v deadline", took, s.hello.timeout)
+		}
+		if !slices.Equal(hello.Degraded, []string{"snapshot"}) || hello.PendingRequests != 0 {
+			t.Errorf("got %+v, want the snapshot degraded and no pending count", hello)
+		}
+		if hello.OnlineContacts == nil {
+			t.Error("online_contacts is null, want a list")
+		}
+	})
+
+	t.Run("failed query", func(t *testing.T) {
+		s.hello = helloSources{
+			timeout: time.Minute,
+			pendingRequests: func(context.Context, int) (store.RequestCounts, error) {
+				return store.RequestCounts{}, errors.New("connection reset")
+			},
+			contactRefs: contacts,
+		}
+		start := time.Now()
+		hello := decodeHello(t, s.buildHello(context.Background(), user))
+		if took := time.Since(start); took > 10*time.Second {
+			t.Errorf("a failed query held the hello for %v", took)
+		}
+		if !slices.Equal(hello.Degraded, []string{"pending_requests"}) {
+			t.Errorf("degraded %v, want only pending_requests", hello.Degraded)
+		}
+	})
+
+	t.Run("all in time", func(t *testing.T) {
+		s.hello = helloSources{
+			timeout: time.Minute,
+			pendingRequests: func(context.Context, int) (store.RequestCounts, error) {
+				return store.RequestCounts{Incoming: 3, Outgoing: 1}, nil
+			},
+			contactRefs: contacts,
+		}
+		hello := decodeHello(t, s.buildHello(context.Background(), user))
+		// bob isn't connected to this hub, so isn't listed
+		if hello.Degraded != nil || hello.PendingRequests != 3 || len(hello.OnlineContacts) != 0 {
+			t.Errorf("got %+v, want 3 incoming requests, nobody online and nothing degraded", hello)
+		}
+	})
+}
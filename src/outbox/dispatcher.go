@@ -0,0 +1,240 @@
+// src/outbox/dispatcher.go
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"cryptachat-server/clock"
+	"cryptachat-server/deliverylog"
+	"cryptachat-server/store"
+	"cryptachat-server/websockets"
+)
+
+const (
+	// How often the dispatcher polls for new events.
+	pollInterval = 100 * time.Millisecond
+	// Events claimed per transaction.
+	batchSize = 100
+	// Processed events are kept this long for debugging, then pruned.
+	retention = 24 * time.Hour
+	// How often processed events are pruned.
+	pruneInterval = time.Hour
+	// Cache invalidations are kept this long for /sync; clients offline
+	// for longer should do a full refresh.
+	invalidationRetention = 30 * 24 * time.Hour
+)
+
+// Dispatcher executes queued outbox events (currently WebSocket fan-out).
+// Delivery is at-least-once: if the process dies after pushing but before
+// marking an event processed, it is pushed again after restart. Clients
+// deduplicate pushed messages on their "id".
+type Dispatcher struct {
+	store    *store.PostgresStore
+	hub      *websockets.Hub
+	clock    clock.Clock
+	recorder *deliverylog.Recorder
+}
+
+func NewDispatcher(store *store.PostgresStore, hub *websockets.Hub, recorder *deliverylog.Recorder) *Dispatcher {
+	return &Dispatcher{
+		store:    store,
+		hub:      hub,
+		clock:    clock.Real,
+		recorder: recorder,
+	}
+}
+
+// SetClock replaces the dispatcher's clock. Must be called before Run. Intended for tests.
+func (d *Dispatcher) SetClock(c clock.Clock) {
+	d.clock = c
+}
+
+// Run polls the outbox until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	poll := d.clock.NewTicker(pollInterval)
+	defer poll.Stop()
+	prune := d.clock.NewTicker(pruneInterval)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C():
+			d.drain(ctx)
+		case <-prune.C():
+			n, err := d.store.PruneOutbox(ctx, d.clock.Now().Add(-retention))
+			if err != nil {
+				log.Printf("OUTBOX: prune failed: %v", err)
+			} else if n > 0 {
+				log.Printf("OUTBOX: pruned %d processed events", n)
+			}
+			n, err = d.store.PruneInvalidations(ctx, d.clock.Now().Add(-invalidationRetention))
+			if err != nil {
+				log.Printf("OUTBOX: invalidation prune failed: %v", err)
+			} else if n > 0 {
+				log.Printf("OUTBOX: pruned %d cache invalidations", n)
+			}
+		}
+	}
+}
+
+// drain processes batches until the outbox is empty or an error occurs.
+func (d *Dispatcher) drain(ctx context.Context) {
+	finish := d.store.StartJobRun("outbox")
+	for {
+		n, err := d.store.ProcessOutbox(ctx, batchSize, d.handle)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("OUTBOX: %v", err)
+			}
+			finish(err)
+			return
+		}
+		if n < batchSize {
+			finish(nil)
+			return
+		}
+	}
+}
+
+// handle executes a single event.
+func (d *Dispatcher) handle(ctx context.Context, ev store.OutboxEvent) error {
+	switch ev.EventType {
+	case store.EventMessageCreated:
+		var p store.MessageCreatedPayload
+		if err := json.Unmarshal(ev.Payload, &p); err != nil {
+			// A malformed payload will never succeed; log and skip it.
+			log.Printf("OUTBOX: dropping event %d with bad payload: %v", ev.ID, err)
+			return nil
+		}
+		if err := d.pushMessage(ctx, p); err != nil {
+			d.recorder.Record(store.DeliveryLogEntry{
+				MessageID: p.MessageID,
+				Stage:     store.StageOutbox,
+				Outcome:   "failed",
+				Details:   map[string]interface{}{"event_id": ev.ID, "error": err.Error()},
+			})
+			return err
+		}
+		d.recorder.Record(store.DeliveryLogEntry{
+			MessageID: p.MessageID,
+			Stage:     store.StageOutbox,
+			Outcome:   "dispatched",
+			Details: map[string]interface{}{
+				"event_id": ev.ID,
+				"lag_ms":   d.clock.Now().Sub(ev.CreatedAt).Milliseconds(),
+			},
+		})
+		return nil
+	case store.EventCacheInvalidated:
+		var p store.CacheInvalidatedPayload
+		if err := json.Unmarshal(ev.Payload, &p); err != nil {
+			log.Printf("OUTBOX: dropping event %d with bad payload: %v", ev.ID, err)
+			return nil
+		}
+		d.pushInvalidations(p)
+		return nil
+	case store.EventUsernameChanged:
+		var p store.UsernameChangedPayload
+		if err := json.Unmarshal(ev.Payload, &p); err != nil {
+			log.Printf("OUTBOX: dropping event %d with bad payload: %v", ev.ID, err)
+			return nil
+		}
+		d.pushUsernameChanged(p)
+		return nil
+	default:
+		log.Printf("OUTBOX: dropping event %d of unknown type %q", ev.ID, ev.EventType)
+		return nil
+	}
+}
+
+// pushMessage pushes a new message to both participants, each with their own
+// blob. Sealed-sender messages have no stored sender and go to the recipient only.
+func (d *Dispatcher) pushMessage(ctx context.Context, p store.MessageCreatedPayload) error {
+	if p.Sealed {
+		msg, err := d.store.GetMessageForUser(ctx, p.MessageID, p.RecipientID)
+		if err != nil {
+			return fmt.Errorf("could not get sealed message %d for recipient %d: %v", p.MessageID, p.RecipientID, err)
+		}
+		msg.Transport = store.TransportWSLive
+		d.hub.PushToUserWithReport(p.RecipientID, msg, d.reportPush(p.MessageID, p.RecipientID))
+		return nil
+	}
+
+	// 1. Push to sender's websocket (so all their devices get the new message)
+	msgForSender, err := d.store.GetMessageForUser(ctx, p.MessageID, p.SenderID)
+	if err != nil {
+		return fmt.Errorf("could not get message %d for sender %d: %v", p.MessageID, p.SenderID, err)
+	}
+	// 2. Get the message object as the RECIPIENT sees it
+	msgForRecipient, err := d.store.GetMessageForUser(ctx, p.MessageID, p.RecipientID)
+	if err != nil {
+		return fmt.Errorf("could not get message %d for recipient %d: %v", p.MessageID, p.RecipientID, err)
+	}
+
+	msgForSender.Transport = store.TransportWSLive
+	msgForRecipient.Transport = store.TransportWSLive
+
+	d.hub.PushToUserWithReport(p.SenderID, msgForSender, d.reportPush(p.MessageID, p.SenderID))
+	d.hub.PushToUserWithReport(p.RecipientID, msgForRecipient, d.reportPush(p.MessageID, p.RecipientID))
+	return nil
+}
+
+// reportPush returns a hub callback that logs the push outcome for one
+// participant. Offline users fetch the message over HTTP later.
+func (d *Dispatcher) reportPush(messageID, userID int) func(websockets.PushOutcome) {
+	return func(outcome websockets.PushOutcome) {
+		d.recorder.Record(store.DeliveryLogEntry{
+			MessageID: messageID,
+			UserID:    userID,
+			Stage:     store.StageWSPush,
+			Outcome:   string(outcome),
+		})
+	}
+}
+
+// invalidateFrame is the typed WebSocket frame for a cache invalidation.
+type invalidateFrame struct {
+	Type    string             `json:"type"`
+	Payload store.Invalidation `json:"payload"`
+}
+
+// pushInvalidations sends each user their invalidation. Users who are
+// offline pick it up from /sync.
+func (d *Dispatcher) pushInvalidations(p store.CacheInvalidatedPayload) {
+	for i, userID := range p.UserIDs {
+		if i >= len(p.Invalidations) {
+			break
+		}
+		d.hub.PushToUser(userID, invalidateFrame{Type: "invalidate", Payload: p.Invalidations[i]})
+	}
+}
+
+// usernameChangedFrame is the typed WebSocket frame for a rename.
+type usernameChangedFrame struct {
+	Type    string                `json:"type"`
+	Payload usernameChangedRename `json:"payload"`
+}
+
+type usernameChangedRename struct {
+	OldUsername string          `json:"old_username"`
+	Username    string          `json:"username"`
+	ChangedAt   store.Timestamp `json:"changed_at"`
+}
+
+// pushUsernameChanged tells the renamed user and their contacts. Users who
+// are offline were sent invalidations and refresh their lists instead.
+func (d *Dispatcher) pushUsernameChanged(p store.UsernameChangedPayload) {
+	frame := usernameChangedFrame{
+		Type:    "username_changed",
+		Payload: usernameChangedRename{OldUsername: p.OldUsername, Username: p.Username, ChangedAt: p.ChangedAt},
+	}
+	for _, userID := range p.UserIDs {
+		d.hub.PushToUser(userID, frame)
+	}
+}
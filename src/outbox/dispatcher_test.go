@@ -0,0 +1,143 @@
+// src/outbox/dispatcher_test.go
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cryptachat-server/deliverylog"
+	"cryptachat-server/store"
+	"cryptachat-server/testutil"
+	"cryptachat-server/websockets"
+)
+
+// waitFor polls cond until it holds, failing the test after five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestEventSurvivesDispatcherDeath sends a message, lets a dispatcher
+// claim its event and die before marking it processed, and checks a
+// dispatcher started afterwards pushes it to both participants.
+func TestEventSurvivesDispatcherDeath(t *testing.T) {
+	st, err := store.NewPostgresStore(testutil.DatabaseURL(t), "../store/schema.sql")
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(st.Close)
+	clk := testutil.NewFakeClock(time.Now().UTC().Truncate(time.Second))
+	st.SetClock(clk)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	var ids []int
+	for _, name := range []string{"alice", "bob"} {
+		if err := st.RegisterUser(ctx, name, "hash", nil); err != nil {
+			t.Fatal(err)
+		}
+		id, err := st.GetUserIDByUsername(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	pending := func() int {
+		t.Helper()
+		stats, err := st.GetOutboxStats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats.Pending
+	}
+	before := pending()
+	messageID, _, err := st.SendMessage(ctx, ids[0], "bob", "for alice", "for bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pending(); got != before+1 {
+		t.Fatalf("%d events pending after the send, want %d", got, before+1)
+	}
+
+	// The first dispatcher dies while handling the event, before its
+	// transaction marks it processed
+	died := errors.New("process killed")
+	_, err = st.ProcessOutbox(ctx, batchSize, func(_ context.Context, ev store.OutboxEvent) error {
+		if ev.EventType == store.EventMessageCreated {
+			return died
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("the dying dispatcher reported success")
+	}
+	if got := pending(); got != 1 {
+		t.Fatalf("%d events pending after the dispatcher died, want the message's 1", got)
+	}
+
+	hub := websockets.NewHub()
+	go hub.Run()
+	recorder := deliverylog.NewRecorder(st)
+	recorder.SetClock(clk)
+	go recorder.Run(ctx)
+	d := NewDispatcher(st, hub, recorder)
+	d.SetClock(clk)
+	go d.Run(ctx)
+
+	waitFor(t, "the restarted dispatcher to drain the outbox", func() bool {
+		clk.Advance(pollInterval)
+		return pending() == 0
+	})
+
+	// Neither participant is online, so each push reports that; what
+	// matters is that both were attempted, once
+	var entries []store.DeliveryLogEntry
+	waitFor(t, "the delivery log", func() bool {
+		clk.Advance(time.Second)
+		entries, err = st.GetDeliveryLog(ctx, messageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries) >= 3
+	})
+	pushed := make(map[int]int)
+	dispatched := 0
+	for _, e := range entries {
+		switch e.Stage {
+		case store.StageOutbox:
+			if e.Outcome == "dispatched" {
+				dispatched++
+			}
+		case store.StageWSPush:
+			pushed[e.UserID]++
+		}
+	}
+	if dispatched != 1 || pushed[ids[0]] != 1 || pushed[ids[1]] != 1 {
+		t.Errorf("delivery log %+v: want one dispatch and one push to each participant", entries)
+	}
+}
+
+// TestHandleDropsEventsThatCanNeverSucceed hands the dispatcher events of
+// an unknown type and with malformed payloads. Retrying them would block
+// the events behind them forever, so each must be reported as handled.
+func TestHandleDropsEventsThatCanNeverSucceed(t *testing.T) {
+	d := NewDispatcher(nil, websockets.NewHub(), nil)
+	for _, ev := range []store.OutboxEvent{
+		{ID: 1, EventType: "no.such_event", Payload: []byte(`{}`)},
+		{ID: 2, EventType: store.EventMessageCreated, Payload: []byte(`not json`)},
+		{ID: 3, EventType: store.EventCacheInvalidated, Payload: []byte(`[`)},
+		{ID: 4, EventType: store.EventUsernameChanged, Payload: []byte(`"a string"`)},
+	} {
+		if err := d.handle(context.Background(), ev); err != nil {
+			t.Errorf("event %d (%s): %v, want it dropped", ev.ID, ev.EventType, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// src/passwords/algorithm.go
+package passwords
+
+import (
+	"errors"
+	"strings"
+)
+
+// Stored hashes say which algorithm made them: bcrypt's own "$2b$..." form,
+// or a PHC string such as "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>".
+// A hash is always checked with the algorithm and parameters it declares,
+// so changing the configured algorithm needs no flag day: old hashes keep
+// working and are replaced as their owners log in (see Hasher.NeedsRehash).
+
+// Algorithm names.
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+)
+
+var (
+	// ErrMismatch is returned when a password doesn't match its hash.
+	ErrMismatch = errors.New("password does not match")
+	// ErrMalformedHash is returned for a stored hash that no algorithm
+	// accepts. No password matches it.
+	ErrMalformedHash = errors.New("malformed password hash")
+)
+
+// PasswordHasher is one password hashing algorithm with its parameters.
+type PasswordHasher interface {
+	// Algorithm is the name of the algorithm, e.g. AlgorithmArgon2id.
+	Algorithm() string
+	// Hash returns the encoded hash of password with these parameters.
+	Hash(password []byte) (string, error)
+	// Verify checks password against an encoded hash of this algorithm,
+	// whatever its parameters. It returns ErrMismatch or ErrMalformedHash.
+	Verify(encoded string, password []byte) error
+	// Current reports whether encoded is a hash of this algorithm that
+	// needn't be replaced by one with these parameters.
+	Current(encoded string) bool
+}
+
+// identify returns the name of the algorithm encoded declares, or "".
+func identify(encoded string) string {
+	switch {
+	case strings.HasPrefix(encoded, "$2a$"),
+		strings.HasPrefix(encoded, "$2b$"),
+		strings.HasPrefix(encoded, "$2y$"):
+		return AlgorithmBcrypt
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return AlgorithmArgon2id
+	}
+	return ""
+}
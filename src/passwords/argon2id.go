@@ -0,0 +1,105 @@
+// src/passwords/argon2id.go
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2SaltBytes = 16
+	argon2KeyBytes  = 32
+
+	// A stored hash asking for more than this is refused rather than
+	// computed, so a tampered row can't exhaust the server's memory.
+	maxArgon2MemoryKiB = 1 << 20 // 1 GiB
+	maxArgon2Time      = 64
+)
+
+// Argon2id hashes with Argon2id (RFC 9106) and encodes the result as a PHC
+// string. Memory is in KiB.
+type Argon2id struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// Algorithm returns AlgorithmArgon2id.
+func (a Argon2id) Algorithm() string {
+	return AlgorithmArgon2id
+}
+
+// Hash returns the PHC-encoded Argon2id hash of password with a random salt.
+func (a Argon2id) Hash(password []byte) (string, error) {
+	salt := make([]byte, argon2SaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(password, salt, a.Iterations, a.Memory, a.Parallelism, argon2KeyBytes)
+	return a.encode(salt, key), nil
+}
+
+// Verify checks password against a PHC-encoded Argon2id hash with any
+// parameters within limits.
+func (a Argon2id) Verify(encoded string, password []byte) error {
+	params, salt, key, err := parseArgon2id(encoded)
+	if err != nil {
+		return err
+	}
+	got := argon2.IDKey(password, salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(got, key) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// Current reports whether encoded is an Argon2id hash with a's parameters.
+func (a Argon2id) Current(encoded string) bool {
+	params, _, key, err := parseArgon2id(encoded)
+	return err == nil && params == a && len(key) == argon2KeyBytes
+}
+
+func (a Argon2id) encode(salt, key []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+}
+
+// parseArgon2id splits a PHC-encoded Argon2id hash. Anything that doesn't
+// re-encode to exactly the same string is malformed.
+func parseArgon2id(encoded string) (Argon2id, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != AlgorithmArgon2id {
+		return Argon2id{}, nil, nil, ErrMalformedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2id{}, nil, nil, ErrMalformedHash
+	}
+	var params Argon2id
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return Argon2id{}, nil, nil, ErrMalformedHash
+	}
+	if params.Parallelism == 0 || params.Iterations == 0 || params.Iterations > maxArgon2Time ||
+		params.Memory < 8*uint32(params.Parallelism) || params.Memory > maxArgon2MemoryKiB {
+		return Argon2id{}, nil, nil, ErrMalformedHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) < 8 {
+		return Argon2id{}, nil, nil, ErrMalformedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) < 16 || len(key) > 64 {
+		return Argon2id{}, nil, nil, ErrMalformedHash
+	}
+	if params.encode(salt, key) != encoded {
+		return Argon2id{}, nil, nil, ErrMalformedHash
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,48 @@
+// src/passwords/bcrypt.go
+package passwords
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Bcrypt hashes with bcrypt at Cost. Passwords longer than 72 bytes are
+// refused by Hash.
+type Bcrypt struct {
+	Cost int
+}
+
+// Algorithm returns AlgorithmBcrypt.
+func (b Bcrypt) Algorithm() string {
+	return AlgorithmBcrypt
+}
+
+// Hash returns the bcrypt hash of password.
+func (b Bcrypt) Hash(password []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(password, b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Verify checks password against a bcrypt hash of any cost.
+func (b Bcrypt) Verify(encoded string, password []byte) error {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), password)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrMismatch
+	}
+	if err != nil {
+		return ErrMalformedHash
+	}
+	return nil
+}
+
+// Current reports whether encoded is a bcrypt hash at b.Cost or higher. A
+// costlier hash is kept: lowering BCRYPT_COST, by mistake or not, must not
+// weaken existing hashes as their owners log in.
+func (b Bcrypt) Current(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err == nil && cost >= b.Cost
+}
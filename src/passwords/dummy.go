@@ -0,0 +1,53 @@
+// src/passwords/dummy.go
+package passwords
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// CompareDummy does the work of a Compare against a hash made with the
+// configured algorithm and parameters, and then fails with ErrMismatch.
+// Logins for usernames that don't exist call it, so they take as long as a
+// wrong password for one that does and timing doesn't reveal which names
+// are registered.
+//
+// The dummy hash, of a random password, is made with the configured
+// PasswordHasher on first use, and that same PasswordHasher verifies it.
+func (h *Hasher) CompareDummy(ctx context.Context, password string) error {
+	hash, err := h.dummyHash()
+	if err != nil {
+		return err
+	}
+	release, err := h.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	h.dummyCompares.Add(1)
+	start := time.Now()
+	err = h.hasher.Verify(hash, []byte(password))
+	h.compare.observe(time.Since(start))
+	if err == nil {
+		// Nobody knows the random password, but never let it log anyone in
+		return ErrMismatch
+	}
+	return err
+}
+
+// dummyHash returns the hash CompareDummy checks against, making it once.
+func (h *Hasher) dummyHash() (string, error) {
+	h.dummyOnce.Do(func() {
+		b := make([]byte, 18)
+		if _, err := rand.Read(b); err != nil {
+			h.dummyErr = fmt.Errorf("could not generate dummy password: %w", err)
+			return
+		}
+		h.dummy, h.dummyErr = h.hasher.Hash([]byte(base64.RawURLEncoding.EncodeToString(b)))
+	})
+	return h.dummy, h.dummyErr
+}
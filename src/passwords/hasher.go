@@ -0,0 +1,207 @@
+// src/passwords/hasher.go
+package passwords
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBusy is returned when no hashing slot frees up within the queue
+// timeout. Callers should answer 503 rather than wait indefinitely.
+var ErrBusy = errors.New("password hashing is saturated")
+
+// Hasher hashes new passwords with one PasswordHasher and checks stored
+// hashes with whichever algorithm they declare, with a cap on concurrent
+// operations. Password hashing is deliberately expensive, so without a cap
+// a burst of registrations starves logins; excess callers queue briefly
+// and then fail with ErrBusy.
+type Hasher struct {
+	hasher       PasswordHasher
+	slots        chan struct{}
+	queueTimeout time.Duration
+
+	hash     durationHistogram
+	compare  durationHistogram
+	inFlight atomic.Int64
+	rejected atomic.Int64
+
+	// CompareDummy's hash (see dummy.go) and how often it was checked
+	dummyOnce     sync.Once
+	dummy         string
+	dummyErr      error
+	dummyCompares atomic.Int64
+}
+
+// NewHasher creates a hasher hashing with hasher, allowing concurrency
+// simultaneous operations and queueing others for up to queueTimeout.
+func NewHasher(hasher PasswordHasher, concurrency int, queueTimeout time.Duration) *Hasher {
+	return &Hasher{
+		hasher:       hasher,
+		slots:        make(chan struct{}, concurrency),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// acquire waits for a free slot. The caller must call the returned release.
+func (h *Hasher) acquire(ctx context.Context) (func(), error) {
+	select {
+	case h.slots <- struct{}{}:
+	default:
+		timer := time.NewTimer(h.queueTimeout)
+		defer timer.Stop()
+		select {
+		case h.slots <- struct{}{}:
+		case <-timer.C:
+			h.rejected.Add(1)
+			return nil, ErrBusy
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	h.inFlight.Add(1)
+	return func() {
+		h.inFlight.Add(-1)
+		<-h.slots
+	}, nil
+}
+
+// Algorithm is the name of the algorithm new hashes use.
+func (h *Hasher) Algorithm() string {
+	return h.hasher.Algorithm()
+}
+
+// Hash returns the encoded hash of password.
+func (h *Hasher) Hash(ctx context.Context, password string) (string, error) {
+	release, err := h.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	start := time.Now()
+	hash, err := h.hasher.Hash([]byte(password))
+	h.hash.observe(time.Since(start))
+	return hash, err
+}
+
+// Compare checks password against a stored hash of any supported
+// algorithm. A mismatch returns ErrMismatch; a hash no algorithm accepts
+// returns ErrMalformedHash without taking a slot.
+func (h *Hasher) Compare(ctx context.Context, hash, password string) error {
+	verifier := h.verifier(hash)
+	if verifier == nil {
+		return ErrMalformedHash
+	}
+	release, err := h.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	start := time.Now()
+	err = verifier.Verify(hash, []byte(password))
+	h.compare.observe(time.Since(start))
+	return err
+}
+
+// NeedsRehash reports whether hash was made with another algorithm than
+// new hashes, or with parameters its algorithm's Current refuses (a lower
+// bcrypt cost, other Argon2id parameters), so it should be replaced once
+// the password is known to match.
+func (h *Hasher) NeedsRehash(hash string) bool {
+	return identify(hash) != h.hasher.Algorithm() || !h.hasher.Current(hash)
+}
+
+// verifier returns the algorithm hash declares, or nil if none does. The
+// parameters come from the hash itself.
+func (h *Hasher) verifier(hash string) PasswordHasher {
+	switch identify(hash) {
+	case AlgorithmBcrypt:
+		return Bcrypt{}
+	case AlgorithmArgon2id:
+		return Argon2id{}
+	}
+	return nil
+}
+
+// Stats is a snapshot of the hasher's load and timings.
+type Stats struct {
+	Algorithm   string    `json:"algorithm"`
+	Concurrency int       `json:"concurrency"`
+	InFlight    int64     `json:"in_flight"`
+	Rejected    int64     `json:"rejected_busy"`
+	Hash        Histogram `json:"hash"`
+	Compare     Histogram `json:"compare"` // Includes dummy comparisons
+	// DummyCompares counts CompareDummy calls: logins for unknown usernames.
+	DummyCompares int64 `json:"dummy_compares"`
+}
+
+// Stats returns the current counters and duration histograms.
+func (h *Hasher) Stats() Stats {
+	return Stats{
+		Algorithm:   h.hasher.Algorithm(),
+		Concurrency: cap(h.slots),
+		InFlight:    h.inFlight.Load(),
+		Rejected:    h.rejected.Load(),
+		Hash:        h.hash.snapshot(),
+		Compare:     h.compare.snapshot(),
+
+		DummyCompares: h.dummyCompares.Load(),
+	}
+}
+
+// bucketBoundsMs are the upper bounds of the histogram buckets; the last
+// bucket catches everything slower.
+var bucketBoundsMs = [...]int64{10, 25, 50, 100, 250, 500, 1000, 2500}
+
+// Histogram is a snapshot of operation durations. Buckets maps "le_<ms>"
+// (and "le_inf") to the number of operations at most that long.
+type Histogram struct {
+	Count   int64            `json:"count"`
+	SumMs   float64          `json:"sum_ms"`
+	Buckets map[string]int64 `json:"buckets"`
+}
+
+type durationHistogram struct {
+	mu     sync.Mutex
+	count  int64
+	sum    time.Duration
+	counts [len(bucketBoundsMs) + 1]int64 // One per bound, plus +Inf
+}
+
+func (d *durationHistogram) observe(took time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.count++
+	d.sum += took
+	i := 0
+	for i < len(bucketBoundsMs) && took > time.Duration(bucketBoundsMs[i])*time.Millisecond {
+		i++
+	}
+	d.counts[i]++
+}
+
+// snapshot returns cumulative bucket counts, like a Prometheus histogram.
+func (d *durationHistogram) snapshot() Histogram {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h := Histogram{
+		Count:   d.count,
+		SumMs:   float64(d.sum) / float64(time.Millisecond),
+		Buckets: make(map[string]int64, len(d.counts)),
+	}
+	var cumulative int64
+	for i, n := range d.counts {
+		cumulative += n
+		if i < len(bucketBoundsMs) {
+			h.Buckets["le_"+strconv.FormatInt(bucketBoundsMs[i], 10)] = cumulative
+		} else {
+			h.Buckets["le_inf"] = cumulative
+		}
+	}
+	return h
+}
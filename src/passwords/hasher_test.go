@@ -0,0 +1,157 @@
+// src/passwords/hasher_test.go
+package passwords
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Parameters about as cheap as each algorithm allows, so the tests run
+// fast. bcrypt is one above its minimum, so a hash can have a lower cost.
+var (
+	testBcrypt   = Bcrypt{Cost: 5}
+	testArgon2id = Argon2id{Memory: 64, Iterations: 1, Parallelism: 1}
+)
+
+func newTestHasher(hasher PasswordHasher) *Hasher {
+	return NewHasher(hasher, 2, time.Second)
+}
+
+// mustHash returns hasher's hash of password.
+func mustHash(t *testing.T, hasher PasswordHasher, password string) string {
+	t.Helper()
+	hash, err := hasher.Hash([]byte(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestHashRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	for _, hasher := range []PasswordHasher{testBcrypt, testArgon2id} {
+		t.Run(hasher.Algorithm(), func(t *testing.T) {
+			h := newTestHasher(hasher)
+			hash, err := h.Hash(ctx, "correct horse battery")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := identify(hash); got != hasher.Algorithm() {
+				t.Errorf("hash %q declares %q, want %q", hash, got, hasher.Algorithm())
+			}
+			if err := h.Compare(ctx, hash, "correct horse battery"); err != nil {
+				t.Errorf("right password: %v", err)
+			}
+			if err := h.Compare(ctx, hash, "correct horse batterY"); !errors.Is(err, ErrMismatch) {
+				t.Errorf("wrong password: got %v, want ErrMismatch", err)
+			}
+			if h.NeedsRehash(hash) {
+				t.Error("a hash just made needs rehashing")
+			}
+
+			// Salted, so the same password never hashes the same way twice
+			again, err := h.Hash(ctx, "correct horse battery")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again == hash {
+				t.Error("two hashes of one password are equal")
+			}
+		})
+	}
+}
+
+// TestCompareAcrossAlgorithms checks stored hashes with whichever
+// algorithm they declare, whatever new hashes use, and that each is due
+// for replacement unless it has the configured algorithm and parameters or,
+// for bcrypt, a higher cost.
+func TestCompareAcrossAlgorithms(t *testing.T) {
+	ctx := context.Background()
+	const password = "correct horse battery"
+	hashes := map[string]string{
+		"bcrypt":                 mustHash(t, testBcrypt, password),
+		"bcrypt, lower cost":     mustHash(t, Bcrypt{Cost: 4}, password),
+		"bcrypt, higher cost":    mustHash(t, Bcrypt{Cost: 6}, password),
+		"argon2id":               mustHash(t, testArgon2id, password),
+		"argon2id, other memory": mustHash(t, Argon2id{Memory: 128, Iterations: 1, Parallelism: 1}, password),
+		"argon2id, other time":   mustHash(t, Argon2id{Memory: 64, Iterations: 2, Parallelism: 1}, password),
+		"argon2id, other lanes":  mustHash(t, Argon2id{Memory: 64, Iterations: 1, Parallelism: 2}, password),
+	}
+	tests := []struct {
+		configured PasswordHasher
+		current    []string // Stored hashes that need no rehash
+	}{
+		{testBcrypt, []string{"bcrypt", "bcrypt, higher cost"}},
+		{testArgon2id, []string{"argon2id"}},
+	}
+	for _, tt := range tests {
+		h := newTestHasher(tt.configured)
+		for name, hash := range hashes {
+			t.Run(tt.configured.Algorithm()+"/"+name, func(t *testing.T) {
+				if err := h.Compare(ctx, hash, password); err != nil {
+					t.Errorf("right password: %v", err)
+				}
+				if err := h.Compare(ctx, hash, "wrong"); !errors.Is(err, ErrMismatch) {
+					t.Errorf("wrong password: got %v, want ErrMismatch", err)
+				}
+				if got, want := h.NeedsRehash(hash), !slices.Contains(tt.current, name); got != want {
+					t.Errorf("NeedsRehash = %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+// TestMalformedHashesFailClosed checks that a stored hash no algorithm
+// accepts matches no password, not even the empty one, and is never
+// treated as current.
+func TestMalformedHashesFailClosed(t *testing.T) {
+	ctx := context.Background()
+	bcryptHash := mustHash(t, testBcrypt, "password")
+	argonHash := mustHash(t, testArgon2id, "password")
+	salt := "AAAAAAAAAAAAAAAAAAAAAA"
+	key := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"empty", ""},
+		{"plain text", "password"},
+		{"unknown algorithm", "$scrypt$ln=15,r=8,p=1$" + salt + "$" + key},
+		{"argon2i", "$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + key},
+		{"bcrypt truncated", bcryptHash[:len(bcryptHash)-10]},
+		{"bcrypt cost out of range", "$2b$99$" + bcryptHash[7:]},
+		{"argon2id truncated", argonHash[:strings.LastIndex(argonHash, "$")]},
+		{"argon2id old version", "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key},
+		{"argon2id no parameters", "$argon2id$v=19$$" + salt + "$" + key},
+		{"argon2id zero lanes", "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key},
+		{"argon2id zero time", "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key},
+		{"argon2id too little memory", "$argon2id$v=19$m=7,t=1,p=1$" + salt + "$" + key},
+		{"argon2id too much memory", "$argon2id$v=19$m=4194304,t=1,p=1$" + salt + "$" + key},
+		{"argon2id too much time", "$argon2id$v=19$m=64,t=65,p=1$" + salt + "$" + key},
+		{"argon2id not canonical", "$argon2id$v=19$m=064,t=1,p=1$" + salt + "$" + key},
+		{"argon2id padded base64", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "==$" + key},
+		{"argon2id short salt", "$argon2id$v=19$m=64,t=1,p=1$AAAA$" + key},
+		{"argon2id short key", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$AAAA"},
+		{"argon2id extra field", argonHash + "$"},
+	}
+	for _, configured := range []PasswordHasher{testBcrypt, testArgon2id} {
+		h := newTestHasher(configured)
+		for _, tt := range tests {
+			t.Run(configured.Algorithm()+"/"+tt.name, func(t *testing.T) {
+				for _, password := range []string{"password", ""} {
+					if err := h.Compare(ctx, tt.hash, password); !errors.Is(err, ErrMalformedHash) {
+						t.Errorf("Compare(%q) = %v, want ErrMalformedHash", password, err)
+					}
+				}
+				if !h.NeedsRehash(tt.hash) {
+					t.Error("a malformed hash is current")
+				}
+			})
+		}
+	}
+}
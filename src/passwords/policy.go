@@ -0,0 +1,95 @@
+// src/passwords/policy.go
+package passwords
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxBytes is the longest password accepted: bcrypt's limit, applied to
+// every algorithm so a password works whichever one is configured.
+const MaxBytes = 72
+
+// Reasons a new password is refused, for clients to show the rule.
+const (
+	ReasonTooShort        = "too_short"
+	ReasonTooLong         = "too_long"
+	ReasonMatchesUsername = "matches_username"
+	ReasonCommon          = "common_password"
+)
+
+//go:embed common.txt
+var commonPasswords string
+
+// Policy is what a new password must satisfy. Existing passwords are not
+// checked against it.
+type Policy struct {
+	MinLength int                 // In characters
+	common    map[string]struct{} // Lowercased; nil if not checked
+}
+
+// NewPolicy returns a policy requiring minLength characters. With
+// rejectCommon, passwords on the common list are refused too: the list at
+// commonListFile if set, else the bundled one.
+func NewPolicy(minLength int, rejectCommon bool, commonListFile string) (*Policy, error) {
+	p := &Policy{MinLength: minLength}
+	if !rejectCommon {
+		return p, nil
+	}
+	if commonListFile == "" {
+		p.common, _ = p.readCommon(strings.NewReader(commonPasswords))
+		return p, nil
+	}
+	f, err := os.Open(commonListFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if p.common, err = p.readCommon(f); err != nil {
+		return nil, fmt.Errorf("%s: %v", commonListFile, err)
+	}
+	return p, nil
+}
+
+// readCommon reads one password per line, skipping blank lines, "#"
+// comments and passwords the length rule refuses anyway.
+func (p *Policy) readCommon(r io.Reader) (map[string]struct{}, error) {
+	common := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || utf8.RuneCountInString(line) < p.MinLength {
+			continue
+		}
+		common[strings.ToLower(line)] = struct{}{}
+	}
+	return common, scanner.Err()
+}
+
+// CommonCount is how many passwords the common check refuses beyond the
+// length rule; 0 if it is off.
+func (p *Policy) CommonCount() int {
+	return len(p.common)
+}
+
+// Check returns why password may not be used by username, or "" if it may.
+func (p *Policy) Check(username, password string) string {
+	if len(password) > MaxBytes {
+		return ReasonTooLong
+	}
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return ReasonTooShort
+	}
+	if strings.EqualFold(password, username) {
+		return ReasonMatchesUsername
+	}
+	if _, ok := p.common[strings.ToLower(password)]; ok {
+		return ReasonCommon
+	}
+	return ""
+}
@@ -0,0 +1,99 @@
+// src/passwords/policy_test.go
+package passwords
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	bundled, err := NewPolicy(10, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lengthOnly, err := NewPolicy(10, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		policy   *Policy
+		username string
+		password string
+		want     string
+	}{
+		{"long enough", bundled, "alice", "tr0ub4dor&3x", ""},
+		{"empty", bundled, "alice", "", ReasonTooShort},
+		{"one short", bundled, "alice", "abcdefghi", ReasonTooShort},
+		{"exactly the minimum", bundled, "alice", "xkcdbatter", ""},
+		// Length is in characters: nine of them is short in any script
+		{"short in characters, long in bytes", bundled, "alice", "ééééééééé", ReasonTooShort},
+		{"long enough in characters", bundled, "alice", "éééééééééé", ""},
+		{"at the byte limit", bundled, "alice", strings.Repeat("a", MaxBytes), ""},
+		{"over the byte limit", bundled, "alice", strings.Repeat("a", MaxBytes+1), ReasonTooLong},
+		{"over the byte limit in multibyte characters", bundled, "alice", strings.Repeat("é", MaxBytes/2+1), ReasonTooLong},
+		{"the username", bundled, "alexandria", "alexandria", ReasonMatchesUsername},
+		{"the username in other case", bundled, "alexandria", "AlexAndria", ReasonMatchesUsername},
+		{"containing the username", bundled, "alexandria", "alexandria1", ""},
+		{"common", bundled, "alice", "qwertyuiop", ReasonCommon},
+		{"common in other case", bundled, "alice", "QwertyUIOP", ReasonCommon},
+		{"common, list off", lengthOnly, "alice", "qwertyuiop", ""},
+		// The username rule comes first when both apply
+		{"common and the username", bundled, "qwertyuiop", "qwertyuiop", ReasonMatchesUsername},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Check(tt.username, tt.password); got != tt.want {
+				t.Errorf("Check(%q, %q) = %q, want %q", tt.username, tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyCommonList(t *testing.T) {
+	bundled, err := NewPolicy(10, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundled.CommonCount() == 0 {
+		t.Error("the bundled list is empty")
+	}
+	off, err := NewPolicy(10, false, filepath.Join(t.TempDir(), "missing.txt"))
+	if err != nil {
+		t.Fatalf("the list file is read with the check off: %v", err)
+	}
+	if off.CommonCount() != 0 {
+		t.Errorf("CommonCount with the check off = %d, want 0", off.CommonCount())
+	}
+
+	file := filepath.Join(t.TempDir(), "common.txt")
+	list := "# Comment\n\n  Sunshine123  \nshort\ncorrecthorse\n# notapassword1\n"
+	if err := os.WriteFile(file, []byte(list), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPolicy(10, true, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Comments, blank lines and entries the length rule refuses are skipped
+	if p.CommonCount() != 2 {
+		t.Errorf("CommonCount = %d, want 2", p.CommonCount())
+	}
+	for password, want := range map[string]string{
+		"sunshine123":    ReasonCommon,
+		"CORRECTHORSE":   ReasonCommon,
+		"notapassword1":  "",
+		"qwertyuiop":     "", // Only on the bundled list
+		"notonthelist12": "",
+	} {
+		if got := p.Check("alice", password); got != want {
+			t.Errorf("Check(%q) = %q, want %q", password, got, want)
+		}
+	}
+
+	if _, err := NewPolicy(10, true, filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("a missing list file was accepted")
+	}
+}
@@ -0,0 +1,54 @@
+// src/pow/pow.go
+
+// Package pow is the proof of work /register asks for when
+// REGISTRATION_POW_BITS is set: find a counter such that the SHA-256 of
+// "<nonce>:<counter>", with the counter in decimal, starts with at least
+// the challenge's number of zero bits. Like contactdoc it has no
+// dependencies, so a client solves with the same code the server checks
+// with.
+package pow
+
+import (
+	"context"
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+)
+
+// Hash is the SHA-256 a solution is judged by.
+func Hash(nonce string, counter uint64) [sha256.Size]byte {
+	return sha256.Sum256([]byte(nonce + ":" + strconv.FormatUint(counter, 10)))
+}
+
+// LeadingZeroBits counts the zero bits sum starts with.
+func LeadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// Valid reports whether counter solves nonce at difficulty bits.
+func Valid(nonce string, counter uint64, difficulty int) bool {
+	return LeadingZeroBits(Hash(nonce, counter)) >= difficulty
+}
+
+// Solve tries counters from 0 up until one solves nonce at difficulty
+// bits. That takes about 2^difficulty hashes. It returns ctx's error if
+// ctx ends first.
+func Solve(ctx context.Context, nonce string, difficulty int) (uint64, error) {
+	for counter := uint64(0); ; counter++ {
+		if counter%4096 == 0 {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+		}
+		if Valid(nonce, counter, difficulty) {
+			return counter, nil
+		}
+	}
+}
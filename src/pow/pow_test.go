@@ -0,0 +1,88 @@
+// src/pow/pow_test.go
+package pow
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestLeadingZeroBits(t *testing.T) {
+	// sum returns a hash starting with prefix and then all ones
+	sum := func(prefix ...byte) [sha256.Size]byte {
+		var s [sha256.Size]byte
+		for i := range s {
+			s[i] = 0xff
+		}
+		copy(s[:], prefix)
+		return s
+	}
+	tests := []struct {
+		name string
+		sum  [sha256.Size]byte
+		want int
+	}{
+		{"top bit set", sum(0x80), 0},
+		{"second bit set", sum(0x40), 1},
+		{"last bit of the first byte", sum(0x01), 7},
+		{"first bit of the second byte", sum(0x00, 0x80), 8},
+		{"within the second byte", sum(0x00, 0x10), 11},
+		{"four zero bytes", sum(0, 0, 0, 0, 0x01), 39},
+		{"all zero", [sha256.Size]byte{}, 256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := LeadingZeroBits(tt.sum); got != tt.want {
+				t.Errorf("LeadingZeroBits(%x...) = %d, want %d", tt.sum[:6], got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashFormat(t *testing.T) {
+	if Hash("abc", 42) != sha256.Sum256([]byte("abc:42")) {
+		t.Error(`Hash("abc", 42) isn't the SHA-256 of "abc:42"`)
+	}
+}
+
+// TestValidAtDifficultyBoundaries solves a nonce and checks the solution
+// is valid up to exactly the number of zero bits its hash starts with, and
+// not one bit past it.
+func TestValidAtDifficultyBoundaries(t *testing.T) {
+	const nonce = "test-nonce"
+	for _, difficulty := range []int{0, 1, 4, 8, 12} {
+		counter, err := Solve(context.Background(), nonce, difficulty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zeros := LeadingZeroBits(Hash(nonce, counter))
+		if zeros < difficulty {
+			t.Fatalf("difficulty %d: Solve returned %d, whose hash starts with only %d zero bits", difficulty, counter, zeros)
+		}
+		for d := 0; d <= zeros; d++ {
+			if !Valid(nonce, counter, d) {
+				t.Errorf("difficulty %d: %d not valid at %d bits, though its hash starts with %d", difficulty, counter, d, zeros)
+			}
+		}
+		if Valid(nonce, counter, zeros+1) {
+			t.Errorf("difficulty %d: %d valid at %d bits, but its hash starts with %d", difficulty, counter, zeros+1, zeros)
+		}
+		// Solve tries counters in order, so none before this one solves it
+		for c := uint64(0); c < counter; c++ {
+			if Valid(nonce, c, difficulty) {
+				t.Errorf("difficulty %d: Solve returned %d, but %d solves it too", difficulty, counter, c)
+				break
+			}
+		}
+	}
+}
+
+func TestSolveStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// 256 bits is never solved, so only the context can end it
+	if _, err := Solve(ctx, "test-nonce", 256); !errors.Is(err, context.Canceled) {
+		t.Errorf("Solve with a cancelled context: %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,125 @@
+// src/ratelimit/bucket.go
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"cryptachat-server/clock"
+)
+
+// TokenBucket allows each key bursts of up to burst events, with tokens
+// refilled at burst per period. Unlike Limiter it keeps one small entry per
+// key whatever the rate, and it holds at most maxKeys of them: a key whose
+// bucket has refilled is the same as one never seen, so those are dropped
+// first, and after that the fullest bucket is. It is in-memory, so limits
+// are per process.
+type TokenBucket struct {
+	mu      sync.Mutex
+	clock   clock.Clock
+	burst   float64
+	perSec  float64 // Tokens refilled per second
+	maxKeys int
+	buckets map[string]*bucket
+	evicted int64
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time // When tokens was last brought up to date
+}
+
+// NewTokenBucket creates a limiter allowing burst events per period for
+// each key, for at most maxKeys keys at once.
+func NewTokenBucket(burst int, period time.Duration, maxKeys int) *TokenBucket {
+	return &TokenBucket{
+		clock:   clock.Real,
+		burst:   float64(burst),
+		perSec:  float64(burst) / period.Seconds(),
+		maxKeys: maxKeys,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// SetClock replaces the limiter's clock. Intended for tests.
+func (b *TokenBucket) SetClock(c clock.Clock) {
+	b.clock = c
+}
+
+// SetLimit changes the burst and period. Keys already seen keep their
+// tokens, up to the new burst, and refill at the new rate.
+func (b *TokenBucket) SetLimit(burst int, period time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.burst = float64(burst)
+	b.perSec = float64(burst) / period.Seconds()
+	for _, bk := range b.buckets {
+		if bk.tokens > b.burst {
+			bk.tokens = b.burst
+		}
+	}
+}
+
+// Allow takes a token from key's bucket if it has one. If not, it returns
+// false and how long until it will.
+func (b *TokenBucket) Allow(key string) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	bk, ok := b.buckets[key]
+	if !ok {
+		if len(b.buckets) >= b.maxKeys {
+			b.evict(now)
+		}
+		bk = &bucket{tokens: b.burst, at: now}
+		b.buckets[key] = bk
+	}
+	b.refill(bk, now)
+	if bk.tokens < 1 {
+		wait := time.Duration((1 - bk.tokens) / b.perSec * float64(time.Second))
+		return false, wait
+	}
+	bk.tokens--
+	return true, 0
+}
+
+// refill brings bk up to date at now. Must be called with b.mu held.
+func (b *TokenBucket) refill(bk *bucket, now time.Time) {
+	if elapsed := now.Sub(bk.at); elapsed > 0 {
+		bk.tokens += elapsed.Seconds() * b.perSec
+		if bk.tokens > b.burst {
+			bk.tokens = b.burst
+		}
+		bk.at = now
+	}
+}
+
+// evict makes room for a key: it drops every bucket that has refilled, or
+// failing that the fullest one. Must be called with b.mu held.
+func (b *TokenBucket) evict(now time.Time) {
+	var fullest string
+	most := -1.0
+	for key, bk := range b.buckets {
+		b.refill(bk, now)
+		if bk.tokens >= b.burst {
+			delete(b.buckets, key)
+			b.evicted++
+			continue
+		}
+		if bk.tokens > most {
+			fullest, most = key, bk.tokens
+		}
+	}
+	if len(b.buckets) >= b.maxKeys {
+		delete(b.buckets, fullest)
+		b.evicted++
+	}
+}
+
+// Stats returns the number of keys held and how many have been evicted.
+func (b *TokenBucket) Stats() (keys int, evicted int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.buckets), b.evicted
+}
@@ -0,0 +1,111 @@
+// src/ratelimit/bucket_test.go
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"cryptachat-server/testutil"
+)
+
+func TestTokenBucketRefills(t *testing.T) {
+	clk := testutil.NewFakeClock(start)
+	b := NewTokenBucket(4, 16*time.Second, 10) // A token every 4s
+	b.SetClock(clk)
+
+	for i := 0; i < 4; i++ {
+		if ok, _ := b.Allow("a"); !ok {
+			t.Fatalf("event %d of the burst refused", i+1)
+		}
+	}
+	if ok, wait := b.Allow("a"); ok || wait != 4*time.Second {
+		t.Fatalf("past the burst: %v, wait %v; want refused for 4s", ok, wait)
+	}
+	if ok, _ := b.Allow("b"); !ok {
+		t.Error("another key was refused")
+	}
+
+	clk.Advance(time.Second)
+	if ok, wait := b.Allow("a"); ok || wait != 3*time.Second {
+		t.Errorf("a second later: %v, wait %v; want refused for 3s", ok, wait)
+	}
+	clk.Advance(3 * time.Second)
+	if ok, _ := b.Allow("a"); !ok {
+		t.Error("refused once a token had refilled")
+	}
+	if ok, _ := b.Allow("a"); ok {
+		t.Error("allowed a second event on one refilled token")
+	}
+
+	// Refilling stops at the burst
+	clk.Advance(time.Hour)
+	for i := 0; i < 4; i++ {
+		b.Allow("a")
+	}
+	if ok, _ := b.Allow("a"); ok {
+		t.Error("an idle hour refilled past the burst")
+	}
+}
+
+func TestTokenBucketSetLimit(t *testing.T) {
+	clk := testutil.NewFakeClock(start)
+	b := NewTokenBucket(4, 16*time.Second, 10)
+	b.SetClock(clk)
+	b.Allow("a")
+
+	// a's three tokens are cut to the new burst
+	b.SetLimit(2, 4*time.Second)
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.Allow("a"); !ok {
+			t.Fatalf("event %d under the lower limit refused", i+1)
+		}
+	}
+	if ok, wait := b.Allow("a"); ok || wait != 2*time.Second {
+		t.Errorf("past the lower burst: %v, wait %v; want refused for 2s at the new rate", ok, wait)
+	}
+
+	// Raising the limit doesn't add tokens, but refills at the new rate
+	b.SetLimit(8, 4*time.Second)
+	if ok, _ := b.Allow("a"); ok {
+		t.Error("raising the limit added tokens")
+	}
+	clk.Advance(time.Second)
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.Allow("a"); !ok {
+			t.Errorf("event %d a second after raising the limit refused", i+1)
+		}
+	}
+}
+
+// TestTokenBucketEvicts fills the bucket's keys and checks refilled keys
+// go first, then the fullest, so a drained key can't escape its limit by
+// being evicted.
+func TestTokenBucketEvicts(t *testing.T) {
+	clk := testutil.NewFakeClock(start)
+	b := NewTokenBucket(4, 16*time.Second, 2)
+	b.SetClock(clk)
+
+	for i := 0; i < 4; i++ {
+		b.Allow("drained")
+	}
+	b.Allow("used")
+	b.Allow("new") // Evicts used, with three tokens left
+	if keys, evicted := b.Stats(); keys != 2 || evicted != 1 {
+		t.Fatalf("holding %d keys, %d evicted; want 2 and 1", keys, evicted)
+	}
+	if ok, _ := b.Allow("drained"); ok {
+		t.Error("the drained key was evicted")
+	}
+
+	// Both refill, so both go to make room for one more
+	clk.Advance(16 * time.Second)
+	b.Allow("another")
+	if keys, evicted := b.Stats(); keys != 1 || evicted != 3 {
+		t.Errorf("after refilling: holding %d keys, %d evicted; want 1 and 3", keys, evicted)
+	}
+	for i := 0; i < 4; i++ {
+		if ok, _ := b.Allow("drained"); !ok {
+			t.Errorf("event %d for a refilled key refused", i+1)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// src/ratelimit/distinct.go
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"cryptachat-server/clock"
+)
+
+// DistinctLimiter allows each key to touch at most limit distinct targets
+// within a sliding window. Repeat visits to a target already counted in the
+// window are free. It is in-memory, so limits are per process.
+type DistinctLimiter struct {
+	mu     sync.Mutex
+	clock  clock.Clock
+	limit  int
+	window time.Duration
+	seen   map[string]map[string]time.Time // key -> target -> first seen in window
+}
+
+// NewDistinct creates a limiter allowing limit distinct targets per window for each key.
+func NewDistinct(limit int, window time.Duration) *DistinctLimiter {
+	return &DistinctLimiter{
+		clock:  clock.Real,
+		limit:  limit,
+		window: window,
+		seen:   make(map[string]map[string]time.Time),
+	}
+}
+
+// SetClock replaces the limiter's clock. Intended for tests.
+func (l *DistinctLimiter) SetClock(c clock.Clock) {
+	l.clock = c
+}
+
+// SetLimit changes the limit and window. Targets already counted stay
+// counted, and are judged against the new window.
+func (l *DistinctLimiter) SetLimit(limit int, window time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.window = window
+}
+
+// Allow records that key touched target if it is within the limit. If not,
+// it returns false and how long until a new target would be allowed.
+func (l *DistinctLimiter) Allow(key, target string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	targets := l.prune(key, now)
+	if _, ok := targets[target]; ok {
+		return true, 0
+	}
+	if len(targets) >= l.limit {
+		oldest := now
+		for _, t := range targets {
+			if t.Before(oldest) {
+				oldest = t
+			}
+		}
+		return false, oldest.Add(l.window).Sub(now)
+	}
+	if targets == nil {
+		targets = make(map[string]time.Time)
+		l.seen[key] = targets
+	}
+	targets[target] = now
+	return true, 0
+}
+
+// prune drops targets older than the window and returns what's left.
+// Must be called with l.mu held.
+func (l *DistinctLimiter) prune(key string, now time.Time) map[string]time.Time {
+	targets := l.seen[key]
+	cutoff := now.Add(-l.window)
+	for target, t := range targets {
+		if !t.After(cutoff) {
+			delete(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		delete(l.seen, key)
+		return nil
+	}
+	return targets
+}
@@ -0,0 +1,63 @@
+// src/ratelimit/distinct_test.go
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"cryptachat-server/testutil"
+)
+
+func TestDistinctLimiterCountsTargetsOnce(t *testing.T) {
+	clk := testutil.NewFakeClock(start)
+	l := NewDistinct(2, time.Hour)
+	l.SetClock(clk)
+
+	for _, target := range []string{"x", "x", "y", "x", "y"} {
+		if ok, _ := l.Allow("a", target); !ok {
+			t.Fatalf("%s refused within the limit", target)
+		}
+		clk.Advance(time.Minute)
+	}
+	// x was first seen 5 minutes ago
+	if ok, wait := l.Allow("a", "z"); ok || wait != 55*time.Minute {
+		t.Fatalf("third target: %v, wait %v; want refused for 55m", ok, wait)
+	}
+	if ok, _ := l.Allow("a", "y"); !ok {
+		t.Error("a counted target was refused at the limit")
+	}
+	if ok, _ := l.Allow("b", "z"); !ok {
+		t.Error("another key was refused")
+	}
+
+	// Repeats don't extend a target's time in the window
+	clk.Advance(55 * time.Minute)
+	if ok, _ := l.Allow("a", "z"); !ok {
+		t.Error("refused after the first target left the window")
+	}
+	if ok, _ := l.Allow("a", "w"); ok {
+		t.Error("allowed a fourth target with only one gone from the window")
+	}
+}
+
+func TestDistinctLimiterSetLimit(t *testing.T) {
+	clk := testutil.NewFakeClock(start)
+	l := NewDistinct(1, time.Hour)
+	l.SetClock(clk)
+
+	l.Allow("a", "x")
+	if ok, _ := l.Allow("a", "y"); ok {
+		t.Fatal("allowed past the limit")
+	}
+	l.SetLimit(2, time.Hour)
+	if ok, _ := l.Allow("a", "y"); !ok {
+		t.Error("refused after the limit was raised")
+	}
+
+	// A shorter window applies to targets already counted
+	clk.Advance(10 * time.Minute)
+	l.SetLimit(2, 10*time.Minute)
+	if ok, _ := l.Allow("a", "z"); !ok {
+		t.Error("targets older than the new window still count")
+	}
+}
@@ -0,0 +1,121 @@
+// src/ratelimit/limiter.go
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"cryptachat-server/clock"
+)
+
+// Limiter allows at most limit events per key within a sliding window.
+// Keys with no event in the window are the same as keys never seen, so
+// they are swept out once a window; with a cap on keys, the least recently
+// used key is dropped after that to make room. It is in-memory, so limits
+// are per process.
+type Limiter struct {
+	mu      sync.Mutex
+	clock   clock.Clock
+	limit   int
+	window  time.Duration
+	maxKeys int // 0 for no cap
+	hits    map[string][]time.Time
+	swept   time.Time // When idle keys were last dropped
+	evicted int64
+}
+
+// New creates a limiter allowing limit events per window for each key.
+func New(limit int, window time.Duration) *Limiter {
+	return NewCapped(limit, window, 0)
+}
+
+// NewCapped is New holding at most maxKeys keys at once, for keys that
+// callers choose, such as addresses typed into a form.
+func NewCapped(limit int, window time.Duration, maxKeys int) *Limiter {
+	return &Limiter{
+		clock:   clock.Real,
+		limit:   limit,
+		window:  window,
+		maxKeys: maxKeys,
+		hits:    make(map[string][]time.Time),
+	}
+}
+
+// SetClock replaces the limiter's clock. Intended for tests.
+func (l *Limiter) SetClock(c clock.Clock) {
+	l.clock = c
+}
+
+// Allow records an event for key if it is within the limit. If not, it
+// returns false and how long until the next event would be allowed.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	if now.Sub(l.swept) >= l.window {
+		l.sweep(now)
+	}
+	recent := l.prune(key, now)
+	if len(recent) >= l.limit {
+		return false, recent[0].Add(l.window).Sub(now)
+	}
+	if recent == nil && l.maxKeys > 0 && len(l.hits) >= l.maxKeys {
+		l.evict(now)
+	}
+	l.hits[key] = append(recent, now)
+	return true, 0
+}
+
+// sweep drops every key with no event in the window. Must be called with
+// l.mu held.
+func (l *Limiter) sweep(now time.Time) {
+	for key := range l.hits {
+		l.prune(key, now)
+	}
+	l.swept = now
+}
+
+// evict makes room for a key: it drops idle keys, or failing that the one
+// whose last event is oldest. Must be called with l.mu held.
+func (l *Limiter) evict(now time.Time) {
+	l.sweep(now)
+	if len(l.hits) < l.maxKeys {
+		return
+	}
+	var oldest string
+	var last time.Time
+	for key, hits := range l.hits {
+		if t := hits[len(hits)-1]; last.IsZero() || t.Before(last) {
+			oldest, last = key, t
+		}
+	}
+	delete(l.hits, oldest)
+	l.evicted++
+}
+
+// Stats returns the number of keys held and how many have been evicted
+// to stay under the cap.
+func (l *Limiter) Stats() (keys int, evicted int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.hits), l.evicted
+}
+
+// prune drops events older than the window and returns what's left.
+// Must be called with l.mu held.
+func (l *Limiter) prune(key string, now time.Time) []time.Time {
+	hits := l.hits[key]
+	cutoff := now.Add(-l.window)
+	i := 0
+	for i < len(hits) && !hits[i].After(cutoff) {
+		i++
+	}
+	hits = hits[i:]
+	if len(hits) == 0 {
+		delete(l.hits, key)
+		return nil
+	}
+	l.hits[key] = hits
+	return hits
+}
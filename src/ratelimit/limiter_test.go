@@ -0,0 +1,99 @@
+// src/ratelimit/limiter_test.go
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"cryptachat-server/testutil"
+)
+
+var start = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func TestLimiterSlidingWindow(t *testing.T) {
+	clk := testutil.NewFakeClock(start)
+	l := New(3, time.Hour)
+	l.SetClock(clk)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("event %d refused", i+1)
+		}
+		clk.Advance(10 * time.Minute)
+	}
+	// The first event was 30 minutes ago, so the next slot opens in 30
+	ok, wait := l.Allow("a")
+	if ok || wait != 30*time.Minute {
+		t.Fatalf("fourth event: %v, wait %v; want refused for 30m", ok, wait)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("another key was refused")
+	}
+
+	clk.Advance(30 * time.Minute)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("refused after the oldest event left the window")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Error("allowed a second event when only one had left the window")
+	}
+}
+
+// TestLimiterSweepsIdleKeys checks keys are forgotten once their events
+// have all left the window, even if they never come back.
+func TestLimiterSweepsIdleKeys(t *testing.T) {
+	clk := testutil.NewFakeClock(start)
+	l := New(3, time.Hour)
+	l.SetClock(clk)
+
+	for i := 0; i < 100; i++ {
+		l.Allow(fmt.Sprint("once-", i))
+	}
+	if keys, _ := l.Stats(); keys != 100 {
+		t.Fatalf("%d keys, want 100", keys)
+	}
+	clk.Advance(time.Hour)
+	l.Allow("later")
+	if keys, evicted := l.Stats(); keys != 1 || evicted != 0 {
+		t.Errorf("%d keys, %d evicted after the window; want only the new key, none evicted", keys, evicted)
+	}
+}
+
+// TestLimiterCap fills a capped limiter with live keys. Each new key then
+// displaces the one used least recently, and the others keep their counts.
+func TestLimiterCap(t *testing.T) {
+	clk := testutil.NewFakeClock(start)
+	l := NewCapped(1, time.Hour, 3)
+	l.SetClock(clk)
+
+	for _, key := range []string{"a", "b", "c"} {
+		l.Allow(key)
+		clk.Advance(time.Minute)
+	}
+	if ok, _ := l.Allow("d"); !ok {
+		t.Fatal("new key refused at the cap")
+	}
+	if keys, evicted := l.Stats(); keys != 3 || evicted != 1 {
+		t.Fatalf("%d keys, %d evicted; want 3 and 1", keys, evicted)
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		if ok, _ := l.Allow(key); ok {
+			t.Errorf("%s lost its count to the eviction", key)
+		}
+	}
+	// a was dropped, so it starts afresh, displacing b
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("the evicted key is still limited")
+	}
+	if keys, evicted := l.Stats(); keys != 3 || evicted != 2 {
+		t.Fatalf("%d keys, %d evicted; want 3 and 2", keys, evicted)
+	}
+
+	// Once every key is idle they are swept, which isn't an eviction
+	clk.Advance(time.Hour)
+	l.Allow("e")
+	if keys, evicted := l.Stats(); keys != 1 || evicted != 2 {
+		t.Errorf("%d keys, %d evicted; want only e, with no further eviction", keys, evicted)
+	}
+}
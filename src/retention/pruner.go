@@ -0,0 +1,157 @@
+// src/retention/pruner.go
+package retention
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"cryptachat-server/clock"
+	"cryptachat-server/store"
+)
+
+// pruneInterval is how often expired message copies are removed.
+const pruneInterval = time.Hour
+
+// Pruner periodically applies per-user message retention preferences.
+type Pruner struct {
+	store       *store.PostgresStore
+	clock       clock.Clock
+	defaultDays atomic.Int32
+	auditDays   atomic.Int32
+}
+
+// NewPruner creates a pruner. defaultDays applies to users without a
+// preference; 0 keeps their messages forever. Audit events are kept for
+// auditDays, or forever if it is 0.
+func NewPruner(store *store.PostgresStore, defaultDays, auditDays int) *Pruner {
+	p := &Pruner{
+		store: store,
+		clock: clock.Real,
+	}
+	p.SetRetention(defaultDays, auditDays)
+	return p
+}
+
+// SetRetention changes the retention periods from the next pass on.
+func (p *Pruner) SetRetention(defaultDays, auditDays int) {
+	p.defaultDays.Store(int32(defaultDays))
+	p.auditDays.Store(int32(auditDays))
+}
+
+// SetClock replaces the pruner's clock. Must be called before Run. Intended for tests.
+func (p *Pruner) SetClock(c clock.Clock) {
+	p.clock = c
+}
+
+// Run prunes once immediately and then every pruneInterval until ctx is cancelled.
+func (p *Pruner) Run(ctx context.Context) {
+	ticker := p.clock.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		p.PruneOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// refreshTokenGrace is how long expired refresh tokens are kept, so that
+// /refresh can tell "expired" from "unknown" for a while.
+const refreshTokenGrace = 24 * time.Hour
+
+// loginAttemptRetention is how long failed login counts are kept after
+// the last attempt. A lockout still running is kept until it ends.
+const loginAttemptRetention = 24 * time.Hour
+
+// PruneOnce runs a single pruning pass and logs the result.
+func (p *Pruner) PruneOnce(ctx context.Context) {
+	finish := p.store.StartJobRun("retention")
+	p.pruneRefreshTokens(ctx)
+	p.pruneSessions(ctx)
+	p.pruneLoginAttempts(ctx)
+	p.pruneAuditEvents(ctx)
+	p.pruneRegistrationChallenges(ctx)
+
+	res, err := p.store.PruneExpiredMessages(ctx, int(p.defaultDays.Load()))
+	if err != nil {
+		log.Printf("RETENTION: prune failed: %v", err)
+		finish(err)
+		return
+	}
+	finish(nil)
+	if res.SenderCopies > 0 || res.RecipientCopies > 0 || res.Rows > 0 {
+		log.Printf("RETENTION: pruned %d sender copies, %d recipient copies, %d rows",
+			res.SenderCopies, res.RecipientCopies, res.Rows)
+	}
+}
+
+// pruneRefreshTokens deletes refresh tokens that expired over
+// refreshTokenGrace ago.
+func (p *Pruner) pruneRefreshTokens(ctx context.Context) {
+	n, err := p.store.PruneRefreshTokens(ctx, p.clock.Now().Add(-refreshTokenGrace))
+	if err != nil {
+		log.Printf("RETENTION: refresh token prune failed: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("RETENTION: pruned %d expired refresh tokens", n)
+	}
+}
+
+// pruneSessions deletes sessions whose refresh tokens have expired.
+func (p *Pruner) pruneSessions(ctx context.Context) {
+	n, err := p.store.PruneSessions(ctx, p.clock.Now())
+	if err != nil {
+		log.Printf("RETENTION: session prune failed: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("RETENTION: pruned %d expired sessions", n)
+	}
+}
+
+// pruneLoginAttempts deletes failed login counts idle for over
+// loginAttemptRetention.
+func (p *Pruner) pruneLoginAttempts(ctx context.Context) {
+	n, err := p.store.PruneLoginAttempts(ctx, p.clock.Now().Add(-loginAttemptRetention))
+	if err != nil {
+		log.Printf("RETENTION: login attempt prune failed: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("RETENTION: pruned %d idle login attempt counts", n)
+	}
+}
+
+// pruneRegistrationChallenges deletes proof-of-work challenges that
+// expired unredeemed.
+func (p *Pruner) pruneRegistrationChallenges(ctx context.Context) {
+	n, err := p.store.PruneRegistrationChallenges(ctx, p.clock.Now())
+	if err != nil {
+		log.Printf("RETENTION: registration challenge prune failed: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("RETENTION: pruned %d expired registration challenges", n)
+	}
+}
+
+// pruneAuditEvents deletes audit events older than auditDays.
+func (p *Pruner) pruneAuditEvents(ctx context.Context) {
+	days := int(p.auditDays.Load())
+	if days <= 0 {
+		return
+	}
+	n, err := p.store.PruneAuditEvents(ctx, p.clock.Now().AddDate(0, 0, -days))
+	if err != nil {
+		log.Printf("RETENTION: audit event prune failed: %v", err)
+	}
+	if n > 0 {
+		log.Printf("RETENTION: pruned %d audit events older than %d days", n, days)
+	}
+}
@@ -0,0 +1,92 @@
+// src/retention/pruner_test.go
+package retention
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cryptachat-server/store"
+	"cryptachat-server/testutil"
+)
+
+// TestPrunerPassesFollowTheClock runs the pruner on a fake clock: a pass at
+// start and one per pruneInterval after, each applying the retention set
+// then, so a change takes effect without a restart.
+func TestPrunerPassesFollowTheClock(t *testing.T) {
+	st, err := store.NewPostgresStore(testutil.DatabaseURL(t), "../store/schema.sql")
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(st.Close)
+	clk := testutil.NewFakeClock(time.Now().UTC().Truncate(time.Second))
+	st.SetClock(clk)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	var alice int
+	for _, name := range []string{"alice", "bob"} {
+		if err := st.RegisterUser(ctx, name, "hash", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if alice, err = st.GetUserIDByUsername(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	send := func() int {
+		t.Helper()
+		id, _, err := st.SendMessage(ctx, alice, "bob", "sender copy", "recipient copy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	gone := func(id int) bool {
+		_, err := st.GetMessageForUser(ctx, id, alice)
+		return err != nil
+	}
+	// passes waits for the retention job's nth pass
+	passes := func(n int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			for _, run := range st.JobRuns() {
+				if run.Name == "retention" && run.Runs >= n {
+					if run.Failures != 0 {
+						t.Fatalf("pass failed: %s", run.LastError)
+					}
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for pass %d", n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	first := send()
+	p := NewPruner(st, 1, 0)
+	p.SetClock(clk)
+	go p.Run(ctx)
+	passes(1)
+	if gone(first) {
+		t.Fatal("the pass at start pruned a new message")
+	}
+
+	// A day and an hour later one more pass has run, which prunes it
+	clk.Advance(25 * time.Hour)
+	passes(2)
+	if !gone(first) {
+		t.Error("a message past the 1 day default is still there")
+	}
+
+	// Keeping messages forever applies from the next pass on
+	p.SetRetention(0, 0)
+	second := send()
+	clk.Advance(48 * time.Hour)
+	passes(3)
+	if gone(second) {
+		t.Error("a message was pruned after retention was turned off")
+	}
+}
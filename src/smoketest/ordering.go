@@ -0,0 +1,178 @@
+// src/smoketest/ordering.go
+package smoketest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cryptachat-server/client"
+)
+
+const (
+	// orderingSenders send concurrently from each side of the conversation.
+	orderingSenders = 2
+	// orderingMessages is how many messages each sender sends.
+	orderingMessages = 10
+)
+
+// checkOrdering sends messages both ways from several goroutines while bob
+// polls and listens on the WebSocket, and checks the guarantees documented
+// on store.Message. Repeats are allowed; anything else is a failure:
+//   - a poll page skips a seq, i.e. a later message became visible first
+//   - a pushed message isn't yet visible to a poll
+//   - the conversation doesn't end up with every message exactly once
+func checkOrdering(ctx context.Context, alice, bob *client.Client, aliceName, bobName string) error {
+	subCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	events := bob.Subscribe(subCtx)
+	if err := awaitConnected(events); err != nil {
+		return err
+	}
+	// Give the hub a moment to register the connection before sending.
+	time.Sleep(200 * time.Millisecond)
+
+	base, err := bob.GetMessagePage(ctx, aliceName, 0, "")
+	if err != nil {
+		return err
+	}
+	total := 2 * orderingSenders * orderingMessages
+
+	var (
+		mu       sync.Mutex
+		failures []string
+	)
+	fail := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures = append(failures, fmt.Sprintf(format, args...))
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(failures) > 0
+	}
+
+	// Senders
+	var senders sync.WaitGroup
+	for _, side := range []struct {
+		c  *client.Client
+		to string
+	}{{alice, bobName}, {bob, aliceName}} {
+		for i := 0; i < orderingSenders; i++ {
+			senders.Add(1)
+			go func(c *client.Client, to string, i int) {
+				defer senders.Done()
+				for j := 0; j < orderingMessages; j++ {
+					blob := fmt.Sprintf("order:%d:%d", i, j)
+					if err := c.SendMessage(ctx, to, blob, blob); err != nil {
+						fail("send to %s: %v", to, err)
+						return
+					}
+				}
+			}(side.c, side.to, i)
+		}
+	}
+	sendersDone := make(chan struct{})
+	go func() {
+		senders.Wait()
+		close(sendersDone)
+	}()
+
+	// Poller: each page must continue the previous one without a gap
+	var poller sync.WaitGroup
+	poller.Add(1)
+	go func() {
+		defer poller.Done()
+		cursor, lastSeq := base.MaxID, base.MaxSeq
+		for {
+			select {
+			case <-sendersDone:
+				return
+			default:
+			}
+			page, err := bob.GetMessagePage(ctx, aliceName, cursor, "")
+			if err != nil {
+				fail("poll: %v", err)
+				return
+			}
+			for _, m := range page.Messages {
+				if m.Seq != lastSeq+1 {
+					fail("poll after seq %d returned seq %d (id %d)", lastSeq, m.Seq, m.ID)
+				}
+				cursor, lastSeq = m.ID, m.Seq
+			}
+			if lastSeq != page.MaxSeq {
+				fail("poll saw seq %d but max_seq %d", lastSeq, page.MaxSeq)
+			}
+		}
+	}()
+
+	// WebSocket: every pushed message must already be visible to a poll
+	pushed := make(map[int]bool)
+	for len(pushed) < total {
+		ev, ok := <-events
+		if !ok {
+			fail("only %d of %d messages pushed before timing out", len(pushed), total)
+			break
+		}
+		switch ev.Type {
+		case client.EventDisconnected:
+			fail("websocket disconnected: %v", ev.Err)
+		case client.EventMessage:
+			m := ev.Message
+			if m.ID <= base.MaxID || pushed[m.ID] {
+				continue // Earlier steps, or a repeat
+			}
+			pushed[m.ID] = true
+			page, err := bob.GetMessagePage(ctx, aliceName, m.ID-1, "")
+			if err != nil {
+				fail("poll for pushed message %d: %v", m.ID, err)
+			} else if len(page.Messages) == 0 || page.Messages[0].ID != m.ID {
+				fail("message %d was pushed before a poll could see it", m.ID)
+			} else if page.Messages[0].Seq != m.Seq {
+				fail("message %d pushed with seq %d, polled with seq %d", m.ID, m.Seq, page.Messages[0].Seq)
+			}
+		}
+		if failed() {
+			break
+		}
+	}
+	cancel()
+	<-sendersDone
+	poller.Wait()
+
+	// Final state: every message exactly once, numbered without gaps
+	page, err := bob.GetMessagePage(ctx, aliceName, base.MaxID, "")
+	if err != nil {
+		return err
+	}
+	if len(page.Messages) != total {
+		fail("expected %d new messages, got %d", total, len(page.Messages))
+	}
+	for i, m := range page.Messages {
+		if m.Seq != base.MaxSeq+int64(i)+1 {
+			fail("message %d has seq %d, expected %d", m.ID, m.Seq, base.MaxSeq+int64(i)+1)
+			break
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d anomalies, first: %s", len(failures), failures[0])
+	}
+	return nil
+}
+
+// awaitConnected waits for the first EventConnected.
+func awaitConnected(events <-chan client.Event) error {
+	for ev := range events {
+		switch ev.Type {
+		case client.EventConnected:
+			return nil
+		case client.EventDisconnected:
+			return fmt.Errorf("websocket disconnected: %v", ev.Err)
+		}
+	}
+	return fmt.Errorf("websocket did not connect")
+}
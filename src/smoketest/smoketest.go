@@ -0,0 +1,190 @@
+// src/smoketest/smoketest.go
+package smoketest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"cryptachat-server/client"
+)
+
+// step is a single named check in the smoke test.
+type step struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// Run exercises the core flows against a running server at baseURL and
+// writes a pass/fail line per step to out. It returns an error if any step failed.
+func Run(ctx context.Context, baseURL string, out io.Writer) error {
+	alice := client.New(baseURL)
+	bob := client.New(baseURL)
+	aliceName := "smoke_" + randomSuffix()
+	bobName := "smoke_" + randomSuffix()
+	password := randomSuffix() + randomSuffix()
+
+	var lastID int
+
+	steps := []step{
+		{"register users", func(ctx context.Context) error {
+			if err := alice.Register(ctx, aliceName, password); err != nil {
+				return err
+			}
+			return bob.Register(ctx, bobName, password)
+		}},
+		{"login", func(ctx context.Context) error {
+			if err := alice.Login(ctx, aliceName, password); err != nil {
+				return err
+			}
+			return bob.Login(ctx, bobName, password)
+		}},
+		{"upload keys", func(ctx context.Context) error {
+			if err := alice.UploadKey(ctx, "smoke-key-"+aliceName); err != nil {
+				return err
+			}
+			if err := bob.UploadKey(ctx, "smoke-key-"+bobName); err != nil {
+				return err
+			}
+			key, err := alice.GetKey(ctx, bobName)
+			if err != nil {
+				return err
+			}
+			if key != "smoke-key-"+bobName {
+				return fmt.Errorf("got key %q for %s", key, bobName)
+			}
+			return nil
+		}},
+		{"request and accept chat", func(ctx context.Context) error {
+			if err := alice.RequestChat(ctx, bobName); err != nil {
+				return err
+			}
+			if err := bob.AcceptChat(ctx, aliceName); err != nil {
+				return err
+			}
+			contacts, err := alice.GetContacts(ctx)
+			if err != nil {
+				return err
+			}
+			for _, c := range contacts {
+				if c == bobName {
+					return nil
+				}
+			}
+			return fmt.Errorf("%s missing from contacts", bobName)
+		}},
+		{"send messages both ways", func(ctx context.Context) error {
+			if err := alice.SendMessage(ctx, bobName, "a-to-b:sender", "a-to-b:recipient"); err != nil {
+				return err
+			}
+			return bob.SendMessage(ctx, aliceName, "b-to-a:sender", "b-to-a:recipient")
+		}},
+		{"retrieve with since_id", func(ctx context.Context) error {
+			msgs, err := bob.GetMessages(ctx, aliceName, 0)
+			if err != nil {
+				return err
+			}
+			if len(msgs) != 2 {
+				return fmt.Errorf("expected 2 messages, got %d", len(msgs))
+			}
+			if msgs[0].EncryptedBlob != "a-to-b:recipient" || msgs[1].EncryptedBlob != "b-to-a:sender" {
+				return fmt.Errorf("wrong blobs returned: %q, %q", msgs[0].EncryptedBlob, msgs[1].EncryptedBlob)
+			}
+			lastID = msgs[1].ID
+
+			newer, err := bob.GetMessages(ctx, aliceName, msgs[0].ID)
+			if err != nil {
+				return err
+			}
+			if len(newer) != 1 || newer[0].ID != lastID {
+				return fmt.Errorf("since_id=%d returned %d messages", msgs[0].ID, len(newer))
+			}
+			return nil
+		}},
+		{"websocket push", func(ctx context.Context) error {
+			subCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			events := bob.Subscribe(subCtx)
+
+			for ev := range events {
+				switch ev.Type {
+				case client.EventConnected:
+					// Give the hub a moment to register the connection before sending.
+					time.Sleep(200 * time.Millisecond)
+					if err := alice.SendMessage(ctx, bobName, "ws:sender", "ws:recipient"); err != nil {
+						return err
+					}
+				case client.EventDisconnected:
+					return fmt.Errorf("websocket disconnected: %v", ev.Err)
+				case client.EventMessage:
+					if ev.Message.EncryptedBlob != "ws:recipient" || ev.Message.ID <= lastID {
+						return fmt.Errorf("unexpected pushed message %d", ev.Message.ID)
+					}
+					return nil
+				}
+			}
+			return fmt.Errorf("no pushed event received: %v", subCtx.Err())
+		}},
+		{"interleaved sends and polls", func(ctx context.Context) error {
+			return checkOrdering(ctx, alice, bob, aliceName, bobName)
+		}},
+	}
+
+	failed := 0
+	for _, st := range steps {
+		start := time.Now()
+		err := st.run(ctx)
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL  %-28s %8s  %v\n", st.name, elapsed, err)
+			// Later steps depend on earlier ones, so stop here.
+			break
+		}
+		fmt.Fprintf(out, "PASS  %-28s %8s\n", st.name, elapsed)
+	}
+
+	// Delete the throwaway users whatever happened above, as far as they
+	// got logged in. They are prefixed with "smoke_" in case this fails.
+	start := time.Now()
+	var left []string
+	var deleteErr error
+	for _, u := range []struct {
+		c    *client.Client
+		name string
+	}{{alice, aliceName}, {bob, bobName}} {
+		if u.c.Token() == "" {
+			left = append(left, u.name)
+			continue
+		}
+		if err := u.c.DeleteAccount(ctx, password); err != nil {
+			left = append(left, u.name)
+			deleteErr = err
+		}
+	}
+	elapsed := time.Since(start).Round(time.Millisecond)
+	switch {
+	case deleteErr != nil:
+		failed++
+		fmt.Fprintf(out, "FAIL  %-28s %8s  %v; left %v\n", "delete users", elapsed, deleteErr, left)
+	case len(left) > 0:
+		fmt.Fprintf(out, "SKIP  %-28s %8s  not logged in; left %v\n", "delete users", "-", left)
+	default:
+		fmt.Fprintf(out, "PASS  %-28s %8s\n", "delete users", elapsed)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("smoke test failed")
+	}
+	return nil
+}
+
+// randomSuffix returns a short random hex string for throwaway names.
+func randomSuffix() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
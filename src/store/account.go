@@ -0,0 +1,222 @@
+// src/store/account.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// DeleteUser deletes userID with their public key, chat requests and
+// messages in both directions, in one transaction. Everything else keyed
+// by the user goes with them by cascade; the key log keeps its entries so
+// the chain stays verifiable. Pushes still queued for the deleted messages
+// are dropped, since the dispatcher could no longer load them.
+//
+// It returns the users who had a chat request with them, whose contact and
+// request lists changed. Fails with "user not found", or with "user under
+// legal hold" if they or anyone they exchanged messages with is on legal
+// hold, because the messages would go too.
+func (s *PostgresStore) DeleteUser(ctx context.Context, userID int) ([]int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var held bool
+	err = tx.QueryRow(ctx, "SELECT legal_hold FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&held)
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if !held {
+		err = tx.QueryRow(ctx,
+			`
+            SELECT EXISTS (
+                SELECT 1 FROM messages m
+                JOIN users u ON u.id = CASE WHEN m.sender_id = $1 THEN m.recipient_id ELSE m.sender_id END
+                WHERE (m.sender_id = $1 OR m.recipient_id = $1) AND u.legal_hold
+            )
+            `, userID,
+		).Scan(&held)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+	}
+	if held {
+		return nil, fmt.Errorf("user under legal hold")
+	}
+
+	partners, err := requestPartners(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := bumpRelationshipsVersions(ctx, tx, partners...); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx,
+		`
+        UPDATE outbox SET processed_at = $3
+        WHERE processed_at IS NULL AND event_type = $2
+          AND ((payload->>'sender_id')::int = $1 OR (payload->>'recipient_id')::int = $1)
+        `, userID, EventMessageCreated, s.clock.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	for _, q := range []string{
+		"DELETE FROM messages WHERE sender_id = $1 OR recipient_id = $1",
+		"DELETE FROM chat_requests WHERE requester_id = $1 OR requested_id = $1",
+		"DELETE FROM public_keys WHERE user_id = $1",
+		"DELETE FROM users WHERE id = $1",
+	} {
+		if _, err := tx.Exec(ctx, q, userID); err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	s.forgetUser(userID)
+	return partners, nil
+}
+
+// GetUserCreatedAt returns when userID registered. Fails with "user not
+// found".
+func (s *PostgresStore) GetUserCreatedAt(ctx context.Context, userID int) (time.Time, error) {
+	var createdAt time.Time
+	err := s.db.QueryRow(ctx, "SELECT created_at FROM users WHERE id = $1", userID).Scan(&createdAt)
+	if err == pgx.ErrNoRows {
+		return time.Time{}, fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("database error: %w", err)
+	}
+	return createdAt, nil
+}
+
+// RenameUser changes userID's username to username, which must already be
+// canonical, and returns the old one and the users they have a chat
+// request with. Like RegisterUser, it holds an advisory lock on the new
+// name while checking it is free. In the same transaction it logs their
+// current key again under the new name, so the key log still shows which
+// key the name is bound to, and queues a "user.username_changed" event for
+// them and those users. Tokens carry the name the user had when they were
+// issued, so the rename also signs the user out everywhere, as a password
+// change does: their token version is bumped, their refresh tokens revoked
+// and their sessions ended. Returns the new token version too. Fails with
+// "user not found" or "username already exists".
+func (s *PostgresStore) RenameUser(ctx context.Context, userID int, username string) (previous string, version int, partners []int, err error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", username); err != nil {
+		return "", 0, nil, fmt.Errorf("database error: %w", err)
+	}
+	// Taken before the rename, so a key upload logging meanwhile either
+	// commits first (and its key is the one logged here) or waits and
+	// reads the new name
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", keyLogLockID); err != nil {
+		return "", 0, nil, fmt.Errorf("database error: %w", err)
+	}
+	var taken bool
+	err = tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM users WHERE lower(username) = $1 AND id <> $2)",
+		username, userID,
+	).Scan(&taken)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("database error: %w", err)
+	}
+	if taken {
+		return "", 0, nil, fmt.Errorf("username already exists")
+	}
+
+	var key *string
+	err = tx.QueryRow(ctx,
+		`
+        SELECT u.username, k.public_key
+        FROM users u LEFT JOIN public_keys k ON k.user_id = u.id
+        WHERE u.id = $1 FOR UPDATE OF u
+        `, userID).Scan(&previous, &key)
+	if err == pgx.ErrNoRows {
+		return "", 0, nil, fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("database error: %w", err)
+	}
+	err = tx.QueryRow(ctx,
+		"UPDATE users SET username = $2, token_version = token_version + 1 WHERE id = $1 RETURNING token_version",
+		userID, username,
+	).Scan(&version)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return "", 0, nil, fmt.Errorf("username already exists")
+		}
+		return "", 0, nil, fmt.Errorf("database error: %w", err)
+	}
+	if err := endUserSessions(ctx, tx, userID, s.clock.Now().UTC()); err != nil {
+		return "", 0, nil, err
+	}
+
+	if key != nil {
+		if err := s.appendKeyLog(ctx, tx, userID, *key); err != nil {
+			return "", 0, nil, err
+		}
+	}
+
+	partners, err = requestPartners(ctx, tx, userID)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	// Their lists show the new name
+	if err := bumpRelationshipsVersions(ctx, tx, partners...); err != nil {
+		return "", 0, nil, err
+	}
+	payload := UsernameChangedPayload{
+		UserIDs:     append([]int{userID}, partners...),
+		OldUsername: previous,
+		Username:    username,
+		ChangedAt:   NewTimestamp(s.clock.Now().UTC()),
+	}
+	if err := s.insertOutboxEvent(ctx, tx, EventUsernameChanged, payload); err != nil {
+		return "", 0, nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		if isUniqueViolation(err) {
+			return "", 0, nil, fmt.Errorf("username already exists")
+		}
+		return "", 0, nil, fmt.Errorf("database error: %w", err)
+	}
+	s.forgetUser(userID)
+	return previous, version, partners, nil
+}
+
+// requestPartners returns the users userID has a chat request with, in
+// either direction and any state.
+func requestPartners(ctx context.Context, tx pgx.Tx, userID int) ([]int, error) {
+	rows, err := tx.Query(ctx,
+		`
+        SELECT DISTINCT CASE WHEN requester_id = $1 THEN requested_id ELSE requester_id END
+        FROM chat_requests
+        WHERE requester_id = $1 OR requested_id = $1
+        `, userID)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	partners, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return partners, nil
+}
@@ -0,0 +1,66 @@
+// src/store/admin.go
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// CountAdmins returns how many admin users exist.
+func (s *PostgresStore) CountAdmins(ctx context.Context) (int, error) {
+	var n int
+	if err := s.db.QueryRow(ctx, "SELECT COUNT(*) FROM users WHERE is_admin").Scan(&n); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return n, nil
+}
+
+// BootstrapAdmin creates the first admin user. It claims the single
+// admin_bootstrap row in the same transaction, so across all replicas it
+// can succeed at most once; later calls fail with "admin already
+// bootstrapped". It returns the new user's ID.
+func (s *PostgresStore) BootstrapAdmin(ctx context.Context, username, passwordHash string) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := s.clock.Now().UTC()
+	cmdTag, err := tx.Exec(ctx,
+		"INSERT INTO admin_bootstrap (id, created_at) VALUES (1, $1) ON CONFLICT (id) DO NOTHING", now)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return 0, fmt.Errorf("admin already bootstrapped")
+	}
+
+	var exists bool
+	if err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE is_admin)").Scan(&exists); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if exists {
+		return 0, fmt.Errorf("admin already bootstrapped")
+	}
+
+	var userID int
+	err = tx.QueryRow(ctx,
+		"INSERT INTO users (username, password_hash, is_admin) VALUES ($1, $2, TRUE) RETURNING id",
+		username, passwordHash,
+	).Scan(&userID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, fmt.Errorf("username already exists")
+		}
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE admin_bootstrap SET user_id = $1 WHERE id = 1", userID); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return userID, nil
+}
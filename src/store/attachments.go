@@ -0,0 +1,156 @@
+// src/store/attachments.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Attachments are uploaded in chunks to the attachment store (package
+// attachments); the rows here say who each upload belongs to and what it
+// should add up to. A row is created when the upload starts and completed
+// once the chunks have been assembled and checked. Incomplete uploads
+// expire, and the attachment GC job deletes them along with their chunks.
+
+// Attachment is one attachment upload.
+type Attachment struct {
+	ID          string
+	UserID      int
+	Size        int64
+	ChunkSize   int
+	SHA256      []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time  // When an incomplete upload is deleted
+	CompletedAt *time.Time // nil until the upload is complete
+}
+
+// ChunkCount is how many chunks the attachment is cut into.
+func (a *Attachment) ChunkCount() int {
+	return int((a.Size + int64(a.ChunkSize) - 1) / int64(a.ChunkSize))
+}
+
+// CreateAttachment records a new upload, unless its user already has limit
+// incomplete uploads that haven't expired, in which case it fails with
+// "upload limit reached". CreatedAt is set from the store's clock.
+func (s *PostgresStore) CreateAttachment(ctx context.Context, a *Attachment, limit int) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialises one user's uploads, so concurrent ones can't both fit
+	if _, err := tx.Exec(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", a.UserID); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	now := s.clock.Now().UTC()
+	var open int
+	err = tx.QueryRow(ctx,
+		"SELECT count(*) FROM attachments WHERE user_id = $1 AND completed_at IS NULL AND expires_at > $2",
+		a.UserID, now).Scan(&open)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if open >= limit {
+		return fmt.Errorf("upload limit reached")
+	}
+
+	_, err = tx.Exec(ctx,
+		`
+        INSERT INTO attachments (id, user_id, size, chunk_size, sha256, created_at, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        `, a.ID, a.UserID, a.Size, a.ChunkSize, a.SHA256, now, a.ExpiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	a.CreatedAt = now
+	return nil
+}
+
+// GetAttachment returns an upload, or fails with "attachment not found".
+// An incomplete upload past its expiry is not found, even before the GC
+// job deletes it.
+func (s *PostgresStore) GetAttachment(ctx context.Context, id string) (*Attachment, error) {
+	var a Attachment
+	err := s.db.QueryRow(ctx,
+		`
+        SELECT id, user_id, size, chunk_size, sha256, created_at, expires_at, completed_at
+        FROM attachments
+        WHERE id = $1 AND (completed_at IS NOT NULL OR expires_at > $2)
+        `, id, s.clock.Now().UTC(),
+	).Scan(&a.ID, &a.UserID, &a.Size, &a.ChunkSize, &a.SHA256, &a.CreatedAt, &a.ExpiresAt, &a.CompletedAt)
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("attachment not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return &a, nil
+}
+
+// CompleteAttachment marks an upload complete and returns when it was. It
+// fails with "attachment not found" if the upload has expired or been
+// deleted meanwhile; completing one twice returns the first time.
+func (s *PostgresStore) CompleteAttachment(ctx context.Context, id string) (time.Time, error) {
+	var completedAt time.Time
+	err := s.db.QueryRow(ctx,
+		`
+        UPDATE attachments SET completed_at = COALESCE(completed_at, $2)
+        WHERE id = $1 AND (completed_at IS NOT NULL OR expires_at > $2)
+        RETURNING completed_at
+        `, id, s.clock.Now().UTC()).Scan(&completedAt)
+	if err == pgx.ErrNoRows {
+		return time.Time{}, fmt.Errorf("attachment not found")
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("database error: %w", err)
+	}
+	return completedAt, nil
+}
+
+// DeleteAttachment deletes an upload and reports whether there was one.
+func (s *PostgresStore) DeleteAttachment(ctx context.Context, id string) (bool, error) {
+	tag, err := s.db.Exec(ctx, "DELETE FROM attachments WHERE id = $1", id)
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// DeleteExpiredAttachments deletes incomplete uploads that expired before
+// before, and returns their IDs so their chunks can be deleted too.
+func (s *PostgresStore) DeleteExpiredAttachments(ctx context.Context, before time.Time) ([]string, error) {
+	rows, err := s.db.Query(ctx,
+		"DELETE FROM attachments WHERE completed_at IS NULL AND expires_at < $1 RETURNING id",
+		before.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return ids, nil
+}
+
+// UnknownAttachments returns those of ids that have no upload row, such as
+// blobs left behind by a deleted account.
+func (s *PostgresStore) UnknownAttachments(ctx context.Context, ids []string) ([]string, error) {
+	rows, err := s.db.Query(ctx,
+		"SELECT u.id FROM unnest($1::text[]) AS u(id) WHERE NOT EXISTS (SELECT 1 FROM attachments a WHERE a.id = u.id)",
+		ids)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	unknown, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return unknown, nil
+}
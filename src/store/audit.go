@@ -0,0 +1,210 @@
+// src/store/audit.go
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RecordAuditEvent stores a security-relevant event for a user, or with
+// userID 0 for none (e.g. an action taken with the admin token).
+// details may be nil.
+func (s *PostgresStore) RecordAuditEvent(ctx context.Context, userID int, eventType string, details map[string]interface{}) error {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	data, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("could not encode audit details: %v", err)
+	}
+	var user *int
+	if userID != 0 {
+		user = &userID
+	}
+	_, err = s.db.Exec(ctx,
+		"INSERT INTO audit_events (user_id, event_type, details, created_at) VALUES ($1, $2, $3, $4)",
+		user, eventType, data, s.clock.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// AuditEvent is a stored audit event. UserID is nil for events not tied
+// to a user and for users since deleted; Username is their current name.
+type AuditEvent struct {
+	ID        int64           `json:"id"`
+	UserID    *int            `json:"user_id"`
+	Username  string          `json:"username,omitempty"`
+	EventType string          `json:"event_type"`
+	Details   json.RawMessage `json:"details"`
+	CreatedAt Timestamp       `json:"created_at"`
+}
+
+// AuditFilter selects audit events. Zero fields don't filter.
+type AuditFilter struct {
+	UserID int
+	Types  []string  // Any of these event types
+	Since  time.Time // Inclusive
+	Until  time.Time // Exclusive
+}
+
+// where returns f as a WHERE clause over audit_events e, with its values
+// as bind parameters. Filter values are never spliced into the SQL. With
+// idOp ("<" or ">"), events are also limited to ids idOp id.
+func (f AuditFilter) where(idOp string, id int64) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	param := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if f.UserID != 0 {
+		conds = append(conds, "e.user_id = "+param(f.UserID))
+	}
+	if len(f.Types) > 0 {
+		conds = append(conds, "e.event_type = ANY("+param(f.Types)+")")
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "e.created_at >= "+param(f.Since.UTC()))
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "e.created_at < "+param(f.Until.UTC()))
+	}
+	if idOp != "" {
+		conds = append(conds, "e.id "+idOp+" "+param(id))
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// ListAuditEvents returns up to limit events matching f, newest first,
+// starting below beforeID (0 for the newest).
+func (s *PostgresStore) ListAuditEvents(ctx context.Context, f AuditFilter, beforeID int64, limit int) ([]AuditEvent, error) {
+	var where string
+	var args []interface{}
+	if beforeID > 0 {
+		where, args = f.where("<", beforeID)
+	} else {
+		where, args = f.where("", 0)
+	}
+	return s.queryAuditEvents(ctx, where, "e.id DESC", args, limit)
+}
+
+// auditExportBatch is how many events ExportAuditEvents reads per query.
+const auditExportBatch = 1000
+
+// ExportAuditEvents calls fn with every event matching f, oldest first,
+// stopping at the first error. Events are read in batches, so a slow
+// consumer doesn't hold a database connection.
+func (s *PostgresStore) ExportAuditEvents(ctx context.Context, f AuditFilter, fn func(AuditEvent) error) error {
+	var afterID int64
+	for {
+		where, args := f.where(">", afterID)
+		events, err := s.queryAuditEvents(ctx, where, "e.id", args, auditExportBatch)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			if err := fn(e); err != nil {
+				return err
+			}
+			afterID = e.ID
+		}
+		if len(events) < auditExportBatch {
+			return nil
+		}
+	}
+}
+
+// queryAuditEvents lists audit events; where and order are built in this
+// file, never from input.
+func (s *PostgresStore) queryAuditEvents(ctx context.Context, where, order string, args []interface{}, limit int) ([]AuditEvent, error) {
+	args = append(args, limit)
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT e.id, e.user_id, COALESCE(u.username, ''), e.event_type, e.details, e.created_at
+        FROM audit_events e
+        LEFT JOIN users u ON u.id = e.user_id
+        `+where+`
+        ORDER BY `+order+`
+        LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (AuditEvent, error) {
+		var e AuditEvent
+		err := row.Scan(&e.ID, &e.UserID, &e.Username, &e.EventType, &e.Details, &e.CreatedAt)
+		return e, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return events, nil
+}
+
+// AuditDayCount is how many events of one type happened on one UTC day.
+type AuditDayCount struct {
+	Day       string `json:"day"` // YYYY-MM-DD
+	EventType string `json:"event_type"`
+	Count     int64  `json:"count"`
+}
+
+// CountAuditEventsByDay counts the events matching f per UTC day and event
+// type, oldest day first.
+func (s *PostgresStore) CountAuditEventsByDay(ctx context.Context, f AuditFilter) ([]AuditDayCount, error) {
+	where, args := f.where("", 0)
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT to_char(e.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, e.event_type, COUNT(*)
+        FROM audit_events e
+        `+where+`
+        GROUP BY day, e.event_type
+        ORDER BY day, e.event_type
+        `, args...)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	counts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (AuditDayCount, error) {
+		var c AuditDayCount
+		err := row.Scan(&c.Day, &c.EventType, &c.Count)
+		return c, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return counts, nil
+}
+
+// auditPruneBatch is how many audit events PruneAuditEvents deletes per
+// statement, so a large backlog doesn't hold one long transaction.
+const auditPruneBatch = 10000
+
+// PruneAuditEvents deletes audit events created before before. It returns
+// how many were deleted.
+func (s *PostgresStore) PruneAuditEvents(ctx context.Context, before time.Time) (int64, error) {
+	var total int64
+	for {
+		tag, err := s.db.Exec(ctx,
+			`
+            DELETE FROM audit_events WHERE id IN (
+                SELECT id FROM audit_events WHERE created_at < $1 LIMIT $2
+            )
+            `, before.UTC(), auditPruneBatch)
+		if err != nil {
+			return total, fmt.Errorf("database error: %w", err)
+		}
+		total += tag.RowsAffected()
+		if tag.RowsAffected() < auditPruneBatch {
+			return total, nil
+		}
+	}
+}
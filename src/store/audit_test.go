@@ -0,0 +1,146 @@
+// src/store/audit_test.go
+package store
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptachat-server/testutil"
+)
+
+// TestAuditFilterBindsValues checks every filter value is passed as a
+// parameter, never spliced into the SQL.
+func TestAuditFilterBindsValues(t *testing.T) {
+	evil := "x'); DROP TABLE users; --"
+	f := AuditFilter{
+		UserID: 7,
+		Types:  []string{evil},
+		Since:  time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:  time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+	where, args := f.where("<", 99)
+	want := "WHERE e.user_id = $1 AND e.event_type = ANY($2) AND e.created_at >= $3 AND e.created_at < $4 AND e.id < $5"
+	if where != want {
+		t.Errorf("got %s\nwant %s", where, want)
+	}
+	if strings.Contains(where, "DROP") || len(args) != 5 || args[4] != int64(99) {
+		t.Errorf("args %v", args)
+	}
+
+	if where, args := (AuditFilter{}).where("", 0); where != "" || len(args) != 0 {
+		t.Errorf("empty filter: %q %v", where, args)
+	}
+	if where, _ := (AuditFilter{Until: f.Until}).where(">", 3); where != "WHERE e.created_at < $1 AND e.id > $2" {
+		t.Errorf("until only: %s", where)
+	}
+}
+
+// TestAuditQueries records events for two users over three days and checks
+// each filter alone and in combination, paging, export order, the daily
+// counts and pruning.
+func TestAuditQueries(t *testing.T) {
+	s := newTestStore(t)
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	clk := testutil.NewFakeClock(day)
+	s.SetClock(clk)
+	ctx := context.Background()
+	alice := mustRegister(t, s, "alice")
+	bob := mustRegister(t, s, "bob")
+
+	record := func(userID int, eventType string) {
+		t.Helper()
+		if err := s.RecordAuditEvent(ctx, userID, eventType, map[string]interface{}{"n": 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Day 1: alice logs in twice, bob once; day 2: alice changes her
+	// password, and the admin token acts; day 3: bob logs in
+	record(alice, "login")
+	record(alice, "login")
+	record(bob, "login")
+	clk.Advance(24 * time.Hour)
+	record(alice, "password_changed")
+	record(0, "admin.user_deleted")
+	clk.Advance(24 * time.Hour)
+	record(bob, "login")
+
+	list := func(f AuditFilter) []string {
+		t.Helper()
+		events, err := s.ListAuditEvents(ctx, f, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range events {
+			got = append(got, e.Username+":"+e.EventType)
+		}
+		return got
+	}
+	day2 := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	day3 := time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		f    AuditFilter
+		want []string // Newest first
+	}{
+		{"everything", AuditFilter{}, []string{"bob:login", ":admin.user_deleted", "alice:password_changed", "bob:login", "alice:login", "alice:login"}},
+		{"user", AuditFilter{UserID: alice}, []string{"alice:password_changed", "alice:login", "alice:login"}},
+		{"type", AuditFilter{Types: []string{"login"}}, []string{"bob:login", "bob:login", "alice:login", "alice:login"}},
+		{"types", AuditFilter{Types: []string{"password_changed", "admin.user_deleted"}}, []string{":admin.user_deleted", "alice:password_changed"}},
+		{"since", AuditFilter{Since: day2}, []string{"bob:login", ":admin.user_deleted", "alice:password_changed"}},
+		{"until", AuditFilter{Until: day2}, []string{"bob:login", "alice:login", "alice:login"}},
+		{"since and until", AuditFilter{Since: day2, Until: day3}, []string{":admin.user_deleted", "alice:password_changed"}},
+		{"user and type", AuditFilter{UserID: bob, Types: []string{"login"}}, []string{"bob:login", "bob:login"}},
+		{"user, type and since", AuditFilter{UserID: bob, Types: []string{"login"}, Since: day2}, []string{"bob:login"}},
+		{"no match", AuditFilter{UserID: alice, Types: []string{"login"}, Since: day3}, nil},
+	}
+	for _, tt := range tests {
+		if got := list(tt.f); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Paging by ID through the logins
+	logins := AuditFilter{Types: []string{"login"}}
+	page, err := s.ListAuditEvents(ctx, logins, 0, 3)
+	if err != nil || len(page) != 3 {
+		t.Fatalf("first page: %v, %v", page, err)
+	}
+	rest, err := s.ListAuditEvents(ctx, logins, page[2].ID, 3)
+	if err != nil || len(rest) != 1 || rest[0].ID >= page[2].ID {
+		t.Errorf("second page: %+v, %v; want the oldest login", rest, err)
+	}
+
+	var exported []int64
+	err = s.ExportAuditEvents(ctx, logins, func(e AuditEvent) error {
+		exported = append(exported, e.ID)
+		return nil
+	})
+	if err != nil || len(exported) != 4 || !slices.IsSorted(exported) {
+		t.Errorf("exported %v, %v; want four logins oldest first", exported, err)
+	}
+
+	counts, err := s.CountAuditEventsByDay(ctx, AuditFilter{Until: day3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCounts := []AuditDayCount{
+		{"2026-03-01", "login", 3},
+		{"2026-03-02", "admin.user_deleted", 1},
+		{"2026-03-02", "password_changed", 1},
+	}
+	if !slices.Equal(counts, wantCounts) {
+		t.Errorf("daily counts %v, want %v", counts, wantCounts)
+	}
+
+	n, err := s.PruneAuditEvents(ctx, day2)
+	if err != nil || n != 3 {
+		t.Errorf("pruned %d, %v; want the first day's 3", n, err)
+	}
+	if got := list(AuditFilter{}); len(got) != 3 {
+		t.Errorf("after pruning: %v", got)
+	}
+}
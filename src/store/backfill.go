@@ -0,0 +1,364 @@
+// src/store/backfill.go
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Adding a NOT NULL column to a large table in one migration rewrites or
+// scans the whole table while holding an ACCESS EXCLUSIVE lock, which stops
+// every write to it for minutes. Such columns are added in steps instead:
+//
+//  1. The migration adds the column as nullable, which only changes the
+//     catalog, and the code starts filling it in for new rows.
+//  2. A Backfill registered below under the migration's version fills in
+//     the existing rows, a batch per transaction, pausing in between. It
+//     runs in the background after startup, or to completion with
+//     -backfill-only, and resumes where it stopped.
+//  3. The backfill then adds Check as a NOT VALID constraint, which is
+//     instant, and validates it, which scans the table but lets writes
+//     through. With NotNull the column is then marked NOT NULL, which
+//     Postgres proves from the validated constraint without a scan.
+//
+// Migrations that rely on the column being filled in must come after the
+// backfill is done; schema_backfills records its progress.
+
+// backfillLockID keeps two replicas from running the same backfill.
+const backfillLockID = 7240002
+
+// DDL in a backfill waits at most backfillLockTimeout for its lock, so a
+// long transaction on the table can't queue every other query behind it. It
+// is tried backfillLockAttempts times.
+const (
+	backfillLockTimeout  = 2 * time.Second
+	backfillLockAttempts = 10
+)
+
+// backfillLogEvery is how often a running backfill logs its progress.
+const backfillLogEvery = 10 * time.Second
+
+// Backfill fills in a column added by migration Version.
+type Backfill struct {
+	Version int
+	Table   string
+	Column  string
+	// Key is an integer primary key to walk the table by; "id" if empty.
+	Key string
+	// Set is the SQL expression the column is set to, over the row's
+	// columns. Only rows where the column is NULL are updated. It may use
+	// $1, the key the batch starts after: every row up to it has been
+	// filled in.
+	Set string
+	// Check is the condition every row must meet once filled in, added as
+	// a constraint. Empty adds none.
+	Check string
+	// NotNull marks the column NOT NULL afterwards, using Check (which
+	// must then imply it) so no scan is needed.
+	NotNull bool
+}
+
+// backfills are the registered backfills, oldest first.
+var backfills = []Backfill{
+	{
+		// Numbers each conversation's messages in ID order, continuing from
+		// its last message in earlier batches. Later messages of the same
+		// conversation in the batch count towards a row's number, so
+		// several of them in one batch get consecutive numbers. Sealed
+		// messages get none.
+		Version: 11,
+		Table:   "messages",
+		Column:  "seq",
+		Set:     messageSeqBackfill,
+		Check:   "seq IS NOT NULL OR sender_id IS NULL",
+	},
+	{
+		// Sealed-sender messages belong to no conversation, so the column
+		// stays nullable
+		Version: 16,
+		Table:   "messages",
+		Column:  "conversation_id",
+		Set:     "(LEAST(sender_id, recipient_id)::bigint << 32) | GREATEST(sender_id, recipient_id)",
+		Check:   "conversation_id IS NOT NULL OR sender_id IS NULL",
+	},
+}
+
+// messageSeqBackfill is the seq of a message from before migration 11:
+// the seq of the conversation's newest message up to $1, plus the number
+// of its unnumbered messages from $1 to this one. Each lookup is a range
+// scan of a (sender_id, recipient_id, id) index.
+const messageSeqBackfill = `CASE WHEN messages.sender_id IS NOT NULL THEN
+    COALESCE(GREATEST(
+        (SELECT p.seq FROM messages p
+         WHERE p.sender_id = messages.sender_id AND p.recipient_id = messages.recipient_id AND p.id <= $1
+         ORDER BY p.id DESC LIMIT 1),
+        (SELECT p.seq FROM messages p
+         WHERE p.sender_id = messages.recipient_id AND p.recipient_id = messages.sender_id AND p.id <= $1
+         ORDER BY p.id DESC LIMIT 1)
+    ), 0)
+    + (SELECT count(*) FROM messages q
+       WHERE q.id > $1 AND q.id <= messages.id AND q.seq IS NULL
+         AND ((q.sender_id = messages.sender_id AND q.recipient_id = messages.recipient_id)
+           OR (q.sender_id = messages.recipient_id AND q.recipient_id = messages.sender_id)))
+END`
+
+func (b Backfill) key() string {
+	if b.Key == "" {
+		return "id"
+	}
+	return b.Key
+}
+
+// name identifies the backfill in schema_backfills and the logs.
+func (b Backfill) name() string {
+	return b.Table + "." + b.Column
+}
+
+// constraint is the name of the constraint Check is added as.
+func (b Backfill) constraint() string {
+	return b.Table + "_" + b.Column + "_filled"
+}
+
+// backfillsFor returns the backfills registered under a migration version.
+func backfillsFor(version int) []Backfill {
+	var found []Backfill
+	for _, b := range backfills {
+		if b.Version == version {
+			found = append(found, b)
+		}
+	}
+	return found
+}
+
+// BackfillOptions pace RunBackfills.
+type BackfillOptions struct {
+	BatchSize int
+	Pause     time.Duration // Between batches
+	// Wait waits for another replica's run to finish instead of leaving
+	// the backfills to it.
+	Wait bool
+}
+
+// RunBackfills runs every backfill whose migration is applied and which
+// hasn't finished, oldest first, resuming each where it stopped. Only one
+// replica runs them at a time; without opts.Wait, the others return at
+// once.
+func (s *PostgresStore) RunBackfills(ctx context.Context, opts BackfillOptions) error {
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer conn.Release()
+
+	if opts.Wait {
+		if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", backfillLockID); err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+	} else {
+		var locked bool
+		if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", backfillLockID).Scan(&locked); err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		if !locked {
+			return nil
+		}
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", backfillLockID)
+
+	rows, err := conn.Query(ctx, "SELECT version, name, last_key FROM schema_backfills WHERE done_at IS NULL ORDER BY version")
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	type pending struct {
+		version int
+		name    string
+		lastKey int64
+	}
+	todo, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (pending, error) {
+		var p pending
+		err := row.Scan(&p.version, &p.name, &p.lastKey)
+		return p, err
+	})
+	if err != nil {
+		return fmt.Errorf("database scan error: %w", err)
+	}
+
+	for _, p := range todo {
+		for _, b := range backfillsFor(p.version) {
+			if b.name() != p.name {
+				continue
+			}
+			if err := s.runBackfill(ctx, b, p.lastKey, opts); err != nil {
+				return fmt.Errorf("backfill %s: %w", b.name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// runBackfill fills in b's column from the key after lastKey, then adds its
+// constraint and records it done.
+func (s *PostgresStore) runBackfill(ctx context.Context, b Backfill, lastKey int64, opts BackfillOptions) error {
+	if opts.BatchSize <= 0 {
+		return fmt.Errorf("batch size must be positive")
+	}
+	if lastKey == 0 {
+		log.Printf("BACKFILL: starting %s", b.name())
+	} else {
+		log.Printf("BACKFILL: resuming %s after %s %d", b.name(), b.key(), lastKey)
+	}
+
+	// Walks the table by key, so each batch reads at most BatchSize rows
+	// whether or not they still need updating
+	batchSQL := fmt.Sprintf(`
+        WITH batch AS (
+            SELECT %[2]s AS batch_key FROM %[1]s WHERE %[2]s > $1 ORDER BY %[2]s LIMIT $2
+        ), updated AS (
+            UPDATE %[1]s SET %[3]s = %[4]s
+            FROM batch WHERE %[1]s.%[2]s = batch.batch_key AND %[1]s.%[3]s IS NULL
+            RETURNING 1
+        )
+        SELECT (SELECT max(batch_key) FROM batch), (SELECT count(*) FROM updated)`,
+		pgx.Identifier{b.Table}.Sanitize(), pgx.Identifier{b.key()}.Sanitize(),
+		pgx.Identifier{b.Column}.Sanitize(), b.Set)
+
+	var total int64
+	lastLog := time.Now()
+	for {
+		tx, err := s.db.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		var maxKey *int64
+		var updated int64
+		if err := tx.QueryRow(ctx, batchSQL, lastKey, opts.BatchSize).Scan(&maxKey, &updated); err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("database error: %w", err)
+		}
+		if maxKey == nil {
+			tx.Rollback(ctx)
+			break
+		}
+		_, err = tx.Exec(ctx, `
+            UPDATE schema_backfills
+            SET last_key = $2, rows_done = rows_done + $3, started_at = COALESCE(started_at, NOW())
+            WHERE version = $1 AND name = $4`, b.Version, *maxKey, updated, b.name())
+		if err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("database error: %w", err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		lastKey = *maxKey
+		total += updated
+
+		if time.Since(lastLog) >= backfillLogEvery {
+			log.Printf("BACKFILL: %s updated %d rows so far, at %s %d", b.name(), total, b.key(), lastKey)
+			lastLog = time.Now()
+		}
+		if opts.Pause > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(opts.Pause):
+			}
+		}
+	}
+	log.Printf("BACKFILL: %s updated %d rows, adding its constraint", b.name(), total)
+
+	if err := s.addBackfillConstraint(ctx, b); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(ctx, "UPDATE schema_backfills SET done_at = NOW() WHERE version = $1 AND name = $2", b.Version, b.name()); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	log.Printf("BACKFILL: %s done", b.name())
+	return nil
+}
+
+// addBackfillConstraint adds b.Check as a NOT VALID constraint unless it
+// exists, validates it, and with b.NotNull sets NOT NULL and drops the
+// check. Each step is safe to repeat after an interruption.
+func (s *PostgresStore) addBackfillConstraint(ctx context.Context, b Backfill) error {
+	if b.Check == "" {
+		return nil
+	}
+	table := pgx.Identifier{b.Table}.Sanitize()
+	constraint := pgx.Identifier{b.constraint()}.Sanitize()
+
+	var exists bool
+	err := s.db.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = to_regclass($1) AND conname = $2)",
+		b.Table, b.constraint()).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if !exists {
+		err := s.execWithLockTimeout(ctx, fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s CHECK (%s) NOT VALID", table, constraint, b.Check))
+		if err != nil {
+			return err
+		}
+	}
+	// Only takes a lock that lets reads and writes through while it scans;
+	// a no-op once validated
+	if err := s.execWithLockTimeout(ctx, fmt.Sprintf("ALTER TABLE %s VALIDATE CONSTRAINT %s", table, constraint)); err != nil {
+		return err
+	}
+	if !b.NotNull {
+		return nil
+	}
+	err = s.execWithLockTimeout(ctx, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET NOT NULL", table, pgx.Identifier{b.Column}.Sanitize()))
+	if err != nil {
+		return err
+	}
+	return s.execWithLockTimeout(ctx, fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s", table, constraint))
+}
+
+// execWithLockTimeout runs DDL that gives up waiting for its lock after
+// backfillLockTimeout, retrying up to backfillLockAttempts times.
+func (s *PostgresStore) execWithLockTimeout(ctx context.Context, sql string) error {
+	for attempt := 1; ; attempt++ {
+		err := s.execLocked(ctx, sql)
+		var pgErr *pgconn.PgError
+		if err == nil || !errors.As(err, &pgErr) || pgErr.Code != "55P03" || attempt == backfillLockAttempts {
+			if err != nil {
+				return fmt.Errorf("database error: %w", err)
+			}
+			return nil
+		}
+		log.Printf("BACKFILL: lock not available for %q, retrying (%d/%d)", sql, attempt, backfillLockAttempts)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backfillLockTimeout):
+		}
+	}
+}
+
+func (s *PostgresStore) execLocked(ctx context.Context, sql string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, fmt.Sprintf("SET LOCAL lock_timeout = %d", backfillLockTimeout.Milliseconds())); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// conversationID is messages.conversation_id for a message between a and b,
+// as computed by the backfill: both user IDs, the lower in the high bits.
+func conversationID(a, b int) int64 {
+	return int64(min(a, b))<<32 | int64(max(a, b))
+}
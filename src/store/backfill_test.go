@@ -0,0 +1,232 @@
+// src/store/backfill_test.go
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// TestMessageSeqBackfill numbers messages stored before migration 11: three
+// interleaved conversations, in batches smaller than a conversation, so
+// numbering continues across batches and within one.
+func TestMessageSeqBackfill(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	alice, bob, carol := mustRegister(t, s, "alice"), mustRegister(t, s, "bob"), mustRegister(t, s, "carol")
+	names := map[int]string{alice: "alice", bob: "bob", carol: "carol"}
+	pairs := [][2]int{{alice, bob}, {bob, alice}, {alice, carol}, {bob, carol}, {carol, alice}, {alice, bob}, {alice, bob}}
+	for round := 0; round < 4; round++ {
+		for i, p := range pairs {
+			blob := fmt.Sprintf("%d-%d", round, i)
+			if _, _, err := s.SendMessage(ctx, p[0], names[p[1]], blob, blob); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Back to how migration 11 leaves existing messages
+	if _, err := s.db.Exec(ctx, "UPDATE messages SET seq = NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RunBackfills(ctx, BackfillOptions{BatchSize: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := s.db.Query(ctx, `
+        SELECT LEAST(sender_id, recipient_id), GREATEST(sender_id, recipient_id), id, seq
+        FROM messages ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := make(map[[2]int]int64)
+	for rows.Next() {
+		var low, high, id int
+		var seq *int64
+		if err := rows.Scan(&low, &high, &id, &seq); err != nil {
+			t.Fatal(err)
+		}
+		conv := [2]int{low, high}
+		next[conv]++
+		if seq == nil || *seq != next[conv] {
+			t.Errorf("message %d in conversation %v: seq %v, want %d", id, conv, seq, next[conv])
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var validated bool
+	err = s.db.QueryRow(ctx,
+		"SELECT convalidated FROM pg_constraint WHERE conrelid = 'messages'::regclass AND conname = 'messages_seq_filled'").Scan(&validated)
+	if err != nil || !validated {
+		t.Errorf("messages_seq_filled: validated %v, %v", validated, err)
+	}
+
+	// Sends after the backfill continue each conversation's numbering
+	if _, _, err := s.SendMessage(ctx, carol, "bob", "after", "after"); err != nil {
+		t.Fatal(err)
+	}
+	var seq int64
+	if err := s.db.QueryRow(ctx, "SELECT seq FROM messages ORDER BY id DESC LIMIT 1").Scan(&seq); err != nil {
+		t.Fatal(err)
+	}
+	if want := next[[2]int{min(bob, carol), max(bob, carol)}] + 1; seq != want {
+		t.Errorf("next send got seq %d, want %d", seq, want)
+	}
+}
+
+// backfillProgress returns the schema_backfills row of the backfill of
+// table.column.
+func backfillProgress(t *testing.T, s *PostgresStore, table, column string) (lastKey, rowsDone int64, done bool) {
+	t.Helper()
+	err := s.db.QueryRow(context.Background(),
+		"SELECT last_key, rows_done, done_at IS NOT NULL FROM schema_backfills WHERE name = $1",
+		table+"."+column).Scan(&lastKey, &rowsDone, &done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lastKey, rowsDone, done
+}
+
+// constraintState reports whether the constraint exists and is validated.
+func constraintState(t *testing.T, s *PostgresStore, name string) (exists, validated bool) {
+	t.Helper()
+	err := s.db.QueryRow(context.Background(),
+		"SELECT convalidated FROM pg_constraint WHERE conrelid = 'messages'::regclass AND conname = $1",
+		name).Scan(&validated)
+	if err == pgx.ErrNoRows {
+		return false, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return true, validated
+}
+
+// TestBackfillResumesAfterInterruption stops the conversation_id backfill
+// after its first batch, as a restart would, and checks that the next run
+// carries on from the recorded key, skips rows new code already filled in,
+// and then adds and validates its constraint. It then stops one again
+// between adding the constraint NOT VALID and validating it.
+func TestBackfillResumesAfterInterruption(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	alice, bob := mustRegister(t, s, "alice"), mustRegister(t, s, "bob")
+	var ids []int
+	for i := 0; i < 10; i++ {
+		from, to := alice, "bob"
+		if i%2 == 1 {
+			from, to = bob, "alice"
+		}
+		id, _, err := s.SendMessage(ctx, from, to, "blob", "blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// Back to how migration 16 leaves existing messages, with only this
+	// backfill left to run
+	for _, sql := range []string{
+		"ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_conversation_id_filled",
+		"UPDATE messages SET conversation_id = NULL",
+		"UPDATE schema_backfills SET done_at = NOW() WHERE name <> 'messages.conversation_id'",
+		"UPDATE schema_backfills SET last_key = 0, rows_done = 0, started_at = NULL, done_at = NULL WHERE name = 'messages.conversation_id'",
+	} {
+		if _, err := s.db.Exec(ctx, sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+
+	// Interrupted in the pause after the first batch
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- s.RunBackfills(runCtx, BackfillOptions{BatchSize: 3, Pause: time.Minute})
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, rowsDone, _ := backfillProgress(t, s, "messages", "conversation_id"); rowsDone > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the first batch never committed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted run: got %v, want context.Canceled", err)
+	}
+
+	lastKey, rowsDone, done := backfillProgress(t, s, "messages", "conversation_id")
+	if lastKey != int64(ids[2]) || rowsDone != 3 || done {
+		t.Fatalf("after one batch: last_key %d, rows_done %d, done %v; want %d, 3, false", lastKey, rowsDone, done, ids[2])
+	}
+	var filled int
+	if err := s.db.QueryRow(ctx, "SELECT count(*) FROM messages WHERE conversation_id IS NOT NULL").Scan(&filled); err != nil {
+		t.Fatal(err)
+	}
+	if filled != 3 {
+		t.Errorf("after one batch: %d rows filled in, want 3", filled)
+	}
+	if exists, _ := constraintState(t, s, "messages_conversation_id_filled"); exists {
+		t.Error("the constraint was added before the backfill finished")
+	}
+
+	// Written meanwhile by code that fills the column in itself
+	if _, _, err := s.SendMessage(ctx, alice, "bob", "blob", "blob"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RunBackfills(ctx, BackfillOptions{BatchSize: 3}); err != nil {
+		t.Fatal(err)
+	}
+	lastKey, rowsDone, done = backfillProgress(t, s, "messages", "conversation_id")
+	if rowsDone != int64(len(ids)) || !done {
+		t.Errorf("resumed: rows_done %d, done %v; want %d, true", rowsDone, done, len(ids))
+	}
+	var wrong int
+	err := s.db.QueryRow(ctx, "SELECT count(*) FROM messages WHERE conversation_id IS DISTINCT FROM $1", conversationID(alice, bob)).Scan(&wrong)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrong != 0 {
+		t.Errorf("%d messages with a wrong or missing conversation_id", wrong)
+	}
+	if exists, validated := constraintState(t, s, "messages_conversation_id_filled"); !exists || !validated {
+		t.Errorf("constraint: exists %v, validated %v; want both", exists, validated)
+	}
+
+	// Interrupted after adding the constraint NOT VALID: the next run
+	// validates it and finishes
+	for _, sql := range []string{
+		"ALTER TABLE messages DROP CONSTRAINT messages_conversation_id_filled",
+		"ALTER TABLE messages ADD CONSTRAINT messages_conversation_id_filled CHECK (conversation_id IS NOT NULL OR sender_id IS NULL) NOT VALID",
+		"UPDATE schema_backfills SET done_at = NULL WHERE name = 'messages.conversation_id'",
+	} {
+		if _, err := s.db.Exec(ctx, sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	if exists, validated := constraintState(t, s, "messages_conversation_id_filled"); !exists || validated {
+		t.Fatalf("constraint before resuming: exists %v, validated %v; want NOT VALID", exists, validated)
+	}
+	if err := s.RunBackfills(ctx, BackfillOptions{BatchSize: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if exists, validated := constraintState(t, s, "messages_conversation_id_filled"); !exists || !validated {
+		t.Errorf("constraint after resuming: exists %v, validated %v; want both", exists, validated)
+	}
+	if _, rowsDone2, done := backfillProgress(t, s, "messages", "conversation_id"); rowsDone2 != rowsDone || !done {
+		t.Errorf("after validating: rows_done %d, done %v; want %d, true", rowsDone2, done, rowsDone)
+	}
+}
@@ -0,0 +1,90 @@
+// src/store/backup.go
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// backupVersionsKept is how many backup versions are retained per user.
+const backupVersionsKept = 3
+
+// KeyBackup is one version of a user's encrypted key backup.
+type KeyBackup struct {
+	Version   int       `json:"version"`
+	Blob      string    `json:"blob"`
+	CreatedAt Timestamp `json:"created_at"`
+}
+
+// PutKeyBackup stores a new backup version and prunes all but the newest
+// backupVersionsKept. It returns the new version number.
+func (s *PostgresStore) PutKeyBackup(ctx context.Context, userID int, blob string) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialise concurrent uploads for the same user
+	if _, err := tx.Exec(ctx, "SELECT 1 FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+
+	var version int
+	err = tx.QueryRow(ctx,
+		`
+        INSERT INTO key_backups (user_id, version, blob, blob_key_id, created_at)
+        SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4 FROM key_backups WHERE user_id = $1
+        RETURNING version
+        `, userID, s.blobs.seal(blob, blobAADKeyBackups), s.blobs.keyID(), s.clock.Now().UTC(),
+	).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx,
+		"DELETE FROM key_backups WHERE user_id = $1 AND version <= $2",
+		userID, version-backupVersionsKept); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return version, nil
+}
+
+// GetLatestKeyBackup returns the newest backup version for a user.
+func (s *PostgresStore) GetLatestKeyBackup(ctx context.Context, userID int) (*KeyBackup, error) {
+	var b KeyBackup
+	var keyID *string
+	err := s.db.QueryRow(ctx,
+		`
+        SELECT version, blob, blob_key_id, created_at FROM key_backups
+        WHERE user_id = $1
+        ORDER BY version DESC
+        LIMIT 1
+        `, userID,
+	).Scan(&b.Version, &b.Blob, &keyID, &b.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, fmt.Errorf("backup not found")
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if b.Blob, err = s.blobs.open(b.Blob, keyID, blobAADKeyBackups); err != nil {
+		return nil, fmt.Errorf("blob decryption error: %v", err)
+	}
+	return &b, nil
+}
+
+// DeleteKeyBackups removes every backup version for a user and returns how many were deleted.
+func (s *PostgresStore) DeleteKeyBackups(ctx context.Context, userID int) (int64, error) {
+	cmdTag, err := s.db.Exec(ctx, "DELETE FROM key_backups WHERE user_id = $1", userID)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return cmdTag.RowsAffected(), nil
+}
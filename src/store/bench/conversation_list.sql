@@ -0,0 +1,105 @@
+-- Benchmark for GET /conversations: the newest message of each of a user's
+-- conversations, on a skewed dataset. bench_hot has one conversation of
+-- 2,000,000 messages and 200 of 50 each. Run against a scratch database
+-- migrated to at least version 19:
+--
+--     psql "$DATABASE_URL" -f store/bench/conversation_list.sql
+--
+-- Everything runs in one transaction that is rolled back, so nothing is
+-- left behind. Compare the "Execution Time" of each plan; the target is
+-- under 20 ms.
+--
+-- Decision: plan D, conversation_stats.last_message_id, kept by the send
+-- transaction (see store/conversations.go). A and B have to read every one
+-- of the user's messages, so they grow with the hot conversation. C does two
+-- index probes per conversation, so it doesn't, but it still touches
+-- messages once per contact and has to sort all of them to page. D reads
+-- one conversation_stats row per conversation, in index order, and costs
+-- sends nothing extra: the row is already locked and written for the
+-- counters.
+
+\timing on
+BEGIN;
+
+INSERT INTO users (username, password_hash)
+SELECT 'bench_' || g, 'x' FROM generate_series(0, 200) g;
+
+CREATE TEMP TABLE bench_users AS
+SELECT
+    (SELECT id FROM users WHERE username = 'bench_0') AS hot,
+    array_agg(id ORDER BY id) FILTER (WHERE username <> 'bench_0') AS others
+FROM users WHERE username LIKE 'bench\_%';
+
+-- The hot conversation, alternating direction
+INSERT INTO messages (sender_id, recipient_id, sender_blob, recipient_blob, timestamp, conversation_id)
+SELECT
+    CASE WHEN g % 2 = 0 THEN b.hot ELSE b.others[1] END,
+    CASE WHEN g % 2 = 0 THEN b.others[1] ELSE b.hot END,
+    'x', 'x', NOW() - interval '1 second' * (2000000 - g),
+    (LEAST(b.hot, b.others[1])::bigint << 32) | GREATEST(b.hot, b.others[1])
+FROM bench_users b, generate_series(1, 2000000) g;
+
+-- 200 small ones
+INSERT INTO messages (sender_id, recipient_id, sender_blob, recipient_blob, timestamp, conversation_id)
+SELECT b.others[c], b.hot, 'x', 'x', NOW() - interval '1 minute' * (c * 50 + g),
+    (LEAST(b.hot, b.others[c])::bigint << 32) | GREATEST(b.hot, b.others[c])
+FROM bench_users b, generate_series(1, 200) c, generate_series(1, 50) g;
+
+INSERT INTO conversation_stats (user_low, user_high, low_sent, high_sent, last_message_at, last_message_id)
+SELECT LEAST(sender_id, recipient_id), GREATEST(sender_id, recipient_id),
+    COUNT(*) FILTER (WHERE sender_id < recipient_id), COUNT(*) FILTER (WHERE sender_id > recipient_id),
+    MAX(timestamp), MAX(id)
+FROM messages, bench_users b
+WHERE sender_id = b.hot OR recipient_id = b.hot
+GROUP BY 1, 2;
+
+ANALYZE messages;
+ANALYZE conversation_stats;
+SELECT hot FROM bench_users \gset
+
+-- A: GROUP BY / MAX over the user's messages
+EXPLAIN (ANALYZE, BUFFERS)
+SELECT LEAST(sender_id, recipient_id), GREATEST(sender_id, recipient_id), MAX(id)
+FROM messages
+WHERE sender_id = :hot OR recipient_id = :hot
+GROUP BY 1, 2
+ORDER BY 3 DESC LIMIT 50;
+
+-- B: DISTINCT ON (conversation pair) ORDER BY id DESC
+EXPLAIN (ANALYZE, BUFFERS)
+SELECT * FROM (
+    SELECT DISTINCT ON (LEAST(sender_id, recipient_id), GREATEST(sender_id, recipient_id))
+        LEAST(sender_id, recipient_id) AS low, GREATEST(sender_id, recipient_id) AS high, id
+    FROM messages
+    WHERE sender_id = :hot OR recipient_id = :hot
+    ORDER BY LEAST(sender_id, recipient_id), GREATEST(sender_id, recipient_id), id DESC
+) last ORDER BY id DESC LIMIT 50;
+
+-- C: per contact, the newest message each way through the composite indexes
+EXPLAIN (ANALYZE, BUFFERS)
+SELECT other_id, GREATEST(
+    (SELECT m.id FROM messages m WHERE m.sender_id = :hot AND m.recipient_id = other_id ORDER BY m.id DESC LIMIT 1),
+    (SELECT m.id FROM messages m WHERE m.sender_id = other_id AND m.recipient_id = :hot ORDER BY m.id DESC LIMIT 1)
+) AS last_id
+FROM unnest((SELECT others FROM bench_users)) AS other_id
+ORDER BY last_id DESC NULLS LAST LIMIT 50;
+
+-- D: conversation_stats only, as ListConversations does it
+EXPLAIN (ANALYZE, BUFFERS)
+SELECT u.username, c.last_message_id, c.last_message_at, c.sent, c.received
+FROM (
+    (SELECT user_high AS other_id, last_message_id, last_message_at, low_sent AS sent, high_sent AS received
+     FROM conversation_stats
+     WHERE user_low = :hot AND last_message_id < 2147483647
+     ORDER BY last_message_id DESC LIMIT 51)
+    UNION ALL
+    (SELECT user_low, last_message_id, last_message_at, high_sent, low_sent
+     FROM conversation_stats
+     WHERE user_high = :hot AND last_message_id < 2147483647
+     ORDER BY last_message_id DESC LIMIT 51)
+) c
+JOIN users u ON u.id = c.other_id
+ORDER BY c.last_message_id DESC
+LIMIT 51;
+
+ROLLBACK;
@@ -0,0 +1,408 @@
+// src/store/blobkeys.go
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"cryptachat-server/blobcrypt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Blobs at rest (message copies, key backups and TOTP secrets) can be
+// envelope-encrypted (see blobcrypt and migrations/0004). Each row records
+// the data key its blobs are sealed with in blob_key_id, NULL meaning
+// plaintext. Writes use the current data key; reads open whatever key the
+// row names, so enabling encryption or rotating the master key needs no
+// downtime. RekeyMessageBlobs, RekeyBackupBlobs and RekeyTOTPSecrets move
+// old rows over.
+
+// blobKeyLockID serialises data key creation across replicas.
+const blobKeyLockID = 7240002
+
+// Associated data per table, so a sealed blob can't be moved to another table.
+const (
+	blobAADMessages   = "messages"
+	blobAADKeyBackups = "key_backups"
+)
+
+// blobKeyring holds the unwrapped data keys. A nil keyring means blob
+// encryption is off: new blobs are stored in plaintext.
+type blobKeyring struct {
+	current string                       // Key new blobs are sealed with
+	sealers map[string]*blobcrypt.Sealer // By blob_keys.id
+}
+
+// keyID returns the blob_key_id for newly sealed rows.
+func (r *blobKeyring) keyID() *string {
+	if r == nil {
+		return nil
+	}
+	id := r.current
+	return &id
+}
+
+// seal encrypts blob under the current key, or returns it as is when
+// encryption is off.
+func (r *blobKeyring) seal(blob, aad string) string {
+	if r == nil {
+		return blob
+	}
+	return r.sealers[r.current].Seal(blob, aad)
+}
+
+// sealNullable is seal for columns where NULL means the copy was deleted.
+func (r *blobKeyring) sealNullable(blob *string, aad string) *string {
+	if blob == nil {
+		return nil
+	}
+	sealed := r.seal(*blob, aad)
+	return &sealed
+}
+
+// open returns the plaintext of a stored blob sealed under keyID.
+func (r *blobKeyring) open(stored string, keyID *string, aad string) (string, error) {
+	if keyID == nil {
+		return stored, nil
+	}
+	if r == nil {
+		return "", fmt.Errorf("blob is encrypted with key %s but blob encryption is not configured", *keyID)
+	}
+	sealer, ok := r.sealers[*keyID]
+	if !ok {
+		return "", fmt.Errorf("unknown blob key %s", *keyID)
+	}
+	blob, err := sealer.Open(stored, aad)
+	if err != nil {
+		return "", fmt.Errorf("blob key %s: %v", *keyID, err)
+	}
+	return blob, nil
+}
+
+// openNullable is open for columns where NULL means the copy was deleted.
+func (r *blobKeyring) openNullable(stored *string, keyID *string, aad string) (*string, error) {
+	if stored == nil {
+		return nil, nil
+	}
+	blob, err := r.open(*stored, keyID, aad)
+	if err != nil {
+		return nil, err
+	}
+	return &blob, nil
+}
+
+// EnableBlobEncryption loads the data keys and seals new blobs from now on.
+// Keys wrapped by current or any of previous can be read; the newest key
+// wrapped by current is used for writes, and one is created if there is
+// none. Call it before serving requests.
+func (s *PostgresStore) EnableBlobEncryption(ctx context.Context, current blobcrypt.KeyWrapper, previous []blobcrypt.KeyWrapper) error {
+	wrappers := map[string]blobcrypt.KeyWrapper{current.ID(): current}
+	for _, w := range previous {
+		wrappers[w.ID()] = w
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", blobKeyLockID); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	type storedKey struct {
+		id, masterKeyID string
+		wrapped         []byte
+	}
+	rows, err := tx.Query(ctx, "SELECT id, master_key_id, wrapped_key FROM blob_keys ORDER BY created_at, id")
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	keys, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (storedKey, error) {
+		var k storedKey
+		err := row.Scan(&k.id, &k.masterKeyID, &k.wrapped)
+		return k, err
+	})
+	if err != nil {
+		return fmt.Errorf("database scan error: %w", err)
+	}
+
+	ring := &blobKeyring{sealers: make(map[string]*blobcrypt.Sealer, len(keys)+1)}
+	for _, k := range keys {
+		w, ok := wrappers[k.masterKeyID]
+		if !ok {
+			return fmt.Errorf("blob key %s is wrapped by master key %s, which is not configured", k.id, k.masterKeyID)
+		}
+		dataKey, err := w.Unwrap(k.wrapped)
+		if err != nil {
+			return fmt.Errorf("blob key %s: %v", k.id, err)
+		}
+		sealer, err := blobcrypt.NewSealer(dataKey)
+		if err != nil {
+			return fmt.Errorf("blob key %s: %v", k.id, err)
+		}
+		ring.sealers[k.id] = sealer
+		if k.masterKeyID == current.ID() {
+			ring.current = k.id // Newest wins
+		}
+	}
+
+	if ring.current == "" {
+		id, sealer, err := s.createBlobKey(ctx, tx, current)
+		if err != nil {
+			return err
+		}
+		ring.sealers[id] = sealer
+		ring.current = id
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	s.blobs = ring
+	return nil
+}
+
+// createBlobKey stores a new data key wrapped by w.
+func (s *PostgresStore) createBlobKey(ctx context.Context, tx pgx.Tx, w blobcrypt.KeyWrapper) (string, *blobcrypt.Sealer, error) {
+	dataKey, err := blobcrypt.NewDataKey()
+	if err != nil {
+		return "", nil, fmt.Errorf("could not generate blob key: %v", err)
+	}
+	wrapped, err := w.Wrap(dataKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not wrap blob key: %v", err)
+	}
+	sealer, err := blobcrypt.NewSealer(dataKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, fmt.Errorf("could not generate blob key id: %v", err)
+	}
+	id := hex.EncodeToString(idBytes)
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO blob_keys (id, master_key_id, wrapped_key, created_at) VALUES ($1, $2, $3, $4)",
+		id, w.ID(), wrapped, s.clock.Now().UTC())
+	if err != nil {
+		return "", nil, fmt.Errorf("database error: %w", err)
+	}
+	return id, sealer, nil
+}
+
+// CheckBlobsReadable fails if blob encryption is off but some blobs are
+// encrypted, since they couldn't be served.
+func (s *PostgresStore) CheckBlobsReadable(ctx context.Context) error {
+	if s.blobs != nil {
+		return nil
+	}
+	var encrypted bool
+	err := s.db.QueryRow(ctx,
+		`
+        SELECT EXISTS (SELECT 1 FROM messages WHERE blob_key_id IS NOT NULL)
+            OR EXISTS (SELECT 1 FROM key_backups WHERE blob_key_id IS NOT NULL)
+        `,
+	).Scan(&encrypted)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if encrypted {
+		return fmt.Errorf("some blobs are encrypted but no blob master key is configured")
+	}
+	return nil
+}
+
+// BlobEncryptionInfo describes blob encryption for /admin/runtime.
+type BlobEncryptionInfo struct {
+	Enabled      bool   `json:"enabled"`
+	CurrentKeyID string `json:"current_key_id,omitempty"`
+	Keys         int    `json:"keys"` // Data keys loaded, including old ones still in use
+}
+
+// BlobEncryption reports whether blobs are being encrypted and with what.
+func (s *PostgresStore) BlobEncryption() BlobEncryptionInfo {
+	if s.blobs == nil {
+		return BlobEncryptionInfo{}
+	}
+	return BlobEncryptionInfo{Enabled: true, CurrentKeyID: s.blobs.current, Keys: len(s.blobs.sealers)}
+}
+
+// rekeyTarget is the blob_key_id rows are moved to, and the keyring that
+// seals for it (nil for plaintext).
+func (s *PostgresStore) rekeyTarget(toPlaintext bool) (*string, *blobKeyring) {
+	if toPlaintext {
+		return nil, nil
+	}
+	return s.blobs.keyID(), s.blobs
+}
+
+// RekeyMessageBlobs re-seals up to limit messages with an ID above afterID
+// whose blobs aren't under the current key (or, with toPlaintext, aren't
+// plaintext). It returns how many it re-sealed and the ID to continue
+// after; 0 means the table has been covered. Conversation byte counters of
+// the touched messages are recounted, since sealed blobs are larger.
+func (s *PostgresStore) RekeyMessageBlobs(ctx context.Context, afterID, limit int, toPlaintext bool) (int, int, error) {
+	target, ring := s.rekeyTarget(toPlaintext)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`
+        SELECT id, sender_id, recipient_id, sender_blob, recipient_blob, blob_key_id
+        FROM messages
+        WHERE id > $1 AND blob_key_id IS DISTINCT FROM $2
+        ORDER BY id
+        LIMIT $3
+        FOR UPDATE SKIP LOCKED
+        `, afterID, target, limit)
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	type stored struct {
+		id                        int
+		senderID                  *int
+		recipientID               int
+		senderBlob, recipientBlob *string
+		keyID                     *string
+	}
+	found, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (stored, error) {
+		var m stored
+		err := row.Scan(&m.id, &m.senderID, &m.recipientID, &m.senderBlob, &m.recipientBlob, &m.keyID)
+		return m, err
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("database scan error: %w", err)
+	}
+	if len(found) == 0 {
+		return 0, 0, nil
+	}
+
+	ids := make([]int32, len(found))
+	senderBlobs := make([]*string, len(found))
+	recipientBlobs := make([]*string, len(found))
+	pairs := make(map[conversationPair]struct{})
+	for i, m := range found {
+		sb, err := s.blobs.openNullable(m.senderBlob, m.keyID, blobAADMessages)
+		if err != nil {
+			return 0, 0, fmt.Errorf("message %d: %v", m.id, err)
+		}
+		rb, err := s.blobs.openNullable(m.recipientBlob, m.keyID, blobAADMessages)
+		if err != nil {
+			return 0, 0, fmt.Errorf("message %d: %v", m.id, err)
+		}
+		ids[i] = int32(m.id)
+		senderBlobs[i] = ring.sealNullable(sb, blobAADMessages)
+		recipientBlobs[i] = ring.sealNullable(rb, blobAADMessages)
+		if m.senderID != nil { // Sealed-sender messages have no conversation counters
+			pairs[conversationPair{low: min(*m.senderID, m.recipientID), high: max(*m.senderID, m.recipientID)}] = struct{}{}
+		}
+	}
+
+	_, err = tx.Exec(ctx,
+		`
+        UPDATE messages m
+        SET sender_blob = u.sender_blob, recipient_blob = u.recipient_blob, blob_key_id = $4
+        FROM unnest($1::int[], $2::text[], $3::text[]) AS u(id, sender_blob, recipient_blob)
+        WHERE m.id = u.id
+        `, ids, senderBlobs, recipientBlobs, target)
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	if err := recountConversationStats(ctx, tx, pairs); err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+
+	next := found[len(found)-1].id
+	if len(found) < limit {
+		next = 0
+	}
+	return len(found), next, nil
+}
+
+// RekeyBackupBlobs re-seals up to limit key backups whose blobs aren't under
+// the current key (or, with toPlaintext, aren't plaintext). It returns how
+// many it re-sealed; fewer than limit means none are left.
+func (s *PostgresStore) RekeyBackupBlobs(ctx context.Context, limit int, toPlaintext bool) (int, error) {
+	target, ring := s.rekeyTarget(toPlaintext)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`
+        SELECT user_id, version, blob, blob_key_id
+        FROM key_backups
+        WHERE blob_key_id IS DISTINCT FROM $1
+        LIMIT $2
+        FOR UPDATE SKIP LOCKED
+        `, target, limit)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	type stored struct {
+		userID, version int
+		blob            string
+		keyID           *string
+	}
+	found, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (stored, error) {
+		var b stored
+		err := row.Scan(&b.userID, &b.version, &b.blob, &b.keyID)
+		return b, err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("database scan error: %w", err)
+	}
+
+	for _, b := range found {
+		blob, err := s.blobs.open(b.blob, b.keyID, blobAADKeyBackups)
+		if err != nil {
+			return 0, fmt.Errorf("backup %d/%d: %v", b.userID, b.version, err)
+		}
+		_, err = tx.Exec(ctx,
+			"UPDATE key_backups SET blob = $3, blob_key_id = $4 WHERE user_id = $1 AND version = $2",
+			b.userID, b.version, ring.seal(blob, blobAADKeyBackups), target)
+		if err != nil {
+			return 0, fmt.Errorf("database error: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return len(found), nil
+}
+
+// PruneBlobKeys deletes data keys that no row uses any more, other than the
+// current one, so their master keys can be retired. It returns how many
+// were deleted.
+func (s *PostgresStore) PruneBlobKeys(ctx context.Context) (int64, error) {
+	cmdTag, err := s.db.Exec(ctx,
+		`
+        DELETE FROM blob_keys k
+        WHERE k.id IS DISTINCT FROM $1
+          AND NOT EXISTS (SELECT 1 FROM messages WHERE blob_key_id = k.id)
+          AND NOT EXISTS (SELECT 1 FROM key_backups WHERE blob_key_id = k.id)
+          AND NOT EXISTS (SELECT 1 FROM user_totp WHERE blob_key_id = k.id)
+        `, s.blobs.keyID())
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return cmdTag.RowsAffected(), nil
+}
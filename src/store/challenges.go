@@ -0,0 +1,56 @@
+// src/store/challenges.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Registration challenges are the proof-of-work nonces /register_challenge
+// hands out. They live in the store rather than in memory so any replica
+// can redeem one another issued. Each is deleted by the registration that
+// redeems it, so it can't pay for a second account.
+
+// CreateRegistrationChallenge records a challenge of difficulty leading zero
+// bits, redeemable until expiresAt.
+func (s *PostgresStore) CreateRegistrationChallenge(ctx context.Context, nonce string, difficulty int, expiresAt time.Time) error {
+	_, err := s.db.Exec(ctx,
+		`
+        INSERT INTO registration_challenges (nonce, difficulty, created_at, expires_at)
+        VALUES ($1, $2, $3, $4)
+        `, nonce, difficulty, s.clock.Now().UTC(), expiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// ConsumeRegistrationChallenge deletes a live challenge and returns its
+// difficulty. Fails with "challenge not found" if the nonce is unknown,
+// already redeemed or expired.
+func (s *PostgresStore) ConsumeRegistrationChallenge(ctx context.Context, nonce string) (int, error) {
+	var difficulty int
+	err := s.db.QueryRow(ctx,
+		"DELETE FROM registration_challenges WHERE nonce = $1 AND expires_at > $2 RETURNING difficulty",
+		nonce, s.clock.Now().UTC()).Scan(&difficulty)
+	if err == pgx.ErrNoRows {
+		return 0, fmt.Errorf("challenge not found")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return difficulty, nil
+}
+
+// PruneRegistrationChallenges deletes challenges that expired before
+// before. It returns how many were deleted.
+func (s *PostgresStore) PruneRegistrationChallenges(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := s.db.Exec(ctx, "DELETE FROM registration_challenges WHERE expires_at < $1", before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
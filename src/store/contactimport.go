@@ -0,0 +1,274 @@
+// src/store/contactimport.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cryptachat-server/keylog"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Contact import item states. Queued items wait for not_before; processing
+// ones have been claimed by the import worker.
+const (
+	ImportItemQueued     = "queued"
+	ImportItemProcessing = "processing"
+	ImportItemRequested  = "requested" // Chat request sent, waiting on the recipient
+	ImportItemAccepted   = "accepted"  // The recipient had already asked; auto-accepted
+	ImportItemSkipped    = "skipped"   // Already a contact or request, or the user themselves
+	ImportItemFailed     = "failed"    // No such user here, or an error
+)
+
+// importClaimTimeout is how long a claimed item may stay processing before
+// another worker pass retries it.
+const importClaimTimeout = 10 * time.Minute
+
+// ExportedContact is one accepted contact as written to an export document.
+type ExportedContact struct {
+	Username       string
+	KeyFingerprint string // "" if the contact has no public key
+	AcceptedAt     *Timestamp
+}
+
+// ExportContacts lists myID's accepted contacts with their current key
+// fingerprints, ordered by username.
+func (s *PostgresStore) ExportContacts(ctx context.Context, myID int) ([]ExportedContact, error) {
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT u.username, pk.public_key, cr.accepted_at
+        FROM chat_requests cr
+        JOIN users u ON u.id = CASE WHEN cr.requester_id = $1 THEN cr.requested_id ELSE cr.requester_id END
+        LEFT JOIN public_keys pk ON pk.user_id = u.id
+        WHERE cr.status = 'accepted' AND (cr.requester_id = $1 OR cr.requested_id = $1)
+        ORDER BY u.username
+        `, myID)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	contacts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ExportedContact, error) {
+		var c ExportedContact
+		var publicKey *string
+		err := row.Scan(&c.Username, &publicKey, &c.AcceptedAt)
+		if publicKey != nil {
+			c.KeyFingerprint = keylog.KeyHash(*publicKey)
+		}
+		return c, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return contacts, nil
+}
+
+// ContactImport is one import and its progress.
+type ContactImport struct {
+	ID             int                 `json:"id"`
+	SourceIssuer   string              `json:"source_issuer"`
+	SourceUsername string              `json:"source_username"`
+	SignerKey      string              `json:"signer_key"`
+	CreatedAt      Timestamp           `json:"created_at"`
+	FinishedAt     *Timestamp          `json:"finished_at"`
+	Counts         map[string]int      `json:"counts"` // Items per status
+	Items          []ContactImportItem `json:"items"`
+}
+
+// ContactImportItem is one contact being imported.
+type ContactImportItem struct {
+	ID             int        `json:"id"`
+	ImportID       int        `json:"-"`
+	UserID         int        `json:"-"` // The importing user
+	Username       string     `json:"username"`
+	KeyFingerprint string     `json:"key_fingerprint"`
+	NotBefore      Timestamp  `json:"not_before"`
+	Status         string     `json:"status"`
+	Detail         string     `json:"detail,omitempty"`
+	KeyMatches     *bool      `json:"key_matches"`
+	ProcessedAt    *Timestamp `json:"processed_at"`
+}
+
+// NewContactImport describes an import to create.
+type NewContactImport struct {
+	SourceIssuer   string
+	SourceUsername string
+	SignerKey      string
+	Usernames      []string
+	Fingerprints   []string // Parallel to Usernames
+}
+
+// CreateContactImport queues an import for userID, one item every interval
+// starting now. A user may only have one unfinished import.
+func (s *PostgresStore) CreateContactImport(ctx context.Context, userID int, imp NewContactImport, interval time.Duration) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialize concurrent imports by the same user on their users row
+	if _, err := tx.Exec(ctx, "SELECT 1 FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	var running bool
+	err = tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM contact_imports WHERE user_id = $1 AND finished_at IS NULL)", userID,
+	).Scan(&running)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if running {
+		return 0, fmt.Errorf("import already running")
+	}
+
+	now := s.clock.Now().UTC()
+	var finishedAt *time.Time // An empty import is finished on arrival
+	if len(imp.Usernames) == 0 {
+		finishedAt = &now
+	}
+	var importID int
+	err = tx.QueryRow(ctx,
+		`
+        INSERT INTO contact_imports (user_id, source_issuer, source_username, signer_key, created_at, finished_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id
+        `, userID, imp.SourceIssuer, imp.SourceUsername, imp.SignerKey, now, finishedAt,
+	).Scan(&importID)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		`
+        INSERT INTO contact_import_items (import_id, username, key_fingerprint, not_before)
+        SELECT $1, e.username, e.fingerprint, $4::timestamptz + (e.ord - 1) * $5::interval
+        FROM unnest($2::text[], $3::text[]) WITH ORDINALITY AS e(username, fingerprint, ord)
+        `, importID, imp.Usernames, imp.Fingerprints, now, interval)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return importID, nil
+}
+
+// ClaimContactImportItems marks up to limit due items as processing and
+// returns them. Items claimed longer than importClaimTimeout ago are
+// reclaimed, so a crashed worker doesn't strand them.
+func (s *PostgresStore) ClaimContactImportItems(ctx context.Context, limit int) ([]ContactImportItem, error) {
+	now := s.clock.Now().UTC()
+	rows, err := s.db.Query(ctx,
+		`
+        UPDATE contact_import_items i SET status = 'processing', claimed_at = $1
+        FROM contact_imports ci
+        WHERE ci.id = i.import_id AND i.id IN (
+            SELECT id FROM contact_import_items
+            WHERE (status = 'queued' AND not_before <= $1)
+               OR (status = 'processing' AND claimed_at < $2)
+            ORDER BY not_before, id
+            LIMIT $3
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING i.id, i.import_id, ci.user_id, i.username, i.key_fingerprint, i.not_before, i.status
+        `, now, now.Add(-importClaimTimeout), limit)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	items, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ContactImportItem, error) {
+		var it ContactImportItem
+		err := row.Scan(&it.ID, &it.ImportID, &it.UserID, &it.Username, &it.KeyFingerprint, &it.NotBefore, &it.Status)
+		return it, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return items, nil
+}
+
+// FinishContactImportItem records the outcome of a claimed item, and
+// finishes its import once no items are left queued or processing.
+func (s *PostgresStore) FinishContactImportItem(ctx context.Context, itemID int, status, detail string, keyMatches *bool) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := s.clock.Now().UTC()
+	var importID int
+	err = tx.QueryRow(ctx,
+		`
+        UPDATE contact_import_items
+        SET status = $2, detail = NULLIF($3, ''), key_matches = $4, processed_at = $5
+        WHERE id = $1
+        RETURNING import_id
+        `, itemID, status, detail, keyMatches, now,
+	).Scan(&importID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("import item not found")
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		`
+        UPDATE contact_imports SET finished_at = $2
+        WHERE id = $1 AND finished_at IS NULL AND NOT EXISTS (
+            SELECT 1 FROM contact_import_items
+            WHERE import_id = $1 AND status IN ('queued', 'processing')
+        )
+        `, importID, now)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// GetContactImport returns one of userID's imports with its items.
+func (s *PostgresStore) GetContactImport(ctx context.Context, userID, importID int) (*ContactImport, error) {
+	imp := &ContactImport{Counts: map[string]int{}}
+	err := s.db.QueryRow(ctx,
+		`
+        SELECT id, source_issuer, source_username, signer_key, created_at, finished_at
+        FROM contact_imports
+        WHERE id = $1 AND user_id = $2
+        `, importID, userID,
+	).Scan(&imp.ID, &imp.SourceIssuer, &imp.SourceUsername, &imp.SignerKey, &imp.CreatedAt, &imp.FinishedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, fmt.Errorf("import not found")
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT id, username, key_fingerprint, not_before, status, COALESCE(detail, ''), key_matches, processed_at
+        FROM contact_import_items
+        WHERE import_id = $1
+        ORDER BY id
+        `, importID)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	imp.Items, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (ContactImportItem, error) {
+		var it ContactImportItem
+		err := row.Scan(&it.ID, &it.Username, &it.KeyFingerprint, &it.NotBefore, &it.Status, &it.Detail, &it.KeyMatches, &it.ProcessedAt)
+		return it, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	for _, it := range imp.Items {
+		imp.Counts[it.Status]++
+	}
+	return imp, nil
+}
@@ -0,0 +1,240 @@
+// src/store/conversations.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// conversation_stats keeps running counters per pair of users (see
+// migrations/0002). SendMessage bumps them in its transaction; pruning
+// recomputes the pairs it touched, so they never drift from the messages
+// table. Rows go away with either user.
+//
+// last_message_id is the newest message still stored in the conversation.
+// It lets ListConversations answer without reading messages at all, so a
+// user with one conversation of millions of messages lists as fast as
+// anyone; store/bench/conversation_list.sql compares it with the plans that
+// read messages.
+
+// ConversationParty is one side of a conversation.
+type ConversationParty struct {
+	ID        int    `json:"id"`
+	Username  string `json:"username"`
+	Sent      int64  `json:"sent"`
+	BlobBytes int64  `json:"blob_bytes"` // Stored on behalf of this user
+}
+
+// ConversationStats are the counters for one conversation.
+type ConversationStats struct {
+	Users          [2]ConversationParty `json:"users"`
+	MessageCount   int64                `json:"message_count"`
+	TotalBlobBytes int64                `json:"total_blob_bytes"`
+	LastMessageAt  *Timestamp           `json:"last_message_at"`
+}
+
+// Orders for ListConversationStats.
+const (
+	ConversationSortMessages = "messages"
+	ConversationSortBytes    = "bytes"
+	ConversationSortRecent   = "recent"
+)
+
+var conversationOrders = map[string]string{
+	ConversationSortMessages: "cs.low_sent + cs.high_sent DESC",
+	ConversationSortBytes:    "cs.low_bytes + cs.high_bytes DESC",
+	ConversationSortRecent:   "cs.last_message_at DESC NULLS LAST",
+}
+
+// ValidConversationSort reports whether sort is one of the ConversationSort constants.
+func ValidConversationSort(sort string) bool {
+	_, ok := conversationOrders[sort]
+	return ok
+}
+
+// ListConversationStats returns conversations largest (or most recent)
+// first, skipping offset of them.
+func (s *PostgresStore) ListConversationStats(ctx context.Context, sort string, limit, offset int) ([]ConversationStats, error) {
+	order, ok := conversationOrders[sort]
+	if !ok {
+		return nil, fmt.Errorf("unknown conversation sort %q", sort)
+	}
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT cs.user_low, lo.username, cs.low_sent, cs.low_bytes,
+               cs.user_high, hi.username, cs.high_sent, cs.high_bytes,
+               cs.last_message_at
+        FROM conversation_stats cs
+        JOIN users lo ON lo.id = cs.user_low
+        JOIN users hi ON hi.id = cs.user_high
+        ORDER BY `+order+`, cs.user_low, cs.user_high
+        LIMIT $1 OFFSET $2
+        `, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	stats, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ConversationStats, error) {
+		var c ConversationStats
+		lo, hi := &c.Users[0], &c.Users[1]
+		err := row.Scan(&lo.ID, &lo.Username, &lo.Sent, &lo.BlobBytes,
+			&hi.ID, &hi.Username, &hi.Sent, &hi.BlobBytes,
+			&c.LastMessageAt)
+		c.MessageCount = lo.Sent + hi.Sent
+		c.TotalBlobBytes = lo.BlobBytes + hi.BlobBytes
+		return c, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return stats, nil
+}
+
+// Conversation is one of a user's conversations, as seen by them.
+type Conversation struct {
+	Username      string     `json:"username"` // The other participant
+	LastMessageID int        `json:"last_message_id"`
+	LastMessageAt *Timestamp `json:"last_message_at"`
+	Sent          int64      `json:"sent"`     // Stored messages from the user
+	Received      int64      `json:"received"` // Stored messages to the user
+}
+
+// ListConversations returns userID's conversations with a stored message,
+// most recent first, starting below last message ID beforeID (0 for the
+// start). It reads conversation_stats only: each side of the union walks
+// one of its recency indexes.
+func (s *PostgresStore) ListConversations(ctx context.Context, userID, beforeID, limit int) ([]Conversation, error) {
+	if beforeID <= 0 {
+		beforeID = math.MaxInt32
+	}
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT u.username, c.last_message_id, c.last_message_at, c.sent, c.received
+        FROM (
+            (SELECT user_high AS other_id, last_message_id, last_message_at, low_sent AS sent, high_sent AS received
+             FROM conversation_stats
+             WHERE user_low = $1 AND last_message_id < $2
+             ORDER BY last_message_id DESC LIMIT $3)
+            UNION ALL
+            (SELECT user_low, last_message_id, last_message_at, high_sent, low_sent
+             FROM conversation_stats
+             WHERE user_high = $1 AND last_message_id < $2
+             ORDER BY last_message_id DESC LIMIT $3)
+        ) c
+        JOIN users u ON u.id = c.other_id
+        ORDER BY c.last_message_id DESC
+        LIMIT $3
+        `, userID, beforeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	conversations, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Conversation, error) {
+		var c Conversation
+		err := row.Scan(&c.Username, &c.LastMessageID, &c.LastMessageAt, &c.Sent, &c.Received)
+		return c, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return conversations, nil
+}
+
+// bumpConversationStats counts one new message in its conversation and
+// returns the message's sequence number. It locks the conversation's row
+// until tx ends, so it must run before the message is inserted: sends in one
+// conversation then get their IDs, and commit, one after the other.
+func bumpConversationStats(ctx context.Context, tx pgx.Tx, senderID, recipientID int, senderBlob, recipientBlob string, at time.Time) (int64, error) {
+	low, high := senderID, recipientID
+	lowSent, highSent := 1, 0
+	lowBytes, highBytes := len(senderBlob), len(recipientBlob)
+	if senderID > recipientID {
+		low, high = recipientID, senderID
+		lowSent, highSent = 0, 1
+		lowBytes, highBytes = len(recipientBlob), len(senderBlob)
+	}
+
+	var seq int64
+	err := tx.QueryRow(ctx,
+		`
+        INSERT INTO conversation_stats (user_low, user_high, low_sent, high_sent, low_bytes, high_bytes, last_message_at, last_seq)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, 1)
+        ON CONFLICT (user_low, user_high) DO UPDATE SET
+            low_sent = conversation_stats.low_sent + EXCLUDED.low_sent,
+            high_sent = conversation_stats.high_sent + EXCLUDED.high_sent,
+            low_bytes = conversation_stats.low_bytes + EXCLUDED.low_bytes,
+            high_bytes = conversation_stats.high_bytes + EXCLUDED.high_bytes,
+            last_message_at = GREATEST(conversation_stats.last_message_at, EXCLUDED.last_message_at),
+            last_seq = conversation_stats.last_seq + 1
+        RETURNING last_seq
+        `, low, high, lowSent, highSent, lowBytes, highBytes, at).Scan(&seq)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return seq, nil
+}
+
+// setConversationLastMessage records messageID as its conversation's
+// newest message. bumpConversationStats has already locked the row.
+func setConversationLastMessage(ctx context.Context, tx pgx.Tx, senderID, recipientID, messageID int) error {
+	_, err := tx.Exec(ctx,
+		"UPDATE conversation_stats SET last_message_id = $3 WHERE user_low = $1 AND user_high = $2",
+		min(senderID, recipientID), max(senderID, recipientID), messageID)
+	if err != nil {
+		return fmt.Errorf("database error (conversation stats): %w", err)
+	}
+	return nil
+}
+
+// conversationPair is a conversation as (smaller user ID, larger user ID).
+type conversationPair struct {
+	low, high int
+}
+
+// recountConversationStats recomputes the counters of the given
+// conversations from the messages table. last_message_at never moves
+// backwards: it records activity, not what is still stored. last_message_id
+// does, and is NULL once nothing is.
+func recountConversationStats(ctx context.Context, tx pgx.Tx, pairs map[conversationPair]struct{}) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	lows := make([]int32, 0, len(pairs))
+	highs := make([]int32, 0, len(pairs))
+	for p := range pairs {
+		lows = append(lows, int32(p.low))
+		highs = append(highs, int32(p.high))
+	}
+
+	_, err := tx.Exec(ctx,
+		`
+        INSERT INTO conversation_stats (user_low, user_high, low_sent, high_sent, low_bytes, high_bytes, last_message_at, last_message_id)
+        SELECT p.low, p.high, agg.low_sent, agg.high_sent, agg.low_bytes, agg.high_bytes, agg.last_message_at, agg.last_message_id
+        FROM unnest($1::int[], $2::int[]) AS p(low, high)
+        CROSS JOIN LATERAL (
+            SELECT
+                COUNT(*) FILTER (WHERE m.sender_id = p.low) AS low_sent,
+                COUNT(*) FILTER (WHERE m.sender_id = p.high) AS high_sent,
+                COALESCE(SUM(CASE WHEN m.sender_id = p.low THEN octet_length(m.sender_blob) ELSE octet_length(m.recipient_blob) END), 0) AS low_bytes,
+                COALESCE(SUM(CASE WHEN m.sender_id = p.high THEN octet_length(m.sender_blob) ELSE octet_length(m.recipient_blob) END), 0) AS high_bytes,
+                MAX(m.timestamp) AS last_message_at,
+                MAX(m.id) AS last_message_id
+            FROM messages m
+            WHERE (m.sender_id = p.low AND m.recipient_id = p.high)
+               OR (m.sender_id = p.high AND m.recipient_id = p.low)
+        ) agg
+        ON CONFLICT (user_low, user_high) DO UPDATE SET
+            low_sent = EXCLUDED.low_sent,
+            high_sent = EXCLUDED.high_sent,
+            low_bytes = EXCLUDED.low_bytes,
+            high_bytes = EXCLUDED.high_bytes,
+            last_message_at = GREATEST(conversation_stats.last_message_at, EXCLUDED.last_message_at),
+            last_message_id = EXCLUDED.last_message_id
+        `, lows, highs)
+	if err != nil {
+		return fmt.Errorf("database error (conversation stats): %w", err)
+	}
+	return nil
+}
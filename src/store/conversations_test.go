@@ -0,0 +1,135 @@
+// src/store/conversations_test.go
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cryptachat-server/testutil"
+)
+
+// countedFromMessages computes a conversation's counters by scanning
+// messages, as the counters are meant to spare operators from doing.
+func countedFromMessages(t *testing.T, s *PostgresStore, low, high int) (lowSent, highSent, lowBytes, highBytes int64) {
+	t.Helper()
+	err := s.db.QueryRow(context.Background(),
+		`
+        SELECT COUNT(*) FILTER (WHERE sender_id = $1),
+               COUNT(*) FILTER (WHERE sender_id = $2),
+               COALESCE(SUM(CASE WHEN sender_id = $1 THEN octet_length(sender_blob) ELSE octet_length(recipient_blob) END), 0),
+               COALESCE(SUM(CASE WHEN sender_id = $2 THEN octet_length(sender_blob) ELSE octet_length(recipient_blob) END), 0)
+        FROM messages
+        WHERE (sender_id = $1 AND recipient_id = $2) OR (sender_id = $2 AND recipient_id = $1)
+        `, low, high,
+	).Scan(&lowSent, &highSent, &lowBytes, &highBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lowSent, highSent, lowBytes, highBytes
+}
+
+// TestConversationStatsFollowSendsAndDeletes sends, prunes and deletes
+// accounts, and after each step compares every conversation's counters
+// with a count of the messages table.
+func TestConversationStatsFollowSendsAndDeletes(t *testing.T) {
+	s := newTestStore(t)
+	clk := testutil.NewFakeClock(time.Now().UTC().Truncate(time.Second))
+	s.SetClock(clk)
+	ctx := context.Background()
+
+	alice := mustRegister(t, s, "alice")
+	bob := mustRegister(t, s, "bob")
+	carol := mustRegister(t, s, "carol")
+	week := 7
+	if err := s.SetRetentionDays(ctx, alice, &week); err != nil {
+		t.Fatal(err)
+	}
+	send := func(from int, to, senderBlob, recipientBlob string) {
+		t.Helper()
+		if _, _, err := s.SendMessage(ctx, from, to, senderBlob, recipientBlob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := func() map[[2]int]ConversationStats {
+		t.Helper()
+		list, err := s.ListConversationStats(ctx, ConversationSortMessages, 100, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byPair := make(map[[2]int]ConversationStats, len(list))
+		for _, c := range list {
+			byPair[[2]int{c.Users[0].ID, c.Users[1].ID}] = c
+		}
+		return byPair
+	}
+	check := func(after string) {
+		t.Helper()
+		for pair, c := range stats() {
+			lowSent, highSent, lowBytes, highBytes := countedFromMessages(t, s, pair[0], pair[1])
+			lo, hi := c.Users[0], c.Users[1]
+			if lo.Sent != lowSent || hi.Sent != highSent || lo.BlobBytes != lowBytes || hi.BlobBytes != highBytes {
+				t.Errorf("after %s, %s and %s: counted sent %d/%d, bytes %d/%d; the messages hold %d/%d, %d/%d",
+					after, lo.Username, hi.Username, lo.Sent, hi.Sent, lo.BlobBytes, hi.BlobBytes,
+					lowSent, highSent, lowBytes, highBytes)
+			}
+			if c.MessageCount != lo.Sent+hi.Sent || c.TotalBlobBytes != lo.BlobBytes+hi.BlobBytes {
+				t.Errorf("after %s, %s and %s: totals %d, %d don't add up", after, lo.Username, hi.Username, c.MessageCount, c.TotalBlobBytes)
+			}
+		}
+	}
+
+	send(alice, "bob", "aaaa", "bbbbbbbb")
+	clk.Advance(time.Hour)
+	send(bob, "alice", "bb", "aaaaaa")
+	send(bob, "alice", "bb", "aaaaaa")
+	send(alice, "carol", "a", "cc")
+	check("sending")
+
+	ab := stats()[[2]int{alice, bob}]
+	if ab.MessageCount != 3 || ab.TotalBlobBytes != 4+8+2*(2+6) {
+		t.Errorf("alice and bob: %d messages, %d bytes; want 3 and 28", ab.MessageCount, ab.TotalBlobBytes)
+	}
+	if ab.Users[0].Sent != 1 || ab.Users[0].BlobBytes != 4+6+6 {
+		t.Errorf("alice's side: %+v, want 1 sent and 16 bytes", ab.Users[0])
+	}
+	if ab.LastMessageAt == nil || !ab.LastMessageAt.Time.Equal(clk.Now()) {
+		t.Errorf("last message at %v, want %v", ab.LastMessageAt, clk.Now())
+	}
+
+	// Sorted by bytes, alice and bob come first; paging skips them
+	page, err := s.ListConversationStats(ctx, ConversationSortBytes, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Users[1].ID != carol {
+		t.Errorf("second page by bytes: %+v, want alice and carol", page)
+	}
+
+	// alice's copies go after a week; nothing else does
+	clk.Advance(8 * 24 * time.Hour)
+	if _, err := s.PruneExpiredMessages(ctx, 30); err != nil {
+		t.Fatal(err)
+	}
+	check("pruning alice's copies")
+	if got := stats()[[2]int{alice, bob}]; got.LastMessageAt == nil || !got.LastMessageAt.Time.Equal(ab.LastMessageAt.Time) {
+		t.Errorf("pruning moved last_message_at to %v", got.LastMessageAt)
+	}
+
+	// And everything goes after the server default
+	clk.Advance(30 * 24 * time.Hour)
+	if _, err := s.PruneExpiredMessages(ctx, 30); err != nil {
+		t.Fatal(err)
+	}
+	check("pruning everything")
+	send(bob, "alice", "bb", "aaaaaa")
+	check("sending after pruning")
+
+	if _, err := s.DeleteUser(ctx, carol); err != nil {
+		t.Fatal(err)
+	}
+	check("deleting carol")
+	if _, ok := stats()[[2]int{alice, carol}]; ok {
+		t.Error("a deleted user's conversation is still counted")
+	}
+}
@@ -0,0 +1,209 @@
+// src/store/delivery_log.go
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Delivery log stages.
+const (
+	StageOutbox     = "outbox"
+	StageWSPush     = "ws_push"
+	StageFederation = "federation" // Relay to the recipient's instance
+)
+
+// DeliveryLogEntry records one step of a message's delivery.
+type DeliveryLogEntry struct {
+	MessageID int                    `json:"message_id"`
+	UserID    int                    `json:"user_id,omitempty"` // 0 when the step isn't per-recipient
+	Stage     string                 `json:"stage"`
+	Outcome   string                 `json:"outcome"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	CreatedAt Timestamp              `json:"created_at"`
+}
+
+// InsertDeliveryLog writes a batch of entries in one COPY.
+func (s *PostgresStore) InsertDeliveryLog(ctx context.Context, entries []DeliveryLogEntry) error {
+	rows := make([][]interface{}, 0, len(entries))
+	for _, e := range entries {
+		details := e.Details
+		if details == nil {
+			details = map[string]interface{}{}
+		}
+		data, err := json.Marshal(details)
+		if err != nil {
+			return fmt.Errorf("could not encode delivery log details: %v", err)
+		}
+		var userID *int
+		if e.UserID != 0 {
+			userID = &e.UserID
+		}
+		rows = append(rows, []interface{}{e.MessageID, userID, e.Stage, e.Outcome, data, e.CreatedAt.UTC()})
+	}
+
+	_, err := s.db.CopyFrom(ctx,
+		pgx.Identifier{"message_delivery_log"},
+		[]string{"message_id", "user_id", "stage", "outcome", "details", "created_at"},
+		pgx.CopyFromRows(rows),
+	)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// GetDeliveryLog returns a message's log entries in the order they were written.
+func (s *PostgresStore) GetDeliveryLog(ctx context.Context, messageID int) ([]DeliveryLogEntry, error) {
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT message_id, COALESCE(user_id, 0), stage, outcome, details, created_at
+        FROM message_delivery_log
+        WHERE message_id = $1
+        ORDER BY id
+        `, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DeliveryLogEntry, error) {
+		var e DeliveryLogEntry
+		err := row.Scan(&e.MessageID, &e.UserID, &e.Stage, &e.Outcome, &e.Details, &e.CreatedAt)
+		return e, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return entries, nil
+}
+
+// PruneDeliveryLog deletes entries older than the cutoff.
+func (s *PostgresStore) PruneDeliveryLog(ctx context.Context, olderThan time.Time) (int64, error) {
+	cmdTag, err := s.db.Exec(ctx,
+		"DELETE FROM message_delivery_log WHERE created_at < $1", olderThan)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return cmdTag.RowsAffected(), nil
+}
+
+// MessageTrace is the stored state of one message, without any blob contents.
+type MessageTrace struct {
+	MessageID           int        `json:"message_id"`
+	SenderID            int        `json:"sender_id"` // Zero for sealed-sender messages
+	Sealed              bool       `json:"sealed"`
+	RecipientID         int        `json:"recipient_id"`
+	InsertedAt          Timestamp  `json:"inserted_at"`
+	DeliveredAt         *Timestamp `json:"delivered_at"` // Reported by the recipient's client
+	DeliveredVia        *string    `json:"delivered_via"`
+	SenderCopyPruned    bool       `json:"sender_copy_pruned"`
+	RecipientCopyPruned bool       `json:"recipient_copy_pruned"`
+	SenderLegalHold     bool       `json:"sender_legal_hold"`
+	RecipientLegalHold  bool       `json:"recipient_legal_hold"`
+	OutboxEventID       *int64     `json:"outbox_event_id"`
+	OutboxCreatedAt     *Timestamp `json:"outbox_created_at"`
+	OutboxProcessedAt   *Timestamp `json:"outbox_processed_at"`
+}
+
+// GetMessageTrace loads a message's row and its outbox event, if the event
+// has not been pruned yet.
+func (s *PostgresStore) GetMessageTrace(ctx context.Context, messageID int) (*MessageTrace, error) {
+	var t MessageTrace
+	err := s.db.QueryRow(ctx,
+		`
+        SELECT m.id, COALESCE(m.sender_id, 0), m.sender_id IS NULL, m.recipient_id, m.timestamp,
+               m.delivered_at, m.delivered_via,
+               m.sender_blob IS NULL, m.recipient_blob IS NULL,
+               COALESCE(us.legal_hold, FALSE), ur.legal_hold,
+               o.id, o.created_at, o.processed_at
+        FROM messages m
+        LEFT JOIN users us ON us.id = m.sender_id
+        JOIN users ur ON ur.id = m.recipient_id
+        LEFT JOIN outbox o
+               ON o.event_type = $2 AND (o.payload->>'message_id')::int = m.id
+        WHERE m.id = $1
+        `, messageID, EventMessageCreated,
+	).Scan(&t.MessageID, &t.SenderID, &t.Sealed, &t.RecipientID, &t.InsertedAt, &t.DeliveredAt, &t.DeliveredVia,
+		&t.SenderCopyPruned, &t.RecipientCopyPruned,
+		&t.SenderLegalHold, &t.RecipientLegalHold,
+		&t.OutboxEventID, &t.OutboxCreatedAt, &t.OutboxProcessedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, fmt.Errorf("message not found")
+		}
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return &t, nil
+}
+
+// Receipt is a delivery receipt accepted for a message.
+type Receipt struct {
+	MessageID int
+	SentAt    time.Time // The message's insert time
+	At        time.Time // When the receipt arrived
+	// First is false if the message already had a receipt, which is kept.
+	First bool
+}
+
+// MarkMessagesDelivered sets delivered_at (and delivered_via, if via is not
+// empty) on those of messageIDs addressed to recipientID, keeping any earlier
+// receipt, and returns a receipt for each that matched.
+func (s *PostgresStore) MarkMessagesDelivered(ctx context.Context, recipientID int, messageIDs []int, via string) ([]Receipt, error) {
+	now := s.clock.Now().UTC()
+	rows, err := s.db.Query(ctx,
+		`
+        WITH target AS (
+            SELECT id, timestamp, delivered_at IS NULL AS first FROM messages
+            WHERE recipient_id = $1 AND id = ANY($2)
+            FOR UPDATE
+        )
+        UPDATE messages AS m
+        SET delivered_at = COALESCE(m.delivered_at, $3),
+            delivered_via = CASE WHEN m.delivered_at IS NULL THEN NULLIF($4, '') ELSE m.delivered_via END
+        FROM target
+        WHERE m.id = target.id
+        RETURNING m.id, target.timestamp, target.first
+        `, recipientID, messageIDs, now, via)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	receipts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Receipt, error) {
+		r := Receipt{At: now}
+		err := row.Scan(&r.MessageID, &r.SentAt, &r.First)
+		return r, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return receipts, nil
+}
+
+// MessageStatus is what either participant may see about a message's delivery.
+type MessageStatus struct {
+	MessageID    int        `json:"message_id"`
+	SentAt       Timestamp  `json:"sent_at"`
+	DeliveredAt  *Timestamp `json:"delivered_at"`
+	DeliveredVia *string    `json:"delivered_via"`
+}
+
+// GetMessageStatus returns the delivery status of a message userID sent or
+// received.
+func (s *PostgresStore) GetMessageStatus(ctx context.Context, userID, messageID int) (*MessageStatus, error) {
+	var st MessageStatus
+	err := s.db.QueryRow(ctx,
+		`
+        SELECT id, timestamp, delivered_at, delivered_via FROM messages
+        WHERE id = $1 AND (sender_id = $2 OR recipient_id = $2)
+        `, messageID, userID,
+	).Scan(&st.MessageID, &st.SentAt, &st.DeliveredAt, &st.DeliveredVia)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, fmt.Errorf("message not found")
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return &st, nil
+}
@@ -0,0 +1,243 @@
+// src/store/email.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// A user may give a recovery email, which must be verified with a token
+// mailed to it before a password reset can be sent there. Each user has at
+// most one live token per purpose: making a new one deletes the old. The
+// service hashes tokens before they get here.
+
+// Email token purposes.
+const (
+	EmailTokenVerify = "verify"
+	EmailTokenReset  = "reset"
+)
+
+// RecoveryEmail is a user's recovery email.
+type RecoveryEmail struct {
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
+}
+
+// GetRecoveryEmail returns userID's recovery email, or nil if they have
+// none.
+func (s *PostgresStore) GetRecoveryEmail(ctx context.Context, userID int) (*RecoveryEmail, error) {
+	var e RecoveryEmail
+	err := s.db.QueryRow(ctx,
+		"SELECT email, verified_at IS NOT NULL FROM recovery_emails WHERE user_id = $1",
+		userID).Scan(&e.Email, &e.Verified)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return &e, nil
+}
+
+// SetRecoveryEmail sets userID's recovery email to email, unverified, with
+// a verification token valid until expiresAt. Any earlier verification
+// token stops working.
+func (s *PostgresStore) SetRecoveryEmail(ctx context.Context, userID int, email string, tokenHash []byte, expiresAt time.Time) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := s.clock.Now().UTC()
+	_, err = tx.Exec(ctx,
+		`
+        INSERT INTO recovery_emails (user_id, email, verified_at, updated_at) VALUES ($1, $2, NULL, $3)
+        ON CONFLICT (user_id) DO UPDATE SET email = EXCLUDED.email, verified_at = NULL, updated_at = EXCLUDED.updated_at
+        `, userID, email, now)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if err := insertEmailToken(ctx, tx, userID, EmailTokenVerify, email, tokenHash, now, expiresAt); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// DeleteRecoveryEmail removes userID's recovery email and any token mailed
+// to it.
+func (s *PostgresStore) DeleteRecoveryEmail(ctx context.Context, userID int) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM recovery_emails WHERE user_id = $1", userID); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM email_tokens WHERE user_id = $1", userID); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// VerifyRecoveryEmail redeems a verification token, marking the address it
+// was sent to verified, and returns its user. Fails with "email token not
+// found" if the token is unknown, used, expired, or for an address the user
+// has since replaced, and with "email already verified" if another account
+// has verified the same address.
+func (s *PostgresStore) VerifyRecoveryEmail(ctx context.Context, tokenHash []byte) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := s.clock.Now().UTC()
+	userID, email, err := useEmailToken(ctx, tx, EmailTokenVerify, tokenHash, now)
+	if err != nil {
+		return 0, err
+	}
+	tag, err := tx.Exec(ctx,
+		"UPDATE recovery_emails SET verified_at = $3, updated_at = $3 WHERE user_id = $1 AND email = $2",
+		userID, email, now)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, fmt.Errorf("email already verified")
+		}
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return 0, fmt.Errorf("email token not found")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return userID, nil
+}
+
+// CreatePasswordReset stores a password reset token valid until expiresAt
+// for the account whose verified recovery email is email, compared without
+// case. Any earlier reset token for it stops working. Returns the account's
+// username and stored address. Fails with "email not found" if no account
+// has verified it.
+func (s *PostgresStore) CreatePasswordReset(ctx context.Context, email string, tokenHash []byte, expiresAt time.Time) (string, string, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID int
+	var username, stored string
+	err = tx.QueryRow(ctx,
+		`
+        SELECT e.user_id, u.username, e.email
+        FROM recovery_emails e JOIN users u ON u.id = e.user_id
+        WHERE lower(e.email) = lower($1) AND e.verified_at IS NOT NULL
+        `, email).Scan(&userID, &username, &stored)
+	if err == pgx.ErrNoRows {
+		return "", "", fmt.Errorf("email not found")
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("database error: %w", err)
+	}
+	if err := insertEmailToken(ctx, tx, userID, EmailTokenReset, stored, tokenHash, s.clock.Now().UTC(), expiresAt); err != nil {
+		return "", "", err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", "", fmt.Errorf("database error: %w", err)
+	}
+	return username, stored, nil
+}
+
+// GetPasswordReset returns the user a live reset token is for, without
+// using it up. Fails with "email token not found" if there is none.
+func (s *PostgresStore) GetPasswordReset(ctx context.Context, tokenHash []byte) (*User, error) {
+	var user User
+	err := s.db.QueryRow(ctx,
+		`
+        SELECT u.id, u.username FROM email_tokens t JOIN users u ON u.id = t.user_id
+        WHERE t.token_hash = $1 AND t.purpose = $2 AND t.used_at IS NULL AND t.expires_at > $3
+        `, tokenHash, EmailTokenReset, s.clock.Now().UTC()).Scan(&user.ID, &user.Username)
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("email token not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return &user, nil
+}
+
+// ResetPassword redeems a reset token and, in the same transaction,
+// replaces its user's password hash and signs them out everywhere, as
+// UpdatePasswordHash does. Returns the user. Fails with "email token not
+// found" if the token is unknown, used or expired.
+func (s *PostgresStore) ResetPassword(ctx context.Context, tokenHash []byte, passwordHash string) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := s.clock.Now().UTC()
+	userID, _, err := useEmailToken(ctx, tx, EmailTokenReset, tokenHash, now)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := replacePasswordHash(ctx, tx, userID, passwordHash, now); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	s.forgetUser(userID)
+	return userID, nil
+}
+
+// insertEmailToken replaces userID's token for purpose.
+func insertEmailToken(ctx context.Context, tx pgx.Tx, userID int, purpose, email string, tokenHash []byte, now, expiresAt time.Time) error {
+	if _, err := tx.Exec(ctx, "DELETE FROM email_tokens WHERE user_id = $1 AND purpose = $2", userID, purpose); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	_, err := tx.Exec(ctx,
+		`
+        INSERT INTO email_tokens (token_hash, user_id, purpose, email, created_at, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        `, tokenHash, userID, purpose, email, now, expiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// useEmailToken marks a live token for purpose used and returns its user
+// and the address it was sent to. The row lock makes it single-use even
+// under concurrent redemptions.
+func useEmailToken(ctx context.Context, tx pgx.Tx, purpose string, tokenHash []byte, now time.Time) (int, string, error) {
+	var userID int
+	var email string
+	err := tx.QueryRow(ctx,
+		`
+        UPDATE email_tokens SET used_at = $3
+        WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > $3
+        RETURNING user_id, email
+        `, tokenHash, purpose, now).Scan(&userID, &email)
+	if err == pgx.ErrNoRows {
+		return 0, "", fmt.Errorf("email token not found")
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("database error: %w", err)
+	}
+	return userID, email, nil
+}
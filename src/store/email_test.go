@@ -0,0 +1,152 @@
+// src/store/email_test.go
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cryptachat-server/testutil"
+)
+
+// wantErr fails t unless err's message is want.
+func wantErr(t *testing.T, what string, err error, want string) {
+	t.Helper()
+	if err == nil || err.Error() != want {
+		t.Errorf("%s: got %v, want %q", what, err, want)
+	}
+}
+
+// TestRecoveryEmailAndPasswordReset runs a recovery email through
+// verification and a password reset, checking at each step that only the
+// live token works: each one is single-use, replaced by the next of its
+// purpose, and dead once expired.
+func TestRecoveryEmailAndPasswordReset(t *testing.T) {
+	s := newTestStore(t)
+	clk := testutil.NewFakeClock(time.Now().UTC().Truncate(time.Second))
+	s.SetClock(clk)
+	ctx := context.Background()
+	alice, bob := mustRegister(t, s, "alice"), mustRegister(t, s, "bob")
+	token := func(name string) []byte { return []byte("hash of " + name) }
+	expires := func() time.Time { return clk.Now().Add(time.Hour) }
+
+	if e, err := s.GetRecoveryEmail(ctx, alice); err != nil || e != nil {
+		t.Fatalf("before setting one: %+v, %v; want none", e, err)
+	}
+
+	// Unverified, the address can't be used for a reset
+	if err := s.SetRecoveryEmail(ctx, alice, "Alice@example.com", token("verify 1"), expires()); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := s.GetRecoveryEmail(ctx, alice); err != nil || e == nil || e.Email != "Alice@example.com" || e.Verified {
+		t.Fatalf("after setting: %+v, %v; want unverified Alice@example.com", e, err)
+	}
+	_, _, err := s.CreatePasswordReset(ctx, "alice@example.com", token("reset 0"), expires())
+	wantErr(t, "reset to an unverified address", err, "email not found")
+
+	// Setting it again replaces the verification token
+	if err := s.SetRecoveryEmail(ctx, alice, "Alice@example.com", token("verify 2"), expires()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.VerifyRecoveryEmail(ctx, token("verify 1"))
+	wantErr(t, "replaced verification token", err, "email token not found")
+	if id, err := s.VerifyRecoveryEmail(ctx, token("verify 2")); err != nil || id != alice {
+		t.Fatalf("verifying: %d, %v; want %d", id, err, alice)
+	}
+	_, err = s.VerifyRecoveryEmail(ctx, token("verify 2"))
+	wantErr(t, "used verification token", err, "email token not found")
+	if e, err := s.GetRecoveryEmail(ctx, alice); err != nil || e == nil || !e.Verified {
+		t.Fatalf("after verifying: %+v, %v; want verified", e, err)
+	}
+
+	// Another account may give the same address in other case, but not
+	// verify it
+	if err := s.SetRecoveryEmail(ctx, bob, "alice@EXAMPLE.com", token("verify bob"), expires()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.VerifyRecoveryEmail(ctx, token("verify bob"))
+	wantErr(t, "verifying an address another account verified", err, "email already verified")
+
+	// A verification token expires
+	if err := s.SetRecoveryEmail(ctx, bob, "bob@example.com", token("verify bob 2"), expires()); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Hour)
+	_, err = s.VerifyRecoveryEmail(ctx, token("verify bob 2"))
+	wantErr(t, "expired verification token", err, "email token not found")
+
+	// Resets look the address up in any case and reply with the stored one
+	username, to, err := s.CreatePasswordReset(ctx, "ALICE@example.com", token("reset 1"), expires())
+	if err != nil || username != "alice" || to != "Alice@example.com" {
+		t.Fatalf("creating a reset: %q, %q, %v; want alice, Alice@example.com", username, to, err)
+	}
+	_, _, err = s.CreatePasswordReset(ctx, "bob@example.com", token("reset bob"), expires())
+	wantErr(t, "reset to an address never verified", err, "email not found")
+
+	if _, _, err := s.CreatePasswordReset(ctx, "alice@example.com", token("reset 2"), expires()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.GetPasswordReset(ctx, token("reset 1"))
+	wantErr(t, "looking up a replaced reset token", err, "email token not found")
+	_, err = s.ResetPassword(ctx, token("reset 1"), "new hash")
+	wantErr(t, "replaced reset token", err, "email token not found")
+
+	before, err := s.GetUserByID(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Looking a token up doesn't use it
+	for i := 0; i < 2; i++ {
+		if user, err := s.GetPasswordReset(ctx, token("reset 2")); err != nil || user.ID != alice || user.Username != "alice" {
+			t.Fatalf("looking up the reset token: %+v, %v; want alice", user, err)
+		}
+	}
+	if id, err := s.ResetPassword(ctx, token("reset 2"), "new hash"); err != nil || id != alice {
+		t.Fatalf("resetting: %d, %v; want %d", id, err, alice)
+	}
+	after, err := s.GetUserByID(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.PasswordHash != "new hash" {
+		t.Errorf("password hash after the reset: %q", after.PasswordHash)
+	}
+	if after.TokenVersion != before.TokenVersion+1 {
+		t.Errorf("token_version %d after the reset, want %d", after.TokenVersion, before.TokenVersion+1)
+	}
+	_, err = s.ResetPassword(ctx, token("reset 2"), "another hash")
+	wantErr(t, "used reset token", err, "email token not found")
+
+	// A reset token expires
+	if _, _, err := s.CreatePasswordReset(ctx, "alice@example.com", token("reset 3"), clk.Now().Add(30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(30 * time.Minute)
+	_, err = s.GetPasswordReset(ctx, token("reset 3"))
+	wantErr(t, "looking up an expired reset token", err, "email token not found")
+	_, err = s.ResetPassword(ctx, token("reset 3"), "another hash")
+	wantErr(t, "expired reset token", err, "email token not found")
+
+	// Removing the address kills its live tokens
+	if _, _, err := s.CreatePasswordReset(ctx, "alice@example.com", token("reset 4"), expires()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteRecoveryEmail(ctx, alice); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := s.GetRecoveryEmail(ctx, alice); err != nil || e != nil {
+		t.Errorf("after removing: %+v, %v; want none", e, err)
+	}
+	_, err = s.ResetPassword(ctx, token("reset 4"), "another hash")
+	wantErr(t, "reset token of a removed address", err, "email token not found")
+	_, _, err = s.CreatePasswordReset(ctx, "alice@example.com", token("reset 5"), expires())
+	wantErr(t, "reset to a removed address", err, "email not found")
+
+	// Once alice's is gone, bob may verify the address
+	if err := s.SetRecoveryEmail(ctx, bob, "alice@example.com", token("verify bob 3"), expires()); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := s.VerifyRecoveryEmail(ctx, token("verify bob 3")); err != nil || id != bob {
+		t.Errorf("verifying a freed address: %d, %v; want %d", id, err, bob)
+	}
+}
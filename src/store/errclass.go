@@ -0,0 +1,76 @@
+// src/store/errclass.go
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Store errors wrap the underlying pgx error (fmt.Errorf with %w), so
+// callers can ask IsTransient whether a failure is worth retrying. This is
+// the one place that knows which database failures are transient.
+
+// transientCodes are the SQLSTATEs of failures that may not recur: lost
+// races between transactions, contention, and a database that is
+// restarting or out of connections. Class 08 (connection exceptions) is
+// matched separately.
+var transientCodes = map[string]bool{
+	"40001": true, // serialization_failure, also hot standby conflicts
+	"40P01": true, // deadlock_detected
+	"55P03": true, // lock_not_available
+	"57014": true, // query_canceled, e.g. statement_timeout
+	"53300": true, // too_many_connections
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// IsTransient reports whether err is a database failure that may succeed
+// if the same call is made again shortly. Constraint violations, missing
+// rows and the store's own validation errors are permanent. Context
+// cancellation and deadlines aren't classified here; callers report those
+// as timeouts.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return transientCodes[pgErr.Code] || strings.HasPrefix(pgErr.Code, "08")
+	}
+	// The request never reached the server, or the connection broke
+	if pgconn.SafeToRetry(err) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isSerializationFailure reports whether err is a serialization failure,
+// which is always safe to retry for a read.
+func isSerializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "40001"
+}
+
+// retryRead runs read and, if it failed with a serialization failure, runs
+// it once more. Only for reads: they have no effects to repeat. Under READ
+// COMMITTED these come mostly from replicas cancelling queries that
+// conflict with replication.
+func retryRead[T any](ctx context.Context, read func() (T, error)) (T, error) {
+	v, err := read()
+	if err != nil && isSerializationFailure(err) && ctx.Err() == nil {
+		return read()
+	}
+	return v, err
+}
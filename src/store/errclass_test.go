@@ -0,0 +1,91 @@
+// src/store/errclass_test.go
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestIsTransient(t *testing.T) {
+	pg := func(code string) error {
+		return fmt.Errorf("database error: %w", &pgconn.PgError{Code: code})
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"serialization failure", pg("40001"), true},
+		{"deadlock", pg("40P01"), true},
+		{"lock timeout", pg("55P03"), true},
+		{"statement timeout", pg("57014"), true},
+		{"too many connections", pg("53300"), true},
+		{"shutting down", pg("57P01"), true},
+		{"starting up", pg("57P03"), true},
+		{"connection failure", pg("08006"), true},
+		{"connection refused by the server", pg("08001"), true},
+		{"connection reset", fmt.Errorf("database error: %w", syscall.ECONNRESET), true},
+		{"connection refused", fmt.Errorf("database error: %w", syscall.ECONNREFUSED), true},
+		{"connection cut short", fmt.Errorf("database error: %w", io.ErrUnexpectedEOF), true},
+		{"network timeout", fmt.Errorf("database error: %w", &net.OpError{Op: "read", Err: syscall.ETIMEDOUT}), true},
+
+		{"unique violation", pg("23505"), false},
+		{"foreign key violation", pg("23503"), false},
+		{"missing table", pg("42P01"), false},
+		{"no rows", fmt.Errorf("database error: %w", pgx.ErrNoRows), false},
+		{"the store's own error", errors.New("user not found"), false},
+		{"cancelled", fmt.Errorf("database error: %w", context.Canceled), false},
+		{"deadline", fmt.Errorf("database error: %w", context.DeadlineExceeded), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsTransient(tt.err); got != tt.want {
+			t.Errorf("%s: transient %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryReadOnlyAfterSerializationFailures(t *testing.T) {
+	serialization := fmt.Errorf("database error: %w", &pgconn.PgError{Code: "40001"})
+	deadlock := fmt.Errorf("database error: %w", &pgconn.PgError{Code: "40P01"})
+	tests := []struct {
+		name      string
+		errs      []error // What each call fails with, nil for success
+		cancelled bool
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", []error{nil}, false, 1, nil},
+		{"one serialization failure", []error{serialization, nil}, false, 2, nil},
+		{"two serialization failures", []error{serialization, serialization}, false, 2, serialization},
+		{"another transient failure", []error{deadlock, nil}, false, 1, deadlock},
+		{"cancelled meanwhile", []error{serialization, nil}, true, 1, serialization},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.cancelled {
+			cancel()
+		}
+		calls := 0
+		got, err := retryRead(ctx, func() (int, error) {
+			err := tt.errs[calls]
+			calls++
+			if err != nil {
+				return 0, err
+			}
+			return 42, nil
+		})
+		cancel()
+		if calls != tt.wantCalls || err != tt.wantErr || (err == nil && got != 42) {
+			t.Errorf("%s: %d calls, %v, %v; want %d calls and %v", tt.name, calls, got, err, tt.wantCalls, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// src/store/feature_flags.go
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// ---- Feature Flag Methods ----
+
+// GetFlagRollouts returns the rollout percentage of every flag that has one.
+func (s *PostgresStore) GetFlagRollouts(ctx context.Context) (map[string]int, error) {
+	rows, err := s.db.Query(ctx, "SELECT flag, percent FROM feature_flag_rollouts")
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	rollouts := make(map[string]int)
+	for rows.Next() {
+		var flag string
+		var percent int
+		if err := rows.Scan(&flag, &percent); err != nil {
+			return nil, fmt.Errorf("database scan error: %w", err)
+		}
+		rollouts[flag] = percent
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return rollouts, nil
+}
+
+// SetFlagRollout sets flag's rollout percentage, or removes it with nil.
+func (s *PostgresStore) SetFlagRollout(ctx context.Context, flag string, percent *int) error {
+	var err error
+	if percent == nil {
+		_, err = s.db.Exec(ctx, "DELETE FROM feature_flag_rollouts WHERE flag = $1", flag)
+	} else {
+		_, err = s.db.Exec(ctx,
+			`
+            INSERT INTO feature_flag_rollouts (flag, percent, updated_at) VALUES ($1, $2, $3)
+            ON CONFLICT (flag) DO UPDATE SET percent = EXCLUDED.percent, updated_at = EXCLUDED.updated_at
+            `, flag, *percent, s.clock.Now().UTC())
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// GetUserFlagOverrides returns userID's per-flag overrides.
+func (s *PostgresStore) GetUserFlagOverrides(ctx context.Context, userID int) (map[string]bool, error) {
+	rows, err := s.db.Query(ctx, "SELECT flag, enabled FROM feature_flag_overrides WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	overrides := make(map[string]bool)
+	for rows.Next() {
+		var flag string
+		var enabled bool
+		if err := rows.Scan(&flag, &enabled); err != nil {
+			return nil, fmt.Errorf("database scan error: %w", err)
+		}
+		overrides[flag] = enabled
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return overrides, nil
+}
+
+// SetFlagOverride sets userID's override of flag, or removes it with nil.
+func (s *PostgresStore) SetFlagOverride(ctx context.Context, userID int, flag string, enabled *bool) error {
+	var err error
+	if enabled == nil {
+		_, err = s.db.Exec(ctx, "DELETE FROM feature_flag_overrides WHERE user_id = $1 AND flag = $2", userID, flag)
+	} else {
+		_, err = s.db.Exec(ctx,
+			`
+            INSERT INTO feature_flag_overrides (user_id, flag, enabled, updated_at) VALUES ($1, $2, $3, $4)
+            ON CONFLICT (user_id, flag) DO UPDATE SET enabled = EXCLUDED.enabled, updated_at = EXCLUDED.updated_at
+            `, userID, flag, *enabled, s.clock.Now().UTC())
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// FlagOverrideCounts holds how many users have a flag forced on and off.
+type FlagOverrideCounts struct {
+	Enabled  int `json:"enabled"`
+	Disabled int `json:"disabled"`
+}
+
+// CountFlagOverrides counts the overrides of each flag that has any.
+func (s *PostgresStore) CountFlagOverrides(ctx context.Context) (map[string]FlagOverrideCounts, error) {
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT flag, COUNT(*) FILTER (WHERE enabled), COUNT(*) FILTER (WHERE NOT enabled)
+        FROM feature_flag_overrides
+        GROUP BY flag
+        `)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]FlagOverrideCounts)
+	for rows.Next() {
+		var flag string
+		var c FlagOverrideCounts
+		if err := rows.Scan(&flag, &c.Enabled, &c.Disabled); err != nil {
+			return nil, fmt.Errorf("database scan error: %w", err)
+		}
+		counts[flag] = c
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return counts, nil
+}
@@ -0,0 +1,509 @@
+// src/store/federation.go
+package store
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Federation relays chat requests, acceptances and messages between this
+// instance and configured peers (see migrations/0005). Users on a peer are
+// stood in for by local users rows named "user@peer" that can't log in, so
+// the existing chat_requests and messages logic applies to them unchanged.
+//
+// Writes that involve a stand-in queue a relay in the same transaction
+// (enqueueRelay). Only writes by a local user toward a stand-in are
+// relayed, so what arrives from a peer is never sent on anywhere.
+
+// Relay kinds.
+const (
+	RelayChatRequest = "chat_request"
+	RelayChatAccept  = "chat_accept"
+	RelayMessage     = "message"
+)
+
+// Relay states. Pending relays wait for their peer's retry time; sending
+// ones have been claimed by a relayer.
+const (
+	RelayPending   = "pending"
+	RelaySending   = "sending"
+	RelayDelivered = "delivered"
+	RelayFailed    = "failed" // Refused by the peer, or expired
+)
+
+// relayClaimTimeout is how long a claimed relay may stay sending before
+// another relayer pass retries it.
+const relayClaimTimeout = 10 * time.Minute
+
+// RemoteAddress is the local username standing in for username on peer.
+func RemoteAddress(username, peer string) string {
+	return username + "@" + peer
+}
+
+// EnsureRemoteUser returns the ID and username of the local stand-in for
+// username on peer, creating it the first time. Fails with "username
+// already exists" if a local account already has that name.
+func (s *PostgresStore) EnsureRemoteUser(ctx context.Context, peer, username string) (int, string, error) {
+	var id int
+	var local string
+	err := s.db.QueryRow(ctx,
+		`
+        SELECT u.id, u.username FROM remote_users r JOIN users u ON u.id = r.user_id
+        WHERE r.peer = $1 AND lower(r.remote_username) = lower($2)
+        `, peer, username,
+	).Scan(&id, &local)
+	if err == nil {
+		return id, local, nil
+	}
+	if err != pgx.ErrNoRows {
+		return 0, "", fmt.Errorf("database error: %w", err)
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, "", fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// The same lock RegisterUser takes, so neither can claim the name
+	// while the other is checking it
+	local = RemoteAddress(username, peer)
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", CanonicalUsername(local)); err != nil {
+		return 0, "", fmt.Errorf("database error: %w", err)
+	}
+	var remote bool
+	err = tx.QueryRow(ctx,
+		`
+        SELECT u.id, u.username, r.user_id IS NOT NULL
+        FROM users u LEFT JOIN remote_users r ON r.user_id = u.id
+        WHERE lower(u.username) = $1
+        `, CanonicalUsername(local),
+	).Scan(&id, &local, &remote)
+	switch {
+	case err == nil && remote:
+		return id, local, nil // Created by a concurrent call
+	case err == nil:
+		return 0, "", fmt.Errorf("username already exists")
+	case err != pgx.ErrNoRows:
+		return 0, "", fmt.Errorf("database error: %w", err)
+	}
+
+	// An empty hash never matches a password, so stand-ins can't log in
+	now := s.clock.Now().UTC()
+	err = tx.QueryRow(ctx,
+		"INSERT INTO users (username, password_hash, created_at) VALUES ($1, '', $2) RETURNING id",
+		local, now,
+	).Scan(&id)
+	if err != nil {
+		return 0, "", fmt.Errorf("database error: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		"INSERT INTO remote_users (user_id, peer, remote_username, created_at) VALUES ($1, $2, $3, $4)",
+		id, peer, username, now)
+	if err != nil {
+		return 0, "", fmt.Errorf("database error: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, "", fmt.Errorf("database error: %w", err)
+	}
+	return id, local, nil
+}
+
+// IsRemoteUser reports whether userID stands in for a user on a peer.
+func (s *PostgresStore) IsRemoteUser(ctx context.Context, userID int) (bool, error) {
+	var remote bool
+	err := s.db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM remote_users WHERE user_id = $1)", userID).Scan(&remote)
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return remote, nil
+}
+
+// enqueueRelay queues kind for relaying if fromID is a local user and toID
+// stands in for a user on a peer; otherwise it does nothing. messageID is
+// 0 except for messages. Must run in the transaction of the write.
+func enqueueRelay(ctx context.Context, tx pgx.Tx, kind string, fromID, toID, messageID int, now time.Time) error {
+	_, err := tx.Exec(ctx,
+		`
+        INSERT INTO federation_outbox (peer, kind, from_user_id, to_user_id, message_id, created_at)
+        SELECT r.peer, $1, $2, $3, NULLIF($4, 0), $5
+        FROM remote_users r
+        WHERE r.user_id = $3 AND NOT EXISTS (SELECT 1 FROM remote_users WHERE user_id = $2)
+        `, kind, fromID, toID, messageID, now)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// Relay is a claimed relay, with what is needed to send it.
+type Relay struct {
+	ID           int64
+	Peer         string
+	Kind         string
+	FromUserID   int
+	FromUsername string // Local username
+	ToUserID     int
+	ToUsername   string // Username on the peer
+	MessageID    int    // 0 unless Kind is RelayMessage
+	CreatedAt    time.Time
+}
+
+// ClaimRelays marks up to limit of peer's unsent relays as sending and
+// returns them, oldest first. It returns none while the peer is backing
+// off, and none while another relayer holds some of the peer's relays, so
+// each peer's relays are sent in order by one relayer at a time. Claims
+// older than relayClaimTimeout are taken over.
+func (s *PostgresStore) ClaimRelays(ctx context.Context, peer string, limit int) ([]Relay, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := s.clock.Now().UTC()
+	if _, err := tx.Exec(ctx, "INSERT INTO federation_peers (peer) VALUES ($1) ON CONFLICT DO NOTHING", peer); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	// The peer row serializes claims for the peer
+	var retryAt *time.Time
+	err = tx.QueryRow(ctx, "SELECT retry_at FROM federation_peers WHERE peer = $1 FOR UPDATE SKIP LOCKED", peer).Scan(&retryAt)
+	if err == pgx.ErrNoRows {
+		return nil, nil // Another relayer is claiming
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if retryAt != nil && retryAt.After(now) {
+		return nil, nil
+	}
+	var busy bool
+	err = tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM federation_outbox WHERE peer = $1 AND status = 'sending' AND claimed_at >= $2)",
+		peer, now.Add(-relayClaimTimeout),
+	).Scan(&busy)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if busy {
+		return nil, nil
+	}
+
+	rows, err := tx.Query(ctx,
+		`
+        UPDATE federation_outbox o SET status = 'sending', claimed_at = $2
+        FROM users f, remote_users t
+        WHERE f.id = o.from_user_id AND t.user_id = o.to_user_id AND o.id IN (
+            SELECT id FROM federation_outbox
+            WHERE peer = $1 AND status IN ('pending', 'sending')
+            ORDER BY id
+            LIMIT $3
+        )
+        RETURNING o.id, o.peer, o.kind, o.from_user_id, f.username, o.to_user_id, t.remote_username,
+            COALESCE(o.message_id, 0), o.created_at
+        `, peer, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	relays, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Relay, error) {
+		var r Relay
+		err := row.Scan(&r.ID, &r.Peer, &r.Kind, &r.FromUserID, &r.FromUsername, &r.ToUserID, &r.ToUsername, &r.MessageID, &r.CreatedAt)
+		return r, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	slices.SortFunc(relays, func(a, b Relay) int { return cmp.Compare(a.ID, b.ID) })
+	return relays, nil
+}
+
+// CompleteRelay records that the peer accepted a relay and clears the
+// peer's backoff. A relayed message's copy for the stand-in is dropped:
+// the peer now holds it.
+func (s *PostgresStore) CompleteRelay(ctx context.Context, r Relay) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := s.clock.Now().UTC()
+	if _, err := tx.Exec(ctx,
+		"UPDATE federation_outbox SET status = 'delivered', last_error = NULL, finished_at = $2 WHERE id = $1",
+		r.ID, now); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if r.Kind == RelayMessage {
+		tag, err := tx.Exec(ctx,
+			"UPDATE messages SET recipient_blob = NULL WHERE id = $1 AND recipient_id = $2 AND recipient_blob IS NOT NULL",
+			r.MessageID, r.ToUserID)
+		if err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		// The dropped copy no longer counts toward the conversation's bytes
+		if tag.RowsAffected() > 0 {
+			pair := conversationPair{low: min(r.FromUserID, r.ToUserID), high: max(r.FromUserID, r.ToUserID)}
+			if err := recountConversationStats(ctx, tx, map[conversationPair]struct{}{pair: {}}); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(ctx,
+		"UPDATE federation_peers SET failures = 0, retry_at = NULL, last_error = NULL, last_success_at = $2 WHERE peer = $1",
+		r.Peer, now); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// FailRelay records that the peer refused a relay for good. A refused
+// chat request is withdrawn, so the sender can correct the address and
+// ask again.
+func (s *PostgresStore) FailRelay(ctx context.Context, r Relay, detail string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := s.clock.Now().UTC()
+	if _, err := tx.Exec(ctx,
+		"UPDATE federation_outbox SET status = 'failed', last_error = $2, finished_at = $3 WHERE id = $1",
+		r.ID, detail, now); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if r.Kind == RelayChatRequest {
+		withdrawn, err := withdrawRequest(ctx, tx, r)
+		if err != nil {
+			return err
+		}
+		if withdrawn {
+			if err := bumpRelationshipsVersions(ctx, tx, r.ToUserID); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// withdrawRequest deletes the pending chat request a relay was carrying,
+// and reports whether there was one. The caller bumps the recipient's
+// relationship version.
+func withdrawRequest(ctx context.Context, tx pgx.Tx, r Relay) (bool, error) {
+	cmdTag, err := tx.Exec(ctx,
+		"DELETE FROM chat_requests WHERE requester_id = $1 AND requested_id = $2 AND status = 'pending'",
+		r.FromUserID, r.ToUserID)
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return cmdTag.RowsAffected() > 0, nil
+}
+
+// DeferRelays puts claimed relays back after peer could not be reached,
+// and backs the peer off: base doubled per consecutive failure, up to
+// maxDelay. It returns when the peer will be tried again.
+func (s *PostgresStore) DeferRelays(ctx context.Context, peer string, ids []int64, detail string, base, maxDelay time.Duration) (time.Time, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := s.clock.Now().UTC()
+	if _, err := tx.Exec(ctx,
+		"UPDATE federation_outbox SET status = 'pending', claimed_at = NULL, last_error = $2 WHERE id = ANY($1) AND status = 'sending'",
+		ids, detail); err != nil {
+		return time.Time{}, fmt.Errorf("database error: %w", err)
+	}
+	var retryAt time.Time
+	err = tx.QueryRow(ctx,
+		`
+        UPDATE federation_peers SET
+            failures = failures + 1,
+            retry_at = $2::timestamptz + LEAST($4::interval, $3::interval * power(2, LEAST(failures, 20))),
+            last_error = $5
+        WHERE peer = $1
+        RETURNING retry_at
+        `, peer, now, base, maxDelay, detail,
+	).Scan(&retryAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("database error: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return time.Time{}, fmt.Errorf("database error: %w", err)
+	}
+	return retryAt, nil
+}
+
+// ExpireRelays fails relays still unsent after being queued before
+// olderThan, withdrawing expired chat requests as FailRelay does.
+func (s *PostgresStore) ExpireRelays(ctx context.Context, olderThan time.Time) (int64, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`
+        UPDATE federation_outbox SET status = 'failed', last_error = 'expired', finished_at = $2
+        WHERE status IN ('pending', 'sending') AND created_at < $1
+        RETURNING kind, from_user_id, to_user_id
+        `, olderThan, s.clock.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	expired, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Relay, error) {
+		var r Relay
+		err := row.Scan(&r.Kind, &r.FromUserID, &r.ToUserID)
+		return r, err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("database scan error: %w", err)
+	}
+	var recipients []int
+	for _, r := range expired {
+		if r.Kind != RelayChatRequest {
+			continue
+		}
+		withdrawn, err := withdrawRequest(ctx, tx, r)
+		if err != nil {
+			return 0, err
+		}
+		if withdrawn {
+			recipients = append(recipients, r.ToUserID)
+		}
+	}
+	if err := bumpRelationshipsVersions(ctx, tx, recipients...); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return int64(len(expired)), nil
+}
+
+// PruneRelays deletes finished relays, and the record of relays received,
+// from before olderThan.
+func (s *PostgresStore) PruneRelays(ctx context.Context, olderThan time.Time) (int64, error) {
+	sent, err := s.db.Exec(ctx, "DELETE FROM federation_outbox WHERE finished_at < $1", olderThan)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	received, err := s.db.Exec(ctx, "DELETE FROM federation_inbox WHERE received_at < $1", olderThan)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return sent.RowsAffected() + received.RowsAffected(), nil
+}
+
+// ReceiveRelayedMessage stores a message relayed by peer from the
+// stand-in senderID to a local user. relayID is the peer's ID for the
+// relay; a repeat returns duplicate and stores nothing. The two must be
+// contacts, and the recipient's inbound limit applies. Only the
+// recipient's copy is stored: the sender's is on the peer.
+func (s *PostgresStore) ReceiveRelayedMessage(ctx context.Context, peer string, relayID int64, senderID int, recipientUsername, blob string) (messageID int, duplicate bool, err error) {
+	recipientID, err := s.GetUserIDByUsername(ctx, recipientUsername)
+	if err != nil {
+		return 0, false, fmt.Errorf("recipient user not found")
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, false, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := s.clock.Now().UTC()
+	tag, err := tx.Exec(ctx,
+		"INSERT INTO federation_inbox (peer, relay_id, received_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		peer, relayID, now)
+	if err != nil {
+		return 0, false, fmt.Errorf("database error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return 0, true, nil
+	}
+
+	var contacts bool
+	err = tx.QueryRow(ctx,
+		`
+        SELECT EXISTS (
+            SELECT 1 FROM chat_requests
+            WHERE status = 'accepted'
+              AND ((requester_id = $1 AND requested_id = $2) OR (requester_id = $2 AND requested_id = $1))
+        )
+        `, senderID, recipientID,
+	).Scan(&contacts)
+	if err != nil {
+		return 0, false, fmt.Errorf("database error: %w", err)
+	}
+	if !contacts {
+		return 0, false, fmt.Errorf("not a contact")
+	}
+	if err := checkInboundLimit(ctx, tx, recipientID, now); err != nil {
+		return 0, false, err
+	}
+
+	messageID, err = s.insertMessage(ctx, tx, senderID, recipientID, nil, &blob, now)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, false, fmt.Errorf("database error: %w", err)
+	}
+	return messageID, false, nil
+}
+
+// PeerStatus is one peer's relay state for /admin/runtime.
+type PeerStatus struct {
+	Peer            string     `json:"peer"`
+	Pending         int        `json:"pending"` // Queued or being sent
+	Failed          int        `json:"failed"`  // Not yet pruned
+	OldestPendingAt *Timestamp `json:"oldest_pending_at"`
+	Failures        int        `json:"consecutive_failures"`
+	RetryAt         *Timestamp `json:"retry_at"`
+	LastError       string     `json:"last_error,omitempty"`
+	LastSuccessAt   *Timestamp `json:"last_success_at"`
+}
+
+// GetPeerStatuses reports relay state for each of peers, in that order.
+func (s *PostgresStore) GetPeerStatuses(ctx context.Context, peers []string) ([]PeerStatus, error) {
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT p.name,
+            (SELECT COUNT(*) FROM federation_outbox WHERE peer = p.name AND status IN ('pending', 'sending')),
+            (SELECT COUNT(*) FROM federation_outbox WHERE peer = p.name AND status = 'failed'),
+            (SELECT MIN(created_at) FROM federation_outbox WHERE peer = p.name AND status IN ('pending', 'sending')),
+            COALESCE(fp.failures, 0), fp.retry_at, COALESCE(fp.last_error, ''), fp.last_success_at
+        FROM unnest($1::text[]) WITH ORDINALITY AS p(name, ord)
+        LEFT JOIN federation_peers fp ON fp.peer = p.name
+        ORDER BY p.ord
+        `, peers)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	statuses, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (PeerStatus, error) {
+		var st PeerStatus
+		err := row.Scan(&st.Peer, &st.Pending, &st.Failed, &st.OldestPendingAt, &st.Failures, &st.RetryAt, &st.LastError, &st.LastSuccessAt)
+		return st, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return statuses, nil
+}
@@ -0,0 +1,69 @@
+// src/store/inbound.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// inboundWindow is the period inbound_messages_per_hour applies to.
+const inboundWindow = time.Hour
+
+// checkInboundLimit fails with "recipient rate limited" if recipientID has
+// an inbound ceiling and already received that many messages in the last
+// inboundWindow. It locks the recipient's settings row, so concurrent
+// sends to a limited recipient are counted one at a time and can't
+// overshoot together. Recipients without a ceiling take no lock. Must run
+// in the transaction that inserts the message.
+func checkInboundLimit(ctx context.Context, tx pgx.Tx, recipientID int, now time.Time) error {
+	var limit int
+	err := tx.QueryRow(ctx,
+		`
+        SELECT inbound_messages_per_hour FROM user_settings
+        WHERE user_id = $1 AND inbound_messages_per_hour IS NOT NULL
+        FOR UPDATE
+        `, recipientID,
+	).Scan(&limit)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	// Counting stops at the limit, so a flooded user costs no more to check
+	var recent int
+	err = tx.QueryRow(ctx,
+		`
+        SELECT count(*) FROM (
+            SELECT 1 FROM messages
+            WHERE recipient_id = $1 AND timestamp > $2
+            LIMIT $3
+        ) recent
+        `, recipientID, now.Add(-inboundWindow), limit,
+	).Scan(&recent)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if recent >= limit {
+		return fmt.Errorf("recipient rate limited")
+	}
+	return nil
+}
+
+// SetInboundLimit stores a user's inbound ceiling in messages per hour
+// (nil = unlimited).
+func (s *PostgresStore) SetInboundLimit(ctx context.Context, userID int, perHour *int) error {
+	_, err := s.db.Exec(ctx,
+		`
+        INSERT INTO user_settings (user_id, inbound_messages_per_hour) VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE SET inbound_messages_per_hour = EXCLUDED.inbound_messages_per_hour
+        `, userID, perHour)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
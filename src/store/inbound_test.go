@@ -0,0 +1,129 @@
+// src/store/inbound_test.go
+package store
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cryptachat-server/testutil"
+)
+
+// TestInboundLimit sends to a recipient with no ceiling, then with one, from
+// a contact (plain and sealed) and from a stranger. All count together, and
+// being a contact doesn't get around it.
+func TestInboundLimit(t *testing.T) {
+	s := newTestStore(t)
+	clk := testutil.NewFakeClock(time.Now().UTC().Truncate(time.Second))
+	s.SetClock(clk)
+	ctx := context.Background()
+
+	alice := mustRegister(t, s, "alice")
+	bob := mustRegister(t, s, "bob")
+	carol := mustRegister(t, s, "carol")
+	if _, err := s.RequestChat(ctx, bob, "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AcceptChat(ctx, alice, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range []struct {
+		id      int
+		partner string
+	}{{alice, "bob"}, {bob, "alice"}} {
+		if _, err := s.SetSealedSender(ctx, opt.id, opt.partner, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plain := func(from int) error {
+		_, _, err := s.SendMessage(ctx, from, "alice", "s", "r")
+		return err
+	}
+	sealed := func(from int) error {
+		_, _, err := s.SendSealedMessage(ctx, from, "alice", "r")
+		return err
+	}
+	limited := func(what string, err error) {
+		t.Helper()
+		if err == nil || !strings.Contains(err.Error(), "recipient rate limited") {
+			t.Errorf("%s: %v, want refused", what, err)
+		}
+	}
+
+	// No ceiling by default
+	for i := 0; i < 10; i++ {
+		if err := plain(carol); err != nil {
+			t.Fatalf("unlimited, message %d: %v", i+1, err)
+		}
+	}
+	settings, err := s.GetUserSettings(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.InboundMessagesPerHour != nil {
+		t.Errorf("default ceiling %d, want none", *settings.InboundMessagesPerHour)
+	}
+
+	clk.Advance(time.Hour)
+	limit := 3
+	if err := s.SetInboundLimit(ctx, alice, &limit); err != nil {
+		t.Fatal(err)
+	}
+	if settings, err := s.GetUserSettings(ctx, alice); err != nil || settings.InboundMessagesPerHour == nil || *settings.InboundMessagesPerHour != 3 {
+		t.Fatalf("settings %+v, %v; want a ceiling of 3", settings, err)
+	}
+	for i, send := range []func() error{
+		func() error { return plain(bob) },
+		func() error { return sealed(bob) },
+		func() error { return plain(carol) },
+	} {
+		if err := send(); err != nil {
+			t.Fatalf("message %d of 3: %v", i+1, err)
+		}
+	}
+	limited("a contact", plain(bob))
+	limited("a contact, sealed", sealed(bob))
+	limited("a stranger", plain(carol))
+	if err := plain(alice); err == nil || strings.Contains(err.Error(), "rate limited") {
+		t.Errorf("to oneself: %v, want the usual refusal", err)
+	}
+	if _, _, err := s.SendMessage(ctx, alice, "bob", "s", "r"); err != nil {
+		t.Errorf("alice's own sends are limited too: %v", err)
+	}
+
+	// The window slides
+	clk.Advance(time.Hour)
+	if err := plain(carol); err != nil {
+		t.Errorf("an hour later: %v", err)
+	}
+
+	// Concurrent sends can't overshoot together
+	clk.Advance(time.Hour)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(from int) {
+			defer wg.Done()
+			if plain(from) == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}([]int{bob, carol}[i%2])
+	}
+	wg.Wait()
+	if accepted != limit {
+		t.Errorf("%d concurrent sends accepted, want %d", accepted, limit)
+	}
+
+	if err := s.SetInboundLimit(ctx, alice, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := plain(carol); err != nil {
+		t.Errorf("after clearing the ceiling: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+// src/store/invalidation.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// EventCacheInvalidated is the outbox event that pushes invalidations to
+// connected clients.
+const EventCacheInvalidated = "cache.invalidated"
+
+// Invalidation tells one user's client to drop part of its local cache.
+type Invalidation struct {
+	ID        int64     `json:"id"`
+	Scope     string    `json:"scope"`
+	Username  string    `json:"username,omitempty"` // Whose data changed, for per-user scopes
+	CreatedAt Timestamp `json:"created_at"`
+	// RelationshipsVersion is the user's relationship version once the
+	// change was made, for the contacts and chat_requests scopes. A client
+	// whose ETag for the list is already at least this can skip the refetch.
+	RelationshipsVersion *int64 `json:"relationships_version,omitempty"`
+}
+
+// CacheInvalidatedPayload is the payload of a "cache.invalidated" event.
+type CacheInvalidatedPayload struct {
+	UserIDs       []int          `json:"user_ids"`
+	Invalidations []Invalidation `json:"invalidations"` // Parallel to UserIDs
+}
+
+// PublishInvalidation records an invalidation for each of userIDs and queues
+// the push in the same transaction. With withVersion, each carries that
+// user's current relationship version.
+func (s *PostgresStore) PublishInvalidation(ctx context.Context, userIDs []int, scope, username string, withVersion bool) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	now := NewTimestamp(s.clock.Now().UTC())
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var subject *string
+	if username != "" {
+		subject = &username
+	}
+
+	payload := CacheInvalidatedPayload{UserIDs: userIDs}
+	for _, userID := range userIDs {
+		inv := Invalidation{Scope: scope, Username: username, CreatedAt: now}
+		err := tx.QueryRow(ctx,
+			`
+            INSERT INTO cache_invalidations (user_id, scope, subject, created_at, relationships_version)
+            VALUES ($1, $2, $3, $4,
+                CASE WHEN $5::boolean THEN COALESCE((SELECT version FROM relationship_versions WHERE user_id = $1), 0) END)
+            RETURNING id, relationships_version
+            `, userID, scope, subject, now, withVersion,
+		).Scan(&inv.ID, &inv.RelationshipsVersion)
+		if err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		payload.Invalidations = append(payload.Invalidations, inv)
+	}
+
+	if err := s.insertOutboxEvent(ctx, tx, EventCacheInvalidated, payload); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// GetInvalidations returns up to limit of a user's invalidations with an ID
+// greater than sinceID, oldest first.
+func (s *PostgresStore) GetInvalidations(ctx context.Context, userID int, sinceID int64, limit int) ([]Invalidation, error) {
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT id, scope, COALESCE(subject, ''), created_at, relationships_version
+        FROM cache_invalidations
+        WHERE user_id = $1 AND id > $2
+        ORDER BY id
+        LIMIT $3
+        `, userID, sinceID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	invalidations, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Invalidation, error) {
+		var inv Invalidation
+		err := row.Scan(&inv.ID, &inv.Scope, &inv.Username, &inv.CreatedAt, &inv.RelationshipsVersion)
+		return inv, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return invalidations, nil
+}
+
+// PruneInvalidations deletes invalidations older than the cutoff.
+func (s *PostgresStore) PruneInvalidations(ctx context.Context, olderThan time.Time) (int64, error) {
+	cmdTag, err := s.db.Exec(ctx,
+		"DELETE FROM cache_invalidations WHERE created_at < $1", olderThan)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return cmdTag.RowsAffected(), nil
+}
@@ -0,0 +1,61 @@
+// src/store/invites.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Invites gate registration when INVITES_REQUIRED is set: each code lets
+// one account register, and records which one did. The service hashes codes
+// before they get here.
+
+// InviteLimitError reports a user who has minted as many invites as they
+// may within the window.
+type InviteLimitError struct {
+	RetryAt time.Time // When the oldest invite in the window leaves it
+}
+
+func (e *InviteLimitError) Error() string {
+	return "invite limit reached"
+}
+
+// CreateInvite stores an invite code minted by userID, unless they have
+// already minted limit within window, in which case it fails with an
+// *InviteLimitError. It returns when the invite was created.
+func (s *PostgresStore) CreateInvite(ctx context.Context, userID int, codeHash []byte, limit int, window time.Duration) (time.Time, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialises one user's mints, so concurrent ones can't both fit
+	if _, err := tx.Exec(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+		return time.Time{}, fmt.Errorf("database error: %w", err)
+	}
+	now := s.clock.Now().UTC()
+	var recent int
+	var oldest *time.Time
+	err = tx.QueryRow(ctx,
+		"SELECT count(*), min(created_at) FROM invites WHERE created_by = $1 AND created_at > $2",
+		userID, now.Add(-window)).Scan(&recent, &oldest)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("database error: %w", err)
+	}
+	if recent >= limit && oldest != nil {
+		return time.Time{}, &InviteLimitError{RetryAt: oldest.Add(window)}
+	}
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO invites (code_hash, created_by, created_at) VALUES ($1, $2, $3)",
+		codeHash, userID, now)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("database error: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return time.Time{}, fmt.Errorf("database error: %w", err)
+	}
+	return now, nil
+}
@@ -0,0 +1,66 @@
+// src/store/jobruns.go
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Background jobs hold the store, so it keeps their last-run times for the
+// admin dashboard. Only the latest pass of each job is kept, in memory; a
+// restarted process reports no runs until each job has been around once.
+
+// JobRun describes a background job's passes in this process.
+type JobRun struct {
+	Name           string    `json:"name"`
+	LastRunAt      Timestamp `json:"last_run_at"` // When the last pass started
+	LastDurationMs float64   `json:"last_duration_ms"`
+	LastError      string    `json:"last_error,omitempty"`
+	Runs           int64     `json:"runs"`
+	Failures       int64     `json:"failures"`
+}
+
+type jobRuns struct {
+	mu   sync.Mutex
+	runs map[string]*JobRun
+}
+
+// StartJobRun marks the start of a pass of the named job. Call the returned
+// function when the pass ends, with the error that cut it short, if any.
+func (s *PostgresStore) StartJobRun(name string) func(err error) {
+	started := s.clock.Now()
+	return func(err error) {
+		took := s.clock.Now().Sub(started)
+		s.jobs.mu.Lock()
+		defer s.jobs.mu.Unlock()
+		if s.jobs.runs == nil {
+			s.jobs.runs = make(map[string]*JobRun)
+		}
+		run, ok := s.jobs.runs[name]
+		if !ok {
+			run = &JobRun{Name: name}
+			s.jobs.runs[name] = run
+		}
+		run.LastRunAt = NewTimestamp(started)
+		run.LastDurationMs = float64(took) / float64(time.Millisecond)
+		run.LastError = ""
+		run.Runs++
+		if err != nil {
+			run.LastError = err.Error()
+			run.Failures++
+		}
+	}
+}
+
+// JobRuns returns every job that has finished a pass, by name.
+func (s *PostgresStore) JobRuns() []JobRun {
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	out := make([]JobRun, 0, len(s.jobs.runs))
+	for _, run := range s.jobs.runs {
+		out = append(out, *run)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
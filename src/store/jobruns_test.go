@@ -0,0 +1,56 @@
+// src/store/jobruns_test.go
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"cryptachat-server/testutil"
+)
+
+// TestJobRuns runs two jobs, one of them failing once, and checks only the
+// latest pass of each is reported, with the failures counted.
+func TestJobRuns(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now().UTC().Truncate(time.Second))
+	s := &PostgresStore{clock: clk}
+	if runs := s.JobRuns(); runs == nil || len(runs) != 0 {
+		t.Fatalf("before any run: %+v", runs)
+	}
+
+	finish := s.StartJobRun("retention")
+	clk.Advance(1500 * time.Millisecond)
+	finish(errors.New("database error: timeout"))
+
+	// Unfinished passes aren't reported
+	s.StartJobRun("blob_rekey")
+
+	started := clk.Now()
+	finish = s.StartJobRun("outbox")
+	clk.Advance(20 * time.Millisecond)
+	finish(nil)
+
+	clk.Advance(time.Minute)
+	rerun := clk.Now()
+	finish = s.StartJobRun("retention")
+	clk.Advance(250 * time.Millisecond)
+	finish(nil)
+
+	want := []JobRun{
+		{Name: "outbox", LastRunAt: NewTimestamp(started), LastDurationMs: 20, Runs: 1},
+		{Name: "retention", LastRunAt: NewTimestamp(rerun), LastDurationMs: 250, Runs: 2, Failures: 1},
+	}
+	got := s.JobRuns()
+	if len(got) != len(want) {
+		t.Fatalf("runs: %+v", got)
+	}
+	for i := range want {
+		if !got[i].LastRunAt.Time.Equal(want[i].LastRunAt.Time) {
+			t.Errorf("%s last ran at %v, want %v", got[i].Name, got[i].LastRunAt, want[i].LastRunAt)
+		}
+		got[i].LastRunAt = want[i].LastRunAt
+		if got[i] != want[i] {
+			t.Errorf("run %d: %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// src/store/keylog.go
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"cryptachat-server/keylog"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// keyLogLockID serialises appends so sequence numbers have no gaps and each
+// entry links to the true previous one.
+const keyLogLockID = 7250001
+
+// KeyLogEntry is one row of the public key transparency log.
+type KeyLogEntry struct {
+	Seq       int64     `json:"seq"`
+	Username  string    `json:"username"`
+	Version   int       `json:"version"`
+	KeyHash   string    `json:"key_hash"`
+	CreatedAt Timestamp `json:"created_at"`
+	PrevHash  string    `json:"prev_hash"`
+	EntryHash string    `json:"entry_hash"`
+}
+
+// KeyLogHead identifies the newest entry. An empty log has Seq 0 and the
+// genesis hash.
+type KeyLogHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// appendKeyLog records a key change inside the upload transaction.
+func (s *PostgresStore) appendKeyLog(ctx context.Context, tx pgx.Tx, userID int, publicKey string) error {
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", keyLogLockID); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	head := KeyLogHead{Hash: keylog.Genesis}
+	err := tx.QueryRow(ctx, "SELECT seq, entry_hash FROM key_log ORDER BY seq DESC LIMIT 1").Scan(&head.Seq, &head.Hash)
+	if err != nil && err != pgx.ErrNoRows {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	e := keylog.Entry{
+		Seq:       head.Seq + 1,
+		KeyHash:   keylog.KeyHash(publicKey),
+		CreatedAt: keylog.Truncate(s.clock.Now()),
+		PrevHash:  head.Hash,
+	}
+	err = tx.QueryRow(ctx,
+		`
+        SELECT u.username, COALESCE((SELECT MAX(version) FROM key_log WHERE user_id = u.id), 0) + 1
+        FROM users u WHERE u.id = $1
+        `, userID,
+	).Scan(&e.Username, &e.Version)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	e.EntryHash = e.ComputeHash()
+
+	_, err = tx.Exec(ctx,
+		`
+        INSERT INTO key_log (seq, user_id, username, version, key_hash, created_at, prev_hash, entry_hash)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        `, e.Seq, userID, e.Username, e.Version, e.KeyHash, e.CreatedAt, e.PrevHash, e.EntryHash)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// BackfillKeyLog adds a log entry for every stored key that predates the log.
+// It returns how many were added.
+func (s *PostgresStore) BackfillKeyLog(ctx context.Context) (int, error) {
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT pk.user_id FROM public_keys pk
+        WHERE NOT EXISTS (SELECT 1 FROM key_log kl WHERE kl.user_id = pk.user_id)
+        ORDER BY pk.user_id
+        `)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	userIDs, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+
+	added := 0
+	for _, userID := range userIDs {
+		ok, err := s.backfillKeyLog(ctx, userID)
+		if err != nil {
+			return added, err
+		}
+		if ok {
+			added++
+		}
+	}
+	return added, nil
+}
+
+func (s *PostgresStore) backfillKeyLog(ctx context.Context, userID int) (bool, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var key string
+	err = tx.QueryRow(ctx,
+		`
+        SELECT public_key FROM public_keys WHERE user_id = $1
+        AND NOT EXISTS (SELECT 1 FROM key_log WHERE user_id = $1)
+        FOR UPDATE
+        `, userID).Scan(&key)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			// Key removed or logged concurrently
+			return false, nil
+		}
+		return false, fmt.Errorf("database error: %w", err)
+	}
+
+	if err := s.appendKeyLog(ctx, tx, userID, key); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return true, nil
+}
+
+// GetKeyLogByUsername returns every key change for username, oldest first.
+func (s *PostgresStore) GetKeyLogByUsername(ctx context.Context, username string) ([]KeyLogEntry, error) {
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT seq, username, version, key_hash, created_at, prev_hash, entry_hash
+        FROM key_log WHERE lower(username) = $1 ORDER BY seq
+        `, CanonicalUsername(username))
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return collectKeyLog(rows)
+}
+
+// GetKeyLog returns up to limit entries after afterSeq, oldest first.
+func (s *PostgresStore) GetKeyLog(ctx context.Context, afterSeq int64, limit int) ([]KeyLogEntry, error) {
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT seq, username, version, key_hash, created_at, prev_hash, entry_hash
+        FROM key_log WHERE seq > $1 ORDER BY seq LIMIT $2
+        `, afterSeq, limit)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return collectKeyLog(rows)
+}
+
+func collectKeyLog(rows pgx.Rows) ([]KeyLogEntry, error) {
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (KeyLogEntry, error) {
+		var e KeyLogEntry
+		err := row.Scan(&e.Seq, &e.Username, &e.Version, &e.KeyHash, &e.CreatedAt, &e.PrevHash, &e.EntryHash)
+		return e, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return entries, nil
+}
+
+// GetKeyLogHead returns the newest entry's sequence number and hash.
+func (s *PostgresStore) GetKeyLogHead(ctx context.Context) (KeyLogHead, error) {
+	head := KeyLogHead{Hash: keylog.Genesis}
+	err := s.db.QueryRow(ctx, "SELECT seq, entry_hash FROM key_log ORDER BY seq DESC LIMIT 1").Scan(&head.Seq, &head.Hash)
+	if err != nil && err != pgx.ErrNoRows {
+		return head, fmt.Errorf("database error: %w", err)
+	}
+	return head, nil
+}
@@ -0,0 +1,108 @@
+// src/store/login_attempts.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// LoginAttempt is the outcome of BeginLoginAttempt.
+type LoginAttempt struct {
+	Allowed     bool      // The password may be checked
+	Failures    int       // Consecutive failures, counting this attempt
+	LockedUntil time.Time // Zero unless the username is locked for this address
+}
+
+// Login attempts are counted per canonical username (see migrations/0025),
+// whether or not an account has it, so the lockout treats unknown names
+// exactly like registered ones.
+
+// BeginLoginAttempt counts a login as username from sourceIP before its
+// password is checked, so that racing guesses each take a turn: once
+// maxFailures have been counted, the pair is locked until lockout has
+// passed and further attempts are refused without being counted. The
+// attempt that reaches maxFailures is still allowed, and a correct
+// password then lifts the lock through ResetLoginAttempts. Counts older
+// than lockout start over.
+func (s *PostgresStore) BeginLoginAttempt(ctx context.Context, username, sourceIP string, maxFailures int, lockout time.Duration) (LoginAttempt, error) {
+	now := s.clock.Now().UTC()
+	var attempt LoginAttempt
+	var lockedUntil *time.Time
+	// The upsert locks the row, so concurrent attempts count one at a time
+	err := s.db.QueryRow(ctx,
+		`
+        INSERT INTO login_attempts (username, source_ip, failures, last_attempt_at, locked_until)
+        VALUES ($1, $2, 1, $3, CASE WHEN 1 >= $4 THEN $5::timestamptz END)
+        ON CONFLICT (username, source_ip) DO UPDATE SET
+            failures = CASE WHEN login_attempts.last_attempt_at <= $6 THEN 1 ELSE login_attempts.failures + 1 END,
+            last_attempt_at = EXCLUDED.last_attempt_at,
+            locked_until = CASE
+                WHEN (CASE WHEN login_attempts.last_attempt_at <= $6 THEN 1 ELSE login_attempts.failures + 1 END) >= $4
+                THEN $5::timestamptz
+            END
+        WHERE login_attempts.locked_until IS NULL OR login_attempts.locked_until <= $3
+        RETURNING failures, locked_until
+        `, CanonicalUsername(username), sourceIP, now, maxFailures, now.Add(lockout), now.Add(-lockout),
+	).Scan(&attempt.Failures, &lockedUntil)
+	if err == nil {
+		attempt.Allowed = true
+		if lockedUntil != nil {
+			attempt.LockedUntil = *lockedUntil
+		}
+		return attempt, nil
+	}
+	if err != pgx.ErrNoRows {
+		return LoginAttempt{}, fmt.Errorf("database error: %w", err)
+	}
+
+	// Locked: the WHERE clause skipped the update
+	err = s.db.QueryRow(ctx,
+		"SELECT failures, locked_until FROM login_attempts WHERE username = $1 AND source_ip = $2",
+		CanonicalUsername(username), sourceIP,
+	).Scan(&attempt.Failures, &attempt.LockedUntil)
+	if err != nil {
+		return LoginAttempt{}, fmt.Errorf("database error: %w", err)
+	}
+	return attempt, nil
+}
+
+// UndoLoginAttempt uncounts an attempt from BeginLoginAttempt whose
+// password could not be checked, e.g. because the server was busy.
+func (s *PostgresStore) UndoLoginAttempt(ctx context.Context, username, sourceIP string, maxFailures int) error {
+	_, err := s.db.Exec(ctx,
+		`
+        UPDATE login_attempts SET
+            failures = failures - 1,
+            locked_until = CASE WHEN failures - 1 >= $3 THEN locked_until END
+        WHERE username = $1 AND source_ip = $2 AND failures > 0
+        `, CanonicalUsername(username), sourceIP, maxFailures)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// ResetLoginAttempts clears the count for username from sourceIP after a
+// successful login.
+func (s *PostgresStore) ResetLoginAttempts(ctx context.Context, username, sourceIP string) error {
+	_, err := s.db.Exec(ctx, "DELETE FROM login_attempts WHERE username = $1 AND source_ip = $2", CanonicalUsername(username), sourceIP)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// PruneLoginAttempts deletes counts last touched before before whose lock,
+// if any, has also ended by then. It returns how many were deleted.
+func (s *PostgresStore) PruneLoginAttempts(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := s.db.Exec(ctx,
+		"DELETE FROM login_attempts WHERE last_attempt_at < $1 AND (locked_until IS NULL OR locked_until < $1)",
+		before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
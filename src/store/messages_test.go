@@ -0,0 +1,418 @@
+// src/store/messages_test.go
+package store
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var benchMessages = flag.Int("bench-messages", 200_000, "messages seeded for BenchmarkGetMessages; the plans diverge clearly from about 5000000")
+
+// TestGetMessagesDeletionAndPagination pages through a conversation after a
+// message is deleted at each place relative to the cursor, by each kind of
+// deletion, in each direction. The page must hold exactly the messages
+// after the cursor that the direction selects and whose row still exists,
+// with a stub for those whose reader copy was pruned, and paging on from
+// its last ID must pick up the next message and nothing twice.
+func TestGetMessagesDeletionAndPagination(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	// The conversation alternates senders, starting with the reader. The
+	// reader has fetched up to the cursor message; the page is the rest.
+	const (
+		messages = 6
+		cursor   = 2
+	)
+	positions := []struct {
+		name  string
+		index int
+	}{
+		{"behind the cursor", 1},
+		{"at the cursor", cursor},
+		{"just after the cursor", 3},
+		{"inside the page", 4},
+		{"at the end of the page", 5},
+	}
+	// How a message is deleted: one participant's copy is pruned, or both
+	// are and the row is removed
+	const (
+		readerCopy = iota
+		partnerCopy
+		bothCopies
+	)
+	kinds := []struct {
+		name string
+		kind int
+	}{
+		{"reader's copy pruned", readerCopy},
+		{"partner's copy pruned", partnerCopy},
+		{"row deleted", bothCopies},
+	}
+	directions := []string{DirectionBoth, DirectionIncoming, DirectionOutgoing}
+
+	n := 0
+	for _, pos := range positions {
+		for _, kind := range kinds {
+			for _, direction := range directions {
+				n++
+				name := fmt.Sprintf("%s/%s/%s", pos.name, kind.name, direction)
+				t.Run(name, func(t *testing.T) {
+					reader := mustRegister(t, s, fmt.Sprintf("reader%d", n))
+					partner := mustRegister(t, s, fmt.Sprintf("partner%d", n))
+					readerName, partnerName := fmt.Sprintf("reader%d", n), fmt.Sprintf("partner%d", n)
+
+					ids := make([]int, messages)
+					for i := range ids {
+						from, to := reader, partnerName
+						if i%2 == 1 {
+							from, to = partner, readerName
+						}
+						id, _, err := s.SendMessage(ctx, from, to, fmt.Sprintf("sender-%d", i), fmt.Sprintf("recipient-%d", i))
+						if err != nil {
+							t.Fatalf("sending message %d: %v", i, err)
+						}
+						ids[i] = id
+					}
+					sentByReader := func(i int) bool { return i%2 == 0 }
+
+					target := ids[pos.index]
+					var err error
+					switch {
+					case kind.kind == bothCopies:
+						_, err = s.db.Exec(ctx, "DELETE FROM messages WHERE id = $1", target)
+					case (kind.kind == readerCopy) == sentByReader(pos.index):
+						_, err = s.db.Exec(ctx, "UPDATE messages SET sender_blob = NULL WHERE id = $1", target)
+					default:
+						_, err = s.db.Exec(ctx, "UPDATE messages SET recipient_blob = NULL WHERE id = $1", target)
+					}
+					if err != nil {
+						t.Fatalf("deleting message %d: %v", pos.index, err)
+					}
+
+					type seen struct {
+						ID      int
+						Deleted bool
+						Blob    string
+					}
+					var want []seen
+					for i := cursor + 1; i < messages; i++ {
+						if i == pos.index && kind.kind == bothCopies {
+							continue
+						}
+						if direction == DirectionIncoming && sentByReader(i) || direction == DirectionOutgoing && !sentByReader(i) {
+							continue
+						}
+						m := seen{ID: ids[i], Blob: fmt.Sprintf("recipient-%d", i)}
+						if sentByReader(i) {
+							m.Blob = fmt.Sprintf("sender-%d", i)
+						}
+						if i == pos.index && kind.kind == readerCopy {
+							m = seen{ID: ids[i], Deleted: true}
+						}
+						want = append(want, m)
+					}
+					wantMax := ids[messages-1]
+					if pos.index == messages-1 && kind.kind == bothCopies {
+						wantMax = ids[messages-2]
+					}
+
+					page, snapshot, err := s.GetMessages(ctx, reader, partnerName, ids[cursor], direction)
+					if err != nil {
+						t.Fatal(err)
+					}
+					var got []seen
+					for _, m := range page {
+						got = append(got, seen{ID: m.ID, Deleted: m.Deleted, Blob: m.EncryptedBlob})
+					}
+					if !reflect.DeepEqual(got, want) {
+						t.Fatalf("page after the cursor:\ngot  %+v\nwant %+v", got, want)
+					}
+					if snapshot.MaxID != wantMax {
+						t.Errorf("max_id = %d, want %d", snapshot.MaxID, wantMax)
+					}
+
+					// Page on from the last ID received, or the same cursor if
+					// there was none: only a new message comes back
+					next := ids[cursor]
+					if len(page) > 0 {
+						next = page[len(page)-1].ID
+					}
+					from, to := partner, readerName
+					if direction == DirectionOutgoing {
+						from, to = reader, partnerName
+					}
+					newID, _, err := s.SendMessage(ctx, from, to, "sender-new", "recipient-new")
+					if err != nil {
+						t.Fatal(err)
+					}
+					page, _, err = s.GetMessages(ctx, reader, partnerName, next, direction)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(page) != 1 || page[0].ID != newID {
+						var got []int
+						for _, m := range page {
+							got = append(got, m.ID)
+						}
+						t.Errorf("next page from %d: %v, want only the new message %d", next, got, newID)
+					}
+				})
+			}
+		}
+	}
+}
+
+// seedConversation inserts n messages between a and b, alternating
+// senders and starting with a, and returns the ID of the last one.
+func seedConversation(tb testing.TB, s *PostgresStore, a, b, n int) int {
+	tb.Helper()
+	var last int
+	err := s.db.QueryRow(context.Background(),
+		`
+        WITH inserted AS (
+            INSERT INTO messages (sender_id, recipient_id, sender_blob, recipient_blob)
+            SELECT CASE WHEN i % 2 = 1 THEN $1::int ELSE $2::int END,
+                   CASE WHEN i % 2 = 1 THEN $2::int ELSE $1::int END,
+                   'sender-' || i, 'recipient-' || i
+            FROM generate_series(1, $3::int) i
+            RETURNING id
+        )
+        SELECT MAX(id) FROM inserted
+        `, a, b, n).Scan(&last)
+	if err != nil {
+		tb.Fatalf("seeding messages: %v", err)
+	}
+	return last
+}
+
+// TestGetMessagesPageLimit reads a conversation longer than a page. Each
+// read stops at MessagePageLimit, and paging on from the last ID returned
+// gets the rest, in order, with nothing skipped or repeated.
+func TestGetMessagesPageLimit(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	alice := mustRegister(t, s, "alice")
+	bob := mustRegister(t, s, "bob")
+	const total = MessagePageLimit + 5
+	last := seedConversation(t, s, alice, bob, total)
+
+	for _, direction := range []string{DirectionBoth, DirectionIncoming, DirectionOutgoing} {
+		t.Run(direction, func(t *testing.T) {
+			want := total
+			if direction != DirectionBoth {
+				want = total / 2
+				if direction == DirectionOutgoing {
+					want = total - total/2 // alice sends first
+				}
+			}
+			var got, pages int
+			prev := 0
+			for since := 0; ; pages++ {
+				page, snapshot, err := s.GetMessages(ctx, alice, "bob", since, direction)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(page) > MessagePageLimit {
+					t.Fatalf("page of %d messages, over the limit of %d", len(page), MessagePageLimit)
+				}
+				if snapshot.MaxID != last {
+					t.Errorf("max_id = %d, want %d", snapshot.MaxID, last)
+				}
+				if len(page) == 0 {
+					break
+				}
+				for _, m := range page {
+					if m.ID <= prev {
+						t.Fatalf("message %d after %d", m.ID, prev)
+					}
+					if incoming := m.SenderID == bob; direction == DirectionIncoming && !incoming || direction == DirectionOutgoing && incoming {
+						t.Fatalf("message %d from %d in a %s read", m.ID, m.SenderID, direction)
+					}
+					prev = m.ID
+				}
+				got += len(page)
+				since = prev
+			}
+			if got != want {
+				t.Errorf("read %d messages, want %d", got, want)
+			}
+			if wantPages := (want + MessagePageLimit - 1) / MessagePageLimit; pages != wantPages {
+				t.Errorf("read them in %d pages, want %d", pages, wantPages)
+			}
+		})
+	}
+}
+
+// BenchmarkGetMessages polls one conversation in a table of
+// -bench-messages messages among a thousand users, with the query
+// GetMessages runs (one index range scan per direction, merged) and with
+// the single OR query it replaced, which Postgres answers with a bitmap-or
+// over both indexes. The plans are logged with -v. To compare at scale:
+//
+//	go test ./store -run '^$' -bench BenchmarkGetMessages -bench-messages 5000000 -v
+func BenchmarkGetMessages(b *testing.B) {
+	s := newTestStore(b)
+	ctx := context.Background()
+	alice := mustRegister(b, s, "alice")
+	bob := mustRegister(b, s, "bob")
+
+	const users = 1000
+	_, err := s.db.Exec(ctx,
+		"INSERT INTO users (username, password_hash) SELECT 'user' || i, 'hash' FROM generate_series(1, $1::int) i", users)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var first int
+	if err := s.db.QueryRow(ctx, "SELECT MIN(id) FROM users WHERE username LIKE 'user%'").Scan(&first); err != nil {
+		b.Fatal(err)
+	}
+	// Everyone else's traffic, then a long conversation between alice and bob
+	_, err = s.db.Exec(ctx,
+		`
+        INSERT INTO messages (sender_id, recipient_id, sender_blob, recipient_blob)
+        SELECT $1::int + i % $2::int, $1::int + (i + 1 + (i / $2::int) % ($2::int - 1)) % $2::int, 'blob', 'blob'
+        FROM generate_series(1, $3::int) i
+        `, first, users, *benchMessages)
+	if err != nil {
+		b.Fatalf("seeding messages: %v", err)
+	}
+	last := seedConversation(b, s, alice, bob, 10_000)
+	if _, err := s.db.Exec(ctx, "ANALYZE messages"); err != nil {
+		b.Fatal(err)
+	}
+	// A client that is nearly caught up, as most polls are
+	since := last - 50
+
+	const orQuery = `
+        SELECT m.id, m.sender_id, m.recipient_id, m.timestamp, u.username,
+               CASE WHEN m.sender_id = $1 THEN m.sender_blob ELSE m.recipient_blob END
+        FROM messages m JOIN users u ON u.id = m.sender_id
+        WHERE ((m.sender_id = $1 AND m.recipient_id = $2) OR (m.sender_id = $2 AND m.recipient_id = $1)) AND m.id > $3
+        ORDER BY m.id ASC`
+	logPlan := func(name, query string, args ...interface{}) {
+		rows, err := s.db.Query(ctx, "EXPLAIN "+query, args...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer rows.Close()
+		var plan []string
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				b.Fatal(err)
+			}
+			plan = append(plan, line)
+		}
+		b.Logf("%s plan:\n%s", name, strings.Join(plan, "\n"))
+	}
+	logPlan("union_all", conversationPageQuery, alice, bob, since, DirectionBoth, MessagePageLimit)
+	logPlan("bitmap_or", orQuery, alice, bob, since)
+
+	b.Run("union_all", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			page, _, err := s.GetMessages(ctx, alice, "bob", since, DirectionBoth)
+			if err != nil || len(page) != 50 {
+				b.Fatalf("got %d messages, %v; want 50", len(page), err)
+			}
+		}
+	})
+	b.Run("bitmap_or", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rows, err := s.db.Query(ctx, orQuery, alice, bob, since)
+			if err != nil {
+				b.Fatal(err)
+			}
+			n := 0
+			for rows.Next() {
+				n++
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil || n != 50 {
+				b.Fatalf("got %d messages, %v; want 50", n, err)
+			}
+		}
+	})
+}
+
+// TestGetMessagesSwitchingDirection reads a conversation incoming only,
+// then switches filter while keeping the cursor. The cursor is a message ID
+// whatever the filter, so each read starts just after it; messages the
+// earlier filter skipped stay behind it. Each message carries the reader's
+// own copy: the sender's for outgoing, the recipient's for incoming.
+func TestGetMessagesSwitchingDirection(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	alice := mustRegister(t, s, "alice")
+	bob := mustRegister(t, s, "bob")
+
+	var ids []int
+	send := func(from int, to string) {
+		t.Helper()
+		i := len(ids)
+		id, _, err := s.SendMessage(ctx, from, to, fmt.Sprintf("sender-%d", i), fmt.Sprintf("recipient-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// read returns the indexes of the messages alice reads, checking each
+	// has her copy
+	read := func(since int, direction string) []int {
+		t.Helper()
+		page, _, err := s.GetMessages(ctx, alice, "bob", since, direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, m := range page {
+			i := slices.Index(ids, m.ID)
+			want := fmt.Sprintf("recipient-%d", i)
+			if m.SenderID == alice {
+				want = fmt.Sprintf("sender-%d", i)
+			}
+			if m.EncryptedBlob != want {
+				t.Errorf("%s read, message %d: blob %q, want %q", direction, i, m.EncryptedBlob, want)
+			}
+			got = append(got, i)
+		}
+		return got
+	}
+
+	for i := 0; i < 6; i++ {
+		if i%2 == 0 {
+			send(alice, "bob")
+		} else {
+			send(bob, "alice")
+		}
+	}
+	if got := read(0, DirectionIncoming); !reflect.DeepEqual(got, []int{1, 3, 5}) {
+		t.Fatalf("incoming from the start: %v, want 1 3 5", got)
+	}
+	cursor := ids[3]
+	if got := read(cursor, DirectionBoth); !reflect.DeepEqual(got, []int{4, 5}) {
+		t.Errorf("both from 3: %v, want 4 5", got)
+	}
+	if got := read(cursor, DirectionOutgoing); !reflect.DeepEqual(got, []int{4}) {
+		t.Errorf("outgoing from 3: %v, want 4", got)
+	}
+
+	// New messages after the cursor are picked up by each filter
+	cursor = ids[5]
+	send(bob, "alice")
+	send(alice, "bob")
+	if got := read(cursor, DirectionIncoming); !reflect.DeepEqual(got, []int{6}) {
+		t.Errorf("incoming from 5: %v, want 6", got)
+	}
+	if got := read(cursor, DirectionOutgoing); !reflect.DeepEqual(got, []int{7}) {
+		t.Errorf("outgoing from 5: %v, want 7", got)
+	}
+	if got := read(cursor, DirectionBoth); !reflect.DeepEqual(got, []int{6, 7}) {
+		t.Errorf("both from 5: %v, want 6 7", got)
+	}
+}
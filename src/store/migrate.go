@@ -0,0 +1,616 @@
+// src/store/migrate.go
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Versioned migrations live next to schema.sql in migrations/ as
+// NNNN_name.up.sql with an optional NNNN_name.down.sql. schema.sql remains
+// the idempotent baseline applied on every start; migrations run after it,
+// once each, and are recorded in schema_migrations.
+//
+// A migration file whose first line is noTransactionDirective runs outside
+// a transaction, for statements Postgres refuses inside one such as CREATE
+// INDEX CONCURRENTLY. Its statements run one at a time (see
+// splitStatements), so each should be safe to run again after a failure
+// part-way.
+
+// migrationLockID serialises migration runs across replicas.
+const migrationLockID = 7240001
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// noTransactionDirective, as the first line of a migration file, runs it
+// outside a transaction.
+const noTransactionDirective = "-- migrate:no-transaction"
+
+// Migration is one schema version.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string // Empty if the migration can't be reverted
+}
+
+// MigrationsDir returns the migrations directory belonging to schemaPath.
+func MigrationsDir(schemaPath string) string {
+	return filepath.Join(filepath.Dir(schemaPath), "migrations")
+}
+
+// LoadMigrations reads every migration in dir, sorted by version. A missing
+// directory means no migrations.
+func LoadMigrations(dir string) ([]Migration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not read migrations: %v", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		m := migrationFileRe.FindStringSubmatch(e.Name())
+		if e.IsDir() || m == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(m[1])
+		if version <= 0 {
+			return nil, fmt.Errorf("migration %s: version must be positive", e.Name())
+		}
+		sql, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read migration %s: %v", e.Name(), err)
+		}
+
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration version %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(sql)
+		} else {
+			mig.Down = string(sql)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no .up.sql", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies and reverts migrations. Unlike NewPostgresStore, opening
+// one changes nothing in the database.
+type Migrator struct {
+	db         *pgxpool.Pool
+	schemaPath string
+	migrations []Migration
+}
+
+// NewMigrator connects to the database and loads the migrations that belong
+// to schemaPath.
+func NewMigrator(databaseURL, schemaPath string) (*Migrator, error) {
+	migrations, err := LoadMigrations(MigrationsDir(schemaPath))
+	if err != nil {
+		return nil, err
+	}
+	pool, err := connect(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: pool, schemaPath: schemaPath, migrations: migrations}, nil
+}
+
+// Close closes the database connection pool.
+func (m *Migrator) Close() {
+	m.db.Close()
+}
+
+// latestKnown is the highest version this binary ships.
+func (m *Migrator) latestKnown() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// applied returns the recorded versions. A database that has never been
+// migrated has none.
+func (m *Migrator) applied(ctx context.Context) (map[int]bool, int, error) {
+	var exists bool
+	if err := m.db.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, 0, fmt.Errorf("database error: %w", err)
+	}
+	versions := make(map[int]bool)
+	if !exists {
+		return versions, 0, nil
+	}
+
+	rows, err := m.db.Query(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, 0, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+	highest := 0
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, 0, fmt.Errorf("database error: %w", err)
+		}
+		versions[v] = true
+		if v > highest {
+			highest = v
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("database error: %w", err)
+	}
+	return versions, highest, nil
+}
+
+// SchemaAheadError reports a database migrated past what this binary knows,
+// e.g. after rolling back a deploy without migrating down first.
+type SchemaAheadError struct {
+	DatabaseVersion int `json:"database_version"`
+	BinaryVersion   int `json:"binary_version"` // Highest migration this binary ships
+}
+
+func (e *SchemaAheadError) Error() string {
+	return fmt.Sprintf("database schema is at version %d but this binary only knows up to version %d; "+
+		"run a newer binary, or migrate down with the binary that applied version %d",
+		e.DatabaseVersion, e.BinaryVersion, e.DatabaseVersion)
+}
+
+// IsSchemaAhead returns the SchemaAheadError in err's chain, if any.
+func IsSchemaAhead(err error) (*SchemaAheadError, bool) {
+	var ahead *SchemaAheadError
+	ok := errors.As(err, &ahead)
+	return ahead, ok
+}
+
+// CheckVersion refuses a database whose schema is newer than this binary
+// with a *SchemaAheadError.
+func (m *Migrator) CheckVersion(ctx context.Context) error {
+	_, highest, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	if highest > m.latestKnown() {
+		return &SchemaAheadError{DatabaseVersion: highest, BinaryVersion: m.latestKnown()}
+	}
+	return nil
+}
+
+// NoTransaction reports whether sql (an up or down migration) runs outside
+// a transaction.
+func NoTransaction(sql string) bool {
+	first, _, _ := strings.Cut(strings.TrimLeft(sql, " \t\r\n"), "\n")
+	return strings.TrimSpace(first) == noTransactionDirective
+}
+
+// splitStatements splits a no-transaction migration into the statements it
+// runs one by one: a statement ends at a semicolon that ends a line.
+// Comment-only and blank lines between statements are dropped.
+func splitStatements(sql string) []string {
+	var stmts []string
+	var cur strings.Builder
+	for _, line := range strings.Split(sql, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if cur.Len() == 0 && (trimmed == "" || strings.HasPrefix(trimmed, "--")) {
+			continue
+		}
+		cur.WriteString(line)
+		cur.WriteByte('\n')
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(cur.String()); rest != "" {
+		stmts = append(stmts, rest)
+	}
+	return stmts
+}
+
+// Backfills returns the names of the backfills registered under mig, which
+// run after it is applied (see backfill.go).
+func (mig Migration) Backfills() []string {
+	var names []string
+	for _, b := range backfillsFor(mig.Version) {
+		names = append(names, b.name())
+	}
+	return names
+}
+
+// Pending returns the migrations that Up would apply.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	if err := m.CheckVersion(ctx); err != nil {
+		return nil, err
+	}
+	versions, _, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, mig := range m.migrations {
+		if !versions[mig.Version] {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// WriteDryRun writes what -migrate-dry-run prints: each of pending with
+// its SQL and the backfills it starts.
+func WriteDryRun(w io.Writer, schemaPath string, pending []Migration) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "-- %s is re-applied on every start (idempotent)\n", schemaPath)
+	if len(pending) == 0 {
+		b.WriteString("-- No pending migrations.\n")
+	}
+	for _, mig := range pending {
+		fmt.Fprintf(&b, "\n-- Migration %04d_%s\n", mig.Version, mig.Name)
+		if NoTransaction(mig.Up) {
+			b.WriteString("-- Runs outside a transaction, one statement at a time\n")
+		}
+		fmt.Fprintf(&b, "%s\n", strings.TrimSpace(mig.Up))
+		for _, name := range mig.Backfills() {
+			fmt.Fprintf(&b, "-- Then backfills %s in batches after startup (or with -backfill-only)\n", name)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Baseline returns the contents of schema.sql.
+func (m *Migrator) Baseline() (string, error) {
+	schemaSQL, err := os.ReadFile(m.schemaPath)
+	if err != nil {
+		return "", fmt.Errorf("could not read schema file: %v", err)
+	}
+	return string(schemaSQL), nil
+}
+
+// Up applies schema.sql and then every pending migration, each in its own
+// transaction. It returns the migrations applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	if err := m.CheckVersion(ctx); err != nil {
+		return nil, err
+	}
+
+	baseline, err := m.Baseline()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkUsernameCollisions(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := m.db.Exec(ctx, baseline); err != nil {
+		return nil, fmt.Errorf("failed to apply schema: %v", err)
+	}
+	if _, err := m.db.Exec(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INTEGER PRIMARY KEY,
+            name TEXT NOT NULL,
+            applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        )`); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	// Progress of the backfills in backfill.go, one row per backfill whose
+	// migration is applied
+	if _, err := m.db.Exec(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_backfills (
+            version INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            last_key BIGINT NOT NULL DEFAULT 0,
+            rows_done BIGINT NOT NULL DEFAULT 0,
+            started_at TIMESTAMPTZ,
+            done_at TIMESTAMPTZ,
+            PRIMARY KEY (version, name)
+        )`); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	var ran []Migration
+	for _, mig := range m.migrations {
+		applied, err := m.apply(ctx, mig)
+		if err != nil {
+			return ran, err
+		}
+		if applied {
+			ran = append(ran, mig)
+		}
+	}
+	return ran, nil
+}
+
+// checkUsernameCollisions fails, naming them, if usernames differ only in
+// case. schema.sql's users_username_canonical_idx can't be created over
+// them, and lookups by name couldn't tell them apart; an operator has to
+// rename one of each set. At most 20 sets are listed. Once the index
+// exists there can be none.
+func (m *Migrator) checkUsernameCollisions(ctx context.Context) error {
+	var check bool
+	err := m.db.QueryRow(ctx, `
+        SELECT to_regclass('users') IS NOT NULL
+           AND to_regclass('users_username_canonical_idx') IS NULL`,
+	).Scan(&check)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if !check {
+		return nil
+	}
+
+	rows, err := m.db.Query(ctx, `
+        SELECT string_agg(format('%s (id %s)', username, id), ', ' ORDER BY id)
+        FROM users GROUP BY lower(username) HAVING COUNT(*) > 1
+        ORDER BY lower(username) LIMIT 20`)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	var sets []string
+	for rows.Next() {
+		var set string
+		if err := rows.Scan(&set); err != nil {
+			rows.Close()
+			return fmt.Errorf("database scan error: %w", err)
+		}
+		sets = append(sets, set)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if len(sets) > 0 {
+		return fmt.Errorf("usernames must be unique ignoring case; rename all but one of each before upgrading: %s",
+			strings.Join(sets, "; "))
+	}
+	return nil
+}
+
+// apply runs one up migration unless another replica already has.
+func (m *Migrator) apply(ctx context.Context, mig Migration) (bool, error) {
+	if NoTransaction(mig.Up) {
+		return m.applyNoTx(ctx, mig)
+	}
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	var done bool
+	if err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", mig.Version).Scan(&done); err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	if done {
+		return false, nil
+	}
+
+	if _, err := tx.Exec(ctx, mig.Up); err != nil {
+		return false, fmt.Errorf("migration %04d_%s failed: %v", mig.Version, mig.Name, err)
+	}
+	if err := recordApplied(ctx, tx, mig); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return true, nil
+}
+
+// recordApplied records mig and its backfills as applied.
+func recordApplied(ctx context.Context, tx pgx.Tx, mig Migration) error {
+	if _, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", mig.Version, mig.Name); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	for _, b := range backfillsFor(mig.Version) {
+		if _, err := tx.Exec(ctx, "INSERT INTO schema_backfills (version, name) VALUES ($1, $2)", mig.Version, b.name()); err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+	}
+	return nil
+}
+
+// withSessionLock runs f on one connection holding the migration lock at
+// session level, for migrations that can't run in a transaction to hold
+// pg_advisory_xact_lock in.
+func (m *Migrator) withSessionLock(ctx context.Context, f func(conn *pgxpool.Conn) error) error {
+	conn, err := m.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer func() {
+		// A connection whose unlock failed goes back to the pool still
+		// holding the lock; close it instead
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+			conn.Conn().Close(context.Background())
+		}
+	}()
+	return f(conn)
+}
+
+// applyNoTx runs a no-transaction up migration. If a statement fails, the
+// ones before it stay applied and the migration is not recorded, so the
+// next start runs it again from the top.
+func (m *Migrator) applyNoTx(ctx context.Context, mig Migration) (bool, error) {
+	applied := false
+	err := m.withSessionLock(ctx, func(conn *pgxpool.Conn) error {
+		var done bool
+		if err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", mig.Version).Scan(&done); err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		if done {
+			return nil
+		}
+		for _, stmt := range splitStatements(mig.Up) {
+			if _, err := conn.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("migration %04d_%s failed: %v", mig.Version, mig.Name, err)
+			}
+		}
+		// CREATE INDEX CONCURRENTLY IF NOT EXISTS skips an index left
+		// invalid by an earlier, interrupted build, so check for one
+		if err := checkInvalidIndexes(ctx, conn); err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", mig.Version, mig.Name, err)
+		}
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		defer tx.Rollback(ctx)
+		if err := recordApplied(ctx, tx, mig); err != nil {
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		applied = true
+		return nil
+	})
+	return applied, err
+}
+
+// checkInvalidIndexes fails, naming them, if any index in the current
+// schema is invalid: what a failed CREATE INDEX CONCURRENTLY leaves behind.
+func checkInvalidIndexes(ctx context.Context, conn *pgxpool.Conn) error {
+	var names []string
+	err := conn.QueryRow(ctx, `
+        SELECT COALESCE(array_agg(c.relname::text ORDER BY c.relname), '{}')
+        FROM pg_index i JOIN pg_class c ON c.oid = i.indexrelid
+        WHERE NOT i.indisvalid AND c.relnamespace = current_schema()::regnamespace`,
+	).Scan(&names)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("invalid indexes left by an interrupted build: %s; drop them with DROP INDEX CONCURRENTLY and restart",
+			strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// Down reverts applied migrations newer than target, newest first. Nothing
+// is reverted unless every one of them has a down migration. It returns the
+// migrations reverted.
+func (m *Migrator) Down(ctx context.Context, target int) ([]Migration, error) {
+	if target < 0 {
+		return nil, fmt.Errorf("target version must not be negative")
+	}
+	if err := m.CheckVersion(ctx); err != nil {
+		return nil, err
+	}
+	versions, _, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var revert []Migration
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if mig.Version <= target || !versions[mig.Version] {
+			continue
+		}
+		if mig.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no .down.sql and cannot be reverted", mig.Version, mig.Name)
+		}
+		revert = append(revert, mig)
+	}
+
+	var ran []Migration
+	for _, mig := range revert {
+		if err := m.revert(ctx, mig); err != nil {
+			return ran, err
+		}
+		ran = append(ran, mig)
+	}
+	return ran, nil
+}
+
+func (m *Migrator) revert(ctx context.Context, mig Migration) error {
+	if NoTransaction(mig.Down) {
+		return m.revertNoTx(ctx, mig)
+	}
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if _, err := tx.Exec(ctx, mig.Down); err != nil {
+		return fmt.Errorf("down migration %04d_%s failed: %v", mig.Version, mig.Name, err)
+	}
+	if err := recordReverted(ctx, tx, mig); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// recordReverted forgets mig and its backfills.
+func recordReverted(ctx context.Context, tx pgx.Tx, mig Migration) error {
+	if _, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", mig.Version); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM schema_backfills WHERE version = $1", mig.Version); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// revertNoTx runs a no-transaction down migration, like applyNoTx.
+func (m *Migrator) revertNoTx(ctx context.Context, mig Migration) error {
+	return m.withSessionLock(ctx, func(conn *pgxpool.Conn) error {
+		for _, stmt := range splitStatements(mig.Down) {
+			if _, err := conn.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("down migration %04d_%s failed: %v", mig.Version, mig.Name, err)
+			}
+		}
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		defer tx.Rollback(ctx)
+		if err := recordReverted(ctx, tx, mig); err != nil {
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,486 @@
+// src/store/migrate_test.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptachat-server/testutil"
+)
+
+func TestMigrationFilesArePairedAndContiguous(t *testing.T) {
+	entries, err := os.ReadDir("migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]bool)
+	for _, e := range entries {
+		files[e.Name()] = true
+	}
+	for name := range files {
+		if base, ok := strings.CutSuffix(name, ".up.sql"); ok && !files[base+".down.sql"] {
+			t.Errorf("%s has no %s.down.sql", name, base)
+		}
+		if base, ok := strings.CutSuffix(name, ".down.sql"); ok && !files[base+".up.sql"] {
+			t.Errorf("%s has no %s.up.sql", name, base)
+		}
+		if strings.HasSuffix(name, ".sql") && !migrationFileRe.MatchString(name) {
+			t.Errorf("%s doesn't match NNNN_name.up.sql or NNNN_name.down.sql", name)
+		}
+	}
+
+	migrations, err := LoadMigrations("migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations loaded")
+	}
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			t.Fatalf("migration %04d_%s follows version %d; versions must count up from 1 without gaps", mig.Version, mig.Name, i)
+		}
+		if strings.TrimSpace(mig.Down) == "" {
+			t.Errorf("migration %04d_%s can't be reverted", mig.Version, mig.Name)
+		}
+	}
+}
+
+func TestLoadMigrationsRejectsMissingUp(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/0001_orphan.down.sql", []byte("SELECT 1;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadMigrations(dir); err == nil {
+		t.Fatal("a down migration without an up one was accepted")
+	}
+}
+
+func TestWriteDryRunListsPending(t *testing.T) {
+	migrations, err := LoadMigrations("migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := migrations[len(migrations)-3:]
+
+	var out strings.Builder
+	if err := WriteDryRun(&out, "store/schema.sql", pending); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	if !strings.HasPrefix(got, "-- store/schema.sql is re-applied on every start") {
+		t.Errorf("dry run doesn't start with the baseline note:\n%s", got)
+	}
+	for _, mig := range pending {
+		header := fmt.Sprintf("-- Migration %04d_%s\n", mig.Version, mig.Name)
+		if NoTransaction(mig.Up) {
+			header += "-- Runs outside a transaction, one statement at a time\n"
+		}
+		if !strings.Contains(got, header+strings.TrimSpace(mig.Up)) {
+			t.Errorf("dry run lacks %q followed by its SQL", strings.TrimSpace(header))
+		}
+	}
+	for _, mig := range migrations[:len(migrations)-3] {
+		if strings.Contains(got, fmt.Sprintf("-- Migration %04d_", mig.Version)) {
+			t.Errorf("dry run lists %04d, which isn't pending", mig.Version)
+		}
+	}
+
+	out.Reset()
+	if err := WriteDryRun(&out, "store/schema.sql", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "-- No pending migrations.") {
+		t.Errorf("dry run without pending migrations:\n%s", out.String())
+	}
+}
+
+func TestWriteDryRunNamesBackfills(t *testing.T) {
+	var mig Migration
+	for _, b := range backfills {
+		mig = Migration{Version: b.Version, Name: "with_backfill", Up: "SELECT 1;"}
+		break
+	}
+	if mig.Version == 0 {
+		t.Skip("no backfills registered")
+	}
+	var out strings.Builder
+	if err := WriteDryRun(&out, "schema.sql", []Migration{mig}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range mig.Backfills() {
+		if !strings.Contains(out.String(), "-- Then backfills "+name+" ") {
+			t.Errorf("dry run doesn't mention backfill %s:\n%s", name, out.String())
+		}
+	}
+}
+
+func TestNoTransactionDirective(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{"-- migrate:no-transaction\nCREATE INDEX CONCURRENTLY x ON t (a);", true},
+		{"\n  -- migrate:no-transaction  \r\nDROP INDEX CONCURRENTLY x;", true},
+		{"-- migrate:no-transaction", true},
+		{"-- Builds x\n-- migrate:no-transaction\nCREATE INDEX x ON t (a);", false},
+		{"CREATE INDEX x ON t (a); -- migrate:no-transaction", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := NoTransaction(tt.sql); got != tt.want {
+			t.Errorf("NoTransaction(%q) = %v, want %v", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	sql := `-- migrate:no-transaction
+-- Drops what an interrupted run left
+
+DROP INDEX CONCURRENTLY IF EXISTS a_idx;
+CREATE INDEX CONCURRENTLY IF NOT EXISTS a_idx
+    ON t (a) -- the column clients filter on
+    WHERE b;
+
+-- Trailing comment
+CREATE INDEX CONCURRENTLY IF NOT EXISTS b_idx ON t (b)`
+	want := []string{
+		"DROP INDEX CONCURRENTLY IF EXISTS a_idx;",
+		"CREATE INDEX CONCURRENTLY IF NOT EXISTS a_idx\n    ON t (a) -- the column clients filter on\n    WHERE b;",
+		"CREATE INDEX CONCURRENTLY IF NOT EXISTS b_idx ON t (b)",
+	}
+	got := splitStatements(sql)
+	if len(got) != len(want) {
+		t.Fatalf("got %d statements %q, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("statement %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+// TestConcurrentlyOnlyOutsideTransactions keeps index builds on existing
+// tables out of schema.sql and transactional migrations, where they would
+// block writes, and CONCURRENTLY out of transactions, where Postgres
+// refuses it.
+func TestConcurrentlyOnlyOutsideTransactions(t *testing.T) {
+	migrations, err := LoadMigrations("migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mig := range migrations {
+		for dir, sql := range map[string]string{"up": mig.Up, "down": mig.Down} {
+			if strings.Contains(strings.ToUpper(sql), "CONCURRENTLY") && !NoTransaction(sql) {
+				t.Errorf("%04d_%s.%s.sql uses CONCURRENTLY inside a transaction; start it with %q", mig.Version, mig.Name, dir, noTransactionDirective)
+			}
+		}
+	}
+	schema, err := os.ReadFile("schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index, version := range map[string]int{
+		"messages_recipient_timestamp_idx": 24,
+		"messages_sender_recipient_id_idx": 26,
+		"messages_recipient_sender_id_idx": 26,
+	} {
+		if strings.Contains(string(schema), index+" ON") {
+			t.Errorf("schema.sql builds %s again; migration %04d does, concurrently", index, version)
+		}
+	}
+}
+
+func TestWriteDryRunMarksNoTransaction(t *testing.T) {
+	mig := Migration{Version: 99, Name: "concurrent_idx", Up: noTransactionDirective + "\nCREATE INDEX CONCURRENTLY x ON t (a);"}
+	var out strings.Builder
+	if err := WriteDryRun(&out, "schema.sql", []Migration{mig}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "-- Migration 0099_concurrent_idx\n-- Runs outside a transaction") {
+		t.Errorf("dry run doesn't say the migration runs outside a transaction:\n%s", out.String())
+	}
+}
+
+// TestMigratorUpDownUp applies every migration to an empty schema, reverts
+// them all, and applies them again, so each down migration is checked
+// against its up migration and a reverted database can be migrated again.
+func TestMigratorUpDownUp(t *testing.T) {
+	url := testutil.DatabaseURL(t)
+	ctx := context.Background()
+	m, err := NewMigrator(url, "schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	latest := m.latestKnown()
+
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != latest {
+		t.Fatalf("%d pending on an empty schema, want %d", len(pending), latest)
+	}
+
+	for round := 1; round <= 2; round++ {
+		ran, err := m.Up(ctx)
+		if err != nil {
+			t.Fatalf("round %d: up: %v", round, err)
+		}
+		if len(ran) != latest {
+			t.Fatalf("round %d: up applied %d migrations, want %d", round, len(ran), latest)
+		}
+		if again, err := m.Up(ctx); err != nil || len(again) != 0 {
+			t.Fatalf("round %d: second up applied %d, %v; want none", round, len(again), err)
+		}
+		if pending, err := m.Pending(ctx); err != nil || len(pending) != 0 {
+			t.Fatalf("round %d: %d pending after up, %v", round, len(pending), err)
+		}
+
+		reverted, err := m.Down(ctx, 0)
+		if err != nil {
+			t.Fatalf("round %d: down: %v", round, err)
+		}
+		if len(reverted) != latest || reverted[0].Version != latest {
+			t.Fatalf("round %d: down reverted %d migrations, want all %d, newest first", round, len(reverted), latest)
+		}
+		if pending, err := m.Pending(ctx); err != nil || len(pending) != latest {
+			t.Fatalf("round %d: %d pending after down, %v", round, len(pending), err)
+		}
+	}
+
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if reverted, err := m.Down(ctx, latest-1); err != nil || len(reverted) != 1 {
+		t.Fatalf("down to %d reverted %d, %v; want 1", latest-1, len(reverted), err)
+	}
+	if pending, err := m.Pending(ctx); err != nil || len(pending) != 1 || pending[0].Version != latest {
+		t.Fatalf("pending after reverting one = %v, %v", pending, err)
+	}
+}
+
+func TestMigratorRefusesSchemaAhead(t *testing.T) {
+	url := testutil.DatabaseURL(t)
+	ctx := context.Background()
+	m, err := NewMigrator(url, "schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ahead := m.latestKnown() + 1
+	if _, err := m.db.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, 'from_the_future')", ahead); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, run := range map[string]func() error{
+		"up":      func() error { _, err := m.Up(ctx); return err },
+		"down":    func() error { _, err := m.Down(ctx, 0); return err },
+		"pending": func() error { _, err := m.Pending(ctx); return err },
+	} {
+		e, ok := IsSchemaAhead(run())
+		if !ok {
+			t.Errorf("%s: not refused as schema ahead", name)
+			continue
+		}
+		if e.DatabaseVersion != ahead || e.BinaryVersion != ahead-1 {
+			t.Errorf("%s: versions %d/%d, want %d/%d", name, e.DatabaseVersion, e.BinaryVersion, ahead, ahead-1)
+		}
+	}
+
+	s, err := NewPostgresStore(url, "schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.SchemaAhead() == nil {
+		t.Error("store opened on a newer schema doesn't report it")
+	}
+}
+
+// roundTripMigration opens a store on a fresh schema of the test database
+// with every migration applied, reverts migrations down to before version,
+// and applies them again. applied runs after each up and reverted after
+// the down, to check what the migration adds and that reverting removes it.
+func roundTripMigration(t *testing.T, version int, applied, reverted func(s *PostgresStore)) {
+	t.Helper()
+	url := testutil.DatabaseURL(t)
+	ctx := context.Background()
+	s, err := NewPostgresStore(url, "schema.sql")
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(s.Close)
+	m, err := NewMigrator(url, "schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+
+	applied(s)
+	ran, err := m.Down(ctx, version-1)
+	if err != nil {
+		t.Fatalf("down to %d: %v", version-1, err)
+	}
+	if len(ran) == 0 || ran[len(ran)-1].Version != version {
+		t.Fatalf("down to %d reverted %v, want through %d", version-1, ran, version)
+	}
+	reverted(s)
+	if ran, err := m.Up(ctx); err != nil || len(ran) == 0 || ran[0].Version != version {
+		t.Fatalf("up again applied %v, %v; want from %d", ran, err, version)
+	}
+	applied(s)
+}
+
+// relationExists reports whether the test schema has table, or column of
+// table if column isn't empty.
+func relationExists(t *testing.T, s *PostgresStore, table, column string) bool {
+	t.Helper()
+	var exists bool
+	err := s.db.QueryRow(context.Background(),
+		`
+        SELECT EXISTS (
+            SELECT 1 FROM information_schema.columns
+            WHERE table_schema = current_schema() AND table_name = $1 AND ($2 = '' OR column_name = $2)
+        )
+        `, table, column).Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+// TestRelationshipVersionsMigration runs migration 22 up, down and up. The
+// counters work after each up; reverting drops them, and migrating up
+// again restarts them at 0, as its down migration warns.
+func TestRelationshipVersionsMigration(t *testing.T) {
+	ctx := context.Background()
+	var alice int
+	applied := func(s *PostgresStore) {
+		t.Helper()
+		if alice == 0 {
+			alice = mustRegister(t, s, "alice")
+		}
+		if v, err := s.GetRelationshipsVersion(ctx, alice); err != nil || v != 0 {
+			t.Fatalf("version before any change: %d, %v; want 0", v, err)
+		}
+		tx, err := s.db.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback(ctx)
+		if err := bumpRelationshipsVersions(ctx, tx, alice, alice); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := s.GetRelationshipsVersion(ctx, alice); err != nil || v != 1 {
+			t.Errorf("version after a change: %d, %v; want 1", v, err)
+		}
+		if !relationExists(t, s, "cache_invalidations", "relationships_version") {
+			t.Error("cache_invalidations.relationships_version is missing")
+		}
+	}
+	reverted := func(s *PostgresStore) {
+		t.Helper()
+		if relationExists(t, s, "relationship_versions", "") {
+			t.Error("relationship_versions is still there")
+		}
+		if relationExists(t, s, "cache_invalidations", "relationships_version") {
+			t.Error("cache_invalidations.relationships_version is still there")
+		}
+		if _, err := s.GetRelationshipsVersion(ctx, alice); err == nil {
+			t.Error("reading a version worked without the table")
+		}
+	}
+	roundTripMigration(t, 22, applied, reverted)
+}
+
+// TestRegistrationChallengesMigration runs migration 23 up, down and up.
+// Challenges can be issued and redeemed after each up, and one left
+// outstanding doesn't survive the round trip, as its down migration says.
+func TestRegistrationChallengesMigration(t *testing.T) {
+	ctx := context.Background()
+	applied := func(s *PostgresStore) {
+		t.Helper()
+		_, err := s.ConsumeRegistrationChallenge(ctx, "outstanding")
+		wantErr(t, "a challenge from before the migration", err, "challenge not found")
+
+		expires := s.clock.Now().Add(time.Hour)
+		if err := s.CreateRegistrationChallenge(ctx, "fresh", 12, expires); err != nil {
+			t.Fatal(err)
+		}
+		if d, err := s.ConsumeRegistrationChallenge(ctx, "fresh"); err != nil || d != 12 {
+			t.Errorf("redeeming: %d, %v; want difficulty 12", d, err)
+		}
+		if err := s.CreateRegistrationChallenge(ctx, "outstanding", 12, expires); err != nil {
+			t.Fatal(err)
+		}
+
+		var indexed bool
+		if err := s.db.QueryRow(ctx,
+			"SELECT EXISTS (SELECT 1 FROM pg_indexes WHERE schemaname = current_schema() AND indexname = 'registration_challenges_expires_idx')",
+		).Scan(&indexed); err != nil {
+			t.Fatal(err)
+		}
+		if !indexed {
+			t.Error("registration_challenges_expires_idx is missing")
+		}
+	}
+	reverted := func(s *PostgresStore) {
+		t.Helper()
+		if relationExists(t, s, "registration_challenges", "") {
+			t.Error("registration_challenges is still there")
+		}
+		if err := s.CreateRegistrationChallenge(ctx, "late", 12, s.clock.Now().Add(time.Hour)); err == nil {
+			t.Error("issuing a challenge worked without the table")
+		}
+	}
+	roundTripMigration(t, 23, applied, reverted)
+}
+
+// indexExists reports whether the test schema has the index name.
+func indexExists(t *testing.T, s *PostgresStore, name string) bool {
+	t.Helper()
+	var exists bool
+	err := s.db.QueryRow(context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM pg_indexes WHERE schemaname = current_schema() AND indexname = $1)",
+		name).Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+// TestConversationIndexesMigration runs migration 26 up, down and up. The
+// two conversation indexes come and go with it.
+func TestConversationIndexesMigration(t *testing.T) {
+	indexes := []string{"messages_sender_recipient_id_idx", "messages_recipient_sender_id_idx"}
+	applied := func(s *PostgresStore) {
+		t.Helper()
+		for _, name := range indexes {
+			if !indexExists(t, s, name) {
+				t.Errorf("%s is missing", name)
+			}
+		}
+	}
+	reverted := func(s *PostgresStore) {
+		t.Helper()
+		for _, name := range indexes {
+			if indexExists(t, s, name) {
+				t.Errorf("%s is still there", name)
+			}
+		}
+	}
+	roundTripMigration(t, 26, applied, reverted)
+}
@@ -0,0 +1 @@
+ALTER TABLE chat_requests DROP COLUMN accepted_at;
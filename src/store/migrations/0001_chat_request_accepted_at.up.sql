@@ -0,0 +1,4 @@
+-- When a chat request was accepted. Requests accepted before this column
+-- existed get their created_at, the closest time on record.
+ALTER TABLE chat_requests ADD COLUMN accepted_at TIMESTAMPTZ;
+UPDATE chat_requests SET accepted_at = created_at WHERE status = 'accepted';
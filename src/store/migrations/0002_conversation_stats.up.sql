@@ -0,0 +1,30 @@
+-- Per-conversation counters, so operators and /account/summary don't have to
+-- aggregate the messages table. user_low is always the smaller user ID;
+-- low_* columns describe user_low's side and high_* user_high's. *_bytes are
+-- the blob bytes still stored on behalf of that side.
+CREATE TABLE conversation_stats (
+    user_low INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    user_high INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    low_sent BIGINT NOT NULL DEFAULT 0,
+    high_sent BIGINT NOT NULL DEFAULT 0,
+    low_bytes BIGINT NOT NULL DEFAULT 0,
+    high_bytes BIGINT NOT NULL DEFAULT 0,
+    last_message_at TIMESTAMPTZ,
+    PRIMARY KEY (user_low, user_high),
+    CHECK (user_low < user_high)
+);
+
+CREATE INDEX conversation_stats_user_high_idx ON conversation_stats (user_high);
+
+INSERT INTO conversation_stats (user_low, user_high, low_sent, high_sent, low_bytes, high_bytes, last_message_at)
+SELECT
+    LEAST(sender_id, recipient_id),
+    GREATEST(sender_id, recipient_id),
+    COUNT(*) FILTER (WHERE sender_id < recipient_id),
+    COUNT(*) FILTER (WHERE sender_id > recipient_id),
+    COALESCE(SUM(CASE WHEN sender_id < recipient_id THEN octet_length(sender_blob) ELSE octet_length(recipient_blob) END), 0),
+    COALESCE(SUM(CASE WHEN sender_id > recipient_id THEN octet_length(sender_blob) ELSE octet_length(recipient_blob) END), 0),
+    MAX(timestamp)
+FROM messages
+WHERE sender_id <> recipient_id
+GROUP BY 1, 2;
@@ -0,0 +1,8 @@
+-- Sealed messages can't be given a sender back, so reverting deletes them.
+DELETE FROM messages WHERE sender_id IS NULL;
+DROP INDEX messages_sealed_recipient_idx;
+ALTER TABLE messages ALTER COLUMN sender_id SET NOT NULL;
+
+ALTER TABLE chat_requests
+    DROP COLUMN requester_sealed_sender,
+    DROP COLUMN requested_sealed_sender;
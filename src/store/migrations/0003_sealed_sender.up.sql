@@ -0,0 +1,9 @@
+-- Sealed-sender messages store no sender: sender_id and sender_blob are NULL
+-- and only the recipient's copy is kept.
+ALTER TABLE messages ALTER COLUMN sender_id DROP NOT NULL;
+CREATE INDEX messages_sealed_recipient_idx ON messages (recipient_id, id) WHERE sender_id IS NULL;
+
+-- Each side of an accepted contact opts in separately; sealed sends need both.
+ALTER TABLE chat_requests
+    ADD COLUMN requester_sealed_sender BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN requested_sealed_sender BOOLEAN NOT NULL DEFAULT FALSE;
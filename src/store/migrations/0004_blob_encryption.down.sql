@@ -0,0 +1,14 @@
+-- An older binary would serve the ciphertext as if it were the blob, so
+-- refuse to revert until everything has been decrypted (-decrypt-blobs).
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM messages WHERE blob_key_id IS NOT NULL)
+       OR EXISTS (SELECT 1 FROM key_backups WHERE blob_key_id IS NOT NULL) THEN
+        RAISE EXCEPTION 'encrypted blobs remain; run -decrypt-blobs before reverting migration 4';
+    END IF;
+END
+$$;
+
+ALTER TABLE messages DROP COLUMN blob_key_id;
+ALTER TABLE key_backups DROP COLUMN blob_key_id;
+DROP TABLE blob_keys;
@@ -0,0 +1,12 @@
+-- At-rest envelope encryption of blobs (see store/blobkeys.go). Data keys
+-- are stored wrapped by a master key that only the server's config holds.
+-- A row whose blob_key_id is NULL is stored in plaintext.
+CREATE TABLE blob_keys (
+    id TEXT PRIMARY KEY,
+    master_key_id TEXT NOT NULL,
+    wrapped_key BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+ALTER TABLE messages ADD COLUMN blob_key_id TEXT REFERENCES blob_keys (id);
+ALTER TABLE key_backups ADD COLUMN blob_key_id TEXT REFERENCES blob_keys (id);
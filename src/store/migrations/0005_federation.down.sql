@@ -0,0 +1,7 @@
+-- Stand-in users go too, taking their chat requests and messages with them.
+DELETE FROM users WHERE id IN (SELECT user_id FROM remote_users);
+
+DROP TABLE federation_inbox;
+DROP TABLE federation_peers;
+DROP TABLE federation_outbox;
+DROP TABLE remote_users;
@@ -0,0 +1,51 @@
+-- Instance-to-instance relay (see store/federation.go). A user on a peer
+-- instance is stood in for by a local users row named "user@peer" that
+-- can't log in, so chat requests and messages with them need no changes.
+CREATE TABLE remote_users (
+    user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    peer TEXT NOT NULL,
+    remote_username TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX remote_users_address_idx ON remote_users (peer, lower(remote_username));
+
+-- Chat requests, acceptances and messages waiting to be relayed to a peer.
+-- A message's blob is read from messages when it is sent, not copied here.
+CREATE TABLE federation_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    peer TEXT NOT NULL,
+    kind TEXT NOT NULL, -- 'chat_request', 'chat_accept', 'message'
+    from_user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    to_user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    message_id INTEGER,
+    status TEXT NOT NULL DEFAULT 'pending', -- 'pending', 'sending', 'delivered', 'failed'
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL,
+    claimed_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX federation_outbox_unfinished_idx ON federation_outbox (peer, id) WHERE status IN ('pending', 'sending');
+CREATE INDEX federation_outbox_finished_idx ON federation_outbox (finished_at) WHERE finished_at IS NOT NULL;
+
+-- Backoff per peer: while a peer is unreachable all its relays wait
+-- together, so they are still delivered in order.
+CREATE TABLE federation_peers (
+    peer TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    retry_at TIMESTAMPTZ,
+    last_error TEXT,
+    last_success_at TIMESTAMPTZ
+);
+
+-- Relayed messages received from each peer, so a redelivery after a lost
+-- response isn't stored twice.
+CREATE TABLE federation_inbox (
+    peer TEXT NOT NULL,
+    relay_id BIGINT NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (peer, relay_id)
+);
+
+CREATE INDEX federation_inbox_received_idx ON federation_inbox (received_at);
@@ -0,0 +1,3 @@
+-- Reverting logs every client out of its refresh token; access tokens
+-- keep working until they expire.
+DROP TABLE refresh_tokens;
@@ -0,0 +1,17 @@
+-- Refresh tokens (see store/refresh_tokens.go). Only a SHA-256 of each
+-- token is stored. A login starts a family; every refresh replaces the
+-- token with a new one in the same family and marks the old one used.
+CREATE TABLE refresh_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    family_id TEXT NOT NULL,
+    token_hash BYTEA NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,   -- Exchanged for a new token; using it again revokes the family
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX refresh_tokens_family_idx ON refresh_tokens (family_id);
+CREATE INDEX refresh_tokens_user_idx ON refresh_tokens (user_id);
+CREATE INDEX refresh_tokens_expires_idx ON refresh_tokens (expires_at);
@@ -0,0 +1,2 @@
+-- Tokens revoked by a bump become valid again until they expire.
+ALTER TABLE users DROP COLUMN token_version;
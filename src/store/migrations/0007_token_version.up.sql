@@ -0,0 +1,4 @@
+-- Embedded in access tokens and compared on every request. Bumping it
+-- rejects every token issued before (see BumpTokenVersion). Existing tokens
+-- carry no version, which reads as 0.
+ALTER TABLE users ADD COLUMN token_version INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- When the user last made an authenticated request, to the precision of
+-- the write-behind flush interval (see store/writebehind.go). NULL until
+-- their first request after this migration.
+ALTER TABLE users ADD COLUMN last_seen_at TIMESTAMPTZ;
@@ -0,0 +1,3 @@
+-- Reverting turns two-factor authentication off for everyone.
+DROP TABLE totp_recovery_codes;
+DROP TABLE user_totp;
@@ -0,0 +1,23 @@
+-- Two-factor authentication (see store/twofactor.go). The TOTP secret is
+-- sealed like message blobs when blob encryption is on. enabled_at is NULL
+-- until the user confirms setup with a code. last_step is the time step of
+-- the last code accepted, so each code works once.
+CREATE TABLE user_totp (
+    user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    blob_key_id TEXT REFERENCES blob_keys (id),
+    created_at TIMESTAMPTZ NOT NULL,
+    enabled_at TIMESTAMPTZ,
+    last_step BIGINT NOT NULL DEFAULT 0
+);
+
+-- Single-use recovery codes, replaced whenever setup starts over. Only a
+-- SHA-256 of each code is stored.
+CREATE TABLE totp_recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash BYTEA NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX totp_recovery_codes_user_idx ON totp_recovery_codes (user_id);
@@ -0,0 +1,3 @@
+-- Reverting puts every flag back on its FEATURE_FLAGS default.
+DROP TABLE feature_flag_rollouts;
+DROP TABLE feature_flag_overrides;
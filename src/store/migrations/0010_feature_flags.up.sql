@@ -0,0 +1,15 @@
+-- Feature flag rollout (see featureflags). A user's override wins over
+-- the flag's rollout percentage, which wins over the FEATURE_FLAGS default.
+CREATE TABLE feature_flag_overrides (
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    flag TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, flag)
+);
+
+CREATE TABLE feature_flag_rollouts (
+    flag TEXT PRIMARY KEY,
+    percent INTEGER NOT NULL CHECK (percent BETWEEN 0 AND 100),
+    updated_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,4 @@
+-- Reverting drops the sequence numbers; reapplying numbers the messages
+-- still stored again, so clients holding old numbers must re-sync.
+ALTER TABLE messages DROP COLUMN seq;
+ALTER TABLE conversation_stats DROP COLUMN last_seq;
@@ -0,0 +1,15 @@
+-- Per-conversation message sequence numbers (see store.Message). A send
+-- takes the next number from its conversation_stats row before its message
+-- gets an ID, so the row lock also makes sends within a conversation commit
+-- in ID order. Sealed-sender messages belong to no conversation and get none.
+--
+-- seq is added nullable, which doesn't rewrite or scan messages. Each
+-- counter starts after the messages its conversation already has, from the
+-- counts kept in conversation_stats (one row per conversation, not per
+-- message), and the backfill registered in store/backfill.go numbers those
+-- messages 1, 2, 3... in ID order after startup (or with -backfill-only).
+-- Until it reaches a message, reads return it without a seq.
+ALTER TABLE conversation_stats ADD COLUMN last_seq BIGINT NOT NULL DEFAULT 0;
+UPDATE conversation_stats SET last_seq = low_sent + high_sent;
+
+ALTER TABLE messages ADD COLUMN seq BIGINT;
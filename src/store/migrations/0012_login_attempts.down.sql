@@ -0,0 +1,2 @@
+-- Reverting lifts every current lockout.
+DROP TABLE login_attempts;
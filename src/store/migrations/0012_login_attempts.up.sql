@@ -0,0 +1,10 @@
+-- Failed logins per account and source address, for the login lockout (see
+-- store/login_attempts.go). A row is deleted when a login succeeds.
+CREATE TABLE login_attempts (
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    source_ip TEXT NOT NULL,
+    failures INTEGER NOT NULL,
+    last_attempt_at TIMESTAMPTZ NOT NULL,
+    locked_until TIMESTAMPTZ,
+    PRIMARY KEY (user_id, source_ip)
+);
@@ -0,0 +1,4 @@
+-- Reverting only makes audit searches slower.
+DROP INDEX audit_events_created_idx;
+DROP INDEX audit_events_type_id_idx;
+DROP INDEX audit_events_user_id_idx;
@@ -0,0 +1,6 @@
+-- Indexes for searching the audit log (see store/audit.go). Listings are
+-- newest first by id, filtered by user or event type; time ranges, the
+-- daily counts and retention pruning go by created_at.
+CREATE INDEX audit_events_user_id_idx ON audit_events (user_id, id);
+CREATE INDEX audit_events_type_id_idx ON audit_events (event_type, id);
+CREATE INDEX audit_events_created_idx ON audit_events (created_at);
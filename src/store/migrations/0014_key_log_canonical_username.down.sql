@@ -0,0 +1,2 @@
+-- Reverting only makes key log lookups by name slower.
+DROP INDEX key_log_username_canonical_idx;
@@ -0,0 +1,3 @@
+-- Key log lookups by name compare canonical (lowercased) usernames, like
+-- every other lookup by name (see CanonicalUsername in store/postgres.go).
+CREATE INDEX key_log_username_canonical_idx ON key_log (lower(username), seq);
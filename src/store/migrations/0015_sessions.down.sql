@@ -0,0 +1,3 @@
+-- Reverting forgets every session. Access tokens naming one keep working
+-- until they expire, and revoking a single session is no longer possible.
+DROP TABLE sessions;
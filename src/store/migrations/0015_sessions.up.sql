@@ -0,0 +1,16 @@
+-- Sessions (see store/sessions.go): one per login with a refresh token, so
+-- users can see where they are signed in and sign one place out. Access
+-- tokens name their session; deleting the row rejects them.
+CREATE TABLE sessions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    family_id TEXT NOT NULL UNIQUE, -- The login's refresh token family
+    device_label TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL,
+    last_seen_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL -- That of the family's current refresh token
+);
+
+CREATE INDEX sessions_user_idx ON sessions (user_id, created_at);
+CREATE INDEX sessions_expires_idx ON sessions (expires_at);
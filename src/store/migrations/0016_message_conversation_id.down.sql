@@ -0,0 +1,4 @@
+-- Reverting drops every message's conversation_id, backfilled or not;
+-- migrating up again starts the backfill over.
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_conversation_id_filled;
+ALTER TABLE messages DROP COLUMN conversation_id;
@@ -0,0 +1,7 @@
+-- Identifies a message's conversation by its two user IDs, the lower in the
+-- high 32 bits. Added nullable, which doesn't rewrite or scan messages; new
+-- messages set it, and the backfill registered in store/backfill.go fills in
+-- the rest after startup (or with -backfill-only) and then adds the
+-- messages_conversation_id_filled constraint. Sealed-sender messages have
+-- no conversation and keep it NULL.
+ALTER TABLE messages ADD COLUMN conversation_id BIGINT;
@@ -0,0 +1,3 @@
+-- Reverting deletes every invite code, used or not, along with the record
+-- of who redeemed them. Registration can't require invites afterwards.
+DROP TABLE invites;
@@ -0,0 +1,13 @@
+-- Invite codes (see store/invites.go): minted by existing users, each
+-- redeemable by one registration when INVITES_REQUIRED is set. Codes are
+-- stored hashed.
+CREATE TABLE invites (
+    id BIGSERIAL PRIMARY KEY,
+    code_hash BYTEA NOT NULL UNIQUE,
+    created_by INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL,
+    redeemed_by INTEGER REFERENCES users (id) ON DELETE SET NULL,
+    redeemed_at TIMESTAMPTZ
+);
+
+CREATE INDEX invites_created_by_idx ON invites (created_by, created_at);
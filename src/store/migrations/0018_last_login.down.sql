@@ -0,0 +1,2 @@
+-- Reverting forgets when every user last logged in.
+ALTER TABLE users DROP COLUMN last_login_at;
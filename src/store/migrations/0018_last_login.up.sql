@@ -0,0 +1,3 @@
+-- When each user last logged in (see TouchLastLogin), for GET /me. NULL
+-- until their first login after this migration.
+ALTER TABLE users ADD COLUMN last_login_at TIMESTAMPTZ;
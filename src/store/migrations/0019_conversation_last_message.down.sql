@@ -0,0 +1,6 @@
+-- Reverting forgets each conversation's last message, which
+-- GET /conversations lists conversations by.
+CREATE INDEX conversation_stats_user_high_idx ON conversation_stats (user_high);
+DROP INDEX conversation_stats_high_recent_idx;
+DROP INDEX conversation_stats_low_recent_idx;
+ALTER TABLE conversation_stats DROP COLUMN last_message_id;
@@ -0,0 +1,16 @@
+-- The newest stored message of each conversation, kept by SendMessage in
+-- the same upsert as the counters, so GET /conversations reads only
+-- conversation_stats (see store/bench/conversation_list.sql). Filled in here
+-- with two backward index scans per conversation, whatever its length.
+ALTER TABLE conversation_stats ADD COLUMN last_message_id INTEGER;
+
+UPDATE conversation_stats cs SET last_message_id = GREATEST(
+    (SELECT m.id FROM messages m
+     WHERE m.sender_id = cs.user_low AND m.recipient_id = cs.user_high ORDER BY m.id DESC LIMIT 1),
+    (SELECT m.id FROM messages m
+     WHERE m.sender_id = cs.user_high AND m.recipient_id = cs.user_low ORDER BY m.id DESC LIMIT 1)
+);
+
+CREATE INDEX conversation_stats_low_recent_idx ON conversation_stats (user_low, last_message_id DESC);
+CREATE INDEX conversation_stats_high_recent_idx ON conversation_stats (user_high, last_message_id DESC);
+DROP INDEX conversation_stats_user_high_idx;
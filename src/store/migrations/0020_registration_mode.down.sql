@@ -0,0 +1,3 @@
+-- Reverting forgets the mode set by an admin, so registration follows
+-- INVITES_REQUIRED again: a closed instance reopens.
+DROP TABLE registration_mode;
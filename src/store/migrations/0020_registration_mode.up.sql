@@ -0,0 +1,9 @@
+-- The registration mode an admin set with POST /admin/registration_mode
+-- (see store/registration.go). At most one row; with none, the mode follows
+-- INVITES_REQUIRED.
+CREATE TABLE registration_mode (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    mode TEXT NOT NULL CHECK (mode IN ('open', 'invite_only', 'closed')),
+    updated_by INTEGER REFERENCES users (id) ON DELETE SET NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,5 @@
+-- Reverting forgets every recovery email and invalidates outstanding
+-- verification and password reset tokens. Accounts become unrecoverable
+-- again.
+DROP TABLE email_tokens;
+DROP TABLE recovery_emails;
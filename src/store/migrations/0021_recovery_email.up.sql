@@ -0,0 +1,24 @@
+-- Optional recovery email per user (see store/email.go), and the
+-- single-use tokens that verify one or reset a password through it. A
+-- verified address belongs to one account at a time; unverified ones may
+-- repeat. Tokens are stored hashed.
+CREATE TABLE recovery_emails (
+    user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    verified_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX recovery_emails_verified_idx ON recovery_emails (lower(email)) WHERE verified_at IS NOT NULL;
+
+CREATE TABLE email_tokens (
+    token_hash BYTEA PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL CHECK (purpose IN ('verify', 'reset')),
+    email TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX email_tokens_user_idx ON email_tokens (user_id, purpose);
@@ -0,0 +1,6 @@
+-- Reverting drops every version. Migrating up again restarts them at 0, so
+-- an ETag a client kept from before could match different data; clients
+-- should drop cached contact lists and requests after such a round trip.
+ALTER TABLE cache_invalidations DROP COLUMN relationships_version;
+
+DROP TABLE relationship_versions;
@@ -0,0 +1,12 @@
+-- A counter per user, bumped in the same transaction as any change to what
+-- /get_contacts or /get_chat_requests returns for them (see
+-- store/relationships.go), and served as those routes' ETag. A missing row
+-- is version 0. Invalidations of those scopes record the version they
+-- announce. It is kept apart from users so that bumping it doesn't lock
+-- users rows.
+CREATE TABLE relationship_versions (
+    user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    version BIGINT NOT NULL
+);
+
+ALTER TABLE cache_invalidations ADD COLUMN relationships_version BIGINT;
@@ -0,0 +1,2 @@
+-- Outstanding challenges are lost; clients fetch a new one.
+DROP TABLE registration_challenges;
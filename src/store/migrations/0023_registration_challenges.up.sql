@@ -0,0 +1,13 @@
+-- Proof-of-work challenges handed out by /register_challenge (see
+-- store/challenges.go). Each keeps the difficulty it was issued at, so a
+-- change to REGISTRATION_POW_BITS doesn't invalidate ones already being
+-- solved. A registration deletes the row it redeems; expired rows are
+-- pruned by the retention job.
+CREATE TABLE registration_challenges (
+    nonce TEXT PRIMARY KEY,
+    difficulty INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX registration_challenges_expires_idx ON registration_challenges (expires_at);
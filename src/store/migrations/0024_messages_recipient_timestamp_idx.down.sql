@@ -0,0 +1,3 @@
+-- migrate:no-transaction
+-- Inbound ceiling checks fall back to scanning the recipient's messages.
+DROP INDEX CONCURRENTLY IF EXISTS messages_recipient_timestamp_idx;
@@ -0,0 +1,6 @@
+-- migrate:no-transaction
+-- For counting a user's recent inbound messages against their inbound
+-- ceiling (user_settings.inbound_messages_per_hour). schema.sql used to
+-- create it with a plain CREATE INDEX, which blocks writes to messages
+-- while it builds; on databases that already have it this does nothing.
+CREATE INDEX CONCURRENTLY IF NOT EXISTS messages_recipient_timestamp_idx ON messages (recipient_id, timestamp);
@@ -0,0 +1,11 @@
+-- Counts for names no account has are dropped.
+ALTER TABLE login_attempts ADD COLUMN user_id INTEGER REFERENCES users (id) ON DELETE CASCADE;
+
+UPDATE login_attempts a SET user_id = u.id FROM users u WHERE lower(u.username) = a.username;
+
+DELETE FROM login_attempts WHERE user_id IS NULL;
+
+ALTER TABLE login_attempts
+    DROP COLUMN username,
+    ALTER COLUMN user_id SET NOT NULL,
+    ADD PRIMARY KEY (user_id, source_ip);
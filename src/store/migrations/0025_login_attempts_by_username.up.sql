@@ -0,0 +1,12 @@
+-- Count failed logins per canonical username and source address instead of
+-- per account (see store/login_attempts.go), so a name nobody has is
+-- counted and locked like one that exists, and the lockout can't be used
+-- to tell them apart. Counts in progress carry over.
+ALTER TABLE login_attempts ADD COLUMN username TEXT;
+
+UPDATE login_attempts a SET username = lower(u.username) FROM users u WHERE u.id = a.user_id;
+
+ALTER TABLE login_attempts
+    DROP COLUMN user_id,
+    ALTER COLUMN username SET NOT NULL,
+    ADD PRIMARY KEY (username, source_ip);
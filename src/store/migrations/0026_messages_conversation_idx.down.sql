@@ -0,0 +1,5 @@
+-- migrate:no-transaction
+-- Message polls fall back to scanning by recipient and get slower as the
+-- table grows.
+DROP INDEX CONCURRENTLY IF EXISTS messages_recipient_sender_id_idx;
+DROP INDEX CONCURRENTLY IF EXISTS messages_sender_recipient_id_idx;
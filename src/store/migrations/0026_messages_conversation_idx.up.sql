@@ -0,0 +1,8 @@
+-- migrate:no-transaction
+-- One index per direction of a conversation, so each half of the message
+-- polling query (sender, recipient, id > cursor, ORDER BY id LIMIT n) is
+-- a single index range scan. schema.sql used to create them with a plain
+-- CREATE INDEX, which blocks writes to messages while it builds; on
+-- databases that already have them this does nothing.
+CREATE INDEX CONCURRENTLY IF NOT EXISTS messages_sender_recipient_id_idx ON messages (sender_id, recipient_id, id);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS messages_recipient_sender_id_idx ON messages (recipient_id, sender_id, id);
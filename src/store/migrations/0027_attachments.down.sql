@@ -0,0 +1,2 @@
+-- The stored blobs are left behind; delete ATTACHMENTS_DIR by hand.
+DROP TABLE attachments;
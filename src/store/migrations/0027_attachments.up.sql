@@ -0,0 +1,18 @@
+-- Attachment uploads (see store/attachments.go). The blobs themselves are
+-- in the attachment store; a row records who uploaded one, its declared
+-- size and SHA-256, and how it is cut into chunks. completed_at is set
+-- once the chunks have been assembled and checked. Uploads still
+-- incomplete at expires_at are deleted by the attachment GC job.
+CREATE TABLE attachments (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    size BIGINT NOT NULL,
+    chunk_size INTEGER NOT NULL,
+    sha256 BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    completed_at TIMESTAMPTZ
+);
+
+CREATE INDEX attachments_user_idx ON attachments (user_id);
+CREATE INDEX attachments_incomplete_expires_idx ON attachments (expires_at) WHERE completed_at IS NULL;
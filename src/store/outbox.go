@@ -0,0 +1,146 @@
+// src/store/outbox.go
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Outbox event types.
+const (
+	EventMessageCreated  = "message.created"
+	EventUsernameChanged = "user.username_changed"
+)
+
+// OutboxEvent is a queued side effect. ID is unique and increasing, so
+// consumers that can see an event twice should deduplicate on it (or on the
+// IDs inside the payload, e.g. the message ID).
+type OutboxEvent struct {
+	ID        int64
+	EventType string
+	Payload   json.RawMessage
+	CreatedAt time.Time
+}
+
+// MessageCreatedPayload is the payload of a "message.created" event.
+type MessageCreatedPayload struct {
+	MessageID   int  `json:"message_id"`
+	SenderID    int  `json:"sender_id,omitempty"` // Zero for sealed-sender messages
+	RecipientID int  `json:"recipient_id"`
+	Sealed      bool `json:"sealed,omitempty"`
+}
+
+// UsernameChangedPayload is the payload of a "user.username_changed"
+// event. UserIDs are the renamed user and everyone they have a chat
+// request with.
+type UsernameChangedPayload struct {
+	UserIDs     []int     `json:"user_ids"`
+	OldUsername string    `json:"old_username"`
+	Username    string    `json:"username"`
+	ChangedAt   Timestamp `json:"changed_at"`
+}
+
+// insertOutboxEvent queues an event inside an existing transaction.
+func (s *PostgresStore) insertOutboxEvent(ctx context.Context, tx pgx.Tx, eventType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("could not encode outbox payload: %v", err)
+	}
+	_, err = tx.Exec(ctx,
+		"INSERT INTO outbox (event_type, payload, created_at) VALUES ($1, $2, $3)",
+		eventType, data, s.clock.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// ProcessOutbox claims up to limit unprocessed events in ID order and calls
+// handle for each. Events whose handler succeeds are marked processed; the
+// batch stops at the first failure so ordering is preserved and the failed
+// event is retried on the next call. Rows are locked with SKIP LOCKED so
+// several dispatchers can run at once. It returns how many were processed.
+func (s *PostgresStore) ProcessOutbox(ctx context.Context, limit int, handle func(context.Context, OutboxEvent) error) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`
+        SELECT id, event_type, payload, created_at
+        FROM outbox
+        WHERE processed_at IS NULL
+        ORDER BY id
+        LIMIT $1
+        FOR UPDATE SKIP LOCKED
+        `, limit)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (OutboxEvent, error) {
+		var ev OutboxEvent
+		err := row.Scan(&ev.ID, &ev.EventType, &ev.Payload, &ev.CreatedAt)
+		return ev, err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("database scan error: %w", err)
+	}
+
+	processed := 0
+	var handleErr error
+	for _, ev := range events {
+		if handleErr = handle(ctx, ev); handleErr != nil {
+			break
+		}
+		if _, err := tx.Exec(ctx, "UPDATE outbox SET processed_at = $1 WHERE id = $2", s.clock.Now().UTC(), ev.ID); err != nil {
+			return 0, fmt.Errorf("database error: %w", err)
+		}
+		processed++
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if handleErr != nil {
+		return processed, fmt.Errorf("outbox event failed: %v", handleErr)
+	}
+	return processed, nil
+}
+
+// OutboxStats describes the dispatcher backlog.
+type OutboxStats struct {
+	Pending    int        `json:"pending"`
+	OldestAt   *Timestamp `json:"oldest_pending_at"`
+	LagSeconds float64    `json:"lag_seconds"`
+}
+
+// GetOutboxStats reports how many events are waiting and how old the oldest is.
+func (s *PostgresStore) GetOutboxStats(ctx context.Context) (OutboxStats, error) {
+	var stats OutboxStats
+	err := s.db.QueryRow(ctx,
+		"SELECT COUNT(*), MIN(created_at) FROM outbox WHERE processed_at IS NULL",
+	).Scan(&stats.Pending, &stats.OldestAt)
+	if err != nil {
+		return OutboxStats{}, fmt.Errorf("database error: %w", err)
+	}
+	if stats.OldestAt != nil {
+		stats.LagSeconds = s.clock.Now().Sub(stats.OldestAt.Time).Seconds()
+	}
+	return stats, nil
+}
+
+// PruneOutbox deletes processed events older than the cutoff.
+func (s *PostgresStore) PruneOutbox(ctx context.Context, olderThan time.Time) (int64, error) {
+	cmdTag, err := s.db.Exec(ctx,
+		"DELETE FROM outbox WHERE processed_at IS NOT NULL AND processed_at < $1", olderThan)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return cmdTag.RowsAffected(), nil
+}
@@ -3,9 +3,11 @@ package store
 import (
 	"context"
 	"fmt"
-	"os"
+	"strings"
 	"time"
 
+	"cryptachat-server/clock"
+
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -13,7 +15,20 @@ import (
 
 // PostgresStore holds the connection pool.
 type PostgresStore struct {
-	db *pgxpool.Pool
+	db    *pgxpool.Pool
+	clock clock.Clock // Used for timestamps the store computes in Go
+	// schemaAhead is set if the database was migrated past this binary; no
+	// schema changes were applied at startup.
+	schemaAhead *SchemaAheadError
+	// blobs seals blobs at rest; nil unless EnableBlobEncryption was called.
+	blobs *blobKeyring
+	// wb batches updates queued by opted-in methods; nil unless
+	// EnableWriteBehind was called.
+	wb *writeBehind
+	// users caches GetAuthUser; nil unless EnableUserCache was called.
+	users *userCache
+	// jobs records background job passes for the admin dashboard.
+	jobs jobRuns
 }
 
 // User struct to hold user data
@@ -21,34 +36,77 @@ type User struct {
 	ID           int    `json:"id"`
 	Username     string `json:"username"`
 	PasswordHash string `json:"-"` // Omit from JSON responses
+	IsAdmin      bool   `json:"-"`
+	// TokenVersion must match the version in an access token for the
+	// token to be accepted.
+	TokenVersion int        `json:"-"`
+	CreatedAt    Timestamp  `json:"-"`
+	LastLogin    *Timestamp `json:"-"` // nil before the first login
+	// HasPublicKey is only set by GetUserByID.
+	HasPublicKey bool `json:"-"`
 }
 
-// NewPostgresStore creates a new store, connects to the DB, and initializes the schema.
+// NewPostgresStore creates a new store, connects to the DB, and initializes
+// the schema: schema.sql, then any pending migrations (see migrate.go).
+//
+// If the database is already migrated past this binary, nothing is applied
+// and the store is still returned; SchemaAhead reports the versions and the
+// caller decides whether to run at all.
 func NewPostgresStore(databaseURL string, schemaPath string) (*PostgresStore, error) {
-	pool, err := pgxpool.New(context.Background(), databaseURL)
+	migrations, err := LoadMigrations(MigrationsDir(schemaPath))
 	if err != nil {
-		return nil, fmt.Errorf("unable to connect to database: %v", err)
+		return nil, err
 	}
 
-	// Verify the connection
-	if err := pool.Ping(context.Background()); err != nil {
+	pool, err := connect(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Migrator{db: pool, schemaPath: schemaPath, migrations: migrations}
+	if _, err := m.Up(context.Background()); err != nil {
+		if ahead, ok := IsSchemaAhead(err); ok {
+			return &PostgresStore{db: pool, clock: clock.Real, schemaAhead: ahead}, nil
+		}
 		pool.Close()
-		return nil, fmt.Errorf("database ping failed: %v", err)
+		return nil, err
 	}
 
-	// Initialize the schema (from schema.sql)
-	schemaSQL, err := os.ReadFile(schemaPath)
+	return &PostgresStore{db: pool, clock: clock.Real}, nil
+}
+
+// connect opens and verifies a connection pool.
+func connect(databaseURL string) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(databaseURL)
 	if err != nil {
-		pool.Close()
-		return nil, fmt.Errorf("could not read schema file: %v", err)
+		return nil, fmt.Errorf("invalid database URL: %v", err)
 	}
+	// Pin every session to UTC so timestamps (and any SQL that casts
+	// between timestamp and timestamptz) don't depend on the server's zone.
+	poolConfig.ConnConfig.RuntimeParams["timezone"] = "UTC"
 
-	if _, err := pool.Exec(context.Background(), string(schemaSQL)); err != nil {
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to database: %v", err)
+	}
+
+	// Verify the connection
+	if err := pool.Ping(context.Background()); err != nil {
 		pool.Close()
-		return nil, fmt.Errorf("failed to apply schema: %v", err)
+		return nil, fmt.Errorf("database ping failed: %v", err)
 	}
+	return pool, nil
+}
+
+// SchemaAhead returns the version mismatch if the database schema is newer
+// than this binary, or nil.
+func (s *PostgresStore) SchemaAhead() *SchemaAheadError {
+	return s.schemaAhead
+}
 
-	return &PostgresStore{db: pool}, nil
+// SetClock replaces the store's clock. Intended for tests.
+func (s *PostgresStore) SetClock(c clock.Clock) {
+	s.clock = c
 }
 
 // Close closes the database connection pool.
@@ -56,6 +114,32 @@ func (s *PostgresStore) Close() {
 	s.db.Close()
 }
 
+// PoolStats describes the connection pool for the admin dashboard.
+type PoolStats struct {
+	Acquired     int32   `json:"acquired"` // Connections in use
+	Idle         int32   `json:"idle"`
+	Total        int32   `json:"total"`
+	Max          int32   `json:"max"`
+	Utilization  float64 `json:"utilization"`   // Acquired / Max
+	EmptyAcquire int64   `json:"empty_acquire"` // Acquires that had to wait for a connection
+}
+
+// PoolStats returns the connection pool's current use.
+func (s *PostgresStore) PoolStats() PoolStats {
+	st := s.db.Stat()
+	ps := PoolStats{
+		Acquired:     st.AcquiredConns(),
+		Idle:         st.IdleConns(),
+		Total:        st.TotalConns(),
+		Max:          st.MaxConns(),
+		EmptyAcquire: st.EmptyAcquireCount(),
+	}
+	if ps.Max > 0 {
+		ps.Utilization = float64(ps.Acquired) / float64(ps.Max)
+	}
+	return ps
+}
+
 // checkUniqueViolation is a helper to check for pgx "unique_violation" errors
 func isUniqueViolation(err error) bool {
 	if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23505" {
@@ -67,83 +151,282 @@ func isUniqueViolation(err error) bool {
 // ---- User Methods ----
 
 // RegisterUser is the Go equivalent of the INSERT query in your /register endpoint.
-func (s *PostgresStore) RegisterUser(ctx context.Context, username string, passwordHash string) error {
-	// db.Exec is for queries that don't return rows.
-	_, err := s.db.Exec(ctx,
-		"INSERT INTO users (username, password_hash) VALUES ($1, $2)",
-		username, passwordHash)
+// Usernames are unique by their canonical form, so "Alice" and "alice" cannot
+// both exist. The check and insert run in one transaction holding an advisory
+// lock on the canonical name; the unique index is the final backstop.
+//
+// With inviteHash, the invite with that code hash is redeemed by the new
+// account in the same transaction. Fails with "invite code not found" or
+// "invite code already used" if it can't be.
+func (s *PostgresStore) RegisterUser(ctx context.Context, username string, passwordHash string, inviteHash []byte) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
 
+	canonical := CanonicalUsername(username)
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", canonical); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	var exists bool
+	err = tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM users WHERE lower(username) = $1)",
+		canonical,
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("username already exists")
+	}
+
+	var inviteID int64
+	if inviteHash != nil {
+		// Locked, so two registrations can't both redeem it
+		var used bool
+		err := tx.QueryRow(ctx,
+			"SELECT id, redeemed_at IS NOT NULL FROM invites WHERE code_hash = $1 FOR UPDATE",
+			inviteHash).Scan(&inviteID, &used)
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("invite code not found")
+		}
+		if err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		if used {
+			return fmt.Errorf("invite code already used")
+		}
+	}
+
+	var userID int
+	err = tx.QueryRow(ctx,
+		"INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id",
+		username, passwordHash).Scan(&userID)
 	if err != nil {
 		if isUniqueViolation(err) {
 			return fmt.Errorf("username already exists")
 		}
-		return fmt.Errorf("database error: %v", err)
+		return fmt.Errorf("database error: %w", err)
+	}
+	if inviteHash != nil {
+		_, err := tx.Exec(ctx,
+			"UPDATE invites SET redeemed_by = $2, redeemed_at = $3 WHERE id = $1",
+			inviteID, userID, s.clock.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
 	}
 
+	if err := tx.Commit(ctx); err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("username already exists")
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
 	return nil
 }
 
-// GetUserByUsername fetches a user for the login handler.
+// CanonicalUsername is the form usernames are compared in for uniqueness.
+// It must match the expression in users_username_canonical_idx.
+func CanonicalUsername(username string) string {
+	return strings.ToLower(username)
+}
+
+// GetUserByUsername fetches a user for the login handler. Like every
+// lookup by name, it compares canonical forms.
 func (s *PostgresStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
 	var user User
 	err := s.db.QueryRow(ctx,
-		"SELECT id, username, password_hash FROM users WHERE username = $1",
-		username,
-	).Scan(&user.ID, &user.Username, &user.PasswordHash)
+		"SELECT id, username, password_hash, is_admin, token_version, created_at, last_login_at FROM users WHERE lower(username) = $1",
+		CanonicalUsername(username),
+	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.IsAdmin, &user.TokenVersion, &user.CreatedAt, &user.LastLogin)
 
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, fmt.Errorf("user not found")
 		}
-		return nil, fmt.Errorf("database error: %v", err)
+		return nil, fmt.Errorf("database error: %w", err)
 	}
 	return &user, nil
 }
 
-// GetUserByID fetches a user for the auth middleware.
+// GetUserByID fetches a user for the auth middleware. Whether they have a
+// public key comes from the same query, so GET /me needs no other.
 func (s *PostgresStore) GetUserByID(ctx context.Context, id int) (*User, error) {
 	var user User
 	err := s.db.QueryRow(ctx,
-		"SELECT id, username, password_hash FROM users WHERE id = $1",
+		`
+        SELECT u.id, u.username, u.password_hash, u.is_admin, u.token_version, u.created_at, u.last_login_at,
+               k.user_id IS NOT NULL
+        FROM users u LEFT JOIN public_keys k ON k.user_id = u.id
+        WHERE u.id = $1
+        `,
 		id,
-	).Scan(&user.ID, &user.Username, &user.PasswordHash)
+	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.IsAdmin, &user.TokenVersion, &user.CreatedAt, &user.LastLogin,
+		&user.HasPublicKey)
 
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, fmt.Errorf("user not found")
 		}
-		return nil, fmt.Errorf("database error: %v", err)
+		return nil, fmt.Errorf("database error: %w", err)
 	}
 	return &user, nil
 }
 
+// TouchLastLogin records that userID logged in at now.
+func (s *PostgresStore) TouchLastLogin(ctx context.Context, userID int, now time.Time) error {
+	_, err := s.db.Exec(ctx, "UPDATE users SET last_login_at = $2 WHERE id = $1", userID, now.UTC())
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	s.forgetUser(userID)
+	return nil
+}
+
+// BumpTokenVersion increments userID's token version, so every access
+// token issued before is rejected, and returns the new version.
+func (s *PostgresStore) BumpTokenVersion(ctx context.Context, userID int) (int, error) {
+	var version int
+	err := s.db.QueryRow(ctx,
+		"UPDATE users SET token_version = token_version + 1 WHERE id = $1 RETURNING token_version",
+		userID,
+	).Scan(&version)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return 0, fmt.Errorf("user not found")
+		}
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	s.forgetUser(userID)
+	return version, nil
+}
+
+// UpgradePasswordHash replaces userID's password hash with newHash, a hash
+// of the same password with other settings, unless it is no longer oldHash
+// (the password changed meanwhile). Sessions are left alone.
+func (s *PostgresStore) UpgradePasswordHash(ctx context.Context, userID int, oldHash, newHash string) error {
+	_, err := s.db.Exec(ctx,
+		"UPDATE users SET password_hash = $3 WHERE id = $1 AND password_hash = $2",
+		userID, oldHash, newHash)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	s.forgetUser(userID)
+	return nil
+}
+
+// UpdatePasswordHash replaces userID's password hash and, in the same
+// transaction, signs them out everywhere: their token version is bumped,
+// their refresh tokens revoked and their sessions ended. Returns the new
+// token version.
+func (s *PostgresStore) UpdatePasswordHash(ctx context.Context, userID int, hash string) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	version, err := replacePasswordHash(ctx, tx, userID, hash, s.clock.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	s.forgetUser(userID)
+	return version, nil
+}
+
+// replacePasswordHash is UpdatePasswordHash within tx.
+func replacePasswordHash(ctx context.Context, tx pgx.Tx, userID int, hash string, now time.Time) (int, error) {
+	var version int
+	err := tx.QueryRow(ctx,
+		"UPDATE users SET password_hash = $2, token_version = token_version + 1 WHERE id = $1 RETURNING token_version",
+		userID, hash,
+	).Scan(&version)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return 0, fmt.Errorf("user not found")
+		}
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if err := endUserSessions(ctx, tx, userID, now); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// endUserSessions revokes userID's refresh tokens and ends their sessions
+// within tx. Callers bump the token version in the same transaction, so
+// their access tokens are refused too.
+func endUserSessions(ctx context.Context, tx pgx.Tx, userID int, now time.Time) error {
+	_, err := tx.Exec(ctx,
+		"UPDATE refresh_tokens SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL",
+		userID, now)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM sessions WHERE user_id = $1", userID); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
 // GetUserIDByUsername is a helper to get just the ID for a given username.
 func (s *PostgresStore) GetUserIDByUsername(ctx context.Context, username string) (int, error) {
 	var id int
-	err := s.db.QueryRow(ctx, "SELECT id FROM users WHERE username = $1", username).Scan(&id)
+	err := s.db.QueryRow(ctx, "SELECT id FROM users WHERE lower(username) = $1", CanonicalUsername(username)).Scan(&id)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return 0, fmt.Errorf("user not found")
 		}
-		return 0, fmt.Errorf("database error: %v", err)
+		return 0, fmt.Errorf("database error: %w", err)
 	}
 	return id, nil
 }
 
 // ---- Key Methods ----
 
-// UploadPublicKey upserts a user's public key.
+// UploadPublicKey upserts a user's public key. Changes are appended to the
+// key transparency log in the same transaction.
 func (s *PostgresStore) UploadPublicKey(ctx context.Context, userID int, key string) error {
-	_, err := s.db.Exec(ctx,
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var current string
+	err = tx.QueryRow(ctx, "SELECT public_key FROM public_keys WHERE user_id = $1 FOR UPDATE", userID).Scan(&current)
+	if err != nil && err != pgx.ErrNoRows {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if err == nil && current == key {
+		// Unchanged, so nothing to log
+		return nil
+	}
+
+	_, err = tx.Exec(ctx,
 		`
         INSERT INTO public_keys (user_id, public_key) VALUES ($1, $2)
         ON CONFLICT (user_id) DO UPDATE SET public_key = EXCLUDED.public_key
         `,
 		userID, key)
-
 	if err != nil {
-		return fmt.Errorf("database error: %v", err)
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	if err := s.appendKeyLog(ctx, tx, userID, key); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
 	}
+	// HasPublicKey may have changed
+	s.forgetUser(userID)
 	return nil
 }
 
@@ -155,16 +438,16 @@ func (s *PostgresStore) GetPublicKeyByUsername(ctx context.Context, username str
         SELECT pk.public_key 
         FROM public_keys pk 
         JOIN users u ON u.id = pk.user_id 
-        WHERE u.username = $1
+        WHERE lower(u.username) = $1
         `,
-		username,
+		CanonicalUsername(username),
 	).Scan(&publicKey)
 
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return "", fmt.Errorf("user not found or has no public key")
 		}
-		return "", fmt.Errorf("database error: %v", err)
+		return "", fmt.Errorf("database error: %w", err)
 	}
 	return publicKey, nil
 }
@@ -172,86 +455,289 @@ func (s *PostgresStore) GetPublicKeyByUsername(ctx context.Context, username str
 // ---- Chat Request Methods ----
 
 // RequestChat creates a new 'pending' chat request.
-func (s *PostgresStore) RequestChat(ctx context.Context, requesterID int, recipientUsername string) error {
+// A non-empty filterReason shadow-filters it out of the recipient's main list.
+//
+// Each pair of users has at most one row. If the recipient already has a
+// pending request to the requester, that request is accepted instead and
+// autoAccepted is true. A reverse request the requester once declined is
+// replaced by the new one.
+func (s *PostgresStore) RequestChat(ctx context.Context, requesterID int, recipientUsername string, filterReason string) (autoAccepted bool, err error) {
 	recipientID, err := s.GetUserIDByUsername(ctx, recipientUsername)
 	if err != nil {
-		return fmt.Errorf("recipient user not found")
+		return false, fmt.Errorf("recipient user not found")
 	}
 
 	if requesterID == recipientID {
-		return fmt.Errorf("cannot send chat request to yourself")
+		return false, fmt.Errorf("cannot send chat request to yourself")
 	}
 
-	_, err = s.db.Exec(ctx,
-		"INSERT INTO chat_requests (requester_id, requested_id, status) VALUES ($1, $2, 'pending')",
-		requesterID, recipientID,
-	)
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialise requests between the same two users, whichever direction
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(LEAST($1::int, $2::int), GREATEST($1::int, $2::int))",
+		requesterID, recipientID); err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+
+	var reverseID int
+	var reverseStatus string
+	err = tx.QueryRow(ctx,
+		"SELECT id, status FROM chat_requests WHERE requester_id = $1 AND requested_id = $2",
+		recipientID, requesterID,
+	).Scan(&reverseID, &reverseStatus)
+	switch {
+	case err == pgx.ErrNoRows:
+	case err != nil:
+		return false, fmt.Errorf("database error: %w", err)
+	case reverseStatus == "pending":
+		now := s.clock.Now().UTC()
+		if _, err := tx.Exec(ctx, "UPDATE chat_requests SET status = 'accepted', accepted_at = $2 WHERE id = $1",
+			reverseID, now); err != nil {
+			return false, fmt.Errorf("database error: %w", err)
+		}
+		// Whichever side is on a peer learns of the acceptance. A request
+		// that arrived from a peer can only meet a pending one here if the
+		// peer's copy of it was declined, so the peer needs telling too.
+		if err := enqueueRelay(ctx, tx, RelayChatAccept, requesterID, recipientID, 0, now); err != nil {
+			return false, err
+		}
+		if err := enqueueRelay(ctx, tx, RelayChatAccept, recipientID, requesterID, 0, now); err != nil {
+			return false, err
+		}
+		if err := bumpRelationshipsVersions(ctx, tx, requesterID, recipientID); err != nil {
+			return false, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return false, fmt.Errorf("database error: %w", err)
+		}
+		return true, nil
+	case reverseStatus == "declined":
+		if _, err := tx.Exec(ctx, "DELETE FROM chat_requests WHERE id = $1", reverseID); err != nil {
+			return false, fmt.Errorf("database error: %w", err)
+		}
+	default:
+		return false, fmt.Errorf("chat request already pending or accepted")
+	}
 
+	now := s.clock.Now().UTC()
+	_, err = tx.Exec(ctx,
+		`
+        INSERT INTO chat_requests (requester_id, requested_id, status, created_at, filtered, filter_reason)
+        VALUES ($1, $2, 'pending', $3, $4, NULLIF($5, ''))
+        `,
+		requesterID, recipientID, now, filterReason != "", filterReason,
+	)
 	if err != nil {
 		if isUniqueViolation(err) {
-			return fmt.Errorf("chat request already pending or accepted")
+			return false, fmt.Errorf("chat request already pending or accepted")
 		}
-		return fmt.Errorf("database error: %v", err)
+		return false, fmt.Errorf("database error: %w", err)
 	}
-	return nil
+	if err := enqueueRelay(ctx, tx, RelayChatRequest, requesterID, recipientID, 0, now); err != nil {
+		return false, err
+	}
+	// Only the recipient lists incoming requests, filtered ones included
+	if err := bumpRelationshipsVersions(ctx, tx, recipientID); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return false, nil
 }
 
 // PendingRequest struct for get_chat_requests response
 type PendingRequest struct {
-	RequesterUsername string `json:"requester_username"`
-	Status            string `json:"status"`
+	RequesterUsername string    `json:"requester_username"`
+	Status            string    `json:"status"`
+	CreatedAt         Timestamp `json:"created_at"`
+	Filtered          bool      `json:"filtered,omitempty"`
+	FilterReason      string    `json:"filter_reason,omitempty"`
 }
 
 // GetChatRequests fetches all pending requests for a user.
-func (s *PostgresStore) GetChatRequests(ctx context.Context, requestedID int) ([]PendingRequest, error) {
+// Shadow-filtered requests are only included if includeFiltered is set.
+func (s *PostgresStore) GetChatRequests(ctx context.Context, requestedID int, includeFiltered bool) ([]PendingRequest, error) {
 	rows, err := s.db.Query(ctx,
 		`
-        SELECT u.username AS requester_username, cr.status
+        SELECT u.username AS requester_username, cr.status, cr.created_at, cr.filtered, COALESCE(cr.filter_reason, '')
         FROM chat_requests cr
         JOIN users u ON u.id = cr.requester_id
-        WHERE cr.requested_id = $1 AND cr.status = 'pending'
-        `, requestedID)
+        WHERE cr.requested_id = $1 AND cr.status = 'pending' AND (NOT cr.filtered OR $2)
+        ORDER BY cr.created_at
+        `, requestedID, includeFiltered)
 	if err != nil {
-		return nil, fmt.Errorf("database error: %v", err)
+		return nil, fmt.Errorf("database error: %w", err)
 	}
 	defer rows.Close()
 
-	var requests []PendingRequest
+	requests := []PendingRequest{} // Encodes as [] when empty
 	for rows.Next() {
 		var req PendingRequest
-		if err := rows.Scan(&req.RequesterUsername, &req.Status); err != nil {
-			return nil, fmt.Errorf("database scan error: %v", err)
+		if err := rows.Scan(&req.RequesterUsername, &req.Status, &req.CreatedAt, &req.Filtered, &req.FilterReason); err != nil {
+			return nil, fmt.Errorf("database scan error: %w", err)
 		}
 		requests = append(requests, req)
 	}
 	return requests, nil
 }
 
-// AcceptChat updates a 'pending' request to 'accepted'.
-func (s *PostgresStore) AcceptChat(ctx context.Context, requestedID int, requesterUsername string) error {
+// AcceptChat accepts requesterUsername's pending request to requestedID. It
+// reports false, and changes nothing, if the two are already contacts, so a
+// repeated accept succeeds. The pair's row is locked while its state is
+// read, so concurrent accepts see each other's result. A request sent by
+// requestedID, to themselves or not, can't be accepted by them.
+func (s *PostgresStore) AcceptChat(ctx context.Context, requestedID int, requesterUsername string) (bool, error) {
+	requesterID, err := s.GetUserIDByUsername(ctx, requesterUsername)
+	if err != nil {
+		return false, fmt.Errorf("requester user not found")
+	}
+	if requesterID == requestedID {
+		return false, fmt.Errorf("cannot accept a chat request from yourself")
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// One row per pair, in either direction (chat_requests_pair_idx)
+	var rowRequester int
+	var status string
+	err = tx.QueryRow(ctx,
+		`
+        SELECT requester_id, status FROM chat_requests
+        WHERE (requester_id = $1 AND requested_id = $2) OR (requester_id = $2 AND requested_id = $1)
+        FOR UPDATE
+        `,
+		requesterID, requestedID).Scan(&rowRequester, &status)
+	if err == pgx.ErrNoRows {
+		return false, fmt.Errorf("no chat request found from that user")
+	}
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	switch {
+	case status == "accepted":
+		return false, nil
+	case rowRequester != requesterID:
+		return false, fmt.Errorf("cannot accept a chat request you sent")
+	case status != "pending":
+		return false, fmt.Errorf("chat request from that user is no longer pending (%s)", status)
+	}
+
+	now := s.clock.Now().UTC()
+	_, err = tx.Exec(ctx,
+		`
+        UPDATE chat_requests
+        SET status = 'accepted', accepted_at = $3
+        WHERE requester_id = $1 AND requested_id = $2
+        `,
+		requesterID, requestedID, now)
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	if err := enqueueRelay(ctx, tx, RelayChatAccept, requestedID, requesterID, 0, now); err != nil {
+		return false, err
+	}
+	if err := bumpRelationshipsVersions(ctx, tx, requestedID, requesterID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return true, nil
+}
+
+// DeclineChat updates a 'pending' request to 'declined'. Only requestedID's
+// lists change; the requester isn't told.
+func (s *PostgresStore) DeclineChat(ctx context.Context, requestedID int, requesterUsername string) error {
 	requesterID, err := s.GetUserIDByUsername(ctx, requesterUsername)
 	if err != nil {
 		return fmt.Errorf("requester user not found")
 	}
 
-	cmdTag, err := s.db.Exec(ctx,
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	cmdTag, err := tx.Exec(ctx,
 		`
         UPDATE chat_requests
-        SET status = 'accepted'
+        SET status = 'declined', declined_at = $3
         WHERE requester_id = $1 AND requested_id = $2 AND status = 'pending'
         `,
-		requesterID, requestedID)
+		requesterID, requestedID, s.clock.Now().UTC())
 
 	if err != nil {
-		return fmt.Errorf("database error: %v", err)
+		return fmt.Errorf("database error: %w", err)
 	}
 
 	if cmdTag.RowsAffected() == 0 {
 		return fmt.Errorf("no pending request found from that user")
 	}
+	if err := bumpRelationshipsVersions(ctx, tx, requestedID); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
 	return nil
 }
 
+// RequesterSignals are the facts the spam heuristics look at.
+type RequesterSignals struct {
+	CreatedAt      time.Time
+	HasPublicKey   bool
+	RecentDeclines int
+	// SharesContact is true if requester and recipient have a mutual accepted contact.
+	SharesContact bool
+}
+
+// GetRequesterSignals gathers spam signals about requesterID relative to
+// recipientUsername. Declines are counted since declinedSince.
+func (s *PostgresStore) GetRequesterSignals(ctx context.Context, requesterID int, recipientUsername string, declinedSince time.Time) (RequesterSignals, error) {
+	var sig RequesterSignals
+	err := s.db.QueryRow(ctx,
+		`
+        WITH recipient AS (SELECT id FROM users WHERE lower(username) = $2),
+        contacts AS (
+            SELECT CASE WHEN requester_id = $1 THEN requested_id ELSE requester_id END AS id
+            FROM chat_requests
+            WHERE (requester_id = $1 OR requested_id = $1) AND status = 'accepted'
+        )
+        SELECT
+            u.created_at,
+            EXISTS (SELECT 1 FROM public_keys WHERE user_id = $1),
+            (SELECT COUNT(*) FROM chat_requests
+             WHERE requester_id = $1 AND status = 'declined' AND declined_at >= $3),
+            EXISTS (
+                SELECT 1 FROM chat_requests cr, contacts c, recipient r
+                WHERE cr.status = 'accepted'
+                  AND ((cr.requester_id = c.id AND cr.requested_id = r.id)
+                    OR (cr.requested_id = c.id AND cr.requester_id = r.id))
+            )
+        FROM users u
+        WHERE u.id = $1
+        `, requesterID, CanonicalUsername(recipientUsername), declinedSince,
+	).Scan(&sig.CreatedAt, &sig.HasPublicKey, &sig.RecentDeclines, &sig.SharesContact)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return RequesterSignals{}, fmt.Errorf("user not found")
+		}
+		return RequesterSignals{}, fmt.Errorf("database error: %w", err)
+	}
+	return sig, nil
+}
+
 // GetContacts fetches all accepted chat partners.
 func (s *PostgresStore) GetContacts(ctx context.Context, myID int) ([]string, error) {
 	contacts := make(map[string]struct{}) // Use a map as a set
@@ -265,14 +751,14 @@ func (s *PostgresStore) GetContacts(ctx context.Context, myID int) ([]string, er
         WHERE cr.requester_id = $1 AND cr.status = 'accepted'
         `, myID)
 	if err != nil {
-		return nil, fmt.Errorf("database error (query 1): %v", err)
+		return nil, fmt.Errorf("database error (query 1): %w", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var username string
 		if err := rows.Scan(&username); err != nil {
-			return nil, fmt.Errorf("database scan error (query 1): %v", err)
+			return nil, fmt.Errorf("database scan error (query 1): %w", err)
 		}
 		contacts[username] = struct{}{}
 	}
@@ -286,14 +772,14 @@ func (s *PostgresStore) GetContacts(ctx context.Context, myID int) ([]string, er
         WHERE cr.requested_id = $1 AND cr.status = 'accepted'
         `, myID)
 	if err != nil {
-		return nil, fmt.Errorf("database error (query 2): %v", err)
+		return nil, fmt.Errorf("database error (query 2): %w", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var username string
 		if err := rows.Scan(&username); err != nil {
-			return nil, fmt.Errorf("database scan error (query 2): %v", err)
+			return nil, fmt.Errorf("database scan error (query 2): %w", err)
 		}
 		contacts[username] = struct{}{}
 	}
@@ -306,111 +792,502 @@ func (s *PostgresStore) GetContacts(ctx context.Context, myID int) ([]string, er
 	return contactList, nil
 }
 
+// ContactRef identifies an accepted chat partner.
+type ContactRef struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+// GetContactRefs fetches all accepted chat partners with their user IDs.
+func (s *PostgresStore) GetContactRefs(ctx context.Context, myID int) ([]ContactRef, error) {
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT DISTINCT u.id, u.username
+        FROM chat_requests cr
+        JOIN users u ON u.id = CASE WHEN cr.requester_id = $1 THEN cr.requested_id ELSE cr.requester_id END
+        WHERE (cr.requester_id = $1 OR cr.requested_id = $1) AND cr.status = 'accepted'
+        `, myID)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	contacts := []ContactRef{}
+	for rows.Next() {
+		var c ContactRef
+		if err := rows.Scan(&c.ID, &c.Username); err != nil {
+			return nil, fmt.Errorf("database scan error: %w", err)
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, nil
+}
+
 // ---- Message Methods ----
 
 // SendMessage inserts a new encrypted message.
+// In the same transaction it queues a "message.created" outbox event so the
+// real-time fan-out happens even if the process dies right after the commit.
 func (s *PostgresStore) SendMessage(ctx context.Context, senderID int, recipientUsername, senderBlob, recipientBlob string) (int, int, error) {
 	recipientID, err := s.GetUserIDByUsername(ctx, recipientUsername)
 	if err != nil {
 		return 0, 0, fmt.Errorf("recipient user not found")
 	}
+	if recipientID == senderID {
+		return 0, 0, fmt.Errorf("cannot send message to yourself")
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := s.clock.Now().UTC()
+	if err := checkInboundLimit(ctx, tx, recipientID, now); err != nil {
+		return 0, 0, err
+	}
+
+	newID, err := s.insertMessage(ctx, tx, senderID, recipientID, &senderBlob, &recipientBlob, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := enqueueRelay(ctx, tx, RelayMessage, senderID, recipientID, newID, now); err != nil {
+		return 0, 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	return newID, recipientID, nil
+}
+
+// insertMessage stores a message, counts it in the conversation stats and
+// queues its "message.created" event. A nil blob stores no copy for that
+// side.
+func (s *PostgresStore) insertMessage(ctx context.Context, tx pgx.Tx, senderID, recipientID int, senderBlob, recipientBlob *string, now time.Time) (int, error) {
+	// Counters are of stored bytes, so they see the sealed blobs
+	storedSender := s.blobs.sealNullable(senderBlob, blobAADMessages)
+	storedRecipient := s.blobs.sealNullable(recipientBlob, blobAADMessages)
+	var senderBytes, recipientBytes string
+	if storedSender != nil {
+		senderBytes = *storedSender
+	}
+	if storedRecipient != nil {
+		recipientBytes = *storedRecipient
+	}
+	// Before the insert: this locks the conversation, so its messages get
+	// IDs in commit order (see Message)
+	seq, err := bumpConversationStats(ctx, tx, senderID, recipientID, senderBytes, recipientBytes, now)
+	if err != nil {
+		return 0, err
+	}
 
 	var newID int
 	// Use QueryRow with RETURNING id to get the new message's ID
-	err = s.db.QueryRow(ctx,
-		"INSERT INTO messages (sender_id, recipient_id, sender_blob, recipient_blob) VALUES ($1, $2, $3, $4) RETURNING id",
-		senderID, recipientID, senderBlob, recipientBlob,
+	err = tx.QueryRow(ctx,
+		"INSERT INTO messages (sender_id, recipient_id, sender_blob, recipient_blob, blob_key_id, timestamp, seq, conversation_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id",
+		senderID, recipientID, storedSender, storedRecipient, s.blobs.keyID(), now, seq, conversationID(senderID, recipientID),
 	).Scan(&newID)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if err := setConversationLastMessage(ctx, tx, senderID, recipientID, newID); err != nil {
+		return 0, err
+	}
 
+	err = s.insertOutboxEvent(ctx, tx, EventMessageCreated, MessageCreatedPayload{
+		MessageID:   newID,
+		SenderID:    senderID,
+		RecipientID: recipientID,
+	})
 	if err != nil {
-		return 0, 0, fmt.Errorf("database error: %v", err)
+		return 0, err
 	}
-	return newID, recipientID, nil
+	return newID, nil
 }
 
-// Message struct for get_messages response
+// Message struct for get_messages response.
+//
+// Message reads page by ID and sinceID is exclusive: a page holds the
+// messages with an ID greater than sinceID, and the next cursor is the
+// highest ID returned, whatever state that message is in. A message whose
+// copy for the reader was pruned is still returned, as a Deleted stub with
+// its ID, participants and timestamp but no blob, so it never opens a gap
+// below a cursor. A message is only missing once both copies are gone and
+// the row is deleted (or an account is deleted); those IDs are simply never
+// returned, so IDs are increasing but not contiguous.
+//
+// Within one conversation, and within one user's sealed messages, IDs are
+// handed out and committed in the same order. A read that sees a message
+// therefore sees every earlier one, and a cursor never skips a message that
+// commits later. Seq numbers a conversation's messages 1, 2, 3...; a gap
+// means a message was never seen or has since been deleted. Pushes are
+// queued in the same transaction as the message (see outbox), so a pushed
+// message is already visible to reads.
 type Message struct {
 	ID             int       `json:"id"`
 	SenderID       int       `json:"sender_id"`
 	RecipientID    int       `json:"recipient_id"`
-	Timestamp      time.Time `json:"timestamp"`
+	Timestamp      Timestamp `json:"timestamp"`
 	SenderUsername string    `json:"sender_username"`
-	EncryptedBlob  string    `json:"encrypted_blob"`
+	EncryptedBlob  string    `json:"encrypted_blob"`      // Empty if Deleted
+	Deleted        bool      `json:"deleted,omitempty"`   // Stub: this user's copy was pruned; the other side's may remain
+	Transport      string    `json:"transport,omitempty"` // How this copy reached the client; set by the delivery path
+	Sealed         bool      `json:"sealed,omitempty"`    // Sealed sender: SenderID and SenderUsername are not known
+	Seq            int64     `json:"seq,omitempty"`       // Position in the conversation; 0 if Sealed or not yet backfilled
+}
+
+// Message transports, reported to clients in Message.Transport and back by
+// them as delivered_via.
+const (
+	TransportWSLive = "ws_live" // Pushed over the WebSocket as it was sent
+	TransportPoll   = "poll"    // Fetched from /get_messages
+)
+
+// ValidTransport reports whether t is one of the Transport constants.
+func ValidTransport(t string) bool {
+	switch t {
+	case TransportWSLive, TransportPoll:
+		return true
+	}
+	return false
 }
 
 // --- NEW FUNCTION ---
 // GetMessageForUser fetches a single message, formatted for a specific user's perspective (to get the correct blob).
 func (s *PostgresStore) GetMessageForUser(ctx context.Context, messageID int, perspectiveUserID int) (*Message, error) {
+	return retryRead(ctx, func() (*Message, error) { return s.getMessageForUser(ctx, messageID, perspectiveUserID) })
+}
+
+func (s *PostgresStore) getMessageForUser(ctx context.Context, messageID int, perspectiveUserID int) (*Message, error) {
 	var msg Message
+	var keyID *string
 	// This query is based on GetMessages, but for a single ID
 	err := s.db.QueryRow(ctx,
 		`
         SELECT 
             m.id, 
-            m.sender_id, 
+            COALESCE(m.sender_id, 0), 
             m.recipient_id, 
             m.timestamp, 
-            u_sender.username AS sender_username,
-            CASE
+            COALESCE(u_sender.username, '') AS sender_username,
+            COALESCE(CASE
                 WHEN m.sender_id = $1 THEN m.sender_blob
                 ELSE m.recipient_blob
-            END AS encrypted_blob
+            END, '') AS encrypted_blob,
+            m.blob_key_id,
+            m.sender_id IS NULL AS sealed,
+            COALESCE(m.seq, 0)
         FROM messages m
-        JOIN users u_sender ON u_sender.id = m.sender_id
-        WHERE m.id = $2
+        -- Sealed-sender messages have no sender
+        LEFT JOIN users u_sender ON u_sender.id = m.sender_id
+        WHERE m.id = $2 AND $1 IN (m.sender_id, m.recipient_id)
+          -- The perspective user's copy may have been pruned; there is
+          -- nothing to push then
+          AND CASE WHEN m.sender_id = $1 THEN m.sender_blob ELSE m.recipient_blob END IS NOT NULL
         `,
 		perspectiveUserID, messageID,
-	).Scan(&msg.ID, &msg.SenderID, &msg.RecipientID, &msg.Timestamp, &msg.SenderUsername, &msg.EncryptedBlob)
+	).Scan(&msg.ID, &msg.SenderID, &msg.RecipientID, &msg.Timestamp, &msg.SenderUsername, &msg.EncryptedBlob, &keyID, &msg.Sealed, &msg.Seq)
 
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, fmt.Errorf("message not found")
 		}
-		return nil, fmt.Errorf("database scan error: %v", err)
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	if msg.EncryptedBlob, err = s.blobs.open(msg.EncryptedBlob, keyID, blobAADMessages); err != nil {
+		return nil, fmt.Errorf("blob decryption error: %v", err)
 	}
 	return &msg, nil
 }
 
-// GetMessages fetches new messages between two users.
-func (s *PostgresStore) GetMessages(ctx context.Context, myID int, partnerUsername string, sinceID int) ([]Message, error) {
-	partnerID, err := s.GetUserIDByUsername(ctx, partnerUsername)
+// Message directions for GetMessages, from the fetching user's side.
+const (
+	DirectionBoth     = "both"
+	DirectionIncoming = "incoming" // Only messages the partner sent
+	DirectionOutgoing = "outgoing" // Only messages I sent
+)
+
+// MessagePageLimit caps the messages one GetMessages call returns. The
+// rest follow from the highest ID returned, like any other cursor.
+const MessagePageLimit = 1000
+
+// ParseDirection returns the Direction constant d names, DirectionBoth if d
+// is empty, or false if it names none.
+func ParseDirection(d string) (string, bool) {
+	switch d {
+	case "":
+		return DirectionBoth, true
+	case DirectionBoth, DirectionIncoming, DirectionOutgoing:
+		return d, true
+	}
+	return "", false
+}
+
+// MessageSnapshot is what a message read could see: the highest message
+// ID and Seq in the conversation (or among the user's sealed messages) when
+// it ran, whichever direction was asked for. A pushed message with a higher
+// Seq is newer than the read; one at or below it was already visible to it.
+type MessageSnapshot struct {
+	MaxID  int   `json:"max_id"`            // 0 if there are no messages
+	MaxSeq int64 `json:"max_seq,omitempty"` // Absent for sealed reads
+}
+
+// messagePage is a message read with its snapshot, for retryRead.
+type messagePage struct {
+	messages []Message
+	snapshot MessageSnapshot
+}
+
+// beginSnapshot starts a read-only transaction whose statements all see
+// the same snapshot.
+func (s *PostgresStore) beginSnapshot(ctx context.Context) (pgx.Tx, error) {
+	return s.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+}
+
+// LastMessageID returns the highest message ID handed out so far, or 0 if
+// none has been. It reads the ID sequence rather than the table, so it
+// doesn't go down when the newest messages are deleted; no cursor a client
+// was given can be above it.
+func (s *PostgresStore) LastMessageID(ctx context.Context) (int64, error) {
+	var id int64
+	err := s.db.QueryRow(ctx,
+		"SELECT COALESCE(pg_sequence_last_value(pg_get_serial_sequence('messages', 'id')), 0)").Scan(&id)
 	if err != nil {
-		return nil, fmt.Errorf("partner user not found")
+		return 0, fmt.Errorf("database error: %w", err)
 	}
+	return id, nil
+}
 
-	rows, err := s.db.Query(ctx,
-		`
+// conversationPageQuery reads a page of a conversation for GetMessages:
+// $1 is the reader, $2 the partner, $3 the cursor, $4 the direction and
+// $5 the page size.
+//
+// The two directions are queried separately and merged so each half can
+// use its own composite index (sender_id, recipient_id, id) instead of a
+// bitmap-or over the whole table. Each half stops after a page, so a
+// long conversation costs one page per direction, not its whole
+// history. A direction filter turns a half off with a one-time filter,
+// so that half costs no index scan.
+const conversationPageQuery = `
         SELECT 
             m.id, 
             m.sender_id, 
             m.recipient_id, 
             m.timestamp, 
             u_sender.username AS sender_username,
-            CASE
-                WHEN m.sender_id = $1 THEN m.sender_blob
-                ELSE m.recipient_blob
-            END AS encrypted_blob
-        FROM messages m
+            -- The first half is always my sent copy, the second my received one
+            m.blob,
+            m.blob_key_id,
+            COALESCE(m.seq, 0)
+        FROM (
+            (SELECT id, sender_id, recipient_id, timestamp, sender_blob AS blob, blob_key_id, seq
+             FROM messages WHERE sender_id = $1 AND recipient_id = $2 AND id > $3 AND $4::text <> 'incoming' ORDER BY id LIMIT $5)
+            UNION ALL
+            (SELECT id, sender_id, recipient_id, timestamp, recipient_blob AS blob, blob_key_id, seq
+             FROM messages WHERE sender_id = $2 AND recipient_id = $1 AND id > $3 AND $4::text <> 'outgoing' ORDER BY id LIMIT $5)
+        ) m
         JOIN users u_sender ON u_sender.id = m.sender_id
-        WHERE 
-            ((m.sender_id = $1 AND m.recipient_id = $2) OR (m.sender_id = $2 AND m.recipient_id = $1))
-            AND m.id > $3
-        ORDER BY m.timestamp ASC
-        `,
-		myID, partnerID, sinceID)
+        ORDER BY m.id ASC
+        LIMIT $5
+        `
 
+// GetMessages fetches the messages between two users with an ID greater
+// than sinceID, in the given direction, ordered by ID, at most
+// MessagePageLimit of them. Messages whose copy for myID has been pruned
+// are returned as Deleted stubs (see Message).
+func (s *PostgresStore) GetMessages(ctx context.Context, myID int, partnerUsername string, sinceID int, direction string) ([]Message, MessageSnapshot, error) {
+	page, err := retryRead(ctx, func() (messagePage, error) { return s.getMessages(ctx, myID, partnerUsername, sinceID, direction) })
+	return page.messages, page.snapshot, err
+}
+
+func (s *PostgresStore) getMessages(ctx context.Context, myID int, partnerUsername string, sinceID int, direction string) (messagePage, error) {
+	partnerID, err := s.GetUserIDByUsername(ctx, partnerUsername)
 	if err != nil {
-		return nil, fmt.Errorf("database error: %v", err)
+		return messagePage{}, fmt.Errorf("partner user not found")
+	}
+	if partnerID == myID {
+		return messagePage{}, fmt.Errorf("cannot fetch a conversation with yourself")
+	}
+
+	tx, err := s.beginSnapshot(ctx)
+	if err != nil {
+		return messagePage{}, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var page messagePage
+	err = tx.QueryRow(ctx,
+		`
+        SELECT
+            COALESCE(GREATEST(
+                (SELECT MAX(id) FROM messages WHERE sender_id = $1 AND recipient_id = $2),
+                (SELECT MAX(id) FROM messages WHERE sender_id = $2 AND recipient_id = $1)
+            ), 0),
+            COALESCE((SELECT last_seq FROM conversation_stats
+                      WHERE user_low = LEAST($1::int, $2::int) AND user_high = GREATEST($1::int, $2::int)), 0)
+        `, myID, partnerID,
+	).Scan(&page.snapshot.MaxID, &page.snapshot.MaxSeq)
+	if err != nil {
+		return messagePage{}, fmt.Errorf("database error: %w", err)
+	}
+
+	rows, err := tx.Query(ctx, conversationPageQuery,
+		myID, partnerID, sinceID, direction, MessagePageLimit)
+
+	if err != nil {
+		return messagePage{}, fmt.Errorf("database error: %w", err)
 	}
 	defer rows.Close()
 
-	var messages []Message
+	page.messages = []Message{} // Encodes as [] when empty
 	for rows.Next() {
 		var msg Message
-		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.RecipientID, &msg.Timestamp, &msg.SenderUsername, &msg.EncryptedBlob); err != nil {
-			return nil, fmt.Errorf("database scan error: %v", err)
+		var blob, keyID *string
+		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.RecipientID, &msg.Timestamp, &msg.SenderUsername, &blob, &keyID, &msg.Seq); err != nil {
+			return messagePage{}, fmt.Errorf("database scan error: %w", err)
+		}
+		if blob == nil {
+			msg.Deleted = true
+		} else if msg.EncryptedBlob, err = s.blobs.open(*blob, keyID, blobAADMessages); err != nil {
+			return messagePage{}, fmt.Errorf("blob decryption error: %v", err)
 		}
-		messages = append(messages, msg)
+		page.messages = append(page.messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return messagePage{}, fmt.Errorf("database error: %w", err)
+	}
+	return page, nil
+}
+
+// ---- Account Summary Methods ----
+
+// MessageCounts holds how many messages a user has sent and received.
+type MessageCounts struct {
+	Sent     int `json:"sent"`
+	Received int `json:"received"`
+}
+
+// CountMessages counts the messages a user has sent and received, from the
+// per-conversation counters. Sealed-sender messages have no conversation and
+// are counted directly as received; sent ones can't be attributed.
+func (s *PostgresStore) CountMessages(ctx context.Context, userID int) (MessageCounts, error) {
+	var counts MessageCounts
+	err := s.db.QueryRow(ctx,
+		`
+        SELECT
+            COALESCE(SUM(CASE WHEN user_low = $1 THEN low_sent ELSE high_sent END), 0),
+            COALESCE(SUM(CASE WHEN user_low = $1 THEN high_sent ELSE low_sent END), 0)
+                + (SELECT COUNT(*) FROM messages WHERE recipient_id = $1 AND sender_id IS NULL)
+        FROM conversation_stats
+        WHERE user_low = $1 OR user_high = $1
+        `, userID,
+	).Scan(&counts.Sent, &counts.Received)
+	if err != nil {
+		return MessageCounts{}, fmt.Errorf("database error: %w", err)
+	}
+	return counts, nil
+}
+
+// RequestCounts holds a user's pending chat requests in each direction.
+// Incoming excludes shadow-filtered requests.
+type RequestCounts struct {
+	Incoming int `json:"incoming"`
+	Outgoing int `json:"outgoing"`
+}
+
+// CountPendingRequests counts pending chat requests to and from a user.
+func (s *PostgresStore) CountPendingRequests(ctx context.Context, userID int) (RequestCounts, error) {
+	var counts RequestCounts
+	err := s.db.QueryRow(ctx,
+		`
+        SELECT
+            COUNT(*) FILTER (WHERE requested_id = $1 AND NOT filtered),
+            COUNT(*) FILTER (WHERE requester_id = $1)
+        FROM chat_requests
+        WHERE (requested_id = $1 OR requester_id = $1) AND status = 'pending'
+        `, userID,
+	).Scan(&counts.Incoming, &counts.Outgoing)
+	if err != nil {
+		return RequestCounts{}, fmt.Errorf("database error: %w", err)
+	}
+	return counts, nil
+}
+
+// BadgeCounts holds the numbers a client shows on its app icon.
+type BadgeCounts struct {
+	// Unread counts messages to the user, sealed ones included, that their
+	// client hasn't confirmed receiving and whose copy hasn't been pruned
+	Unread int `json:"unread"`
+	// PendingRequests counts incoming pending requests, excluding
+	// shadow-filtered ones
+	PendingRequests int `json:"pending_requests"`
+}
+
+// CountBadge returns a user's badge counts in one query.
+func (s *PostgresStore) CountBadge(ctx context.Context, userID int) (BadgeCounts, error) {
+	var counts BadgeCounts
+	err := s.db.QueryRow(ctx,
+		`
+        SELECT
+            (SELECT COUNT(*) FROM messages
+             WHERE recipient_id = $1 AND delivered_at IS NULL AND recipient_blob IS NOT NULL),
+            (SELECT COUNT(*) FROM chat_requests
+             WHERE requested_id = $1 AND status = 'pending' AND NOT filtered)
+        `, userID,
+	).Scan(&counts.Unread, &counts.PendingRequests)
+	if err != nil {
+		return BadgeCounts{}, fmt.Errorf("database error: %w", err)
+	}
+	return counts, nil
+}
+
+// CountContacts counts a user's accepted chat partners.
+func (s *PostgresStore) CountContacts(ctx context.Context, userID int) (int, error) {
+	var count int
+	err := s.db.QueryRow(ctx,
+		`
+        SELECT COUNT(DISTINCT CASE WHEN requester_id = $1 THEN requested_id ELSE requester_id END)
+        FROM chat_requests
+        WHERE (requester_id = $1 OR requested_id = $1) AND status = 'accepted'
+        `, userID,
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return count, nil
+}
+
+// GetStorageUsage returns the bytes of blob data stored on behalf of a user:
+// the sender copy of messages they sent plus the recipient copy of messages
+// they received, from the per-conversation counters plus any sealed-sender
+// messages they received.
+func (s *PostgresStore) GetStorageUsage(ctx context.Context, userID int) (int64, error) {
+	var usage int64
+	err := s.db.QueryRow(ctx,
+		`
+        SELECT COALESCE(SUM(CASE WHEN user_low = $1 THEN low_bytes ELSE high_bytes END), 0)
+            + (SELECT COALESCE(SUM(octet_length(recipient_blob)), 0)
+               FROM messages WHERE recipient_id = $1 AND sender_id IS NULL)
+        FROM conversation_stats
+        WHERE user_low = $1 OR user_high = $1
+        `, userID,
+	).Scan(&usage)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return usage, nil
+}
+
+// HasPublicKey reports whether a user has uploaded a public key.
+func (s *PostgresStore) HasPublicKey(ctx context.Context, userID int) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM public_keys WHERE user_id = $1)", userID,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
 	}
-	return messages, nil
+	return exists, nil
 }
@@ -0,0 +1,90 @@
+// src/store/postgres_test.go
+package store
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"cryptachat-server/testutil"
+)
+
+// newTestStore opens a store on a fresh schema of the test database,
+// with schema.sql and every migration applied.
+func newTestStore(t testing.TB) *PostgresStore {
+	t.Helper()
+	s, err := NewPostgresStore(testutil.DatabaseURL(t), "schema.sql")
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// mustRegister registers username and returns their ID.
+func mustRegister(t testing.TB, s *PostgresStore, username string) int {
+	t.Helper()
+	ctx := context.Background()
+	if err := s.RegisterUser(ctx, username, "hash", nil); err != nil {
+		t.Fatalf("registering %s: %v", username, err)
+	}
+	id, err := s.GetUserIDByUsername(ctx, username)
+	if err != nil {
+		t.Fatalf("looking up %s: %v", username, err)
+	}
+	return id
+}
+
+// casingVariant spells name with the letters picked by the bits of i in
+// upper case.
+func casingVariant(name string, i int) string {
+	b := []byte(name)
+	for j := range b {
+		if i&(1<<j) != 0 {
+			b[j] = strings.ToUpper(string(b[j]))[0]
+		}
+	}
+	return string(b)
+}
+
+func TestRegisterUserConcurrentCasingVariants(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	const n = 50
+	errs := make([]error, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = s.RegisterUser(ctx, casingVariant("charlie", i), "hash", nil)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	succeeded := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case err.Error() != "username already exists":
+			t.Errorf("registration %d (%s): %v", i, casingVariant("charlie", i), err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d registrations succeeded, want 1", succeeded)
+	}
+
+	var rows int
+	if err := s.db.QueryRow(ctx, "SELECT count(*) FROM users WHERE lower(username) = 'charlie'").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Errorf("%d rows for charlie, want 1", rows)
+	}
+}
@@ -0,0 +1,119 @@
+// src/store/prekeys.go
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Prekey is a client-generated one-time public prekey.
+type Prekey struct {
+	KeyID     int    `json:"key_id"`
+	PublicKey string `json:"public_key"`
+}
+
+// PrekeyBundle is what a peer needs to start a session with a user.
+// OneTimePrekey is nil when the user has run out.
+type PrekeyBundle struct {
+	Username      string  `json:"username"`
+	IdentityKey   string  `json:"identity_key"`
+	OneTimePrekey *Prekey `json:"one_time_prekey"`
+}
+
+// AddPrekeys stores new one-time prekeys for a user. Key IDs the user has
+// already uploaded are skipped. It returns how many were added.
+func (s *PostgresStore) AddPrekeys(ctx context.Context, userID int, prekeys []Prekey) (int, error) {
+	batch := &pgx.Batch{}
+	for _, pk := range prekeys {
+		batch.Queue(
+			"INSERT INTO one_time_prekeys (user_id, key_id, public_key, created_at) VALUES ($1, $2, $3, $4) ON CONFLICT (user_id, key_id) DO NOTHING",
+			userID, pk.KeyID, pk.PublicKey, s.clock.Now().UTC())
+	}
+
+	results := s.db.SendBatch(ctx, batch)
+	defer results.Close()
+
+	added := 0
+	for range prekeys {
+		cmdTag, err := results.Exec()
+		if err != nil {
+			return added, fmt.Errorf("database error: %w", err)
+		}
+		added += int(cmdTag.RowsAffected())
+	}
+	return added, nil
+}
+
+// CountPrekeys returns how many unused one-time prekeys a user has left.
+func (s *PostgresStore) CountPrekeys(ctx context.Context, userID int) (int, error) {
+	var n int
+	err := s.db.QueryRow(ctx,
+		"SELECT COUNT(*) FROM one_time_prekeys WHERE user_id = $1", userID,
+	).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return n, nil
+}
+
+// GetPrekeyBundle returns a user's identity key together with one of their
+// one-time prekeys, which is deleted so it is never served twice.
+//
+// The pop is a single DELETE of the oldest row not locked by a concurrent
+// fetch (SKIP LOCKED), so many callers fetching the same user's bundle
+// neither queue behind one another nor receive the same prekey. When all
+// remaining prekeys are locked or used up the bundle is returned without one.
+func (s *PostgresStore) GetPrekeyBundle(ctx context.Context, username string) (*PrekeyBundle, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID int
+	bundle := &PrekeyBundle{}
+	err = tx.QueryRow(ctx,
+		`
+        SELECT u.id, u.username, pk.public_key
+        FROM users u
+        JOIN public_keys pk ON pk.user_id = u.id
+        WHERE lower(u.username) = $1
+        `, CanonicalUsername(username),
+	).Scan(&userID, &bundle.Username, &bundle.IdentityKey)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, fmt.Errorf("user not found or has no public key")
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	var prekey Prekey
+	err = tx.QueryRow(ctx,
+		`
+        DELETE FROM one_time_prekeys
+        WHERE id = (
+            SELECT id FROM one_time_prekeys
+            WHERE user_id = $1
+            ORDER BY id
+            LIMIT 1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING key_id, public_key
+        `, userID,
+	).Scan(&prekey.KeyID, &prekey.PublicKey)
+	switch {
+	case err == pgx.ErrNoRows:
+		// Exhausted: the bundle is still usable without a one-time prekey
+	case err != nil:
+		return nil, fmt.Errorf("database error: %w", err)
+	default:
+		bundle.OneTimePrekey = &prekey
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return bundle, nil
+}
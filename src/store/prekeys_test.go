@@ -0,0 +1,65 @@
+// src/store/prekeys_test.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestGetPrekeyBundleConcurrentClaims(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	bob := mustRegister(t, s, "bob")
+	if err := s.UploadPublicKey(ctx, bob, "identity-key"); err != nil {
+		t.Fatal(err)
+	}
+	const prekeys, fetches = 50, 100
+	var uploaded []Prekey
+	for i := 1; i <= prekeys; i++ {
+		uploaded = append(uploaded, Prekey{KeyID: i, PublicKey: fmt.Sprintf("prekey-%d", i)})
+	}
+	if n, err := s.AddPrekeys(ctx, bob, uploaded); err != nil || n != prekeys {
+		t.Fatalf("AddPrekeys = %d, %v", n, err)
+	}
+
+	bundles := make([]*PrekeyBundle, fetches)
+	errs := make([]error, fetches)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < fetches; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			bundles[i], errs[i] = s.GetPrekeyBundle(ctx, "bob")
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	served := make(map[int]int) // Key ID -> fetch that got it
+	for i, b := range bundles {
+		if errs[i] != nil {
+			t.Fatalf("fetch %d: %v", i, errs[i])
+		}
+		if b.IdentityKey != "identity-key" {
+			t.Errorf("fetch %d: identity key %q", i, b.IdentityKey)
+		}
+		if b.OneTimePrekey == nil {
+			continue
+		}
+		if other, ok := served[b.OneTimePrekey.KeyID]; ok {
+			t.Errorf("prekey %d served to fetches %d and %d", b.OneTimePrekey.KeyID, other, i)
+		}
+		served[b.OneTimePrekey.KeyID] = i
+	}
+	if len(served) != prekeys {
+		t.Errorf("%d fetches got a prekey, want %d", len(served), prekeys)
+	}
+	if n, err := s.CountPrekeys(ctx, bob); err != nil || n != 0 {
+		t.Errorf("CountPrekeys = %d, %v; want 0", n, err)
+	}
+}
@@ -0,0 +1,182 @@
+// src/store/refresh_tokens.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Refresh tokens are exchanged at POST /refresh for a new access token and
+// a new refresh token. Tokens are stored as hashes, grouped in families:
+// each login starts one, and each exchange adds the replacement to it. A
+// token exchanged twice means it was copied, so the whole family is
+// revoked and whoever holds its current token has to log in again. Each
+// family has a session (see sessions.go), which goes when the family is
+// revoked.
+
+// CreateRefreshToken stores a new token for userID, starting or continuing
+// family.
+func (s *PostgresStore) CreateRefreshToken(ctx context.Context, userID int, family string, tokenHash []byte, expiresAt time.Time) error {
+	_, err := s.db.Exec(ctx,
+		`
+        INSERT INTO refresh_tokens (user_id, family_id, token_hash, created_at, expires_at)
+        VALUES ($1, $2, $3, $4, $5)
+        `, userID, family, tokenHash, s.clock.Now().UTC(), expiresAt)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// RotateRefreshToken exchanges the token with oldHash for one with newHash
+// in the same family, expiring at expiresAt, and returns its user and
+// session; the session is 0 for families from before sessions. Fails
+// with "refresh token not found", "refresh token expired" or "refresh
+// token revoked". A token that was already exchanged fails with "refresh
+// token reused" and revokes its family.
+func (s *PostgresStore) RotateRefreshToken(ctx context.Context, oldHash, newHash []byte, expiresAt time.Time) (int, int64, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		id, userID     int
+		family         string
+		tokenExpiresAt time.Time
+		usedAt         *time.Time
+		revokedAt      *time.Time
+	)
+	err = tx.QueryRow(ctx,
+		`
+        SELECT id, user_id, family_id, expires_at, used_at, revoked_at
+        FROM refresh_tokens WHERE token_hash = $1
+        FOR UPDATE
+        `, oldHash,
+	).Scan(&id, &userID, &family, &tokenExpiresAt, &usedAt, &revokedAt)
+	if err == pgx.ErrNoRows {
+		return 0, 0, fmt.Errorf("refresh token not found")
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+
+	now := s.clock.Now().UTC()
+	switch {
+	case revokedAt != nil:
+		return 0, 0, fmt.Errorf("refresh token revoked")
+	case usedAt != nil:
+		if err := revokeFamily(ctx, tx, family, now); err != nil {
+			return 0, 0, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return 0, 0, fmt.Errorf("database error: %w", err)
+		}
+		return 0, 0, fmt.Errorf("refresh token reused")
+	case !tokenExpiresAt.After(now):
+		return 0, 0, fmt.Errorf("refresh token expired")
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE refresh_tokens SET used_at = $2 WHERE id = $1", id, now); err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		`
+        INSERT INTO refresh_tokens (user_id, family_id, token_hash, created_at, expires_at)
+        VALUES ($1, $2, $3, $4, $5)
+        `, userID, family, newHash, now, expiresAt)
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	var sessionID int64
+	err = tx.QueryRow(ctx,
+		"UPDATE sessions SET last_seen_at = $2, expires_at = $3 WHERE family_id = $1 RETURNING id",
+		family, now, expiresAt).Scan(&sessionID)
+	if err != nil && err != pgx.ErrNoRows {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	return userID, sessionID, nil
+}
+
+// revokeFamily revokes every token of family not revoked yet, and ends
+// its session.
+func revokeFamily(ctx context.Context, tx pgx.Tx, family string, now time.Time) error {
+	_, err := tx.Exec(ctx,
+		"UPDATE refresh_tokens SET revoked_at = $2 WHERE family_id = $1 AND revoked_at IS NULL",
+		family, now)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM sessions WHERE family_id = $1", family); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// RevokeRefreshToken revokes the family of the token with tokenHash, i.e.
+// logs out the session it belongs to. Unknown tokens are ignored.
+func (s *PostgresStore) RevokeRefreshToken(ctx context.Context, tokenHash []byte) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var family string
+	err = tx.QueryRow(ctx, "SELECT family_id FROM refresh_tokens WHERE token_hash = $1", tokenHash).Scan(&family)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if err := revokeFamily(ctx, tx, family, s.clock.Now().UTC()); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// RevokeUserRefreshTokens revokes all of userID's refresh tokens and ends
+// their sessions, e.g. on /logout_all. It returns how many tokens were
+// still live.
+func (s *PostgresStore) RevokeUserRefreshTokens(ctx context.Context, userID int) (int64, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		"UPDATE refresh_tokens SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL AND used_at IS NULL AND expires_at > $2",
+		userID, s.clock.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM sessions WHERE user_id = $1", userID); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// PruneRefreshTokens deletes tokens that expired before olderThan. Used
+// tokens are kept until then so that reuse is still detected.
+func (s *PostgresStore) PruneRefreshTokens(ctx context.Context, olderThan time.Time) (int64, error) {
+	tag, err := s.db.Exec(ctx, "DELETE FROM refresh_tokens WHERE expires_at < $1", olderThan)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,50 @@
+// src/store/registration.go
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// The registration mode lets an admin close sign-ups, or require invites,
+// without a restart. It lives in the database so every replica sees the
+// same one; the service checks what it means.
+
+// GetRegistrationMode returns the mode an admin set, or "" if none has been.
+func (s *PostgresStore) GetRegistrationMode(ctx context.Context) (string, error) {
+	var mode string
+	err := s.db.QueryRow(ctx, "SELECT mode FROM registration_mode").Scan(&mode)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("database error: %w", err)
+	}
+	return mode, nil
+}
+
+// SetRegistrationMode stores mode as set by adminID (0 for the admin
+// token), and returns the mode it replaced ("" if none had been set).
+func (s *PostgresStore) SetRegistrationMode(ctx context.Context, mode string, adminID int) (string, error) {
+	var admin *int
+	if adminID != 0 {
+		admin = &adminID
+	}
+	var previous *string
+	err := s.db.QueryRow(ctx,
+		`
+        WITH old AS (SELECT mode FROM registration_mode)
+        INSERT INTO registration_mode (mode, updated_by, updated_at) VALUES ($1, $2, $3)
+        ON CONFLICT (id) DO UPDATE SET mode = EXCLUDED.mode, updated_by = EXCLUDED.updated_by, updated_at = EXCLUDED.updated_at
+        RETURNING (SELECT mode FROM old)
+        `, mode, admin, s.clock.Now().UTC()).Scan(&previous)
+	if err != nil {
+		return "", fmt.Errorf("database error: %w", err)
+	}
+	if previous == nil {
+		return "", nil
+	}
+	return *previous, nil
+}
@@ -0,0 +1,139 @@
+// src/store/relationships.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Relationship states, from the viewing user's side.
+const (
+	RelationshipAccepted        = "accepted"
+	RelationshipIncomingPending = "incoming_pending"
+	RelationshipOutgoingPending = "outgoing_pending"
+	RelationshipDeclinedByMe    = "declined_by_me"
+)
+
+// Relationship is one user the viewer has a chat request with, in either direction.
+type Relationship struct {
+	Username     string     `json:"username"`
+	State        string     `json:"state"`
+	HasPublicKey bool       `json:"has_public_key"`
+	LastActivity *Timestamp `json:"last_activity"` // Latest request or message between the two
+	// AcceptedAt is when the request was accepted; nil unless State is accepted.
+	AcceptedAt *Timestamp `json:"accepted_at,omitempty"`
+	// InitiatedByMe is true if the viewer sent the request behind State.
+	InitiatedByMe bool `json:"initiated_by_me"`
+}
+
+// GetRelationships lists everyone myID has a chat_requests row with, ordered
+// by username and starting after the given username (keyset pagination).
+//
+// When rows exist in both directions the most significant state wins
+// (accepted, then incoming, then outgoing, then declined), so each user
+// appears once. An outgoing request the other side declined or that was
+// shadow-filtered still shows as outgoing_pending, and filtered incoming
+// requests are left out, matching what /get_chat_requests reveals.
+func (s *PostgresStore) GetRelationships(ctx context.Context, myID int, afterUsername string, limit int) ([]Relationship, error) {
+	rows, err := s.db.Query(ctx,
+		`
+        WITH rel AS (
+            SELECT
+                CASE WHEN requester_id = $1 THEN requested_id ELSE requester_id END AS other_id,
+                CASE
+                    WHEN status = 'accepted' THEN 'accepted'
+                    WHEN requester_id = $1 AND status IN ('pending', 'declined') THEN 'outgoing_pending'
+                    WHEN status = 'pending' AND NOT filtered THEN 'incoming_pending'
+                    WHEN status = 'declined' THEN 'declined_by_me'
+                END AS state,
+                created_at,
+                accepted_at,
+                requester_id = $1 AS initiated_by_me
+            FROM chat_requests
+            WHERE requester_id = $1 OR requested_id = $1
+        ),
+        best AS (
+            SELECT DISTINCT ON (other_id) other_id, state, accepted_at, initiated_by_me,
+                MAX(created_at) OVER (PARTITION BY other_id) AS requested_at
+            FROM rel
+            WHERE state IS NOT NULL
+            ORDER BY other_id, CASE state
+                WHEN 'accepted' THEN 0
+                WHEN 'incoming_pending' THEN 1
+                WHEN 'outgoing_pending' THEN 2
+                ELSE 3
+            END
+        )
+        SELECT
+            u.username,
+            b.state,
+            pk.user_id IS NOT NULL,
+            CASE WHEN b.state = 'accepted' THEN b.accepted_at END,
+            b.initiated_by_me,
+            GREATEST(
+                b.requested_at,
+                (SELECT m.timestamp FROM messages m
+                 WHERE m.sender_id = $1 AND m.recipient_id = u.id ORDER BY m.id DESC LIMIT 1),
+                (SELECT m.timestamp FROM messages m
+                 WHERE m.sender_id = u.id AND m.recipient_id = $1 ORDER BY m.id DESC LIMIT 1)
+            )
+        FROM best b
+        JOIN users u ON u.id = b.other_id
+        LEFT JOIN public_keys pk ON pk.user_id = u.id
+        WHERE u.username > $2
+        ORDER BY u.username
+        LIMIT $3
+        `, myID, afterUsername, limit)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	relationships, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Relationship, error) {
+		var r Relationship
+		err := row.Scan(&r.Username, &r.State, &r.HasPublicKey, &r.AcceptedAt, &r.InitiatedByMe, &r.LastActivity)
+		return r, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return relationships, nil
+}
+
+// Relationship versions count changes to what /get_contacts and
+// /get_chat_requests return for a user (see migrations/0022). Writers bump
+// them in the same transaction as the change, for exactly the users whose
+// lists change, so a version never moves because of something the user
+// can't see, like their request being declined or filtered. Bumps lock
+// version rows in user ID order, so concurrent ones can't deadlock.
+
+// bumpRelationshipsVersions adds one to each of userIDs' relationship
+// versions.
+func bumpRelationshipsVersions(ctx context.Context, tx pgx.Tx, userIDs ...int) error {
+	ids := append([]int(nil), userIDs...)
+	slices.Sort(ids)
+	for _, id := range slices.Compact(ids) {
+		if _, err := tx.Exec(ctx,
+			`
+            INSERT INTO relationship_versions (user_id, version) VALUES ($1, 1)
+            ON CONFLICT (user_id) DO UPDATE SET version = relationship_versions.version + 1
+            `, id); err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetRelationshipsVersion returns userID's relationship version, 0 if
+// nothing has changed for them yet.
+func (s *PostgresStore) GetRelationshipsVersion(ctx context.Context, userID int) (int64, error) {
+	var version int64
+	err := s.db.QueryRow(ctx,
+		"SELECT COALESCE((SELECT version FROM relationship_versions WHERE user_id = $1), 0)", userID,
+	).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return version, nil
+}
@@ -0,0 +1,118 @@
+// src/store/relationships_test.go
+package store
+
+import (
+	"context"
+	"testing"
+)
+
+// versionTracker checks relationship versions move by the expected step
+// for every user it follows, the ones a change mustn't touch included.
+type versionTracker struct {
+	t    *testing.T
+	s    *PostgresStore
+	last map[int]int64
+}
+
+func newVersionTracker(t *testing.T, s *PostgresStore, userIDs ...int) *versionTracker {
+	v := &versionTracker{t: t, s: s, last: make(map[int]int64)}
+	for _, id := range userIDs {
+		v.last[id] = v.get(id)
+	}
+	return v
+}
+
+func (v *versionTracker) get(userID int) int64 {
+	v.t.Helper()
+	version, err := v.s.GetRelationshipsVersion(context.Background(), userID)
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	return version
+}
+
+// check fails unless each followed user's version moved by bumps[id] (0
+// if absent) since the last check.
+func (v *versionTracker) check(what string, bumps map[int]int64) {
+	v.t.Helper()
+	for id, last := range v.last {
+		got := v.get(id)
+		if got-last != bumps[id] {
+			v.t.Errorf("%s: user %d's version went from %d to %d, want +%d", what, id, last, got, bumps[id])
+		}
+		v.last[id] = got
+	}
+}
+
+// TestRelationshipVersionBumps walks chat requests through each change
+// that alters someone's contact or request list, and checks exactly the
+// users whose lists changed have their version bumped: both parties where
+// both lists change, and nobody else.
+func TestRelationshipVersionBumps(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	alice := mustRegister(t, s, "alice")
+	bob := mustRegister(t, s, "bob")
+	carol := mustRegister(t, s, "carol")
+	dave := mustRegister(t, s, "dave")
+	erin := mustRegister(t, s, "erin")
+	v := newVersionTracker(t, s, alice, bob, carol, dave, erin)
+
+	// A pending request shows up in the recipient's requests only
+	if _, err := s.RequestChat(ctx, alice, "bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	v.check("alice requests bob", map[int]int64{bob: 1})
+
+	// Accepting adds each to the other's contacts, so the requester's
+	// version moves on the recipient's accept
+	if _, err := s.AcceptChat(ctx, bob, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	v.check("bob accepts", map[int]int64{alice: 1, bob: 1})
+
+	// A repeated accept changes nothing
+	if changed, err := s.AcceptChat(ctx, bob, "alice"); err != nil || changed {
+		t.Fatalf("second accept: %v, %v; want no change", changed, err)
+	}
+	v.check("bob accepts again", nil)
+
+	// A decline drops the request from the recipient's list, and the
+	// requester isn't told
+	if _, err := s.RequestChat(ctx, carol, "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	v.check("carol requests alice", map[int]int64{alice: 1})
+	if err := s.DeclineChat(ctx, alice, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	v.check("alice declines carol", map[int]int64{alice: 1})
+
+	// Requesting someone who has a pending request to you accepts it
+	if _, err := s.RequestChat(ctx, dave, "bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	v.check("dave requests bob", map[int]int64{bob: 1})
+	if accepted, err := s.RequestChat(ctx, bob, "dave", ""); err != nil || !accepted {
+		t.Fatalf("crossed request: %v, %v; want it accepted", accepted, err)
+	}
+	v.check("bob requests dave back", map[int]int64{bob: 1, dave: 1})
+
+	// A rename changes the name in the lists of everyone bob has a
+	// request with; bob's own lists don't show his name
+	if _, err := s.RequestChat(ctx, erin, "bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	v.check("erin requests bob", map[int]int64{bob: 1})
+	if _, _, _, err := s.RenameUser(ctx, bob, "robert"); err != nil {
+		t.Fatal(err)
+	}
+	v.check("bob renamed", map[int]int64{alice: 1, dave: 1, erin: 1})
+
+	// Deleting an account removes it from the same lists
+	if _, err := s.DeleteUser(ctx, bob); err != nil {
+		t.Fatal(err)
+	}
+	delete(v.last, bob)
+	v.check("bob deleted", map[int]int64{alice: 1, dave: 1, erin: 1})
+}
@@ -0,0 +1,200 @@
+// src/store/retention.go
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ---- Settings Methods ----
+
+// UserSettings holds a user's preferences.
+type UserSettings struct {
+	// RetentionDays is how long the user's copy of messages is kept.
+	// nil means the server default; 0 means forever.
+	RetentionDays *int `json:"retention_days"`
+	// InboundMessagesPerHour caps messages to the user from everyone
+	// together; nil means unlimited.
+	InboundMessagesPerHour *int `json:"inbound_messages_per_hour"`
+	// PushBadgeCounts allows push payloads to carry the user's unread and
+	// pending request counts.
+	PushBadgeCounts bool `json:"push_badge_counts"`
+}
+
+// GetUserSettings returns a user's settings, or the defaults if none are saved.
+func (s *PostgresStore) GetUserSettings(ctx context.Context, userID int) (UserSettings, error) {
+	settings := UserSettings{PushBadgeCounts: true}
+	err := s.db.QueryRow(ctx,
+		"SELECT retention_days, inbound_messages_per_hour, push_badge_counts FROM user_settings WHERE user_id = $1", userID,
+	).Scan(&settings.RetentionDays, &settings.InboundMessagesPerHour, &settings.PushBadgeCounts)
+	if err != nil && err != pgx.ErrNoRows {
+		return UserSettings{}, fmt.Errorf("database error: %w", err)
+	}
+	return settings, nil
+}
+
+// SetRetentionDays stores a user's retention preference (nil = server default).
+func (s *PostgresStore) SetRetentionDays(ctx context.Context, userID int, days *int) error {
+	_, err := s.db.Exec(ctx,
+		`
+        INSERT INTO user_settings (user_id, retention_days) VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE SET retention_days = EXCLUDED.retention_days
+        `, userID, days)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// SetPushBadgeCounts stores whether push payloads may carry the user's counts.
+func (s *PostgresStore) SetPushBadgeCounts(ctx context.Context, userID int, enabled bool) error {
+	_, err := s.db.Exec(ctx,
+		`
+        INSERT INTO user_settings (user_id, push_badge_counts) VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE SET push_badge_counts = EXCLUDED.push_badge_counts
+        `, userID, enabled)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// SetLegalHold sets or clears the admin legal-hold flag on a user.
+func (s *PostgresStore) SetLegalHold(ctx context.Context, username string, hold bool) error {
+	cmdTag, err := s.db.Exec(ctx,
+		"UPDATE users SET legal_hold = $1 WHERE lower(username) = $2", hold, CanonicalUsername(username))
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
+
+// ---- Retention Methods ----
+
+// PruneResult reports what one pruning pass removed.
+type PruneResult struct {
+	SenderCopies    int64
+	RecipientCopies int64
+	Rows            int64
+}
+
+// PruneExpiredMessages applies each participant's retention preference to
+// their own copy of a message: a sender's preference nulls sender_blob and a
+// recipient's nulls recipient_blob. Users on legal hold are skipped. Rows are
+// hard-deleted only once both copies are gone. defaultDays is used for users
+// without a preference; 0 keeps messages forever.
+func (s *PostgresStore) PruneExpiredMessages(ctx context.Context, defaultDays int) (PruneResult, error) {
+	var res PruneResult
+	now := s.clock.Now().UTC()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return res, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// $1 = now, $2 = server default retention in days
+	const effectiveDays = "COALESCE(us.retention_days, $2)"
+
+	// Conversations whose counters need recounting once the pass is done
+	touched := make(map[conversationPair]struct{})
+
+	res.SenderCopies, err = pruneCopies(ctx, tx, touched,
+		`
+        UPDATE messages m
+        SET sender_blob = NULL
+        FROM users u
+        LEFT JOIN user_settings us ON us.user_id = u.id
+        WHERE u.id = m.sender_id
+          AND m.sender_blob IS NOT NULL
+          AND NOT u.legal_hold
+          AND `+effectiveDays+` > 0
+          AND m.timestamp < $1 - make_interval(days => `+effectiveDays+`)
+        RETURNING m.sender_id, m.recipient_id
+        `, now, defaultDays)
+	if err != nil {
+		return res, fmt.Errorf("database error (sender copies): %w", err)
+	}
+
+	res.RecipientCopies, err = pruneCopies(ctx, tx, touched,
+		`
+        UPDATE messages m
+        SET recipient_blob = NULL
+        FROM users u
+        LEFT JOIN user_settings us ON us.user_id = u.id
+        WHERE u.id = m.recipient_id
+          AND m.recipient_blob IS NOT NULL
+          AND NOT u.legal_hold
+          AND `+effectiveDays+` > 0
+          AND m.timestamp < $1 - make_interval(days => `+effectiveDays+`)
+        RETURNING m.sender_id, m.recipient_id
+        `, now, defaultDays)
+	if err != nil {
+		return res, fmt.Errorf("database error (recipient copies): %w", err)
+	}
+
+	cmdTag, err := tx.Exec(ctx,
+		"DELETE FROM messages WHERE sender_blob IS NULL AND recipient_blob IS NULL")
+	if err != nil {
+		return res, fmt.Errorf("database error (rows): %w", err)
+	}
+	res.Rows = cmdTag.RowsAffected()
+
+	if err := recountConversationStats(ctx, tx, touched); err != nil {
+		return res, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return res, fmt.Errorf("database error: %w", err)
+	}
+	return res, nil
+}
+
+// pruneCopies runs one copy-pruning UPDATE, which must return the sender and
+// recipient of each row it changed, and records those conversations in
+// touched. It returns the number of rows changed.
+func pruneCopies(ctx context.Context, tx pgx.Tx, touched map[conversationPair]struct{}, update string, args ...interface{}) (int64, error) {
+	rows, err := tx.Query(ctx,
+		`
+        WITH pruned AS (`+update+`)
+        -- Sealed-sender messages (no sender) have no conversation counters
+        -- and are grouped under NULLs
+        SELECT
+            CASE WHEN sender_id IS NOT NULL THEN LEAST(sender_id, recipient_id) END,
+            CASE WHEN sender_id IS NOT NULL THEN GREATEST(sender_id, recipient_id) END,
+            COUNT(*)
+        FROM pruned
+        GROUP BY 1, 2
+        `, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var total int64
+	for rows.Next() {
+		var low, high *int
+		var n int64
+		if err := rows.Scan(&low, &high, &n); err != nil {
+			return 0, err
+		}
+		if low != nil && high != nil {
+			touched[conversationPair{low: *low, high: *high}] = struct{}{}
+		}
+		total += n
+	}
+	return total, rows.Err()
+}
+
+// EffectiveRetentionDays resolves a user's preference against the server default.
+func EffectiveRetentionDays(settings UserSettings, defaultDays int) int {
+	if settings.RetentionDays != nil {
+		return *settings.RetentionDays
+	}
+	return defaultDays
+}
@@ -0,0 +1,117 @@
+// src/store/retention_test.go
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cryptachat-server/testutil"
+)
+
+// copiesLeft reports which copies of a message are still stored, and
+// whether its row is.
+func copiesLeft(t *testing.T, s *PostgresStore, messageID int) (sender, recipient, row bool) {
+	t.Helper()
+	err := s.db.QueryRow(context.Background(),
+		"SELECT sender_blob IS NOT NULL, recipient_blob IS NOT NULL FROM messages WHERE id = $1", messageID,
+	).Scan(&sender, &recipient)
+	if err != nil {
+		return false, false, false
+	}
+	return sender, recipient, true
+}
+
+// TestPruneExpiredMessagesPerSide sends messages between users with
+// different retention preferences and moves the clock past each of them.
+// Each preference removes only its owner's copy, a row goes once both
+// copies have, and a user on legal hold keeps their copies whatever the
+// other side prefers.
+func TestPruneExpiredMessagesPerSide(t *testing.T) {
+	s := newTestStore(t)
+	clk := testutil.NewFakeClock(time.Now().UTC().Truncate(time.Second))
+	s.SetClock(clk)
+	ctx := context.Background()
+	const serverDefault = 30
+
+	alice := mustRegister(t, s, "alice")
+	bob := mustRegister(t, s, "bob")
+	carol := mustRegister(t, s, "carol")
+	dave := mustRegister(t, s, "dave")
+	week, forever := 7, 0
+	for id, days := range map[int]*int{alice: &week, bob: nil, carol: &forever, dave: &week} {
+		if err := s.SetRetentionDays(ctx, id, days); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetLegalHold(ctx, "dave", true); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(from int, to string) int {
+		t.Helper()
+		id, _, err := s.SendMessage(ctx, from, to, "sender copy", "recipient copy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	// Nobody fetches these; undelivered messages are pruned like any other
+	toBob := send(alice, "bob")
+	toCarol := send(alice, "carol")
+	fromDave := send(dave, "alice")
+	toDave := send(bob, "dave")
+
+	check := func(when string, id int, sender, recipient, row bool) {
+		t.Helper()
+		gotSender, gotRecipient, gotRow := copiesLeft(t, s, id)
+		if gotSender != sender || gotRecipient != recipient || gotRow != row {
+			t.Errorf("%s, message %d: sender copy %v, recipient copy %v, row %v; want %v, %v, %v",
+				when, id, gotSender, gotRecipient, gotRow, sender, recipient, row)
+		}
+	}
+	prune := func(want PruneResult) {
+		t.Helper()
+		res, err := s.PruneExpiredMessages(ctx, serverDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != want {
+			t.Errorf("pruned %+v, want %+v", res, want)
+		}
+	}
+
+	// Copies go once they are older than the preference, not at it
+	clk.Advance(7 * 24 * time.Hour)
+	prune(PruneResult{})
+
+	// A week: alice's copies go, including the one dave sent her; dave's
+	// own copy is held
+	clk.Advance(time.Second)
+	prune(PruneResult{SenderCopies: 2, RecipientCopies: 1})
+	check("after a week", toBob, false, true, true)
+	check("after a week", toCarol, false, true, true)
+	check("after a week", fromDave, true, false, true)
+	check("after a week", toDave, true, true, true)
+
+	// The server default: bob's copies go, and with them the first row
+	clk.Advance((serverDefault - 7) * 24 * time.Hour)
+	prune(PruneResult{SenderCopies: 1, RecipientCopies: 1, Rows: 1})
+	check("after the default", toBob, false, false, false)
+	check("after the default", toDave, false, true, true)
+
+	// Much later, carol's and dave's copies are still there
+	clk.Advance(365 * 24 * time.Hour)
+	prune(PruneResult{})
+	check("a year on", toCarol, false, true, true)
+	check("a year on", fromDave, true, false, true)
+	check("a year on", toDave, false, true, true)
+
+	// Lifting the hold lets dave's preference apply
+	if err := s.SetLegalHold(ctx, "dave", false); err != nil {
+		t.Fatal(err)
+	}
+	prune(PruneResult{SenderCopies: 1, RecipientCopies: 1, Rows: 2})
+	check("after the hold", fromDave, false, false, false)
+	check("after the hold", toDave, false, false, false)
+}
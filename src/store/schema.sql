@@ -31,7 +31,223 @@ CREATE TABLE IF NOT EXISTS messages (
     sender_blob TEXT NOT NULL,
     recipient_blob TEXT NOT NULL,
     -- Use TIMESTAMPTZ for timezone-aware timestamps
-    timestamp TIMESTAMPTZ NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC'),
+    timestamp TIMESTAMPTZ NOT NULL DEFAULT NOW(),
     FOREIGN KEY (sender_id) REFERENCES users (id) ON DELETE CASCADE,
     FOREIGN KEY (recipient_id) REFERENCES users (id) ON DELETE CASCADE
-);
\ No newline at end of file
+);
+-- Transactional outbox for side effects of writes (e.g. WebSocket pushes).
+-- Rows are inserted in the same transaction as the write they describe and
+-- processed at-least-once by the dispatcher.
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    event_type TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    processed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS outbox_unprocessed_idx ON outbox (id) WHERE processed_at IS NULL;
+
+-- Per-side deletion: each participant's copy of a message can be removed
+-- independently. The row itself goes once both copies are gone.
+ALTER TABLE messages ALTER COLUMN sender_blob DROP NOT NULL;
+ALTER TABLE messages ALTER COLUMN recipient_blob DROP NOT NULL;
+
+-- Admin flag that exempts a user's data from pruning
+ALTER TABLE users ADD COLUMN IF NOT EXISTS legal_hold BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Per-user preferences
+CREATE TABLE IF NOT EXISTS user_settings (
+    user_id INTEGER PRIMARY KEY,
+    retention_days INTEGER CHECK (retention_days >= 0), -- NULL = server default, 0 = forever
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Inbound ceiling: at most this many messages to the user per hour from
+-- everyone together. NULL = unlimited
+ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS inbound_messages_per_hour INTEGER
+    CHECK (inbound_messages_per_hour > 0);
+-- Whether push payloads may carry the unread and pending request counts
+ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS push_badge_counts BOOLEAN NOT NULL DEFAULT TRUE;
+-- messages_recipient_timestamp_idx, for counting a user's recent inbound
+-- messages against the ceiling, is built concurrently by migration 0024
+
+-- Security-relevant events per user (e.g. backup access)
+CREATE TABLE IF NOT EXISTS audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER,
+    event_type TEXT NOT NULL,
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_user_idx ON audit_events (user_id, created_at);
+
+-- Client-encrypted key backups; the server only ever sees ciphertext
+CREATE TABLE IF NOT EXISTS key_backups (
+    user_id INTEGER NOT NULL,
+    version INTEGER NOT NULL,
+    blob TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, version),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Account creation time (existing rows get the time of this migration)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+-- Chat request lifecycle and spam filtering
+ALTER TABLE chat_requests ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+ALTER TABLE chat_requests ADD COLUMN IF NOT EXISTS declined_at TIMESTAMPTZ;
+ALTER TABLE chat_requests ADD COLUMN IF NOT EXISTS filtered BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE chat_requests ADD COLUMN IF NOT EXISTS filter_reason TEXT;
+
+-- Usernames are unique case-insensitively. Creation fails if existing rows
+-- already collide; rename one of each pair before upgrading.
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_canonical_idx ON users (lower(username));
+
+-- Per-message delivery outcomes for admin tracing. No foreign key: entries
+-- outlive pruned messages and are deleted by age instead.
+CREATE TABLE IF NOT EXISTS message_delivery_log (
+    id BIGSERIAL PRIMARY KEY,
+    message_id INTEGER NOT NULL,
+    user_id INTEGER,
+    stage TEXT NOT NULL,
+    outcome TEXT NOT NULL,
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS message_delivery_log_message_idx ON message_delivery_log (message_id, id);
+CREATE INDEX IF NOT EXISTS message_delivery_log_created_idx ON message_delivery_log (created_at);
+
+-- Timezone audit. The old messages.timestamp default produced a zone-less
+-- value that was reinterpreted in the session zone; NOW() is already absolute.
+ALTER TABLE messages ALTER COLUMN timestamp SET DEFAULT NOW();
+
+-- Any timestamp column created without a zone is converted, treating its
+-- stored values as UTC. A no-op once everything is timestamptz.
+DO $$
+DECLARE
+    col RECORD;
+BEGIN
+    FOR col IN
+        SELECT table_name, column_name
+        FROM information_schema.columns
+        WHERE table_schema = current_schema()
+          AND data_type = 'timestamp without time zone'
+    LOOP
+        EXECUTE format(
+            'ALTER TABLE %I ALTER COLUMN %I TYPE TIMESTAMPTZ USING %I AT TIME ZONE ''UTC''',
+            col.table_name, col.column_name, col.column_name);
+    END LOOP;
+END
+$$;
+
+-- Set when the recipient's client confirms it has the message
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS delivered_at TIMESTAMPTZ;
+
+-- One-time prekeys; each is handed out at most once in a prekey bundle
+CREATE TABLE IF NOT EXISTS one_time_prekeys (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    key_id INTEGER NOT NULL,
+    public_key TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, key_id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS one_time_prekeys_user_idx ON one_time_prekeys (user_id, id);
+
+-- Cache invalidations per user, served by /sync and pushed over the WebSocket
+CREATE TABLE IF NOT EXISTS cache_invalidations (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    scope TEXT NOT NULL,
+    subject TEXT,
+    created_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS cache_invalidations_user_idx ON cache_invalidations (user_id, id);
+
+-- Admin users, and a single-row guard so the first admin is only ever
+-- bootstrapped once, even with several replicas starting together
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS admin_bootstrap (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    user_id INTEGER,
+    created_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE SET NULL
+);
+
+-- One chat_requests row per pair of users. Legacy pairs with rows in both
+-- directions keep the most advanced one (accepted, then pending, then
+-- anything else; oldest on ties) before the pair index is created.
+WITH ranked AS (
+    SELECT id, ROW_NUMBER() OVER (
+        PARTITION BY LEAST(requester_id, requested_id), GREATEST(requester_id, requested_id)
+        ORDER BY CASE status WHEN 'accepted' THEN 0 WHEN 'pending' THEN 1 ELSE 2 END, id
+    ) AS rn
+    FROM chat_requests
+)
+DELETE FROM chat_requests WHERE id IN (SELECT id FROM ranked WHERE rn > 1);
+
+CREATE UNIQUE INDEX IF NOT EXISTS chat_requests_pair_idx
+    ON chat_requests (LEAST(requester_id, requested_id), GREATEST(requester_id, requested_id));
+
+-- Append-only public key transparency log. Each entry is chained to the
+-- previous one by hash (see keylog/keylog.go). Rows outlive their user so
+-- the chain stays verifiable.
+CREATE TABLE IF NOT EXISTS key_log (
+    seq BIGINT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    username TEXT NOT NULL,
+    version INTEGER NOT NULL,
+    key_hash TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    prev_hash TEXT NOT NULL,
+    entry_hash TEXT NOT NULL,
+    UNIQUE (user_id, version)
+);
+
+CREATE INDEX IF NOT EXISTS key_log_username_idx ON key_log (username, seq);
+
+-- How the recipient's client says it received each message (see Transport*)
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS delivered_via TEXT;
+
+-- Contact imports from another instance's signed export (see contactdoc).
+-- Each item becomes an ordinary chat request once its not_before passes;
+-- items are spaced out so a large import stays within request limits.
+CREATE TABLE IF NOT EXISTS contact_imports (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    source_issuer TEXT NOT NULL,
+    source_username TEXT NOT NULL,
+    signer_key TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS contact_imports_user_idx ON contact_imports (user_id, id);
+
+CREATE TABLE IF NOT EXISTS contact_import_items (
+    id SERIAL PRIMARY KEY,
+    import_id INTEGER NOT NULL,
+    username TEXT NOT NULL,
+    key_fingerprint TEXT NOT NULL,
+    not_before TIMESTAMPTZ NOT NULL,
+    status TEXT NOT NULL DEFAULT 'queued', -- 'queued', 'processing', 'requested', 'accepted', 'skipped', 'failed'
+    detail TEXT,
+    key_matches BOOLEAN, -- NULL if either side had no key
+    claimed_at TIMESTAMPTZ,
+    processed_at TIMESTAMPTZ,
+    FOREIGN KEY (import_id) REFERENCES contact_imports (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS contact_import_items_due_idx ON contact_import_items (status, not_before);
+CREATE INDEX IF NOT EXISTS contact_import_items_import_idx ON contact_import_items (import_id, id);
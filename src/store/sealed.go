@@ -0,0 +1,180 @@
+// src/store/sealed.go
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Sealed-sender messages are stored with sender_id and sender_blob NULL, so
+// the database doesn't record who sent them. The sender is only known while
+// the send request is being authorized. Contacts opt in per side on their
+// chat_requests row (see migrations/0003).
+
+// SetSealedSender records whether userID accepts sealed-sender messages
+// with partnerUsername. It returns whether both sides have now opted in.
+func (s *PostgresStore) SetSealedSender(ctx context.Context, userID int, partnerUsername string, enabled bool) (bool, error) {
+	partnerID, err := s.GetUserIDByUsername(ctx, partnerUsername)
+	if err != nil {
+		return false, fmt.Errorf("partner user not found")
+	}
+
+	var mutual bool
+	err = s.db.QueryRow(ctx,
+		`
+        UPDATE chat_requests SET
+            requester_sealed_sender = CASE WHEN requester_id = $1 THEN $3 ELSE requester_sealed_sender END,
+            requested_sealed_sender = CASE WHEN requested_id = $1 THEN $3 ELSE requested_sealed_sender END
+        WHERE status = 'accepted'
+          AND ((requester_id = $1 AND requested_id = $2) OR (requester_id = $2 AND requested_id = $1))
+        RETURNING requester_sealed_sender AND requested_sealed_sender
+        `, userID, partnerID, enabled,
+	).Scan(&mutual)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, fmt.Errorf("not a contact")
+		}
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return mutual, nil
+}
+
+// sealedInboxLockBase plus a recipient's ID is the advisory lock held while
+// a sealed message to them is stored. It is above the 32-bit range hashtext
+// locks and the other lock IDs use.
+const sealedInboxLockBase int64 = 7260001 << 32
+
+// SendSealedMessage stores a message from senderID without recording the
+// sender. The two must be contacts who have both opted in to sealed sender.
+// Only the recipient's copy is kept. It returns the message and recipient IDs.
+func (s *PostgresStore) SendSealedMessage(ctx context.Context, senderID int, recipientUsername, recipientBlob string) (int, int, error) {
+	recipientID, err := s.GetUserIDByUsername(ctx, recipientUsername)
+	if err != nil {
+		return 0, 0, fmt.Errorf("recipient user not found")
+	}
+	if recipientID == senderID {
+		return 0, 0, fmt.Errorf("cannot send message to yourself")
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the contact row so an opt-out can't race the insert
+	var mutual bool
+	err = tx.QueryRow(ctx,
+		`
+        SELECT requester_sealed_sender AND requested_sealed_sender
+        FROM chat_requests
+        WHERE status = 'accepted'
+          AND ((requester_id = $1 AND requested_id = $2) OR (requester_id = $2 AND requested_id = $1))
+        FOR SHARE
+        `, senderID, recipientID,
+	).Scan(&mutual)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return 0, 0, fmt.Errorf("not a contact")
+		}
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	if !mutual {
+		return 0, 0, fmt.Errorf("sealed sender not enabled for this conversation")
+	}
+
+	// Sealed messages have no conversation row to lock, so the recipient's
+	// are serialised here instead, keeping their IDs in commit order (see
+	// Message)
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", sealedInboxLockBase+int64(recipientID)); err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+
+	now := s.clock.Now().UTC()
+	if err := checkInboundLimit(ctx, tx, recipientID, now); err != nil {
+		return 0, 0, err
+	}
+
+	var newID int
+	err = tx.QueryRow(ctx,
+		"INSERT INTO messages (recipient_id, recipient_blob, blob_key_id, timestamp) VALUES ($1, $2, $3, $4) RETURNING id",
+		recipientID, s.blobs.seal(recipientBlob, blobAADMessages), s.blobs.keyID(), now,
+	).Scan(&newID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+
+	err = s.insertOutboxEvent(ctx, tx, EventMessageCreated, MessageCreatedPayload{
+		MessageID:   newID,
+		RecipientID: recipientID,
+		Sealed:      true,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	return newID, recipientID, nil
+}
+
+// GetSealedMessages fetches sealed-sender messages received by recipientID
+// with an ID greater than sinceID, ordered by ID. They have no SenderID or
+// SenderUsername; the sender is identified only inside the encrypted blob.
+// Pruned ones are returned as Deleted stubs, as in GetMessages.
+func (s *PostgresStore) GetSealedMessages(ctx context.Context, recipientID, sinceID int) ([]Message, MessageSnapshot, error) {
+	page, err := retryRead(ctx, func() (messagePage, error) { return s.getSealedMessages(ctx, recipientID, sinceID) })
+	return page.messages, page.snapshot, err
+}
+
+func (s *PostgresStore) getSealedMessages(ctx context.Context, recipientID, sinceID int) (messagePage, error) {
+	tx, err := s.beginSnapshot(ctx)
+	if err != nil {
+		return messagePage{}, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var page messagePage
+	err = tx.QueryRow(ctx,
+		"SELECT COALESCE(MAX(id), 0) FROM messages WHERE recipient_id = $1 AND sender_id IS NULL",
+		recipientID,
+	).Scan(&page.snapshot.MaxID)
+	if err != nil {
+		return messagePage{}, fmt.Errorf("database error: %w", err)
+	}
+
+	rows, err := tx.Query(ctx,
+		`
+        SELECT id, recipient_id, timestamp, recipient_blob, blob_key_id
+        FROM messages
+        WHERE recipient_id = $1 AND sender_id IS NULL AND id > $2
+        ORDER BY id
+        `, recipientID, sinceID)
+	if err != nil {
+		return messagePage{}, fmt.Errorf("database error: %w", err)
+	}
+	messages, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Message, error) {
+		msg := Message{Sealed: true}
+		var blob, keyID *string
+		if err := row.Scan(&msg.ID, &msg.RecipientID, &msg.Timestamp, &blob, &keyID); err != nil {
+			return msg, fmt.Errorf("database scan error: %w", err)
+		}
+		if blob == nil {
+			msg.Deleted = true
+			return msg, nil
+		}
+		var err error
+		if msg.EncryptedBlob, err = s.blobs.open(*blob, keyID, blobAADMessages); err != nil {
+			return msg, fmt.Errorf("blob decryption error: %v", err)
+		}
+		return msg, nil
+	})
+	if err != nil {
+		return messagePage{}, err
+	}
+	page.messages = messages
+	return page, nil
+}
@@ -0,0 +1,114 @@
+// src/store/seed.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ---- Seeding Helpers ----
+// These bypass the HTTP layer to set up fixtures for tests and tooling.
+// They go through the regular store methods where invariants matter and
+// use direct SQL where speed matters.
+
+// SeedUser registers a user with the given password and returns its ID.
+// It hashes with bcrypt.MinCost so fixtures stay fast.
+func (s *PostgresStore) SeedUser(ctx context.Context, username, password string) (int, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		return 0, fmt.Errorf("seed: could not hash password: %v", err)
+	}
+	if err := s.RegisterUser(ctx, username, string(hash), nil); err != nil {
+		return 0, fmt.Errorf("seed: %v", err)
+	}
+	return s.GetUserIDByUsername(ctx, username)
+}
+
+// SeedContactPair registers two users (password "password") and makes them
+// accepted contacts, with a as the requester. It returns both user IDs.
+func (s *PostgresStore) SeedContactPair(ctx context.Context, a, b string) (int, int, error) {
+	aID, err := s.SeedUser(ctx, a, "password")
+	if err != nil {
+		return 0, 0, err
+	}
+	bID, err := s.SeedUser(ctx, b, "password")
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := s.RequestChat(ctx, aID, b, ""); err != nil {
+		return 0, 0, fmt.Errorf("seed: %v", err)
+	}
+	if _, err := s.AcceptChat(ctx, bID, a); err != nil {
+		return 0, 0, fmt.Errorf("seed: %v", err)
+	}
+	return aID, bID, nil
+}
+
+// SeedConversation bulk-inserts n messages between aID and bID, alternating
+// direction (a sends first). The first message is timestamped with the
+// store's clock and each following one is spacing later. Blobs are
+// "seed-<i>:sender" and "seed-<i>:recipient". It returns the new message IDs in order.
+func (s *PostgresStore) SeedConversation(ctx context.Context, aID, bID int, n int, spacing time.Duration) ([]int, error) {
+	start := s.clock.Now().UTC()
+
+	rows := make([][]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		sender, recipient := aID, bID
+		if i%2 == 1 {
+			sender, recipient = bID, aID
+		}
+		rows = append(rows, []interface{}{
+			sender,
+			recipient,
+			conversationID(sender, recipient),
+			s.blobs.seal(fmt.Sprintf("seed-%d:sender", i), blobAADMessages),
+			s.blobs.seal(fmt.Sprintf("seed-%d:recipient", i), blobAADMessages),
+			s.blobs.keyID(),
+			start.Add(time.Duration(i) * spacing),
+		})
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.CopyFrom(ctx,
+		pgx.Identifier{"messages"},
+		[]string{"sender_id", "recipient_id", "conversation_id", "sender_blob", "recipient_blob", "blob_key_id", "timestamp"},
+		pgx.CopyFromRows(rows),
+	); err != nil {
+		return nil, fmt.Errorf("seed: copy failed: %v", err)
+	}
+	pair := conversationPair{low: min(aID, bID), high: max(aID, bID)}
+	if err := recountConversationStats(ctx, tx, map[conversationPair]struct{}{pair: {}}); err != nil {
+		return nil, err
+	}
+
+	idRows, err := tx.Query(ctx,
+		`
+        SELECT id FROM messages
+        WHERE (sender_id = $1 AND recipient_id = $2) OR (sender_id = $2 AND recipient_id = $1)
+        ORDER BY id DESC
+        LIMIT $3
+        `, aID, bID, n)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	ids, err := pgx.CollectRows(idRows, pgx.RowTo[int])
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	slices.Reverse(ids)
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return ids, nil
+}
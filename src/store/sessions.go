@@ -0,0 +1,159 @@
+// src/store/sessions.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// A session is a login that issued a refresh token: the device it came
+// from and when it was last used. Access tokens carry their session's ID,
+// and are refused once its row is gone. Revoking a session deletes the row
+// and revokes its refresh token family; so does everything that revokes a
+// whole family, such as a reused refresh token or /logout.
+
+// MaxSessionsPerUser is how many sessions a user keeps. A login beyond it
+// evicts the oldest.
+const MaxSessionsPerUser = 20
+
+// sessionSeenGranularity is how stale last_seen_at may get before a request
+// updates it, so busy clients don't write on every request.
+const sessionSeenGranularity = time.Minute
+
+// Session is what a user sees of one of their sessions.
+type Session struct {
+	ID          int64     `json:"id"`
+	DeviceLabel string    `json:"device_label"`
+	IP          string    `json:"ip"`
+	CreatedAt   Timestamp `json:"created_at"`
+	LastSeenAt  Timestamp `json:"last_seen_at"`
+	ExpiresAt   Timestamp `json:"expires_at"`
+}
+
+// CreateSession starts a session for userID's login with refresh token
+// family, expiring with its first token at expiresAt, and evicts the
+// user's oldest sessions beyond MaxSessionsPerUser.
+func (s *PostgresStore) CreateSession(ctx context.Context, userID int, family, deviceLabel, ip string, expiresAt time.Time) (int64, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := s.clock.Now().UTC()
+	var id int64
+	err = tx.QueryRow(ctx,
+		`
+        INSERT INTO sessions (user_id, family_id, device_label, ip, created_at, last_seen_at, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $5, $6)
+        RETURNING id
+        `, userID, family, deviceLabel, ip, now, expiresAt).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		`
+        WITH evicted AS (
+            DELETE FROM sessions WHERE id IN (
+                SELECT id FROM sessions WHERE user_id = $1
+                ORDER BY created_at DESC, id DESC
+                OFFSET $2
+            )
+            RETURNING family_id
+        )
+        UPDATE refresh_tokens SET revoked_at = $3
+        WHERE family_id IN (SELECT family_id FROM evicted) AND revoked_at IS NULL
+        `, userID, MaxSessionsPerUser, now)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return id, nil
+}
+
+// CheckSession reports whether userID's session sessionID still exists.
+// With touch, it also moves the session's last_seen_at to now, at most
+// once per sessionSeenGranularity.
+func (s *PostgresStore) CheckSession(ctx context.Context, userID int, sessionID int64, now time.Time, touch bool) (bool, error) {
+	var n int
+	err := s.db.QueryRow(ctx,
+		`
+        WITH found AS (
+            SELECT id FROM sessions WHERE id = $1 AND user_id = $2
+        ), touched AS (
+            UPDATE sessions SET last_seen_at = $3
+            WHERE $5 AND id IN (SELECT id FROM found) AND last_seen_at < $4
+        )
+        SELECT count(*) FROM found
+        `, sessionID, userID, now.UTC(), now.Add(-sessionSeenGranularity).UTC(), touch).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return n > 0, nil
+}
+
+// ListSessions returns userID's unexpired sessions, most recently used
+// first.
+func (s *PostgresStore) ListSessions(ctx context.Context, userID int) ([]Session, error) {
+	rows, err := s.db.Query(ctx,
+		`
+        SELECT id, device_label, ip, created_at, last_seen_at, expires_at
+        FROM sessions WHERE user_id = $1 AND expires_at > $2
+        ORDER BY last_seen_at DESC, id DESC
+        `, userID, s.clock.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	sessions, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Session, error) {
+		var ss Session
+		err := row.Scan(&ss.ID, &ss.DeviceLabel, &ss.IP, &ss.CreatedAt, &ss.LastSeenAt, &ss.ExpiresAt)
+		return ss, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return sessions, nil
+}
+
+// DeleteSession revokes userID's session sessionID and its refresh token
+// family. Fails with "session not found" if the user has no such session.
+func (s *PostgresStore) DeleteSession(ctx context.Context, userID int, sessionID int64) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var family string
+	err = tx.QueryRow(ctx,
+		"DELETE FROM sessions WHERE id = $1 AND user_id = $2 RETURNING family_id",
+		sessionID, userID).Scan(&family)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("session not found")
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if err := revokeFamily(ctx, tx, family, s.clock.Now().UTC()); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// PruneSessions deletes sessions whose refresh tokens expired before
+// olderThan.
+func (s *PostgresStore) PruneSessions(ctx context.Context, olderThan time.Time) (int64, error) {
+	tag, err := s.db.Exec(ctx, "DELETE FROM sessions WHERE expires_at < $1", olderThan)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
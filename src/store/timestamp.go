@@ -0,0 +1,60 @@
+// src/store/timestamp.go
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// TimestampFormat is how every timestamp in an API response or WebSocket
+// frame is written: RFC3339 in UTC with millisecond precision.
+const TimestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Timestamp is a time.Time that always serialises as TimestampFormat,
+// whatever zone it was read or computed in. It scans from and writes to
+// timestamptz columns like a plain time.Time.
+type Timestamp struct {
+	time.Time
+}
+
+// NewTimestamp wraps t.
+func NewTimestamp(t time.Time) Timestamp {
+	return Timestamp{Time: t}
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.UTC().Format(TimestampFormat))
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed.UTC()
+	return nil
+}
+
+// ScanTimestamptz implements pgtype.TimestamptzScanner.
+func (t *Timestamp) ScanTimestamptz(v pgtype.Timestamptz) error {
+	if !v.Valid {
+		return fmt.Errorf("cannot scan NULL into Timestamp")
+	}
+	if v.InfinityModifier != pgtype.Finite {
+		return fmt.Errorf("cannot scan infinite timestamp into Timestamp")
+	}
+	t.Time = v.Time.UTC()
+	return nil
+}
+
+// TimestamptzValue implements pgtype.TimestamptzValuer.
+func (t Timestamp) TimestamptzValue() (pgtype.Timestamptz, error) {
+	return pgtype.Timestamptz{Time: t.UTC(), Valid: true}, nil
+}
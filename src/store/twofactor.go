@@ -0,0 +1,230 @@
+// src/store/twofactor.go
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// blobAADTOTP is the associated data for sealed TOTP secrets.
+const blobAADTOTP = "user_totp"
+
+// TOTP is a user's two-factor setup.
+type TOTP struct {
+	Secret   string // Base32, as given to the authenticator app
+	Enabled  bool   // Setup was confirmed with a code
+	LastStep int64  // Time step of the last code accepted
+}
+
+// StartTOTP stores a new, not yet enabled secret for userID along with the
+// hashes of their recovery codes, replacing any earlier unconfirmed setup.
+// Fails with "two-factor already enabled" if it is on.
+func (s *PostgresStore) StartTOTP(ctx context.Context, userID int, secret string, recoveryHashes [][]byte) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`
+        INSERT INTO user_totp (user_id, secret, blob_key_id, created_at) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (user_id) DO UPDATE
+            SET secret = EXCLUDED.secret, blob_key_id = EXCLUDED.blob_key_id,
+                created_at = EXCLUDED.created_at, last_step = 0
+            WHERE user_totp.enabled_at IS NULL
+        `, userID, s.blobs.seal(secret, blobAADTOTP), s.blobs.keyID(), s.clock.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("two-factor already enabled")
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM totp_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		"INSERT INTO totp_recovery_codes (user_id, code_hash) SELECT $1, unnest($2::bytea[])",
+		userID, recoveryHashes)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// GetTOTP returns userID's two-factor setup. Fails with "two-factor not set
+// up" if there is none.
+func (s *PostgresStore) GetTOTP(ctx context.Context, userID int) (*TOTP, error) {
+	var (
+		t      TOTP
+		sealed string
+		keyID  *string
+	)
+	err := s.db.QueryRow(ctx,
+		"SELECT secret, blob_key_id, enabled_at IS NOT NULL, last_step FROM user_totp WHERE user_id = $1", userID,
+	).Scan(&sealed, &keyID, &t.Enabled, &t.LastStep)
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("two-factor not set up")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if t.Secret, err = s.blobs.open(sealed, keyID, blobAADTOTP); err != nil {
+		return nil, fmt.Errorf("blob decryption error: %v", err)
+	}
+	return &t, nil
+}
+
+// TOTPEnabled reports whether userID has two-factor authentication on.
+func (s *PostgresStore) TOTPEnabled(ctx context.Context, userID int) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)", userID,
+	).Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return enabled, nil
+}
+
+// UseTOTPStep records that a code for step was accepted, enabling
+// two-factor authentication if setup wasn't confirmed yet. Fails with
+// "totp code already used" if a code for this step or a later one was
+// accepted before, so a code can't be replayed.
+func (s *PostgresStore) UseTOTPStep(ctx context.Context, userID int, step int64) error {
+	tag, err := s.db.Exec(ctx,
+		`
+        UPDATE user_totp SET last_step = $2, enabled_at = COALESCE(enabled_at, $3)
+        WHERE user_id = $1 AND last_step < $2
+        `, userID, step, s.clock.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("totp code already used")
+	}
+	return nil
+}
+
+// UseRecoveryCode marks userID's unused recovery code with codeHash used
+// and returns how many they have left. Fails with "recovery code not found"
+// if there is no such unused code.
+func (s *PostgresStore) UseRecoveryCode(ctx context.Context, userID int, codeHash []byte) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`
+        UPDATE totp_recovery_codes SET used_at = $3
+        WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+        `, userID, codeHash, s.clock.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return 0, fmt.Errorf("recovery code not found")
+	}
+
+	var remaining int
+	err = tx.QueryRow(ctx,
+		"SELECT COUNT(*) FROM totp_recovery_codes WHERE user_id = $1 AND used_at IS NULL", userID,
+	).Scan(&remaining)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return remaining, nil
+}
+
+// DeleteTOTP turns two-factor authentication off for userID and deletes
+// their recovery codes.
+func (s *PostgresStore) DeleteTOTP(ctx context.Context, userID int) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	for _, q := range []string{
+		"DELETE FROM totp_recovery_codes WHERE user_id = $1",
+		"DELETE FROM user_totp WHERE user_id = $1",
+	} {
+		if _, err := tx.Exec(ctx, q, userID); err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// RekeyTOTPSecrets re-seals up to limit TOTP secrets that aren't under the
+// current data key (or, with toPlaintext, aren't in plaintext). It returns
+// how many it re-sealed.
+func (s *PostgresStore) RekeyTOTPSecrets(ctx context.Context, limit int, toPlaintext bool) (int, error) {
+	target, ring := s.rekeyTarget(toPlaintext)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`
+        SELECT user_id, secret, blob_key_id
+        FROM user_totp
+        WHERE blob_key_id IS DISTINCT FROM $1
+        LIMIT $2
+        FOR UPDATE SKIP LOCKED
+        `, target, limit)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	type stored struct {
+		userID int
+		secret string
+		keyID  *string
+	}
+	found, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (stored, error) {
+		var t stored
+		err := row.Scan(&t.userID, &t.secret, &t.keyID)
+		return t, err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("database scan error: %w", err)
+	}
+
+	for _, t := range found {
+		secret, err := s.blobs.open(t.secret, t.keyID, blobAADTOTP)
+		if err != nil {
+			return 0, fmt.Errorf("totp secret of user %d: %v", t.userID, err)
+		}
+		_, err = tx.Exec(ctx,
+			"UPDATE user_totp SET secret = $2, blob_key_id = $3 WHERE user_id = $1",
+			t.userID, ring.seal(secret, blobAADTOTP), target)
+		if err != nil {
+			return 0, fmt.Errorf("database error: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return len(found), nil
+}
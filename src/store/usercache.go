@@ -0,0 +1,182 @@
+// src/store/usercache.go
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The user cache serves GetAuthUser, the lookup behind every authenticated
+// request, from memory for a short TTL. Every store method that changes a
+// field of User (password, token version, last login, public key) or
+// deletes the user forgets that user once its write has committed, so this
+// process never serves a stale row after its own writes. Writes made by
+// other replicas show up once the entry expires.
+//
+// Concurrent misses for one user share a single query. A load that was
+// running when the user was forgotten is not cached, and later requests
+// don't wait on it, so a forget can't be undone by a read that started
+// before the write committed.
+//
+// Beyond max entries, expired ones are swept and then arbitrary ones
+// evicted, so memory stays bounded however many users are active.
+
+// UserCacheStats describes the user cache for /admin/runtime.
+type UserCacheStats struct {
+	Enabled     bool  `json:"enabled"`
+	TTLSeconds  int64 `json:"ttl_seconds"`
+	Size        int   `json:"size"`
+	Max         int   `json:"max"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"` // Each miss is one query
+	Shared      int64 `json:"shared"` // Misses that waited on another request's query
+	Evictions   int64 `json:"evictions"`
+	Invalidated int64 `json:"invalidated"`
+}
+
+type cachedUser struct {
+	user      User
+	expiresAt time.Time
+}
+
+// userLoad is a query in flight, shared by the requests that missed while
+// it ran.
+type userLoad struct {
+	done chan struct{}
+	user *User
+	err  error
+}
+
+type userCache struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[int]cachedUser
+	loading map[int]*userLoad
+	stats   UserCacheStats
+}
+
+// EnableUserCache turns on the user cache behind GetAuthUser, keeping up to
+// max users for ttl. Call it before serving requests.
+func (s *PostgresStore) EnableUserCache(ttl time.Duration, max int) {
+	s.users = &userCache{
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[int]cachedUser),
+		loading: make(map[int]*userLoad),
+	}
+}
+
+// GetAuthUser is GetUserByID for the auth middleware, served from the user
+// cache when it is enabled. Callers get their own copy. Anything that
+// decides on a password or token version outside request authentication
+// should use GetUserByID.
+func (s *PostgresStore) GetAuthUser(ctx context.Context, id int) (*User, error) {
+	if s.users == nil {
+		return s.GetUserByID(ctx, id)
+	}
+	return s.users.get(ctx, id, s.clock.Now(), s.GetUserByID)
+}
+
+// get returns id's user, from the cache or else from load.
+func (c *userCache) get(ctx context.Context, id int, now time.Time, load func(context.Context, int) (*User, error)) (*User, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[id]; ok && now.Before(e.expiresAt) {
+		c.stats.Hits++
+		c.mu.Unlock()
+		u := e.user
+		return &u, nil
+	}
+	if l, ok := c.loading[id]; ok {
+		c.stats.Shared++
+		c.mu.Unlock()
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if l.err != nil {
+			// The leader's failure may be its own context; try once more
+			return load(ctx, id)
+		}
+		u := *l.user
+		return &u, nil
+	}
+	l := &userLoad{done: make(chan struct{})}
+	c.loading[id] = l
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	l.user, l.err = load(ctx, id)
+
+	c.mu.Lock()
+	// Only still ours if the user wasn't forgotten meanwhile
+	if c.loading[id] == l {
+		delete(c.loading, id)
+		if l.err == nil {
+			c.store(id, *l.user, now)
+		}
+	}
+	c.mu.Unlock()
+	close(l.done)
+
+	if l.err != nil {
+		return nil, l.err
+	}
+	u := *l.user
+	return &u, nil
+}
+
+// store caches u. c.mu must be held.
+func (c *userCache) store(id int, u User, now time.Time) {
+	if _, ok := c.entries[id]; !ok && len(c.entries) >= c.max {
+		for k, e := range c.entries {
+			if !now.Before(e.expiresAt) {
+				delete(c.entries, k)
+				c.stats.Evictions++
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.max {
+				break
+			}
+			delete(c.entries, k)
+			c.stats.Evictions++
+		}
+	}
+	c.entries[id] = cachedUser{user: u, expiresAt: now.Add(c.ttl)}
+}
+
+// forgetUser drops userID from the user cache. Call it after the write
+// that changed them has committed.
+func (s *PostgresStore) forgetUser(userID int) {
+	c := s.users
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if _, ok := c.entries[userID]; ok {
+		delete(c.entries, userID)
+		c.stats.Invalidated++
+	}
+	delete(c.loading, userID)
+	c.mu.Unlock()
+}
+
+// UserCacheStats returns the user cache's counters.
+func (s *PostgresStore) UserCacheStats() UserCacheStats {
+	c := s.users
+	if c == nil {
+		return UserCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.stats
+	st.Enabled = true
+	st.TTLSeconds = int64(c.ttl / time.Second)
+	st.Size = len(c.entries)
+	st.Max = c.max
+	return st
+}
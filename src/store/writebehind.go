@@ -0,0 +1,387 @@
+// src/store/writebehind.go
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Write-behind batches small, frequent updates whose exact timing doesn't
+// matter (last_seen_at, delivery receipts) into a few multi-row UPDATEs.
+// Methods opt in by queueing instead of writing; until EnableWriteBehind is
+// called they write directly.
+//
+// Updates are merged in memory per key: the latest last_seen_at per user,
+// and the first receipt per message (the columns keep the first one
+// anyway). They are flushed every interval, or early once maxBatch keys
+// are pending, so none waits longer than the interval while the database
+// is healthy. A failed flush keeps its updates for the next one.
+//
+// FlushWriteBehind writes everything pending and must run on clean
+// shutdown, after the HTTP server has stopped taking requests. A crash
+// loses what was pending: at most one interval of updates, plus whatever
+// piled up while flushes were failing. Beyond maxPendingFactor*maxBatch
+// pending keys new updates are dropped and counted rather than growing
+// memory without bound.
+
+// maxPendingFactor caps pending keys at this many batches.
+const maxPendingFactor = 100
+
+// WriteBehindStats describes the batcher for /admin/runtime.
+type WriteBehindStats struct {
+	Enabled      bool    `json:"enabled"`
+	IntervalMs   int64   `json:"interval_ms"`
+	Pending      int     `json:"pending"`
+	Flushes      int64   `json:"flushes"`
+	Failures     int64   `json:"failures"`
+	Written      int64   `json:"written"`
+	Dropped      int64   `json:"dropped"`
+	LastBatch    int     `json:"last_batch"`
+	MaxBatch     int     `json:"max_batch"`
+	LastFlushMs  float64 `json:"last_flush_ms"`
+	MaxFlushMs   float64 `json:"max_flush_ms"`
+	OldestWaitMs float64 `json:"oldest_pending_ms"` // Age of the oldest pending update
+}
+
+// pendingReceipt is a queued delivery receipt for one message.
+type pendingReceipt struct {
+	recipientID int
+	at          time.Time
+	via         string
+}
+
+type writeBehind struct {
+	interval time.Duration
+	maxBatch int
+	kick     chan struct{} // Asks Run for an early flush
+
+	mu        sync.Mutex
+	lastSeen  map[int]time.Time      // userID -> latest
+	receipts  map[int]pendingReceipt // messageID -> first
+	oldest    time.Time              // When the oldest pending update was queued
+	stats     WriteBehindStats
+	flushLock sync.Mutex // Serializes flushes
+}
+
+// EnableWriteBehind turns on batching for the methods that opt in, flushing
+// every interval or once maxBatch updates are pending. Call RunWriteBehind
+// to flush on that schedule.
+func (s *PostgresStore) EnableWriteBehind(interval time.Duration, maxBatch int) {
+	s.wb = &writeBehind{
+		interval: interval,
+		maxBatch: maxBatch,
+		kick:     make(chan struct{}, 1),
+		lastSeen: make(map[int]time.Time),
+		receipts: make(map[int]pendingReceipt),
+	}
+}
+
+// RunWriteBehind flushes pending updates every interval, and early when a
+// batch fills, until ctx is cancelled. It doesn't flush on the way out;
+// call FlushWriteBehind for that.
+func (s *PostgresStore) RunWriteBehind(ctx context.Context) {
+	if s.wb == nil {
+		return
+	}
+	ticker := s.clock.NewTicker(s.wb.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		case <-s.wb.kick:
+		}
+		if err := s.FlushWriteBehind(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("WRITEBEHIND: %v", err)
+		}
+	}
+}
+
+// UpdateLastSeen records that userID was active at t.
+func (s *PostgresStore) UpdateLastSeen(ctx context.Context, userID int, t time.Time) error {
+	t = t.UTC()
+	if s.wb == nil {
+		return s.writeLastSeen(ctx, []int{userID}, []time.Time{t})
+	}
+	wb := s.wb
+	wb.mu.Lock()
+	if prev, ok := wb.lastSeen[userID]; ok {
+		if t.After(prev) {
+			wb.lastSeen[userID] = t
+		}
+	} else if s.admitLocked() {
+		wb.lastSeen[userID] = t
+	}
+	s.kickLocked()
+	wb.mu.Unlock()
+	return nil
+}
+
+// QueueMessagesDelivered is MarkMessagesDelivered for write-behind: it
+// checks which of messageIDs are addressed to recipientID and returns
+// them, and their receipts are written with the next flush. Until then
+// GetMessageStatus doesn't show them.
+func (s *PostgresStore) QueueMessagesDelivered(ctx context.Context, recipientID int, messageIDs []int, via string) ([]Receipt, error) {
+	if s.wb == nil {
+		return s.MarkMessagesDelivered(ctx, recipientID, messageIDs, via)
+	}
+	receipts, err := retryRead(ctx, func() ([]Receipt, error) { return s.deliverableMessages(ctx, recipientID, messageIDs) })
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.clock.Now().UTC()
+	wb := s.wb
+	wb.mu.Lock()
+	for i := range receipts {
+		r := &receipts[i]
+		r.At = now
+		if _, ok := wb.receipts[r.MessageID]; ok || !r.First || !s.admitLocked() {
+			// Queued or stored already, or dropped for want of room, in
+			// which case a later receipt may still be the first
+			r.First = false
+			continue
+		}
+		wb.receipts[r.MessageID] = pendingReceipt{recipientID: recipientID, at: now, via: via}
+	}
+	s.kickLocked()
+	wb.mu.Unlock()
+	return receipts, nil
+}
+
+// deliverableMessages returns receipts for those of messageIDs addressed to
+// recipientID, First if the message has none stored yet.
+func (s *PostgresStore) deliverableMessages(ctx context.Context, recipientID int, messageIDs []int) ([]Receipt, error) {
+	rows, err := s.db.Query(ctx,
+		"SELECT id, timestamp, delivered_at IS NULL FROM messages WHERE recipient_id = $1 AND id = ANY($2)",
+		recipientID, messageIDs)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	receipts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Receipt, error) {
+		var r Receipt
+		err := row.Scan(&r.MessageID, &r.SentAt, &r.First)
+		return r, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("database scan error: %w", err)
+	}
+	return receipts, nil
+}
+
+// admitLocked reports whether one more key may be queued, counting it as
+// dropped if not. Must hold wb.mu.
+func (s *PostgresStore) admitLocked() bool {
+	wb := s.wb
+	n := len(wb.lastSeen) + len(wb.receipts)
+	if n >= wb.maxBatch*maxPendingFactor {
+		wb.stats.Dropped++
+		return false
+	}
+	if n == 0 {
+		wb.oldest = s.clock.Now()
+	}
+	return true
+}
+
+// kickLocked asks for an early flush once a batch is full. Must hold wb.mu.
+func (s *PostgresStore) kickLocked() {
+	wb := s.wb
+	if len(wb.lastSeen)+len(wb.receipts) < wb.maxBatch {
+		return
+	}
+	select {
+	case wb.kick <- struct{}{}:
+	default:
+	}
+}
+
+// FlushWriteBehind writes every pending update, in batches of maxBatch.
+// Updates that fail to write stay pending.
+func (s *PostgresStore) FlushWriteBehind(ctx context.Context) error {
+	wb := s.wb
+	if wb == nil {
+		return nil
+	}
+	wb.flushLock.Lock()
+	defer wb.flushLock.Unlock()
+
+	wb.mu.Lock()
+	lastSeen, receipts, oldest := wb.lastSeen, wb.receipts, wb.oldest
+	wb.lastSeen = make(map[int]time.Time)
+	wb.receipts = make(map[int]pendingReceipt)
+	wb.oldest = time.Time{}
+	wb.mu.Unlock()
+	if len(lastSeen) == 0 && len(receipts) == 0 {
+		return nil
+	}
+
+	err := s.flushLastSeen(ctx, lastSeen)
+	if err == nil {
+		err = s.flushReceipts(ctx, receipts)
+	}
+	if err != nil {
+		// Put back what wasn't written, without overriding newer updates
+		wb.mu.Lock()
+		for id, t := range lastSeen {
+			if cur, ok := wb.lastSeen[id]; !ok || t.After(cur) {
+				wb.lastSeen[id] = t
+			}
+		}
+		for id, r := range receipts {
+			if _, ok := wb.receipts[id]; !ok {
+				wb.receipts[id] = r
+			}
+		}
+		if !oldest.IsZero() && (wb.oldest.IsZero() || oldest.Before(wb.oldest)) {
+			wb.oldest = oldest
+		}
+		wb.stats.Failures++
+		wb.mu.Unlock()
+		return fmt.Errorf("flush failed, %d updates kept: %w", len(lastSeen)+len(receipts), err)
+	}
+	return nil
+}
+
+// flushLastSeen writes lastSeen in batches, removing each written batch.
+func (s *PostgresStore) flushLastSeen(ctx context.Context, lastSeen map[int]time.Time) error {
+	ids := make([]int, 0, s.wb.maxBatch)
+	times := make([]time.Time, 0, s.wb.maxBatch)
+	for id, t := range lastSeen {
+		ids = append(ids, id)
+		times = append(times, t)
+		if len(ids) == s.wb.maxBatch {
+			if err := s.timedFlush(len(ids), func() error { return s.writeLastSeen(ctx, ids, times) }); err != nil {
+				return err
+			}
+			for _, id := range ids {
+				delete(lastSeen, id)
+			}
+			ids, times = ids[:0], times[:0]
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := s.timedFlush(len(ids), func() error { return s.writeLastSeen(ctx, ids, times) }); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		delete(lastSeen, id)
+	}
+	return nil
+}
+
+// flushReceipts writes receipts in batches, removing each written batch.
+func (s *PostgresStore) flushReceipts(ctx context.Context, receipts map[int]pendingReceipt) error {
+	var batch []int
+	write := func() error {
+		ids := make([]int, len(batch))
+		recipients := make([]int, len(batch))
+		times := make([]time.Time, len(batch))
+		vias := make([]string, len(batch))
+		for i, id := range batch {
+			r := receipts[id]
+			ids[i], recipients[i], times[i], vias[i] = id, r.recipientID, r.at, r.via
+		}
+		if err := s.timedFlush(len(batch), func() error { return s.writeReceipts(ctx, ids, recipients, times, vias) }); err != nil {
+			return err
+		}
+		for _, id := range batch {
+			delete(receipts, id)
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for id := range receipts {
+		batch = append(batch, id)
+		if len(batch) == s.wb.maxBatch {
+			if err := write(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return write()
+}
+
+// timedFlush runs one batch write and records its size and latency.
+func (s *PostgresStore) timedFlush(n int, write func() error) error {
+	start := s.clock.Now()
+	err := write()
+	ms := float64(s.clock.Now().Sub(start).Microseconds()) / 1000
+
+	wb := s.wb
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	wb.stats.Flushes++
+	wb.stats.Written += int64(n)
+	wb.stats.LastBatch = n
+	if n > wb.stats.MaxBatch {
+		wb.stats.MaxBatch = n
+	}
+	wb.stats.LastFlushMs = ms
+	if ms > wb.stats.MaxFlushMs {
+		wb.stats.MaxFlushMs = ms
+	}
+	return nil
+}
+
+func (s *PostgresStore) writeLastSeen(ctx context.Context, userIDs []int, times []time.Time) error {
+	_, err := s.db.Exec(ctx,
+		`
+        UPDATE users AS u
+        SET last_seen_at = GREATEST(u.last_seen_at, v.at)
+        FROM unnest($1::int[], $2::timestamptz[]) AS v(id, at)
+        WHERE u.id = v.id
+        `, userIDs, times)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) writeReceipts(ctx context.Context, messageIDs, recipientIDs []int, times []time.Time, vias []string) error {
+	_, err := s.db.Exec(ctx,
+		`
+        UPDATE messages AS m
+        SET delivered_at = COALESCE(m.delivered_at, v.at),
+            delivered_via = CASE WHEN m.delivered_at IS NULL THEN NULLIF(v.via, '') ELSE m.delivered_via END
+        FROM unnest($1::int[], $2::int[], $3::timestamptz[], $4::text[]) AS v(id, recipient_id, at, via)
+        WHERE m.id = v.id AND m.recipient_id = v.recipient_id
+        `, messageIDs, recipientIDs, times, vias)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// WriteBehindStats returns the batcher's counters.
+func (s *PostgresStore) WriteBehindStats() WriteBehindStats {
+	wb := s.wb
+	if wb == nil {
+		return WriteBehindStats{}
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	st := wb.stats
+	st.Enabled = true
+	st.IntervalMs = wb.interval.Milliseconds()
+	st.Pending = len(wb.lastSeen) + len(wb.receipts)
+	if st.Pending > 0 && !wb.oldest.IsZero() {
+		st.OldestWaitMs = float64(s.clock.Now().Sub(wb.oldest).Microseconds()) / 1000
+	}
+	return st
+}
@@ -0,0 +1,193 @@
+// src/store/writebehind_test.go
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cryptachat-server/testutil"
+)
+
+// TestWriteBehindMerges queues last_seen updates without a database: each
+// user keeps their latest, a full batch asks for an early flush, and past
+// the pending cap only users already queued are updated.
+func TestWriteBehindMerges(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Second)
+	clk := testutil.NewFakeClock(start)
+	s := &PostgresStore{clock: clk}
+	s.EnableWriteBehind(5*time.Second, 2)
+	ctx := context.Background()
+	seen := func(at time.Duration) time.Time { return start.Add(at) }
+
+	for _, at := range []time.Duration{2 * time.Second, time.Second, 3 * time.Second} {
+		if err := s.UpdateLastSeen(ctx, 1, seen(at)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := s.wb.lastSeen[1]; !got.Equal(seen(3 * time.Second)) {
+		t.Errorf("user 1 pending at %v, want the latest", got)
+	}
+	if len(s.wb.kick) != 0 {
+		t.Error("an early flush was asked for before the batch filled")
+	}
+	clk.Advance(1500 * time.Millisecond)
+	s.UpdateLastSeen(ctx, 2, seen(0))
+	if len(s.wb.kick) != 1 {
+		t.Error("no early flush asked for with a full batch")
+	}
+	if st := s.WriteBehindStats(); !st.Enabled || st.Pending != 2 || st.OldestWaitMs != 1500 || st.IntervalMs != 5000 {
+		t.Errorf("stats %+v, want 2 pending for 1500ms", st)
+	}
+
+	for id := 3; id <= 2*maxPendingFactor+5; id++ {
+		s.UpdateLastSeen(ctx, id, seen(0))
+	}
+	s.UpdateLastSeen(ctx, 1, seen(time.Minute))
+	st := s.WriteBehindStats()
+	if st.Pending != 2*maxPendingFactor || st.Dropped != 5 {
+		t.Errorf("past the cap: %d pending, %d dropped; want %d and 5", st.Pending, st.Dropped, 2*maxPendingFactor)
+	}
+	if got := s.wb.lastSeen[1]; !got.Equal(seen(time.Minute)) {
+		t.Errorf("a queued user wasn't updated past the cap: %v", got)
+	}
+}
+
+// TestWriteBehindFlushes queues last_seen updates and receipts, and checks
+// nothing is written until a flush: early once a batch fills, on the
+// interval, and on shutdown. Batch sizes are recorded.
+func TestWriteBehindFlushes(t *testing.T) {
+	s := newTestStore(t)
+	start := time.Now().UTC().Truncate(time.Second)
+	clk := testutil.NewFakeClock(start)
+	s.SetClock(clk)
+	s.EnableWriteBehind(time.Minute, 2)
+	ctx := context.Background()
+
+	alice := mustRegister(t, s, "alice")
+	bob := mustRegister(t, s, "bob")
+	carol := mustRegister(t, s, "carol")
+	lastSeen := func(id int) time.Time {
+		t.Helper()
+		var at *time.Time
+		if err := s.db.QueryRow(ctx, "SELECT last_seen_at FROM users WHERE id = $1", id).Scan(&at); err != nil {
+			t.Fatal(err)
+		}
+		if at == nil {
+			return time.Time{}
+		}
+		return *at
+	}
+	flushed := func(what string, tick bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for s.WriteBehindStats().Pending > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			if tick {
+				// Run may not have started its ticker yet
+				clk.Advance(time.Minute)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		s.RunWriteBehind(runCtx)
+		close(done)
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	defer stop()
+
+	// One update waits for the interval
+	s.UpdateLastSeen(ctx, alice, start)
+	if !lastSeen(alice).IsZero() {
+		t.Fatal("last_seen_at written before a flush")
+	}
+	flushed("the interval flush", true)
+	if !lastSeen(alice).Equal(start) {
+		t.Errorf("after the interval, alice last seen %v, want %v", lastSeen(alice), start)
+	}
+
+	// Two fill a batch and are flushed at once
+	later := start.Add(time.Second)
+	s.UpdateLastSeen(ctx, alice, later)
+	s.UpdateLastSeen(ctx, bob, later)
+	flushed("the early flush", false)
+	if !lastSeen(alice).Equal(later) || !lastSeen(bob).Equal(later) {
+		t.Errorf("after the early flush, last seen %v and %v, want %v", lastSeen(alice), lastSeen(bob), later)
+	}
+	stop()
+
+	// Three are flushed in batches of two; an older update doesn't move
+	// last_seen_at back
+	latest := later.Add(time.Second)
+	s.UpdateLastSeen(ctx, alice, start)
+	s.UpdateLastSeen(ctx, bob, latest)
+	s.UpdateLastSeen(ctx, carol, latest)
+	if err := s.FlushWriteBehind(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !lastSeen(alice).Equal(later) || !lastSeen(bob).Equal(latest) || !lastSeen(carol).Equal(latest) {
+		t.Errorf("last seen %v, %v, %v; want %v, %v, %v", lastSeen(alice), lastSeen(bob), lastSeen(carol), later, latest, latest)
+	}
+	st := s.WriteBehindStats()
+	if st.Flushes != 4 || st.Written != 6 || st.MaxBatch != 2 || st.Failures != 0 || st.Pending != 0 {
+		t.Errorf("stats %+v, want 4 flushes writing 6 updates in batches of at most 2", st)
+	}
+
+	// Receipts are returned at once but stored with the flush, and only
+	// the first counts
+	id, _, err := s.SendMessage(ctx, alice, "bob", "s", "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipts, err := s.QueueMessagesDelivered(ctx, bob, []int{id}, "ws")
+	if err != nil || len(receipts) != 1 || !receipts[0].First {
+		t.Fatalf("queued %+v, %v; want one first receipt", receipts, err)
+	}
+	if again, err := s.QueueMessagesDelivered(ctx, bob, []int{id}, "http"); err != nil || len(again) != 1 || again[0].First {
+		t.Errorf("queued again %+v, %v; want a receipt that isn't the first", again, err)
+	}
+	if other, err := s.QueueMessagesDelivered(ctx, carol, []int{id}, "ws"); err != nil || len(other) != 0 {
+		t.Errorf("someone else's message: %+v, %v", other, err)
+	}
+	status, err := s.GetMessageStatus(ctx, alice, id)
+	if err != nil || status.DeliveredAt != nil {
+		t.Fatalf("before the flush: %+v, %v; want undelivered", status, err)
+	}
+
+	// Shutdown flushes what is pending
+	if err := s.FlushWriteBehind(ctx); err != nil {
+		t.Fatal(err)
+	}
+	status, err = s.GetMessageStatus(ctx, alice, id)
+	if err != nil || status.DeliveredAt == nil || status.DeliveredVia == nil || *status.DeliveredVia != "ws" {
+		t.Errorf("after the flush: %+v, %v; want delivered over ws", status, err)
+	}
+}
+
+// TestWriteBehindKeepsFailedUpdates flushes with the database gone: the
+// updates stay pending for the next flush and the failure is counted.
+func TestWriteBehindKeepsFailedUpdates(t *testing.T) {
+	s := newTestStore(t)
+	s.EnableWriteBehind(time.Minute, 2)
+	ctx := context.Background()
+	alice := mustRegister(t, s, "alice")
+	s.Close()
+
+	s.UpdateLastSeen(ctx, alice, time.Now())
+	s.UpdateLastSeen(ctx, alice+1, time.Now())
+	if err := s.FlushWriteBehind(ctx); err == nil {
+		t.Fatal("a flush with the database gone succeeded")
+	}
+	if st := s.WriteBehindStats(); st.Pending != 2 || st.Failures != 1 || st.Flushes != 0 {
+		t.Errorf("after the failure: %+v, want both updates kept", st)
+	}
+}
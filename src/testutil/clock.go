@@ -0,0 +1,89 @@
+// src/testutil/clock.go
+package testutil
+
+import (
+	"sync"
+	"time"
+
+	"cryptachat-server/clock"
+)
+
+// FakeClock is a clock.Clock whose time only moves when Advance is called.
+// Tickers created from it fire (at most once per Advance, like a real
+// ticker that drops ticks) when their next tick time has been reached.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFakeClock returns a FakeClock starting at start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the fake current time.
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTicker returns a ticker driven by Advance.
+func (f *FakeClock) NewTicker(d time.Duration) clock.Ticker {
+	if d <= 0 {
+		panic("testutil: non-positive interval for NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{
+		clock:  f,
+		period: d,
+		next:   f.now.Add(d),
+		c:      make(chan time.Time, 1),
+	}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and fires any tickers that are due.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	for _, t := range f.tickers {
+		if t.stopped || f.now.Before(t.next) {
+			continue
+		}
+		for !f.now.Before(t.next) {
+			t.next = t.next.Add(t.period)
+		}
+		select {
+		case t.c <- f.now:
+		default:
+		}
+	}
+}
+
+// Set jumps the clock to t (which may be in the past) without firing tickers.
+func (f *FakeClock) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = t
+}
+
+type fakeTicker struct {
+	clock   *FakeClock
+	period  time.Duration
+	next    time.Time
+	c       chan time.Time
+	stopped bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
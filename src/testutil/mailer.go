@@ -0,0 +1,38 @@
+// src/testutil/mailer.go
+package testutil
+
+import (
+	"context"
+	"sync"
+)
+
+// Mail is a message sent through a FakeMailer.
+type Mail struct {
+	To, Subject, Body string
+}
+
+// FakeMailer is a mailer.Mailer that keeps what it is asked to send. Err,
+// if set, is returned instead.
+type FakeMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+	Err  error
+}
+
+// Send records the message.
+func (f *FakeMailer) Send(ctx context.Context, to, subject, body string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.sent = append(f.sent, Mail{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+// Sent returns the messages sent so far, oldest first.
+func (f *FakeMailer) Sent() []Mail {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Mail(nil), f.sent...)
+}
@@ -0,0 +1,227 @@
+// src/tokensign/tokensign.go
+package tokensign
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Access tokens are signed with the shared SECRET_KEY (HS256) by default.
+// With RS256 or EdDSA they are signed with a private key instead, and
+// anything holding the public key, e.g. from /.well-known/jwks.json, can
+// verify them without being able to issue any.
+
+// Algorithms.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+// minRSABits is the smallest RSA key accepted.
+const minRSABits = 2048
+
+// Signer signs and verifies the server's JWTs with one algorithm. Tokens
+// signed with any other algorithm are refused.
+type Signer struct {
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+	kid       string // Key ID in token headers and the JWKS; "" for HS256
+	jwk       *JWK   // nil for HS256
+}
+
+// NewHMAC returns an HS256 signer with a shared secret.
+func NewHMAC(secret []byte) *Signer {
+	return &Signer{method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+}
+
+// Load returns a signer for alg. For RS256 and EdDSA, privateKeyFile is a
+// PEM private key (PKCS#8, or PKCS#1 for RSA). publicKeyFile is optional;
+// if set it must be the matching PEM public key (PKIX).
+func Load(alg string, secret []byte, privateKeyFile, publicKeyFile string) (*Signer, error) {
+	if alg == "" || alg == HS256 {
+		if privateKeyFile != "" || publicKeyFile != "" {
+			return nil, fmt.Errorf("key files are only used with %s or %s", RS256, EdDSA)
+		}
+		return NewHMAC(secret), nil
+	}
+	if alg != RS256 && alg != EdDSA {
+		return nil, fmt.Errorf("unknown algorithm %q, must be %s, %s or %s", alg, HS256, RS256, EdDSA)
+	}
+	if privateKeyFile == "" {
+		return nil, fmt.Errorf("%s needs a private key file", alg)
+	}
+
+	priv, err := readPrivateKey(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var s *Signer
+	switch key := priv.(type) {
+	case *rsa.PrivateKey:
+		if alg != RS256 {
+			return nil, fmt.Errorf("%s is an RSA key, not usable with %s", privateKeyFile, alg)
+		}
+		if key.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("%s: RSA key must be at least %d bits", privateKeyFile, minRSABits)
+		}
+		s = &Signer{method: jwt.SigningMethodRS256, signKey: key, verifyKey: &key.PublicKey}
+		s.jwk = &JWK{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+	case ed25519.PrivateKey:
+		if alg != EdDSA {
+			return nil, fmt.Errorf("%s is an Ed25519 key, not usable with %s", privateKeyFile, alg)
+		}
+		pub := key.Public().(ed25519.PublicKey)
+		s = &Signer{method: jwt.SigningMethodEdDSA, signKey: key, verifyKey: pub}
+		s.jwk = &JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(pub),
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T", privateKeyFile, priv)
+	}
+
+	if publicKeyFile != "" {
+		pub, err := readPublicKey(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if eq, ok := pub.(interface{ Equal(crypto.PublicKey) bool }); !ok || !eq.Equal(s.verifyKey) {
+			return nil, fmt.Errorf("%s does not match %s", publicKeyFile, privateKeyFile)
+		}
+	}
+
+	s.kid = s.jwk.thumbprint()
+	s.jwk.Alg = alg
+	s.jwk.Use = "sig"
+	s.jwk.Kid = s.kid
+	return s, nil
+}
+
+// Algorithm is the JWT "alg" this signer uses.
+func (s *Signer) Algorithm() string {
+	return s.method.Alg()
+}
+
+// Sign returns claims as a signed JWT.
+func (s *Signer) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.method, claims)
+	if s.kid != "" {
+		token.Header["kid"] = s.kid
+	}
+	return token.SignedString(s.signKey)
+}
+
+// Parse verifies tokenString into claims. A token signed with another
+// algorithm fails, as does one that doesn't verify.
+func (s *Signer) Parse(tokenString string, claims jwt.Claims, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	opts = append(opts, jwt.WithValidMethods([]string{s.method.Alg()}))
+	return jwt.ParseWithClaims(tokenString, claims, func(*jwt.Token) (interface{}, error) {
+		return s.verifyKey, nil
+	}, opts...)
+}
+
+// JWK is a public key in JSON Web Key form (RFC 7517).
+type JWK struct {
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	E   string `json:"e,omitempty"`
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n,omitempty"`
+	Use string `json:"use"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is the body of /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public key set, or nil for HS256, whose key is secret.
+func (s *Signer) JWKS() *JWKS {
+	if s.jwk == nil {
+		return nil
+	}
+	return &JWKS{Keys: []JWK{*s.jwk}}
+}
+
+// thumbprint is the RFC 7638 SHA-256 thumbprint of the key: its required
+// members, in lexicographic order, without whitespace.
+func (k *JWK) thumbprint() string {
+	var canonical string
+	switch k.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, k.Crv, k.X)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func readPrivateKey(path string) (interface{}, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return key, nil
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: expected a PRIVATE KEY or RSA PRIVATE KEY block, found %s", path, block.Type)
+}
+
+func readPublicKey(path string) (interface{}, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: expected a PUBLIC KEY block, found %s", path, block.Type)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(path + ": no PEM data")
+	}
+	return block, nil
+}
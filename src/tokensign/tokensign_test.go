@@ -0,0 +1,214 @@
+// src/tokensign/tokensign_test.go
+package tokensign
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writePEM writes der as a PEM block of type typ and returns its path.
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func writePKCS8(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, "private.pem", "PRIVATE KEY", der)
+}
+
+func writePublic(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, "public.pem", "PUBLIC KEY", der)
+}
+
+func claims() jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{Subject: "alice", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+}
+
+// roundTrip signs with s and checks s verifies it, and that other doesn't.
+func roundTrip(t *testing.T, s, other *Signer) string {
+	t.Helper()
+	token, err := s.Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got jwt.RegisteredClaims
+	if _, err := s.Parse(token, &got); err != nil || got.Subject != "alice" {
+		t.Errorf("%s: parsing its own token: %v", s.Algorithm(), err)
+	}
+	if _, err := other.Parse(token, &jwt.RegisteredClaims{}); err == nil {
+		t.Errorf("a %s token verified by a %s signer", s.Algorithm(), other.Algorithm())
+	}
+	return token
+}
+
+func TestHMAC(t *testing.T) {
+	s, err := Load("", []byte("secret-one"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Algorithm() != HS256 || s.JWKS() != nil {
+		t.Errorf("algorithm %s, JWKS %v", s.Algorithm(), s.JWKS())
+	}
+	token := roundTrip(t, s, NewHMAC([]byte("secret-two")))
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := parsed.Header["kid"]; ok {
+		t.Error("an HS256 token names a key")
+	}
+}
+
+func TestRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// PKCS#1 and PKCS#8 load the same key
+	pkcs1 := writePEM(t, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	s, err := Load(RS256, nil, pkcs1, writePublic(t, &key.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s8, err := Load(RS256, nil, writePKCS8(t, key), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.kid == "" || s.kid != s8.kid {
+		t.Errorf("key IDs %q and %q", s.kid, s8.kid)
+	}
+
+	token := roundTrip(t, s, NewHMAC([]byte("secret")))
+	if _, err := s8.Parse(token, &jwt.RegisteredClaims{}); err != nil {
+		t.Errorf("the PKCS#8 signer: %v", err)
+	}
+	parsed, _, _ := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+	if parsed.Header["kid"] != s.kid || parsed.Header["alg"] != RS256 {
+		t.Errorf("header %v", parsed.Header)
+	}
+
+	// The JWKS holds the public key, and nothing private
+	jwks := s.JWKS()
+	if jwks == nil || len(jwks.Keys) != 1 {
+		t.Fatalf("JWKS %+v", jwks)
+	}
+	k := jwks.Keys[0]
+	n, _ := base64.RawURLEncoding.DecodeString(k.N)
+	e, _ := base64.RawURLEncoding.DecodeString(k.E)
+	if k.Kty != "RSA" || k.Alg != RS256 || k.Use != "sig" || k.Kid != s.kid ||
+		new(big.Int).SetBytes(n).Cmp(key.N) != 0 || new(big.Int).SetBytes(e).Int64() != int64(key.E) {
+		t.Errorf("JWK %+v", k)
+	}
+
+	// An HS256 token keyed with the public key, the classic confusion, fails
+	pubPEM, _ := os.ReadFile(writePublic(t, &key.PublicKey))
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims()).SignedString(pubPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Parse(forged, &jwt.RegisteredClaims{}); err == nil {
+		t.Error("an HS256 token keyed with the public key was accepted")
+	}
+	if _, err := s.Parse(strings.Replace(token, ".", "x.", 1), &jwt.RegisteredClaims{}); err == nil {
+		t.Error("a mangled token was accepted")
+	}
+}
+
+func TestEdDSA(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(EdDSA, nil, writePKCS8(t, priv), writePublic(t, pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, s, NewHMAC([]byte("secret")))
+
+	k := s.JWKS().Keys[0]
+	x, _ := base64.RawURLEncoding.DecodeString(k.X)
+	if k.Kty != "OKP" || k.Crv != "Ed25519" || k.Alg != EdDSA || !pub.Equal(ed25519.PublicKey(x)) || k.N != "" {
+		t.Errorf("JWK %+v", k)
+	}
+
+	// Tokens from another Ed25519 key don't verify
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	other, err := Load(EdDSA, nil, writePKCS8(t, otherPriv), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, other, s)
+}
+
+func TestLoadRefuses(t *testing.T) {
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	edFile := writePKCS8(t, edPriv)
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, alg, priv, pub string
+	}{
+		{"unknown algorithm", "ES256", edFile, ""},
+		{"HS256 with a key file", HS256, edFile, ""},
+		{"no private key", EdDSA, "", ""},
+		{"missing file", EdDSA, filepath.Join(t.TempDir(), "none.pem"), ""},
+		{"no PEM data", EdDSA, garbage, ""},
+		{"public key as private", EdDSA, writePublic(t, edPub), ""},
+		{"private key as public", EdDSA, edFile, edFile},
+		{"Ed25519 key for RS256", RS256, edFile, ""},
+		{"RSA key for EdDSA", EdDSA, writePKCS8(t, small), ""},
+		{"short RSA key", RS256, writePKCS8(t, small), ""},
+		{"mismatched public key", EdDSA, edFile, writePublic(t, otherPub)},
+	}
+	for _, tt := range tests {
+		if _, err := Load(tt.alg, []byte("secret"), tt.priv, tt.pub); err == nil {
+			t.Errorf("%s: loaded", tt.name)
+		}
+	}
+}
+
+// TestThumbprint checks the key ID against RFC 7638's example.
+func TestThumbprint(t *testing.T) {
+	k := &JWK{
+		Kty: "RSA",
+		E:   "AQAB",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+	}
+	if got := k.thumbprint(); got != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("thumbprint %s", got)
+	}
+}
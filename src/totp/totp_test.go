@@ -0,0 +1,102 @@
+// src/totp/totp_test.go
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key of RFC 6238's test vectors, base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestCodeMatchesRFC6238 checks the RFC's test vectors, cut to 6 digits.
+func TestCodeMatchesRFC6238(t *testing.T) {
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range vectors {
+		got, err := Code(rfcSecret, Step(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("at %d: %s, want %s", unix, got, want)
+		}
+	}
+	// Apps may show the secret in lower case
+	if got, _ := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", Step(time.Unix(59, 0))); got != "287082" {
+		t.Errorf("lower-case secret: %s", got)
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("an invalid secret was accepted")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1111111111, 0) // Step 37037037, 1s into it
+	step := Step(now)
+
+	code := func(step int64) string {
+		c, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	for _, delta := range []int64{-1, 0, 1} {
+		if got, ok := Verify(rfcSecret, code(step+delta), now, 1); !ok || got != step+delta {
+			t.Errorf("code from step %+d: %d %v, want it matched at %d", delta, got, ok, step+delta)
+		}
+	}
+	for _, delta := range []int64{-2, 2} {
+		if _, ok := Verify(rfcSecret, code(step+delta), now, 1); ok {
+			t.Errorf("code from step %+d accepted with a skew of 1", delta)
+		}
+	}
+	if _, ok := Verify(rfcSecret, code(step+1), now, 0); ok {
+		t.Error("the next step's code accepted with no skew")
+	}
+	for _, bad := range []string{"", "05047", "0504710", "abcdef"} {
+		if _, ok := Verify(rfcSecret, bad, now, 1); ok {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	if _, ok := Verify("not base32!", "050471", now, 1); ok {
+		t.Error("accepted against an invalid secret")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := GenerateSecret()
+	if len(a) != 32 || a == b {
+		t.Errorf("secrets %s and %s, want two different 32-character ones", a, b)
+	}
+	if _, err := Code(a, 1); err != nil {
+		t.Errorf("a generated secret can't make codes: %v", err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	got := URI("Crypta Chat", "alice@example", rfcSecret)
+	u, err := url.Parse(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Crypta Chat:alice@example" {
+		t.Errorf("URI %s", got)
+	}
+	q := u.Query()
+	if q.Get("secret") != rfcSecret || q.Get("issuer") != "Crypta Chat" || q.Get("digits") != "6" || q.Get("period") != "30" || q.Get("algorithm") != "SHA1" {
+		t.Errorf("query %v", q)
+	}
+}
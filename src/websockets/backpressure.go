@@ -0,0 +1,177 @@
+// src/websockets/backpressure.go
+package websockets
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// BackpressurePolicy decides what happens when a client's send buffer is full.
+type BackpressurePolicy string
+
+const (
+	// PolicyDisconnect drops the slow client (the original behaviour).
+	PolicyDisconnect BackpressurePolicy = "disconnect"
+	// PolicyDropOldest evicts the oldest queued frame to make room.
+	PolicyDropOldest BackpressurePolicy = "drop-oldest"
+	// PolicyDropNewest discards the frame that didn't fit.
+	PolicyDropNewest BackpressurePolicy = "drop-newest"
+)
+
+// DefaultSendBuffer is the per-client outbound queue length.
+const DefaultSendBuffer = 256
+
+// ParseBackpressurePolicy validates a policy name from config.
+func ParseBackpressurePolicy(name string) (BackpressurePolicy, error) {
+	switch p := BackpressurePolicy(name); p {
+	case PolicyDisconnect, PolicyDropOldest, PolicyDropNewest:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown backpressure policy %q", name)
+}
+
+// PushStats counts the outcome of every push to a connected client.
+type PushStats struct {
+	Delivered    int64 `json:"delivered"`
+	DroppedOld   int64 `json:"dropped_oldest"`
+	DroppedNew   int64 `json:"dropped_newest"`
+	Disconnected int64 `json:"disconnected"`
+	NotConnected int64 `json:"not_connected"`
+	ShedGlobal   int64 `json:"shed_global_budget"`
+	// QueuedBytes is a gauge of frame bytes waiting in all send buffers.
+	QueuedBytes  int64 `json:"queued_bytes"`
+	ClientBudget int64 `json:"client_budget_bytes"` // 0 = no cap
+	GlobalBudget int64 `json:"global_budget_bytes"` // 0 = no cap
+}
+
+// PushOutcome is what happened to a single push.
+type PushOutcome string
+
+const (
+	OutcomeDelivered     PushOutcome = "delivered"
+	OutcomeQueuedEvicted PushOutcome = "queued_evicted_oldest"
+	OutcomeDroppedNewest PushOutcome = "dropped_newest"
+	OutcomeDisconnected  PushOutcome = "client_disconnected"
+	OutcomeNotConnected  PushOutcome = "not_connected"
+	OutcomeHubFull       PushOutcome = "hub_queue_full"
+	OutcomeEncodeFailed  PushOutcome = "encode_failed"
+	OutcomeGlobalBudget  PushOutcome = "shed_global_budget"
+)
+
+type pushCounters struct {
+	delivered    atomic.Int64
+	droppedOld   atomic.Int64
+	droppedNew   atomic.Int64
+	disconnected atomic.Int64
+	notConnected atomic.Int64
+	shedGlobal   atomic.Int64
+}
+
+// streamDegradedFrame tells a client that frames were dropped and it should
+// re-sync over HTTP.
+func streamDegradedFrame(policy BackpressurePolicy, dropped int64) []byte {
+	frame, err := json.Marshal(map[string]interface{}{
+		"type": "stream_degraded",
+		"payload": map[string]interface{}{
+			"policy":  policy,
+			"dropped": dropped,
+		},
+	})
+	if err != nil {
+		log.Printf("WS: could not encode stream_degraded frame: %v", err)
+		return nil
+	}
+	return frame
+}
+
+// enqueue tries to queue frame for client without blocking, counting its
+// bytes while it is queued. It does not check the budgets.
+func (h *Hub) enqueue(client *Client, frame []byte) bool {
+	size := int64(len(frame))
+	client.queuedBytes.Add(size)
+	h.queuedBytes.Add(size)
+	select {
+	case client.send <- frame:
+		return true
+	default:
+		h.dequeued(client, frame)
+		return false
+	}
+}
+
+// dequeued releases the bytes of a frame taken off client's queue, whether
+// it was written, evicted or discarded on close.
+func (h *Hub) dequeued(client *Client, frame []byte) {
+	size := int64(len(frame))
+	client.queuedBytes.Add(-size)
+	h.queuedBytes.Add(-size)
+}
+
+// fits reports whether size more bytes stay within client's byte budget.
+func (h *Hub) fits(client *Client, size int64) bool {
+	budget := h.clientBudget.Load()
+	return budget <= 0 || client.queuedBytes.Load()+size <= budget
+}
+
+// deliver queues a frame for client according to the hub's policy and
+// reports the outcome. A frame that doesn't fit the client's queue length or
+// byte budget is handled by the policy. One that would take all queues past
+// the global budget is shed whatever the policy: the message is already
+// stored, and the client re-syncs after its stream_degraded notice. It must
+// be called from the hub's Run loop.
+func (h *Hub) deliver(client *Client, frame []byte) PushOutcome {
+	size := int64(len(frame))
+	if budget := h.globalBudget.Load(); budget > 0 && h.queuedBytes.Load()+size > budget {
+		h.counters.shedGlobal.Add(1)
+		client.dropped.Add(1)
+		return OutcomeGlobalBudget
+	}
+
+	if h.fits(client, size) && h.enqueue(client, frame) {
+		h.counters.delivered.Add(1)
+		return OutcomeDelivered
+	}
+
+	switch h.backpressure() {
+	case PolicyDropOldest:
+		// Larger than the whole budget on its own: evicting can't help
+		if budget := h.clientBudget.Load(); budget > 0 && size > budget {
+			client.dropped.Add(1)
+			h.counters.droppedNew.Add(1)
+			return OutcomeDroppedNewest
+		}
+		// Evict queued frames until the new one fits (the writer may race us
+		// for them, which is fine)
+		for !h.fits(client, size) || len(client.send) == cap(client.send) {
+			select {
+			case old := <-client.send:
+				h.dequeued(client, old)
+				client.dropped.Add(1)
+				continue
+			default:
+			}
+			break
+		}
+		if h.fits(client, size) && h.enqueue(client, frame) {
+			h.counters.droppedOld.Add(1)
+			return OutcomeQueuedEvicted
+		}
+		// Nothing left to evict and it still doesn't fit
+		client.dropped.Add(1)
+		h.counters.droppedNew.Add(1)
+		return OutcomeDroppedNewest
+
+	case PolicyDropNewest:
+		h.counters.droppedNew.Add(1)
+		client.dropped.Add(1)
+		return OutcomeDroppedNewest
+
+	default: // PolicyDisconnect
+		log.Printf("WS: Client queue full for user %d. Disconnecting.", client.userID)
+		h.counters.disconnected.Add(1)
+		h.removeClient(client)
+		return OutcomeDisconnected
+	}
+}
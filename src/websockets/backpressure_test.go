@@ -0,0 +1,200 @@
+// src/websockets/backpressure_test.go
+package websockets
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBackpressurePolicies pushes six frames at a stalled client with room
+// for four, under each policy, and checks what each push reports, what is
+// left queued and what the counters say.
+func TestBackpressurePolicies(t *testing.T) {
+	const bob = 2
+	frames := make([][]byte, 6)
+	for i := range frames {
+		frames[i] = []byte(fmt.Sprintf(`"f%d"`, i))
+	}
+
+	tests := []struct {
+		policy   BackpressurePolicy
+		outcomes []PushOutcome
+		queued   []string // What the client would still be sent
+		stats    PushStats
+	}{
+		{
+			policy:   PolicyDisconnect,
+			outcomes: []PushOutcome{OutcomeDelivered, OutcomeDelivered, OutcomeDelivered, OutcomeDelivered, OutcomeDisconnected},
+			stats:    PushStats{Delivered: 4, Disconnected: 1},
+		},
+		{
+			policy:   PolicyDropOldest,
+			outcomes: []PushOutcome{OutcomeDelivered, OutcomeDelivered, OutcomeDelivered, OutcomeDelivered, OutcomeQueuedEvicted, OutcomeQueuedEvicted},
+			queued:   []string{`"f2"`, `"f3"`, `"f4"`, `"f5"`},
+			stats:    PushStats{Delivered: 4, DroppedOld: 2, QueuedBytes: 16},
+		},
+		{
+			policy:   PolicyDropNewest,
+			outcomes: []PushOutcome{OutcomeDelivered, OutcomeDelivered, OutcomeDelivered, OutcomeDelivered, OutcomeDroppedNewest, OutcomeDroppedNewest},
+			queued:   []string{`"f0"`, `"f1"`, `"f2"`, `"f3"`},
+			stats:    PushStats{Delivered: 4, DroppedNew: 2, QueuedBytes: 16},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			h := NewHub()
+			h.SetBackpressure(tt.policy, 4)
+			c := connect(h, bob)
+
+			for i, want := range tt.outcomes {
+				if got := h.deliver(c, frames[i]); got != want {
+					t.Fatalf("push %d: %s, want %s", i, got, want)
+				}
+			}
+			if got := h.Stats(); got != tt.stats {
+				t.Errorf("stats %+v, want %+v", got, tt.stats)
+			}
+
+			if tt.policy == PolicyDisconnect {
+				if h.IsOnline(bob) {
+					t.Error("the slow client is still registered")
+				}
+				if _, open := <-c.send; open {
+					t.Error("the slow client's queue is still open")
+				}
+				return
+			}
+			var queued []string
+			for len(c.send) > 0 {
+				queued = append(queued, string(<-c.send))
+			}
+			if strings.Join(queued, " ") != strings.Join(tt.queued, " ") {
+				t.Errorf("queued %v, want %v", queued, tt.queued)
+			}
+			if n := c.dropped.Load(); n != 2 {
+				t.Errorf("%d frames counted for the stream_degraded notice, want 2", n)
+			}
+		})
+	}
+}
+
+// TestStreamDegradedNotice connects a real client under each dropping
+// policy and pushes it a frame over its byte budget, which is dropped, and
+// then one that fits. The client must be told of the gap before the frame
+// that follows it.
+func TestStreamDegradedNotice(t *testing.T) {
+	for _, policy := range []BackpressurePolicy{PolicyDropOldest, PolicyDropNewest} {
+		t.Run(string(policy), func(t *testing.T) {
+			h, dial := serveHub(t)
+			h.SetBackpressure(policy, 0)
+			h.SetQueueBudgets(100, 0)
+			conn := dial(2, 0)
+			defer conn.Close()
+			waitFor(t, "the client to register", func() bool { return h.IsOnline(2) })
+
+			h.PushToUser(2, strings.Repeat("x", 200))
+			h.PushToUser(2, "fits")
+
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var notice struct {
+				Type    string `json:"type"`
+				Payload struct {
+					Policy  BackpressurePolicy `json:"policy"`
+					Dropped int64              `json:"dropped"`
+				} `json:"payload"`
+			}
+			if err := conn.ReadJSON(&notice); err != nil {
+				t.Fatal(err)
+			}
+			if notice.Type != "stream_degraded" || notice.Payload.Policy != policy || notice.Payload.Dropped != 1 {
+				t.Errorf("first frame %+v, want stream_degraded for 1 frame under %s", notice, policy)
+			}
+			_, frame, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body string
+			if err := json.Unmarshal(frame, &body); err != nil || body != "fits" {
+				t.Errorf("second frame %s, want the one that fit", frame)
+			}
+		})
+	}
+}
+
+// TestQueueByteBudgets pushes large frames at stalled clients until each
+// budget is reached. The per-client budget is applied through the policy,
+// the global one sheds whatever the policy, and the gauge counts exactly
+// what is queued, back to zero once the clients are gone.
+func TestQueueByteBudgets(t *testing.T) {
+	h := NewHub()
+	h.SetBackpressure(PolicyDropOldest, 100)
+	h.SetQueueBudgets(1000, 2500)
+	a, b, c := connect(h, 1), connect(h, 2), connect(h, 3)
+	frame := func(n int) []byte { return []byte(strings.Repeat("x", n)) }
+	push := func(client *Client, size int, want PushOutcome) {
+		t.Helper()
+		if got := h.deliver(client, frame(size)); got != want {
+			t.Fatalf("pushing %d bytes to user %d: %s, want %s", size, client.userID, got, want)
+		}
+	}
+	queued := func(want int64) {
+		t.Helper()
+		if got := h.Stats().QueuedBytes; got != want {
+			t.Fatalf("%d bytes queued, want %d", got, want)
+		}
+	}
+
+	push(a, 400, OutcomeDelivered)
+	push(a, 400, OutcomeDelivered)
+	// A third would take a past its budget, so the oldest makes way
+	push(a, 400, OutcomeQueuedEvicted)
+	queued(800)
+	// Evicting can't make room for a frame over the whole budget
+	push(a, 1200, OutcomeDroppedNewest)
+	if len(a.send) != 2 || a.queuedBytes.Load() != 800 {
+		t.Errorf("a has %d frames, %d bytes queued; want 2 and 800", len(a.send), a.queuedBytes.Load())
+	}
+
+	push(b, 400, OutcomeDelivered)
+	push(b, 400, OutcomeDelivered)
+	push(c, 400, OutcomeDelivered)
+	queued(2000)
+	push(c, 400, OutcomeDelivered)
+	// 2800 would pass the global budget, though c has room of its own
+	push(c, 400, OutcomeGlobalBudget)
+	queued(2400)
+	if n := c.dropped.Load(); n != 1 {
+		t.Errorf("%d frames counted for c's stream_degraded notice, want 1", n)
+	}
+	if s := h.Stats(); s.ShedGlobal != 1 || s.DroppedOld != 1 || s.DroppedNew != 1 {
+		t.Errorf("stats %+v, want one each shed, evicting and dropped", s)
+	}
+
+	for _, client := range []*Client{a, b, c} {
+		h.removeClient(client)
+	}
+	queued(0)
+}
+
+// TestQueuedBytesReleasedOnWrite checks frames a connected client is sent
+// leave the gauge as they are written.
+func TestQueuedBytesReleasedOnWrite(t *testing.T) {
+	h, dial := serveHub(t)
+	conn := dial(2, 0)
+	defer conn.Close()
+	waitFor(t, "the client to register", func() bool { return h.IsOnline(2) })
+
+	for i := 0; i < 3; i++ {
+		h.PushToUser(2, strings.Repeat("x", 1000))
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 3; i++ {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the gauge to return to zero", func() bool { return h.Stats().QueuedBytes == 0 })
+}
@@ -3,6 +3,7 @@ package websockets
 
 import (
 	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,19 +22,63 @@ const (
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
-	hub    *Hub
-	conn   *websocket.Conn
-	send   chan []byte // Buffered channel of outbound messages.
+	hub  *Hub
+	conn *websocket.Conn
+	send chan []byte // Buffered channel of outbound messages.
+	// Signalled by the hub when a ping is due
+	ping   chan struct{}
 	userID int
+	// Login session of the token the connection was opened with; 0 if none
+	sessionID int64
+	// When the connection was opened, and the last frame or pong from the
+	// client in Unix nanoseconds (see sessions.go)
+	connectedAt time.Time
+	lastActive  atomic.Int64
+	// Close code the writer sends once the hub closes the connection; 0
+	// sends an empty close frame
+	closeCode atomic.Int32
+	// Closed once the writer has exited and closed the socket
+	closed chan struct{}
+	// Frames dropped by the backpressure policy since the last stream_degraded notice.
+	dropped atomic.Int64
+	// Bytes of frames in send
+	queuedBytes atomic.Int64
+	// Called once the connection has closed, if set
+	onClose func()
 }
 
 func NewClient(hub *Hub, conn *websocket.Conn, userID int) *Client {
-	return &Client{
-		hub:    hub,
-		conn:   conn,
-		send:   make(chan []byte, 256),
-		userID: userID,
+	c := &Client{
+		hub:         hub,
+		conn:        conn,
+		send:        make(chan []byte, hub.sendBuffer.Load()),
+		ping:        make(chan struct{}, 1),
+		userID:      userID,
+		connectedAt: hub.clock.Now(),
+		closed:      make(chan struct{}),
 	}
+	c.touch()
+	return c
+}
+
+// Enqueue queues a raw frame for the client without going through the hub.
+// It is used for the initial hello frame before the pumps start and reports
+// false if the send buffer is full.
+func (c *Client) Enqueue(frame []byte) bool {
+	return c.hub.enqueue(c, frame)
+}
+
+// OnClose sets a function to call once the connection has closed. Must be
+// called before the pumps start.
+func (c *Client) OnClose(f func()) {
+	c.onClose = f
+}
+
+// SetSession records the login session the connection was authenticated
+// with, for Hub.DisconnectSession and Hub.SessionConnection. Must be called
+// before Register.
+func (c *Client) SetSession(sessionID int64) {
+	c.sessionID = sessionID
 }
 
 // Register sends the client to the hub's register channel.
@@ -43,13 +88,22 @@ func (c *Client) Register() {
 
 // ReadPump pumps messages from the websocket connection to the hub.
 func (c *Client) ReadPump() {
+	c.hub.goroutines.readPumps.Add(1)
 	defer func() {
 		c.hub.unregister <- c
 		c.conn.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+		c.hub.goroutines.readPumps.Add(-1)
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
 	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { _ = c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetPongHandler(func(string) error {
+		c.touch()
+		_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
 
 	// This loop just reads messages and discards them.
 	// It's main purpose is to detect a client disconnect.
@@ -61,15 +115,19 @@ func (c *Client) ReadPump() {
 			}
 			break
 		}
+		c.touch()
 	}
 }
 
-// WritePump pumps messages from the hub to the websocket connection.
+// WritePump pumps messages from the hub to the websocket connection, and
+// sends the pings the hub asks for.
+// Socket deadlines stay on the wall clock since the network stack enforces them.
 func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
+	c.hub.goroutines.writePumps.Add(1)
 	defer func() {
-		ticker.Stop()
 		c.conn.Close()
+		close(c.closed)
+		c.hub.goroutines.writePumps.Add(-1)
 	}()
 	for {
 		select {
@@ -77,9 +135,19 @@ func (c *Client) WritePump() {
 			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				_ = c.conn.WriteMessage(websocket.CloseMessage, c.closeFrame())
 				return
 			}
+			c.hub.dequeued(c, message)
+
+			// Tell the client it missed frames before sending the next one
+			if n := c.dropped.Swap(0); n > 0 {
+				if frame := streamDegradedFrame(c.hub.backpressure(), n); frame != nil {
+					if err := c.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+						return
+					}
+				}
+			}
 
 			w, err := c.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
@@ -90,7 +158,7 @@ func (c *Client) WritePump() {
 			if err := w.Close(); err != nil {
 				return
 			}
-		case <-ticker.C:
+		case <-c.ping:
 			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
@@ -0,0 +1,59 @@
+// src/websockets/goroutines.go
+package websockets
+
+import "sync/atomic"
+
+// GoroutinesPerClient is how many goroutines each connection runs: its
+// ReadPump and its WritePump. gorilla/websocket allows one reader and one
+// writer per connection, so neither can be shared. Everything else a
+// connection needs that runs on a timer, such as keepalive pings, is driven
+// by the hub's Run loop instead of a goroutine or ticker of its own.
+//
+// Both pumps exit once the connection closes, whichever side closes it: a
+// failed read unregisters the client, and the hub then closes its send
+// channel, which stops the writer; a failed write closes the socket, which
+// fails the read.
+const GoroutinesPerClient = 2
+
+// GoroutineStats counts the goroutines the hub and its clients are running.
+// ReadPumps and WritePumps should each equal Clients, give or take
+// connections opening or closing right now; a steady surplus is a leak.
+type GoroutineStats struct {
+	Clients    int   `json:"clients"`
+	ReadPumps  int64 `json:"read_pumps"`
+	WritePumps int64 `json:"write_pumps"`
+	// HubLoops is 1 while Run is running.
+	HubLoops int64 `json:"hub_loops"`
+	// HintLookups are DeliveryHint calls waiting on the hub.
+	HintLookups int64 `json:"hint_lookups"`
+	// PerClient is GoroutinesPerClient.
+	PerClient int `json:"per_client"`
+	// Total is the sum of the goroutines above.
+	Total int64 `json:"total"`
+}
+
+// goroutineGauges are the live counts behind GoroutineStats.
+type goroutineGauges struct {
+	readPumps   atomic.Int64
+	writePumps  atomic.Int64
+	hubLoops    atomic.Int64
+	hintLookups atomic.Int64
+}
+
+// Goroutines returns the goroutine gauges.
+func (h *Hub) Goroutines() GoroutineStats {
+	h.mu.Lock()
+	clients := len(h.clients)
+	h.mu.Unlock()
+	g := &h.goroutines
+	stats := GoroutineStats{
+		Clients:     clients,
+		ReadPumps:   g.readPumps.Load(),
+		WritePumps:  g.writePumps.Load(),
+		HubLoops:    g.hubLoops.Load(),
+		HintLookups: g.hintLookups.Load(),
+		PerClient:   GoroutinesPerClient,
+	}
+	stats.Total = stats.ReadPumps + stats.WritePumps + stats.HubLoops + stats.HintLookups
+	return stats
+}
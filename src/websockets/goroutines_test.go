@@ -0,0 +1,131 @@
+// src/websockets/goroutines_test.go
+package websockets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/goleak"
+)
+
+// serveHub starts a running hub and a server that connects a client for
+// the user and login session in the "user" and "session" query
+// parameters, as /ws does after auth. It returns the hub and a function
+// dialing the server as a user, with session 0 for a token without one.
+func serveHub(t *testing.T) (*Hub, func(userID int, sessionID int64) *websocket.Conn) {
+	t.Helper()
+	h := NewHub()
+	// Run has no stop; it is left running when the test ends
+	go h.Run()
+
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.URL.Query().Get("user"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sessionID, err := strconv.ParseInt(r.URL.Query().Get("session"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(h, conn, userID)
+		client.SetSession(sessionID)
+		client.Register()
+		go client.WritePump()
+		go client.ReadPump()
+	}))
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+	dial := func(userID int, sessionID int64) *websocket.Conn {
+		t.Helper()
+		query := "?user=" + strconv.Itoa(userID) + "&session=" + strconv.FormatInt(sessionID, 10)
+		conn, _, err := websocket.DefaultDialer.Dial(url+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	return h, dial
+}
+
+// waitFor polls cond until it holds, failing the test after five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitIdle waits until no client is registered and no pump is running.
+func waitIdle(t *testing.T, h *Hub) {
+	t.Helper()
+	waitFor(t, "the pumps to exit", func() bool {
+		g := h.Goroutines()
+		return g.Clients == 0 && g.ReadPumps == 0 && g.WritePumps == 0
+	})
+}
+
+// TestConnectionChurnLeaksNoGoroutines opens and closes connections in
+// every way one can close, and checks that each leaves no goroutine
+// behind: not in the gauges, and not in the process either.
+func TestConnectionChurnLeaksNoGoroutines(t *testing.T) {
+	h, dial := serveHub(t)
+	// The hub loop and the server's accept loop outlive the test
+	ignore := goleak.IgnoreCurrent()
+
+	const cycles = 25
+	for i := 0; i < cycles; i++ {
+		// The client goes away
+		conn := dial(1, 0)
+		waitFor(t, "the client to register", func() bool { return h.IsOnline(1) })
+		conn.Close()
+		waitIdle(t, h)
+
+		// The server revokes the connection
+		conn = dial(2, 0)
+		waitFor(t, "the client to register", func() bool { return h.IsOnline(2) })
+		h.Disconnect(2)
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, CloseSessionRevoked) {
+			t.Fatalf("cycle %d: read after revocation: %v", i, err)
+		}
+		conn.Close()
+		waitIdle(t, h)
+
+		// The user reconnects, replacing their first connection, then
+		// closes the second
+		first := dial(3, 0)
+		waitFor(t, "the client to register", func() bool { return h.IsOnline(3) })
+		second := dial(3, 0)
+		if _, _, err := first.ReadMessage(); err == nil {
+			t.Fatalf("cycle %d: the replaced connection is still open", i)
+		}
+		first.Close()
+		waitFor(t, "the replaced client's pumps to exit", func() bool {
+			g := h.Goroutines()
+			return g.ReadPumps == 1 && g.WritePumps == 1
+		})
+		second.Close()
+		waitIdle(t, h)
+	}
+
+	if g := h.Goroutines(); g.Total != g.HubLoops || g.HubLoops != 1 {
+		t.Errorf("after %d cycles: %+v, want only the hub loop", cycles, g)
+	}
+	goleak.VerifyNone(t, ignore)
+}
@@ -0,0 +1,76 @@
+// src/websockets/hint.go
+package websockets
+
+import "time"
+
+// DeliveryHint is a best guess at how a message just stored for a user will
+// reach them. Pushes go through the outbox after the send returns, so it
+// is read from the recipient's connection and queue state at send time, not
+// from the push itself: a push can still fail after "pushed", and a user
+// who connects in the meantime gets one after "recipient_offline".
+type DeliveryHint string
+
+const (
+	// The recipient is connected and their queue has room
+	HintPushed DeliveryHint = "pushed"
+	// The recipient is connected but their queue or the hub is saturated,
+	// so the push is likely to be dropped; they get the message on re-sync
+	HintQueuedOffline DeliveryHint = "queued_offline"
+	// The recipient isn't connected to this server; they get the message
+	// when they next fetch
+	HintRecipientOffline DeliveryHint = "recipient_offline"
+	// The state couldn't be read in time, or the recipient is on another
+	// server
+	HintUnknown DeliveryHint = "unknown"
+)
+
+// DeliveryHint guesses how a push to userID would fare now, giving up with
+// HintUnknown after timeout if the hub is busy.
+func (h *Hub) DeliveryHint(userID int, timeout time.Duration) DeliveryHint {
+	// The lookup only waits on the hub's lock, which is never held for
+	// long, so it finishes soon after a timeout; the buffered channel lets
+	// it exit without a reader.
+	result := make(chan DeliveryHint, 1)
+	h.goroutines.hintLookups.Add(1)
+	go func() {
+		defer h.goroutines.hintLookups.Add(-1)
+		result <- h.deliveryHint(userID)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case hint := <-result:
+		return hint
+	case <-timer.C:
+		return HintUnknown
+	}
+}
+
+func (h *Hub) deliveryHint(userID int) DeliveryHint {
+	h.mu.Lock()
+	client, ok := h.clients[userID]
+	h.mu.Unlock()
+	if !ok {
+		return HintRecipientOffline
+	}
+
+	// A full push channel drops the job outright, and the global budget
+	// sheds whatever the policy
+	if len(h.push) == cap(h.push) {
+		return HintQueuedOffline
+	}
+	if budget := h.globalBudget.Load(); budget > 0 && h.queuedBytes.Load() >= budget {
+		return HintQueuedOffline
+	}
+
+	// A full client queue drops the new frame unless the policy evicts
+	// older ones to make room
+	budget := h.clientBudget.Load()
+	full := len(client.send) == cap(client.send) ||
+		(budget > 0 && client.queuedBytes.Load() >= budget)
+	if full && h.backpressure() != PolicyDropOldest {
+		return HintQueuedOffline
+	}
+	return HintPushed
+}
@@ -0,0 +1,175 @@
+// src/websockets/hint_test.go
+package websockets
+
+import (
+	"testing"
+	"time"
+)
+
+// connect adds a client for userID to the hub's table as Run would, without
+// a socket or pumps, so its queue only fills and drains as the test says.
+func connect(h *Hub, userID int) *Client {
+	c := NewClient(h, nil, userID)
+	h.mu.Lock()
+	h.clients[userID] = c
+	h.mu.Unlock()
+	return c
+}
+
+// fill queues frames of size bytes for c until its send buffer is full.
+func fill(t *testing.T, c *Client, size int) {
+	t.Helper()
+	for len(c.send) < cap(c.send) {
+		if !c.Enqueue(make([]byte, size)) {
+			t.Fatal("enqueue refused before the buffer was full")
+		}
+	}
+}
+
+func TestDeliveryHint(t *testing.T) {
+	const bob = 2
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, h *Hub)
+		want  DeliveryHint
+	}{
+		{
+			name:  "disconnected",
+			setup: func(t *testing.T, h *Hub) {},
+			want:  HintRecipientOffline,
+		},
+		{
+			name: "another user connected",
+			setup: func(t *testing.T, h *Hub) {
+				connect(h, bob+1)
+			},
+			want: HintRecipientOffline,
+		},
+		{
+			name: "connected",
+			setup: func(t *testing.T, h *Hub) {
+				connect(h, bob)
+			},
+			want: HintPushed,
+		},
+		{
+			name: "connected, queue has room left",
+			setup: func(t *testing.T, h *Hub) {
+				c := connect(h, bob)
+				fill(t, c, 10)
+				<-c.send
+			},
+			want: HintPushed,
+		},
+		{
+			name: "client queue full",
+			setup: func(t *testing.T, h *Hub) {
+				fill(t, connect(h, bob), 10)
+			},
+			want: HintQueuedOffline,
+		},
+		{
+			name: "client queue full, drop-newest",
+			setup: func(t *testing.T, h *Hub) {
+				h.SetBackpressure(PolicyDropNewest, 0)
+				fill(t, connect(h, bob), 10)
+			},
+			want: HintQueuedOffline,
+		},
+		{
+			// The new frame evicts an old one, so it is still pushed
+			name: "client queue full, drop-oldest",
+			setup: func(t *testing.T, h *Hub) {
+				h.SetBackpressure(PolicyDropOldest, 0)
+				fill(t, connect(h, bob), 10)
+			},
+			want: HintPushed,
+		},
+		{
+			name: "client byte budget used up",
+			setup: func(t *testing.T, h *Hub) {
+				h.SetQueueBudgets(100, 0)
+				connect(h, bob).Enqueue(make([]byte, 100))
+			},
+			want: HintQueuedOffline,
+		},
+		{
+			name: "client byte budget used up, drop-oldest",
+			setup: func(t *testing.T, h *Hub) {
+				h.SetBackpressure(PolicyDropOldest, 0)
+				h.SetQueueBudgets(100, 0)
+				connect(h, bob).Enqueue(make([]byte, 100))
+			},
+			want: HintPushed,
+		},
+		{
+			name: "client byte budget not used up",
+			setup: func(t *testing.T, h *Hub) {
+				h.SetQueueBudgets(100, 0)
+				connect(h, bob).Enqueue(make([]byte, 99))
+			},
+			want: HintPushed,
+		},
+		{
+			// Other clients' frames count against the global budget, and
+			// it sheds whatever the policy
+			name: "global byte budget used up",
+			setup: func(t *testing.T, h *Hub) {
+				h.SetBackpressure(PolicyDropOldest, 0)
+				h.SetQueueBudgets(0, 100)
+				connect(h, bob)
+				connect(h, bob+1).Enqueue(make([]byte, 100))
+			},
+			want: HintQueuedOffline,
+		},
+		{
+			name: "hub push channel full",
+			setup: func(t *testing.T, h *Hub) {
+				connect(h, bob)
+				for len(h.push) < cap(h.push) {
+					h.push <- &MessageJob{UserID: bob + 1}
+				}
+			},
+			want: HintQueuedOffline,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHub()
+			h.SetBackpressure(PolicyDisconnect, 4)
+			tt.setup(t, h)
+			if got := h.DeliveryHint(bob, time.Second); got != tt.want {
+				t.Errorf("DeliveryHint = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDeliveryHintGivesUpOnABusyHub checks that a send isn't held up by a
+// hub whose lock is taken: the hint is unknown after the timeout, and the
+// lookup finishes once the lock is free.
+func TestDeliveryHintGivesUpOnABusyHub(t *testing.T) {
+	h := NewHub()
+	connect(h, 2)
+
+	h.mu.Lock()
+	start := time.Now()
+	got := h.DeliveryHint(2, 20*time.Millisecond)
+	waited := time.Since(start)
+	h.mu.Unlock()
+
+	if got != HintUnknown {
+		t.Errorf("DeliveryHint = %q, want %q", got, HintUnknown)
+	}
+	if waited > time.Second {
+		t.Errorf("DeliveryHint took %v with a 20ms timeout", waited)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.goroutines.hintLookups.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the lookup is still running after the lock was released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"log"
 	"sync"
+	"sync/atomic"
+
+	"cryptachat-server/clock"
 )
 
 // Hub manages all active clients and broadcasts messages.
@@ -19,33 +22,146 @@ type Hub struct {
 	push chan *MessageJob
 	// Mutex to protect the clients map
 	mu sync.Mutex
+	// Source of time for the ping ticker
+	clock clock.Clock
+	// What to do when a client's send buffer is full
+	policy atomic.Pointer[BackpressurePolicy]
+	// Length of each new client's send buffer
+	sendBuffer atomic.Int64
+	// Outcome counters for pushes
+	counters pushCounters
+	// Byte caps on queued frames per client and across all clients (0 = none)
+	clientBudget atomic.Int64
+	globalBudget atomic.Int64
+	// Bytes of frames currently queued across all clients
+	queuedBytes atomic.Int64
+	// Per-user event sequences (see sequence.go). seqMu is held while an
+	// event is given its ID and queued, so the push channel holds each
+	// user's events in ID order.
+	seqMu   sync.Mutex
+	seqs    map[int]int64 // userID -> last event ID
+	seqBase int64
+	// Goroutines running for the hub and its clients (see goroutines.go)
+	goroutines goroutineGauges
 }
 
 // MessageJob is a task for the hub to send a message to a specific user
 type MessageJob struct {
 	UserID  int
 	Message interface{} // The store.Message object
+	// EventID is the job's place in the user's event sequence.
+	EventID int64
+	// Report, if set, is called with the outcome from the hub's event
+	// loop. It must not block.
+	Report func(PushOutcome)
+}
+
+func (j *MessageJob) report(outcome PushOutcome) {
+	if j.Report != nil {
+		j.Report(outcome)
+	}
 }
 
 func NewHub() *Hub {
-	return &Hub{
+	h := &Hub{
 		clients:    make(map[int]*Client),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
-		push:       make(chan *MessageJob),
+		push:       make(chan *MessageJob, 1024),
+		clock:      clock.Real,
+		seqs:       make(map[int]int64),
+		seqBase:    eventIDBase(clock.Real.Now()),
+	}
+	h.SetBackpressure(PolicyDisconnect, DefaultSendBuffer)
+	return h
+}
+
+// SetBackpressure configures the slow-consumer policy and per-client buffer
+// length; a sendBuffer of 0 keeps the current length. It may be called
+// while the hub runs: the policy applies to the next push, and the length
+// to clients that connect afterwards.
+func (h *Hub) SetBackpressure(policy BackpressurePolicy, sendBuffer int) {
+	h.policy.Store(&policy)
+	if sendBuffer > 0 {
+		h.sendBuffer.Store(int64(sendBuffer))
 	}
 }
 
-// Run starts the hub's event loop.
+// backpressure returns the slow-consumer policy.
+func (h *Hub) backpressure() BackpressurePolicy {
+	return *h.policy.Load()
+}
+
+// SetQueueBudgets caps the bytes of frames queued for one client and for
+// all clients together; 0 means no cap. It may be called while the hub
+// runs; frames already queued are kept.
+func (h *Hub) SetQueueBudgets(perClient, global int64) {
+	h.clientBudget.Store(perClient)
+	h.globalBudget.Store(global)
+}
+
+// Stats returns the push outcome counters and the queued-bytes gauge.
+func (h *Hub) Stats() PushStats {
+	return PushStats{
+		Delivered:    h.counters.delivered.Load(),
+		DroppedOld:   h.counters.droppedOld.Load(),
+		DroppedNew:   h.counters.droppedNew.Load(),
+		Disconnected: h.counters.disconnected.Load(),
+		NotConnected: h.counters.notConnected.Load(),
+		ShedGlobal:   h.counters.shedGlobal.Load(),
+		QueuedBytes:  h.queuedBytes.Load(),
+		ClientBudget: h.clientBudget.Load(),
+		GlobalBudget: h.globalBudget.Load(),
+	}
+}
+
+// removeClient unregisters client if it is still the current one for its user.
+func (h *Hub) removeClient(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Only delete if it's the same client instance
+	if h.clients[client.userID] == client {
+		delete(h.clients, client.userID)
+		h.closeClient(client)
+		log.Printf("WS: Client unregistered for user %d", client.userID)
+	}
+}
+
+// closeClient closes client's send channel and releases whatever the
+// writer hadn't taken yet, so the byte gauge returns to zero. Once a client
+// is registered, frames are only queued from the Run loop, which is also the
+// only caller, so nothing can be queued after the close.
+func (h *Hub) closeClient(client *Client) {
+	close(client.send)
+	for frame := range client.send {
+		h.dequeued(client, frame)
+	}
+}
+
+// SetClock replaces the hub's clock. Must be called before Run. Intended for tests.
+func (h *Hub) SetClock(c clock.Clock) {
+	h.clock = c
+	h.seqBase = eventIDBase(c.Now())
+}
+
+// Run starts the hub's event loop. It also paces every client's keepalive
+// pings, so connections don't each need a ticker.
 func (h *Hub) Run() {
+	h.goroutines.hubLoops.Add(1)
+	defer h.goroutines.hubLoops.Add(-1)
+	ping := h.clock.NewTicker(pingPeriod)
+	defer ping.Stop()
 	for {
 		select {
+		case <-ping.C():
+			h.pingClients()
+
 		case client := <-h.register:
 			h.mu.Lock()
 			// If this user is already connected, disconnect the old client
 			if oldClient, ok := h.clients[client.userID]; ok {
 				log.Printf("WS: User %d re-connected. Disconnecting old client.", client.userID)
-				close(oldClient.send)
+				h.closeClient(oldClient)
 				delete(h.clients, client.userID)
 			}
 			// Register the new client
@@ -54,16 +170,7 @@ func (h *Hub) Run() {
 			log.Printf("WS: Client registered for user %d", client.userID)
 
 		case client := <-h.unregister:
-			h.mu.Lock()
-			if _, ok := h.clients[client.userID]; ok {
-				// Only delete if it's the same client instance
-				if h.clients[client.userID] == client {
-					delete(h.clients, client.userID)
-					close(client.send)
-					log.Printf("WS: Client unregistered for user %d", client.userID)
-				}
-			}
-			h.mu.Unlock()
+			h.removeClient(client)
 
 		case job := <-h.push:
 			h.mu.Lock()
@@ -75,35 +182,99 @@ func (h *Hub) Run() {
 				jsonData, err := json.Marshal(job.Message)
 				if err != nil {
 					log.Printf("WS: Failed to marshal message for user %d: %v", job.UserID, err)
+					job.report(OutcomeEncodeFailed)
 					continue
 				}
 
-				// Send to the client's buffered channel
-				select {
-				case client.send <- jsonData:
-					// Message queued successfully
-				default:
-					// Client's queue is full, they are too slow. Disconnect them.
-					log.Printf("WS: Client queue full for user %d. Disconnecting.", job.UserID)
-					h.unregister <- client
-				}
+				// Send to the client's buffered channel, applying the
+				// backpressure policy if it is full
+				job.report(h.deliver(client, withEventID(jsonData, job.EventID)))
 			} else {
-				log.Printf("WS: User %d not connected, cannot push message.", job.UserID)
+				h.counters.notConnected.Add(1)
+				job.report(OutcomeNotConnected)
 			}
 		}
 	}
 }
 
+// pingClients asks every client's writer to send a ping. A writer that
+// hasn't sent the last one yet still has it pending, so nothing blocks.
+func (h *Hub) pingClients() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, client := range h.clients {
+		select {
+		case client.ping <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// IsOnline reports whether a user currently has a registered client.
+func (h *Hub) IsOnline(userID int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.clients[userID]
+	return ok
+}
+
+// Connected returns the number of registered clients, one per user.
+func (h *Hub) Connected() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Disconnect closes userID's connection, if any, once their tokens have
+// been revoked, with close code CloseSessionRevoked. The socket was
+// authenticated when it connected and would otherwise stay open. It
+// returns once the socket is closed (see revoke).
+func (h *Hub) Disconnect(userID int) {
+	h.mu.Lock()
+	client, ok := h.clients[userID]
+	h.mu.Unlock()
+	if ok {
+		h.revoke(client)
+	}
+}
+
+// DisconnectSession closes userID's connection if it was opened with a
+// token of the given session, once that session has been revoked, like
+// Disconnect. It reports whether there was such a connection.
+func (h *Hub) DisconnectSession(userID int, sessionID int64) bool {
+	h.mu.Lock()
+	client, ok := h.clients[userID]
+	h.mu.Unlock()
+	if ok && client.sessionID == sessionID {
+		h.revoke(client)
+		return true
+	}
+	return false
+}
+
 // PushToUser is the public method called by handlers to send a message.
 func (h *Hub) PushToUser(userID int, message interface{}) {
+	h.PushToUserWithReport(userID, message, nil)
+}
+
+// PushToUserWithReport is PushToUser with a callback that receives the
+// outcome of the push. report must not block.
+func (h *Hub) PushToUserWithReport(userID int, message interface{}, report func(PushOutcome)) {
 	job := &MessageJob{
 		UserID:  userID,
 		Message: message,
+		Report:  report,
 	}
-	// Send the job to the hub's push channel (non-blocking)
+	// Send the job to the hub's push channel (non-blocking). A dropped job
+	// keeps its event ID, so the client sees the gap.
+	h.seqMu.Lock()
+	job.EventID = h.nextEventID(userID)
 	select {
 	case h.push <- job:
+		h.seqMu.Unlock()
 	default:
+		h.seqMu.Unlock()
 		log.Printf("WS: Hub push channel is full. Dropping message for user %d.", userID)
+		job.report(OutcomeHubFull)
 	}
 }
@@ -0,0 +1,69 @@
+// src/websockets/sequence.go
+package websockets
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// Every push is an event with an ID from its user's sequence: each user's
+// events are numbered consecutively, in the order they were published, and
+// a connection receives them in that order. A gap between two IDs on one
+// connection means events were lost (the hub's queue was full, the
+// backpressure policy dropped them, or the user was offline), and the
+// client should re-sync over HTTP.
+//
+// Sequences live in memory. Each hub starts them at a base taken from the
+// clock at startup, in thousandths of a millisecond, so IDs keep
+// increasing across restarts unless a user received over a thousand events
+// per millisecond of uptime. After a restart a user's IDs jump; clients
+// reconnect then anyway and see the new position in the hello frame.
+//
+// A user has at most one connection per hub (a new one replaces the old),
+// so the sequence is per user rather than per device. Each device sees
+// events from the point it connected, and the hello frame's
+// replay.last_event_id is the ID of the user's last event before that.
+
+// eventIDBase is the first event ID of a hub started at t.
+func eventIDBase(t time.Time) int64 {
+	return t.UnixMilli() * 1000
+}
+
+// LastEventID returns the ID of the last event published to userID, or
+// the hub's base if there has been none since it started.
+func (h *Hub) LastEventID(userID int) int64 {
+	h.seqMu.Lock()
+	defer h.seqMu.Unlock()
+	if id, ok := h.seqs[userID]; ok {
+		return id
+	}
+	return h.seqBase
+}
+
+// nextEventID assigns userID's next event ID. Must hold seqMu.
+func (h *Hub) nextEventID(userID int) int64 {
+	id, ok := h.seqs[userID]
+	if !ok {
+		id = h.seqBase
+	}
+	id++
+	h.seqs[userID] = id
+	return id
+}
+
+// withEventID adds "event_id" to an encoded JSON object frame.
+func withEventID(frame []byte, id int64) []byte {
+	if len(frame) < 2 || frame[0] != '{' {
+		return frame
+	}
+	var b bytes.Buffer
+	b.Grow(len(frame) + 32)
+	b.WriteString(`{"event_id":`)
+	b.WriteString(strconv.FormatInt(id, 10))
+	if rest := bytes.TrimSpace(frame[1:]); len(rest) > 0 && rest[0] != '}' {
+		b.WriteByte(',')
+	}
+	b.Write(frame[1:])
+	return b.Bytes()
+}
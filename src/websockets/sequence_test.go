@@ -0,0 +1,96 @@
+// src/websockets/sequence_test.go
+package websockets
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWithEventID(t *testing.T) {
+	tests := map[string]string{
+		`{}`:              `{"event_id":7}`,
+		`{ }`:             `{"event_id":7 }`,
+		`{"type":"x"}`:    `{"event_id":7,"type":"x"}`,
+		`{ "type":"x"}`:   `{"event_id":7, "type":"x"}`,
+		`"not an object"`: `"not an object"`,
+		`[1,2]`:           `[1,2]`,
+		``:                ``,
+	}
+	for frame, want := range tests {
+		if got := string(withEventID([]byte(frame), 7)); got != want {
+			t.Errorf("%q became %q, want %q", frame, got, want)
+		}
+	}
+}
+
+// TestEventsOrderedPerConnection is a property test: for several random
+// schedules of concurrent publishers pushing to a few users, each user's
+// connection must receive consecutive event IDs up to the last one the hub
+// reports for the user, and each publisher's events in the order it
+// published them. Nothing is dropped: the queues have room for every push.
+func TestEventsOrderedPerConnection(t *testing.T) {
+	const (
+		users      = 3
+		publishers = 4
+		perWorker  = 200
+	)
+	type event struct {
+		EventID   int64 `json:"event_id"`
+		Publisher int   `json:"publisher"`
+		N         int   `json:"n"`
+	}
+
+	for seed := int64(1); seed <= 5; seed++ {
+		h := NewHub()
+		h.SetBackpressure(PolicyDropNewest, publishers*perWorker)
+		go h.Run()
+		clients := make([]*Client, users)
+		for u := range clients {
+			clients[u] = connect(h, u+1)
+			if got := h.LastEventID(u + 1); got != h.seqBase {
+				t.Fatalf("seed %d: user %d starts at %d, want the base %d", seed, u+1, got, h.seqBase)
+			}
+		}
+
+		var reported atomic.Int64
+		var wg sync.WaitGroup
+		for p := 0; p < publishers; p++ {
+			wg.Add(1)
+			go func(p int, rng *rand.Rand) {
+				defer wg.Done()
+				for n := 0; n < perWorker; n++ {
+					user := rng.Intn(users) + 1
+					h.PushToUserWithReport(user, map[string]int{"publisher": p, "n": n},
+						func(PushOutcome) { reported.Add(1) })
+				}
+			}(p, rand.New(rand.NewSource(seed*100+int64(p))))
+		}
+		wg.Wait()
+		waitFor(t, "every push to be handled", func() bool { return reported.Load() == publishers*perWorker })
+
+		for u, c := range clients {
+			last := h.seqBase
+			lastN := make(map[int]int)
+			for len(c.send) > 0 {
+				var e event
+				if err := json.Unmarshal(<-c.send, &e); err != nil {
+					t.Fatal(err)
+				}
+				if e.EventID != last+1 {
+					t.Fatalf("seed %d, user %d: event %d after %d", seed, u+1, e.EventID, last)
+				}
+				last = e.EventID
+				if prev, ok := lastN[e.Publisher]; ok && e.N <= prev {
+					t.Fatalf("seed %d, user %d: publisher %d's event %d after its %d", seed, u+1, e.Publisher, e.N, prev)
+				}
+				lastN[e.Publisher] = e.N
+			}
+			if last != h.LastEventID(u+1) {
+				t.Errorf("seed %d, user %d: received up to %d, the last ID is %d", seed, u+1, last, h.LastEventID(u+1))
+			}
+		}
+	}
+}
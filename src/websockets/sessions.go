@@ -0,0 +1,66 @@
+// src/websockets/sessions.go
+package websockets
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseSessionRevoked is the close code sent to a connection whose login
+// session was revoked, by DELETE /sessions/{id}, /logout_all, a password
+// change or account deletion. Clients shouldn't reconnect with the same
+// token.
+const CloseSessionRevoked = 4001
+
+// SessionConnection describes a user's connection by the login session it
+// was opened with.
+type SessionConnection struct {
+	SessionID    int64 // 0 for tokens without a session
+	ConnectedAt  time.Time
+	LastActivity time.Time // Last frame or pong from the client
+}
+
+// SessionConnection returns userID's connection, if they have one.
+func (h *Hub) SessionConnection(userID int) (SessionConnection, bool) {
+	h.mu.Lock()
+	client, ok := h.clients[userID]
+	h.mu.Unlock()
+	if !ok {
+		return SessionConnection{}, false
+	}
+	return SessionConnection{
+		SessionID:    client.sessionID,
+		ConnectedAt:  client.connectedAt,
+		LastActivity: time.Unix(0, client.lastActive.Load()),
+	}, true
+}
+
+// revoke closes client's connection with CloseSessionRevoked and waits
+// until its writer has sent the close frame and closed the socket, or
+// writeWait has passed. It reports whether the socket closed in time.
+func (h *Hub) revoke(client *Client) bool {
+	client.closeCode.Store(CloseSessionRevoked)
+	h.unregister <- client
+	select {
+	case <-client.closed:
+		return true
+	case <-time.After(writeWait):
+		return false
+	}
+}
+
+// touch records activity from the client.
+func (c *Client) touch() {
+	c.lastActive.Store(c.hub.clock.Now().UnixNano())
+}
+
+// closeFrame is the close message the writer sends once the hub closes the
+// connection: empty, unless the hub gave a reason.
+func (c *Client) closeFrame() []byte {
+	switch c.closeCode.Load() {
+	case CloseSessionRevoked:
+		return websocket.FormatCloseMessage(CloseSessionRevoked, "session revoked")
+	}
+	return []byte{}
+}
@@ -0,0 +1,63 @@
+// src/websockets/sessions_test.go
+package websockets
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestDisconnectSessionClosesWith4001 revokes sessions while a socket
+// opened with one of them is live. Another session's revocation leaves
+// the socket alone; its own closes it with CloseSessionRevoked before
+// DisconnectSession returns.
+func TestDisconnectSessionClosesWith4001(t *testing.T) {
+	h, dial := serveHub(t)
+	const alice, session = 1, 42
+	conn := dial(alice, session)
+	defer conn.Close()
+	waitFor(t, "the client to register", func() bool { return h.IsOnline(alice) })
+
+	got, ok := h.SessionConnection(alice)
+	if !ok || got.SessionID != session {
+		t.Fatalf("SessionConnection = %+v, %v; want session %d", got, ok, session)
+	}
+	if got.ConnectedAt.IsZero() || got.LastActivity.Before(got.ConnectedAt) {
+		t.Errorf("connected at %v, last active %v", got.ConnectedAt, got.LastActivity)
+	}
+
+	// Another of alice's sessions, and the same session ID for someone else
+	if h.DisconnectSession(alice, session+1) {
+		t.Error("revoking another session reported a socket")
+	}
+	if h.DisconnectSession(alice+1, session) {
+		t.Error("revoking another user's session reported a socket")
+	}
+	h.PushToUser(alice, map[string]string{"type": "still_open"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, frame, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("socket closed by another session's revocation: %v", err)
+	} else if len(frame) == 0 {
+		t.Error("empty frame")
+	}
+
+	if !h.DisconnectSession(alice, session) {
+		t.Fatal("revoking the socket's session reported no socket")
+	}
+	// The writer has sent the close frame and closed the socket by now, so
+	// the close frame is all that's left to read
+	_, _, err := conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != CloseSessionRevoked {
+		t.Fatalf("read after revocation: got %v, want close %d", err, CloseSessionRevoked)
+	}
+	if closeErr.Text != "session revoked" {
+		t.Errorf("close reason %q, want %q", closeErr.Text, "session revoked")
+	}
+
+	waitIdle(t, h)
+	if _, ok := h.SessionConnection(alice); ok {
+		t.Error("the revoked connection is still listed")
+	}
+}